@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// ActiveHoursConfig limits a metric to the hours it is meaningful in, such as overnight for
+// batch jobs or trading hours for business KPIs
+type ActiveHoursConfig struct {
+	Windows   []SuppressionWindow `yaml:"windows"`    // the metric is active in any of the windows
+	AlertOnly bool                `yaml:"alert_only"` // keeps detecting outside the windows, for dashboards and exports, and only holds back notifications
+}
+
+// activeHours is an ActiveHoursConfig with its windows parsed
+type activeHours struct {
+	windows   []*dailyWindow
+	alertOnly bool
+}
+
+// compileActiveHours parses the active hours of the metrics that have them, by metric type
+func compileActiveHours(metrics []MetricConfig) (map[string]*activeHours, error) {
+	compiled := make(map[string]*activeHours)
+	for _, metric := range metrics {
+		if metric.ActiveHours == nil {
+			continue
+		}
+		if len(metric.ActiveHours.Windows) == 0 {
+			return nil, fmt.Errorf("metric %s: active_hours: no windows configured", metric.Type)
+		}
+		hours := &activeHours{alertOnly: metric.ActiveHours.AlertOnly}
+		for i, window := range metric.ActiveHours.Windows {
+			parsed, err := parseDailyWindow(window)
+			if err != nil {
+				return nil, fmt.Errorf("metric %s: active_hours: window %d: %v", metric.Type, i+1, err)
+			}
+			hours.windows = append(hours.windows, parsed)
+		}
+		compiled[metric.Type] = hours
+	}
+	return compiled, nil
+}
+
+// contains reports whether t falls in any of the windows
+func (a *activeHours) contains(t time.Time) bool {
+	for _, window := range a.windows {
+		if window.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// inactive reports whether the metric has active hours that t is outside of
+func inactive(hours map[string]*activeHours, metricType string, t time.Time) bool {
+	a, ok := hours[metricType]
+	return ok && !a.contains(t)
+}
+
+// activeMetrics leaves out the metrics outside their active hours at now, except those only
+// holding back alerts, which are still detected
+func activeMetrics(hours map[string]*activeHours, metrics []string, now time.Time) []string {
+	var active, skipped []string
+	for _, metric := range metrics {
+		if a, ok := hours[metric]; ok && !a.alertOnly && !a.contains(now) {
+			skipped = append(skipped, metric)
+			continue
+		}
+		active = append(active, metric)
+	}
+	if len(skipped) > 0 {
+		log.Printf("Skipping metrics outside their active hours: %s\n", strings.Join(skipped, ", "))
+	}
+	return active
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"net"
+	"sort"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/krzko/gcp-anomaly-detector/adminpb"
+)
+
+// adminServer implements the gRPC AdminService over the state of a scanServer. Every call holds
+// the scan lock, so it sees the detector between detection cycles.
+type adminServer struct {
+	adminpb.UnimplementedAdminServiceServer
+	scan *scanServer
+}
+
+// serveAdmin serves the AdminService on address until the listener fails
+func serveAdmin(address string, scan *scanServer) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", address, err)
+	}
+	options, err := scan.config.Server.grpcOptions()
+	if err != nil {
+		log.Fatalf("Failed to secure the gRPC admin service: %v", err)
+	}
+	server := grpc.NewServer(options...)
+	adminpb.RegisterAdminServiceServer(server, &adminServer{scan: scan})
+
+	log.Printf("gRPC admin service listening on %s...\n", address)
+	if err := server.Serve(listener); err != nil {
+		log.Fatalf("gRPC server failed: %v", err)
+	}
+}
+
+func (s *adminServer) GetBaselines(ctx context.Context, req *adminpb.GetBaselinesRequest) (*adminpb.GetBaselinesResponse, error) {
+	s.scan.mu.Lock()
+	defer s.scan.mu.Unlock()
+
+	detector := s.scan.detector
+	detector.mu.RLock()
+	defer detector.mu.RUnlock()
+	if req.MetricType != "" {
+		if _, ok := detector.metricsStats[req.MetricType]; !ok {
+			return nil, status.Errorf(codes.NotFound, "no baseline for metric %s", req.MetricType)
+		}
+	}
+
+	response := &adminpb.GetBaselinesResponse{}
+	for metricType, stats := range detector.metricsStats {
+		if req.MetricType == "" || req.MetricType == metricType {
+			response.Metrics = append(response.Metrics, baselineProto(metricType, stats))
+		}
+	}
+	sort.Slice(response.Metrics, func(i, j int) bool { return response.Metrics[i].MetricType < response.Metrics[j].MetricType })
+
+	for fingerprint, stats := range detector.seriesStats {
+		metricType := detector.seriesTypes[fingerprint]
+		if req.MetricType != "" && req.MetricType != metricType {
+			continue
+		}
+		response.Series = append(response.Series, &adminpb.SeriesBaseline{
+			MetricType:  metricType,
+			Fingerprint: fingerprint,
+			Mean:        stats.mean,
+			Stddev:      stats.stddev,
+			Count:       stats.count,
+		})
+	}
+	sort.Slice(response.Series, func(i, j int) bool {
+		a, b := response.Series[i], response.Series[j]
+		if a.MetricType != b.MetricType {
+			return a.MetricType < b.MetricType
+		}
+		return a.Fingerprint < b.Fingerprint
+	})
+	return response, nil
+}
+
+func (s *adminServer) GetScores(ctx context.Context, req *adminpb.GetScoresRequest) (*adminpb.GetScoresResponse, error) {
+	s.scan.mu.Lock()
+	defer s.scan.mu.Unlock()
+
+	detector := s.scan.detector
+	response := &adminpb.GetScoresResponse{}
+	for metricType, score := range detector.Scores() {
+		response.Metrics = append(response.Metrics, &adminpb.MetricScore{
+			MetricType: metricType,
+			Latest:     score.Latest,
+			LatestTime: timestamppb.New(score.LatestTime),
+			Peak:       score.Peak,
+			Points:     int32(score.Points),
+		})
+	}
+	sort.Slice(response.Metrics, func(i, j int) bool { return response.Metrics[i].MetricType < response.Metrics[j].MetricType })
+
+	for _, score := range detector.TopSeries(math.MaxInt) {
+		response.Series = append(response.Series, &adminpb.SeriesScore{
+			MetricType:  score.MetricName,
+			Fingerprint: score.Fingerprint,
+			Labels:      score.Labels,
+			ZScore:      score.ZScore,
+			Time:        timestamppb.New(score.Timestamp),
+		})
+	}
+	return response, nil
+}
+
+// ListOpenAnomalies returns the events the detector still considers open, as last reported.
+// An open event no longer among the recently reported anomalies is returned with its series
+// and start only.
+func (s *adminServer) ListOpenAnomalies(ctx context.Context, req *adminpb.ListOpenAnomaliesRequest) (*adminpb.ListOpenAnomaliesResponse, error) {
+	s.scan.mu.Lock()
+	defer s.scan.mu.Unlock()
+
+	detector := s.scan.detector
+	detector.mu.RLock()
+	defer detector.mu.RUnlock()
+	response := &adminpb.ListOpenAnomaliesResponse{}
+	for fingerprint, start := range detector.openEvents {
+		id := anomalyID(fingerprint, start)
+		anomaly, ok := s.scan.router.recentAnomaly(id)
+		if !ok {
+			anomaly = Anomaly{Kind: KindAnomaly, ID: id, Fingerprint: fingerprint, Timestamp: start}
+		}
+		response.Anomalies = append(response.Anomalies, anomalyProto(anomaly))
+	}
+	sort.Slice(response.Anomalies, func(i, j int) bool {
+		return response.Anomalies[i].StartTime.AsTime().Before(response.Anomalies[j].StartTime.AsTime())
+	})
+	return response, nil
+}
+
+// Rebaseline fetches the historical window of a metric again and replaces its baseline.
+// Detection cycles wait for it to complete.
+func (s *adminServer) Rebaseline(ctx context.Context, req *adminpb.RebaselineRequest) (*adminpb.RebaselineResponse, error) {
+	if req.MetricType == "" {
+		return nil, status.Error(codes.InvalidArgument, "metric_type is required")
+	}
+	if _, err := scopeMetrics(s.scan.config, []string{req.MetricType}); err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+
+	s.scan.mu.Lock()
+	defer s.scan.mu.Unlock()
+
+	log.Printf("Rebaseline requested for metric %s\n", req.MetricType)
+	stats, series, err := s.scan.detector.Rebaseline(req.MetricType, func(add func(*monitoringpb.TimeSeries)) error {
+		return streamHistoricalMetrics(s.scan.client, s.scan.config, []string{req.MetricType}, add)
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Unavailable, "could not rebaseline metric %s: %s", req.MetricType, redact(err.Error()))
+	}
+	return &adminpb.RebaselineResponse{Baseline: baselineProto(req.MetricType, stats), Series: int32(series)}, nil
+}
+
+func baselineProto(metricType string, stats MetricStats) *adminpb.Baseline {
+	return &adminpb.Baseline{MetricType: metricType, Mean: stats.mean, Stddev: stats.stddev, Count: stats.count}
+}
+
+func anomalyProto(anomaly Anomaly) *adminpb.Anomaly {
+	message := &adminpb.Anomaly{
+		Id:          anomaly.ID,
+		Kind:        anomaly.Kind,
+		Type:        anomaly.Type,
+		MetricType:  anomaly.MetricName,
+		DisplayName: anomaly.DisplayName,
+		Fingerprint: anomaly.Fingerprint,
+		Labels:      anomaly.Labels,
+		Value:       anomaly.Value,
+		Unit:        anomaly.Unit,
+		ZScore:      anomaly.ZScore,
+		Severity:    anomaly.Severity,
+		Message:     anomaly.Message,
+		StartTime:   timestamppb.New(anomaly.Timestamp),
+		Points:      int32(anomaly.Points),
+	}
+	if !anomaly.EndTime.IsZero() {
+		message.EndTime = timestamppb.New(anomaly.EndTime)
+	}
+	return message
+}
@@ -0,0 +1,228 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             v4.24.4
+// source: adminpb/admin.proto
+
+package adminpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	AdminService_GetBaselines_FullMethodName      = "/gcpanomalydetector.admin.v1.AdminService/GetBaselines"
+	AdminService_GetScores_FullMethodName         = "/gcpanomalydetector.admin.v1.AdminService/GetScores"
+	AdminService_ListOpenAnomalies_FullMethodName = "/gcpanomalydetector.admin.v1.AdminService/ListOpenAnomalies"
+	AdminService_Rebaseline_FullMethodName        = "/gcpanomalydetector.admin.v1.AdminService/Rebaseline"
+)
+
+// AdminServiceClient is the client API for AdminService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AdminServiceClient interface {
+	// GetBaselines returns the baseline statistics of the metrics and their series
+	GetBaselines(ctx context.Context, in *GetBaselinesRequest, opts ...grpc.CallOption) (*GetBaselinesResponse, error)
+	// GetScores returns the Z-scores of the last detection cycle
+	GetScores(ctx context.Context, in *GetScoresRequest, opts ...grpc.CallOption) (*GetScoresResponse, error)
+	// ListOpenAnomalies returns the anomaly events that are still going on
+	ListOpenAnomalies(ctx context.Context, in *ListOpenAnomaliesRequest, opts ...grpc.CallOption) (*ListOpenAnomaliesResponse, error)
+	// Rebaseline recomputes the baseline of a metric from the historical window
+	Rebaseline(ctx context.Context, in *RebaselineRequest, opts ...grpc.CallOption) (*RebaselineResponse, error)
+}
+
+type adminServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminServiceClient(cc grpc.ClientConnInterface) AdminServiceClient {
+	return &adminServiceClient{cc}
+}
+
+func (c *adminServiceClient) GetBaselines(ctx context.Context, in *GetBaselinesRequest, opts ...grpc.CallOption) (*GetBaselinesResponse, error) {
+	out := new(GetBaselinesResponse)
+	err := c.cc.Invoke(ctx, AdminService_GetBaselines_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) GetScores(ctx context.Context, in *GetScoresRequest, opts ...grpc.CallOption) (*GetScoresResponse, error) {
+	out := new(GetScoresResponse)
+	err := c.cc.Invoke(ctx, AdminService_GetScores_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) ListOpenAnomalies(ctx context.Context, in *ListOpenAnomaliesRequest, opts ...grpc.CallOption) (*ListOpenAnomaliesResponse, error) {
+	out := new(ListOpenAnomaliesResponse)
+	err := c.cc.Invoke(ctx, AdminService_ListOpenAnomalies_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminServiceClient) Rebaseline(ctx context.Context, in *RebaselineRequest, opts ...grpc.CallOption) (*RebaselineResponse, error) {
+	out := new(RebaselineResponse)
+	err := c.cc.Invoke(ctx, AdminService_Rebaseline_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServiceServer is the server API for AdminService service.
+// All implementations must embed UnimplementedAdminServiceServer
+// for forward compatibility
+type AdminServiceServer interface {
+	// GetBaselines returns the baseline statistics of the metrics and their series
+	GetBaselines(context.Context, *GetBaselinesRequest) (*GetBaselinesResponse, error)
+	// GetScores returns the Z-scores of the last detection cycle
+	GetScores(context.Context, *GetScoresRequest) (*GetScoresResponse, error)
+	// ListOpenAnomalies returns the anomaly events that are still going on
+	ListOpenAnomalies(context.Context, *ListOpenAnomaliesRequest) (*ListOpenAnomaliesResponse, error)
+	// Rebaseline recomputes the baseline of a metric from the historical window
+	Rebaseline(context.Context, *RebaselineRequest) (*RebaselineResponse, error)
+	mustEmbedUnimplementedAdminServiceServer()
+}
+
+// UnimplementedAdminServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedAdminServiceServer struct {
+}
+
+func (UnimplementedAdminServiceServer) GetBaselines(context.Context, *GetBaselinesRequest) (*GetBaselinesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBaselines not implemented")
+}
+func (UnimplementedAdminServiceServer) GetScores(context.Context, *GetScoresRequest) (*GetScoresResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetScores not implemented")
+}
+func (UnimplementedAdminServiceServer) ListOpenAnomalies(context.Context, *ListOpenAnomaliesRequest) (*ListOpenAnomaliesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListOpenAnomalies not implemented")
+}
+func (UnimplementedAdminServiceServer) Rebaseline(context.Context, *RebaselineRequest) (*RebaselineResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Rebaseline not implemented")
+}
+func (UnimplementedAdminServiceServer) mustEmbedUnimplementedAdminServiceServer() {}
+
+// UnsafeAdminServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServiceServer will
+// result in compilation errors.
+type UnsafeAdminServiceServer interface {
+	mustEmbedUnimplementedAdminServiceServer()
+}
+
+func RegisterAdminServiceServer(s grpc.ServiceRegistrar, srv AdminServiceServer) {
+	s.RegisterService(&AdminService_ServiceDesc, srv)
+}
+
+func _AdminService_GetBaselines_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBaselinesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).GetBaselines(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_GetBaselines_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).GetBaselines(ctx, req.(*GetBaselinesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_GetScores_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetScoresRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).GetScores(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_GetScores_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).GetScores(ctx, req.(*GetScoresRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_ListOpenAnomalies_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListOpenAnomaliesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).ListOpenAnomalies(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_ListOpenAnomalies_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).ListOpenAnomalies(ctx, req.(*ListOpenAnomaliesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _AdminService_Rebaseline_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RebaselineRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServiceServer).Rebaseline(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: AdminService_Rebaseline_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServiceServer).Rebaseline(ctx, req.(*RebaselineRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// AdminService_ServiceDesc is the grpc.ServiceDesc for AdminService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var AdminService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gcpanomalydetector.admin.v1.AdminService",
+	HandlerType: (*AdminServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetBaselines",
+			Handler:    _AdminService_GetBaselines_Handler,
+		},
+		{
+			MethodName: "GetScores",
+			Handler:    _AdminService_GetScores_Handler,
+		},
+		{
+			MethodName: "ListOpenAnomalies",
+			Handler:    _AdminService_ListOpenAnomalies_Handler,
+		},
+		{
+			MethodName: "Rebaseline",
+			Handler:    _AdminService_Rebaseline_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "adminpb/admin.proto",
+}
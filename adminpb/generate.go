@@ -0,0 +1,4 @@
+// Package adminpb holds the protobuf definitions of the detector's gRPC admin service
+package adminpb
+
+//go:generate protoc -I.. --go_out=.. --go_opt=paths=source_relative --go-grpc_out=.. --go-grpc_opt=paths=source_relative adminpb/admin.proto
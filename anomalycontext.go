@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// AnomalyContextConfig attaches the newest values of the series of every anomaly and their
+// sparkline to its notifications, so responders see the shape of the problem right away
+type AnomalyContextConfig struct {
+	Points int `yaml:"points"` // newest values of the series attached, defaults to 20
+}
+
+// defaultContextPoints is the number of values attached to an anomaly by default
+const defaultContextPoints = 20
+
+// AnomalyContext is the shape of the series of an anomaly around it
+type AnomalyContext struct {
+	Start     time.Time `json:"start" yaml:"start"`         // time of the oldest value
+	End       time.Time `json:"end" yaml:"end"`             // time of the newest value
+	Values    []float64 `json:"values" yaml:"values"`       // oldest first
+	Sparkline string    `json:"sparkline" yaml:"sparkline"` // the values as a line of block characters
+}
+
+// sparkBlocks are the characters of a sparkline, lowest to highest
+var sparkBlocks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline draws the values as a line of block characters scaled between their minimum and
+// maximum, the middle block for values that are all the same
+func sparkline(values []float64) string {
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, value := range values {
+		low, high = math.Min(low, value), math.Max(high, value)
+	}
+	var b strings.Builder
+	for _, value := range values {
+		level := len(sparkBlocks) / 2
+		if high > low {
+			level = int((value - low) / (high - low) * float64(len(sparkBlocks)-1))
+		}
+		b.WriteRune(sparkBlocks[level])
+	}
+	return b.String()
+}
+
+// attachContext attaches to every anomaly detected on a single series the newest values of that
+// series in the recent window, which span the anomaly, with anomaly_context. Canary and peer
+// anomalies compare groups of series, whose fingerprints match no fetched series, and get none.
+func (c *Config) attachContext(anomalies []Anomaly, recent []*monitoringpb.TimeSeries) {
+	if c.AnomalyContext == nil || len(anomalies) == 0 {
+		return
+	}
+	count := c.AnomalyContext.Points
+	if count == 0 {
+		count = defaultContextPoints
+	}
+	// A series split across response pages comes as several series with the same fingerprint
+	points := make(map[string][]*monitoringpb.Point)
+	for _, ts := range recent {
+		fingerprint := seriesFingerprint(ts)
+		points[fingerprint] = append(points[fingerprint], ts.Points...)
+	}
+	for i := range anomalies {
+		series := points[anomalies[i].SeriesFingerprint]
+		if len(series) == 0 {
+			continue
+		}
+		anomalies[i].Context = newAnomalyContext(series, count)
+	}
+}
+
+// newAnomalyContext returns the context of the newest count of the points
+func newAnomalyContext(points []*monitoringpb.Point, count int) *AnomalyContext {
+	sorted := append([]*monitoringpb.Point(nil), points...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Interval.EndTime.AsTime().Before(sorted[j].Interval.EndTime.AsTime())
+	})
+	if len(sorted) > count {
+		sorted = sorted[len(sorted)-count:]
+	}
+	context := &AnomalyContext{
+		Start:  sorted[0].Interval.EndTime.AsTime(),
+		End:    sorted[len(sorted)-1].Interval.EndTime.AsTime(),
+		Values: make([]float64, len(sorted)),
+	}
+	for i, point := range sorted {
+		context.Values[i] = pointValue(point)
+	}
+	context.Sparkline = sparkline(context.Values)
+	return context
+}
+
+// contextSummary describes the context of the anomaly for text notifications, such as
+// " [last 20 values ▁▁▂▁█▇ from 40.0 to 90.0]", or nothing without one
+func (a Anomaly) contextSummary() string {
+	if a.Context == nil {
+		return ""
+	}
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, value := range a.Context.Values {
+		low, high = math.Min(low, value), math.Max(high, value)
+	}
+	return fmt.Sprintf(" [last %d values %s from %s to %s]", len(a.Context.Values), a.Context.Sparkline, formatValue(low, a.Unit), formatValue(high, a.Unit))
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// assetProjectType is the asset type of projects in Cloud Asset Inventory
+const assetProjectType = "cloudresourcemanager.googleapis.com/Project"
+
+// assetFoldersKey is the metadata key of the folders of the project of an anomaly
+const assetFoldersKey = "folders"
+
+// AssetInventoryConfig attaches the labels of the resource of an anomaly and of its project, and
+// the folders of the project, from Cloud Asset Inventory to the metadata of the anomaly, so
+// suppressions, notifier matchers and templates can target ownership such as team=payments
+type AssetInventoryConfig struct {
+	Labels         []string `yaml:"labels"`          // labels attached, e.g. [team, owner], all labels of the resource and project if empty
+	RefreshMin     int      `yaml:"refresh_min"`     // minutes the labels of a resource or project are cached, defaults to 60
+	ResourceLabels []string `yaml:"resource_labels"` // labels of the anomalies naming their resource, defaults to those of changes
+}
+
+func (c AssetInventoryConfig) validate() error {
+	if c.RefreshMin < 0 {
+		return fmt.Errorf("refresh_min must not be negative")
+	}
+	return nil
+}
+
+// assetResult is a resource found by a search of Cloud Asset Inventory
+type assetResult struct {
+	Name      string            `json:"name"` // full resource name, e.g. //run.googleapis.com/projects/p/locations/l/services/checkout
+	AssetType string            `json:"assetType"`
+	Labels    map[string]string `json:"labels"`
+	Folders   []string          `json:"folders"` // ancestor folders, nearest first, e.g. folders/123
+}
+
+// cachedSearch is the result of a search at a time
+type cachedSearch struct {
+	results []assetResult
+	at      time.Time
+}
+
+// assetTagger looks up the resources of anomalies and their projects in Cloud Asset Inventory
+type assetTagger struct {
+	config      AssetInventoryConfig
+	projectID   string
+	credentials CredentialsConfig
+	labels      map[string]bool // the labels attached, all when empty
+
+	mu    sync.Mutex
+	http  *http.Client            // created on first use
+	cache map[string]cachedSearch // by project and resource name, empty for the project itself
+}
+
+func newAssetTagger(config AssetInventoryConfig, projectID string, credentials CredentialsConfig) *assetTagger {
+	if config.RefreshMin == 0 {
+		config.RefreshMin = 60
+	}
+	if len(config.ResourceLabels) == 0 {
+		config.ResourceLabels = changesResourceLabels
+	}
+	labels := make(map[string]bool)
+	for _, label := range config.Labels {
+		labels[label] = true
+	}
+	return &assetTagger{config: config, projectID: projectID, credentials: credentials, labels: labels, cache: make(map[string]cachedSearch)}
+}
+
+// attach adds the labels of the resource of every anomaly to its metadata, then those of its
+// project that the resource does not have, and the folders of the project. The static labels of
+// the metric from the configuration are kept over them. A resource or project that cannot be
+// looked up is logged and left out.
+func (t *assetTagger) attach(ctx context.Context, anomalies []Anomaly, now time.Time) {
+	if t == nil {
+		return
+	}
+	for i := range anomalies {
+		anomaly := &anomalies[i]
+		projectID := anomaly.ProjectID
+		if projectID == "" {
+			projectID = t.projectID
+		}
+		metadata := make(map[string]string, len(anomaly.Metadata))
+		for key, value := range anomaly.Metadata {
+			metadata[key] = value
+		}
+		if name := t.resourceName(*anomaly); name != "" {
+			results, err := t.lookup(ctx, projectID, name, now)
+			if err != nil {
+				log.Printf("Could not look up resource %s of project %s in Cloud Asset Inventory: %v", name, projectID, err)
+			} else if resource := matchResource(results, name, *anomaly); resource != nil {
+				t.merge(metadata, resource.Labels)
+			}
+		}
+		results, err := t.lookup(ctx, projectID, "", now)
+		if err != nil {
+			log.Printf("Could not look up project %s in Cloud Asset Inventory: %v", projectID, err)
+		} else if len(results) > 0 {
+			project := results[0]
+			t.merge(metadata, project.Labels)
+			if _, ok := metadata[assetFoldersKey]; !ok && len(project.Folders) > 0 {
+				metadata[assetFoldersKey] = strings.Join(project.Folders, ",")
+			}
+		}
+		if len(metadata) > 0 {
+			anomaly.Metadata = metadata
+		}
+	}
+}
+
+// merge adds the configured labels to the metadata, without replacing those it has
+func (t *assetTagger) merge(metadata, labels map[string]string) {
+	for key, value := range labels {
+		if _, ok := metadata[key]; ok {
+			continue
+		}
+		if len(t.labels) > 0 && !t.labels[key] {
+			continue
+		}
+		metadata[key] = value
+	}
+}
+
+// resourceName returns the value of the first resource label of the anomaly
+func (t *assetTagger) resourceName(anomaly Anomaly) string {
+	for _, label := range t.config.ResourceLabels {
+		if value := anomaly.Labels[label]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// lookup returns the resources of the project matching the name, or the project itself for an
+// empty name, searching them again once the cached ones are older than refresh_min
+func (t *assetTagger) lookup(ctx context.Context, projectID, name string, now time.Time) ([]assetResult, error) {
+	key := projectID + "/" + name
+	t.mu.Lock()
+	cached, ok := t.cache[key]
+	t.mu.Unlock()
+	if ok && now.Sub(cached.at) < time.Duration(t.config.RefreshMin)*time.Minute {
+		return cached.results, nil
+	}
+	params := url.Values{"assetTypes": {assetProjectType}}
+	if name != "" {
+		params = url.Values{"query": {"name:" + name}}
+	}
+	results, err := t.search(ctx, projectID, params)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.cache[key] = cachedSearch{results: results, at: now}
+	t.mu.Unlock()
+	return results, nil
+}
+
+// matchResource returns the resource of the results named name, nil if there is none. Of
+// resources sharing the name, such as services of the same name in several regions, the one
+// whose full name has the most of the label values of the anomaly is taken.
+func matchResource(results []assetResult, name string, anomaly Anomaly) *assetResult {
+	values := make(map[string]bool, len(anomaly.Labels))
+	for _, value := range anomaly.Labels {
+		values[value] = true
+	}
+	var best *assetResult
+	bestScore := -1
+	for i, result := range results {
+		if result.AssetType == assetProjectType || path.Base(result.Name) != name {
+			continue
+		}
+		score := 0
+		for _, segment := range strings.Split(result.Name, "/") {
+			if values[segment] {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = &results[i], score
+		}
+	}
+	return best
+}
+
+// search returns the first page of the resources of the project matching the parameters
+func (t *assetTagger) search(ctx context.Context, projectID string, params url.Values) ([]assetResult, error) {
+	client, err := t.httpClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	params.Set("pageSize", "100")
+	var response struct {
+		Results []assetResult `json:"results"`
+	}
+	searchURL := fmt.Sprintf("https://cloudasset.googleapis.com/v1/projects/%s:searchAllResources?%s", url.PathEscape(projectID), params.Encode())
+	if err := getJSON(ctx, client, searchURL, &response); err != nil {
+		return nil, err
+	}
+	return response.Results, nil
+}
+
+// httpClient returns the client of the Cloud Asset API, creating it on first use
+func (t *assetTagger) httpClient(ctx context.Context) (*http.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.http != nil {
+		return t.http, nil
+	}
+	opts, err := t.credentials.clientOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client, _, err := htransport.NewClient(ctx, append(opts, option.WithScopes(cloudPlatformScope))...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Cloud Asset client: %v", err)
+	}
+	t.http = client
+	return client, nil
+}
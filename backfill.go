@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// backfillRetries is how often the fetch of a metric is retried when the API throttles it
+const backfillRetries = 5
+
+// BackfillConfig detects anomalies over the time the detector was down when it starts again,
+// so anomalies during an outage or a redeployment are still recorded and notified
+type BackfillConfig struct {
+	StatePath   string `yaml:"state_path"`    // local file or gs:// URI where the time of the last completed cycle is kept
+	MaxMin      int    `yaml:"max_min"`       // longest downtime backfilled, in minutes, defaults to 120; only its latest part is backfilled after longer ones
+	QueryPaceMs int    `yaml:"query_pace_ms"` // pause between the queries of the backfill, in milliseconds, defaults to 1000
+}
+
+func (c BackfillConfig) validate() error {
+	if c.StatePath == "" {
+		return fmt.Errorf("no state_path configured")
+	}
+	if c.MaxMin < 0 || c.QueryPaceMs < 0 {
+		return fmt.Errorf("max_min and query_pace_ms must not be negative")
+	}
+	return nil
+}
+
+// backfillState is what is kept at state_path
+type backfillState struct {
+	LastCycle time.Time `json:"last_cycle"`
+}
+
+// backfiller keeps the time of the last completed cycle at state_path and backfills the cycles
+// missed since then at startup
+type backfiller struct {
+	config BackfillConfig
+}
+
+func newBackfiller(config BackfillConfig) *backfiller {
+	if config.MaxMin == 0 {
+		config.MaxMin = 120
+	}
+	if config.QueryPaceMs == 0 {
+		config.QueryPaceMs = 1000
+	}
+	return &backfiller{config: config}
+}
+
+// completed records the time of a completed cycle. A failure to write it is logged, as it only
+// shortens a later backfill.
+func (b *backfiller) completed(ctx context.Context, at time.Time) {
+	if b == nil {
+		return
+	}
+	data, err := json.Marshal(backfillState{LastCycle: at.UTC()})
+	if err == nil {
+		err = writeObject(ctx, b.config.StatePath, data)
+	}
+	if err != nil {
+		log.Printf("Could not record the last cycle at %s: %v", b.config.StatePath, err)
+	}
+}
+
+// lastCycle returns the time of the last completed cycle, false if none was recorded
+func (b *backfiller) lastCycle(ctx context.Context) (time.Time, bool, error) {
+	data, err := readObject(ctx, b.config.StatePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	var state backfillState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return time.Time{}, false, fmt.Errorf("could not parse %s: %v", b.config.StatePath, err)
+	}
+	return state.LastCycle, !state.LastCycle.IsZero(), nil
+}
+
+// backfill replays the polling cycles missed between the last completed cycle and the recent
+// window of the first cycle, at most max_min of them, scoring each against the baseline as the
+// backtest does. The anomalies are marked as backfilled and listed once each, in their final
+// extent. The metrics are fetched one after the other, query_pace_ms apart, and a throttled fetch
+// is retried with backoff, so the backfill does not eat into the quota of the live cycles. A
+// metric that cannot be fetched is logged and left out.
+func (b *backfiller) backfill(client *monitoring.MetricClient, config *Config, detector *SimpleAnomalyDetector) []Anomaly {
+	if b == nil {
+		return nil
+	}
+	ctx := context.Background()
+	last, ok, err := b.lastCycle(ctx)
+	if err != nil {
+		log.Printf("Could not read the last cycle, nothing backfilled: %v", err)
+		return nil
+	}
+	if !ok {
+		log.Printf("No cycle recorded at %s yet, nothing to backfill\n", b.config.StatePath)
+		return nil
+	}
+	window := time.Duration(config.RecentDuration) * time.Minute
+	step := time.Duration(config.PollingTime) * time.Second
+	now := config.now()
+	// The first cycle scores the recent window itself
+	start, end := last, now.Add(-window)
+	if end.Sub(start) < step {
+		return nil
+	}
+	if maxGap := time.Duration(b.config.MaxMin) * time.Minute; end.Sub(start) > maxGap {
+		log.Printf("The detector was down for %s, backfilling only the last %s\n", now.Sub(last).Round(time.Second), maxGap)
+		start = end.Add(-maxGap)
+	}
+	log.Printf("Backfilling the cycles missed from %s to %s...\n", start.Format(time.RFC3339), end.Format(time.RFC3339))
+
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
+	var series []*monitoringpb.TimeSeries
+	for i, metric := range config.flaggedMetrics(config.MetricTypes()) {
+		if i > 0 {
+			time.Sleep(time.Duration(b.config.QueryPaceMs) * time.Millisecond)
+		}
+		fetched, err := b.fetch(client, config, metric, start.Add(-window), end)
+		if err != nil {
+			log.Printf("Could not fetch %s to backfill, left out: %v", metric, err)
+			continue
+		}
+		series = append(series, fetched...)
+	}
+
+	var anomalies []Anomaly
+	seen := make(map[string]int)
+	for cycleTime := start.Add(step); !cycleTime.After(end); cycleTime = cycleTime.Add(step) {
+		cycleAnomalies, err := detector.DetectAnomalies(sliceWindow(series, cycleTime.Add(-window), cycleTime), config.ZScoreThreshold)
+		if err != nil {
+			log.Printf("Backfill stopped at %s: %v", cycleTime.Format(time.RFC3339), err)
+			break
+		}
+		config.classify(cycleAnomalies)
+		config.annotate(cycleAnomalies)
+		config.describeCosts(cycleAnomalies)
+		for _, anomaly := range cycleAnomalies {
+			anomaly.Backfilled = true
+			anomaly.Message += " (backfilled)"
+			if i, ok := seen[anomaly.ID]; ok {
+				anomalies[i] = anomaly
+				continue
+			}
+			seen[anomaly.ID] = len(anomalies)
+			anomalies = append(anomalies, anomaly)
+		}
+	}
+	anomalies = config.flaggedDetections(anomalies)
+	detector.changes.attach(ctx, anomalies, now)
+	detector.assets.attach(ctx, anomalies, now)
+	detector.traces.attach(ctx, anomalies, now)
+	sort.Slice(anomalies, func(i, j int) bool { return anomalies[i].Timestamp.Before(anomalies[j].Timestamp) })
+	log.Printf("Backfill found %d anomalies\n", len(anomalies))
+	return anomalies
+}
+
+// fetch reads a metric between startTime and endTime, retrying with exponential backoff while
+// the API answers that the quota is exhausted
+func (b *backfiller) fetch(client *monitoring.MetricClient, config *Config, metric string, startTime, endTime time.Time) ([]*monitoringpb.TimeSeries, error) {
+	delay := time.Duration(b.config.QueryPaceMs) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		var series []*monitoringpb.TimeSeries
+		err := streamConfiguredMetrics(client, config, "backfill", []string{metric}, startTime, endTime, func(ts *monitoringpb.TimeSeries) {
+			series = append(series, ts)
+		})
+		if err == nil || status.Code(err) != codes.ResourceExhausted || attempt == backfillRetries {
+			return series, err
+		}
+		delay = max(2*delay, time.Second)
+		log.Printf("Backfill of %s throttled, retrying in %s\n", metric, delay)
+		time.Sleep(delay)
+	}
+}
+
+// reportBackfill backfills the cycles missed while the detector was down and reports their
+// anomalies, which are only logged while the baseline warms up like those of the cycles
+func reportBackfill(client *monitoring.MetricClient, config *Config, detector *SimpleAnomalyDetector, router *Router) {
+	anomalies := detector.backfill.backfill(client, config, detector)
+	if len(anomalies) == 0 {
+		return
+	}
+	if config.now().Before(detector.warmUpUntil) {
+		printAnomalies(anomalies)
+		log.Printf("Warming up until %s, %d backfilled anomalies logged but not notified\n", detector.warmUpUntil.Format(time.RFC3339), len(anomalies))
+		return
+	}
+	router.Report(context.Background(), anomalies)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// runBacktest replays a past time range window by window and reports the anomalies
+// the current configuration would have raised, without notifying anyone.
+func runBacktest(args []string) {
+	fs := flag.NewFlagSet("backtest", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	credentials := addCredentialFlags(fs)
+	from := fs.String("from", "", "Start of the backtest range (RFC3339)")
+	to := fs.String("to", "", "End of the backtest range (RFC3339, defaults to now)")
+	step := fs.Duration("step", 0, "Time between simulated polling cycles (defaults to polling_time)")
+	fs.Parse(args)
+
+	config := mustLoadConfig(*configPath)
+	config.Credentials.override(*credentials)
+	mustDiscoverWorkloads(config)
+
+	if *from == "" {
+		log.Fatalf("The -from flag is required")
+	}
+	startTime, err := time.Parse(time.RFC3339, *from)
+	if err != nil {
+		log.Fatalf("Invalid -from time: %v", err)
+	}
+	endTime := config.now()
+	if *to != "" {
+		endTime, err = time.Parse(time.RFC3339, *to)
+		if err != nil {
+			log.Fatalf("Invalid -to time: %v", err)
+		}
+	}
+	if !endTime.After(startTime) {
+		log.Fatalf("The backtest range is empty: %s is not after %s", endTime.Format(time.RFC3339), startTime.Format(time.RFC3339))
+	}
+
+	stepInterval := *step
+	if stepInterval == 0 {
+		stepInterval = time.Duration(config.PollingTime) * time.Second
+	}
+	if stepInterval <= 0 {
+		log.Fatalf("A positive -step or polling_time is required")
+	}
+	window := time.Duration(config.RecentDuration) * time.Minute
+
+	client := mustCreateClient(config.Credentials, config.MonitoringAPI)
+	mustValidateFilters(client, config)
+
+	anomalies, cycles, err := backtest(client, config, startTime, endTime, stepInterval, window)
+	if err != nil {
+		log.Fatalf("Backtest failed: %v", err)
+	}
+
+	feedback, err := NewFeedbackStore(context.Background(), config.FeedbackPath)
+	if err != nil {
+		log.Fatalf("Failed to load feedback: %v", err)
+	}
+
+	printAnomalies(anomalies)
+	printBacktestSummary(config, anomalies, feedback, cycles, startTime, endTime)
+}
+
+// backtest computes the baseline from the window preceding startTime, or the pinned
+// baseline_window, and then simulates a polling cycle every step until endTime. Events
+// reported by more than one cycle are listed once, in their final extent, so the result lists
+// the distinct events in the range. The cycles run on a clock set to their simulated time.
+func backtest(client *monitoring.MetricClient, config *Config, startTime, endTime time.Time, step, window time.Duration) ([]Anomaly, int, error) {
+	clock := newManualClock(startTime)
+	replay := *config
+	replay.clock = clock
+	config = &replay
+
+	baselineStart, baselineEnd := config.baselineRange(startTime)
+	detector := newDetector(config)
+	err := detector.streamBaseline(func(add func(*monitoringpb.TimeSeries)) error {
+		return streamBaselineMetrics(client, config, config.MetricTypes(), baselineStart, baselineEnd, add)
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not fetch baseline metrics: %v", err)
+	}
+
+	var replayMetrics []*monitoringpb.TimeSeries
+	err = streamConfiguredMetrics(client, config, "backtest", config.MetricTypes(), startTime.Add(-window), endTime, func(ts *monitoringpb.TimeSeries) {
+		replayMetrics = append(replayMetrics, ts)
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("could not fetch backtest metrics: %v", err)
+	}
+
+	var anomalies []Anomaly
+	seen := make(map[string]int)
+	cycles := 0
+	for cycleTime := startTime.Add(step); !cycleTime.After(endTime); cycleTime = cycleTime.Add(step) {
+		cycles++
+		clock.Set(cycleTime)
+		log.Printf("Backtest cycle at %s...\n", cycleTime.Format(time.RFC3339))
+
+		windowMetrics := sliceWindow(replayMetrics, cycleTime.Add(-window), cycleTime)
+		cycleAnomalies, err := detector.DetectAnomalies(windowMetrics, config.ZScoreThreshold)
+		if err != nil {
+			return nil, cycles, err
+		}
+		config.classify(cycleAnomalies)
+		config.annotate(cycleAnomalies)
+		config.describeCosts(cycleAnomalies)
+		for _, anomaly := range cycleAnomalies {
+			// An event reported again by a later cycle replaces its earlier, shorter version
+			if i, ok := seen[anomaly.ID]; ok {
+				anomalies[i] = anomaly
+				continue
+			}
+			seen[anomaly.ID] = len(anomalies)
+			anomalies = append(anomalies, anomaly)
+		}
+	}
+
+	sort.Slice(anomalies, func(i, j int) bool {
+		return anomalies[i].Timestamp.Before(anomalies[j].Timestamp)
+	})
+	return anomalies, cycles, nil
+}
+
+// sliceWindow returns copies of the series holding only the points that end within
+// (windowStart, windowEnd].
+func sliceWindow(metrics []*monitoringpb.TimeSeries, windowStart, windowEnd time.Time) []*monitoringpb.TimeSeries {
+	var windowed []*monitoringpb.TimeSeries
+	for _, metric := range metrics {
+		var points []*monitoringpb.Point
+		for _, point := range metric.Points {
+			pointTime := point.Interval.EndTime.AsTime()
+			if pointTime.After(windowStart) && !pointTime.After(windowEnd) {
+				points = append(points, point)
+			}
+		}
+		if len(points) == 0 {
+			continue
+		}
+		windowed = append(windowed, &monitoringpb.TimeSeries{
+			Metric:     metric.Metric,
+			Resource:   metric.Resource,
+			Metadata:   metric.Metadata,
+			MetricKind: metric.MetricKind,
+			ValueType:  metric.ValueType,
+			Unit:       metric.Unit,
+			Points:     points,
+		})
+	}
+	return windowed
+}
+
+func printBacktestSummary(config *Config, anomalies []Anomaly, feedback *FeedbackStore, cycles int, startTime, endTime time.Time) {
+	perMetric := make(map[string]int)
+	labelled := make(map[string]FeedbackCounts)
+	for _, anomaly := range anomalies {
+		perMetric[anomaly.MetricName]++
+		if entry, ok := feedback.Get(anomaly.ID); ok {
+			counts := labelled[anomaly.MetricName]
+			if entry.Label == LabelFalsePositive {
+				counts.FalsePositives++
+			} else {
+				counts.TruePositives++
+			}
+			labelled[anomaly.MetricName] = counts
+		}
+	}
+	metricNames := make([]string, 0, len(perMetric))
+	for name := range perMetric {
+		metricNames = append(metricNames, name)
+	}
+	sort.Strings(metricNames)
+
+	fmt.Printf("Backtest from %s to %s: %d cycles, %d anomalies\n",
+		startTime.Format(time.RFC3339), endTime.Format(time.RFC3339), cycles, len(anomalies))
+	for _, name := range metricNames {
+		counts := labelled[name]
+		fmt.Printf("  %s: %d anomalies, %d labelled false positive, %d confirmed\n",
+			config.displayName(name), perMetric[name], counts.FalsePositives, counts.TruePositives)
+	}
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// baselineAccumulator folds streamed series into running statistics. A series split across
+// response pages is merged by its fingerprint.
+type baselineAccumulator struct {
+	series []*accumulatedSeries
+	byKey  map[string]*accumulatedSeries
+	// seasons holds the metrics with separate weekend baselines, whose weekend points are folded
+	// into weekend rather than into this accumulator
+	seasons map[string]*season
+	weekend *baselineAccumulator
+	// transforms holds the metrics whose values are transformed before they are folded in
+	transforms map[string]*valueTransform
+	// digests holds the distribution of the values of each metric type, over all of its series
+	digests map[string]*quantileDigest
+	// shared tells which series are also folded into a shared baseline, and pooled holds the
+	// statistics of those baselines by key
+	shared sharedBaselines
+	pooled map[string]*RunningStats
+	// label qualifies the baselines in log messages
+	label string
+}
+
+type accumulatedSeries struct {
+	metricType string
+	stats      RunningStats
+	// points, first and last count and bound the points of the series, whatever their season or
+	// transform, and interval is the shortest time between two consecutive ones
+	points      int64
+	first, last time.Time
+	interval    time.Duration
+}
+
+// observe records the time of a point of the series, following the one at previous in its page
+func (s *accumulatedSeries) observe(t, previous time.Time) {
+	s.points++
+	if s.first.IsZero() || t.Before(s.first) {
+		s.first = t
+	}
+	if t.After(s.last) {
+		s.last = t
+	}
+	if !previous.IsZero() {
+		if gap := absDuration(previous.Sub(t)); gap > 0 && (s.interval == 0 || gap < s.interval) {
+			s.interval = gap
+		}
+	}
+}
+
+func newBaselineAccumulator(seasons map[string]*season, transforms map[string]*valueTransform) *baselineAccumulator {
+	return &baselineAccumulator{
+		byKey:      make(map[string]*accumulatedSeries),
+		seasons:    seasons,
+		weekend:    &baselineAccumulator{byKey: make(map[string]*accumulatedSeries), digests: make(map[string]*quantileDigest), label: " on weekends"},
+		transforms: transforms,
+		digests:    make(map[string]*quantileDigest),
+	}
+}
+
+func (a *baselineAccumulator) add(ts *monitoringpb.TimeSeries) {
+	key := seriesFingerprint(ts)
+	series := a.seriesFor(key, ts.Metric.Type)
+	season, transform := a.seasons[ts.Metric.Type], a.transforms[ts.Metric.Type]
+	sharedKey, shared := a.shared.keyOf(ts)
+	var previous time.Time
+	for _, point := range ts.Points {
+		series.observe(point.Interval.EndTime.AsTime(), previous)
+		previous = point.Interval.EndTime.AsTime()
+		value, ok := transform.apply(pointValue(point))
+		if !ok {
+			continue
+		}
+		if season != nil && season.isWeekend(point.Interval.EndTime.AsTime()) {
+			a.weekend.seriesFor(key, ts.Metric.Type).stats.Add(value)
+			a.weekend.digestFor(ts.Metric.Type).Add(value)
+			if shared {
+				a.weekend.pooledFor(sharedKey).Add(value)
+			}
+			continue
+		}
+		series.stats.Add(value)
+		a.digestFor(ts.Metric.Type).Add(value)
+		if shared {
+			a.pooledFor(sharedKey).Add(value)
+		}
+	}
+}
+
+// pooledFor returns the statistics of the shared baseline with the key, adding them if needed
+func (a *baselineAccumulator) pooledFor(key string) *RunningStats {
+	if a.pooled == nil {
+		a.pooled = make(map[string]*RunningStats)
+	}
+	stats, ok := a.pooled[key]
+	if !ok {
+		stats = &RunningStats{}
+		a.pooled[key] = stats
+	}
+	return stats
+}
+
+// digestFor returns the distribution of the values of the metric type, adding it if needed
+func (a *baselineAccumulator) digestFor(metricType string) *quantileDigest {
+	digest, ok := a.digests[metricType]
+	if !ok {
+		digest = &quantileDigest{}
+		a.digests[metricType] = digest
+	}
+	return digest
+}
+
+// seriesFor returns the statistics of the series with the fingerprint, adding them if needed
+func (a *baselineAccumulator) seriesFor(key, metricType string) *accumulatedSeries {
+	series, ok := a.byKey[key]
+	if !ok {
+		series = &accumulatedSeries{metricType: metricType}
+		a.byKey[key] = series
+		a.series = append(a.series, series)
+	}
+	return series
+}
+
+// metricsStats returns the baseline statistics per metric type, over all of its series
+func (a *baselineAccumulator) metricsStats() map[string]MetricStats {
+	merged := make(map[string]*RunningStats)
+	seriesCount := make(map[string]int)
+	var metricTypes []string
+	for _, series := range a.series {
+		if merged[series.metricType] == nil {
+			merged[series.metricType] = &RunningStats{}
+			metricTypes = append(metricTypes, series.metricType)
+		}
+		merged[series.metricType].Merge(series.stats)
+		seriesCount[series.metricType]++
+	}
+
+	metricsStats := make(map[string]MetricStats)
+	for _, metricType := range metricTypes {
+		stats := merged[metricType]
+		if stats.Count == 0 {
+			log.Printf("No data points for metric: %s%s. Skipping...\n", metricType, a.label)
+			continue
+		}
+
+		digest := a.digests[metricType]
+		digest.compress()
+		metricsStats[metricType] = MetricStats{
+			mean:   stats.Mean,
+			stddev: stats.StdDev(),
+			count:  stats.Count,
+			digest: digest,
+		}
+
+		log.Printf("Baseline for metric %s%s: Mean: %.2f, StdDev: %.2f over %d series\n", metricType, a.label, stats.Mean, stats.StdDev(), seriesCount[metricType])
+	}
+	return metricsStats
+}
+
+// seriesStats returns the baseline statistics per series fingerprint, and those of the shared
+// baselines by their keys
+func (a *baselineAccumulator) seriesStats() map[string]MetricStats {
+	seriesStats := make(map[string]MetricStats, len(a.byKey)+len(a.pooled))
+	for fingerprint, series := range a.byKey {
+		seriesStats[fingerprint] = MetricStats{
+			mean:   series.stats.Mean,
+			stddev: series.stats.StdDev(),
+			count:  series.stats.Count,
+		}
+	}
+	for key, stats := range a.pooled {
+		seriesStats[key] = MetricStats{mean: stats.Mean, stddev: stats.StdDev(), count: stats.Count}
+		log.Printf("Shared baseline %s%s: Mean: %.2f, StdDev: %.2f over %d points\n", strings.TrimPrefix(key, sharedBaselinePrefix), a.label, stats.Mean, stats.StdDev(), stats.Count)
+	}
+	return seriesStats
+}
+
+// seriesTypes returns the metric type per series fingerprint
+func (a *baselineAccumulator) seriesTypes() map[string]string {
+	seriesTypes := make(map[string]string, len(a.byKey))
+	for fingerprint, series := range a.byKey {
+		seriesTypes[fingerprint] = series.metricType
+	}
+	return seriesTypes
+}
+
+// Rebaseline replaces the baseline of one metric with the series handed over by fetch, leaving
+// the other metrics untouched. The series of the old baseline are dropped, so series that no
+// longer exist stop being scored against stale statistics.
+func (d *SimpleAnomalyDetector) Rebaseline(metricType string, fetch func(add func(*monitoringpb.TimeSeries)) error) (MetricStats, int, error) {
+	d.mu.RLock()
+	initialised := d.initialised
+	d.mu.RUnlock()
+	if !initialised {
+		return MetricStats{}, 0, fmt.Errorf("baseline not initialised")
+	}
+	// Detection cycles carry on while the historical window is fetched
+	accumulator := newBaselineAccumulator(d.seasons, d.transforms)
+	err := fetch(func(ts *monitoringpb.TimeSeries) {
+		if ts.Metric.Type == metricType {
+			accumulator.add(ts)
+		}
+	})
+	if err != nil {
+		return MetricStats{}, 0, err
+	}
+	stats, ok := accumulator.metricsStats()[metricType]
+	if !ok {
+		return MetricStats{}, 0, fmt.Errorf("no baseline data for metric %s", metricType)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.seasons[metricType] != nil {
+		// Before the series types of the metric are replaced, which tell its old series apart
+		d.rebaselineWeekend(metricType, accumulator.weekend)
+	}
+	previous := d.metricsStats[metricType]
+	stats.currentMean, stats.currentStdDev = previous.currentMean, previous.currentStdDev
+	d.metricsStats[metricType] = stats
+	if d.seriesStats != nil {
+		for fingerprint, seriesType := range d.seriesTypes {
+			if seriesType == metricType {
+				delete(d.seriesStats, fingerprint)
+				delete(d.seriesTypes, fingerprint)
+				delete(d.untrusted, fingerprint)
+			}
+		}
+		if d.seriesTypes == nil {
+			d.seriesTypes = make(map[string]string)
+		}
+		for fingerprint, seriesStats := range accumulator.seriesStats() {
+			d.seriesStats[fingerprint] = seriesStats
+			d.seriesTypes[fingerprint] = metricType
+		}
+		if d.untrusted == nil {
+			d.untrusted = make(map[string]string)
+		}
+		for fingerprint, reason := range d.assessBaselines(accumulator) {
+			d.untrusted[fingerprint] = reason
+		}
+	}
+	d.completeness.learn(accumulator)
+	log.Printf("Rebaselined metric %s over %d series\n", metricType, len(accumulator.byKey))
+	return stats, len(accumulator.byKey), nil
+}
+
+// rebaselineWeekend replaces the weekend baseline of a seasonal metric with the one accumulated
+func (d *SimpleAnomalyDetector) rebaselineWeekend(metricType string, weekend *baselineAccumulator) {
+	if d.weekendMetricsStats == nil {
+		d.weekendMetricsStats = make(map[string]MetricStats)
+	}
+	delete(d.weekendMetricsStats, metricType)
+	if stats, ok := weekend.metricsStats()[metricType]; ok {
+		d.weekendMetricsStats[metricType] = stats
+	}
+	if d.seriesStats == nil {
+		return
+	}
+	if d.weekendSeriesStats == nil {
+		d.weekendSeriesStats = make(map[string]MetricStats)
+	}
+	for fingerprint := range d.weekendSeriesStats {
+		if d.seriesTypes[fingerprint] == metricType {
+			delete(d.weekendSeriesStats, fingerprint)
+		}
+	}
+	for fingerprint, stats := range weekend.seriesStats() {
+		d.weekendSeriesStats[fingerprint] = stats
+	}
+}
+
+// BaselineSnapshot is the persisted form of the baseline statistics, allowing a detector to
+// start without fetching the historical window again
+type BaselineSnapshot struct {
+	CreatedAt time.Time                `json:"created_at"`
+	Metrics   map[string]BaselineStats `json:"metrics"`
+	// Series holds the statistics per series fingerprint. Snapshots written before series
+	// baselines existed lack it, and their series are scored against the metric's statistics.
+	Series map[string]BaselineStats `json:"series,omitempty"`
+	// WeekendMetrics and WeekendSeries hold the weekend baselines of the metrics with
+	// seasonality, whose Metrics and Series entries cover their weekdays only
+	WeekendMetrics map[string]BaselineStats `json:"weekend_metrics,omitempty"`
+	WeekendSeries  map[string]BaselineStats `json:"weekend_series,omitempty"`
+}
+
+// BaselineStats are the persisted baseline statistics of a single metric or series, or the fixed
+// baseline of a metric in the configuration
+type BaselineStats struct {
+	Mean   float64 `json:"mean" yaml:"mean"`
+	StdDev float64 `json:"stddev" yaml:"stddev"`
+	Count  int64   `json:"count,omitempty" yaml:"count"`
+	// Digest summarises the distribution of the baseline values of a metric for its percentiles
+	Digest *BaselineDigest `json:"digest,omitempty" yaml:"-"`
+}
+
+// Snapshot returns the current baseline statistics
+func (d *SimpleAnomalyDetector) Snapshot() BaselineSnapshot {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.snapshot()
+}
+
+func (d *SimpleAnomalyDetector) snapshot() BaselineSnapshot {
+	snapshot := BaselineSnapshot{
+		CreatedAt: d.createdAt.UTC(),
+		Metrics:   make(map[string]BaselineStats),
+	}
+	if d.createdAt.IsZero() {
+		snapshot.CreatedAt = d.clock.Now().UTC()
+	}
+	for metricType, stats := range d.metricsStats {
+		snapshot.Metrics[metricType] = stats.persisted()
+	}
+	if d.seriesStats != nil {
+		snapshot.Series = make(map[string]BaselineStats, len(d.seriesStats))
+		for fingerprint, stats := range d.seriesStats {
+			snapshot.Series[fingerprint] = stats.persisted()
+		}
+	}
+	snapshot.WeekendMetrics = persistedStats(d.weekendMetricsStats)
+	snapshot.WeekendSeries = persistedStats(d.weekendSeriesStats)
+	return snapshot
+}
+
+// Restore replaces the baseline with previously persisted statistics
+func (d *SimpleAnomalyDetector) Restore(snapshot BaselineSnapshot) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.metricsStats = make(map[string]MetricStats)
+	for metricType, stats := range snapshot.Metrics {
+		d.metricsStats[metricType] = stats.restored()
+	}
+	d.seriesStats = nil
+	d.seriesTypes = nil
+	if snapshot.Series != nil {
+		d.seriesStats = make(map[string]MetricStats, len(snapshot.Series))
+		for fingerprint, stats := range snapshot.Series {
+			d.seriesStats[fingerprint] = stats.restored()
+		}
+	}
+	d.weekendMetricsStats = restoredStats(snapshot.WeekendMetrics)
+	d.weekendSeriesStats = restoredStats(snapshot.WeekendSeries)
+	d.untrusted = nil
+	d.applyFixedBaselines()
+	d.initialised = true
+	d.createdAt = snapshot.CreatedAt
+	// A restored baseline has been warming up since it was computed
+	d.startWarmUp(snapshot.CreatedAt)
+	log.Printf("Baseline restored for %d metrics (created at %s).\n", len(snapshot.Metrics), snapshot.CreatedAt.Format(time.RFC3339))
+}
+
+// applyFixedBaselines sets the baseline of the metrics with fixed statistics in the configuration
+func (d *SimpleAnomalyDetector) applyFixedBaselines() {
+	for metricType, stats := range d.fixed {
+		d.metricsStats[metricType] = stats
+	}
+}
+
+// startBaseline returns a detector initialised from the persisted baseline if restore_baseline is
+// set, from the most recent history refined in the background with fast_start, and from the
+// historical window otherwise
+func startBaseline(ctx context.Context, client *monitoring.MetricClient, config *Config) (*SimpleAnomalyDetector, error) {
+	if config.RestoreBaseline {
+		return restoreBaseline(ctx, client, config)
+	}
+	if config.FastStart != nil {
+		return fastStartBaseline(client, config)
+	}
+	return buildBaseline(client, config)
+}
+
+// restoreBaseline restores the baseline persisted at baseline_path, or in the store, fetching
+// only the metrics it lacks, such as those added to the configuration since it was saved. When
+// there is none yet, or it is older than baseline_max_age, the baseline is recomputed from the
+// historical window and saved.
+func restoreBaseline(ctx context.Context, client *monitoring.MetricClient, config *Config) (*SimpleAnomalyDetector, error) {
+	store, key := config.baselineStore()
+	location := storeLocation(store, key)
+	snapshot, err := loadBaseline(ctx, store, key)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		log.Printf("No baseline found at %s, computing one...\n", location)
+	case err != nil:
+		return nil, err
+	case config.BaselineMaxAge > 0 && config.now().Sub(snapshot.CreatedAt) > time.Duration(config.BaselineMaxAge)*time.Hour:
+		log.Printf("Baseline at %s is older than %d hours, recomputing...\n", location, config.BaselineMaxAge)
+	default:
+		detector := newDetector(config)
+		detector.Restore(*snapshot)
+		added := false
+		for _, metricType := range config.fetchedBaselineMetrics() {
+			if _, ok := snapshot.Metrics[metricType]; ok {
+				continue
+			}
+			_, _, err := detector.Rebaseline(metricType, func(add func(*monitoringpb.TimeSeries)) error {
+				return streamHistoricalMetrics(client, config, []string{metricType}, add)
+			})
+			if err != nil {
+				log.Printf("Failed to fetch the baseline of metric %s missing from %s: %v", metricType, location, err)
+				continue
+			}
+			added = true
+		}
+		if added {
+			// So the metrics are not fetched again on the next start
+			if err := saveBaseline(ctx, store, key, detector.Snapshot()); err != nil {
+				log.Printf("Failed to save baseline: %v", err)
+			}
+		}
+		return detector, nil
+	}
+
+	detector, err := buildBaseline(client, config)
+	if err != nil {
+		return nil, err
+	}
+	if err := saveBaseline(ctx, store, key, detector.Snapshot()); err != nil {
+		return nil, err
+	}
+	return detector, nil
+}
+
+// persistedStats converts weekend baselines to their persisted form, nil if there are none
+func persistedStats(stats map[string]MetricStats) map[string]BaselineStats {
+	if len(stats) == 0 {
+		return nil
+	}
+	persisted := make(map[string]BaselineStats, len(stats))
+	for key, s := range stats {
+		persisted[key] = s.persisted()
+	}
+	return persisted
+}
+
+// restoredStats converts persisted weekend baselines back, nil if there are none
+func restoredStats(persisted map[string]BaselineStats) map[string]MetricStats {
+	if len(persisted) == 0 {
+		return nil
+	}
+	stats := make(map[string]MetricStats, len(persisted))
+	for key, s := range persisted {
+		stats[key] = s.restored()
+	}
+	return stats
+}
+
+// persisted returns the persisted form of baseline statistics
+func (s MetricStats) persisted() BaselineStats {
+	return BaselineStats{Mean: s.mean, StdDev: s.stddev, Count: s.count, Digest: s.digest.persisted()}
+}
+
+// restored converts persisted baseline statistics back
+func (s BaselineStats) restored() MetricStats {
+	return MetricStats{mean: s.Mean, stddev: s.StdDev, count: s.Count, digest: s.Digest.restored()}
+}
+
+// baselineStore returns the store and key of the persisted baseline: baseline_path when set,
+// and the baseline key of the configured store otherwise
+func (c *Config) baselineStore() (Store, string) {
+	if c.BaselinePath != "" {
+		store, key := objectStoreAt(c.BaselinePath)
+		return store, key
+	}
+	return c.store, storeBaselineKey
+}
+
+// loadBaseline reads a baseline snapshot from the key of a store
+func loadBaseline(ctx context.Context, store Store, key string) (*BaselineSnapshot, error) {
+	location := storeLocation(store, key)
+	data, err := store.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, gzipMagic) {
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("could not decompress baseline %s: %v", location, err)
+		}
+		if data, err = io.ReadAll(reader); err != nil {
+			return nil, fmt.Errorf("could not decompress baseline %s: %v", location, err)
+		}
+	}
+	var snapshot BaselineSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("could not parse baseline %s: %v", location, err)
+	}
+	return &snapshot, nil
+}
+
+// gzipMagic starts gzip-compressed data
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// saveBaseline writes a baseline snapshot to the key of a store, gzip-compressed if the key ends
+// in .gz
+func saveBaseline(ctx context.Context, store Store, key string, snapshot BaselineSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(key, ".gz") {
+		var compressed bytes.Buffer
+		writer := gzip.NewWriter(&compressed)
+		if _, err := writer.Write(data); err != nil {
+			return err
+		}
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		data = compressed.Bytes()
+	}
+	if err := store.Put(ctx, key, data); err != nil {
+		return err
+	}
+	log.Printf("Baseline for %d metrics saved to %s\n", len(snapshot.Metrics), storeLocation(store, key))
+	return nil
+}
+
+// runBaselineExport computes the baseline from the historical window and persists it, so
+// request-triggered deployments can refresh their baseline on a schedule
+func runBaselineExport(args []string) {
+	fs := flag.NewFlagSet("baseline", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	credentials := addCredentialFlags(fs)
+	output := fs.String("output", "", "Local file or gs:// URI to write the baseline to (defaults to baseline_path, or the store)")
+	fs.Parse(args)
+
+	config := mustLoadConfig(*configPath)
+	config.Credentials.override(*credentials)
+	mustDiscoverWorkloads(config)
+	store, key := config.baselineStore()
+	if *output != "" {
+		objects, outputKey := objectStoreAt(*output)
+		store, key = objects, outputKey
+	}
+	if !store.Durable() {
+		log.Fatalf("No baseline location: set baseline_path or a store, or pass -output")
+	}
+
+	client := mustCreateClient(config.Credentials, config.MonitoringAPI)
+	mustValidateFilters(client, config)
+	detector, err := buildBaseline(client, config)
+	if err != nil {
+		log.Fatalf("Failed to fetch historical metrics: %v", err)
+	}
+	if err := saveBaseline(context.Background(), store, key, detector.Snapshot()); err != nil {
+		log.Fatalf("Failed to save baseline: %v", err)
+	}
+}
+
+// defaultBaselineChunk is the longest part of the baseline window fetched with one query by default
+const defaultBaselineChunk = 7 * 24 * time.Hour
+
+// timeRange is a part of a time window
+type timeRange struct {
+	start, end time.Time
+}
+
+// baselineChunk returns the longest part of the baseline window fetched with one query
+func (c *Config) baselineChunk() time.Duration {
+	if c.BaselineChunk > 0 {
+		return time.Duration(c.BaselineChunk) * time.Hour
+	}
+	return defaultBaselineChunk
+}
+
+// baselineChunks splits the window from start to end into consecutive chunks of at most
+// baseline_chunk hours, oldest first
+func (c *Config) baselineChunks(start, end time.Time) []timeRange {
+	size := c.baselineChunk()
+	var chunks []timeRange
+	for chunkStart := start; chunkStart.Before(end); chunkStart = chunkStart.Add(size) {
+		chunkEnd := chunkStart.Add(size)
+		if chunkEnd.After(end) {
+			chunkEnd = end
+		}
+		chunks = append(chunks, timeRange{start: chunkStart, end: chunkEnd})
+	}
+	if len(chunks) == 0 {
+		chunks = append(chunks, timeRange{start: start, end: end})
+	}
+	return chunks
+}
+
+// pointsAfter returns the series with only its points ending after t
+func pointsAfter(ts *monitoringpb.TimeSeries, t time.Time) *monitoringpb.TimeSeries {
+	kept := make([]*monitoringpb.Point, 0, len(ts.Points))
+	for _, point := range ts.Points {
+		if point.Interval.EndTime.AsTime().After(t) {
+			kept = append(kept, point)
+		}
+	}
+	if len(kept) < len(ts.Points) {
+		ts.Points = kept
+	}
+	return ts
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// benchPointInterval is the spacing of the generated points
+const benchPointInterval = time.Minute
+
+// benchResult is the throughput of one detector over the generated series
+type benchResult struct {
+	detector string
+	series   int
+	points   int
+	elapsed  time.Duration
+}
+
+// runBench scores generated series with every detector and reports the points each processes
+// per second, as a guide to the resources a configuration of that size needs
+func runBench(args []string) {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	configPath := fs.String("config", "", "Configuration file to take the detection settings from (defaults to a z_score_threshold of 3)")
+	metrics := fs.Int("metrics", 5, "Number of metrics to generate")
+	series := fs.Int("series", 200, "Number of series per metric")
+	labels := fs.Int("labels", 4, "Number of metric labels per series")
+	baselinePoints := fs.Int("baseline-points", 1440, "Number of baseline points per series")
+	recentPoints := fs.Int("recent-points", 30, "Number of recent points per series")
+	anomalyRate := fs.Float64("anomaly-rate", 0.01, "Fraction of recent points generated as spikes")
+	iterations := fs.Int("iterations", 5, "Number of detection cycles to measure")
+	seed := fs.Int64("seed", 1, "Seed of the generated values")
+	fs.Parse(args)
+
+	if *metrics <= 0 || *series <= 0 || *baselinePoints <= 0 || *recentPoints <= 0 || *iterations <= 0 {
+		log.Fatalf("The -metrics, -series, -baseline-points, -recent-points and -iterations flags must be positive")
+	}
+	config := &Config{ZScoreThreshold: 3}
+	if *configPath != "" {
+		config = mustLoadConfig(*configPath)
+	}
+	// The detection settings are kept, the metrics replaced by the generated ones
+	config.Metrics = nil
+	for i := 0; i < *metrics; i++ {
+		config.Metrics = append(config.Metrics, MetricConfig{
+			Type:     fmt.Sprintf("custom.googleapis.com/bench/metric_%d", i),
+			Forecast: &ForecastConfig{Limit: 1000},
+		})
+	}
+
+	log.Printf("Generating %d series of %d baseline and %d recent points...\n", *metrics**series, *baselinePoints, *recentPoints)
+	generator := benchGenerator{random: rand.New(rand.NewSource(*seed)), now: time.Now(), labels: *labels}
+	baseline := generator.series(config, *series, *baselinePoints, *recentPoints, 0)
+	recent := generator.series(config, *series, *recentPoints, 0, *anomalyRate)
+
+	// The detectors log every series and point, which would swamp the output
+	log.Println("Measuring detectors...")
+	log.SetOutput(io.Discard)
+	results := benchDetectors(config, baseline, recent, *iterations)
+	log.SetOutput(redactingWriter{os.Stderr})
+
+	fmt.Printf("%-10s %10s %12s %12s %14s\n", "DETECTOR", "SERIES", "POINTS", "TIME", "POINTS/S")
+	for _, result := range results {
+		fmt.Printf("%-10s %10d %12d %12s %14.0f\n", result.detector, result.series, result.points,
+			result.elapsed.Round(time.Microsecond), float64(result.points)/result.elapsed.Seconds())
+	}
+}
+
+// benchDetectors builds the baseline once and runs each detector over the recent series for the
+// given number of cycles
+func benchDetectors(config *Config, baseline, recent []*monitoringpb.TimeSeries, iterations int) []benchResult {
+	points := func(series []*monitoringpb.TimeSeries) int {
+		n := 0
+		for _, ts := range series {
+			n += len(ts.Points)
+		}
+		return n
+	}
+	recentPoints := iterations * points(recent)
+
+	detector := newDetector(config)
+	start := time.Now()
+	detector.GetBaseline(baseline)
+	results := []benchResult{{detector: "baseline", series: len(baseline), points: points(baseline), elapsed: time.Since(start)}}
+
+	measure := func(name string, cycle func()) {
+		start := time.Now()
+		for i := 0; i < iterations; i++ {
+			cycle()
+		}
+		results = append(results, benchResult{detector: name, series: len(recent), points: recentPoints, elapsed: time.Since(start)})
+	}
+	measure("zscore", func() {
+		// Every cycle scores the whole window again, as if its points were new
+		detector.ResetHighWaterMarks()
+		if _, err := detector.DetectAnomalies(recent, config.ZScoreThreshold); err != nil {
+			log.Fatalf("Failed to detect anomalies: %v", err)
+		}
+	})
+	measure("flatline", func() {
+		detector.flatlined = nil
+		detector.DetectFlatlines(recent, config.Flatline)
+	})
+	measure("forecast", func() {
+		detector.projected = nil
+		detector.ForecastBreaches(recent, config)
+	})
+	return results
+}
+
+// benchGenerator generates gauge series following a daily cycle with noise
+type benchGenerator struct {
+	random *rand.Rand
+	now    time.Time
+	labels int
+}
+
+// series generates perMetric series of every configured metric, with points ending offset
+// points before now. Each point is a spike with probability anomalyRate. The labels and level
+// of a series depend only on its index, so recent series are scored against the baseline
+// series generated with the same index.
+func (g benchGenerator) series(config *Config, perMetric, points, offset int, anomalyRate float64) []*monitoringpb.TimeSeries {
+	var generated []*monitoringpb.TimeSeries
+	for _, metricConfig := range config.Metrics {
+		for i := 0; i < perMetric; i++ {
+			metricLabels := make(map[string]string, g.labels)
+			for j := 0; j < g.labels; j++ {
+				metricLabels["label_"+strconv.Itoa(j)] = strconv.Itoa(i % (j + 2))
+			}
+			ts := &monitoringpb.TimeSeries{
+				Metric:     &metricpb.Metric{Type: metricConfig.Type, Labels: metricLabels},
+				Resource:   &monitoredrespb.MonitoredResource{Type: "gce_instance", Labels: map[string]string{"instance_id": strconv.Itoa(i), "zone": "us-central1-a"}},
+				MetricKind: metricpb.MetricDescriptor_GAUGE,
+				ValueType:  metricpb.MetricDescriptor_DOUBLE,
+			}
+			level := 100 + float64(i%10)
+			// Points are newest first, as the API returns them
+			for p := 0; p < points; p++ {
+				end := g.now.Add(-time.Duration(offset+p) * benchPointInterval)
+				phase := 2 * math.Pi * float64(end.Unix()%86400) / 86400
+				value := level + 10*math.Sin(phase) + 2*g.random.NormFloat64()
+				if g.random.Float64() < anomalyRate {
+					value += 50
+				}
+				ts.Points = append(ts.Points, &monitoringpb.Point{
+					Interval: &monitoringpb.TimeInterval{EndTime: timestamppb.New(end)},
+					Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+				})
+			}
+			generated = append(generated, ts)
+		}
+	}
+	return generated
+}
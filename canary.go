@@ -0,0 +1,149 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// CanaryConfig compares two populations of a metric's series over the recent window, such as
+// the instances running a new version against those running the stable one
+type CanaryConfig struct {
+	Canary          string  `yaml:"canary"`            // filter selecting the canary series, e.g. metric.labels.version="canary"
+	Control         string  `yaml:"control"`           // filter selecting the control series, e.g. metric.labels.version="stable"
+	ZScoreThreshold float64 `yaml:"z_score_threshold"` // defaults to the global threshold
+	MinPoints       int     `yaml:"min_points"`        // points each population needs in the recent window, defaults to 10
+}
+
+func (c CanaryConfig) validate() error {
+	if c.Canary == "" || c.Control == "" {
+		return fmt.Errorf("canary and control filters are required")
+	}
+	return nil
+}
+
+// compareCanaries fetches the canary and control populations of every metric with a canary
+// comparison over the recent window and returns the comparisons that deviate
+func compareCanaries(client *monitoring.MetricClient, config *Config, detector *SimpleAnomalyDetector, metrics []string) ([]Anomaly, error) {
+	endTime := config.now()
+	startTime := endTime.Add(-time.Duration(config.RecentDuration) * time.Minute)
+
+	var anomalies []Anomaly
+	for _, metricType := range metrics {
+		metricConfig, ok := config.MetricConfig(metricType)
+		if !ok || metricConfig.Canary == nil {
+			continue
+		}
+		canary := *metricConfig.Canary
+		canarySeries, err := fetchMetricTerm(client, config, "canary", MetricTerm{Type: metricType, Filter: joinFilters(config.Filters[metricType], canary.Canary)}, metricConfig, nil, startTime, endTime)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch canary of %s: %v", metricType, err)
+		}
+		controlSeries, err := fetchMetricTerm(client, config, "control", MetricTerm{Type: metricType, Filter: joinFilters(config.Filters[metricType], canary.Control)}, metricConfig, nil, startTime, endTime)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch control of %s: %v", metricType, err)
+		}
+		if anomaly, ok := detector.CompareCanary(metricType, canary, canarySeries, controlSeries, config.ZScoreThreshold); ok {
+			anomalies = append(anomalies, anomaly)
+		}
+	}
+	return anomalies, nil
+}
+
+// CompareCanary scores the mean of all canary points against the mean and StdDev of all control
+// points, and returns an anomaly when it exceeds the threshold. A deviating canary is reported
+// once until it converges with its control again.
+func (d *SimpleAnomalyDetector) CompareCanary(metricType string, config CanaryConfig, canarySeries, controlSeries []*monitoringpb.TimeSeries, threshold float64) (Anomaly, bool) {
+	if config.ZScoreThreshold != 0 {
+		threshold = config.ZScoreThreshold
+	}
+	if config.MinPoints == 0 {
+		config.MinPoints = 10
+	}
+	if d.canaries == nil {
+		d.canaries = make(map[string]bool)
+	}
+
+	canary, latest := populationStats(canarySeries)
+	control, _ := populationStats(controlSeries)
+	if canary.Count < int64(config.MinPoints) || control.Count < int64(config.MinPoints) {
+		log.Printf("Canary comparison of %s skipped: %d canary and %d control points, %d needed\n", metricType, canary.Count, control.Count, config.MinPoints)
+		return Anomaly{}, false
+	}
+
+	stats := MetricStats{mean: control.Mean, stddev: control.StdDev(), count: control.Count}
+	zScore := d.zeroStdDev.zScore(canary.Mean, stats, threshold)
+	log.Printf("Canary comparison of %s: canary mean %.2f, control mean %.2f, Z-score %.2f\n", metricType, canary.Mean, control.Mean, zScore)
+
+	fingerprint := canaryFingerprint(metricType, config)
+	if math.Abs(zScore) <= threshold {
+		if d.canaries[fingerprint] {
+			log.Printf("Canary of %s converged with its control again\n", metricType)
+			delete(d.canaries, fingerprint)
+		}
+		return Anomaly{}, false
+	}
+	if d.canaries[fingerprint] {
+		return Anomaly{}, false
+	}
+	d.canaries[fingerprint] = true
+
+	margin := d.zeroStdDev.margin(stats, threshold)
+	unit := seriesUnit(canarySeries)
+	expected := newExpectedRange(control.Mean-margin, control.Mean+margin, canary.Mean, control.Mean, unit)
+	return Anomaly{
+		ID:         anomalyID(anomalyFingerprint(KindCanary, fingerprint), latest),
+		Kind:       KindCanary,
+		MetricName: metricType,
+		Value:      canary.Mean,
+		Unit:       unit,
+		ZScore:     zScore,
+		Timestamp:  latest,
+		Message: fmt.Sprintf("Canary mean %s deviates from control mean %s (StdDev %s) over %d canary and %d control points, %s",
+			formatValue(canary.Mean, unit), formatValue(control.Mean, unit), formatValue(control.StdDev(), unit), canary.Count, control.Count, expected),
+
+		Fingerprint:       anomalyFingerprint(KindCanary, fingerprint),
+		SeriesFingerprint: fingerprint,
+		Labels:            map[string]string{"canary": config.Canary, "control": config.Control},
+		Expected:          expected,
+	}, true
+}
+
+// populationStats returns the statistics of the points of all series together and the time of
+// the newest point
+func populationStats(series []*monitoringpb.TimeSeries) (RunningStats, time.Time) {
+	var stats RunningStats
+	var latest time.Time
+	for _, ts := range series {
+		for _, point := range ts.Points {
+			stats.Add(pointValue(point))
+			if t := point.Interval.EndTime.AsTime(); t.After(latest) {
+				latest = t
+			}
+		}
+	}
+	return stats, latest
+}
+
+// canaryFingerprint identifies the comparison of a metric's canary with its control
+func canaryFingerprint(metricType string, config CanaryConfig) string {
+	sum := sha256.Sum256([]byte("canary\x00" + metricType + "\x00" + config.Canary + "\x00" + config.Control))
+	return hex.EncodeToString(sum[:8])
+}
+
+// joinFilters combines two optional monitoring filters
+func joinFilters(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "":
+		return a
+	}
+	return a + " AND " + b
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CentralNotifierConfig forwards the anomalies of an agent, a detector watching one project, to
+// the central command, which routes the anomalies of every agent
+type CentralNotifierConfig struct {
+	URL   string `yaml:"url"`                 // base URL of the central server, e.g. https://anomalies.example.com
+	Token string `yaml:"token" secret:"true"` // bearer token, the agents.token of the central server
+	Agent string `yaml:"agent"`               // name of the agent in the logs of the central server, defaults to the project (and tenant)
+}
+
+// AgentsConfig lets agents report their anomalies to the central command
+type AgentsConfig struct {
+	Token    string `yaml:"token" secret:"true"` // bearer token the agents must send
+	DedupMin int    `yaml:"dedup_min"`           // minutes a received anomaly is remembered to drop its duplicates, defaults to 60
+}
+
+func (c AgentsConfig) validate() error {
+	if c.Token == "" {
+		return fmt.Errorf("no token configured")
+	}
+	if c.DedupMin < 0 {
+		return fmt.Errorf("dedup_min must not be negative")
+	}
+	return nil
+}
+
+// agentBatch is the JSON body of POST /agent/anomalies, the anomalies of a cycle of an agent
+type agentBatch struct {
+	Agent     string    `json:"agent"`
+	Anomalies []Anomaly `json:"anomalies"`
+}
+
+// agentError is the JSON body of POST /agent/errors, a failure of an agent
+type agentError struct {
+	Agent string `json:"agent"`
+	Error string `json:"error"`
+}
+
+// centralNotifier posts the anomalies and failures of an agent to the central server. It is not
+// a recorder: what the agent holds back stays held back.
+type centralNotifier struct {
+	name   string
+	config CentralNotifierConfig
+	client *http.Client
+}
+
+func newCentralNotifier(name string, detectorConfig *Config, config CentralNotifierConfig) (*centralNotifier, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("no url configured")
+	}
+	if config.Token == "" {
+		return nil, fmt.Errorf("no token configured")
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	if config.Agent == "" {
+		config.Agent = detectorConfig.ProjectID
+		if detectorConfig.Tenant != "" {
+			config.Agent += "/" + detectorConfig.Tenant
+		}
+	}
+	return &centralNotifier{name: name, config: config, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (n *centralNotifier) Name() string {
+	return n.name
+}
+
+func (n *centralNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	return postJSON(ctx, n.client, n.config.URL+"/agent/anomalies", n.header(), agentBatch{Agent: n.config.Agent, Anomalies: anomalies})
+}
+
+// ReportError forwards a failure of the agent, so the central command reports it like its own
+func (n *centralNotifier) ReportError(ctx context.Context, err error) error {
+	return postJSON(ctx, n.client, n.config.URL+"/agent/errors", n.header(), agentError{Agent: n.config.Agent, Error: err.Error()})
+}
+
+func (n *centralNotifier) header() http.Header {
+	header := http.Header{}
+	header.Set("Authorization", "Bearer "+n.config.Token)
+	return header
+}
+
+// agentReceiver accepts the anomalies of the agents and reports them through the router of the
+// central command, dropping the duplicates of agent replicas and retried requests
+type agentReceiver struct {
+	config AgentsConfig
+	router *Router
+
+	mu sync.Mutex
+	// seen holds when each anomaly report was received, by anomaly ID and end time, as an event
+	// still going on is reported again with the same ID
+	seen map[string]time.Time
+	// store keeps seen across restarts, nil when it is only kept in memory
+	store Store
+}
+
+// newAgentReceiver returns a receiver restoring the reports seen from a durable store
+func newAgentReceiver(ctx context.Context, config AgentsConfig, router *Router, store Store) *agentReceiver {
+	if config.DedupMin == 0 {
+		config.DedupMin = 60
+	}
+	a := &agentReceiver{config: config, router: router, seen: make(map[string]time.Time)}
+	if store != nil && store.Durable() {
+		a.store = store
+		if err := loadState(ctx, store, storeAgentsKey, &a.seen); err != nil {
+			log.Printf("Could not restore the anomaly reports received from agents: %v", err)
+		}
+	}
+	return a
+}
+
+// register adds the handlers of the agents to mux
+func (a *agentReceiver) register(mux *http.ServeMux) {
+	mux.HandleFunc("/agent/anomalies", func(w http.ResponseWriter, r *http.Request) {
+		var batch agentBatch
+		if !a.decode(w, r, &batch) {
+			return
+		}
+		anomalies := a.dedup(r.Context(), batch.Anomalies, a.router.now())
+		if dropped := len(batch.Anomalies) - len(anomalies); dropped > 0 {
+			log.Printf("Dropped %d duplicate anomalies from agent %s\n", dropped, batch.Agent)
+		}
+		if len(anomalies) > 0 {
+			log.Printf("Received %d anomalies from agent %s\n", len(anomalies), batch.Agent)
+			a.router.Report(r.Context(), anomalies)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("/agent/errors", func(w http.ResponseWriter, r *http.Request) {
+		var report agentError
+		if !a.decode(w, r, &report) {
+			return
+		}
+		log.Printf("Agent %s failed: %s\n", report.Agent, report.Error)
+		a.router.ReportError(r.Context(), fmt.Errorf("agent %s: %s", report.Agent, report.Error))
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// decode checks the method and token of an agent request and decodes its body into out,
+// answering the request itself when it is rejected
+func (a *agentReceiver) decode(w http.ResponseWriter, r *http.Request, out interface{}) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(a.config.Token)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(out); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// dedup returns the anomalies not received within dedup_min before now, and forgets the
+// reports older than that
+func (a *agentReceiver) dedup(ctx context.Context, anomalies []Anomaly, now time.Time) []Anomaly {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	window := time.Duration(a.config.DedupMin) * time.Minute
+	for key, at := range a.seen {
+		if now.Sub(at) > window {
+			delete(a.seen, key)
+		}
+	}
+	var fresh []Anomaly
+	for _, anomaly := range anomalies {
+		key := anomaly.ID + "@" + anomaly.EndTime.Format(time.RFC3339Nano)
+		if _, ok := a.seen[key]; ok {
+			continue
+		}
+		a.seen[key] = now
+		fresh = append(fresh, anomaly)
+	}
+	if a.store != nil {
+		if err := saveState(ctx, a.store, storeAgentsKey, a.seen); err != nil {
+			log.Printf("Could not save the anomaly reports received from agents: %v", err)
+		}
+	}
+	return fresh
+}
+
+// runCentral serves the central command: it detects nothing itself, and routes the anomalies the
+// agents report through its notifiers, silences, lifecycle and rate limits, with the silences,
+// feedback and events APIs of the serve command
+func runCentral(args []string) {
+	fs := flag.NewFlagSet("central", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	listenAddress := fs.String("listen", ":8080", "Address for the HTTP server to listen on")
+	fs.Parse(args)
+
+	config := mustLoadConfig(*configPath)
+	if config.Agents == nil {
+		log.Fatalf("The central command needs agents configured")
+	}
+	router := mustCreateRouter(config)
+
+	mux := http.NewServeMux()
+	newAgentReceiver(context.Background(), *config.Agents, router, config.store).register(mux)
+	registerSilenceHandlers(mux, router)
+	registerFeedbackHandlers(mux, router)
+	registerEventHandlers(mux, router)
+
+	log.Printf("Receiving the anomalies of agents on %s...\n", *listenAddress)
+	if err := config.Server.listenAndServe(*listenAddress, mux, "/agent/"); err != nil {
+		log.Fatalf("HTTP server failed: %v", err)
+	}
+}
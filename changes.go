@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// changesDefaultFilter selects the Admin Activity audit logs, which record every change to the
+	// configuration or metadata of the resources of a project
+	changesDefaultFilter = `logName:"cloudaudit.googleapis.com%2Factivity"`
+
+	// changesLogPages caps the pages of log entries read per cycle
+	changesLogPages = 5
+)
+
+// changesResourceLabels are the labels of the anomalies naming their resource as it appears in
+// the resource names of audit log entries, such as checkout in
+// projects/p/locations/l/services/checkout
+var changesResourceLabels = []string{
+	"service_name", "instance_name", "cluster_name", "function_name", "job_name", "bucket_name",
+	"topic_id", "subscription_id", "queue_id", "url_map_name", "backend_service_name", "forwarding_rule_name",
+}
+
+// ChangesConfig attaches the changes made to the resource of an anomaly shortly before it, such
+// as deployments, configuration edits and scaling actions, for faster root-cause analysis
+type ChangesConfig struct {
+	BeforeMin      int      `yaml:"before_min"`      // minutes before the start of an anomaly its changes are searched, defaults to 60
+	AfterMin       int      `yaml:"after_min"`       // minutes after the start of an anomaly its changes are searched, defaults to 5
+	MaxEvents      int      `yaml:"max_events"`      // changes attached to an anomaly, newest first, defaults to 5
+	Filter         string   `yaml:"filter"`          // Cloud Logging filter of the entries recording changes, defaults to the Admin Activity audit logs
+	ResourceLabels []string `yaml:"resource_labels"` // labels of the anomalies naming their resource, defaults to common ones such as service_name and instance_name
+}
+
+func (c ChangesConfig) validate() error {
+	if c.BeforeMin < 0 || c.AfterMin < 0 {
+		return fmt.Errorf("before_min and after_min must not be negative")
+	}
+	if c.MaxEvents < 0 {
+		return fmt.Errorf("max_events must not be negative")
+	}
+	return nil
+}
+
+// ChangeEvent is a change recorded in the audit logs around an anomaly
+type ChangeEvent struct {
+	Time      time.Time `json:"time" yaml:"time"`
+	Service   string    `json:"service,omitempty" yaml:"service,omitempty"`     // API the change was made through, e.g. run.googleapis.com
+	Method    string    `json:"method,omitempty" yaml:"method,omitempty"`       // e.g. google.cloud.run.v1.Services.ReplaceService
+	Resource  string    `json:"resource,omitempty" yaml:"resource,omitempty"`   // full name of the resource changed
+	Principal string    `json:"principal,omitempty" yaml:"principal,omitempty"` // who made the change
+}
+
+// changeCorrelator reads the changes of the project around the anomalies of a cycle
+type changeCorrelator struct {
+	config      ChangesConfig
+	projectID   string
+	credentials CredentialsConfig
+
+	mu   sync.Mutex
+	http *http.Client // created on first use
+}
+
+func newChangeCorrelator(config ChangesConfig, projectID string, credentials CredentialsConfig) *changeCorrelator {
+	if config.BeforeMin == 0 {
+		config.BeforeMin = 60
+	}
+	if config.AfterMin == 0 {
+		config.AfterMin = 5
+	}
+	if config.MaxEvents == 0 {
+		config.MaxEvents = 5
+	}
+	if config.Filter == "" {
+		config.Filter = changesDefaultFilter
+	}
+	if len(config.ResourceLabels) == 0 {
+		config.ResourceLabels = changesResourceLabels
+	}
+	return &changeCorrelator{config: config, projectID: projectID, credentials: credentials}
+}
+
+// attach sets the changes of the anomalies: those within before_min and after_min of their start
+// made to their resource, or to any resource of the project for anomalies without a resource
+// label. The changes of all the anomalies of a cycle are read with one query; when it fails
+// the anomalies are reported without changes.
+func (c *changeCorrelator) attach(ctx context.Context, anomalies []Anomaly, now time.Time) {
+	if c == nil || len(anomalies) == 0 {
+		return
+	}
+	before, after := time.Duration(c.config.BeforeMin)*time.Minute, time.Duration(c.config.AfterMin)*time.Minute
+	start, end := anomalies[0].Timestamp, anomalies[0].Timestamp
+	for _, anomaly := range anomalies[1:] {
+		if anomaly.Timestamp.Before(start) {
+			start = anomaly.Timestamp
+		}
+		if anomaly.Timestamp.After(end) {
+			end = anomaly.Timestamp
+		}
+	}
+	end = end.Add(after)
+	if end.After(now) {
+		end = now
+	}
+	changes, err := c.read(ctx, start.Add(-before), end)
+	if err != nil {
+		log.Printf("Could not read the changes around the anomalies: %v", err)
+		return
+	}
+	for i := range anomalies {
+		anomaly := &anomalies[i]
+		names := c.resourceNames(*anomaly)
+		anomaly.Changes = nil
+		for _, change := range changes {
+			if change.Time.Before(anomaly.Timestamp.Add(-before)) || change.Time.After(anomaly.Timestamp.Add(after)) {
+				continue
+			}
+			if len(names) > 0 && !changesResource(change.Resource, names) {
+				continue
+			}
+			anomaly.Changes = append(anomaly.Changes, change)
+			if len(anomaly.Changes) == c.config.MaxEvents {
+				break
+			}
+		}
+	}
+}
+
+// resourceNames returns the values of the resource labels of the anomaly
+func (c *changeCorrelator) resourceNames(anomaly Anomaly) []string {
+	var names []string
+	for _, label := range c.config.ResourceLabels {
+		if value := anomaly.Labels[label]; value != "" {
+			names = append(names, value)
+		}
+	}
+	return names
+}
+
+// changesResource reports whether one of the segments of the resource name is one of names
+func changesResource(resource string, names []string) bool {
+	for _, segment := range strings.Split(resource, "/") {
+		for _, name := range names {
+			if segment == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// read returns the changes of the project between start and end, newest first
+func (c *changeCorrelator) read(ctx context.Context, start, end time.Time) ([]ChangeEvent, error) {
+	client, err := c.httpClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	request := map[string]interface{}{
+		"resourceNames": []string{"projects/" + c.projectID},
+		"filter":        fmt.Sprintf("(%s) AND timestamp >= %q AND timestamp <= %q", c.config.Filter, start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339)),
+		"orderBy":       "timestamp desc",
+		"pageSize":      1000,
+	}
+	var changes []ChangeEvent
+	for page := 0; page < changesLogPages; page++ {
+		var response logEntries
+		if err := listLogEntries(ctx, client, request, &response); err != nil {
+			return nil, err
+		}
+		for _, entry := range response.Entries {
+			timestamp, _ := entry["timestamp"].(string)
+			at, err := time.Parse(time.RFC3339Nano, timestamp)
+			if err != nil {
+				continue
+			}
+			changes = append(changes, ChangeEvent{
+				Time:      at,
+				Service:   entryString(entry, "protoPayload.serviceName"),
+				Method:    entryString(entry, "protoPayload.methodName"),
+				Resource:  entryString(entry, "protoPayload.resourceName"),
+				Principal: entryString(entry, "protoPayload.authenticationInfo.principalEmail"),
+			})
+		}
+		if response.NextPageToken == "" {
+			break
+		}
+		request["pageToken"] = response.NextPageToken
+	}
+	sort.SliceStable(changes, func(i, j int) bool { return changes[i].Time.After(changes[j].Time) })
+	return changes, nil
+}
+
+// httpClient returns the client of the Logging API, creating it on first use
+func (c *changeCorrelator) httpClient(ctx context.Context) (*http.Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.http != nil {
+		return c.http, nil
+	}
+	client, err := newLoggingClient(ctx, c.credentials)
+	if err != nil {
+		return nil, err
+	}
+	c.http = client
+	return client, nil
+}
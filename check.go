@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// checkFailedExitCode is the exit status of a check that found anomalies. Errors exit with 1, so
+// a pipeline can tell a regression from a check that could not run.
+const checkFailedExitCode = 2
+
+// runCheck scores a recent window, such as the minutes since a deployment, against the baseline
+// preceding it and exits non-zero if anomalies are found. Nobody is notified.
+func runCheck(args []string) {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	credentials := addCredentialFlags(fs)
+	window := fs.Duration("window", 15*time.Minute, "Window to check, ending now")
+	since := fs.String("since", "", "Start of the window to check (RFC3339), e.g. the deployment time; overrides -window")
+	metrics := fs.String("metrics", "", "Comma-separated metric types to check (defaults to all configured metrics)")
+	severity := fs.String("severity", SeverityWarning, "Lowest severity that fails the check: warning or critical")
+	fs.Parse(args)
+
+	config := mustLoadConfig(*configPath)
+	config.Credentials.override(*credentials)
+	mustDiscoverWorkloads(config)
+	if *severity != SeverityWarning && *severity != SeverityCritical {
+		log.Fatalf("Invalid -severity %q, expected warning or critical", *severity)
+	}
+	if *metrics != "" {
+		if err := config.selectMetrics(strings.Split(*metrics, ",")); err != nil {
+			log.Fatalf("Invalid -metrics: %v", err)
+		}
+	}
+
+	endTime := config.now()
+	startTime := endTime.Add(-*window)
+	if *since != "" {
+		var err error
+		startTime, err = time.Parse(time.RFC3339, *since)
+		if err != nil {
+			log.Fatalf("Invalid -since time: %v", err)
+		}
+	}
+	if !endTime.After(startTime) {
+		log.Fatalf("The check window is empty: %s is not in the past", startTime.Format(time.RFC3339))
+	}
+
+	client := mustCreateClient(config.Credentials, config.MonitoringAPI)
+	mustValidateFilters(client, config)
+
+	// A single cycle over the whole window, against the baseline that ends where it starts (unless
+	// it is pinned), so the points being checked do not dilute the baseline
+	checkWindow := endTime.Sub(startTime)
+	anomalies, _, err := backtest(client, config, startTime, endTime, checkWindow, checkWindow)
+	if err != nil {
+		log.Fatalf("Check failed to run: %v", err)
+	}
+
+	var failing []Anomaly
+	for _, anomaly := range anomalies {
+		if *severity == SeverityWarning || anomaly.Severity == SeverityCritical {
+			failing = append(failing, anomaly)
+		}
+	}
+	printAnomalies(failing)
+	if len(failing) > 0 {
+		fmt.Printf("Check failed: %d anomalies from %s to %s\n", len(failing), startTime.Format(time.RFC3339), endTime.Format(time.RFC3339))
+		os.Exit(checkFailedExitCode)
+	}
+	fmt.Printf("Check passed: no anomalies in %d metrics from %s to %s\n", len(config.Metrics), startTime.Format(time.RFC3339), endTime.Format(time.RFC3339))
+}
+
+// selectMetrics limits the configuration to the given metric types, which must be configured
+func (c *Config) selectMetrics(types []string) error {
+	configured := make(map[string]MetricConfig, len(c.Metrics))
+	for _, metric := range c.Metrics {
+		configured[metric.Type] = metric
+	}
+	var selected []MetricConfig
+	for _, metricType := range types {
+		metric, ok := configured[strings.TrimSpace(metricType)]
+		if !ok {
+			return fmt.Errorf("metric %s is not configured", metricType)
+		}
+		selected = append(selected, metric)
+	}
+	c.Metrics = selected
+	return nil
+}
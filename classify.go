@@ -0,0 +1,75 @@
+package main
+
+import "math"
+
+const (
+	// TypeSpike is a short upward deviation
+	TypeSpike = "spike"
+	// TypeDip is a short downward deviation
+	TypeDip = "dip"
+	// TypeLevelShift is a sustained deviation at a new, roughly constant level
+	TypeLevelShift = "level_shift"
+	// TypeTrendBreak is a sustained deviation that keeps growing
+	TypeTrendBreak = "trend_break"
+
+	// sustainedRunLength is the number of consecutive deviating points that make a deviation
+	// sustained rather than a blip
+	sustainedRunLength = 3
+	// trendFit is the coefficient of determination above which a sustained run is a trend
+	trendFit = 0.8
+)
+
+// classifyDeviation classifies the deviation of point i from the Z-scores of a series ordered
+// oldest first. A deviation is sustained when it belongs to a run of at least
+// sustainedRunLength consecutive points beyond the threshold on the same side of the mean;
+// a sustained run whose Z-scores grow steadily away from the mean is a trend break, otherwise
+// a level shift. Short deviations are spikes or dips.
+func classifyDeviation(zScores []float64, i int, threshold float64) string {
+	sign := math.Copysign(1, zScores[i])
+	deviates := func(j int) bool {
+		return math.Abs(zScores[j]) > threshold && math.Copysign(1, zScores[j]) == sign
+	}
+
+	start, end := i, i
+	for start > 0 && deviates(start-1) {
+		start--
+	}
+	for end < len(zScores)-1 && deviates(end+1) {
+		end++
+	}
+
+	if end-start+1 < sustainedRunLength {
+		if sign > 0 {
+			return TypeSpike
+		}
+		return TypeDip
+	}
+	if growsSteadily(zScores[start:end+1], sign) {
+		return TypeTrendBreak
+	}
+	return TypeLevelShift
+}
+
+// growsSteadily reports whether a run of Z-scores moves away from the mean along a line, by
+// fitting a line against the point index
+func growsSteadily(run []float64, sign float64) bool {
+	n := float64(len(run))
+	var sumX, sumY, sumXX, sumXY, sumYY float64
+	for x, z := range run {
+		y := z * sign // distance from the mean, positive on both sides
+		fx := float64(x)
+		sumX += fx
+		sumY += y
+		sumXX += fx * fx
+		sumXY += fx * y
+		sumYY += y * y
+	}
+	covariance := n*sumXY - sumX*sumY
+	varianceX := n*sumXX - sumX*sumX
+	varianceY := n*sumYY - sumY*sumY
+	if covariance <= 0 || varianceX == 0 || varianceY == 0 {
+		return false
+	}
+	rSquared := covariance * covariance / (varianceX * varianceY)
+	return rSquared >= trendFit
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Clock tells the detector the time: where its fetch windows end, when its polling cycles run
+// and when the anomalies it detects are seen. It is the wall clock but in replays and backtests,
+// which run on the time of the data they go through, and in tests controlling time.
+type Clock interface {
+	Now() time.Time
+	// NewTicker returns a channel receiving the time every interval, with the function stopping it
+	NewTicker(interval time.Duration) (<-chan time.Time, func())
+}
+
+// wallClock is the time of the machine
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+func (wallClock) NewTicker(interval time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(interval)
+	return ticker.C, ticker.Stop
+}
+
+// shiftedClock runs at the pace of the wall clock from a time in the past, such as the start of a
+// recording being replayed
+type shiftedClock struct {
+	offset time.Duration
+}
+
+// newShiftedClock returns a clock telling start now
+func newShiftedClock(start time.Time) shiftedClock {
+	return shiftedClock{offset: start.Sub(time.Now())}
+}
+
+func (c shiftedClock) Now() time.Time {
+	return time.Now().Add(c.offset)
+}
+
+func (c shiftedClock) NewTicker(interval time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(interval)
+	ticks := make(chan time.Time, 1)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case t := <-ticker.C:
+				select {
+				case ticks <- t.Add(c.offset):
+				default: // dropped like the ticks of a slow receiver of a time.Ticker
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return ticks, func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
+
+// manualClock only moves when it is told to, for backtests and tests stepping through time. Its
+// tickers tick as it is moved past their next tick, at most once per move like a time.Ticker
+// with a slow receiver.
+type manualClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers []*manualTicker
+}
+
+type manualTicker struct {
+	interval time.Duration
+	next     time.Time
+	ticks    chan time.Time
+}
+
+// newManualClock returns a clock standing at start
+func newManualClock(start time.Time) *manualClock {
+	return &manualClock{now: start}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) NewTicker(interval time.Duration) (<-chan time.Time, func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ticker := &manualTicker{interval: interval, next: c.now.Add(interval), ticks: make(chan time.Time, 1)}
+	c.tickers = append(c.tickers, ticker)
+	return ticker.ticks, func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, t := range c.tickers {
+			if t == ticker {
+				c.tickers = append(c.tickers[:i], c.tickers[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// Set moves the clock to t, ticking the tickers it moves past. Moving it back ticks none.
+func (c *manualClock) Set(t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = t
+	for _, ticker := range c.tickers {
+		if t.Before(ticker.next) {
+			continue
+		}
+		for !t.Before(ticker.next) {
+			ticker.next = ticker.next.Add(ticker.interval)
+		}
+		select {
+		case ticker.ticks <- t:
+		default:
+		}
+	}
+}
+
+// Advance moves the clock forward by d
+func (c *manualClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+// now returns the time on the clock of the configuration
+func (c *Config) now() time.Time {
+	return c.timeSource().Now()
+}
+
+// timeSource returns the clock of the configuration: the start of the recording being replayed
+// with monitoring_api.replay, the wall clock otherwise
+func (c *Config) timeSource() Clock {
+	if c.clock == nil {
+		return wallClock{}
+	}
+	return c.clock
+}
+
+// recordingStart returns the time the recording at path was started at, the earliest end of the
+// time intervals it requested other than pinned, the end of a pinned baseline window. A detector
+// replaying it starts at that time so its fetch windows, schedules and active hours are those of
+// the recorded run.
+func recordingStart(path string, pinned time.Time) (time.Time, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("could not open recording: %v", err)
+	}
+	defer file.Close()
+
+	var start time.Time
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 256*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var call recordedCall
+		if err := json.Unmarshal(scanner.Bytes(), &call); err != nil {
+			return time.Time{}, fmt.Errorf("could not read recording %s, line %d: %v", path, line, err)
+		}
+		if !strings.HasSuffix(call.Method, "/ListTimeSeries") {
+			continue
+		}
+		var request monitoringpb.ListTimeSeriesRequest
+		if protojson.Unmarshal(call.Request, &request) != nil || request.GetInterval().GetEndTime() == nil {
+			continue
+		}
+		end := request.Interval.EndTime.AsTime()
+		if !end.Equal(pinned) && (start.IsZero() || end.Before(start)) {
+			start = end
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, fmt.Errorf("could not read recording %s: %v", path, err)
+	}
+	if start.IsZero() {
+		return time.Time{}, fmt.Errorf("recording %s has no time series requests", path)
+	}
+	return start, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// clockSkewObservations is the number of cycles the clock skew is measured over
+const clockSkewObservations = 10
+
+// Names of the Prometheus gauges of the measured clock skew, and of whether it is over its
+// threshold
+const (
+	clockSkewMetricName         = "gcp_anomaly_detector_clock_skew_seconds"
+	clockSkewExceededMetricName = "gcp_anomaly_detector_clock_skew_exceeded"
+)
+
+// ClockSkewConfig measures the skew of the local clock against the timestamps of the newest
+// data of the Monitoring API, as a drifting container clock shifts every fetch window
+type ClockSkewConfig struct {
+	ThresholdSec int  `yaml:"threshold_sec"` // skew from which it is warned about, in seconds, defaults to 60
+	MaxSec       int  `yaml:"max_sec"`       // largest skew of a clock running behind that can be measured, in seconds, defaults to 900
+	Adjust       bool `yaml:"adjust"`        // runs the detector on the time of the Monitoring API, the local time corrected by a clock running behind
+}
+
+func (c ClockSkewConfig) validate() error {
+	if c.ThresholdSec < 0 {
+		return fmt.Errorf("threshold_sec must not be negative")
+	}
+	if c.MaxSec < 0 {
+		return fmt.Errorf("max_sec must not be negative")
+	}
+	return nil
+}
+
+// clockSkew measures the skew of the local clock. The recent windows are fetched up to max_sec
+// past the local time, so a point stamped after it shows the local clock running behind by at
+// least as much. A clock running ahead makes the newest points look older instead, which late
+// ingestion does too, so only its upper bound is known: the age of the freshest point.
+type clockSkew struct {
+	config ClockSkewConfig
+
+	mu       sync.Mutex
+	observed []time.Duration // time of the newest point less the local time, in the last cycles
+	skew     time.Duration   // the largest of observed
+	warned   bool
+}
+
+func newClockSkew(config ClockSkewConfig) *clockSkew {
+	if config.ThresholdSec == 0 {
+		config.ThresholdSec = 60
+	}
+	if config.MaxSec == 0 {
+		config.MaxSec = 900
+	}
+	return &clockSkew{config: config}
+}
+
+// horizon returns how far past the local time the recent windows are fetched
+func (s *clockSkew) horizon() time.Duration {
+	if s == nil {
+		return 0
+	}
+	return time.Duration(s.config.MaxSec) * time.Second
+}
+
+// observe records the time of the newest point of the series of a cycle against now, the time of
+// the detector, and warns when the skew measured over the last cycles crosses the threshold or
+// falls back. With adjust, now already holds the correction, which is taken back out so the skew
+// stays that of the local clock.
+func (s *clockSkew) observe(series []*monitoringpb.TimeSeries, now time.Time) {
+	if s == nil {
+		return
+	}
+	var newest time.Time
+	for _, ts := range series {
+		for _, point := range ts.Points {
+			if t := point.Interval.EndTime.AsTime(); t.After(newest) {
+				newest = t
+			}
+		}
+	}
+	if newest.IsZero() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.config.Adjust {
+		now = now.Add(-s.correctionLocked())
+	}
+	s.observed = append(s.observed, newest.Sub(now))
+	if len(s.observed) > clockSkewObservations {
+		s.observed = s.observed[len(s.observed)-clockSkewObservations:]
+	}
+	s.skew = s.observed[0]
+	for _, skew := range s.observed[1:] {
+		s.skew = max(s.skew, skew)
+	}
+	s.skew = s.skew.Round(time.Second)
+
+	exceeded := s.exceeded()
+	switch {
+	case exceeded && !s.warned && s.skew > 0:
+		log.Printf("Clock skew: the Monitoring API has points %s past the local time, the local clock runs behind by at least as much\n", s.skew)
+	case exceeded && !s.warned:
+		log.Printf("Clock skew: the newest points of the Monitoring API are %s older than the local time, the local clock may run ahead by up to as much, or the metrics are ingested late\n", -s.skew)
+	case !exceeded && s.warned:
+		log.Printf("Clock skew back within %ds: %s\n", s.config.ThresholdSec, s.skew)
+	}
+	s.warned = exceeded
+}
+
+// exceeded reports whether the measured skew is over the threshold; s.mu must be held
+func (s *clockSkew) exceeded() bool {
+	return s.skew.Abs() > time.Duration(s.config.ThresholdSec)*time.Second
+}
+
+// measured returns the measured skew, positive for a local clock running behind, and whether it
+// is over the threshold
+func (s *clockSkew) measured() (time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.skew, s.exceeded()
+}
+
+// correction returns the offset of the time of the Monitoring API from the local time: the skew
+// of a clock running behind by more than the threshold, none otherwise. Within the threshold,
+// points can end after the local time by up to their alignment period, and a clock running ahead
+// looks like late ingestion, which ingestion delays account for.
+func (s *clockSkew) correction() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.correctionLocked()
+}
+
+// correctionLocked is correction with s.mu held
+func (s *clockSkew) correctionLocked() time.Duration {
+	if !s.exceeded() {
+		return 0
+	}
+	return max(s.skew, 0)
+}
+
+// otlpMetrics returns the measured skew and whether it is over the threshold as OTLP gauges
+func (s *clockSkew) otlpMetrics(now time.Time) []map[string]interface{} {
+	skew, exceeded := s.measured()
+	flag := 0
+	if exceeded {
+		flag = 1
+	}
+	return []map[string]interface{}{
+		{
+			"name":        "gcp_anomaly_detector.clock.skew",
+			"description": "Time of the newest point of the Monitoring API less the local time, positive for a local clock running behind",
+			"unit":        "s",
+			"gauge": map[string]interface{}{"dataPoints": []map[string]interface{}{{
+				"timeUnixNano": strconv.FormatInt(now.UnixNano(), 10),
+				"asDouble":     skew.Seconds(),
+			}}},
+		},
+		{
+			"name":        "gcp_anomaly_detector.clock.skew_exceeded",
+			"description": "1 when the clock skew is over its threshold, 0 otherwise",
+			"unit":        "1",
+			"gauge": map[string]interface{}{"dataPoints": []map[string]interface{}{{
+				"timeUnixNano": strconv.FormatInt(now.UnixNano(), 10),
+				"asInt":        strconv.Itoa(flag),
+			}}},
+		},
+	}
+}
+
+// skewedClock is the wall clock corrected by the measured skew, the time of the Monitoring API
+type skewedClock struct {
+	skew *clockSkew
+}
+
+func (c skewedClock) Now() time.Time {
+	return time.Now().Add(c.skew.correction())
+}
+
+func (c skewedClock) NewTicker(interval time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(interval)
+	ticks := make(chan time.Time, 1)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case t := <-ticker.C:
+				select {
+				case ticks <- t.Add(c.skew.correction()):
+				default: // dropped like the ticks of a slow receiver of a time.Ticker
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return ticks, func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+const (
+	// completenessFlag scores incomplete series as usual and marks their anomalies
+	completenessFlag = "flag"
+	// completenessDownWeight scales the Z-scores of incomplete series by their completeness
+	completenessDownWeight = "down_weight"
+	// completenessSkip leaves incomplete series unscored for the cycle
+	completenessSkip = "skip"
+)
+
+// CompletenessConfig checks every cycle that each series has the points expected over the recent
+// window, so a series that only reported a couple of points is not scored as if it were complete
+type CompletenessConfig struct {
+	MinRatio float64 `yaml:"min_ratio"` // share of the expected points below which a series is incomplete, defaults to 0.8
+	Action   string  `yaml:"action"`    // flag, down_weight or skip the incomplete series, defaults to flag
+}
+
+func (c CompletenessConfig) validate() error {
+	if c.MinRatio < 0 || c.MinRatio > 1 {
+		return fmt.Errorf("min_ratio must be between 0 and 1")
+	}
+	switch c.Action {
+	case "", completenessFlag, completenessDownWeight, completenessSkip:
+	default:
+		return fmt.Errorf("unknown action %q, expected flag, down_weight or skip", c.Action)
+	}
+	return nil
+}
+
+// completenessChecker compares the points of the series of a cycle with those expected over the
+// recent window. The sampling period of a series is the alignment_period of its metric, else the
+// shortest time between two of its points in the baseline, else in the recent window.
+type completenessChecker struct {
+	config  CompletenessConfig
+	window  time.Duration
+	periods map[string]time.Duration // alignment periods, by metric type
+	// intervals holds the sampling interval of the series of the baseline, by fingerprint. It is
+	// empty for baselines restored from snapshots, which keep no point times.
+	intervals map[string]time.Duration
+}
+
+func newCompletenessChecker(config CompletenessConfig, metrics []MetricConfig, window time.Duration) *completenessChecker {
+	if config.MinRatio == 0 {
+		config.MinRatio = 0.8
+	}
+	if config.Action == "" {
+		config.Action = completenessFlag
+	}
+	periods := make(map[string]time.Duration)
+	for _, metric := range metrics {
+		if metric.AlignmentPeriod > 0 {
+			periods[metric.Type] = time.Duration(metric.AlignmentPeriod) * time.Second
+		}
+	}
+	return &completenessChecker{config: config, window: window, periods: periods, intervals: make(map[string]time.Duration)}
+}
+
+// learn records the sampling intervals of the accumulated baseline series
+func (c *completenessChecker) learn(accumulator *baselineAccumulator) {
+	if c == nil {
+		return
+	}
+	for fingerprint, series := range accumulator.byKey {
+		if series.interval > 0 {
+			c.intervals[fingerprint] = series.interval
+		}
+	}
+}
+
+// check returns the share of the expected points the series has, with the points expected, and
+// whether that is below min_ratio. A series whose sampling period is unknown is complete.
+func (c *completenessChecker) check(ts *monitoringpb.TimeSeries, fingerprint string) (float64, int, bool) {
+	if c == nil || c.window <= 0 {
+		return 1, 0, false
+	}
+	period := c.periods[ts.GetMetric().GetType()]
+	if period == 0 {
+		period = c.intervals[fingerprint]
+	}
+	if period == 0 {
+		period = shortestGap(ts.Points)
+	}
+	if period <= 0 {
+		return 1, 0, false
+	}
+	expected := int(c.window / period)
+	if expected <= 1 {
+		return 1, expected, false
+	}
+	ratio := math.Min(1, float64(len(ts.Points))/float64(expected))
+	return ratio, expected, ratio < c.config.MinRatio
+}
+
+// shortestGap returns the shortest time between two consecutive points, zero with fewer than two
+func shortestGap(points []*monitoringpb.Point) time.Duration {
+	var shortest time.Duration
+	for i := 1; i < len(points); i++ {
+		gap := absDuration(points[i].Interval.EndTime.AsTime().Sub(points[i-1].Interval.EndTime.AsTime()))
+		if gap > 0 && (shortest == 0 || gap < shortest) {
+			shortest = gap
+		}
+	}
+	return shortest
+}
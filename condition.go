@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// alertCondition is a compiled CEL condition deciding which points of a metric are anomalous in
+// place of the Z-score threshold
+type alertCondition struct {
+	source   string
+	program  cel.Program
+	metadata map[string]string // static labels of the metric
+}
+
+// conditionEnv declares the variables and functions conditions are written with
+var conditionEnv = mustConditionEnv()
+
+func mustConditionEnv() *cel.Env {
+	env, err := cel.NewEnv(
+		// Lets conditions compare the double variables with integer literals, e.g. value > 100
+		cel.CrossTypeNumericComparisons(true),
+		cel.Variable("zscore", cel.DoubleType),
+		cel.Variable("value", cel.DoubleType),
+		cel.Variable("metric", cel.StringType),
+		cel.Variable("labels", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("metadata", cel.MapType(cel.StringType, cel.StringType)),
+		cel.Variable("now", cel.TimestampType),
+		cel.Function("hour",
+			cel.Overload("hour_timestamp", []*cel.Type{cel.TimestampType}, cel.IntType,
+				cel.UnaryBinding(func(t ref.Val) ref.Val {
+					return types.Int(t.(types.Timestamp).Time.UTC().Hour())
+				}))),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return env
+}
+
+// compileCondition compiles a condition, which must evaluate to a bool
+func compileCondition(source string) (*alertCondition, error) {
+	ast, issues := conditionEnv.Compile(source)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("condition evaluates to %s, not bool", ast.OutputType())
+	}
+	program, err := conditionEnv.Program(ast)
+	if err != nil {
+		return nil, err
+	}
+	return &alertCondition{source: source, program: program}, nil
+}
+
+// compileConditions compiles the conditions of the metrics that have one, by metric type
+func compileConditions(metrics []MetricConfig) (map[string]*alertCondition, error) {
+	conditions := make(map[string]*alertCondition)
+	for _, metric := range metrics {
+		if metric.Condition == "" {
+			continue
+		}
+		condition, err := compileCondition(metric.Condition)
+		if err != nil {
+			return nil, fmt.Errorf("metric %s: condition: %v", metric.Type, err)
+		}
+		condition.metadata = metric.Labels
+		if condition.metadata == nil {
+			condition.metadata = map[string]string{}
+		}
+		conditions[metric.Type] = condition
+	}
+	return conditions, nil
+}
+
+// matches evaluates the condition for a point. now is the time of the point, so backtests judge
+// points by when they happened. A condition failing to evaluate, such as on a missing label, does
+// not match.
+func (c *alertCondition) matches(metricType string, zScore, value float64, labels map[string]string, now time.Time) bool {
+	out, _, err := c.program.Eval(map[string]interface{}{
+		"zscore":   zScore,
+		"value":    value,
+		"metric":   metricType,
+		"labels":   labels,
+		"metadata": c.metadata,
+		"now":      now,
+	})
+	if err != nil {
+		return false
+	}
+	matched, ok := out.Value().(bool)
+	return ok && matched
+}
@@ -0,0 +1,658 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"gopkg.in/yaml.v2"
+)
+
+type Config struct {
+	Metrics           []MetricConfig         `yaml:"metrics"`
+	Discovery         DiscoveryConfig        `yaml:"discovery"`    // adds the metrics of the workloads found in the project
+	Presets           PresetsConfig          `yaml:"presets"`      // adds ready-made metric sets, such as billing
+	PollingTime       int                    `yaml:"polling_time"` // in seconds
+	ProjectID         string                 `yaml:"project_id"`
+	BaselineDuration  int                    `yaml:"baseline_duration"`   // in days
+	BaselineWindow    *BaselineWindowConfig  `yaml:"baseline_window"`     // fixed time range of the baseline in place of the trailing baseline_duration
+	RecentDuration    int                    `yaml:"recent_duration"`     // in minutes
+	Filters           map[string]string      `yaml:"filters"`             // map of metric to filter string
+	ZScoreThreshold   float64                `yaml:"z_score_threshold"`   // Z-score threshold for anomaly detection
+	CriticalZScore    float64                `yaml:"critical_z_score"`    // Z-score above which anomalies are critical, defaults to 1.5 times the threshold
+	Notifiers         []NotifierConfig       `yaml:"notifiers"`           // destinations for detected anomalies
+	Tenant            string                 `yaml:"tenant"`              // tenant name when loaded from a config directory
+	SilencesPath      string                 `yaml:"silences_path"`       // local file or gs:// URI where silences are persisted
+	Suppressions      []SuppressionRule      `yaml:"suppressions"`        // series whose anomalies are never notified
+	Inhibitions       []InhibitionRule       `yaml:"inhibitions"`         // anomalies not notified while another anomaly they follow from is open
+	Remediations      []RemediationRule      `yaml:"remediations"`        // actions run automatically for matching anomalies
+	ConfigSync        *ConfigSyncConfig      `yaml:"config_sync"`         // runs on the configuration of a Git repository, applying its changes
+	FeedbackPath      string                 `yaml:"feedback_path"`       // local file or gs:// URI where anomaly labels are persisted
+	DetectionWorkers  int                    `yaml:"detection_workers"`   // series scored concurrently, defaults to the number of CPUs
+	MinBaselinePoints int                    `yaml:"min_baseline_points"` // baseline points a series needs to be scored, defaults to 30
+	Flatline          FlatlineConfig         `yaml:"flatline"`            // detection of series stuck at a constant value
+	Delta             DeltaConfig            `yaml:"delta"`               // detection of abrupt shifts of the mean between cycles
+	LeaderElection    *LeaderElectionConfig  `yaml:"leader_election"`     // only the elected replica notifies
+	RateLimit         RateLimitConfig        `yaml:"rate_limit"`          // caps the notifications sent in an alert storm
+	Storm             StormConfig            `yaml:"storm"`               // collapses the notifications of an alert storm into one alert
+	Sharding          ShardingConfig         `yaml:"sharding"`            // spreads the metrics over several replicas
+	Credentials       CredentialsConfig      `yaml:"credentials"`         // credentials of the Monitoring client, Application Default Credentials by default
+	MonitoringAPI     MonitoringAPIConfig    `yaml:"monitoring_api"`      // endpoint and proxy of the Monitoring API
+	ZeroStdDev        ZeroStdDevConfig       `yaml:"zero_stddev"`         // scoring against baselines without variance
+	TopN              int                    `yaml:"top_n"`               // most anomalous series to report each cycle, 0 disables
+	BaselinePath      string                 `yaml:"baseline_path"`       // local file or gs:// URI of the persisted baseline
+	BaselineMaxAge    int                    `yaml:"baseline_max_age"`    // in hours, 0 keeps a persisted baseline forever
+	RestoreBaseline   bool                   `yaml:"restore_baseline"`    // starts from the baseline at baseline_path instead of fetching the historical window
+	Export            *ExportConfig          `yaml:"export"`              // periodic Parquet export of the baselines and scores
+	Injection         *InjectionConfig       `yaml:"injection"`           // synthetic anomalies testing notification delivery
+	OTLP              *OTLPConfig            `yaml:"otlp"`                // push of the scores and anomaly counts to an OpenTelemetry collector
+	Heartbeat         *HeartbeatConfig       `yaml:"heartbeat"`           // dead man's switch pinged after successful cycles
+	Lifecycle         LifecycleConfig        `yaml:"lifecycle"`           // tracking of the anomalies as events from open to resolved
+	AnomalySchema     string                 `yaml:"anomaly_schema"`      // version of the anomaly payload of JSON destinations and responses, defaults to v1
+	WarmUpMin         int                    `yaml:"warm_up_min"`         // minutes after the baseline is initialised during which anomalies are only logged
+	LevelShift        LevelShiftConfig       `yaml:"level_shift"`         // rebaselining of series after sustained level shifts
+	Report            *ReportConfig          `yaml:"report"`              // delivery of the summaries of the report command
+	Service           ServiceConfig          `yaml:"service"`             // liveness reported to systemd or the Windows service control manager
+	BaselineQuality   BaselineQualityConfig  `yaml:"baseline_quality"`    // warnings about, or skipping of, series with sparse or unstable baselines
+	BaselineChunk     int                    `yaml:"baseline_chunk"`      // in hours, longest part of the baseline window fetched with one query, defaults to 168
+	FastStart         *FastStartConfig       `yaml:"fast_start"`          // detection from the most recent history while the rest of the baseline is fetched
+	CycleOverrun      string                 `yaml:"cycle_overrun"`       // skip or delay the cycles a cycle outlasting its polling interval overlaps, defaults to skip
+	AnomalyContext    *AnomalyContextConfig  `yaml:"anomaly_context"`     // newest values of the series and their sparkline attached to anomalies
+	Links             *LinksConfig           `yaml:"links"`               // Metrics Explorer links and charts of the series of anomalies
+	Rollouts          *RolloutsConfig        `yaml:"rollouts"`            // suppression or downgrading of the anomalies during deployments
+	IngestionDelay    IngestionDelayConfig   `yaml:"ingestion_delay"`     // lag of the recent windows behind the ingestion delay of the metrics
+	Backfill          *BackfillConfig        `yaml:"backfill"`            // detection over the time the detector was down when it starts again
+	Changes           *ChangesConfig         `yaml:"changes"`             // changes from the audit logs attached to the anomalies they may have caused
+	AssetInventory    *AssetInventoryConfig  `yaml:"asset_inventory"`     // labels of the resources and projects of the anomalies from Cloud Asset Inventory
+	Traces            *TracesConfig          `yaml:"traces"`              // example traces from Cloud Trace attached to the anomalies of latency metrics
+	Agents            *AgentsConfig          `yaml:"agents"`              // agents whose anomalies the central command accepts
+	Server            *ServerConfig          `yaml:"server"`              // TLS, client certificates and authentication of the HTTP server and gRPC admin service
+	TimeDisplay       TimeDisplayConfig      `yaml:"time_display"`        // layout and time zone of the times in notifications, logs and reports
+	Health            *HealthConfig          `yaml:"health"`              // composite health scores of services
+	ClockSkew         *ClockSkewConfig       `yaml:"clock_skew"`          // measures the skew of the local clock against the Monitoring API
+	Trends            *TrendsConfig          `yaml:"trends"`              // daily history of the metrics their long-term trends are derived from
+	Store             StoreConfig            `yaml:"store"`               // backend of the baselines, recent anomalies, trends and agent reports, in memory by default
+	FeatureFlags      *FeatureFlagsConfig    `yaml:"feature_flags"`       // turns metrics, detectors and notifiers on and off at runtime
+	Completeness      *CompletenessConfig    `yaml:"completeness"`        // checks that every series has the points expected over the recent window
+	SharedBaselines   []SharedBaselineConfig `yaml:"shared_baselines"`    // baselines trained on the series of several metrics or series, which are scored against them
+	ReadOnly          bool                   `yaml:"read_only"`           // refuses every network sink, so the detector only reads metrics and writes local files
+
+	// clock tells the time of the detection cycles, the wall clock when nil
+	clock Clock
+	// skew measures the skew of the local clock with clock_skew
+	skew *clockSkew
+	// timings records how the polling cycles keep to their schedule, nil until they are scheduled
+	timings *cycleTimings
+	// uptimeChecks are the display names of the uptime checks by ID, for the uptime preset
+	uptimeChecks map[string]string
+	// flags evaluates the feature flags of the metrics, detectors and notifiers, nil without feature_flags
+	flags *featureFlags
+	// store keeps the state of the detector in the backend of store
+	store Store
+}
+
+// MetricConfig configures a monitored metric. In YAML an entry is either the metric type as a
+// plain string or a mapping with per-metric overrides.
+type MetricConfig struct {
+	Type        string             `yaml:"type"`
+	DisplayName string             `yaml:"display_name"` // optional name used in notifications and reports instead of the type
+	Labels      map[string]string  `yaml:"labels"`       // static labels such as team, service, runbook_url or dashboard_url, copied onto its anomalies
+	PollingTime int                `yaml:"polling_time"` // in seconds, overrides the global polling_time
+	Tags        []string           `yaml:"tags"`         // free-form tags notifiers can select metrics by, e.g. customer-facing
+	Forecast    *ForecastConfig    `yaml:"forecast"`     // optional early warning when the metric is on track to cross a limit
+	Ratio       *RatioConfig       `yaml:"ratio"`        // derives the metric from two fetched series instead of fetching it
+	Expression  *ExpressionConfig  `yaml:"expression"`   // derives the metric from an expression over fetched series
+	Canary      *CanaryConfig      `yaml:"canary"`       // compares two populations of the metric's series with each other
+	Peers       *PeersConfig       `yaml:"peers"`        // compares groups of the metric's series, such as regions, with each other
+	Replicas    *ReplicasConfig    `yaml:"replicas"`     // compares each of the metric's series with the others of its group
+	Condition   string             `yaml:"condition"`    // CEL expression deciding which points are anomalous in place of the Z-score threshold
+	Reference   *ReferenceConfig   `yaml:"reference"`    // takes the baseline from another environment
+	ActiveHours *ActiveHoursConfig `yaml:"active_hours"` // limits detection or alerting to recurring daily windows
+	Windows     *WindowsConfig     `yaml:"windows"`      // scores the means of a fast and a slow window instead of single points
+	Seasonality *SeasonalityConfig `yaml:"seasonality"`  // keeps separate baselines for weekdays and weekends
+	Transform   *TransformConfig   `yaml:"transform"`    // maps the values before they enter the baseline and are scored, e.g. log
+	States      *StatesConfig      `yaml:"states"`       // scores bool or string states by their numbers or as transitions between them
+	Baseline    *BaselineStats     `yaml:"baseline"`     // fixed baseline statistics of the whole metric, which is then never fetched for a baseline
+	Cost        *CostConfig        `yaml:"cost"`         // describes the metric's anomalies as cost anomalies
+	Rollups     *RollupsConfig     `yaml:"rollups"`      // also scores the metric summed per region and overall, for metrics grouped per zone
+	Flag        string             `yaml:"flag"`         // feature flag the metric is only fetched and scored while on
+	Counter     bool               `yaml:"counter"`      // the metric, or the inputs of a derived metric, count events: raw cumulative points are scored as rates across resets
+	// AlignmentPeriod, in seconds, samples the metric at a fixed granularity with Aligner rather
+	// than using the raw points; it applies to the baseline, recent and derived inputs alike
+	AlignmentPeriod int    `yaml:"alignment_period"`
+	Aligner         string `yaml:"aligner"` // e.g. ALIGN_MEAN, ALIGN_MAX or ALIGN_RATE, defaults to ALIGN_MEAN
+	// GroupByFields reduces the aligned series to one series per combination of these labels,
+	// e.g. resource.labels.service_name, with Reducer; it requires alignment_period
+	GroupByFields []string `yaml:"group_by_fields"`
+	Reducer       string   `yaml:"reducer"` // e.g. REDUCE_SUM or REDUCE_PERCENTILE_99, defaults to REDUCE_SUM with group_by_fields
+	// IngestionDelaySec, in seconds, ends the recent window this long before now, in place of
+	// the delay measured with ingestion_delay.auto
+	IngestionDelaySec int `yaml:"ingestion_delay_sec"`
+	// EvaluationOffsetMin, in minutes, ends the recent window this much earlier still, on top of
+	// the ingestion lag, for metrics reported late on a known schedule such as billing
+	EvaluationOffsetMin int `yaml:"evaluation_offset_min"`
+	// WindowAlignMin, in minutes, rounds the end of the recent window down to a multiple of it in
+	// UTC, so metrics written in batches, such as hourly exports, are scored on whole batches
+	WindowAlignMin int `yaml:"window_align_min"`
+
+	// rollup is set on the metrics added for the rollups of another metric
+	rollup *rollupSource
+}
+
+// aggregation returns the alignment and reduction to fetch the metric with, nil for raw points
+func (m MetricConfig) aggregation() *monitoringpb.Aggregation {
+	if m.AlignmentPeriod == 0 {
+		return nil
+	}
+	aligner := monitoringpb.Aggregation_ALIGN_MEAN
+	if m.Aligner != "" {
+		aligner = monitoringpb.Aggregation_Aligner(monitoringpb.Aggregation_Aligner_value[m.Aligner])
+	}
+	aggregation := &monitoringpb.Aggregation{
+		AlignmentPeriod:  &durationpb.Duration{Seconds: int64(m.AlignmentPeriod)},
+		PerSeriesAligner: aligner,
+	}
+	if m.Reducer != "" || len(m.GroupByFields) > 0 {
+		aggregation.CrossSeriesReducer = monitoringpb.Aggregation_REDUCE_SUM
+		if m.Reducer != "" {
+			aggregation.CrossSeriesReducer = monitoringpb.Aggregation_Reducer(monitoringpb.Aggregation_Reducer_value[m.Reducer])
+		}
+		aggregation.GroupByFields = m.GroupByFields
+	}
+	return aggregation
+}
+
+func (m MetricConfig) validate() error {
+	if m.AlignmentPeriod < 0 {
+		return fmt.Errorf("metric %s: alignment_period must not be negative", m.Type)
+	}
+	if m.Aligner != "" {
+		if _, ok := monitoringpb.Aggregation_Aligner_value[m.Aligner]; !ok || m.Aligner == "ALIGN_NONE" {
+			return fmt.Errorf("metric %s: unknown aligner %s", m.Type, m.Aligner)
+		}
+		if m.AlignmentPeriod == 0 {
+			return fmt.Errorf("metric %s: aligner requires alignment_period", m.Type)
+		}
+	}
+	if m.Reducer != "" {
+		if _, ok := monitoringpb.Aggregation_Reducer_value[m.Reducer]; !ok || m.Reducer == "REDUCE_NONE" {
+			return fmt.Errorf("metric %s: unknown reducer %s", m.Type, m.Reducer)
+		}
+	}
+	if (m.Reducer != "" || len(m.GroupByFields) > 0) && m.AlignmentPeriod == 0 {
+		return fmt.Errorf("metric %s: reducer and group_by_fields require alignment_period", m.Type)
+	}
+	if m.Baseline != nil {
+		if m.Baseline.StdDev < 0 {
+			return fmt.Errorf("metric %s: baseline stddev must not be negative", m.Type)
+		}
+		if m.Reference != nil {
+			return fmt.Errorf("metric %s: a fixed baseline cannot be combined with a reference", m.Type)
+		}
+	}
+	if m.Reference != nil && (m.Ratio != nil || m.Expression != nil) {
+		return fmt.Errorf("metric %s: references require a fetched metric", m.Type)
+	}
+	if m.Canary != nil {
+		if m.Ratio != nil || m.Expression != nil {
+			return fmt.Errorf("metric %s: canary comparisons require a fetched metric", m.Type)
+		}
+		if err := m.Canary.validate(); err != nil {
+			return fmt.Errorf("metric %s: canary: %v", m.Type, err)
+		}
+	}
+	if m.Peers != nil {
+		if err := m.Peers.validate(); err != nil {
+			return fmt.Errorf("metric %s: peers: %v", m.Type, err)
+		}
+	}
+	if m.Replicas != nil {
+		if err := m.Replicas.validate(); err != nil {
+			return fmt.Errorf("metric %s: replicas: %v", m.Type, err)
+		}
+	}
+	if m.States != nil {
+		if err := m.States.validate(); err != nil {
+			return fmt.Errorf("metric %s: states: %v", m.Type, err)
+		}
+	}
+	if m.IngestionDelaySec < 0 {
+		return fmt.Errorf("metric %s: ingestion_delay_sec must not be negative", m.Type)
+	}
+	if m.EvaluationOffsetMin < 0 || m.WindowAlignMin < 0 {
+		return fmt.Errorf("metric %s: evaluation_offset_min and window_align_min must not be negative", m.Type)
+	}
+	if m.Rollups != nil {
+		if err := m.Rollups.validate(); err != nil {
+			return fmt.Errorf("metric %s: rollups: %v", m.Type, err)
+		}
+		if m.AlignmentPeriod == 0 {
+			return fmt.Errorf("metric %s: rollups require alignment_period", m.Type)
+		}
+	}
+	if m.Windows != nil && m.Condition != "" {
+		return fmt.Errorf("metric %s: windows cannot be combined with a condition", m.Type)
+	}
+	return nil
+}
+
+// UnmarshalYAML accepts both the plain string and the mapping form of a metric entry
+func (m *MetricConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var metricType string
+	if err := unmarshal(&metricType); err == nil {
+		*m = MetricConfig{Type: metricType}
+		return nil
+	}
+	type plain MetricConfig
+	return unmarshal((*plain)(m))
+}
+
+// LoadConfig loads the configuration from a YAML file
+func LoadConfig(filename string) (*Config, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+// parseConfig parses and validates the YAML of a configuration
+func parseConfig(data []byte) (*Config, error) {
+	var config Config
+	err := yaml.Unmarshal(data, &config)
+	if err != nil {
+		return nil, err
+	}
+	if err := config.applyPresets(); err != nil {
+		return nil, fmt.Errorf("presets: %v", err)
+	}
+	if config.BaselineWindow != nil {
+		if _, _, err := config.BaselineWindow.bounds(); err != nil {
+			return nil, fmt.Errorf("baseline_window: %v", err)
+		}
+	}
+	if config.Injection != nil {
+		if err := config.Injection.validate(&config); err != nil {
+			return nil, fmt.Errorf("injection: %v", err)
+		}
+	}
+	if config.Heartbeat != nil {
+		if err := config.Heartbeat.validate(); err != nil {
+			return nil, fmt.Errorf("heartbeat: %v", err)
+		}
+	}
+	if config.WarmUpMin < 0 {
+		return nil, fmt.Errorf("warm_up_min must not be negative")
+	}
+	if err := config.LevelShift.validate(); err != nil {
+		return nil, fmt.Errorf("level_shift: %v", err)
+	}
+	if err := config.Delta.validate(); err != nil {
+		return nil, fmt.Errorf("delta: %v", err)
+	}
+	if config.BaselineChunk < 0 {
+		return nil, fmt.Errorf("baseline_chunk must not be negative")
+	}
+	if config.FastStart != nil {
+		if err := config.FastStart.validate(); err != nil {
+			return nil, fmt.Errorf("fast_start: %v", err)
+		}
+		if config.BaselineWindow != nil {
+			return nil, fmt.Errorf("fast_start cannot be combined with baseline_window")
+		}
+	}
+	if config.AnomalyContext != nil && config.AnomalyContext.Points < 0 {
+		return nil, fmt.Errorf("anomaly_context: points must not be negative")
+	}
+	if config.IngestionDelay.MaxSec < 0 {
+		return nil, fmt.Errorf("ingestion_delay: max_sec must not be negative")
+	}
+	if config.Rollouts != nil {
+		if err := config.Rollouts.validate(); err != nil {
+			return nil, fmt.Errorf("rollouts: %v", err)
+		}
+	}
+	if config.Backfill != nil {
+		if err := config.Backfill.validate(); err != nil {
+			return nil, fmt.Errorf("backfill: %v", err)
+		}
+	}
+	if config.Changes != nil {
+		if err := config.Changes.validate(); err != nil {
+			return nil, fmt.Errorf("changes: %v", err)
+		}
+	}
+	if config.AssetInventory != nil {
+		if err := config.AssetInventory.validate(); err != nil {
+			return nil, fmt.Errorf("asset_inventory: %v", err)
+		}
+	}
+	if config.Traces != nil {
+		if err := config.Traces.validate(); err != nil {
+			return nil, fmt.Errorf("traces: %v", err)
+		}
+	}
+	if config.Agents != nil {
+		if err := config.Agents.validate(); err != nil {
+			return nil, fmt.Errorf("agents: %v", err)
+		}
+		registerSecrets(config.Agents)
+	}
+	if config.Server != nil {
+		if err := config.Server.validate(); err != nil {
+			return nil, fmt.Errorf("server: %v", err)
+		}
+		registerSecrets(config.Server)
+	}
+	if err := config.TimeDisplay.validate(); err != nil {
+		return nil, fmt.Errorf("time_display: %v", err)
+	}
+	if config.FeatureFlags != nil {
+		if err := config.FeatureFlags.validate(); err != nil {
+			return nil, fmt.Errorf("feature_flags: %v", err)
+		}
+		config.flags = newFeatureFlags(*config.FeatureFlags, config.ProjectID, config.Tenant)
+	}
+	if config.Completeness != nil {
+		if err := config.Completeness.validate(); err != nil {
+			return nil, fmt.Errorf("completeness: %v", err)
+		}
+	}
+	if err := config.validateSharedBaselines(); err != nil {
+		return nil, err
+	}
+	if err := config.checkReadOnly(); err != nil {
+		return nil, err
+	}
+	switch config.CycleOverrun {
+	case "", overrunSkip, overrunDelay:
+	default:
+		return nil, fmt.Errorf("cycle_overrun must be %s or %s", overrunSkip, overrunDelay)
+	}
+	if err := config.BaselineQuality.validate(); err != nil {
+		return nil, fmt.Errorf("baseline_quality: %v", err)
+	}
+	if config.Service.MaxCycleAgeMin < 0 {
+		return nil, fmt.Errorf("service: max_cycle_age_min must not be negative")
+	}
+	if config.Report != nil {
+		if err := config.Report.validate(); err != nil {
+			return nil, fmt.Errorf("report: %v", err)
+		}
+	}
+	if err := validateAnomalySchema(config.AnomalySchema); err != nil {
+		return nil, fmt.Errorf("anomaly_schema: %v", err)
+	}
+	if config.store, err = newStore(config.Store); err != nil {
+		return nil, fmt.Errorf("store: %v", err)
+	}
+	if config.RestoreBaseline && config.BaselinePath == "" && !config.store.Durable() {
+		return nil, fmt.Errorf("restore_baseline requires baseline_path or a store")
+	}
+	if config.Export != nil && config.Export.Location == "" {
+		return nil, fmt.Errorf("export: no location configured")
+	}
+	if config.Health != nil {
+		if err := config.Health.validate(); err != nil {
+			return nil, fmt.Errorf("health: %v", err)
+		}
+	}
+	if config.Trends != nil {
+		if err := config.Trends.validate(); err != nil {
+			return nil, fmt.Errorf("trends: %v", err)
+		}
+	}
+	if _, err := compileSuppressions(config.Suppressions); err != nil {
+		return nil, fmt.Errorf("suppressions: %v", err)
+	}
+	if _, err := compileInhibitions(config.Inhibitions); err != nil {
+		return nil, fmt.Errorf("inhibitions: %v", err)
+	}
+	if _, err := compileRemediations(config.Remediations); err != nil {
+		return nil, fmt.Errorf("remediations: %v", err)
+	}
+	if config.ConfigSync != nil {
+		if err := config.ConfigSync.validate(); err != nil {
+			return nil, fmt.Errorf("config_sync: %v", err)
+		}
+	}
+	if _, err := compileActiveHours(config.Metrics); err != nil {
+		return nil, err
+	}
+	if _, err := compileConditions(config.Metrics); err != nil {
+		return nil, err
+	}
+	if _, err := compileSeasons(config.Metrics); err != nil {
+		return nil, err
+	}
+	if _, err := compileTransforms(config.Metrics); err != nil {
+		return nil, err
+	}
+	if err := config.ZeroStdDev.validate(); err != nil {
+		return nil, fmt.Errorf("zero_stddev: %v", err)
+	}
+	for _, metric := range config.Metrics {
+		if err := metric.validate(); err != nil {
+			return nil, err
+		}
+		if metric.Windows != nil {
+			if err := metric.Windows.validate(config.RecentDuration); err != nil {
+				return nil, fmt.Errorf("metric %s: windows: %v", metric.Type, err)
+			}
+		}
+	}
+	config.addRollups()
+	if config.MonitoringAPI.Replay != "" {
+		var pinned time.Time
+		if config.BaselineWindow != nil {
+			_, pinned, _ = config.BaselineWindow.bounds()
+		}
+		start, err := recordingStart(config.MonitoringAPI.Replay, pinned)
+		if err != nil {
+			return nil, fmt.Errorf("monitoring_api: %v", err)
+		}
+		config.clock = newShiftedClock(start)
+	}
+	if config.ClockSkew != nil {
+		if err := config.ClockSkew.validate(); err != nil {
+			return nil, fmt.Errorf("clock_skew: %v", err)
+		}
+		if config.MonitoringAPI.Replay != "" {
+			return nil, fmt.Errorf("clock_skew cannot be combined with monitoring_api.replay, which runs on the time of the recording")
+		}
+		config.skew = newClockSkew(*config.ClockSkew)
+		if config.ClockSkew.Adjust {
+			config.clock = skewedClock{skew: config.skew}
+		}
+	}
+	return &config, nil
+}
+
+// mustLoadConfig loads the configuration and applies defaults, exiting on failure
+func mustLoadConfig(filename string) *Config {
+	log.Println("Loading configuration...")
+	config, err := LoadConfig(filename)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	config.setDefaults()
+	config.TimeDisplay.apply()
+	return config
+}
+
+// setDefaults fills in defaults for settings that were not provided
+func (c *Config) setDefaults() {
+	// Set default baseline duration if not provided
+	if c.BaselineDuration == 0 {
+		c.BaselineDuration = 7
+	}
+}
+
+// BaselineWindowConfig pins the baseline to a fixed, known-good time range
+type BaselineWindowConfig struct {
+	Start string `yaml:"start"` // RFC3339
+	End   string `yaml:"end"`   // RFC3339
+}
+
+// bounds parses the start and end of the window
+func (w BaselineWindowConfig) bounds() (time.Time, time.Time, error) {
+	start, err := time.Parse(time.RFC3339, w.Start)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid start: %v", err)
+	}
+	end, err := time.Parse(time.RFC3339, w.End)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid end: %v", err)
+	}
+	if !end.After(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("end %s is not after start %s", w.End, w.Start)
+	}
+	return start, end, nil
+}
+
+// baselineRange returns the time range of a baseline computed at end: the pinned baseline_window
+// if there is one, the baseline_duration days up to end otherwise
+func (c *Config) baselineRange(end time.Time) (time.Time, time.Time) {
+	if c.BaselineWindow != nil {
+		// Validated when the configuration was loaded
+		start, end, _ := c.BaselineWindow.bounds()
+		return start, end
+	}
+	return end.Add(-time.Duration(c.BaselineDuration) * 24 * time.Hour), end
+}
+
+// classify sets the severity of the anomalies from their Z-scores
+func (c *Config) classify(anomalies []Anomaly) {
+	critical := c.CriticalZScore
+	if critical == 0 {
+		critical = 1.5 * c.ZScoreThreshold
+	}
+	for i := range anomalies {
+		if math.Abs(anomalies[i].ZScore) > critical {
+			anomalies[i].Severity = SeverityCritical
+		} else {
+			anomalies[i].Severity = SeverityWarning
+		}
+	}
+}
+
+// annotate sets the project, display name and static labels of the anomalies' metrics
+func (c *Config) annotate(anomalies []Anomaly) {
+	for i := range anomalies {
+		anomalies[i].ProjectID = c.ProjectID
+		if metric, ok := c.MetricConfig(anomalies[i].MetricName); ok {
+			anomalies[i].DisplayName = metric.DisplayName
+			anomalies[i].Metadata = metric.Labels
+		}
+	}
+	c.nameUptimeChecks(anomalies)
+}
+
+// displayName returns the name to show people for a metric type
+func (c *Config) displayName(metricType string) string {
+	if metric, ok := c.MetricConfig(metricType); ok && metric.DisplayName != "" {
+		return metric.DisplayName
+	}
+	return metricType
+}
+
+// aggregations returns the alignment of every metric fetched with one
+func (c *Config) aggregations() map[string]*monitoringpb.Aggregation {
+	aggregations := make(map[string]*monitoringpb.Aggregation)
+	for _, metric := range c.Metrics {
+		if aggregation := metric.aggregation(); aggregation != nil {
+			aggregations[metric.Type] = aggregation
+		}
+	}
+	return aggregations
+}
+
+// fetchedBaselineMetrics returns the types of the metrics whose baseline is fetched from the
+// historical window, which are those without a fixed baseline
+func (c *Config) fetchedBaselineMetrics() []string {
+	var metricTypes []string
+	for _, metric := range c.Metrics {
+		if metric.Baseline == nil {
+			metricTypes = append(metricTypes, metric.Type)
+		}
+	}
+	return metricTypes
+}
+
+// fixedBaselines returns the fixed baseline statistics of the metrics that have them
+func (c *Config) fixedBaselines() map[string]MetricStats {
+	fixed := make(map[string]MetricStats)
+	for _, metric := range c.Metrics {
+		if metric.Baseline != nil {
+			fixed[metric.Type] = MetricStats{mean: metric.Baseline.Mean, stddev: metric.Baseline.StdDev, count: metric.Baseline.Count}
+		}
+	}
+	return fixed
+}
+
+// MetricTypes returns the types of all configured metrics
+func (c *Config) MetricTypes() []string {
+	metricTypes := make([]string, 0, len(c.Metrics))
+	for _, metric := range c.Metrics {
+		metricTypes = append(metricTypes, metric.Type)
+	}
+	return metricTypes
+}
+
+// MetricConfig returns the configuration of a metric type
+func (c *Config) MetricConfig(metricType string) (MetricConfig, bool) {
+	for _, metric := range c.Metrics {
+		if metric.Type == metricType {
+			return metric, true
+		}
+	}
+	return MetricConfig{}, false
+}
+
+// MetricsTagged returns the types of the metrics carrying the tag
+func (c *Config) MetricsTagged(tag string) []string {
+	var metricTypes []string
+	for _, metric := range c.Metrics {
+		for _, t := range metric.Tags {
+			if t == tag {
+				metricTypes = append(metricTypes, metric.Type)
+				break
+			}
+		}
+	}
+	return metricTypes
+}
+
+// PollingInterval returns the effective polling interval of a metric
+func (c *Config) PollingInterval(metric MetricConfig) time.Duration {
+	if metric.PollingTime > 0 {
+		return time.Duration(metric.PollingTime) * time.Second
+	}
+	return time.Duration(c.PollingTime) * time.Second
+}
+
+// pollingGroups groups the metric types by their effective polling interval, shortest first
+func (c *Config) pollingGroups() []pollingGroup {
+	byInterval := make(map[time.Duration][]string)
+	for _, metric := range c.Metrics {
+		interval := c.PollingInterval(metric)
+		byInterval[interval] = append(byInterval[interval], metric.Type)
+	}
+
+	groups := make([]pollingGroup, 0, len(byInterval))
+	for interval, metrics := range byInterval {
+		groups = append(groups, pollingGroup{interval: interval, metrics: metrics})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].interval < groups[j].interval })
+	return groups
+}
+
+type pollingGroup struct {
+	interval time.Duration
+	metrics  []string
+}
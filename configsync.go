@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+)
+
+// configSyncAppliedRef holds the revision of the configuration the detector runs on
+const configSyncAppliedRef = "refs/heads/applied"
+
+// ConfigSyncConfig keeps the configuration in a Git repository, so detection rules go through
+// code review: the detector runs on the configuration of the head of a branch, and applies the
+// commits pushed to it once they pass validation
+type ConfigSyncConfig struct {
+	Repository  string `yaml:"repository"`   // URL of the repository, e.g. git@github.com:foo/detector-config.git
+	Branch      string `yaml:"branch"`       // defaults to main
+	Path        string `yaml:"path"`         // configuration file in the repository, defaults to config.yaml
+	DeployKey   string `yaml:"deploy_key"`   // SSH private key file the repository is read with, the default SSH identities if empty
+	KnownHosts  string `yaml:"known_hosts"`  // known_hosts file the host of the repository is checked against, hosts are trusted on first use if empty
+	Checkout    string `yaml:"checkout"`     // local directory the repository is fetched into, defaults to one in the user cache directory
+	IntervalMin int    `yaml:"interval_min"` // minutes between fetches, defaults to 5
+}
+
+func (c ConfigSyncConfig) validate() error {
+	if c.Repository == "" {
+		return fmt.Errorf("no repository configured")
+	}
+	if c.IntervalMin < 0 {
+		return fmt.Errorf("interval_min must not be negative")
+	}
+	return nil
+}
+
+// configSyncer fetches the configuration from its repository with the git command
+type configSyncer struct {
+	config ConfigSyncConfig
+	// rejected is the last revision that failed validation, reported once rather than on every
+	// fetch until a new commit replaces it
+	rejected string
+}
+
+func newConfigSyncer(config ConfigSyncConfig) *configSyncer {
+	if config.Branch == "" {
+		config.Branch = "main"
+	}
+	if config.Path == "" {
+		config.Path = "config.yaml"
+	}
+	if config.IntervalMin == 0 {
+		config.IntervalMin = 5
+	}
+	return &configSyncer{config: config}
+}
+
+// mustSyncConfig returns the configuration of the repository of the bootstrap configuration,
+// exiting on failure. The head of the branch is applied if it passes validation; the detector
+// runs on the revision applied last otherwise, such as when the repository cannot be reached.
+// The synced configuration keeps the config_sync of the bootstrap one.
+func mustSyncConfig(bootstrap *Config) (*Config, *configSyncer) {
+	ctx := context.Background()
+	s := newConfigSyncer(*bootstrap.ConfigSync)
+	if err := s.init(ctx); err != nil {
+		log.Fatalf("Failed to set up the configuration checkout %s: %v", s.config.Checkout, err)
+	}
+	head, err := s.fetch(ctx)
+	if err != nil {
+		log.Printf("Could not fetch the configuration from %s, using the revision applied last: %v", s.config.Repository, err)
+	} else if head != s.applied(ctx) {
+		if _, err := s.load(ctx, head); err != nil {
+			log.Printf("Configuration %s at %s is invalid, using the revision applied last: %v", s.config.Path, shortRevision(head), err)
+		} else if err := s.apply(ctx, head); err != nil {
+			log.Fatalf("Failed to apply the configuration at %s: %v", shortRevision(head), err)
+		}
+	}
+	applied := s.applied(ctx)
+	if applied == "" {
+		log.Fatalf("No valid configuration %s in %s", s.config.Path, s.config.Repository)
+	}
+	config, err := s.load(ctx, applied)
+	if err != nil {
+		log.Fatalf("Failed to load the configuration at %s: %v", shortRevision(applied), err)
+	}
+	log.Printf("Running on configuration %s at %s of %s\n", s.config.Path, shortRevision(applied), s.config.Repository)
+	config.ConfigSync = bootstrap.ConfigSync
+	config.setDefaults()
+	config.TimeDisplay.apply()
+	return config, s
+}
+
+// watch fetches the branch every interval_min until ctx is done and, when its head moved and its
+// configuration is valid, including its filters, applies it and calls restart for the detector
+// to shut down and start again on it. An invalid configuration is reported through the router
+// and the detector carries on with its current one.
+func (s *configSyncer) watch(ctx context.Context, client *monitoring.MetricClient, router *Router, restart func()) {
+	ticker := time.NewTicker(time.Duration(s.config.IntervalMin) * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		head, err := s.fetch(ctx)
+		if err != nil {
+			log.Printf("Could not fetch the configuration from %s: %v", s.config.Repository, err)
+			continue
+		}
+		if head == s.applied(ctx) || head == s.rejected {
+			continue
+		}
+		config, err := s.load(ctx, head)
+		if err == nil {
+			err = validateFilters(ctx, client, config)
+		}
+		if err != nil {
+			s.rejected = head
+			log.Printf("Configuration %s at %s rejected: %v", s.config.Path, shortRevision(head), err)
+			router.ReportError(ctx, fmt.Errorf("configuration %s at %s of %s rejected: %v", s.config.Path, shortRevision(head), s.config.Repository, err))
+			continue
+		}
+		if err := s.apply(ctx, head); err != nil {
+			log.Printf("Could not apply the configuration at %s: %v", shortRevision(head), err)
+			continue
+		}
+		log.Printf("Configuration %s changed at %s, restarting the detector on it...\n", s.config.Path, shortRevision(head))
+		restart()
+		return
+	}
+}
+
+// init creates the checkout as a repository with the configured repository as its origin. An
+// existing checkout is only reused when the current user owns it and its origin is the
+// configured repository, as the configuration it holds is applied as is.
+func (s *configSyncer) init(ctx context.Context) error {
+	if s.config.Checkout == "" {
+		checkout, err := defaultConfigCheckout(s.config.Repository)
+		if err != nil {
+			return err
+		}
+		s.config.Checkout = checkout
+	}
+	if err := os.MkdirAll(s.config.Checkout, 0o700); err != nil {
+		return err
+	}
+	if err := checkOwnedDir(s.config.Checkout); err != nil {
+		return err
+	}
+	gitDir := filepath.Join(s.config.Checkout, ".git")
+	if _, err := os.Lstat(gitDir); errors.Is(err, os.ErrNotExist) {
+		if _, err := s.git(ctx, "init", "-q"); err != nil {
+			return err
+		}
+		_, err := s.git(ctx, "remote", "add", "origin", s.config.Repository)
+		return err
+	}
+	if err := checkOwnedDir(gitDir); err != nil {
+		return err
+	}
+	origin, err := s.git(ctx, "remote", "get-url", "origin")
+	if err != nil {
+		return err
+	}
+	if origin := strings.TrimSpace(string(origin)); origin != s.config.Repository {
+		return fmt.Errorf("checkout is of %s rather than %s; remove it or configure another checkout", origin, s.config.Repository)
+	}
+	return nil
+}
+
+// defaultConfigCheckout returns the checkout of the repository when none is configured: a
+// directory of the user cache directory named after the repository, so the revision applied
+// last survives restarts, or a new private directory without a cache directory
+func defaultConfigCheckout(repository string) (string, error) {
+	cache, err := os.UserCacheDir()
+	if err != nil {
+		return os.MkdirTemp("", "gcp-anomaly-detector-config-")
+	}
+	dir := filepath.Join(cache, "gcp-anomaly-detector")
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	if err := checkOwnedDir(dir); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(repository))
+	return filepath.Join(dir, "config-"+hex.EncodeToString(sum[:8])), nil
+}
+
+// checkOwnedDir returns an error unless path is a directory, not a link to one, owned by the
+// current user
+func checkOwnedDir(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	if !ownedByCurrentUser(info) {
+		return fmt.Errorf("%s is not owned by the current user", path)
+	}
+	return nil
+}
+
+// fetch fetches the head of the branch and returns its revision
+func (s *configSyncer) fetch(ctx context.Context) (string, error) {
+	if _, err := s.git(ctx, "fetch", "-q", "--depth", "1", "origin", "refs/heads/"+s.config.Branch); err != nil {
+		return "", err
+	}
+	head, err := s.git(ctx, "rev-parse", "FETCH_HEAD")
+	return strings.TrimSpace(string(head)), err
+}
+
+// applied returns the revision applied last, empty if there is none
+func (s *configSyncer) applied(ctx context.Context) string {
+	revision, err := s.git(ctx, "rev-parse", "--verify", "--quiet", configSyncAppliedRef)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(revision))
+}
+
+// apply records the revision as the one the detector runs on
+func (s *configSyncer) apply(ctx context.Context, revision string) error {
+	_, err := s.git(ctx, "update-ref", configSyncAppliedRef, revision)
+	return err
+}
+
+// load parses and validates the configuration at the revision, without checking it out
+func (s *configSyncer) load(ctx context.Context, revision string) (*Config, error) {
+	data, err := s.git(ctx, "show", revision+":"+s.config.Path)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(data)
+}
+
+// git runs a git command in the checkout and returns its output, reading the repository with
+// the deploy key
+func (s *configSyncer) git(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", s.config.Checkout}, args...)...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if ssh := s.sshCommand(); ssh != "" {
+		cmd.Env = append(cmd.Env, "GIT_SSH_COMMAND="+ssh)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// sshCommand returns the ssh command git connects to the repository with, empty for the default
+func (s *configSyncer) sshCommand() string {
+	var options []string
+	if s.config.DeployKey != "" {
+		options = append(options, fmt.Sprintf("-i '%s' -o IdentitiesOnly=yes", s.config.DeployKey))
+	}
+	if s.config.KnownHosts != "" {
+		options = append(options, fmt.Sprintf("-o UserKnownHostsFile='%s' -o StrictHostKeyChecking=yes", s.config.KnownHosts))
+	} else if s.config.DeployKey != "" {
+		options = append(options, "-o StrictHostKeyChecking=accept-new")
+	}
+	if len(options) == 0 {
+		return ""
+	}
+	return "ssh " + strings.Join(options, " ")
+}
+
+// shortRevision abbreviates a revision for logs
+func shortRevision(revision string) string {
+	if len(revision) > 12 {
+		return revision[:12]
+	}
+	return revision
+}
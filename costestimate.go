@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"google.golang.org/api/iterator"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// monitoringReadQuotaPerMinute is the default quota of time series queries per minute and project
+const monitoringReadQuotaPerMinute = 6000
+
+// apiRequest is one ListTimeSeries call the detector makes for a metric
+type apiRequest struct {
+	projectID   string
+	metricType  string
+	filter      string
+	aggregation *monitoringpb.Aggregation
+}
+
+// metricEstimate is the Monitoring API usage of one metric per day
+type metricEstimate struct {
+	metricType     string
+	interval       time.Duration
+	cycleRequests  []apiRequest
+	baseline       []apiRequest
+	seriesPerCycle int // series returned by the requests of a cycle
+	pointsPerCycle int // points returned by the requests of a cycle
+}
+
+// cyclesPerDay returns the detection cycles of the metric in a day
+func (e metricEstimate) cyclesPerDay() int {
+	return int(24 * time.Hour / e.interval)
+}
+
+// runCostEstimate estimates the ListTimeSeries calls, series and points the configuration reads
+// from the Monitoring API per day, to predict its quota usage and billing before deploying it
+func runCostEstimate(args []string) {
+	fs := flag.NewFlagSet("cost-estimate", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	credentials := addCredentialFlags(fs)
+	series := fs.Int("series", 10, "Series assumed per request when they are not counted")
+	count := fs.Bool("count", false, "Count the series of every request in Cloud Monitoring, one header-only call each, instead of assuming -series")
+	samplePeriod := fs.Duration("sample-period", time.Minute, "Spacing assumed of the raw points of metrics without alignment_period")
+	pricePer1000 := fs.Float64("price-per-1000", 0.01, "Price of 1,000 read API calls, before any free tier")
+	fs.Parse(args)
+
+	if *series <= 0 || *samplePeriod <= 0 {
+		log.Fatalf("The -series and -sample-period flags must be positive")
+	}
+	config := mustLoadConfig(*configPath)
+	config.Credentials.override(*credentials)
+	mustDiscoverWorkloads(config)
+	if config.PollingTime <= 0 {
+		for _, metric := range config.Metrics {
+			if metric.PollingTime <= 0 {
+				log.Fatalf("Metric %s has no polling interval: set polling_time", metric.Type)
+			}
+		}
+	}
+
+	var counter func(apiRequest) int
+	if *count {
+		client := mustCreateClient(config.Credentials, config.MonitoringAPI)
+		window := time.Duration(config.RecentDuration) * time.Minute
+		counted := make(map[string]int)
+		counter = func(request apiRequest) int {
+			key := request.projectID + "|" + request.metricType + "|" + request.filter
+			if n, ok := counted[key]; ok {
+				return n
+			}
+			n, err := countSeries(client, request, window)
+			if err != nil {
+				log.Fatalf("Failed to count the series of %s: %v", request.metricType, err)
+			}
+			counted[key] = n
+			return n
+		}
+	} else {
+		counter = func(apiRequest) int { return *series }
+	}
+
+	var estimates []metricEstimate
+	for _, metric := range config.Metrics {
+		estimate := config.estimateMetric(metric)
+		pointsPerSeries := config.recentPoints(metric, *samplePeriod)
+		for _, request := range estimate.cycleRequests {
+			n := counter(request)
+			estimate.seriesPerCycle += n
+			estimate.pointsPerCycle += n * pointsPerSeries
+		}
+		estimates = append(estimates, estimate)
+	}
+	printCostEstimate(config, estimates, *pricePer1000)
+}
+
+// estimateMetric returns the requests a metric makes per detection cycle and for its baseline
+func (c *Config) estimateMetric(metric MetricConfig) metricEstimate {
+	estimate := metricEstimate{metricType: metric.Type, interval: c.PollingInterval(metric)}
+	aggregation := metric.aggregation()
+	switch {
+	case metric.rollup != nil:
+		// Summed from the series of its metric, which are fetched anyway
+	case metric.Ratio != nil:
+		estimate.cycleRequests = []apiRequest{
+			{projectID: c.ProjectID, metricType: metric.Ratio.Numerator.Type, filter: metric.Ratio.Numerator.Filter, aggregation: aggregation},
+			{projectID: c.ProjectID, metricType: metric.Ratio.Denominator.Type, filter: metric.Ratio.Denominator.Filter, aggregation: aggregation},
+		}
+	case metric.Expression != nil:
+		names := make([]string, 0, len(metric.Expression.Inputs))
+		if _, referenced, err := parseExpression(metric.Expression.Expr); err == nil {
+			names = referenced
+		} else {
+			for name := range metric.Expression.Inputs {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			input := metric.Expression.Inputs[name]
+			estimate.cycleRequests = append(estimate.cycleRequests, apiRequest{projectID: c.ProjectID, metricType: input.Type, filter: input.Filter, aggregation: aggregation})
+		}
+	default:
+		estimate.cycleRequests = []apiRequest{{projectID: c.ProjectID, metricType: metric.Type, filter: c.Filters[metric.Type], aggregation: aggregation}}
+	}
+
+	switch {
+	case metric.Baseline != nil:
+		// Never fetched
+	case metric.Reference != nil:
+		projectID, filter := metric.Reference.ProjectID, c.Filters[metric.Type]
+		if projectID == "" {
+			projectID = c.ProjectID
+		}
+		if metric.Reference.Filter != "" {
+			filter = metric.Reference.Filter
+		}
+		estimate.baseline = []apiRequest{{projectID: projectID, metricType: metric.Type, filter: filter, aggregation: aggregation}}
+	default:
+		estimate.baseline = estimate.cycleRequests
+	}
+
+	if metric.Canary != nil {
+		filter := c.Filters[metric.Type]
+		estimate.cycleRequests = append(estimate.cycleRequests,
+			apiRequest{projectID: c.ProjectID, metricType: metric.Type, filter: joinFilters(filter, metric.Canary.Canary), aggregation: aggregation},
+			apiRequest{projectID: c.ProjectID, metricType: metric.Type, filter: joinFilters(filter, metric.Canary.Control), aggregation: aggregation})
+	}
+	return estimate
+}
+
+// recentPoints returns the points a series of the metric has in the recent window, at its
+// alignment period or, for raw points, at the assumed sample period
+func (c *Config) recentPoints(metric MetricConfig, samplePeriod time.Duration) int {
+	step := samplePeriod
+	if metric.AlignmentPeriod > 0 {
+		step = time.Duration(metric.AlignmentPeriod) * time.Second
+	}
+	window := time.Duration(c.RecentDuration) * time.Minute
+	return int(math.Max(1, math.Ceil(float64(window)/float64(step))))
+}
+
+// countSeries counts the series a request returns over the trailing window, reading only their
+// headers
+func countSeries(client *monitoring.MetricClient, request apiRequest, window time.Duration) (int, error) {
+	filter := fmt.Sprintf("metric.type=\"%s\"", request.metricType)
+	if request.filter != "" {
+		filter = fmt.Sprintf("%s AND %s", filter, request.filter)
+	}
+	endTime := time.Now()
+	it := client.ListTimeSeries(context.Background(), &monitoringpb.ListTimeSeriesRequest{
+		Name:   "projects/" + request.projectID,
+		Filter: filter,
+		Interval: &monitoringpb.TimeInterval{
+			StartTime: &timestamppb.Timestamp{Seconds: endTime.Add(-window).Unix()},
+			EndTime:   &timestamppb.Timestamp{Seconds: endTime.Unix()},
+		},
+		Aggregation: request.aggregation,
+		View:        monitoringpb.ListTimeSeriesRequest_HEADERS,
+	})
+	n := 0
+	for {
+		_, err := it.Next()
+		if err == iterator.Done {
+			return n, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		n++
+	}
+}
+
+// printCostEstimate prints the usage of every metric per day followed by the totals, the busiest
+// minute against the default quota and the monthly price of the calls
+func printCostEstimate(config *Config, estimates []metricEstimate, pricePer1000 float64) {
+	fmt.Printf("%-60s %8s %6s %8s %10s %12s %14s\n", "METRIC", "POLLING", "CALLS", "CYCLES", "CALLS/DAY", "SERIES/DAY", "POINTS/DAY")
+	var calls, series, points, baselineCalls int
+	var peakPerMinute float64
+	for _, estimate := range estimates {
+		cycles := estimate.cyclesPerDay()
+		fmt.Printf("%-60s %8s %6d %8d %10d %12d %14d\n", config.displayName(estimate.metricType), estimate.interval,
+			len(estimate.cycleRequests), cycles, cycles*len(estimate.cycleRequests), cycles*estimate.seriesPerCycle, cycles*estimate.pointsPerCycle)
+		calls += cycles * len(estimate.cycleRequests)
+		series += cycles * estimate.seriesPerCycle
+		points += cycles * estimate.pointsPerCycle
+		baselineCalls += len(estimate.baseline)
+		// Metrics polled more than once a minute make several cycles' calls within one
+		peakPerMinute += float64(len(estimate.cycleRequests)) * math.Max(1, float64(time.Minute)/float64(estimate.interval))
+	}
+
+	fmt.Printf("\nPer day: %d ListTimeSeries calls reading %d series and %d points\n", calls, series, points)
+	// Every chunk of a long baseline window is a call of its own
+	chunks := len(config.baselineChunks(config.baselineRange(time.Now())))
+	fmt.Printf("Baseline: %d calls per computation, at startup", baselineCalls*chunks)
+	switch {
+	case config.RestoreBaseline:
+		fmt.Printf(" only without a usable persisted baseline")
+	case config.BaselineMaxAge > 0:
+		fmt.Printf(" and every %d hours in request-triggered mode", config.BaselineMaxAge)
+	}
+	if chunks > 1 {
+		fmt.Printf(", the baseline window being read in %d chunks of up to %s\n", chunks, config.baselineChunk())
+	} else {
+		fmt.Println(", each reading the whole baseline window")
+	}
+	fmt.Printf("Busiest minute: up to %.0f calls, %.1f%% of the default quota of %d time series queries per minute\n",
+		peakPerMinute, peakPerMinute/monitoringReadQuotaPerMinute*100, monitoringReadQuotaPerMinute)
+	monthly := float64(calls) * 30
+	fmt.Printf("Per 30 days: %.0f calls, %.2f at %.4g per 1,000 calls before any free tier\n", monthly, monthly/1000*pricePer1000, pricePer1000)
+
+	var notes []string
+	for _, metric := range config.Metrics {
+		if metric.ActiveHours != nil && !metric.ActiveHours.AlertOnly {
+			notes = append(notes, metric.Type)
+		}
+	}
+	if len(notes) > 0 {
+		fmt.Printf("Metrics only fetched within their active hours are counted as always fetched: %s\n", strings.Join(notes, ", "))
+	}
+}
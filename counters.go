@@ -0,0 +1,135 @@
+package main
+
+import (
+	"log"
+	"sort"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+// counterState keeps the newest raw point of every counter series converted to rates, so the
+// oldest point of the next chunk of a window fetched in chunks gets its rate against the newest
+// point of the previous chunk. A nil state carries nothing over.
+type counterState struct {
+	last map[string]*monitoringpb.Point // by series fingerprint
+}
+
+func newCounterState() *counterState {
+	return &counterState{last: make(map[string]*monitoringpb.Point)}
+}
+
+// series prepares a fetched series of the metric for scoring when the metric is configured as
+// a counter. Raw points of a cumulative metric are converted to per-second rates, as the
+// running total itself only ever grows. A counter that restarts, such as after its process
+// restarted, drops to near zero; such a reset is told by the value falling below the previous
+// one or by a new start time, and the rate across it is taken from the count since the restart
+// instead of a huge negative delta. Series aligned to deltas or rates by Cloud Monitoring,
+// which only accounts for resets the writer signalled with a new start time, have their
+// negative points dropped, as a counter never decreases. Other series are returned unchanged.
+func (s *counterState) series(ts *monitoringpb.TimeSeries, metric MetricConfig) *monitoringpb.TimeSeries {
+	if !metric.Counter {
+		return ts
+	}
+	if aggregation := metric.aggregation(); aggregation != nil {
+		switch aggregation.PerSeriesAligner {
+		case monitoringpb.Aggregation_ALIGN_DELTA, monitoringpb.Aggregation_ALIGN_RATE:
+			return dropNegativePoints(ts)
+		}
+		return ts
+	}
+	if ts.MetricKind != metricpb.MetricDescriptor_CUMULATIVE || len(ts.Points) == 0 {
+		return ts
+	}
+	if s == nil {
+		rates, _ := counterRates(ts, nil)
+		return rates
+	}
+	fingerprint := seriesFingerprint(ts)
+	rates, newest := counterRates(ts, s.last[fingerprint])
+	s.last[fingerprint] = newest
+	return rates
+}
+
+// dropNegativePoints removes the negative points of an aligned counter, which are resets the
+// writer did not signal
+func dropNegativePoints(ts *monitoringpb.TimeSeries) *monitoringpb.TimeSeries {
+	kept := make([]*monitoringpb.Point, 0, len(ts.Points))
+	for _, point := range ts.Points {
+		if pointValue(point) >= 0 {
+			kept = append(kept, point)
+		}
+	}
+	if dropped := len(ts.Points) - len(kept); dropped > 0 {
+		log.Printf("Dropped %d negative points of counter %s (series %s), counter resets without a new start time\n", dropped, ts.Metric.Type, seriesFingerprint(ts))
+		ts.Points = kept
+	}
+	return ts
+}
+
+// counterRates converts the raw points of a cumulative series to per-second rates between
+// consecutive points, and returns them with the newest raw point. The oldest point yields no
+// rate unless it has a previous point, the newest of the series fetched before.
+func counterRates(ts *monitoringpb.TimeSeries, previous *monitoringpb.Point) (*monitoringpb.TimeSeries, *monitoringpb.Point) {
+	points := make([]*monitoringpb.Point, 0, len(ts.Points)+1)
+	points = append(points, ts.Points...)
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Interval.EndTime.AsTime().Before(points[j].Interval.EndTime.AsTime())
+	})
+	if previous != nil && previous.Interval.EndTime.AsTime().Before(points[0].Interval.EndTime.AsTime()) {
+		points = append([]*monitoringpb.Point{previous}, points...)
+	}
+
+	unit := ts.Unit
+	if unit == "" {
+		unit = "1"
+	}
+	rates := &monitoringpb.TimeSeries{
+		Metric:     ts.Metric,
+		Resource:   ts.Resource,
+		Metadata:   ts.Metadata,
+		MetricKind: metricpb.MetricDescriptor_GAUGE,
+		ValueType:  metricpb.MetricDescriptor_DOUBLE,
+		Unit:       unit + "/s",
+	}
+	resets := 0
+	for i := 1; i < len(points); i++ {
+		previous, point := points[i-1], points[i]
+		previousEnd, end := previous.Interval.EndTime.AsTime(), point.Interval.EndTime.AsTime()
+		elapsed := end.Sub(previousEnd)
+		if elapsed <= 0 {
+			continue
+		}
+		delta := pointValue(point) - pointValue(previous)
+		if delta < 0 || restarted(previous, point) {
+			// The counter restarted between the points and has counted the value since
+			resets++
+			delta = pointValue(point)
+			if start := point.Interval.GetStartTime(); start != nil && start.AsTime().After(previousEnd) && end.After(start.AsTime()) {
+				elapsed = end.Sub(start.AsTime())
+			}
+		}
+		rates.Points = append(rates.Points, &monitoringpb.Point{
+			Interval: &monitoringpb.TimeInterval{StartTime: previous.Interval.EndTime, EndTime: point.Interval.EndTime},
+			Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: delta / elapsed.Seconds()}},
+		})
+	}
+	if resets > 0 {
+		log.Printf("Counter %s (series %s) reset %d times\n", ts.Metric.Type, seriesFingerprint(ts), resets)
+	}
+	// Newest first, as the API returns points
+	for i, j := 0, len(rates.Points)-1; i < j; i, j = i+1, j-1 {
+		rates.Points[i], rates.Points[j] = rates.Points[j], rates.Points[i]
+	}
+	return rates, points[len(points)-1]
+}
+
+// restarted reports whether a cumulative point starts counting after the previous point, i.e.
+// its writer restarted the counter and signalled it with a new start time
+func restarted(previous, point *monitoringpb.Point) bool {
+	start, previousStart := point.Interval.GetStartTime(), previous.Interval.GetStartTime()
+	if start == nil || previousStart == nil {
+		return false
+	}
+	return start.AsTime().After(previousStart.AsTime())
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// counterStart is the start time of the cumulative points in the tests, unless they restart
+var counterStart = time.Date(2024, 5, 1, 11, 0, 0, 0, time.UTC)
+
+// counterPoint is a raw point of a cumulative counter ending minute minutes after counterStart
+type counterPoint struct {
+	minute  int
+	value   int64
+	restart int // minute the counter restarted at, signalled by the start time; 0 for none
+}
+
+// cumulativeSeries returns a raw INT64 cumulative series of the points, newest first as the API
+// returns them
+func cumulativeSeries(points ...counterPoint) *monitoringpb.TimeSeries {
+	ts := &monitoringpb.TimeSeries{
+		Metric:     &metricpb.Metric{Type: "custom.googleapis.com/requests"},
+		MetricKind: metricpb.MetricDescriptor_CUMULATIVE,
+		ValueType:  metricpb.MetricDescriptor_INT64,
+	}
+	for i := len(points) - 1; i >= 0; i-- {
+		start := counterStart
+		if points[i].restart > 0 {
+			start = counterStart.Add(time.Duration(points[i].restart) * time.Minute)
+		}
+		ts.Points = append(ts.Points, &monitoringpb.Point{
+			Interval: &monitoringpb.TimeInterval{StartTime: timestamppb.New(start), EndTime: timestamppb.New(counterStart.Add(time.Duration(points[i].minute) * time.Minute))},
+			Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_Int64Value{Int64Value: points[i].value}},
+		})
+	}
+	return ts
+}
+
+// oldestFirst returns the values of the points of a series from the oldest
+func oldestFirst(ts *monitoringpb.TimeSeries) []float64 {
+	values := make([]float64, len(ts.Points))
+	for i, point := range ts.Points {
+		values[len(values)-1-i] = pointValue(point)
+	}
+	return values
+}
+
+func equalValues(got, want []float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if math.Abs(got[i]-want[i]) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestCounterRates(t *testing.T) {
+	counter := MetricConfig{Type: "custom.googleapis.com/requests", Counter: true}
+	tests := []struct {
+		name   string
+		metric MetricConfig
+		series *monitoringpb.TimeSeries
+		want   []float64
+	}{
+		{
+			name:   "steady counter",
+			metric: counter,
+			series: cumulativeSeries(counterPoint{minute: 1, value: 60}, counterPoint{minute: 2, value: 180}, counterPoint{minute: 3, value: 240}),
+			want:   []float64{2, 1},
+		},
+		{
+			// The counter restarted and counted 30 since, in the minute since the last point
+			name:   "drop to zero",
+			metric: counter,
+			series: cumulativeSeries(counterPoint{minute: 1, value: 600}, counterPoint{minute: 2, value: 660}, counterPoint{minute: 3, value: 30}),
+			want:   []float64{1, 0.5},
+		},
+		{
+			// The value grew, but the new start time tells the counter restarted half a minute
+			// before the point and counted all of it since
+			name:   "new start time",
+			metric: counter,
+			series: cumulativeSeries(counterPoint{minute: 1, value: 60}, counterPoint{minute: 2, value: 120}, counterPoint{minute: 4, value: 300, restart: 3}),
+			want:   []float64{1, 5},
+		},
+		{
+			// A decrease without a new start time is still a reset, not a negative rate
+			name:   "unsignalled negative delta",
+			metric: counter,
+			series: cumulativeSeries(counterPoint{minute: 1, value: 6000}, counterPoint{minute: 2, value: 6060}, counterPoint{minute: 3, value: 5940}),
+			want:   []float64{1, 99},
+		},
+		{
+			name:   "not a counter",
+			metric: MetricConfig{Type: "custom.googleapis.com/requests"},
+			series: cumulativeSeries(counterPoint{minute: 1, value: 60}, counterPoint{minute: 2, value: 30}),
+			want:   []float64{60, 30},
+		},
+		{
+			// Cloud Monitoring computed the deltas, and a negative one is a reset it missed
+			name:   "aligned deltas",
+			metric: MetricConfig{Type: "custom.googleapis.com/requests", Counter: true, AlignmentPeriod: 60, Aligner: "ALIGN_DELTA"},
+			series: cumulativeSeries(counterPoint{minute: 1, value: 60}, counterPoint{minute: 2, value: -5940}, counterPoint{minute: 3, value: 30}),
+			want:   []float64{60, 30},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := oldestFirst(newCounterState().series(tt.series, tt.metric))
+			if !equalValues(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCounterRatesAcrossChunks(t *testing.T) {
+	counter := MetricConfig{Type: "custom.googleapis.com/requests", Counter: true}
+	counters := newCounterState()
+
+	first := counters.series(cumulativeSeries(counterPoint{minute: 1, value: 60}, counterPoint{minute: 2, value: 120}), counter)
+	// The next chunk starts on the newest point of the previous one, which the API returns again
+	second := counters.series(cumulativeSeries(counterPoint{minute: 2, value: 120}, counterPoint{minute: 3, value: 300}, counterPoint{minute: 4, value: 360}), counter)
+	// A chunk starting past the newest point takes its first rate against it
+	third := counters.series(cumulativeSeries(counterPoint{minute: 6, value: 600}), counter)
+
+	if got := oldestFirst(first); !equalValues(got, []float64{1}) {
+		t.Errorf("first chunk: got %v, want [1]", got)
+	}
+	if got := oldestFirst(second); !equalValues(got, []float64{3, 1}) {
+		t.Errorf("second chunk: got %v, want [3 1]", got)
+	}
+	if got := oldestFirst(third); !equalValues(got, []float64{2}) {
+		t.Errorf("third chunk: got %v, want [2]", got)
+	}
+	if start := third.Points[0].Interval.StartTime.AsTime(); !start.Equal(counterStart.Add(4 * time.Minute)) {
+		t.Errorf("rate of the third chunk starts at %s, want the newest point of the second", start)
+	}
+
+	// Without a state every chunk loses its oldest rate
+	if got := oldestFirst((*counterState)(nil).series(cumulativeSeries(counterPoint{minute: 6, value: 600}), counter)); len(got) != 0 {
+		t.Errorf("single point without a state: got %v, want no rates", got)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"google.golang.org/api/impersonate"
+	"google.golang.org/api/option"
+)
+
+// CredentialsConfig selects the credentials of the Monitoring client. Without any setting the
+// client uses Application Default Credentials.
+type CredentialsConfig struct {
+	File                      string `yaml:"file"`                        // service account key file, instead of Application Default Credentials
+	ImpersonateServiceAccount string `yaml:"impersonate_service_account"` // service account to act as, e.g. one granted access to another project
+	QuotaProject              string `yaml:"quota_project"`               // project billed for API quota, instead of the credentials' own project
+}
+
+// addCredentialFlags registers flags overriding the credentials settings of the configuration
+func addCredentialFlags(fs *flag.FlagSet) *CredentialsConfig {
+	var flags CredentialsConfig
+	fs.StringVar(&flags.File, "credentials-file", "", "Service account key file for the Monitoring client (overrides credentials.file)")
+	fs.StringVar(&flags.ImpersonateServiceAccount, "impersonate-service-account", "", "Service account the Monitoring client impersonates (overrides credentials.impersonate_service_account)")
+	fs.StringVar(&flags.QuotaProject, "quota-project", "", "Project billed for Monitoring API quota (overrides credentials.quota_project)")
+	return &flags
+}
+
+// override applies the settings given by flags
+func (c *CredentialsConfig) override(flags CredentialsConfig) {
+	if flags.File != "" {
+		c.File = flags.File
+	}
+	if flags.ImpersonateServiceAccount != "" {
+		c.ImpersonateServiceAccount = flags.ImpersonateServiceAccount
+	}
+	if flags.QuotaProject != "" {
+		c.QuotaProject = flags.QuotaProject
+	}
+}
+
+// clientOptions returns the options that authenticate a Monitoring client as configured
+func (c CredentialsConfig) clientOptions(ctx context.Context) ([]option.ClientOption, error) {
+	var opts []option.ClientOption
+	if c.File != "" {
+		opts = append(opts, option.WithCredentialsFile(c.File))
+	}
+	if c.ImpersonateServiceAccount != "" {
+		// The key file, if any, authenticates the impersonation itself
+		tokenSource, err := impersonate.CredentialsTokenSource(ctx, impersonate.CredentialsConfig{
+			TargetPrincipal: c.ImpersonateServiceAccount,
+			Scopes:          monitoring.DefaultAuthScopes(),
+		}, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("could not impersonate %s: %v", c.ImpersonateServiceAccount, err)
+		}
+		opts = []option.ClientOption{option.WithTokenSource(tokenSource)}
+	}
+	if c.QuotaProject != "" {
+		opts = append(opts, option.WithQuotaProject(c.QuotaProject))
+	}
+	return opts, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"math"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// DeltaConfig tunes the detection of abrupt shifts of the current mean of a series between two
+// consecutive cycles, which a recent window averaging the old and new level can hide from the
+// Z-scores of its points
+type DeltaConfig struct {
+	Enabled   bool    `yaml:"enabled"`
+	Threshold float64 `yaml:"threshold"` // shift of the current mean, in baseline standard deviations, defaults to 3
+}
+
+func (c DeltaConfig) validate() error {
+	if c.Threshold < 0 {
+		return fmt.Errorf("threshold must not be negative")
+	}
+	return nil
+}
+
+// recordCurrentMean keeps the current mean of a series of this cycle, and that of the previous
+// cycle it replaces
+func (d *SimpleAnomalyDetector) recordCurrentMean(fingerprint string, mean float64) {
+	if d.currentMeans == nil {
+		d.currentMeans = make(map[string]float64)
+		d.previousMeans = make(map[string]float64)
+	}
+	if current, ok := d.currentMeans[fingerprint]; ok {
+		d.previousMeans[fingerprint] = current
+	}
+	d.currentMeans[fingerprint] = mean
+}
+
+// DetectDeltas returns a delta anomaly for every series whose current mean moved by at least
+// threshold baseline standard deviations since the previous cycle. Series without a previous
+// cycle, or without a varying baseline, are not judged.
+func (d *SimpleAnomalyDetector) DetectDeltas(metrics []*monitoringpb.TimeSeries, config DeltaConfig) []Anomaly {
+	if !config.Enabled {
+		return nil
+	}
+	if config.Threshold == 0 {
+		config.Threshold = 3
+	}
+
+	var anomalies []Anomaly
+	for _, metric := range metrics {
+		fingerprint := seriesFingerprint(metric)
+		current, ok := d.currentMeans[fingerprint]
+		if !ok {
+			continue
+		}
+		previous, ok := d.previousMeans[fingerprint]
+		if !ok {
+			continue
+		}
+		timestamp := newestPointTime(metric)
+		stats, ok := d.baselineFor(metric.Metric.Type, d.baselineKey(metric, fingerprint), timestamp)
+		if !ok || stats.stddev == 0 {
+			continue
+		}
+		shift := (current - previous) / stats.stddev
+		if math.Abs(shift) < config.Threshold {
+			continue
+		}
+
+		anomalies = append(anomalies, Anomaly{
+			Kind:       KindDelta,
+			ID:         anomalyID(anomalyFingerprint(KindDelta, fingerprint), timestamp),
+			MetricName: metric.Metric.Type,
+			Value:      current,
+			Unit:       metric.Unit,
+			Timestamp:  timestamp,
+			Message: fmt.Sprintf("Current mean shifted from %s to %s since the previous cycle, %+.1f baseline StdDev",
+				formatValue(previous, metric.Unit), formatValue(current, metric.Unit), shift),
+			ZScore:   shift,
+			Severity: SeverityWarning,
+
+			Fingerprint:       anomalyFingerprint(KindDelta, fingerprint),
+			SeriesFingerprint: fingerprint,
+			Labels:            seriesLabels(metric),
+		})
+	}
+	return anomalies
+}
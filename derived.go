@@ -0,0 +1,328 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// RatioConfig derives a metric as the ratio of two fetched series, e.g. 5xx over all requests
+type RatioConfig struct {
+	Numerator   MetricTerm `yaml:"numerator"`
+	Denominator MetricTerm `yaml:"denominator"`
+	GroupBy     []string   `yaml:"group_by"` // metric or resource labels the ratio is computed per, all series are summed otherwise
+}
+
+// ExpressionConfig derives a metric by evaluating an expression over named fetched series, e.g.
+// "cpu * instances" or "max(a, b)"
+type ExpressionConfig struct {
+	Expr    string                `yaml:"expr"`
+	Inputs  map[string]MetricTerm `yaml:"inputs"`   // series referenced by name in the expression
+	GroupBy []string              `yaml:"group_by"` // metric or resource labels the expression is evaluated per, all series are summed otherwise
+}
+
+// MetricTerm selects the series summed into an input of a derived metric
+type MetricTerm struct {
+	Type   string `yaml:"type"`
+	Filter string `yaml:"filter"` // optional filter, e.g. metric.labels.response_code_class="5xx"
+}
+
+// streamConfiguredMetrics hands each series of the metrics between startTime and endTime to fn.
+// Fetched metrics are streamed as they are read; derived metrics are computed from their
+// terms once those have been fetched, so only the terms are buffered. Rollups are summed from
+// the series of their metric as they stream by, which is fetched again only when it is not
+// among the metrics.
+func streamConfiguredMetrics(client *monitoring.MetricClient, config *Config, kind string, metrics []string, startTime, endTime time.Time, fn func(*monitoringpb.TimeSeries)) error {
+	return streamConfiguredChunk(client, config, kind, metrics, startTime, endTime, nil, fn)
+}
+
+// streamConfiguredChunk streams the metrics like streamConfiguredMetrics over a chunk of a
+// window fetched in several, converting the counters with the points of the earlier chunks in
+// counters
+func streamConfiguredChunk(client *monitoring.MetricClient, config *Config, kind string, metrics []string, startTime, endTime time.Time, counters *counterState, fn func(*monitoringpb.TimeSeries)) error {
+	var fetched []string
+	var ratios, expressions, rollups []MetricConfig
+	for _, metricType := range metrics {
+		metricConfig, _ := config.MetricConfig(metricType)
+		switch {
+		case metricConfig.rollup != nil:
+			rollups = append(rollups, metricConfig)
+		case metricConfig.Ratio != nil:
+			ratios = append(ratios, metricConfig)
+		case metricConfig.Expression != nil:
+			expressions = append(expressions, metricConfig)
+		default:
+			fetched = append(fetched, metricType)
+		}
+	}
+
+	accumulators := make([]*rollupAccumulator, len(rollups))
+	byParent := make(map[string][]*rollupAccumulator)
+	for i, metricConfig := range rollups {
+		accumulators[i] = newRollupAccumulator(*metricConfig.rollup)
+		byParent[metricConfig.rollup.parent] = append(byParent[metricConfig.rollup.parent], accumulators[i])
+	}
+	rollUp := func(ts *monitoringpb.TimeSeries) {
+		for _, accumulator := range byParent[ts.GetMetric().GetType()] {
+			accumulator.add(ts)
+		}
+	}
+
+	if len(fetched) > 0 {
+		err := streamMetricsInRange(client, kind, config.ProjectID, fetched, startTime, endTime, config.Filters, config.aggregations(), func(ts *monitoringpb.TimeSeries) {
+			metricConfig, _ := config.MetricConfig(ts.GetMetric().GetType())
+			ts = config.numericSeries(counters.series(ts, metricConfig))
+			rollUp(ts)
+			fn(ts)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(rollups) > 0 {
+		streamed := make(map[string]bool, len(fetched))
+		for _, metricType := range fetched {
+			streamed[metricType] = true
+		}
+		for _, metricConfig := range rollups {
+			parent := metricConfig.rollup.parent
+			if streamed[parent] {
+				continue
+			}
+			streamed[parent] = true
+			parentConfig, _ := config.MetricConfig(parent)
+			err := streamMetricsInRange(client, kind, config.ProjectID, []string{parent}, startTime, endTime, config.Filters, config.aggregations(), func(ts *monitoringpb.TimeSeries) {
+				rollUp(config.numericSeries(counters.series(ts, parentConfig)))
+			})
+			if err != nil {
+				return fmt.Errorf("could not fetch %s to roll up: %w", parent, err)
+			}
+		}
+		for i, metricConfig := range rollups {
+			for _, ts := range accumulators[i].series(metricConfig.Type) {
+				fn(ts)
+			}
+		}
+	}
+
+	for _, metricConfig := range ratios {
+		ratio := metricConfig.Ratio
+		numerator, err := fetchMetricTerm(client, config, kind, ratio.Numerator, metricConfig, counters, startTime, endTime)
+		if err != nil {
+			return fmt.Errorf("could not fetch numerator of %s: %w", metricConfig.Type, err)
+		}
+		denominator, err := fetchMetricTerm(client, config, kind, ratio.Denominator, metricConfig, counters, startTime, endTime)
+		if err != nil {
+			return fmt.Errorf("could not fetch denominator of %s: %w", metricConfig.Type, err)
+		}
+		for _, ts := range ratioSeries(metricConfig.Type, ratio.GroupBy, numerator, denominator) {
+			fn(ts)
+		}
+	}
+
+	for _, metricConfig := range expressions {
+		series, err := fetchExpression(client, config, kind, metricConfig, counters, startTime, endTime)
+		if err != nil {
+			return fmt.Errorf("could not derive %s: %w", metricConfig.Type, err)
+		}
+		for _, ts := range series {
+			fn(ts)
+		}
+	}
+	return nil
+}
+
+// fetchExpression fetches the inputs of an expression metric and evaluates it per group at
+// every point time all inputs have a value. Results that are not finite are skipped.
+func fetchExpression(client *monitoring.MetricClient, config *Config, kind string, metricConfig MetricConfig, counters *counterState, startTime, endTime time.Time) ([]*monitoringpb.TimeSeries, error) {
+	spec := metricConfig.Expression
+	expr, names, err := parseExpression(spec.Expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %v", spec.Expr, err)
+	}
+
+	inputs := make(map[string]map[string]map[int64]float64)
+	groupLabels := make(map[string]map[string]string)
+	for _, name := range names {
+		term, ok := spec.Inputs[name]
+		if !ok {
+			return nil, fmt.Errorf("expression refers to undefined input %s", name)
+		}
+		series, err := fetchMetricTerm(client, config, kind, term, metricConfig, counters, startTime, endTime)
+		if err != nil {
+			return nil, fmt.Errorf("could not fetch input %s: %w", name, err)
+		}
+		var labels map[string]map[string]string
+		inputs[name], labels = sumByGroup(spec.GroupBy, series)
+		for group, l := range labels {
+			groupLabels[group] = l
+		}
+	}
+
+	var series []*monitoringpb.TimeSeries
+	for group, labels := range groupLabels {
+		values := make(map[int64]float64)
+		vars := make(map[string]float64, len(names))
+		for t := range firstInput(inputs, names, group) {
+			complete := true
+			for _, name := range names {
+				value, ok := inputs[name][group][t]
+				if !ok {
+					complete = false
+					break
+				}
+				vars[name] = value
+			}
+			if !complete {
+				continue
+			}
+			if value := expr.eval(vars); !math.IsNaN(value) && !math.IsInf(value, 0) {
+				values[t] = value
+			}
+		}
+		if ts := derivedSeries(metricConfig.Type, labels, values); ts != nil {
+			series = append(series, ts)
+		}
+	}
+	sort.Slice(series, func(i, j int) bool { return seriesFingerprint(series[i]) < seriesFingerprint(series[j]) })
+	return series, nil
+}
+
+// firstInput returns the point sums of the group in the first input, whose times are the
+// candidates for evaluation. An expression without inputs is constant and has no points.
+func firstInput(inputs map[string]map[string]map[int64]float64, names []string, group string) map[int64]float64 {
+	if len(names) == 0 {
+		return nil
+	}
+	return inputs[names[0]][group]
+}
+
+// fetchMetricTerm fetches the series of a term of the metric, aligned as the metric and
+// converted as its counters
+func fetchMetricTerm(client *monitoring.MetricClient, config *Config, kind string, term MetricTerm, metric MetricConfig, counters *counterState, startTime, endTime time.Time) ([]*monitoringpb.TimeSeries, error) {
+	if term.Type == "" {
+		return nil, fmt.Errorf("no metric type configured")
+	}
+	var filters map[string]string
+	if term.Filter != "" {
+		filters = map[string]string{term.Type: term.Filter}
+	}
+	var aggregations map[string]*monitoringpb.Aggregation
+	if aggregation := metric.aggregation(); aggregation != nil {
+		aggregations = map[string]*monitoringpb.Aggregation{term.Type: aggregation}
+	}
+	series, err := fetchMetricsInRange(client, kind, config.ProjectID, []string{term.Type}, startTime, endTime, filters, aggregations)
+	if err != nil {
+		return nil, err
+	}
+	for i, ts := range series {
+		series[i] = counters.series(ts, metric)
+	}
+	return series, nil
+}
+
+// ratioSeries sums each term per group and point time, and divides them. A point time missing
+// from the numerator counts as zero, since delta metrics such as error counts often omit zero
+// points; times without a non-zero denominator are skipped.
+func ratioSeries(metricType string, groupBy []string, numerator, denominator []*monitoringpb.TimeSeries) []*monitoringpb.TimeSeries {
+	numeratorSums, _ := sumByGroup(groupBy, numerator)
+	denominatorSums, groupLabels := sumByGroup(groupBy, denominator)
+
+	groups := make([]string, 0, len(denominatorSums))
+	for group := range denominatorSums {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	var series []*monitoringpb.TimeSeries
+	for _, group := range groups {
+		values := make(map[int64]float64)
+		for t, total := range denominatorSums[group] {
+			if total != 0 {
+				values[t] = numeratorSums[group][t] / total
+			}
+		}
+		if ts := derivedSeries(metricType, groupLabels[group], values); ts != nil {
+			series = append(series, ts)
+		}
+	}
+	return series
+}
+
+// derivedSeries builds a gauge series from values by point end time (in Unix seconds), or
+// returns nil when there are none
+func derivedSeries(metricType string, labels map[string]string, values map[int64]float64) *monitoringpb.TimeSeries {
+	if len(values) == 0 {
+		return nil
+	}
+	times := make([]int64, 0, len(values))
+	for t := range values {
+		times = append(times, t)
+	}
+	// Newest first, like the series returned by the API
+	sort.Slice(times, func(i, j int) bool { return times[i] > times[j] })
+
+	points := make([]*monitoringpb.Point, 0, len(times))
+	for _, t := range times {
+		points = append(points, &monitoringpb.Point{
+			Interval: &monitoringpb.TimeInterval{EndTime: timestamppb.New(time.Unix(t, 0))},
+			Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: values[t]}},
+		})
+	}
+	return &monitoringpb.TimeSeries{
+		Metric:     &metricpb.Metric{Type: metricType, Labels: labels},
+		Resource:   &monitoredrespb.MonitoredResource{Type: "global"},
+		MetricKind: metricpb.MetricDescriptor_GAUGE,
+		ValueType:  metricpb.MetricDescriptor_DOUBLE,
+		Points:     points,
+	}
+}
+
+// sumByGroup sums the point values of the series per group and point end time (in Unix
+// seconds), returning the labels identifying each group alongside
+func sumByGroup(groupBy []string, series []*monitoringpb.TimeSeries) (map[string]map[int64]float64, map[string]map[string]string) {
+	sums := make(map[string]map[int64]float64)
+	labels := make(map[string]map[string]string)
+	for _, ts := range series {
+		all := seriesLabels(ts)
+		groupLabels := make(map[string]string)
+		parts := make([]string, 0, len(groupBy))
+		for _, label := range groupBy {
+			groupLabels[label] = all[label]
+			parts = append(parts, label+"="+all[label])
+		}
+		group := strings.Join(parts, ",")
+		if sums[group] == nil {
+			sums[group] = make(map[int64]float64)
+			labels[group] = groupLabels
+		}
+		for _, point := range ts.Points {
+			sums[group][point.Interval.EndTime.AsTime().Unix()] += pointValue(point)
+		}
+	}
+	return sums, labels
+}
+
+// pointValue returns the value of a numeric point as a float, whether it is a double or int64,
+// or 1 and 0 for a bool point
+func pointValue(point *monitoringpb.Point) float64 {
+	switch v := point.GetValue().GetValue().(type) {
+	case *monitoringpb.TypedValue_Int64Value:
+		return float64(v.Int64Value)
+	case *monitoringpb.TypedValue_BoolValue:
+		if v.BoolValue {
+			return 1
+		}
+		return 0
+	}
+	return point.GetValue().GetDoubleValue()
+}
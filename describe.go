@@ -0,0 +1,196 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// describedSeries collects the points of one series of the baseline window
+type describedSeries struct {
+	metricType  string
+	fingerprint string
+	labels      map[string]string
+	unit        string
+	values      []float64
+	times       []time.Time
+}
+
+// seriesDescription summarises the baseline of one series
+type seriesDescription struct {
+	stats       RunningStats
+	min, max    float64
+	percentiles [3]float64 // p50, p90 and p99
+	gaps        int
+	longestGap  time.Duration
+}
+
+// describePercentiles are the percentiles shown for every series
+var describePercentiles = [3]float64{50, 90, 99}
+
+// runDescribe fetches the baseline window of the configured metrics and prints the statistics of
+// every series, without detecting anomalies, to help choose thresholds
+func runDescribe(args []string) {
+	fs := flag.NewFlagSet("describe", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	credentials := addCredentialFlags(fs)
+	metrics := fs.String("metrics", "", "Comma-separated metric types to describe (defaults to all configured metrics)")
+	fs.Parse(args)
+
+	config := mustLoadConfig(*configPath)
+	config.Credentials.override(*credentials)
+	mustDiscoverWorkloads(config)
+	if *metrics != "" {
+		if err := config.selectMetrics(strings.Split(*metrics, ",")); err != nil {
+			log.Fatalf("Invalid -metrics: %v", err)
+		}
+	}
+
+	client := mustCreateClient(config.Credentials, config.MonitoringAPI)
+	mustValidateFilters(client, config)
+
+	// Series split across response pages are merged by fingerprint, as for the baseline
+	var series []*describedSeries
+	byFingerprint := make(map[string]*describedSeries)
+	startTime, endTime := config.baselineRange(time.Now())
+	err := streamBaselineMetrics(client, config, config.MetricTypes(), startTime, endTime, func(ts *monitoringpb.TimeSeries) {
+		fingerprint := seriesFingerprint(ts)
+		described, ok := byFingerprint[fingerprint]
+		if !ok {
+			described = &describedSeries{metricType: ts.Metric.Type, fingerprint: fingerprint, labels: seriesLabels(ts), unit: ts.Unit}
+			byFingerprint[fingerprint] = described
+			series = append(series, described)
+		}
+		for _, point := range ts.Points {
+			described.values = append(described.values, pointValue(point))
+			described.times = append(described.times, point.Interval.EndTime.AsTime())
+		}
+	})
+	if err != nil {
+		log.Fatalf("Failed to fetch historical metrics: %v", err)
+	}
+
+	printDescriptions(config, series, startTime, endTime)
+}
+
+// printDescriptions prints the baseline of every metric followed by that of each of its series
+func printDescriptions(config *Config, series []*describedSeries, startTime, endTime time.Time) {
+	minPoints := config.MinBaselinePoints
+	if minPoints <= 0 {
+		minPoints = defaultMinBaselinePoints
+	}
+	fmt.Printf("Baseline from %s to %s\n", startTime.Format(time.RFC3339), endTime.Format(time.RFC3339))
+
+	for _, metricType := range config.MetricTypes() {
+		var metricSeries []*describedSeries
+		var merged RunningStats
+		for _, described := range series {
+			if described.metricType == metricType {
+				metricSeries = append(metricSeries, described)
+				for _, value := range described.values {
+					merged.Add(value)
+				}
+			}
+		}
+		sort.Slice(metricSeries, func(i, j int) bool {
+			return formatLabels(metricSeries[i].labels) < formatLabels(metricSeries[j].labels)
+		})
+
+		fmt.Printf("\n%s: %d series, %d points\n", config.displayName(metricType), len(metricSeries), merged.Count)
+		if len(metricSeries) == 0 {
+			continue
+		}
+		unit := metricSeries[0].unit
+		fmt.Printf("  all series: mean %s, stddev %s\n", formatValue(merged.Mean, unit), formatValue(merged.StdDev(), unit))
+
+		spacing := time.Duration(0)
+		if metricConfig, ok := config.MetricConfig(metricType); ok && metricConfig.AlignmentPeriod > 0 {
+			spacing = time.Duration(metricConfig.AlignmentPeriod) * time.Second
+		}
+		for _, described := range metricSeries {
+			d := describe(described, spacing)
+			fmt.Printf("  %s {%s} (fingerprint %s)\n", described.labels["resource_type"], formatLabels(withoutResourceType(described.labels)), described.fingerprint)
+			fmt.Printf("    points %d, mean %s, stddev %s, min %s, p50 %s, p90 %s, p99 %s, max %s\n",
+				d.stats.Count, formatValue(d.stats.Mean, unit), formatValue(d.stats.StdDev(), unit), formatValue(d.min, unit),
+				formatValue(d.percentiles[0], unit), formatValue(d.percentiles[1], unit), formatValue(d.percentiles[2], unit), formatValue(d.max, unit))
+			notes := []string{fmt.Sprintf("gaps %d", d.gaps)}
+			if d.gaps > 0 {
+				notes[0] += fmt.Sprintf(" (longest %s)", d.longestGap)
+			}
+			if d.stats.Count < int64(minPoints) {
+				notes = append(notes, fmt.Sprintf("too few points to be scored (%d required)", minPoints))
+			}
+			if d.stats.Count > 1 && d.stats.StdDev() == 0 {
+				notes = append(notes, "constant, scored as configured by zero_stddev")
+			}
+			fmt.Printf("    %s\n", strings.Join(notes, ", "))
+		}
+	}
+}
+
+// describe computes the statistics of a series. A gap is a pause between two points of more than
+// twice the spacing, which is the alignment period if set and the median pause otherwise.
+func describe(series *describedSeries, spacing time.Duration) seriesDescription {
+	var d seriesDescription
+	if len(series.values) == 0 {
+		return d
+	}
+	sorted := make([]float64, len(series.values))
+	copy(sorted, series.values)
+	sort.Float64s(sorted)
+	for _, value := range sorted {
+		d.stats.Add(value)
+	}
+	d.min, d.max = sorted[0], sorted[len(sorted)-1]
+	for i, p := range describePercentiles {
+		// Nearest rank
+		rank := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		d.percentiles[i] = sorted[rank]
+	}
+
+	times := make([]time.Time, len(series.times))
+	copy(times, series.times)
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+	pauses := make([]time.Duration, 0, len(times))
+	for i := 1; i < len(times); i++ {
+		pauses = append(pauses, times[i].Sub(times[i-1]))
+	}
+	if len(pauses) == 0 {
+		return d
+	}
+	if spacing == 0 {
+		sortedPauses := make([]time.Duration, len(pauses))
+		copy(sortedPauses, pauses)
+		sort.Slice(sortedPauses, func(i, j int) bool { return sortedPauses[i] < sortedPauses[j] })
+		spacing = sortedPauses[len(sortedPauses)/2]
+	}
+	for _, pause := range pauses {
+		if pause > 2*spacing {
+			d.gaps++
+			if pause > d.longestGap {
+				d.longestGap = pause
+			}
+		}
+	}
+	return d
+}
+
+// withoutResourceType returns the labels other than resource_type
+func withoutResourceType(labels map[string]string) map[string]string {
+	others := make(map[string]string, len(labels))
+	for key, value := range labels {
+		if key != "resource_type" {
+			others[key] = value
+		}
+	}
+	return others
+}
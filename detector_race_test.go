@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+
+	"github.com/krzko/gcp-anomaly-detector/adminpb"
+)
+
+// raceCycles is the number of detection cycles each cycle goroutine runs
+const raceCycles = 5
+
+// newRaceServer returns a scan server whose detector has its baseline from the emulator, for
+// tests running detection cycles alongside the readers of the detector state. Run them with
+// go test -race.
+func newRaceServer(t *testing.T) (*scanServer, *manualClock) {
+	t.Helper()
+	emulator := newTestEmulator(4)
+	// A series spiking over the last minutes keeps anomalies and open events in the state
+	emulator.generated = append(emulator.generated, generatedSeries{MetricType: emulatedLatency, Mean: 250, StdDev: 20, SpikeMin: 30, SpikeValue: 900})
+	client, api := startEmulator(t, emulator)
+	config := newEmulatorConfig(t, api, emulatedRequests, emulatedLatency)
+	config.BaselineDuration = 1
+	clock := newManualClock(emulatorNow)
+	config.clock = clock
+
+	detector, err := buildBaseline(client, config)
+	if err != nil {
+		t.Fatalf("buildBaseline: %v", err)
+	}
+	router, err := NewRouter(context.Background(), config)
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	detector.events = router.Events()
+	return &scanServer{client: client, config: config, detector: detector, router: router, gauges: newScoreGauges(config)}, clock
+}
+
+// TestDetectorConcurrentAccess runs detection cycles, directly as the polling loops of the tail
+// and tenant modes do and through the scan server, while the baseline is snapshotted and
+// rebaselined and the detector state is read by the admin service and the HTTP endpoints
+func TestDetectorConcurrentAccess(t *testing.T) {
+	server, clock := newRaceServer(t)
+	detector, config := server.detector, server.config
+	metrics := []string{emulatedRequests, emulatedLatency}
+	admin := &adminServer{scan: server}
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	var cycles, readers sync.WaitGroup
+	cycle := func(run func()) {
+		cycles.Add(1)
+		go func() {
+			defer cycles.Done()
+			for i := 0; i < raceCycles; i++ {
+				run()
+			}
+		}()
+	}
+	read := func(run func()) {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+					run()
+				}
+			}
+		}()
+	}
+
+	cycle(func() {
+		clock.Set(clock.Now().Add(time.Minute))
+		if _, err := runCycle(server.client, config, detector, metrics); err != nil {
+			t.Errorf("runCycle: %v", err)
+		}
+	})
+	cycle(func() {
+		if _, err := server.scan(metrics); err != nil {
+			t.Errorf("scan: %v", err)
+		}
+	})
+	cycle(func() {
+		_, _, err := detector.Rebaseline(emulatedRequests, func(add func(*monitoringpb.TimeSeries)) error {
+			return streamHistoricalMetrics(server.client, config, []string{emulatedRequests}, add)
+		})
+		if err != nil {
+			t.Errorf("Rebaseline: %v", err)
+		}
+	})
+	cycle(func() {
+		if _, err := admin.Rebaseline(ctx, &adminpb.RebaselineRequest{MetricType: emulatedLatency}); err != nil {
+			t.Errorf("admin Rebaseline: %v", err)
+		}
+	})
+
+	read(func() { detector.Snapshot() })
+	read(func() {
+		detector.Scores()
+		detector.LatestPoints()
+		detector.TopSeries(math.MaxInt)
+		detector.FetchFailures()
+		detector.InsufficientData()
+		detector.Stats(emulatedRequests)
+		detector.BaselinePercentile(emulatedLatency, clock.Now())
+	})
+	read(func() {
+		if _, err := admin.GetBaselines(ctx, &adminpb.GetBaselinesRequest{}); err != nil {
+			t.Errorf("GetBaselines: %v", err)
+		}
+		if _, err := admin.GetScores(ctx, &adminpb.GetScoresRequest{}); err != nil {
+			t.Errorf("GetScores: %v", err)
+		}
+		if _, err := admin.ListOpenAnomalies(ctx, &adminpb.ListOpenAnomaliesRequest{}); err != nil {
+			t.Errorf("ListOpenAnomalies: %v", err)
+		}
+	})
+	read(func() {
+		recorder := httptest.NewRecorder()
+		server.gauges.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if recorder.Code != http.StatusOK {
+			t.Errorf("GET /metrics: %d", recorder.Code)
+		}
+	})
+
+	cycles.Wait()
+	close(done)
+	readers.Wait()
+
+	if len(detector.Snapshot().Metrics) != 2 {
+		t.Errorf("baseline of %d metrics after the cycles, want 2", len(detector.Snapshot().Metrics))
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// digestCompression bounds the number of centroids a digest keeps, about half as many whatever
+// the number of values folded into it
+const digestCompression = 100
+
+// digestBuffer is the number of values a digest buffers before merging them into its centroids
+const digestBuffer = 500
+
+// quantileDigest summarises a distribution in a bounded number of centroids, a merging t-digest.
+// Centroids are small at the tails and large in the middle, so the tail percentiles that matter
+// to anomaly detection stay accurate.
+type quantileDigest struct {
+	centroids []centroid // ordered by mean
+	buffered  []centroid
+	count     float64
+}
+
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// Add folds a value into the digest
+func (d *quantileDigest) Add(value float64) {
+	d.buffered = append(d.buffered, centroid{mean: value, weight: 1})
+	if len(d.buffered) >= digestBuffer {
+		d.compress()
+	}
+}
+
+// Merge folds another digest into this one
+func (d *quantileDigest) Merge(other *quantileDigest) {
+	if other == nil {
+		return
+	}
+	d.buffered = append(d.buffered, other.centroids...)
+	d.buffered = append(d.buffered, other.buffered...)
+	d.compress()
+}
+
+// compress merges the buffered values into the centroids. Neighbouring centroids are merged
+// while they span at most one unit of the arcsine scale over their quantiles, which bounds their
+// number by the compression and keeps them small at the tails.
+func (d *quantileDigest) compress() {
+	if len(d.buffered) == 0 {
+		return
+	}
+	all := make([]centroid, 0, len(d.centroids)+len(d.buffered))
+	all = append(append(all, d.centroids...), d.buffered...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+	var total float64
+	for _, c := range all {
+		total += c.weight
+	}
+
+	merged := []centroid{all[0]}
+	var before float64 // weight of the centroids before the last merged one
+	limit := digestQuantileLimit(0)
+	for _, c := range all[1:] {
+		last := &merged[len(merged)-1]
+		weight := last.weight + c.weight
+		if (before+weight)/total <= limit {
+			last.mean += (c.mean - last.mean) * c.weight / weight
+			last.weight = weight
+			continue
+		}
+		before += last.weight
+		limit = digestQuantileLimit(before / total)
+		merged = append(merged, c)
+	}
+	d.centroids, d.buffered, d.count = merged, nil, total
+}
+
+// digestQuantileLimit returns the quantile a centroid starting at quantile q may extend to, one
+// unit further on the scale k(q) = compression / 2π · asin(2q - 1)
+func digestQuantileLimit(q float64) float64 {
+	k := digestCompression/(2*math.Pi)*math.Asin(2*q-1) + 1
+	if k >= digestCompression/4 {
+		return 1
+	}
+	return (math.Sin(2*math.Pi*k/digestCompression) + 1) / 2
+}
+
+// CDF returns the share of the values below value, interpolating between the centroids. The
+// digest must be compressed, as the digests of baselines are, so concurrent reads are safe.
+func (d *quantileDigest) CDF(value float64) float64 {
+	n := len(d.centroids)
+	if n == 0 || value < d.centroids[0].mean {
+		return 0
+	}
+	if value >= d.centroids[n-1].mean {
+		return 1
+	}
+	var before float64
+	for i, c := range d.centroids[:n-1] {
+		next := d.centroids[i+1]
+		if value < next.mean {
+			mid, nextMid := before+c.weight/2, before+c.weight+next.weight/2
+			return (mid + (value-c.mean)/(next.mean-c.mean)*(nextMid-mid)) / d.count
+		}
+		before += c.weight
+	}
+	return 1
+}
+
+// BaselineDigest is the persisted form of a digest, the means and weights of its centroids
+type BaselineDigest struct {
+	Means   []float64 `json:"means"`
+	Weights []float64 `json:"weights"`
+}
+
+// persisted returns the persisted form of the digest, nil if it is empty
+func (d *quantileDigest) persisted() *BaselineDigest {
+	if d == nil {
+		return nil
+	}
+	d.compress()
+	if len(d.centroids) == 0 {
+		return nil
+	}
+	persisted := &BaselineDigest{Means: make([]float64, len(d.centroids)), Weights: make([]float64, len(d.centroids))}
+	for i, c := range d.centroids {
+		persisted.Means[i], persisted.Weights[i] = c.mean, c.weight
+	}
+	return persisted
+}
+
+// restored returns the digest persisted, nil if there is none or it is malformed
+func (p *BaselineDigest) restored() *quantileDigest {
+	if p == nil || len(p.Means) == 0 || len(p.Means) != len(p.Weights) {
+		return nil
+	}
+	d := &quantileDigest{centroids: make([]centroid, len(p.Means))}
+	for i := range p.Means {
+		d.centroids[i] = centroid{mean: p.Means[i], weight: p.Weights[i]}
+		d.count += p.Weights[i]
+	}
+	sort.Slice(d.centroids, func(i, j int) bool { return d.centroids[i].mean < d.centroids[j].mean })
+	return d
+}
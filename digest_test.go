@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// exactCDF returns the share of the sorted values below value
+func exactCDF(sorted []float64, value float64) float64 {
+	return float64(sort.SearchFloat64s(sorted, value)) / float64(len(sorted))
+}
+
+func TestDigestAccuracy(t *testing.T) {
+	distributions := []struct {
+		name string
+		draw func(r *rand.Rand) float64
+	}{
+		{name: "normal", draw: func(r *rand.Rand) float64 { return 250 + 20*r.NormFloat64() }},
+		// Latencies are skewed, with a long right tail
+		{name: "log-normal", draw: func(r *rand.Rand) float64 { return math.Exp(5 + 0.5*r.NormFloat64()) }},
+		{name: "uniform", draw: func(r *rand.Rand) float64 { return r.Float64() }},
+	}
+	// The error allowed at each quantile, in quantiles: the centroids are small at the tails, so
+	// the tails are more accurate than the middle
+	tolerances := []struct {
+		q, tolerance float64
+	}{
+		{0.001, 0.0005}, {0.01, 0.001}, {0.05, 0.003}, {0.25, 0.01}, {0.5, 0.01}, {0.75, 0.01}, {0.95, 0.003}, {0.99, 0.001}, {0.999, 0.0005},
+	}
+	for _, distribution := range distributions {
+		t.Run(distribution.name, func(t *testing.T) {
+			r := rand.New(rand.NewSource(1))
+			values := make([]float64, 100000)
+			digest := &quantileDigest{}
+			for i := range values {
+				values[i] = distribution.draw(r)
+				digest.Add(values[i])
+			}
+			digest.compress()
+			sort.Float64s(values)
+
+			if len(digest.centroids) > digestCompression {
+				t.Errorf("got %d centroids, want at most %d", len(digest.centroids), digestCompression)
+			}
+			for _, tt := range tolerances {
+				value := values[int(tt.q*float64(len(values)))]
+				want := exactCDF(values, value)
+				if got := digest.CDF(value); math.Abs(got-want) > tt.tolerance {
+					t.Errorf("CDF at the %g quantile %g = %.5f, want %.5f within %g", tt.q, value, got, want, tt.tolerance)
+				}
+			}
+		})
+	}
+}
+
+func TestDigestMergedAndRestored(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	values := make([]float64, 20000)
+	// Baselines fold the digests of their chunks and series into one
+	parts := []*quantileDigest{{}, {}, {}, {}}
+	for i := range values {
+		values[i] = 100 + 5*r.NormFloat64()
+		parts[i%len(parts)].Add(values[i])
+	}
+	merged := &quantileDigest{}
+	for _, part := range parts {
+		part.compress()
+		merged.Merge(part)
+	}
+	restored := merged.persisted().restored()
+	sort.Float64s(values)
+
+	for _, q := range []float64{0.01, 0.5, 0.99} {
+		value := values[int(q*float64(len(values)))]
+		want := exactCDF(values, value)
+		if got := merged.CDF(value); math.Abs(got-want) > 0.01 {
+			t.Errorf("merged CDF at the %g quantile = %.5f, want %.5f", q, got, want)
+		}
+		if got := restored.CDF(value); got != merged.CDF(value) {
+			t.Errorf("restored CDF at the %g quantile = %.5f, want the merged %.5f", q, got, merged.CDF(value))
+		}
+	}
+	if merged.count != float64(len(values)) || restored.count != merged.count {
+		t.Errorf("got counts %g merged and %g restored, want %d", merged.count, restored.count, len(values))
+	}
+}
+
+func TestDigestSingleValue(t *testing.T) {
+	for _, n := range []int{1, 1000} {
+		digest := &quantileDigest{}
+		for i := 0; i < n; i++ {
+			digest.Add(42)
+		}
+		digest.compress()
+		if n == 1 && len(digest.centroids) != 1 {
+			t.Errorf("got %d centroids of a single value, want 1", len(digest.centroids))
+		}
+		for _, tt := range []struct {
+			value, want float64
+		}{{41.9, 0}, {42, 1}, {42.1, 1}} {
+			if got := digest.CDF(tt.value); got != tt.want {
+				t.Errorf("%d values of 42: CDF(%g) = %g, want %g", n, tt.value, got, tt.want)
+			}
+		}
+		if restored := digest.persisted().restored(); restored == nil || restored.CDF(42) != 1 {
+			t.Errorf("%d values of 42: not restored", n)
+		}
+	}
+}
+
+func TestDigestEmpty(t *testing.T) {
+	digest := &quantileDigest{}
+	digest.compress()
+	if got := digest.CDF(1); got != 0 {
+		t.Errorf("empty CDF(1) = %g, want 0", got)
+	}
+	if persisted := digest.persisted(); persisted != nil {
+		t.Errorf("empty digest persisted as %+v, want nil", persisted)
+	}
+	var missing *quantileDigest
+	if missing.persisted() != nil {
+		t.Error("nil digest persisted")
+	}
+	var none *BaselineDigest
+	if none.restored() != nil {
+		t.Error("restored a digest from nothing")
+	}
+	if (&BaselineDigest{Means: []float64{1, 2}, Weights: []float64{1}}).restored() != nil {
+		t.Error("restored a malformed digest")
+	}
+	// Merging an empty or missing digest changes nothing
+	digest.Add(5)
+	digest.Merge(nil)
+	digest.Merge(&quantileDigest{})
+	if digest.count != 1 || digest.CDF(5) != 1 {
+		t.Errorf("got count %g and CDF(5) %g, want 1 and 1", digest.count, digest.CDF(5))
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+const cloudPlatformScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// DiscoveryConfig monitors a standard metric set for the workloads found in the project, in
+// addition to the configured metrics
+type DiscoveryConfig struct {
+	GKE      bool `yaml:"gke"`       // CPU, memory and restarts per GKE container, if the project has clusters
+	CloudRun bool `yaml:"cloud_run"` // CPU, memory, requests, latency and error rate per Cloud Run service, if the project has services
+}
+
+// gkeWorkloadFields identify a workload's containers independently of the pods running them, so
+// the baseline survives rollouts
+var gkeWorkloadFields = []string{
+	"resource.labels.cluster_name", "resource.labels.location", "resource.labels.namespace_name", "resource.labels.container_name",
+}
+
+// gkeSystemNamespaces are left out of discovery, as GKE manages their workloads
+const gkeSystemNamespaces = `NOT resource.labels.namespace_name = one_of("kube-system", "gke-managed-system", "gmp-system", "gke-gmp-system")`
+
+var gkeMetrics = []MetricConfig{
+	{Type: "kubernetes.io/container/cpu/core_usage_time", DisplayName: "GKE container CPU (cores)", Aligner: "ALIGN_RATE", Reducer: "REDUCE_SUM", Counter: true},
+	{Type: "kubernetes.io/container/memory/used_bytes", DisplayName: "GKE container memory", Aligner: "ALIGN_MEAN", Reducer: "REDUCE_SUM"},
+	{Type: "kubernetes.io/container/restart_count", DisplayName: "GKE container restarts", Aligner: "ALIGN_DELTA", Reducer: "REDUCE_SUM", Counter: true},
+}
+
+// cloudRunServiceFields identify a Cloud Run service across its revisions
+var cloudRunServiceFields = []string{"resource.labels.service_name", "resource.labels.location"}
+
+var cloudRunMetrics = []MetricConfig{
+	{Type: "run.googleapis.com/container/cpu/utilizations", DisplayName: "Cloud Run CPU utilisation (p99)", Aligner: "ALIGN_DELTA", Reducer: "REDUCE_PERCENTILE_99"},
+	{Type: "run.googleapis.com/container/memory/utilizations", DisplayName: "Cloud Run memory utilisation (p99)", Aligner: "ALIGN_DELTA", Reducer: "REDUCE_PERCENTILE_99"},
+	{Type: "run.googleapis.com/request_count", DisplayName: "Cloud Run requests per second", Aligner: "ALIGN_RATE", Reducer: "REDUCE_SUM", Counter: true},
+	{Type: "run.googleapis.com/request_latencies", DisplayName: "Cloud Run request latency (p99)", Aligner: "ALIGN_DELTA", Reducer: "REDUCE_PERCENTILE_99"},
+	{
+		Type:        "derived/cloud_run/error_rate",
+		DisplayName: "Cloud Run error rate",
+		Aligner:     "ALIGN_RATE",
+		Counter:     true,
+		Ratio: &RatioConfig{
+			Numerator:   MetricTerm{Type: "run.googleapis.com/request_count", Filter: `metric.labels.response_code_class="5xx"`},
+			Denominator: MetricTerm{Type: "run.googleapis.com/request_count"},
+			GroupBy:     []string{"service_name", "location"},
+		},
+	},
+}
+
+// discoveryAlignmentPeriod is the alignment of the discovered metrics, in seconds
+const discoveryAlignmentPeriod = 60
+
+// mustDiscoverWorkloads adds the metrics of the discovered workloads, exiting on failure, and
+// resolves the names of the uptime checks, which are named by their IDs if that fails
+func mustDiscoverWorkloads(config *Config) {
+	if err := config.discoverWorkloads(context.Background(), config.Credentials); err != nil {
+		log.Fatalf("Failed to discover workloads: %v", err)
+	}
+	if err := config.resolveUptimeChecks(context.Background(), config.Credentials); err != nil {
+		log.Printf("Could not resolve the names of the uptime checks, naming them by ID: %v\n", err)
+	}
+}
+
+// discoverWorkloads lists the GKE clusters and Cloud Run services of the project and adds the
+// standard metric set of each platform in use. The metrics are grouped per workload, so
+// workloads created later are picked up without discovering again. Configured metrics of the
+// same type take precedence.
+func (c *Config) discoverWorkloads(ctx context.Context, credentials CredentialsConfig) error {
+	if !c.Discovery.GKE && !c.Discovery.CloudRun {
+		return nil
+	}
+	opts, err := credentials.clientOptions(ctx)
+	if err != nil {
+		return err
+	}
+	client, _, err := htransport.NewClient(ctx, append(opts, option.WithScopes(cloudPlatformScope))...)
+	if err != nil {
+		return fmt.Errorf("could not create client: %v", err)
+	}
+
+	if c.Discovery.GKE {
+		clusters, err := listGKEClusters(ctx, client, c.ProjectID)
+		if err != nil {
+			return fmt.Errorf("could not list GKE clusters: %v", err)
+		}
+		log.Printf("Discovered %d GKE clusters: %s\n", len(clusters), strings.Join(clusters, ", "))
+		if len(clusters) > 0 {
+			c.addDiscoveredMetrics(gkeMetrics, gkeWorkloadFields, gkeSystemNamespaces)
+		}
+	}
+	if c.Discovery.CloudRun {
+		services, err := listCloudRunServices(ctx, client, c.ProjectID)
+		if err != nil {
+			return fmt.Errorf("could not list Cloud Run services: %v", err)
+		}
+		log.Printf("Discovered %d Cloud Run services: %s\n", len(services), strings.Join(services, ", "))
+		if len(services) > 0 {
+			c.addDiscoveredMetrics(cloudRunMetrics, cloudRunServiceFields, "")
+		}
+	}
+	return nil
+}
+
+// addDiscoveredMetrics adds the metrics not configured yet, aligned every
+// discoveryAlignmentPeriod and grouped by the fields, with the filter unless one is configured
+func (c *Config) addDiscoveredMetrics(metrics []MetricConfig, fields []string, filter string) {
+	for _, metric := range metrics {
+		if _, configured := c.MetricConfig(metric.Type); configured {
+			continue
+		}
+		metric.AlignmentPeriod = discoveryAlignmentPeriod
+		if metric.Ratio == nil {
+			metric.GroupByFields = fields
+		}
+		c.Metrics = append(c.Metrics, metric)
+		if _, filtered := c.Filters[metric.Type]; !filtered && filter != "" {
+			if c.Filters == nil {
+				c.Filters = make(map[string]string)
+			}
+			c.Filters[metric.Type] = filter
+		}
+		log.Printf("Monitoring discovered metric %s\n", metric.Type)
+	}
+}
+
+// listGKEClusters returns the clusters of the project as location/name
+func listGKEClusters(ctx context.Context, client *http.Client, projectID string) ([]string, error) {
+	var response struct {
+		Clusters []struct {
+			Name     string `json:"name"`
+			Location string `json:"location"`
+		} `json:"clusters"`
+	}
+	listURL := fmt.Sprintf("https://container.googleapis.com/v1/projects/%s/locations/-/clusters", url.PathEscape(projectID))
+	if err := getJSON(ctx, client, listURL, &response); err != nil {
+		return nil, err
+	}
+	var clusters []string
+	for _, cluster := range response.Clusters {
+		clusters = append(clusters, cluster.Location+"/"+cluster.Name)
+	}
+	sort.Strings(clusters)
+	return clusters, nil
+}
+
+// listCloudRunServices returns the services of the project as location/name
+func listCloudRunServices(ctx context.Context, client *http.Client, projectID string) ([]string, error) {
+	var services []string
+	pageToken := ""
+	for {
+		var response struct {
+			Services []struct {
+				Name string `json:"name"` // projects/<project>/locations/<location>/services/<service>
+			} `json:"services"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		listURL := fmt.Sprintf("https://run.googleapis.com/v2/projects/%s/locations/-/services?pageToken=%s", url.PathEscape(projectID), url.QueryEscape(pageToken))
+		if err := getJSON(ctx, client, listURL, &response); err != nil {
+			return nil, err
+		}
+		for _, service := range response.Services {
+			parts := strings.Split(service.Name, "/")
+			if len(parts) == 6 {
+				services = append(services, parts[3]+"/"+parts[5])
+			}
+		}
+		if response.NextPageToken == "" {
+			break
+		}
+		pageToken = response.NextPageToken
+	}
+	sort.Strings(services)
+	return services, nil
+}
+
+// getJSON decodes the JSON response of a GET request, treating any non-2xx response as an error
+func getJSON(ctx context.Context, client *http.Client, url string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
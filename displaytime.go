@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// TimeDisplayConfig formats the times people read in notifications, the console, logs and
+// reports. Machine outputs, such as anomaly payloads, files and the APIs, keep RFC 3339 in UTC.
+type TimeDisplayConfig struct {
+	Format   string `yaml:"format"`    // Go layout, e.g. "Mon 2 Jan 15:04 MST", defaults to RFC 3339
+	TimeZone string `yaml:"time_zone"` // IANA time zone, e.g. Europe/London, defaults to UTC
+}
+
+// timeDisplay is a layout and the location times are shown in
+type timeDisplay struct {
+	layout   string
+	location *time.Location
+}
+
+// displayTimes is how times are shown to people, RFC 3339 in UTC until a configuration with
+// time_display is loaded
+var displayTimes = timeDisplay{layout: time.RFC3339, location: time.UTC}
+
+func (c TimeDisplayConfig) validate() error {
+	if _, err := time.LoadLocation(c.TimeZone); err != nil {
+		return fmt.Errorf("invalid time_zone %s: %v", c.TimeZone, err)
+	}
+	return nil
+}
+
+// apply makes the configured layout and time zone those every time shown to people is formatted
+// in. It is called once when the configuration is loaded, before anything is formatted.
+func (c TimeDisplayConfig) apply() {
+	display := timeDisplay{layout: time.RFC3339, location: time.UTC}
+	if c.Format != "" {
+		display.layout = c.Format
+	}
+	// Validated when the configuration was loaded
+	if location, err := time.LoadLocation(c.TimeZone); err == nil {
+		display.location = location
+	}
+	displayTimes = display
+}
+
+// displayTime formats t for people, in the configured layout and time zone
+func displayTime(t time.Time) string {
+	return t.In(displayTimes.location).Format(displayTimes.layout)
+}
+
+// displayClock formats the time of day of t for people in the configured time zone, for
+// destinations as short as an SMS, such as 15:04Z or 16:04+01:00
+func displayClock(t time.Time) string {
+	return t.In(displayTimes.location).Format("15:04Z07:00")
+}
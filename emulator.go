@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+	monitoredrespb "google.golang.org/genproto/googleapis/api/monitoredres"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// emulatorFixture is a fixture file of the Monitoring API emulator
+type emulatorFixture struct {
+	// Series are served as they are, in the protojson form of monitoring.v3.TimeSeries, for the
+	// points within the requested interval
+	Series []json.RawMessage `json:"series"`
+	// Generated series have points at every interval of any requested window, so a fixture
+	// keeps working whenever it is run
+	Generated []generatedSeries `json:"generated"`
+	// Errors fail the requests for a metric
+	Errors []emulatedError `json:"errors"`
+	// Now fixes the time the spikes of generated series end at (RFC3339), so the fixture serves
+	// the same points on every run; the spikes end at the wall clock time otherwise
+	Now string `json:"now"`
+}
+
+// generatedSeries is a series with normally distributed points around a mean, optionally
+// spiking to another value over its last minutes
+type generatedSeries struct {
+	MetricType     string            `json:"metric_type"`
+	Labels         map[string]string `json:"labels"`
+	ResourceType   string            `json:"resource_type"` // defaults to global
+	ResourceLabels map[string]string `json:"resource_labels"`
+	IntervalSec    int               `json:"interval_sec"` // seconds between points, defaults to 60
+	Mean           float64           `json:"mean"`
+	StdDev         float64           `json:"stddev"`
+	SpikeMin       int               `json:"spike_min"`   // minutes before the time of the emulator the points take spike_value
+	SpikeValue     float64           `json:"spike_value"` // value of the points of the spike
+}
+
+// emulatedError fails the requests for a metric with a gRPC status
+type emulatedError struct {
+	MetricType string     `json:"metric_type"`
+	Code       codes.Code `json:"code"` // name of the gRPC code, such as "UNAVAILABLE"
+	Message    string     `json:"message"`
+	Times      int        `json:"times"` // requests failing before the metric is served, 0 fails every request
+}
+
+// monitoringEmulator serves the ListTimeSeries method of the Monitoring API from fixtures, so the
+// detector can be run end to end without a Google Cloud project
+type monitoringEmulator struct {
+	monitoringpb.UnimplementedMetricServiceServer
+
+	series    []*monitoringpb.TimeSeries
+	generated []generatedSeries
+	pageSize  int   // page size of the requests without one
+	clock     Clock // the time the spikes of generated series end at
+
+	mu     sync.Mutex
+	errors map[string]*emulatedError
+}
+
+// runEmulator serves the Monitoring API emulator until the process is stopped
+func runEmulator(args []string) {
+	fs := flag.NewFlagSet("emulate", flag.ExitOnError)
+	listen := fs.String("listen", "localhost:8085", "Address to serve the emulated Monitoring API on")
+	fixtures := fs.String("fixtures", "", "Fixture file, or directory of .json fixture files, to seed the emulator with")
+	pageSize := fs.Int("page-size", 10, "Series per page of requests without a page size, small to exercise pagination")
+	fs.Parse(args)
+
+	if *fixtures == "" {
+		log.Fatalf("The -fixtures flag is required")
+	}
+	if *pageSize <= 0 {
+		log.Fatalf("The -page-size flag must be positive")
+	}
+	emulator, err := newMonitoringEmulator(*fixtures, *pageSize)
+	if err != nil {
+		log.Fatalf("Failed to load fixtures: %v", err)
+	}
+
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		log.Fatalf("Failed to listen on %s: %v", *listen, err)
+	}
+	server := grpc.NewServer()
+	monitoringpb.RegisterMetricServiceServer(server, emulator)
+	log.Printf("Emulating the Monitoring API on %s with %d series and %d generated series\n", listener.Addr(), len(emulator.series), len(emulator.generated))
+	if err := server.Serve(listener); err != nil {
+		log.Fatalf("Emulator failed: %v", err)
+	}
+}
+
+// newMonitoringEmulator returns an emulator seeded from the fixture file at path, or from every
+// .json file of the directory at path
+func newMonitoringEmulator(path string, pageSize int) (*monitoringEmulator, error) {
+	files := []string{path}
+	if info, err := os.Stat(path); err != nil {
+		return nil, err
+	} else if info.IsDir() {
+		if files, err = filepath.Glob(filepath.Join(path, "*.json")); err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, fmt.Errorf("no .json fixtures in %s", path)
+		}
+	}
+
+	e := &monitoringEmulator{pageSize: pageSize, clock: wallClock{}, errors: make(map[string]*emulatedError)}
+	var now time.Time
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		var fixture emulatorFixture
+		if err := json.Unmarshal(data, &fixture); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		for i, raw := range fixture.Series {
+			ts := &monitoringpb.TimeSeries{}
+			if err := protojson.Unmarshal(raw, ts); err != nil {
+				return nil, fmt.Errorf("%s: series %d: %v", file, i, err)
+			}
+			if ts.GetMetric().GetType() == "" {
+				return nil, fmt.Errorf("%s: series %d has no metric type", file, i)
+			}
+			e.series = append(e.series, ts)
+		}
+		for i, generated := range fixture.Generated {
+			if generated.MetricType == "" {
+				return nil, fmt.Errorf("%s: generated series %d has no metric type", file, i)
+			}
+			if generated.IntervalSec < 0 || generated.StdDev < 0 || generated.SpikeMin < 0 {
+				return nil, fmt.Errorf("%s: generated series %d: interval_sec, stddev and spike_min must not be negative", file, i)
+			}
+			e.generated = append(e.generated, generated)
+		}
+		for i := range fixture.Errors {
+			failure := fixture.Errors[i]
+			if failure.MetricType == "" || failure.Code == codes.OK {
+				return nil, fmt.Errorf("%s: error %d needs a metric type and a code other than OK", file, i)
+			}
+			e.errors[failure.MetricType] = &failure
+		}
+		if fixture.Now != "" {
+			t, err := time.Parse(time.RFC3339, fixture.Now)
+			if err != nil {
+				return nil, fmt.Errorf("%s: invalid now: %v", file, err)
+			}
+			if !now.IsZero() && !t.Equal(now) {
+				return nil, fmt.Errorf("%s: now %s differs from the %s of another fixture", file, fixture.Now, now.Format(time.RFC3339))
+			}
+			now = t
+		}
+	}
+	if !now.IsZero() {
+		e.clock = newManualClock(now)
+	}
+	return e, nil
+}
+
+// ListTimeSeries returns a page of the fixture series matching the filter, with their points in
+// the interval. Aggregations are not emulated, so the points are returned as they are.
+func (e *monitoringEmulator) ListTimeSeries(ctx context.Context, req *monitoringpb.ListTimeSeriesRequest) (*monitoringpb.ListTimeSeriesResponse, error) {
+	filter, err := parseEmulatorFilter(req.Filter)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if req.GetInterval().GetEndTime() == nil {
+		return nil, status.Error(codes.InvalidArgument, "interval.end_time is required")
+	}
+	if err := e.failure(filter["metric.type"]); err != nil {
+		return nil, err
+	}
+	start, end := req.Interval.GetStartTime().AsTime(), req.Interval.EndTime.AsTime()
+	if req.Interval.StartTime == nil {
+		start = end
+	}
+
+	var matched []*monitoringpb.TimeSeries
+	for _, ts := range e.series {
+		if filterMatches(filter, ts) {
+			if windowed := pointsInInterval(ts, start, end); len(windowed.Points) > 0 {
+				matched = append(matched, windowed)
+			}
+		}
+	}
+	for _, generated := range e.generated {
+		if generated.MetricType != filter["metric.type"] {
+			continue
+		}
+		if ts := generated.series(start, end, e.clock.Now()); filterMatches(filter, ts) && len(ts.Points) > 0 {
+			matched = append(matched, ts)
+		}
+	}
+
+	offset := 0
+	if req.PageToken != "" {
+		if offset, err = strconv.Atoi(req.PageToken); err != nil || offset < 0 || offset > len(matched) {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid page token %q", req.PageToken)
+		}
+	}
+	pageSize := int(req.PageSize)
+	if pageSize <= 0 {
+		pageSize = e.pageSize
+	}
+	response := &monitoringpb.ListTimeSeriesResponse{TimeSeries: matched[offset:min(offset+pageSize, len(matched))]}
+	if offset+pageSize < len(matched) {
+		response.NextPageToken = strconv.Itoa(offset + pageSize)
+	}
+	log.Printf("ListTimeSeries %s: %d series, page from %d\n", req.Filter, len(response.TimeSeries), offset)
+	return response, nil
+}
+
+// failure returns the error a request for the metric fails with, if any
+func (e *monitoringEmulator) failure(metricType string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	failure, ok := e.errors[metricType]
+	if !ok {
+		return nil
+	}
+	if failure.Times > 0 {
+		if failure.Times--; failure.Times == 0 {
+			delete(e.errors, metricType)
+		}
+	}
+	log.Printf("ListTimeSeries of %s failed with %s: %s\n", metricType, failure.Code, failure.Message)
+	return status.Error(failure.Code, failure.Message)
+}
+
+// emulatorClause matches a clause of a filter comparing a field with a quoted value, and
+// emulatorAnd the conjunction between clauses
+var (
+	emulatorClause = regexp.MustCompile(`^\s*([a-z_.]+[A-Za-z0-9_]*)\s*=\s*"([^"]*)"\s*$`)
+	emulatorAnd    = regexp.MustCompile(`\s+AND\s+`)
+)
+
+// parseEmulatorFilter parses a filter of equality clauses joined with AND, the form the detector
+// sends, into the values by field. Other clauses are not supported.
+func parseEmulatorFilter(filter string) (map[string]string, error) {
+	fields := make(map[string]string)
+	for _, clause := range emulatorAnd.Split(filter, -1) {
+		match := emulatorClause.FindStringSubmatch(clause)
+		if match == nil {
+			return nil, fmt.Errorf("unsupported filter clause %q, only field = \"value\" clauses joined with AND are emulated", clause)
+		}
+		fields[match[1]] = match[2]
+	}
+	if fields["metric.type"] == "" {
+		return nil, fmt.Errorf("filter %q has no metric.type", filter)
+	}
+	return fields, nil
+}
+
+// filterMatches reports whether a series has the values of all the fields of a filter
+func filterMatches(filter map[string]string, ts *monitoringpb.TimeSeries) bool {
+	for field, value := range filter {
+		var actual string
+		switch {
+		case field == "metric.type":
+			actual = ts.GetMetric().GetType()
+		case field == "resource.type":
+			actual = ts.GetResource().GetType()
+		case strings.HasPrefix(field, "metric.labels."):
+			actual = ts.GetMetric().GetLabels()[strings.TrimPrefix(field, "metric.labels.")]
+		case strings.HasPrefix(field, "resource.labels."):
+			actual = ts.GetResource().GetLabels()[strings.TrimPrefix(field, "resource.labels.")]
+		default:
+			return false
+		}
+		if actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// pointsInInterval returns a copy of the series holding only its points ending in [start, end]
+func pointsInInterval(ts *monitoringpb.TimeSeries, start, end time.Time) *monitoringpb.TimeSeries {
+	windowed := &monitoringpb.TimeSeries{Metric: ts.Metric, Resource: ts.Resource, Metadata: ts.Metadata, MetricKind: ts.MetricKind, ValueType: ts.ValueType, Unit: ts.Unit}
+	for _, point := range ts.Points {
+		if t := point.Interval.GetEndTime().AsTime(); !t.Before(start) && !t.After(end) {
+			windowed.Points = append(windowed.Points, point)
+		}
+	}
+	return windowed
+}
+
+// series returns the generated points ending in [start, end], newest first as the API returns
+// them, with the spike ending at now. A point's value only depends on the series and its time,
+// so overlapping windows agree.
+func (g generatedSeries) series(start, end, now time.Time) *monitoringpb.TimeSeries {
+	resourceType := g.ResourceType
+	if resourceType == "" {
+		resourceType = "global"
+	}
+	ts := &monitoringpb.TimeSeries{
+		Metric:     &metricpb.Metric{Type: g.MetricType, Labels: g.Labels},
+		Resource:   &monitoredrespb.MonitoredResource{Type: resourceType, Labels: g.ResourceLabels},
+		MetricKind: metricpb.MetricDescriptor_GAUGE,
+		ValueType:  metricpb.MetricDescriptor_DOUBLE,
+	}
+	interval := time.Duration(g.IntervalSec) * time.Second
+	if g.IntervalSec == 0 {
+		interval = time.Minute
+	}
+	seed := fnv.New64a()
+	seed.Write([]byte(seriesFingerprint(ts)))
+	spikeStart := now.Add(-time.Duration(g.SpikeMin) * time.Minute)
+
+	for t := end.Truncate(interval); !t.Before(start); t = t.Add(-interval) {
+		value := g.Mean + g.StdDev*rand.New(rand.NewSource(int64(seed.Sum64())^t.Unix())).NormFloat64()
+		if g.SpikeMin > 0 && t.After(spikeStart) {
+			value = g.SpikeValue
+		}
+		ts.Points = append(ts.Points, &monitoringpb.Point{
+			Interval: &monitoringpb.TimeInterval{EndTime: timestamppb.New(t)},
+			Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+		})
+	}
+	return ts
+}
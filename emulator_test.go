@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// emulatorNow is the time the tests run on, so the generated series are the same on every run
+var emulatorNow = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+const (
+	emulatedRequests = "custom.googleapis.com/emulator/requests"
+	emulatedLatency  = "custom.googleapis.com/emulator/latency"
+)
+
+// startEmulator serves the emulator on a loopback listener for the duration of the test and
+// returns a client of the Monitoring API connected to it, the way the detector connects with
+// monitoring_api.insecure
+func startEmulator(t *testing.T, emulator *monitoringEmulator) (*monitoring.MetricClient, MonitoringAPIConfig) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	server := grpc.NewServer()
+	monitoringpb.RegisterMetricServiceServer(server, emulator)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	api := MonitoringAPIConfig{Endpoint: listener.Addr().String(), Insecure: true}
+	client, err := newMetricClient(CredentialsConfig{}, api)
+	if err != nil {
+		t.Fatalf("newMetricClient: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, api
+}
+
+// newTestEmulator returns an emulator on emulatorNow with a page size of 2 and n generated series
+// of the requests metric, one per endpoint
+func newTestEmulator(n int) *monitoringEmulator {
+	e := &monitoringEmulator{pageSize: 2, clock: newManualClock(emulatorNow), errors: make(map[string]*emulatedError)}
+	for i := 0; i < n; i++ {
+		e.generated = append(e.generated, generatedSeries{
+			MetricType:     emulatedRequests,
+			Labels:         map[string]string{"endpoint": fmt.Sprintf("/e%d", i)},
+			ResourceLabels: map[string]string{"project_id": "emulated"},
+			Mean:           100,
+			StdDev:         5,
+		})
+	}
+	return e
+}
+
+// newEmulatorConfig loads a configuration of the metrics against the emulator, running on
+// emulatorNow
+func newEmulatorConfig(t *testing.T, api MonitoringAPIConfig, metrics ...string) *Config {
+	t.Helper()
+	yaml := fmt.Sprintf("project_id: emulated\nrecent_duration: 10\nmonitoring_api:\n  endpoint: %s\n  insecure: true\nmetrics:\n", api.Endpoint)
+	for _, metric := range metrics {
+		yaml += fmt.Sprintf("  - %s\n", metric)
+	}
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("LoadConfig: %v", err)
+	}
+	config.setDefaults()
+	config.clock = newManualClock(emulatorNow)
+	return config
+}
+
+// hasCode reports whether err reports a gRPC status of code. The fetches format the status into
+// their errors, so the code is read from the message.
+func hasCode(err error, code codes.Code) bool {
+	return err != nil && strings.Contains(err.Error(), "code = "+code.String())
+}
+
+func TestFetchRecentMetricsAcrossPages(t *testing.T) {
+	emulator := newTestEmulator(5)
+	client, api := startEmulator(t, emulator)
+	config := newEmulatorConfig(t, api, emulatedRequests)
+
+	recent, failures, err := fetchRecentMetrics(client, config, newIngestionDelays(IngestionDelayConfig{}), []string{emulatedRequests})
+	if err != nil {
+		t.Fatalf("fetchRecentMetrics: %v", err)
+	}
+	if len(failures) != 0 {
+		t.Fatalf("failures = %v, want none", failures)
+	}
+	// Five series at two per page take three pages
+	if len(recent) != 5 {
+		t.Fatalf("got %d series, want 5", len(recent))
+	}
+	endpoints := make(map[string]bool)
+	for _, ts := range recent {
+		endpoints[ts.Metric.Labels["endpoint"]] = true
+		// The interval is closed, as the API's, so the 10 minutes hold 11 points a minute apart
+		if len(ts.Points) != 11 {
+			t.Errorf("series %s has %d points, want 11", ts.Metric.Labels["endpoint"], len(ts.Points))
+		}
+		for _, point := range ts.Points {
+			if end := point.Interval.EndTime.AsTime(); end.After(emulatorNow) || end.Before(emulatorNow.Add(-10*time.Minute)) {
+				t.Errorf("point at %s outside the recent window", end)
+			}
+		}
+	}
+	if len(endpoints) != 5 {
+		t.Errorf("got endpoints %v, want 5 distinct", endpoints)
+	}
+}
+
+func TestStreamMetricsInRangeAcrossPages(t *testing.T) {
+	emulator := newTestEmulator(7)
+	client, _ := startEmulator(t, emulator)
+
+	var series int
+	start, end := emulatorNow.Add(-time.Hour), emulatorNow
+	err := streamMetricsInRange(client, "test", "emulated", []string{emulatedRequests}, start, end, nil, nil, func(ts *monitoringpb.TimeSeries) {
+		series++
+		if len(ts.Points) != 61 {
+			t.Errorf("series %s has %d points, want 61", ts.Metric.Labels["endpoint"], len(ts.Points))
+		}
+	})
+	if err != nil {
+		t.Fatalf("streamMetricsInRange: %v", err)
+	}
+	if series != 7 {
+		t.Fatalf("got %d series over four pages, want 7", series)
+	}
+}
+
+func TestStreamMetricsInRangeReturnsInjectedError(t *testing.T) {
+	emulator := newTestEmulator(3)
+	emulator.errors[emulatedRequests] = &emulatedError{MetricType: emulatedRequests, Code: codes.PermissionDenied, Message: "emulated denial"}
+	client, _ := startEmulator(t, emulator)
+
+	err := streamMetricsInRange(client, "test", "emulated", []string{emulatedRequests}, emulatorNow.Add(-time.Hour), emulatorNow, nil, nil, func(*monitoringpb.TimeSeries) {
+		t.Error("series streamed from a failing metric")
+	})
+	if err == nil {
+		t.Fatal("streamMetricsInRange succeeded, want the injected error")
+	}
+	if !hasCode(err, codes.PermissionDenied) {
+		t.Fatalf("error %v does not carry PermissionDenied", err)
+	}
+	if !strings.Contains(err.Error(), "emulated denial") {
+		t.Errorf("error %v lost the message of the status", err)
+	}
+}
+
+func TestStreamBaselineMetricsAcrossChunks(t *testing.T) {
+	emulator := newTestEmulator(3)
+	client, api := startEmulator(t, emulator)
+	config := newEmulatorConfig(t, api, emulatedRequests)
+	config.BaselineChunk = 1
+
+	// Two and a half hours take three chunks, the last one half an hour; the points 90 and 30
+	// minutes back end exactly on a boundary, so the API returns them with both chunks
+	start, end := emulatorNow.Add(-150*time.Minute), emulatorNow
+	if chunks := config.baselineChunks(start, end); len(chunks) != 3 || !chunks[2].start.Equal(end.Add(-30*time.Minute)) || !chunks[2].end.Equal(end) {
+		t.Fatalf("got chunks %v, want three of an hour, an hour and half an hour", chunks)
+	}
+
+	calls := make(map[string]int)
+	points := make(map[string]map[time.Time]int)
+	err := streamBaselineMetrics(client, config, []string{emulatedRequests}, start, end, func(ts *monitoringpb.TimeSeries) {
+		endpoint := ts.Metric.Labels["endpoint"]
+		calls[endpoint]++
+		if points[endpoint] == nil {
+			points[endpoint] = make(map[time.Time]int)
+		}
+		for _, point := range ts.Points {
+			points[endpoint][point.Interval.EndTime.AsTime()]++
+		}
+	})
+	if err != nil {
+		t.Fatalf("streamBaselineMetrics: %v", err)
+	}
+	if len(calls) != 3 {
+		t.Fatalf("got series %v, want 3", calls)
+	}
+	for endpoint, n := range calls {
+		if n != 3 {
+			t.Errorf("series %s handed over %d times, want once per chunk", endpoint, n)
+		}
+		// Every minute of the closed window once, the boundaries included
+		if len(points[endpoint]) != 151 {
+			t.Errorf("series %s has %d distinct points, want 151", endpoint, len(points[endpoint]))
+		}
+		for at, count := range points[endpoint] {
+			if count != 1 {
+				t.Errorf("series %s has the point at %s %d times", endpoint, at, count)
+			}
+		}
+		for _, boundary := range []time.Time{end.Add(-90 * time.Minute), end.Add(-30 * time.Minute)} {
+			if points[endpoint][boundary] != 1 {
+				t.Errorf("series %s lost the point on the boundary at %s", endpoint, boundary)
+			}
+		}
+	}
+}
+
+func TestFetchRecentMetricsRecoversFromTransientErrors(t *testing.T) {
+	emulator := newTestEmulator(3)
+	// Unavailable is retried by the client, so a metric failing twice is still fetched
+	emulator.errors[emulatedRequests] = &emulatedError{MetricType: emulatedRequests, Code: codes.Unavailable, Message: "emulated outage", Times: 2}
+	client, api := startEmulator(t, emulator)
+	config := newEmulatorConfig(t, api, emulatedRequests)
+
+	recent, failures, err := fetchRecentMetrics(client, config, newIngestionDelays(IngestionDelayConfig{}), []string{emulatedRequests})
+	if err != nil {
+		t.Fatalf("fetchRecentMetrics: %v", err)
+	}
+	if len(failures) != 0 || len(recent) != 3 {
+		t.Fatalf("got %d series and failures %v, want 3 series and no failures", len(recent), failures)
+	}
+}
+
+func TestFetchRecentMetricsReportsFailingMetric(t *testing.T) {
+	emulator := newTestEmulator(3)
+	emulator.generated = append(emulator.generated, generatedSeries{MetricType: emulatedLatency, Mean: 250, StdDev: 20})
+	emulator.errors[emulatedLatency] = &emulatedError{MetricType: emulatedLatency, Code: codes.PermissionDenied, Message: "emulated denial"}
+	client, api := startEmulator(t, emulator)
+	config := newEmulatorConfig(t, api, emulatedRequests, emulatedLatency)
+	metrics := []string{emulatedRequests, emulatedLatency}
+
+	recent, failures, err := fetchRecentMetrics(client, config, newIngestionDelays(IngestionDelayConfig{}), metrics)
+	if err != nil {
+		t.Fatalf("fetchRecentMetrics: %v, want only the failing metric left out", err)
+	}
+	if len(recent) != 3 {
+		t.Errorf("got %d series, want the 3 of the healthy metric", len(recent))
+	}
+	if failure := failures[emulatedLatency]; !hasCode(failure, codes.PermissionDenied) {
+		t.Errorf("failure of %s = %v, want PermissionDenied", emulatedLatency, failure)
+	}
+	if _, ok := failures[emulatedRequests]; ok {
+		t.Errorf("%s reported failing", emulatedRequests)
+	}
+
+	// Every metric failing fails the fetch
+	emulator.errors[emulatedRequests] = &emulatedError{MetricType: emulatedRequests, Code: codes.PermissionDenied, Message: "emulated denial"}
+	if _, _, err := fetchRecentMetrics(client, config, newIngestionDelays(IngestionDelayConfig{}), metrics); err == nil {
+		t.Error("fetchRecentMetrics succeeded with every metric failing")
+	}
+}
+
+func TestGeneratedSpikeEndsAtEmulatorTime(t *testing.T) {
+	g := generatedSeries{MetricType: emulatedRequests, Mean: 40, StdDev: 2, SpikeMin: 10, SpikeValue: 90}
+	ts := g.series(emulatorNow.Add(-time.Hour), emulatorNow, emulatorNow)
+	again := g.series(emulatorNow.Add(-time.Hour), emulatorNow, emulatorNow)
+	for i, point := range ts.Points {
+		value, end := point.Value.GetDoubleValue(), point.Interval.EndTime.AsTime()
+		if again.Points[i].Value.GetDoubleValue() != value {
+			t.Fatalf("point at %s differs between runs", end)
+		}
+		if spiking := end.After(emulatorNow.Add(-10 * time.Minute)); spiking != (value == 90) {
+			t.Errorf("point at %s is %v, spike expected %v", end, value, spiking)
+		}
+	}
+}
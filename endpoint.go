@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// defaultMonitoringEndpoint is the address of the public Cloud Monitoring API
+const defaultMonitoringEndpoint = "monitoring.googleapis.com:443"
+
+// MonitoringAPIConfig selects how the Monitoring API is reached, for deployments in VPCs
+// without direct access to the public Google APIs
+type MonitoringAPIConfig struct {
+	Endpoint string `yaml:"endpoint"` // host:port of the API, e.g. a Private Service Connect endpoint; defaults to monitoring.googleapis.com:443
+	Proxy    string `yaml:"proxy"`    // HTTP proxy URL to tunnel through; defaults to $HTTPS_PROXY, honouring $NO_PROXY
+	Record   string `yaml:"record"`   // file to append the API's requests and responses to
+	Replay   string `yaml:"replay"`   // file of recorded responses to answer requests from, without reaching the API
+	Insecure bool   `yaml:"insecure"` // connects to endpoint without TLS or credentials, for a local emulator
+}
+
+// clientOptions returns the options that connect a Monitoring client as configured
+func (c MonitoringAPIConfig) clientOptions() ([]option.ClientOption, error) {
+	if c.Replay != "" {
+		if c.Record != "" {
+			return nil, fmt.Errorf("record and replay are mutually exclusive")
+		}
+		replay, err := replayInterceptor(c.Replay)
+		if err != nil {
+			return nil, err
+		}
+		return []option.ClientOption{option.WithoutAuthentication(), option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(replay))}, nil
+	}
+
+	if c.Insecure {
+		if c.Endpoint == "" {
+			return nil, fmt.Errorf("insecure requires an endpoint")
+		}
+		dialOpts := []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+		if c.Record != "" {
+			record, err := recordingInterceptor(c.Record)
+			if err != nil {
+				return nil, err
+			}
+			dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(record))
+		}
+		conn, err := grpc.Dial(c.Endpoint, dialOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("could not connect to %s: %v", c.Endpoint, err)
+		}
+		return []option.ClientOption{option.WithGRPCConn(conn)}, nil
+	}
+
+	var opts []option.ClientOption
+	if c.Record != "" {
+		record, err := recordingInterceptor(c.Record)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(record)))
+	}
+	endpoint := defaultMonitoringEndpoint
+	if c.Endpoint != "" {
+		endpoint = c.Endpoint
+		opts = append(opts, option.WithEndpoint(endpoint))
+	}
+
+	proxy, err := c.proxyURL(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if proxy != nil {
+		if password, ok := proxy.User.Password(); ok {
+			secrets.add(password)
+		}
+		opts = append(opts, option.WithGRPCDialOption(grpc.WithContextDialer(func(ctx context.Context, addr string) (net.Conn, error) {
+			return dialThroughProxy(ctx, proxy, addr)
+		})))
+	}
+	return opts, nil
+}
+
+// proxyURL returns the proxy to reach endpoint through, nil for a direct connection
+func (c MonitoringAPIConfig) proxyURL(endpoint string) (*url.URL, error) {
+	if c.Proxy != "" {
+		proxy, err := url.Parse(c.Proxy)
+		if err != nil || proxy.Host == "" {
+			return nil, fmt.Errorf("invalid proxy %q", c.Proxy)
+		}
+		return proxy, nil
+	}
+	// The environment is read explicitly, as gRPC otherwise decides by itself whether to use it
+	return http.ProxyFromEnvironment(&http.Request{URL: &url.URL{Scheme: "https", Host: endpoint}})
+}
+
+// dialThroughProxy opens a tunnel to addr through an HTTP proxy with a CONNECT request
+func dialThroughProxy(ctx context.Context, proxy *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to proxy %s: %v", proxyAddr, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", addr, addr)
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		request += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	if _, err := conn.Write([]byte(request + "\r\n")); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not send CONNECT to proxy %s: %v", proxyAddr, err)
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("could not read CONNECT response of proxy %s: %v", proxyAddr, err)
+	}
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", proxyAddr, addr, strings.TrimSpace(response.Status))
+	}
+	conn.SetDeadline(time.Time{})
+	// Bytes the proxy sent past the response header belong to the tunnel
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// bufferedConn reads through the reader that consumed the proxy's response header
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// EventOpen marks an event whose anomaly is still going on and nobody has taken on
+	EventOpen = "open"
+	// EventAcknowledged marks an event someone is looking into
+	EventAcknowledged = "acknowledged"
+	// EventResolved marks an event that ended, or was closed by hand
+	EventResolved = "resolved"
+
+	// actorDetector is the actor of the transitions the detector makes itself
+	actorDetector = "detector"
+
+	// resolvedEventRetention is how long resolved events are kept
+	resolvedEventRetention = 7 * 24 * time.Hour
+)
+
+// LifecycleConfig tracks every anomaly as an event moving from open through acknowledged to
+// resolved
+type LifecycleConfig struct {
+	Path            string `yaml:"path"`              // local file or gs:// URI where the events are persisted
+	ResolveAfterMin int    `yaml:"resolve_after_min"` // minutes without anomalies before an event is resolved, defaults to 30
+}
+
+// Event is the lifecycle of one anomaly event, identified by the anomaly ID
+type Event struct {
+	ID                string       `json:"id"`
+	Fingerprint       string       `json:"fingerprint"`
+	SeriesFingerprint string       `json:"series_fingerprint,omitempty"`
+	MetricName        string       `json:"metric_name"`
+	Kind              string       `json:"kind"`
+	State             string       `json:"state"`
+	OpenedAt          time.Time    `json:"opened_at"`
+	LastSeen          time.Time    `json:"last_seen"` // when the anomaly was last reported
+	Transitions       []Transition `json:"transitions"`
+	Anomaly           Anomaly      `json:"anomaly"` // the latest report of the anomaly
+}
+
+// Transition records an event changing state
+type Transition struct {
+	From    string    `json:"from,omitempty"` // empty for the opening transition
+	To      string    `json:"to"`
+	At      time.Time `json:"at"`
+	Actor   string    `json:"actor"` // detector, or who acknowledged or resolved the event
+	Comment string    `json:"comment,omitempty"`
+}
+
+// EventStore keeps the anomaly events, optionally persisting them so they survive restarts
+type EventStore struct {
+	path         string
+	resolveAfter time.Duration
+	clock        Clock // tells when resolved events are past their retention
+
+	mu     sync.Mutex
+	events map[string]*Event // by ID
+}
+
+// NewEventStore loads the events persisted at the configured path, running on clock. An empty
+// path keeps them in memory only.
+func NewEventStore(ctx context.Context, config LifecycleConfig, clock Clock) (*EventStore, error) {
+	if config.ResolveAfterMin == 0 {
+		config.ResolveAfterMin = 30
+	}
+	store := &EventStore{
+		path:         config.Path,
+		resolveAfter: time.Duration(config.ResolveAfterMin) * time.Minute,
+		clock:        clock,
+		events:       make(map[string]*Event),
+	}
+	if config.Path == "" {
+		return store, nil
+	}
+
+	data, err := readObject(ctx, config.Path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var events []*Event
+	if err := json.Unmarshal(data, &events); err != nil {
+		return nil, fmt.Errorf("could not parse events %s: %v", config.Path, err)
+	}
+	for _, event := range events {
+		store.events[event.ID] = event
+	}
+	return store, nil
+}
+
+// observe opens an event for every new anomaly and records the others as seen again, setting
+// the state of the anomalies to that of their event. Resolved events reported again reopen. A
+// new event of an alert resolves the alert's earlier events, so an alert has one event at a time.
+func (s *EventStore) observe(ctx context.Context, anomalies []Anomaly, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range anomalies {
+		anomaly := &anomalies[i]
+		if anomaly.Kind == KindRateLimit {
+			continue
+		}
+		event, ok := s.events[anomaly.ID]
+		switch {
+		case !ok:
+			for _, previous := range s.events {
+				if previous.Fingerprint == anomaly.Fingerprint && previous.State != EventResolved {
+					previous.transition(EventResolved, now, actorDetector, "superseded by "+anomaly.ID)
+				}
+			}
+			event = &Event{
+				ID:                anomaly.ID,
+				Fingerprint:       anomaly.Fingerprint,
+				SeriesFingerprint: anomaly.SeriesFingerprint,
+				MetricName:        anomaly.MetricName,
+				Kind:              anomaly.Kind,
+				OpenedAt:          now,
+			}
+			event.transition(EventOpen, now, actorDetector, "")
+			s.events[anomaly.ID] = event
+		case event.State == EventResolved:
+			event.transition(EventOpen, now, actorDetector, "reported again")
+		}
+		event.LastSeen = now
+		event.Anomaly = *anomaly
+		anomaly.State = event.State
+	}
+	if len(anomalies) > 0 {
+		s.persistLogged(ctx)
+	}
+}
+
+// resolveQuiet resolves the events not reported for resolve_after_min and returns them
+func (s *EventStore) resolveQuiet(ctx context.Context, now time.Time) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var resolved []Event
+	for _, event := range s.events {
+		if event.State != EventResolved && now.Sub(event.LastSeen) >= s.resolveAfter {
+			event.transition(EventResolved, now, actorDetector, fmt.Sprintf("no anomalies since %s", event.LastSeen.UTC().Format(time.RFC3339)))
+			resolved = append(resolved, *event)
+		}
+	}
+	if len(resolved) > 0 {
+		s.persistLogged(ctx)
+	}
+	return resolved
+}
+
+// Acknowledge moves the open events of an alert or series fingerprint to acknowledged and
+// returns them
+func (s *EventStore) Acknowledge(ctx context.Context, fingerprint, actor, comment string, now time.Time) ([]Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var acknowledged []Event
+	for _, event := range s.events {
+		if event.State == EventOpen && (event.Fingerprint == fingerprint || event.SeriesFingerprint == fingerprint) {
+			event.transition(EventAcknowledged, now, actor, comment)
+			acknowledged = append(acknowledged, *event)
+		}
+	}
+	if len(acknowledged) == 0 {
+		return nil, nil
+	}
+	return acknowledged, s.persist(ctx)
+}
+
+// Resolve closes an event by hand
+func (s *EventStore) Resolve(ctx context.Context, id, actor, comment string, now time.Time) (Event, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event, ok := s.events[id]
+	if !ok {
+		return Event{}, fmt.Errorf("event %s not found: %w", id, os.ErrNotExist)
+	}
+	if event.State == EventResolved {
+		return Event{}, fmt.Errorf("event %s is already resolved", id)
+	}
+	event.transition(EventResolved, now, actor, comment)
+	return *event, s.persist(ctx)
+}
+
+// Get returns an event by ID
+func (s *EventStore) Get(id string) (Event, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event, ok := s.events[id]
+	if !ok {
+		return Event{}, false
+	}
+	return *event, true
+}
+
+// List returns the events in the state, or all events if it is empty, most recently opened first
+func (s *EventStore) List(state string) []Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := []Event{}
+	for _, event := range s.events {
+		if state == "" || event.State == state {
+			events = append(events, *event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].OpenedAt.After(events[j].OpenedAt) })
+	return events
+}
+
+// latest returns the newest transition of the event
+func (e Event) latest() Transition {
+	return e.Transitions[len(e.Transitions)-1]
+}
+
+func (e *Event) transition(to string, at time.Time, actor, comment string) {
+	e.Transitions = append(e.Transitions, Transition{From: e.State, To: to, At: at, Actor: actor, Comment: comment})
+	log.Printf("Event %s on %s %s by %s\n", e.ID, e.MetricName, to, actor)
+	e.State = to
+}
+
+// save persists the events
+func (s *EventStore) save(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.persist(ctx)
+}
+
+// persistLogged persists the events, logging a failure, for the transitions made while
+// reporting, which must not hold up notification. The caller holds mu.
+func (s *EventStore) persistLogged(ctx context.Context) {
+	if err := s.persist(ctx); err != nil {
+		log.Printf("Failed to persist events: %v", err)
+	}
+}
+
+// persist writes the events to the configured path, dropping those resolved longer ago than
+// the retention. The caller holds mu.
+func (s *EventStore) persist(ctx context.Context) error {
+	now := s.clock.Now()
+	for id, event := range s.events {
+		if event.State == EventResolved && now.Sub(event.latest().At) > resolvedEventRetention {
+			delete(s.events, id)
+		}
+	}
+	if s.path == "" {
+		return nil
+	}
+
+	events := make([]*Event, 0, len(s.events))
+	for _, event := range s.events {
+		events = append(events, event)
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+
+	data, err := json.MarshalIndent(events, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeObject(ctx, s.path, data); err != nil {
+		return fmt.Errorf("could not persist events: %v", err)
+	}
+	return nil
+}
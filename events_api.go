@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// resolveRequest is the JSON body accepted by POST /events/{id}/resolve
+type resolveRequest struct {
+	Comment   string `json:"comment"`
+	CreatedBy string `json:"created_by"`
+}
+
+// registerEventHandlers adds the event lifecycle API to the mux:
+//
+//	GET  /events               lists the events, optionally filtered with ?state=open
+//	GET  /events/{id}          returns an event with its transitions
+//	POST /events/{id}/resolve  resolves an event by hand
+func registerEventHandlers(mux *http.ServeMux, router *Router) {
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, http.StatusOK, router.Events().List(r.URL.Query().Get("state")))
+	})
+	mux.HandleFunc("/events/", func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/events/")
+		if id, ok := strings.CutSuffix(path, "/resolve"); ok {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			resolveEvent(w, r, router, id)
+			return
+		}
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		event, ok := router.Events().Get(path)
+		if !ok {
+			http.Error(w, fmt.Sprintf("event %s not found", path), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, event)
+	})
+}
+
+func resolveEvent(w http.ResponseWriter, r *http.Request, router *Router, id string) {
+	var req resolveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	event, err := router.ResolveEvent(r.Context(), id, req.CreatedBy, req.Comment)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		writeJSON(w, http.StatusOK, event)
+	}
+}
+
+// runEventsCommand lists and resolves anomaly events on a running detector through its HTTP API
+func runEventsCommand(args []string) {
+	fs := flag.NewFlagSet("events", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "URL of the detector started with serve")
+	token := fs.String("token", os.Getenv("ANOMALY_DETECTOR_TOKEN"), "Bearer token of a server with auth configured, defaults to $ANOMALY_DETECTOR_TOKEN")
+	state := fs.String("state", "", "Only list events in this state: open, acknowledged or resolved")
+	show := fs.String("show", "", "ID of an event to show with its transitions")
+	resolve := fs.String("resolve", "", "ID of an event to resolve")
+	comment := fs.String("comment", "", "Why the event was resolved")
+	fs.Parse(args)
+
+	baseURL := strings.TrimSuffix(*server, "/")
+	var req *http.Request
+	var err error
+	switch {
+	case *resolve != "":
+		body, _ := json.Marshal(resolveRequest{Comment: *comment, CreatedBy: os.Getenv("USER")})
+		req, err = http.NewRequest(http.MethodPost, baseURL+"/events/"+url.PathEscape(*resolve)+"/resolve", bytes.NewReader(body))
+	case *show != "":
+		req, err = http.NewRequest(http.MethodGet, baseURL+"/events/"+url.PathEscape(*show), nil)
+	default:
+		req, err = http.NewRequest(http.MethodGet, baseURL+"/events?state="+url.QueryEscape(*state), nil)
+	}
+	if err != nil {
+		log.Fatalf("Invalid request: %v", err)
+	}
+
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		log.Fatalf("Request failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Print(string(body))
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// runExplain shows how the point of a series nearest to a time was scored: the baseline it was
+// compared against, its Z-score, the thresholds that applied and whether it triggered, for
+// reviewing an alert after the fact
+func runExplain(args []string) {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	credentials := addCredentialFlags(fs)
+	metric := fs.String("metric", "", "Metric type of the series")
+	labels := fs.String("labels", "", "Comma-separated key=value labels selecting the series, e.g. instance_id=123,zone=us-central1-a")
+	fingerprint := fs.String("fingerprint", "", "Fingerprint of the series, instead of -labels")
+	at := fs.String("time", "", "Time of the point to explain (RFC3339)")
+	fs.Parse(args)
+
+	if *metric == "" || *at == "" {
+		log.Fatalf("The -metric and -time flags are required")
+	}
+	pointTime, err := time.Parse(time.RFC3339, *at)
+	if err != nil {
+		log.Fatalf("Invalid -time: %v", err)
+	}
+	selector, err := parseLabelSelector(*labels)
+	if err != nil {
+		log.Fatalf("Invalid -labels: %v", err)
+	}
+
+	config := mustLoadConfig(*configPath)
+	config.Credentials.override(*credentials)
+	mustDiscoverWorkloads(config)
+	if err := config.selectMetrics([]string{*metric}); err != nil {
+		log.Fatalf("Invalid -metric: %v", err)
+	}
+	client := mustCreateClient(config.Credentials, config.MonitoringAPI)
+	mustValidateFilters(client, config)
+
+	// The baseline is the one a detector started just before the recent window of the point would
+	// have built
+	recent := time.Duration(config.RecentDuration) * time.Minute
+	baselineStart, baselineEnd := config.baselineRange(pointTime.Add(-recent))
+	detector := newDetector(config)
+	err = detector.streamBaseline(func(add func(*monitoringpb.TimeSeries)) error {
+		return streamBaselineMetrics(client, config, config.MetricTypes(), baselineStart, baselineEnd, add)
+	})
+	if err != nil {
+		log.Fatalf("Failed to fetch baseline metrics: %v", err)
+	}
+
+	var matched []*monitoringpb.TimeSeries
+	err = streamConfiguredMetrics(client, config, "explained", config.MetricTypes(), pointTime.Add(-recent), pointTime.Add(recent), func(ts *monitoringpb.TimeSeries) {
+		if *fingerprint != "" && seriesFingerprint(ts) != *fingerprint {
+			return
+		}
+		if selectsLabels(selector, seriesLabels(ts)) {
+			matched = append(matched, ts)
+		}
+	})
+	if err != nil {
+		log.Fatalf("Failed to fetch the series: %v", err)
+	}
+	if len(matched) == 0 {
+		fmt.Printf("No series of %s matches the selection between %s and %s\n",
+			*metric, pointTime.Add(-recent).Format(time.RFC3339), pointTime.Add(recent).Format(time.RFC3339))
+		os.Exit(1)
+	}
+
+	suppressions, _ := compileSuppressions(config.Suppressions) // validated when loaded
+	fmt.Printf("Baseline window: %s to %s\n", baselineStart.Format(time.RFC3339), baselineEnd.Format(time.RFC3339))
+	for _, ts := range matched {
+		fmt.Println()
+		explainPoint(config, detector, suppressions, ts, pointTime)
+	}
+}
+
+// explainPoint prints the scoring of the point of the series nearest to pointTime
+func explainPoint(config *Config, detector *SimpleAnomalyDetector, suppressions []suppressionRule, ts *monitoringpb.TimeSeries, pointTime time.Time) {
+	fingerprint := seriesFingerprint(ts)
+	labels := seriesLabels(ts)
+	fmt.Printf("Series %s {%s} (fingerprint %s)\n", labels["resource_type"], formatLabels(withoutResourceType(labels)), fingerprint)
+
+	points := make([]*monitoringpb.Point, len(ts.Points))
+	copy(points, ts.Points)
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Interval.EndTime.AsTime().Before(points[j].Interval.EndTime.AsTime())
+	})
+	nearest := 0
+	for i, point := range points {
+		if absDuration(point.Interval.EndTime.AsTime().Sub(pointTime)) < absDuration(points[nearest].Interval.EndTime.AsTime().Sub(pointTime)) {
+			nearest = i
+		}
+	}
+	point := points[nearest]
+	timestamp := point.Interval.EndTime.AsTime()
+	value := pointValue(point)
+	fmt.Printf("  Point: %s at %s\n", formatValue(value, ts.Unit), displayTime(timestamp))
+
+	baselineKey := detector.baselineKey(ts, fingerprint)
+	stats, ok := detector.baselineFor(ts.Metric.Type, baselineKey, timestamp)
+	source := "the series' own baseline"
+	if baselineKey != fingerprint {
+		source = fmt.Sprintf("the shared baseline %s", strings.TrimPrefix(baselineKey, sharedBaselinePrefix))
+	}
+	if detector.referenced[ts.Metric.Type] {
+		source = "the baseline of the whole metric in the reference environment"
+	}
+	if _, ok := detector.fixed[ts.Metric.Type]; ok {
+		source = "the fixed baseline of the metric in the configuration"
+	}
+	transform := detector.transforms[ts.Metric.Type]
+	if transform != nil {
+		// The baseline statistics are those of the transformed values, which have no unit
+		fmt.Printf("  Baseline: %s, of the transformed values, mean %.4g, stddev %.4g over %d points\n",
+			source, stats.mean, stats.stddev, stats.count)
+	} else {
+		fmt.Printf("  Baseline: %s, mean %s, stddev %s over %d points\n",
+			source, formatValue(stats.mean, ts.Unit), formatValue(stats.stddev, ts.Unit), stats.count)
+	}
+	if !ok {
+		fmt.Printf("  Not triggered: the baseline has %d points, fewer than the %d required, so the series is not scored\n",
+			stats.count, detector.requiredBaselinePoints())
+		return
+	}
+	if reason, untrusted := detector.untrusted[baselineKey]; untrusted {
+		if config.BaselineQuality.SkipDetection {
+			fmt.Printf("  Not triggered: the baseline is untrustworthy (%s), so the series is not scored\n", reason)
+			return
+		}
+		fmt.Printf("  Warning: the baseline may not be trustworthy: %s\n", reason)
+	}
+
+	threshold := config.ZScoreThreshold
+	critical := config.CriticalZScore
+	if critical == 0 {
+		critical = 1.5 * threshold
+	}
+	score := func(point *monitoringpb.Point) float64 {
+		value, ok := transform.apply(pointValue(point))
+		if !ok {
+			return 0
+		}
+		return detector.zeroStdDev.zScore(value, stats, threshold)
+	}
+	if _, ok := transform.apply(value); !ok {
+		fmt.Printf("  Not triggered: the value is outside the domain of the metric's transform, so the point is not scored\n")
+		return
+	}
+	zScore := score(point)
+	margin := detector.zeroStdDev.margin(stats, threshold)
+	expected := transform.expectedRange(stats.mean, margin, value, ts.Unit)
+	fmt.Printf("  Z-score: %.2f", zScore)
+	if stats.stddev == 0 {
+		fmt.Printf(" (the baseline has no variance, scored as configured by zero_stddev)")
+	}
+	fmt.Println()
+	fmt.Printf("  Thresholds: warning above %.2f, critical above %.2f; expected range %s to %s\n",
+		threshold, critical, formatValue(expected.Low, ts.Unit), formatValue(expected.High, ts.Unit))
+
+	condition := detector.conditions[ts.Metric.Type]
+	anomalous := func(point *monitoringpb.Point, zScore float64) bool {
+		if condition != nil {
+			return condition.matches(ts.Metric.Type, zScore, pointValue(point), labels, point.Interval.EndTime.AsTime())
+		}
+		return math.Abs(zScore) > threshold
+	}
+	severity := SeverityWarning
+	if math.Abs(zScore) > critical {
+		severity = SeverityCritical
+	}
+	switch {
+	case condition != nil && !anomalous(point, zScore):
+		fmt.Printf("  Not triggered: the condition %s of the metric does not match\n", condition.source)
+		return
+	case condition != nil:
+		fmt.Printf("  Triggered: the condition %s of the metric matches, severity %s at this point\n", condition.source, severity)
+	case !anomalous(point, zScore):
+		fmt.Printf("  Not triggered: |%.2f| does not exceed the threshold of %.2f\n", zScore, threshold)
+		return
+	default:
+		fmt.Printf("  Triggered: |%.2f| exceeds the threshold of %.2f, severity %s at this point\n", zScore, threshold, severity)
+	}
+
+	// Contiguous points deviating in the same direction are reported as one event from its first
+	// point, with the severity of its peak
+	first := nearest
+	for first > 0 {
+		previous := score(points[first-1])
+		if !anomalous(points[first-1], previous) || (previous > 0) != (zScore > 0) {
+			break
+		}
+		first--
+	}
+	start := points[first].Interval.EndTime.AsTime()
+	switch {
+	case first == 0:
+		fmt.Printf("  The point belongs to an event starting at or before %s, the start of the fetched window\n", start.Format(time.RFC3339))
+	case first != nearest:
+		fmt.Printf("  The point belongs to the event starting at %s, reported under id %s\n", start.Format(time.RFC3339), anomalyID(fingerprint, start))
+	default:
+		fmt.Printf("  The point starts an event, reported under id %s\n", anomalyID(fingerprint, start))
+	}
+
+	anomalies := []Anomaly{{Kind: KindAnomaly, MetricName: ts.Metric.Type, Timestamp: start, Labels: labels}}
+	config.annotate(anomalies)
+	for _, rule := range suppressions {
+		if rule.matches(anomalies[0]) {
+			fmt.Printf("  Suppressed: the suppression rule %q matches, so its notification is dropped\n", rule.name)
+			return
+		}
+	}
+}
+
+// parseLabelSelector parses comma-separated key=value pairs
+func parseLabelSelector(s string) (map[string]string, error) {
+	selector := make(map[string]string)
+	if s == "" {
+		return selector, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q is not key=value", pair)
+		}
+		selector[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return selector, nil
+}
+
+// selectsLabels reports whether the labels hold every value of the selector
+func selectsLabels(selector, labels map[string]string) bool {
+	for key, value := range selector {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"log"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// LinksConfig links every anomaly to its series in Metrics Explorer and optionally to a chart
+// of it, so responders need not reconstruct the query
+type LinksConfig struct {
+	Charts   string `yaml:"charts"`    // local directory or gs:// URI prefix the charts of the anomalies are rendered to as PNG images, none by default
+	ChartURL string `yaml:"chart_url"` // base URL the charts are served from, defaults to the authenticated Cloud Storage URL of a gs:// prefix
+}
+
+// chartURL returns the URL the chart named name is served from
+func (c LinksConfig) chartURL(name string) string {
+	if c.ChartURL != "" {
+		return strings.TrimSuffix(c.ChartURL, "/") + "/" + url.PathEscape(name)
+	}
+	if bucket, prefix, ok := parseGCSURI(strings.TrimSuffix(c.Charts, "/") + "/" + name); ok {
+		return "https://storage.cloud.google.com/" + bucket + "/" + prefix
+	}
+	return strings.TrimSuffix(c.Charts, "/") + "/" + name
+}
+
+// attachLinks links every anomaly to its series in Metrics Explorer over the time around it, and
+// renders a chart of its series in the recent window with links.charts. Derived metrics and
+// rollups exist in the detector only and get no Explorer link; canary and peer anomalies, which
+// have no single series, link to the whole metric and get no chart.
+func (c *Config) attachLinks(ctx context.Context, anomalies []Anomaly, recent []*monitoringpb.TimeSeries, now time.Time) {
+	if c.Links == nil || len(anomalies) == 0 {
+		return
+	}
+	series := make(map[string]*monitoringpb.TimeSeries)
+	points := make(map[string][]*monitoringpb.Point)
+	for _, ts := range recent {
+		fingerprint := seriesFingerprint(ts)
+		if _, ok := series[fingerprint]; !ok {
+			series[fingerprint] = ts
+		}
+		points[fingerprint] = append(points[fingerprint], ts.Points...)
+	}
+	for i := range anomalies {
+		anomaly := &anomalies[i]
+		anomaly.ExplorerURL = c.explorerURL(*anomaly, series[anomaly.SeriesFingerprint], now)
+		if c.Links.Charts == "" || len(points[anomaly.SeriesFingerprint]) < 2 {
+			continue
+		}
+		chart, err := renderChart(*anomaly, points[anomaly.SeriesFingerprint])
+		if err != nil {
+			log.Printf("Could not render the chart of anomaly %s: %v", anomaly.ID, err)
+			continue
+		}
+		name := anomaly.ID + ".png"
+		if err := writeTypedObject(ctx, strings.TrimSuffix(c.Links.Charts, "/")+"/"+name, "image/png", chart); err != nil {
+			log.Printf("Could not write the chart of anomaly %s: %v", anomaly.ID, err)
+			continue
+		}
+		anomaly.ChartURL = c.Links.chartURL(name)
+	}
+}
+
+// explorerURL returns the Metrics Explorer link to the series of the anomaly, or to its metric
+// with its configured filter when ts is nil, from a recent window before the anomaly until now.
+// The expected range is drawn as threshold lines.
+func (c *Config) explorerURL(anomaly Anomaly, ts *monitoringpb.TimeSeries, now time.Time) string {
+	metric, _ := c.MetricConfig(anomaly.MetricName)
+	if metric.Ratio != nil || metric.Expression != nil || metric.rollup != nil {
+		return ""
+	}
+	filter := joinFilters(fmt.Sprintf("metric.type = %q", anomaly.MetricName), c.Filters[anomaly.MetricName])
+	if ts != nil {
+		filter = seriesFilter(ts)
+	}
+	dataSet := map[string]interface{}{
+		"timeSeriesFilter": map[string]interface{}{"filter": filter},
+		"plotType":         "LINE",
+		"targetAxis":       "Y1",
+	}
+	if aggregation := metric.aggregation(); aggregation != nil {
+		period := fmt.Sprintf("%ds", aggregation.AlignmentPeriod.Seconds)
+		dataSet["timeSeriesFilter"] = map[string]interface{}{
+			"filter":             filter,
+			"minAlignmentPeriod": period,
+			"aggregations": []map[string]interface{}{{
+				"perSeriesAligner":   aggregation.PerSeriesAligner.String(),
+				"crossSeriesReducer": aggregation.CrossSeriesReducer.String(),
+				"alignmentPeriod":    period,
+				"groupByFields":      aggregation.GroupByFields,
+			}},
+		}
+	}
+	chart := map[string]interface{}{"dataSets": []interface{}{dataSet}}
+	if anomaly.Expected != nil {
+		chart["constantLines"] = []map[string]interface{}{
+			{"value": anomaly.Expected.Low, "targetAxis": "Y1"},
+			{"value": anomaly.Expected.High, "targetAxis": "Y1"},
+		}
+	}
+	start := anomaly.Timestamp
+	if start.IsZero() || start.After(now) {
+		start = now
+	}
+	start = start.Add(-time.Duration(c.RecentDuration) * time.Minute)
+	state, err := json.Marshal(map[string]interface{}{
+		"xyChart": chart,
+		"timeSelection": map[string]interface{}{
+			"timeRange": "custom",
+			"start":     start.UTC().Format(time.RFC3339),
+			"end":       now.UTC().Format(time.RFC3339),
+		},
+	})
+	if err != nil {
+		return ""
+	}
+	projectID := anomaly.ProjectID
+	if projectID == "" {
+		projectID = c.ProjectID
+	}
+	query := url.Values{"project": {projectID}, "pageState": {string(state)}}
+	return "https://console.cloud.google.com/monitoring/metrics-explorer?" + query.Encode()
+}
+
+// seriesFilter returns the Monitoring filter selecting exactly the series
+func seriesFilter(ts *monitoringpb.TimeSeries) string {
+	clauses := []string{fmt.Sprintf("metric.type = %q", ts.GetMetric().GetType()), fmt.Sprintf("resource.type = %q", ts.GetResource().GetType())}
+	var labels []string
+	for key, value := range ts.GetMetric().GetLabels() {
+		labels = append(labels, fmt.Sprintf("metric.labels.%s = %q", key, value))
+	}
+	for key, value := range ts.GetResource().GetLabels() {
+		labels = append(labels, fmt.Sprintf("resource.labels.%s = %q", key, value))
+	}
+	sort.Strings(labels)
+	return strings.Join(append(clauses, labels...), " AND ")
+}
+
+// Size and colours of the rendered charts
+const (
+	chartWidth  = 480
+	chartHeight = 160
+	chartMargin = 8
+)
+
+var (
+	chartBackground = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+	chartExpected   = color.RGBA{R: 0xe3, G: 0xed, B: 0xf7, A: 0xff}
+	chartLine       = color.RGBA{R: 0x1a, G: 0x73, B: 0xe8, A: 0xff}
+	chartAnomalous  = color.RGBA{R: 0xd9, G: 0x30, B: 0x25, A: 0xff}
+)
+
+// renderChart draws the points of the series of the anomaly as a line chart in PNG, with the
+// expected range as a band and the anomalous points in red
+func renderChart(anomaly Anomaly, points []*monitoringpb.Point) ([]byte, error) {
+	sorted := append([]*monitoringpb.Point(nil), points...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Interval.EndTime.AsTime().Before(sorted[j].Interval.EndTime.AsTime())
+	})
+	first, last := sorted[0].Interval.EndTime.AsTime(), sorted[len(sorted)-1].Interval.EndTime.AsTime()
+	low, high := math.Inf(1), math.Inf(-1)
+	for _, point := range sorted {
+		value := pointValue(point)
+		low, high = math.Min(low, value), math.Max(high, value)
+	}
+	if anomaly.Expected != nil {
+		low, high = math.Min(low, anomaly.Expected.Low), math.Max(high, anomaly.Expected.High)
+	}
+	if high == low {
+		low, high = low-1, high+1
+	}
+	x := func(t time.Time) int {
+		if !last.After(first) {
+			return chartWidth / 2
+		}
+		return chartMargin + int(float64(t.Sub(first))/float64(last.Sub(first))*(chartWidth-2*chartMargin-1))
+	}
+	y := func(value float64) int {
+		return chartHeight - chartMargin - 1 - int((value-low)/(high-low)*(chartHeight-2*chartMargin-1))
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, chartWidth, chartHeight))
+	draw.Draw(img, img.Bounds(), &image.Uniform{C: chartBackground}, image.Point{}, draw.Src)
+	if anomaly.Expected != nil {
+		band := image.Rect(chartMargin, y(anomaly.Expected.High), chartWidth-chartMargin, y(anomaly.Expected.Low)+1)
+		draw.Draw(img, band, &image.Uniform{C: chartExpected}, image.Point{}, draw.Src)
+	}
+	end := anomaly.EndTime
+	if end.IsZero() {
+		end = anomaly.Timestamp
+	}
+	for i := 1; i < len(sorted); i++ {
+		from, to := sorted[i-1], sorted[i]
+		c := chartLine
+		if t := to.Interval.EndTime.AsTime(); !t.Before(anomaly.Timestamp) && !t.After(end) {
+			c = chartAnomalous
+		}
+		drawLine(img, x(from.Interval.EndTime.AsTime()), y(pointValue(from)), x(to.Interval.EndTime.AsTime()), y(pointValue(to)), c)
+	}
+
+	var b bytes.Buffer
+	if err := png.Encode(&b, img); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// drawLine draws a line two pixels thick from (x0, y0) to (x1, y1)
+func drawLine(img *image.RGBA, x0, y0, x1, y1 int, c color.Color) {
+	dx, dy := absInt(x1-x0), -absInt(y1-y0)
+	sx, sy := 1, 1
+	if x0 > x1 {
+		sx = -1
+	}
+	if y0 > y1 {
+		sy = -1
+	}
+	for err := dx + dy; ; {
+		img.Set(x0, y0, c)
+		img.Set(x0, y0+1, c)
+		if x0 == x1 && y0 == y1 {
+			return
+		}
+		e2 := 2 * err
+		if e2 >= dy {
+			err += dy
+			x0 += sx
+		}
+		if e2 <= dx {
+			err += dx
+			y0 += sy
+		}
+	}
+}
+
+func absInt(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
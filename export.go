@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExportConfig periodically writes the baselines and the score history of the series as Parquet
+// files, for offline analysis of the detector's own data
+type ExportConfig struct {
+	Location    string `yaml:"location"`     // local directory or gs:// URI prefix the files are written under
+	IntervalMin int    `yaml:"interval_min"` // minutes between exports, defaults to 60
+}
+
+// scoreRecord is the peak Z-score of a series in one detection cycle
+type scoreRecord struct {
+	cycleTime time.Time
+	score     SeriesScore
+}
+
+// exporter collects the series scores of every cycle and writes them, with a snapshot of the
+// baselines, once the export interval has passed. It runs within the detection cycle, so it
+// shares the detector's lock.
+type exporter struct {
+	config     ExportConfig
+	scores     []scoreRecord
+	exportedAt time.Time
+}
+
+func newExporter(config ExportConfig) *exporter {
+	if config.IntervalMin == 0 {
+		config.IntervalMin = 60
+	}
+	return &exporter{config: config, exportedAt: time.Now()}
+}
+
+// cycle records the scores of the detector's last cycle and exports if the interval has passed.
+// A failed export is logged and its scores dropped, so a lasting failure does not grow memory.
+func (e *exporter) cycle(ctx context.Context, d *SimpleAnomalyDetector, now time.Time) {
+	for _, score := range d.seriesScores {
+		e.scores = append(e.scores, scoreRecord{cycleTime: now, score: score})
+	}
+	if now.Sub(e.exportedAt) < time.Duration(e.config.IntervalMin)*time.Minute {
+		return
+	}
+
+	if err := e.export(ctx, d, now); err != nil {
+		log.Printf("Export failed: %v", err)
+	}
+	e.scores = nil
+	e.exportedAt = now
+}
+
+// export writes baselines/<time>.parquet and scores/<time>.parquet under the location
+func (e *exporter) export(ctx context.Context, d *SimpleAnomalyDetector, now time.Time) error {
+	name := now.UTC().Format("20060102T150405Z") + ".parquet"
+	baselines := e.baselines(d, now)
+	if err := e.write(ctx, "baselines/"+name, baselines); err != nil {
+		return err
+	}
+	scores := e.scoreHistory()
+	if err := e.write(ctx, "scores/"+name, scores); err != nil {
+		return err
+	}
+	log.Printf("Exported the baselines and %d series scores to %s\n", len(e.scores), e.config.Location)
+	return nil
+}
+
+// write encodes the columns as a Parquet file at the path under the location, unless they hold
+// no rows
+func (e *exporter) write(ctx context.Context, path string, columns []parquetColumn) error {
+	if len(columns) == 0 || columns[0].count == 0 {
+		return nil
+	}
+	location := strings.TrimSuffix(e.config.Location, "/") + "/" + path
+	if _, _, gcs := parseGCSURI(location); !gcs {
+		if err := os.MkdirAll(filepath.Dir(location), 0o755); err != nil {
+			return fmt.Errorf("could not create directory for %s: %v", location, err)
+		}
+	}
+	return writeObject(ctx, location, encodeParquet(columns, columns[0].count))
+}
+
+// baselines returns a row per metric, with an empty fingerprint, and a row per series. The
+// metric type of the series is empty for baselines restored from a snapshot.
+func (e *exporter) baselines(d *SimpleAnomalyDetector, now time.Time) []parquetColumn {
+	var metricTypes, fingerprints []string
+	var means, stddevs []float64
+	var counts []int64
+	add := func(metricType, fingerprint string, stats MetricStats) {
+		metricTypes = append(metricTypes, metricType)
+		fingerprints = append(fingerprints, fingerprint)
+		means = append(means, stats.mean)
+		stddevs = append(stddevs, stats.stddev)
+		counts = append(counts, stats.count)
+	}
+
+	for _, metricType := range sortedMetricTypes(d.metricsStats) {
+		add(metricType, "", d.metricsStats[metricType])
+	}
+	series := make([]string, 0, len(d.seriesStats))
+	for fingerprint := range d.seriesStats {
+		series = append(series, fingerprint)
+	}
+	sort.Strings(series)
+	for _, fingerprint := range series {
+		add(d.seriesTypes[fingerprint], fingerprint, d.seriesStats[fingerprint])
+	}
+
+	exportedAt := make([]time.Time, len(metricTypes))
+	for i := range exportedAt {
+		exportedAt[i] = now
+	}
+	return []parquetColumn{
+		timestampColumn("exported_at", exportedAt),
+		stringColumn("metric_type", metricTypes),
+		stringColumn("fingerprint", fingerprints),
+		doubleColumn("mean", means),
+		doubleColumn("stddev", stddevs),
+		int64Column("count", counts),
+	}
+}
+
+// scoreHistory returns a row per series and cycle, with the series labels as a JSON object
+func (e *exporter) scoreHistory() []parquetColumn {
+	n := len(e.scores)
+	cycleTimes, pointTimes := make([]time.Time, n), make([]time.Time, n)
+	metricTypes, fingerprints, labels := make([]string, n), make([]string, n), make([]string, n)
+	zScores := make([]float64, n)
+	for i, record := range e.scores {
+		cycleTimes[i] = record.cycleTime
+		metricTypes[i] = record.score.MetricName
+		fingerprints[i] = record.score.Fingerprint
+		encoded, _ := json.Marshal(record.score.Labels)
+		labels[i] = string(encoded)
+		zScores[i] = record.score.ZScore
+		pointTimes[i] = record.score.Timestamp
+	}
+	return []parquetColumn{
+		timestampColumn("cycle_time", cycleTimes),
+		stringColumn("metric_type", metricTypes),
+		stringColumn("fingerprint", fingerprints),
+		stringColumn("labels", labels),
+		doubleColumn("z_score", zScores),
+		timestampColumn("point_time", pointTimes),
+	}
+}
+
+func sortedMetricTypes(stats map[string]MetricStats) []string {
+	metricTypes := make([]string, 0, len(stats))
+	for metricType := range stats {
+		metricTypes = append(metricTypes, metricType)
+	}
+	sort.Strings(metricTypes)
+	return metricTypes
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// expression is a parsed arithmetic expression over named inputs. The grammar supports
+// numbers, input names (which may contain dots), + - * /, unary minus, parentheses and the
+// functions min, max and abs:
+//
+//	expr   = term { ("+" | "-") term }
+//	term   = unary { ("*" | "/") unary }
+//	unary  = "-" unary | factor
+//	factor = number | name | name "(" expr { "," expr } ")" | "(" expr ")"
+type expression interface {
+	eval(vars map[string]float64) float64
+}
+
+type numberExpr float64
+
+type variableExpr string
+
+type unaryExpr struct {
+	operand expression
+}
+
+type binaryExpr struct {
+	op          byte
+	left, right expression
+}
+
+type callExpr struct {
+	function string
+	args     []expression
+}
+
+func (e numberExpr) eval(map[string]float64) float64 { return float64(e) }
+
+func (e variableExpr) eval(vars map[string]float64) float64 { return vars[string(e)] }
+
+func (e unaryExpr) eval(vars map[string]float64) float64 { return -e.operand.eval(vars) }
+
+func (e binaryExpr) eval(vars map[string]float64) float64 {
+	left, right := e.left.eval(vars), e.right.eval(vars)
+	switch e.op {
+	case '+':
+		return left + right
+	case '-':
+		return left - right
+	case '*':
+		return left * right
+	default:
+		return left / right
+	}
+}
+
+func (e callExpr) eval(vars map[string]float64) float64 {
+	result := e.args[0].eval(vars)
+	for _, arg := range e.args[1:] {
+		value := arg.eval(vars)
+		switch e.function {
+		case "min":
+			result = math.Min(result, value)
+		case "max":
+			result = math.Max(result, value)
+		}
+	}
+	if e.function == "abs" {
+		result = math.Abs(result)
+	}
+	return result
+}
+
+// parseExpression parses the expression, returning it with the input names it refers to
+func parseExpression(source string) (expression, []string, error) {
+	p := &expressionParser{source: source, names: make(map[string]bool)}
+	p.next()
+	expr, err := p.parseSum()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.token != "" {
+		return nil, nil, fmt.Errorf("unexpected %q at offset %d", p.token, p.offset)
+	}
+
+	names := make([]string, 0, len(p.names))
+	for name := range p.names {
+		names = append(names, name)
+	}
+	return expr, names, nil
+}
+
+type expressionParser struct {
+	source string
+	pos    int
+	offset int    // offset of the current token
+	token  string // current token, empty at the end of the source
+	names  map[string]bool
+}
+
+// next advances to the next token: a number, a name, or a single character operator
+func (p *expressionParser) next() {
+	for p.pos < len(p.source) && p.source[p.pos] == ' ' {
+		p.pos++
+	}
+	p.offset = p.pos
+	if p.pos >= len(p.source) {
+		p.token = ""
+		return
+	}
+
+	start := p.pos
+	c := rune(p.source[p.pos])
+	switch {
+	case unicode.IsDigit(c) || c == '.':
+		for p.pos < len(p.source) && (unicode.IsDigit(rune(p.source[p.pos])) || p.source[p.pos] == '.') {
+			p.pos++
+		}
+	case unicode.IsLetter(c) || c == '_':
+		for p.pos < len(p.source) && isNameChar(rune(p.source[p.pos])) {
+			p.pos++
+		}
+	default:
+		p.pos++
+	}
+	p.token = p.source[start:p.pos]
+}
+
+func isNameChar(c rune) bool {
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || c == '_' || c == '.'
+}
+
+func (p *expressionParser) parseSum() (expression, error) {
+	left, err := p.parseProduct()
+	if err != nil {
+		return nil, err
+	}
+	for p.token == "+" || p.token == "-" {
+		op := p.token[0]
+		p.next()
+		right, err := p.parseProduct()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) parseProduct() (expression, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.token == "*" || p.token == "/" {
+		op := p.token[0]
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryExpr{op: op, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *expressionParser) parseUnary() (expression, error) {
+	if p.token == "-" {
+		p.next()
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return unaryExpr{operand: operand}, nil
+	}
+	return p.parseFactor()
+}
+
+func (p *expressionParser) parseFactor() (expression, error) {
+	token, offset := p.token, p.offset
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end of expression")
+	case token == "(":
+		p.next()
+		expr, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		if p.token != ")" {
+			return nil, fmt.Errorf("missing ) at offset %d", p.offset)
+		}
+		p.next()
+		return expr, nil
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		value, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q at offset %d", token, offset)
+		}
+		p.next()
+		return numberExpr(value), nil
+	case unicode.IsLetter(rune(token[0])) || token[0] == '_':
+		p.next()
+		if p.token != "(" {
+			p.names[token] = true
+			return variableExpr(token), nil
+		}
+		return p.parseCall(token, offset)
+	default:
+		return nil, fmt.Errorf("unexpected %q at offset %d", token, offset)
+	}
+}
+
+func (p *expressionParser) parseCall(function string, offset int) (expression, error) {
+	switch strings.ToLower(function) {
+	case "min", "max", "abs":
+	default:
+		return nil, fmt.Errorf("unknown function %s at offset %d", function, offset)
+	}
+
+	p.next() // (
+	var args []expression
+	for {
+		arg, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.token != "," {
+			break
+		}
+		p.next()
+	}
+	if p.token != ")" {
+		return nil, fmt.Errorf("missing ) at offset %d", p.offset)
+	}
+	p.next()
+
+	function = strings.ToLower(function)
+	if function == "abs" && len(args) != 1 {
+		return nil, fmt.Errorf("abs takes one argument")
+	}
+	return callExpr{function: function, args: args}, nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// FastStartConfig starts detection from a baseline over the most recent hours of history, then
+// extends the baseline to the full baseline_duration in the background, so a fresh start does not
+// wait for the whole historical window to be fetched before it protects anything
+type FastStartConfig struct {
+	InitialHours int `yaml:"initial_hours"` // hours of history detection starts from, defaults to 24
+}
+
+func (c FastStartConfig) validate() error {
+	if c.InitialHours < 0 {
+		return fmt.Errorf("initial_hours must not be negative")
+	}
+	return nil
+}
+
+// fastStartStages returns the trailing windows the baseline is computed over in turn: the initial
+// hours, doubled at every stage until the last stage covers the full baseline_duration
+func (c *Config) fastStartStages() []time.Duration {
+	initial := time.Duration(c.FastStart.InitialHours) * time.Hour
+	if initial == 0 {
+		initial = 24 * time.Hour
+	}
+	full := time.Duration(c.BaselineDuration) * 24 * time.Hour
+	var stages []time.Duration
+	for window := initial; window < full; window *= 2 {
+		stages = append(stages, window)
+	}
+	return append(stages, full)
+}
+
+// fastStartBaseline returns a detector initialised from the first stage of fast_start, and
+// refines its baseline over the following stages in the background. A stage that cannot be
+// fetched is logged and the detector keeps the baseline of the previous stage.
+func fastStartBaseline(client *monitoring.MetricClient, config *Config) (*SimpleAnomalyDetector, error) {
+	stages := config.fastStartStages()
+	log.Printf("Fetching the most recent %s of historical metrics...\n", stages[0])
+	detector := newDetector(config)
+	detector.baselineWindow = stages[0]
+	err := detector.streamBaseline(func(add func(*monitoringpb.TimeSeries)) error {
+		return streamTrailingMetrics(client, config, stages[0], add)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(stages) > 1 {
+		go detector.refineBaseline(client, config, stages[1:])
+	}
+	return detector, nil
+}
+
+// refineBaseline replaces the baseline with one over each of the windows in turn. Detection
+// cycles carry on against the previous baseline while a window is fetched.
+func (d *SimpleAnomalyDetector) refineBaseline(client *monitoring.MetricClient, config *Config, windows []time.Duration) {
+	for _, window := range windows {
+		log.Printf("Extending the baseline to the most recent %s of historical metrics...\n", window)
+		accumulator, err := d.accumulateBaseline(func(add func(*monitoringpb.TimeSeries)) error {
+			return streamTrailingMetrics(client, config, window, add)
+		})
+		if err != nil {
+			log.Printf("Failed to extend the baseline to %s, keeping the previous one: %v", window, err)
+			return
+		}
+		d.mu.Lock()
+		d.baselineWindow = window
+		d.installBaseline(accumulator)
+		d.mu.Unlock()
+		log.Printf("Baseline extended to %s.\n", window)
+	}
+}
+
+// streamTrailingMetrics hands each historical series of the window ending now to fn
+func streamTrailingMetrics(client *monitoring.MetricClient, config *Config, window time.Duration, fn func(*monitoringpb.TimeSeries)) error {
+	end := config.now()
+	return streamBaselineMetrics(client, config, config.fetchedBaselineMetrics(), end.Add(-window), end, fn)
+}
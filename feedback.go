@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// LabelFalsePositive marks an anomaly that did not reflect a real problem
+	LabelFalsePositive = "false_positive"
+	// LabelTruePositive confirms an anomaly
+	LabelTruePositive = "true_positive"
+
+	// recentAnomalyLimit is the number of reported anomalies kept so they can be labelled by ID
+	recentAnomalyLimit = 1000
+)
+
+// Feedback labels a detected anomaly, keeping the anomaly record alongside the label
+type Feedback struct {
+	AnomalyID string    `json:"anomaly_id"`
+	Label     string    `json:"label"`
+	Comment   string    `json:"comment,omitempty"`
+	CreatedBy string    `json:"created_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Anomaly   Anomaly   `json:"anomaly"`
+}
+
+// FeedbackCounts summarises the labels given to the anomalies of a metric
+type FeedbackCounts struct {
+	FalsePositives int `json:"false_positives"`
+	TruePositives  int `json:"true_positives"`
+}
+
+// FeedbackStore keeps the labels given to anomalies, optionally persisting them
+type FeedbackStore struct {
+	path string
+
+	mu       sync.Mutex
+	feedback map[string]Feedback // by anomaly ID
+}
+
+// NewFeedbackStore loads the feedback persisted at path. An empty path keeps it in memory only.
+func NewFeedbackStore(ctx context.Context, path string) (*FeedbackStore, error) {
+	store := &FeedbackStore{path: path, feedback: make(map[string]Feedback)}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := readObject(ctx, path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entries []Feedback
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("could not parse feedback %s: %v", path, err)
+	}
+	for _, entry := range entries {
+		store.feedback[entry.AnomalyID] = entry
+	}
+	return store, nil
+}
+
+// Label stores the feedback for an anomaly, replacing any earlier label of the same anomaly
+func (s *FeedbackStore) Label(ctx context.Context, feedback Feedback) (Feedback, error) {
+	switch feedback.Label {
+	case LabelFalsePositive, LabelTruePositive:
+	default:
+		return Feedback{}, fmt.Errorf("unknown label %q, expected %s or %s", feedback.Label, LabelFalsePositive, LabelTruePositive)
+	}
+	if feedback.Anomaly.ID == "" {
+		return Feedback{}, errors.New("feedback needs the labelled anomaly")
+	}
+	feedback.AnomalyID = feedback.Anomaly.ID
+	if feedback.CreatedAt.IsZero() {
+		feedback.CreatedAt = time.Now().UTC()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	previous, existed := s.feedback[feedback.AnomalyID]
+	s.feedback[feedback.AnomalyID] = feedback
+	if err := s.persist(ctx); err != nil {
+		if existed {
+			s.feedback[feedback.AnomalyID] = previous
+		} else {
+			delete(s.feedback, feedback.AnomalyID)
+		}
+		return Feedback{}, err
+	}
+	log.Printf("Labelled anomaly %s on %s as %s\n", feedback.AnomalyID, feedback.Anomaly.MetricName, feedback.Label)
+	return feedback, nil
+}
+
+// Get returns the feedback given for an anomaly
+func (s *FeedbackStore) Get(anomalyID string) (Feedback, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	feedback, ok := s.feedback[anomalyID]
+	return feedback, ok
+}
+
+// List returns all feedback, most recent anomaly first
+func (s *FeedbackStore) List() []Feedback {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]Feedback, 0, len(s.feedback))
+	for _, feedback := range s.feedback {
+		entries = append(entries, feedback)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Anomaly.Timestamp.After(entries[j].Anomaly.Timestamp) })
+	return entries
+}
+
+// Counts returns the labels given per metric
+func (s *FeedbackStore) Counts() map[string]FeedbackCounts {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	counts := make(map[string]FeedbackCounts)
+	for _, feedback := range s.feedback {
+		c := counts[feedback.Anomaly.MetricName]
+		if feedback.Label == LabelFalsePositive {
+			c.FalsePositives++
+		} else {
+			c.TruePositives++
+		}
+		counts[feedback.Anomaly.MetricName] = c
+	}
+	return counts
+}
+
+// persist writes the feedback to the configured path. The caller holds mu.
+func (s *FeedbackStore) persist(ctx context.Context) error {
+	if s.path == "" {
+		return nil
+	}
+
+	entries := make([]Feedback, 0, len(s.feedback))
+	for _, feedback := range s.feedback {
+		entries = append(entries, feedback)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].AnomalyID < entries[j].AnomalyID })
+
+	data, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeObject(ctx, s.path, data); err != nil {
+		return fmt.Errorf("could not persist feedback: %v", err)
+	}
+	return nil
+}
+
+// recentAnomalies remembers the most recently reported anomalies by ID, so feedback can refer
+// to an anomaly by its ID alone
+type recentAnomalies struct {
+	mu    sync.Mutex
+	byID  map[string]Anomaly
+	order []string
+	// store keeps the anomalies across restarts, nil when they are only kept in memory
+	store Store
+}
+
+// newRecentAnomalies restores the recent anomalies kept in a durable store
+func newRecentAnomalies(ctx context.Context, store Store) *recentAnomalies {
+	r := &recentAnomalies{byID: make(map[string]Anomaly)}
+	if store == nil || !store.Durable() {
+		return r
+	}
+	r.store = store
+	var anomalies []Anomaly
+	if err := loadState(ctx, store, storeRecentKey, &anomalies); err != nil {
+		log.Printf("Could not restore the recent anomalies: %v", err)
+	}
+	r.remember(anomalies)
+	return r
+}
+
+// add remembers the anomalies, and saves them with those remembered before in a durable store
+func (r *recentAnomalies) add(ctx context.Context, anomalies []Anomaly) {
+	r.mu.Lock()
+	r.remember(anomalies)
+	var all []Anomaly
+	if r.store != nil {
+		all = make([]Anomaly, 0, len(r.order))
+		for _, id := range r.order {
+			all = append(all, r.byID[id])
+		}
+	}
+	r.mu.Unlock()
+
+	if r.store != nil {
+		if err := saveState(ctx, r.store, storeRecentKey, all); err != nil {
+			log.Printf("Could not save the recent anomalies: %v", err)
+		}
+	}
+}
+
+// remember adds the anomalies, forgetting the oldest over the limit; r.mu must be held
+func (r *recentAnomalies) remember(anomalies []Anomaly) {
+	for _, anomaly := range anomalies {
+		if _, exists := r.byID[anomaly.ID]; !exists {
+			r.order = append(r.order, anomaly.ID)
+		}
+		r.byID[anomaly.ID] = anomaly
+	}
+	for len(r.order) > recentAnomalyLimit {
+		delete(r.byID, r.order[0])
+		r.order = r.order[1:]
+	}
+}
+
+func (r *recentAnomalies) get(id string) (Anomaly, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	anomaly, ok := r.byID[id]
+	return anomaly, ok
+}
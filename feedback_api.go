@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// feedbackRequest is the JSON body accepted by POST /feedback. The anomaly is looked up among
+// the recently reported anomalies by its ID; older anomalies, for example from a file
+// notifier's log, can be labelled by passing the full record instead.
+type feedbackRequest struct {
+	AnomalyID string   `json:"anomaly_id"`
+	Anomaly   *Anomaly `json:"anomaly"`
+	Label     string   `json:"label"` // defaults to false_positive
+	Comment   string   `json:"comment"`
+	CreatedBy string   `json:"created_by"`
+}
+
+// feedbackResponse is returned by GET /feedback
+type feedbackResponse struct {
+	Counts   map[string]FeedbackCounts `json:"counts"`
+	Feedback []Feedback                `json:"feedback"`
+}
+
+// registerFeedbackHandlers adds the feedback API to the mux:
+//
+//	GET  /feedback  lists the labelled anomalies with per-metric counts
+//	POST /feedback  labels an anomaly as a false or true positive
+func registerFeedbackHandlers(mux *http.ServeMux, router *Router) {
+	mux.HandleFunc("/feedback", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			store := router.Feedback()
+			writeJSON(w, http.StatusOK, feedbackResponse{Counts: store.Counts(), Feedback: store.List()})
+		case http.MethodPost:
+			createFeedback(w, r, router)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func createFeedback(w http.ResponseWriter, r *http.Request, router *Router) {
+	var req feedbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var anomaly Anomaly
+	switch {
+	case req.Anomaly != nil:
+		anomaly = *req.Anomaly
+	case req.AnomalyID != "":
+		var ok bool
+		if anomaly, ok = router.recentAnomaly(req.AnomalyID); !ok {
+			http.Error(w, fmt.Sprintf("anomaly %s is not among the recent anomalies, pass the full record instead", req.AnomalyID), http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "an anomaly_id or anomaly is required", http.StatusBadRequest)
+		return
+	}
+
+	label := req.Label
+	if label == "" {
+		label = LabelFalsePositive
+	}
+	feedback, err := router.Feedback().Label(r.Context(), Feedback{
+		Label:     label,
+		Comment:   req.Comment,
+		CreatedBy: req.CreatedBy,
+		Anomaly:   anomaly,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusCreated, feedback)
+}
+
+// runFeedbackCommand labels anomalies on a running detector through its HTTP API
+func runFeedbackCommand(args []string) {
+	fs := flag.NewFlagSet("feedback", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "URL of the detector started with serve")
+	token := fs.String("token", os.Getenv("ANOMALY_DETECTOR_TOKEN"), "Bearer token of a server with auth configured, defaults to $ANOMALY_DETECTOR_TOKEN")
+	anomalyID := fs.String("anomaly", "", "ID of the anomaly to label")
+	label := fs.String("label", LabelFalsePositive, "Label to give the anomaly: false_positive or true_positive")
+	comment := fs.String("comment", "", "Why the anomaly was labelled")
+	list := fs.Bool("list", false, "List the labelled anomalies instead of labelling one")
+	fs.Parse(args)
+
+	baseURL := strings.TrimSuffix(*server, "/")
+	var req *http.Request
+	var err error
+	if *list {
+		req, err = http.NewRequest(http.MethodGet, baseURL+"/feedback", nil)
+	} else {
+		if *anomalyID == "" {
+			log.Fatalf("The -anomaly flag is required")
+		}
+		body, _ := json.Marshal(feedbackRequest{
+			AnomalyID: *anomalyID,
+			Label:     *label,
+			Comment:   *comment,
+			CreatedBy: os.Getenv("USER"),
+		})
+		req, err = http.NewRequest(http.MethodPost, baseURL+"/feedback", bytes.NewReader(body))
+	}
+	if err != nil {
+		log.Fatalf("Invalid request: %v", err)
+	}
+
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		log.Fatalf("Request failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Print(string(body))
+}
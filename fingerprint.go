@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// seriesFingerprint derives a stable identifier for a time series from its metric type,
+// metric labels, resource type and resource labels, independent of label ordering
+func seriesFingerprint(ts *monitoringpb.TimeSeries) string {
+	parts := []string{"metric=" + ts.GetMetric().GetType(), "resource=" + ts.GetResource().GetType()}
+	for key, value := range ts.GetMetric().GetLabels() {
+		parts = append(parts, "metric.labels."+key+"="+value)
+	}
+	for key, value := range ts.GetResource().GetLabels() {
+		parts = append(parts, "resource.labels."+key+"="+value)
+	}
+	sort.Strings(parts[2:])
+
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(sum[:8])
+}
+
+// anomalyFingerprint identifies the alert a detector raises on a series, so the alerts of
+// different detectors on one series are deduplicated, resolved and acknowledged apart. Z-score
+// anomalies keep the bare series fingerprint, which silences and alerts created before detectors
+// were told apart refer to.
+func anomalyFingerprint(kind, series string) string {
+	if kind == KindAnomaly {
+		return series
+	}
+	return kind + "-" + series
+}
+
+// anomalyID identifies an event by the fingerprint of its alert and the time it started at
+func anomalyID(fingerprint string, timestamp time.Time) string {
+	return fingerprint + "-" + strconv.FormatInt(timestamp.Unix(), 10)
+}
+
+// seriesLabels flattens the resource and metric labels of a series into one map, metric labels
+// taking precedence, and adds the resource type as resource_type
+func seriesLabels(ts *monitoringpb.TimeSeries) map[string]string {
+	labels := map[string]string{"resource_type": ts.GetResource().GetType()}
+	for key, value := range ts.GetResource().GetLabels() {
+		labels[key] = value
+	}
+	for key, value := range ts.GetMetric().GetLabels() {
+		labels[key] = value
+	}
+	return labels
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// flagProviderOFREP evaluates flags with the OpenFeature Remote Evaluation Protocol, served by
+	// flagd and most flag vendors
+	flagProviderOFREP = "ofrep"
+	// flagProviderFile reads flags from a YAML file of flag keys to booleans
+	flagProviderFile = "file"
+)
+
+// FeatureFlagsConfig gates metrics, detectors and notifiers behind feature flags, so they can be
+// turned off at runtime, for instance to mute an alert during an incident, without a redeploy
+type FeatureFlagsConfig struct {
+	Provider   string            `yaml:"provider"`              // ofrep or file
+	URL        string            `yaml:"url"`                   // ofrep: base URL of the flag service, e.g. http://flagd:8016
+	Headers    map[string]string `yaml:"headers" secret:"true"` // ofrep: sent with every request, e.g. an authorization header
+	Path       string            `yaml:"path"`                  // file: local file or gs:// URI of the flags, e.g. {mute-checkout: false}
+	RefreshSec int               `yaml:"refresh_sec"`           // seconds a flag value is cached, defaults to 30
+	Detectors  map[string]string `yaml:"detectors"`             // flag of each kind of detection, e.g. {flatline: detect-flatlines}
+}
+
+func (c FeatureFlagsConfig) validate() error {
+	switch c.Provider {
+	case flagProviderOFREP:
+		if c.URL == "" {
+			return fmt.Errorf("no url configured")
+		}
+	case flagProviderFile:
+		if c.Path == "" {
+			return fmt.Errorf("no path configured")
+		}
+	default:
+		return fmt.Errorf("unknown provider %q, expected ofrep or file", c.Provider)
+	}
+	if c.RefreshSec < 0 {
+		return fmt.Errorf("refresh_sec must not be negative")
+	}
+	for kind := range c.Detectors {
+		switch kind {
+		case KindAnomaly, KindForecast, KindFlatline, KindDelta, KindCanary, KindPeer, KindReplica, KindHealth:
+		default:
+			return fmt.Errorf("detectors: unknown kind %q", kind)
+		}
+	}
+	return nil
+}
+
+// flagValue is the cached value of a flag
+type flagValue struct {
+	enabled bool
+	at      time.Time
+}
+
+// featureFlags evaluates the flags of the configuration and caches their values for refresh_sec.
+// A flag that cannot be evaluated keeps its last value, or is on if it never had one, so an
+// unreachable flag service does not silence the detector.
+type featureFlags struct {
+	config    FeatureFlagsConfig
+	targeting map[string]string // evaluation context, identifying the project and tenant
+	client    *http.Client
+	refresh   time.Duration
+
+	mu     sync.Mutex
+	values map[string]flagValue
+	file   map[string]bool // flags of the file provider, read at fileAt
+	fileAt time.Time
+}
+
+func newFeatureFlags(config FeatureFlagsConfig, projectID, tenant string) *featureFlags {
+	registerSecrets(config)
+	refresh := time.Duration(config.RefreshSec) * time.Second
+	if config.RefreshSec == 0 {
+		refresh = 30 * time.Second
+	}
+	targeting := map[string]string{"targetingKey": projectID, "project_id": projectID}
+	if tenant != "" {
+		targeting["tenant"] = tenant
+	}
+	return &featureFlags{
+		config:    config,
+		targeting: targeting,
+		client:    &http.Client{Timeout: 5 * time.Second},
+		refresh:   refresh,
+		values:    make(map[string]flagValue),
+	}
+}
+
+// enabled reports whether the flag is on. An empty key, or no feature flags, is always on.
+func (f *featureFlags) enabled(ctx context.Context, key string, now time.Time) bool {
+	if f == nil || key == "" {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cached, ok := f.values[key]
+	if ok && now.Sub(cached.at) < f.refresh {
+		return cached.enabled
+	}
+	var enabled bool
+	var err error
+	if f.config.Provider == flagProviderFile {
+		enabled, err = f.fileFlag(ctx, key, now)
+	} else {
+		enabled, err = f.remoteFlag(ctx, key)
+	}
+	if err != nil {
+		log.Printf("Could not evaluate feature flag %s: %v", key, err)
+		if !ok {
+			cached.enabled = true
+		}
+		f.values[key] = flagValue{enabled: cached.enabled, at: now}
+		return cached.enabled
+	}
+	if ok && cached.enabled != enabled {
+		log.Printf("Feature flag %s turned %s\n", key, onOff(enabled))
+	}
+	f.values[key] = flagValue{enabled: enabled, at: now}
+	return enabled
+}
+
+// remoteFlag evaluates the flag with a single flag evaluation request of OFREP
+func (f *featureFlags) remoteFlag(ctx context.Context, key string) (bool, error) {
+	body, err := json.Marshal(map[string]interface{}{"context": f.targeting})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(f.config.URL, "/")+"/ofrep/v1/evaluate/flags/"+url.PathEscape(key), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range f.config.Headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Value        interface{} `json:"value"`
+		ErrorCode    string      `json:"errorCode"`
+		ErrorDetails string      `json:"errorDetails"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("%s: %v", resp.Status, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, fmt.Errorf("%s: %s %s", resp.Status, result.ErrorCode, result.ErrorDetails)
+	}
+	enabled, ok := result.Value.(bool)
+	if !ok {
+		return false, fmt.Errorf("value %v is not a boolean", result.Value)
+	}
+	return enabled, nil
+}
+
+// fileFlag looks the flag up in the flags file, read again once it is older than refresh_sec.
+// A flag missing from the file is on.
+func (f *featureFlags) fileFlag(ctx context.Context, key string, now time.Time) (bool, error) {
+	if f.file == nil || now.Sub(f.fileAt) >= f.refresh {
+		data, err := readObject(ctx, f.config.Path)
+		if err != nil {
+			return false, err
+		}
+		var flags map[string]bool
+		if err := yaml.Unmarshal(data, &flags); err != nil {
+			return false, fmt.Errorf("could not parse %s: %v", f.config.Path, err)
+		}
+		if flags == nil {
+			flags = make(map[string]bool)
+		}
+		f.file, f.fileAt = flags, now
+	}
+	enabled, ok := f.file[key]
+	return enabled || !ok, nil
+}
+
+// onOff words a flag value
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
+
+// flaggedMetrics returns the metrics whose flag is on, logging those turned off
+func (c *Config) flaggedMetrics(metrics []string) []string {
+	if c.flags == nil {
+		return metrics
+	}
+	var enabled, disabled []string
+	for _, metric := range metrics {
+		config, _ := c.MetricConfig(metric)
+		if !c.flags.enabled(context.Background(), config.Flag, c.now()) {
+			disabled = append(disabled, metric)
+			continue
+		}
+		enabled = append(enabled, metric)
+	}
+	if len(disabled) > 0 {
+		log.Printf("Skipping metrics turned off by their feature flags: %s\n", strings.Join(disabled, ", "))
+	}
+	return enabled
+}
+
+// flaggedDetections drops the anomalies of the kinds of detection whose flag is off
+func (c *Config) flaggedDetections(anomalies []Anomaly) []Anomaly {
+	if c.flags == nil || len(c.FeatureFlags.Detectors) == 0 {
+		return anomalies
+	}
+	kept := anomalies[:0]
+	dropped := make(map[string]int)
+	for _, anomaly := range anomalies {
+		if !c.flags.enabled(context.Background(), c.FeatureFlags.Detectors[anomaly.Kind], c.now()) {
+			dropped[anomaly.Kind]++
+			continue
+		}
+		kept = append(kept, anomaly)
+	}
+	kinds := make([]string, 0, len(dropped))
+	for kind, count := range dropped {
+		kinds = append(kinds, fmt.Sprintf("%d %s", count, kind))
+	}
+	sort.Strings(kinds)
+	if len(kinds) > 0 {
+		log.Printf("Dropped anomalies of detectors turned off by their feature flags: %s\n", strings.Join(kinds, ", "))
+	}
+	return kept
+}
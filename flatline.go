@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// FlatlineConfig tunes the detection of series that stop varying, which usually means a broken
+// exporter reporting a stuck value rather than a real change
+type FlatlineConfig struct {
+	Disabled  bool    `yaml:"disabled"`
+	Ratio     float64 `yaml:"ratio"`      // the recent stddev must fall to this fraction of the baseline stddev, defaults to 0.001
+	MinPoints int     `yaml:"min_points"` // points the recent window needs before it is judged, defaults to 10
+}
+
+// DetectFlatlines returns a flatline anomaly for every series that varies in the baseline but
+// reports an effectively constant value across the recent window. A series is reported once
+// until it varies again.
+func (d *SimpleAnomalyDetector) DetectFlatlines(metrics []*monitoringpb.TimeSeries, config FlatlineConfig) []Anomaly {
+	if config.Disabled {
+		return nil
+	}
+	if config.Ratio == 0 {
+		config.Ratio = 0.001
+	}
+	if config.MinPoints == 0 {
+		config.MinPoints = 10
+	}
+	if d.flatlined == nil {
+		d.flatlined = make(map[string]bool)
+	}
+
+	var anomalies []Anomaly
+	for _, metric := range metrics {
+		fingerprint := seriesFingerprint(metric)
+		stats, ok := d.baselineFor(metric.Metric.Type, d.baselineKey(metric, fingerprint), newestPointTime(metric))
+		if !ok || stats.stddev == 0 || len(metric.Points) < config.MinPoints {
+			continue
+		}
+
+		var recent RunningStats
+		var latest *monitoringpb.Point
+		transform := d.transforms[metric.Metric.Type]
+		for _, point := range metric.Points {
+			// The baseline stddev is that of the transformed values
+			if value, ok := transform.apply(pointValue(point)); ok {
+				recent.Add(value)
+			}
+			if latest == nil || point.Interval.EndTime.AsTime().After(latest.Interval.EndTime.AsTime()) {
+				latest = point
+			}
+		}
+
+		if recent.StdDev() > config.Ratio*stats.stddev {
+			if d.flatlined[fingerprint] {
+				log.Printf("Series of %s (fingerprint %s) varies again\n", metric.Metric.Type, fingerprint)
+				delete(d.flatlined, fingerprint)
+			}
+			continue
+		}
+		if d.flatlined[fingerprint] {
+			continue
+		}
+		d.flatlined[fingerprint] = true
+
+		timestamp := latest.Interval.EndTime.AsTime()
+		anomalies = append(anomalies, Anomaly{
+			Kind:       KindFlatline,
+			ID:         anomalyID(anomalyFingerprint(KindFlatline, fingerprint), timestamp),
+			MetricName: metric.Metric.Type,
+			Value:      pointValue(latest),
+			Unit:       metric.Unit,
+			Timestamp:  timestamp,
+			Message: fmt.Sprintf("Value stuck at %s for %d points (recent StdDev %.4f vs baseline %.4f), the exporter may be broken",
+				formatValue(recent.Mean, metric.Unit), recent.Count, recent.StdDev(), stats.stddev),
+			Severity: SeverityWarning,
+
+			Fingerprint:       anomalyFingerprint(KindFlatline, fingerprint),
+			SeriesFingerprint: fingerprint,
+			Labels:            seriesLabels(metric),
+		})
+	}
+	return anomalies
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// forecastMinPoints is the number of points a series needs before a trend is fitted
+const forecastMinPoints = 5
+
+// ForecastConfig enables early warnings for a metric that is on track to cross a limit
+type ForecastConfig struct {
+	Limit      float64 `yaml:"limit"`
+	HorizonMin int     `yaml:"horizon_min"` // how far ahead to project, in minutes, defaults to 240
+	Below      bool    `yaml:"below"`       // warn when falling below the limit instead of rising above it
+}
+
+// trend is a least-squares line through the points of a series
+type trend struct {
+	slope  float64   // change per second
+	value  float64   // fitted value at the time of the last point
+	latest time.Time // time of the last point
+}
+
+// fitTrend fits a line through the points of a series by ordinary least squares
+func fitTrend(points []*monitoringpb.Point) (trend, bool) {
+	if len(points) < forecastMinPoints {
+		return trend{}, false
+	}
+
+	var latest time.Time
+	for _, point := range points {
+		if t := point.Interval.EndTime.AsTime(); t.After(latest) {
+			latest = t
+		}
+	}
+
+	// Times are taken relative to the last point, so the intercept is the value at that point
+	var n, sumX, sumY, sumXX, sumXY float64
+	for _, point := range points {
+		x := point.Interval.EndTime.AsTime().Sub(latest).Seconds()
+		y := pointValue(point)
+		n++
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return trend{}, false
+	}
+	slope := (n*sumXY - sumX*sumY) / denominator
+	value := (sumY - slope*sumX) / n
+	if math.IsNaN(slope) || math.IsInf(slope, 0) || math.IsNaN(value) {
+		return trend{}, false
+	}
+	return trend{slope: slope, value: value, latest: latest}, true
+}
+
+// breachIn returns how long until the trend crosses the limit, if it is heading towards it
+func (t trend) breachIn(config ForecastConfig) (time.Duration, bool) {
+	distance := config.Limit - t.value
+	if config.Below {
+		distance = -distance
+	}
+	rate := t.slope
+	if config.Below {
+		rate = -rate
+	}
+	if distance <= 0 || rate <= 0 {
+		return 0, false
+	}
+	return time.Duration(distance / rate * float64(time.Second)), true
+}
+
+// ForecastBreaches fits a trend to every series of a metric with a forecast configured and
+// returns a projected breach warning for each series on track to cross its limit within the
+// horizon. A series is warned about once until its projection clears.
+func (d *SimpleAnomalyDetector) ForecastBreaches(metrics []*monitoringpb.TimeSeries, config *Config) []Anomaly {
+	if d.projected == nil {
+		d.projected = make(map[string]bool)
+	}
+
+	var warnings []Anomaly
+	for _, metric := range metrics {
+		metricConfig, ok := config.MetricConfig(metric.Metric.Type)
+		if !ok || metricConfig.Forecast == nil {
+			continue
+		}
+		forecast := *metricConfig.Forecast
+		horizon := time.Duration(forecast.HorizonMin) * time.Minute
+		if horizon == 0 {
+			horizon = 4 * time.Hour
+		}
+
+		fingerprint := seriesFingerprint(metric)
+		fitted, ok := fitTrend(metric.Points)
+		if !ok {
+			continue
+		}
+		breachIn, heading := fitted.breachIn(forecast)
+		if !heading || breachIn > horizon {
+			if d.projected[fingerprint] {
+				log.Printf("Projected breach of %s (fingerprint %s) cleared\n", metric.Metric.Type, fingerprint)
+				delete(d.projected, fingerprint)
+			}
+			continue
+		}
+		if d.projected[fingerprint] {
+			continue
+		}
+		d.projected[fingerprint] = true
+
+		direction := "above"
+		if forecast.Below {
+			direction = "below"
+		}
+		breachAt := fitted.latest.Add(breachIn)
+		projected := fitted.value + fitted.slope*horizon.Seconds()
+		expected := newExpectedRange(math.Min(fitted.value, projected), math.Max(fitted.value, projected), fitted.value, forecast.Limit, metric.Unit)
+		warnings = append(warnings, Anomaly{
+			ID:         anomalyID(anomalyFingerprint(KindForecast, fingerprint), fitted.latest),
+			Kind:       KindForecast,
+			MetricName: metric.Metric.Type,
+			Value:      fitted.value,
+			Unit:       metric.Unit,
+			Timestamp:  fitted.latest,
+			Message: fmt.Sprintf("Projected to cross %s %s in %s (at %s), forecast %s to %s by %s%s",
+				direction, formatValue(forecast.Limit, metric.Unit), breachIn.Round(time.Minute), breachAt.UTC().Format(time.RFC3339),
+				formatValue(expected.Low, metric.Unit), formatValue(expected.High, metric.Unit), fitted.latest.Add(horizon).UTC().Format(time.RFC3339), limitDistance(expected)),
+			Severity: SeverityWarning,
+
+			Fingerprint:       anomalyFingerprint(KindForecast, fingerprint),
+			SeriesFingerprint: fingerprint,
+			Labels:            seriesLabels(metric),
+			Expected:          expected,
+		})
+	}
+	return warnings
+}
+
+// limitDistance describes how far the current value is from the limit, such as ", currently 12.0% below the limit"
+func limitDistance(expected *ExpectedRange) string {
+	if expected.DeviationPercent == nil {
+		return ""
+	}
+	deviation := *expected.DeviationPercent
+	if deviation < 0 {
+		return fmt.Sprintf(", currently %.1f%% below the limit", -deviation)
+	}
+	return fmt.Sprintf(", currently %.1f%% above the limit", deviation)
+}
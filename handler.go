@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+)
+
+// requestHandler runs one detection cycle per HTTP request without keeping state between
+// requests, so the detector can run on Cloud Run or Cloud Functions behind Cloud Scheduler
+type requestHandler struct {
+	client *monitoring.MetricClient
+	config *Config
+	router *Router
+}
+
+// runHandler serves request-triggered detection on $PORT
+func runHandler(args []string) {
+	fs := flag.NewFlagSet("handler", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	credentials := addCredentialFlags(fs)
+	fs.Parse(args)
+
+	config := mustLoadConfig(*configPath)
+	config.Credentials.override(*credentials)
+	mustDiscoverWorkloads(config)
+	if store, _ := config.baselineStore(); !store.Durable() {
+		log.Fatalf("Handler mode requires baseline_path or a store to be set")
+	}
+
+	handler := &requestHandler{
+		client: mustCreateClient(config.Credentials, config.MonitoringAPI),
+		config: config,
+		router: mustCreateRouter(config),
+	}
+	mustValidateFilters(handler.client, config)
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+
+	log.Printf("Listening on port %s...\n", port)
+	if err := config.Server.listenAndServe(":"+port, handler); err != nil {
+		log.Fatalf("HTTP server failed: %v", err)
+	}
+}
+
+// ServeHTTP loads the persisted baseline, runs a detection cycle and returns the anomalies found
+func (h *requestHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	detector, err := restoreBaseline(r.Context(), h.client, h.config)
+	if err != nil {
+		log.Printf("Failed to load baseline: %v", err)
+		http.Error(w, redact(err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	detector.events = h.router.Events()
+	anomalies, err := runCycle(h.client, h.config, detector, h.config.MetricTypes())
+	if err != nil {
+		log.Printf("Detection cycle failed: %v", err)
+		h.router.ReportError(r.Context(), err)
+		http.Error(w, redact(err.Error()), http.StatusBadGateway)
+		return
+	}
+	h.router.ReportCycle(r.Context(), anomalies, detector.FetchFailures())
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newScanResponse(h.config.MetricTypes(), anomalies, h.config, detector))
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// monitoringWriteScope is the OAuth scope of writing time series to Cloud Monitoring
+const monitoringWriteScope = "https://www.googleapis.com/auth/monitoring.write"
+
+// HealthConfig scores the health of services from the anomaly scores of several of their
+// metrics, giving a single signal per service, written to a custom metric every cycle and
+// reported when it crosses its thresholds
+type HealthConfig struct {
+	Services   []ServiceHealthConfig `yaml:"services"`
+	ProjectID  string                `yaml:"project_id"`  // project the scores are written to, defaults to project_id
+	MetricType string                `yaml:"metric_type"` // defaults to custom.googleapis.com/gcp_anomaly_detector/health_score
+}
+
+// ServiceHealthConfig is the health score of one service: the weighted mean of the scores of its
+// components, each the largest absolute peak Z-score of its series in the cycle
+type ServiceHealthConfig struct {
+	Service    string                  `yaml:"service"`    // name of the service, the service label of its score
+	Matchers   []string                `yaml:"matchers"`   // label matchers the series of every component must match, e.g. service_name="checkout"
+	Components []HealthComponentConfig `yaml:"components"` // metrics the score is composed of
+	Warning    float64                 `yaml:"warning"`    // score from which a warning is reported, defaults to z_score_threshold
+	Critical   float64                 `yaml:"critical"`   // score from which it is critical, defaults to critical_z_score
+}
+
+// HealthComponentConfig is a metric of a service health score
+type HealthComponentConfig struct {
+	Metric   string   `yaml:"metric"`   // metric type or glob pattern
+	Matchers []string `yaml:"matchers"` // label matchers the series must also match
+	Weight   float64  `yaml:"weight"`   // weight of the component in the score, defaults to 1
+}
+
+func (c HealthConfig) validate() error {
+	_, err := compileHealthScores(c.Services)
+	return err
+}
+
+// serviceHealth is a ServiceHealthConfig with its matchers parsed
+type serviceHealth struct {
+	ServiceHealthConfig
+	components []healthComponent
+}
+
+type healthComponent struct {
+	match  suppressionRule
+	weight float64
+}
+
+// compileHealthScores parses the services of the health configuration
+func compileHealthScores(services []ServiceHealthConfig) ([]serviceHealth, error) {
+	var compiled []serviceHealth
+	names := make(map[string]bool)
+	for i, service := range services {
+		if service.Service == "" {
+			return nil, fmt.Errorf("service %d: no service name configured", i+1)
+		}
+		if names[service.Service] {
+			return nil, fmt.Errorf("%s: duplicate service", service.Service)
+		}
+		names[service.Service] = true
+		if len(service.Components) == 0 {
+			return nil, fmt.Errorf("%s: no components configured", service.Service)
+		}
+		if service.Warning < 0 || service.Critical < 0 {
+			return nil, fmt.Errorf("%s: thresholds must not be negative", service.Service)
+		}
+		if service.Warning > 0 && service.Critical > 0 && service.Critical < service.Warning {
+			return nil, fmt.Errorf("%s: critical must not be below warning", service.Service)
+		}
+		c := serviceHealth{ServiceHealthConfig: service}
+		for j, component := range service.Components {
+			if component.Metric == "" {
+				return nil, fmt.Errorf("%s: component %d: no metric configured", service.Service, j+1)
+			}
+			if component.Weight < 0 {
+				return nil, fmt.Errorf("%s: component %d: weight must not be negative", service.Service, j+1)
+			}
+			if component.Weight == 0 {
+				component.Weight = 1
+			}
+			match, err := compileAnomalyMatch(component.Metric, append(append([]string(nil), service.Matchers...), component.Matchers...))
+			if err != nil {
+				return nil, fmt.Errorf("%s: component %d: %v", service.Service, j+1, err)
+			}
+			c.components = append(c.components, healthComponent{match: match, weight: component.Weight})
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// healthScorer scores the services after every cycle and writes their scores to Cloud Monitoring
+type healthScorer struct {
+	config      HealthConfig
+	services    []serviceHealth
+	credentials CredentialsConfig
+	// warning and critical are the default thresholds of the services
+	warning, critical float64
+	// breachedSince holds the start of the breach of each service over its warning threshold
+	breachedSince map[string]time.Time
+
+	mu        sync.Mutex
+	http      *http.Client // created on first use
+	described bool
+}
+
+func newHealthScorer(config *Config) *healthScorer {
+	health := *config.Health
+	if health.ProjectID == "" {
+		health.ProjectID = config.ProjectID
+	}
+	if health.MetricType == "" {
+		health.MetricType = "custom.googleapis.com/gcp_anomaly_detector/health_score"
+	}
+	critical := config.CriticalZScore
+	if critical == 0 {
+		critical = 1.5 * config.ZScoreThreshold
+	}
+	// Validated when the configuration was loaded
+	services, _ := compileHealthScores(health.Services)
+	return &healthScorer{
+		config:        health,
+		services:      services,
+		credentials:   config.Credentials,
+		warning:       config.ZScoreThreshold,
+		critical:      critical,
+		breachedSince: make(map[string]time.Time),
+	}
+}
+
+// score computes the health score of every service from the series scores of the cycle, writes
+// the scores and returns a health anomaly for each service at or over its warning threshold.
+// A component without series scored in the cycle is left out of the score of its service, and a
+// service without any is not scored. A failed write is logged.
+func (h *healthScorer) score(ctx context.Context, scores []SeriesScore, now time.Time) []Anomaly {
+	if h == nil {
+		return nil
+	}
+	written := make(map[string]float64)
+	var anomalies []Anomaly
+	for _, service := range h.services {
+		score, parts, ok := service.score(scores)
+		if !ok {
+			delete(h.breachedSince, service.Service)
+			continue
+		}
+		written[service.Service] = score
+		log.Printf("Health score of service %s: %.2f (%s)\n", service.Service, score, strings.Join(parts, ", "))
+
+		warning, critical := service.Warning, service.Critical
+		if warning == 0 {
+			warning = h.warning
+		}
+		if critical == 0 {
+			critical = math.Max(h.critical, warning)
+		}
+		if score < warning {
+			delete(h.breachedSince, service.Service)
+			continue
+		}
+		since, ok := h.breachedSince[service.Service]
+		if !ok {
+			since = now
+			h.breachedSince[service.Service] = since
+		}
+		severity := SeverityWarning
+		if score >= critical {
+			severity = SeverityCritical
+		}
+		fingerprint := healthFingerprint(service.Service)
+		anomalies = append(anomalies, Anomaly{
+			ID:          anomalyID(anomalyFingerprint(KindHealth, fingerprint), since),
+			Kind:        KindHealth,
+			MetricName:  h.config.MetricType,
+			DisplayName: "Health of " + service.Service,
+			Value:       score,
+			ZScore:      score,
+			Timestamp:   now,
+			Message:     fmt.Sprintf("Health score of service %s is %.2f, at or over %.2f: %s", service.Service, score, warning, strings.Join(parts, ", ")),
+			Severity:    severity,
+
+			Fingerprint:       anomalyFingerprint(KindHealth, fingerprint),
+			SeriesFingerprint: fingerprint,
+			Labels:            map[string]string{"service": service.Service},
+		})
+	}
+	if err := h.write(ctx, written, now); err != nil {
+		log.Printf("Could not write the health scores: %v", err)
+	}
+	return anomalies
+}
+
+// score returns the weighted mean of the scores of the components with series in the cycle,
+// and a description of the score of each component
+func (s serviceHealth) score(scores []SeriesScore) (float64, []string, bool) {
+	var sum, weights float64
+	var parts []string
+	for i, component := range s.components {
+		peak, found := 0.0, false
+		for _, series := range scores {
+			if component.match.matches(Anomaly{MetricName: series.MetricName, Labels: series.Labels}) {
+				peak = math.Max(peak, math.Abs(series.ZScore))
+				found = true
+			}
+		}
+		if !found {
+			continue
+		}
+		sum += peak * component.weight
+		weights += component.weight
+		parts = append(parts, fmt.Sprintf("%s %.2f", s.Components[i].Metric, peak))
+	}
+	if weights == 0 {
+		return 0, nil, false
+	}
+	return sum / weights, parts, true
+}
+
+// healthFingerprint identifies the health score of a service
+func healthFingerprint(service string) string {
+	sum := sha256.Sum256([]byte("health\x00" + service))
+	return hex.EncodeToString(sum[:8])
+}
+
+// write writes the scores, by service, as points of the health metric of the global resource
+func (h *healthScorer) write(ctx context.Context, scores map[string]float64, now time.Time) error {
+	if len(scores) == 0 {
+		return nil
+	}
+	client, err := h.httpClient(ctx)
+	if err != nil {
+		return err
+	}
+	if err := h.describe(ctx, client); err != nil {
+		return err
+	}
+	services := make([]string, 0, len(scores))
+	for service := range scores {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	var series []monitoringTimeSeries
+	for _, service := range services {
+		point := monitoringPoint{}
+		point.Interval.EndTime = now.UTC()
+		point.Value.DoubleValue = scores[service]
+		series = append(series, monitoringTimeSeries{
+			Metric:   monitoringMetric{Type: h.config.MetricType, Labels: map[string]string{"service": service}},
+			Resource: monitoringResource{Type: "global", Labels: map[string]string{"project_id": h.config.ProjectID}},
+			Points:   []monitoringPoint{point},
+		})
+	}
+	writeURL := fmt.Sprintf("https://monitoring.googleapis.com/v3/projects/%s/timeSeries", url.PathEscape(h.config.ProjectID))
+	for start := 0; start < len(series); start += cloudMonitoringBatchSize {
+		end := start + cloudMonitoringBatchSize
+		if end > len(series) {
+			end = len(series)
+		}
+		if err := postJSON(ctx, client, writeURL, nil, map[string]interface{}{"timeSeries": series[start:end]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describe creates the descriptor of the health metric, once
+func (h *healthScorer) describe(ctx context.Context, client *http.Client) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.described {
+		return nil
+	}
+	descriptor := map[string]interface{}{
+		"type":        h.config.MetricType,
+		"metricKind":  "GAUGE",
+		"valueType":   "DOUBLE",
+		"unit":        "1",
+		"displayName": "Service health score",
+		"description": "Weighted mean of the absolute Z-scores of the metrics of a service, written every cycle by gcp-anomaly-detector",
+		"labels":      []monitoringLabelDescriptor{{Key: "service", ValueType: "STRING", Description: "Name of the service"}},
+	}
+	descriptorURL := fmt.Sprintf("https://monitoring.googleapis.com/v3/projects/%s/metricDescriptors", url.PathEscape(h.config.ProjectID))
+	if err := postJSON(ctx, client, descriptorURL, nil, descriptor); err != nil {
+		return fmt.Errorf("could not create metric descriptor %s: %v", h.config.MetricType, err)
+	}
+	h.described = true
+	return nil
+}
+
+// httpClient returns the client of the Cloud Monitoring API, creating it on first use
+func (h *healthScorer) httpClient(ctx context.Context) (*http.Client, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.http != nil {
+		return h.http, nil
+	}
+	opts, err := h.credentials.clientOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client, _, err := htransport.NewClient(ctx, append(opts, option.WithScopes(monitoringWriteScope))...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Cloud Monitoring client: %v", err)
+	}
+	h.http = client
+	return client, nil
+}
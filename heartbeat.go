@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeartbeatConfig pings a dead man's switch, such as a healthchecks.io check or an Opsgenie
+// heartbeat, after successful detection cycles, so a detector that stops running is noticed
+type HeartbeatConfig struct {
+	URL         string            `yaml:"url" secret:"true"`      // pinged after every successful cycle
+	FailURL     string            `yaml:"fail_url" secret:"true"` // optional, pinged when a cycle fails, e.g. the /fail URL of a healthchecks.io check
+	Method      string            `yaml:"method"`                 // GET (default) or POST
+	Headers     map[string]string `yaml:"headers" secret:"true"`  // optional, e.g. the GenieKey authorization of Opsgenie
+	IntervalMin int               `yaml:"interval_min"`           // minimum minutes between pings, defaults to 1
+}
+
+// validate checks the heartbeat settings
+func (c HeartbeatConfig) validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("no url configured")
+	}
+	if c.Method != "" && c.Method != http.MethodGet && c.Method != http.MethodPost {
+		return fmt.Errorf("unsupported method %s", c.Method)
+	}
+	return nil
+}
+
+// heartbeat pings the configured URLs, at most once per interval after successful cycles.
+// Failures are always pinged, so the switch trips without waiting for its grace period.
+type heartbeat struct {
+	config   HeartbeatConfig
+	client   *http.Client
+	interval time.Duration
+
+	// mu guards pingedAt, as the request-triggered handler reports cycles concurrently
+	mu       sync.Mutex
+	pingedAt time.Time
+}
+
+func newHeartbeat(config HeartbeatConfig) *heartbeat {
+	registerSecrets(config)
+	if config.Method == "" {
+		config.Method = http.MethodGet
+	}
+	interval := time.Duration(config.IntervalMin) * time.Minute
+	if config.IntervalMin == 0 {
+		interval = time.Minute
+	}
+	return &heartbeat{config: config, client: &http.Client{Timeout: 10 * time.Second}, interval: interval}
+}
+
+// succeeded pings the URL unless it was pinged within the interval
+func (h *heartbeat) succeeded(ctx context.Context, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.pingedAt.IsZero() && now.Sub(h.pingedAt) < h.interval {
+		return
+	}
+	if err := h.ping(ctx, h.config.URL, ""); err != nil {
+		log.Printf("Heartbeat failed: %v", err)
+		return
+	}
+	h.pingedAt = now
+}
+
+// failed pings the failure URL, if any, with the error as the body of POST requests
+func (h *heartbeat) failed(ctx context.Context, err error) {
+	if h.config.FailURL == "" {
+		return
+	}
+	if pingErr := h.ping(ctx, h.config.FailURL, err.Error()); pingErr != nil {
+		log.Printf("Heartbeat failed: %v", pingErr)
+	}
+}
+
+func (h *heartbeat) ping(ctx context.Context, url, body string) error {
+	var reader io.Reader
+	if h.config.Method == http.MethodPost {
+		reader = strings.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, h.config.Method, url, reader)
+	if err != nil {
+		return err
+	}
+	for key, value := range h.config.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// ingestionObservations is the number of cycles the measured ingestion delay of a metric is
+// taken over
+const ingestionObservations = 10
+
+// IngestionDelayConfig lags the recent window of each metric by how late its points arrive, so
+// the newest minutes, which are often still incomplete, do not skew the current statistics
+type IngestionDelayConfig struct {
+	Auto   bool `yaml:"auto"`    // measures the ingestion delay of every metric and lags its recent window by it
+	MaxSec int  `yaml:"max_sec"` // longest lag applied, in seconds, defaults to 600
+}
+
+// ingestionDelays measures the ingestion delay of the metrics and holds the lag of their recent
+// windows
+type ingestionDelays struct {
+	config   IngestionDelayConfig
+	observed map[string][]time.Duration // delays of the last cycles by metric type, oldest first
+	applied  map[string]time.Duration
+}
+
+func newIngestionDelays(config IngestionDelayConfig) *ingestionDelays {
+	if config.MaxSec == 0 {
+		config.MaxSec = 600
+	}
+	return &ingestionDelays{config: config, observed: make(map[string][]time.Duration), applied: make(map[string]time.Duration)}
+}
+
+// lag returns how far the recent window of the metric ends before now: its configured
+// ingestion_delay_sec, else the measured delay with auto, else none
+func (d *ingestionDelays) lag(metric MetricConfig) time.Duration {
+	if metric.IngestionDelaySec > 0 {
+		return time.Duration(metric.IngestionDelaySec) * time.Second
+	}
+	if !d.config.Auto {
+		return 0
+	}
+	return d.applied[metric.Type]
+}
+
+// evaluationEnd returns the end of the recent window of the metric, given the end its ingestion
+// lag leaves: evaluation_offset_min earlier, rounded down to a multiple of window_align_min
+func (m MetricConfig) evaluationEnd(end time.Time) time.Time {
+	end = end.Add(-time.Duration(m.EvaluationOffsetMin) * time.Minute)
+	if m.WindowAlignMin > 0 {
+		end = end.Truncate(time.Duration(m.WindowAlignMin) * time.Minute)
+	}
+	return end
+}
+
+// observe records the ingestion delay of the metric in a cycle, the median age of the newest
+// point of its series at now, and sets its lag to the longest delay of the last cycles capped at
+// max_sec
+func (d *ingestionDelays) observe(metric MetricConfig, series []*monitoringpb.TimeSeries, now time.Time) {
+	if !d.config.Auto || metric.IngestionDelaySec > 0 {
+		return
+	}
+	var ages []time.Duration
+	for _, ts := range series {
+		var newest time.Time
+		for _, point := range ts.Points {
+			if t := point.Interval.EndTime.AsTime(); t.After(newest) {
+				newest = t
+			}
+		}
+		if !newest.IsZero() {
+			ages = append(ages, max(0, now.Sub(newest)))
+		}
+	}
+	if len(ages) == 0 {
+		return
+	}
+	sort.Slice(ages, func(i, j int) bool { return ages[i] < ages[j] })
+	observed := append(d.observed[metric.Type], ages[len(ages)/2])
+	if len(observed) > ingestionObservations {
+		observed = observed[len(observed)-ingestionObservations:]
+	}
+	d.observed[metric.Type] = observed
+
+	var lag time.Duration
+	for _, delay := range observed {
+		lag = max(lag, delay)
+	}
+	d.applied[metric.Type] = min(lag.Round(time.Second), time.Duration(d.config.MaxSec)*time.Second)
+}
+
+// pointsUntil returns the series with only its points ending at or before t
+func pointsUntil(ts *monitoringpb.TimeSeries, t time.Time) *monitoringpb.TimeSeries {
+	kept := make([]*monitoringpb.Point, 0, len(ts.Points))
+	for _, point := range ts.Points {
+		if !point.Interval.EndTime.AsTime().After(t) {
+			kept = append(kept, point)
+		}
+	}
+	if len(kept) < len(ts.Points) {
+		ts.Points = kept
+	}
+	return ts
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"path"
+)
+
+// InhibitionRule keeps the anomalies that follow from another one from being notified while it
+// is open, as Alertmanager inhibition does, such as the latency and errors of a service whose
+// uptime check fails
+type InhibitionRule struct {
+	Name           string   `yaml:"name"`            // identifies the rule in logs
+	SourceMetric   string   `yaml:"source_metric"`   // metric type or glob pattern of the inhibiting anomalies, all metrics if empty
+	SourceMatchers []string `yaml:"source_matchers"` // label matchers the inhibiting anomalies must all match
+	TargetMetric   string   `yaml:"target_metric"`   // metric type or glob pattern of the inhibited anomalies, all metrics if empty
+	TargetMatchers []string `yaml:"target_matchers"` // label matchers the inhibited anomalies must all match
+	Equal          []string `yaml:"equal"`           // labels the source and target must have the same value of, e.g. [service_name]
+}
+
+// inhibitionRule is an InhibitionRule with its metrics and matchers parsed
+type inhibitionRule struct {
+	name           string
+	source, target suppressionRule
+	equal          []string
+}
+
+// compileInhibitions parses the inhibition rules of the configuration
+func compileInhibitions(rules []InhibitionRule) ([]inhibitionRule, error) {
+	var compiled []inhibitionRule
+	for i, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("inhibition %d", i+1)
+		}
+		if rule.SourceMetric == "" && len(rule.SourceMatchers) == 0 {
+			return nil, fmt.Errorf("%s: a rule needs a source_metric or source_matchers", name)
+		}
+		if rule.TargetMetric == "" && len(rule.TargetMatchers) == 0 {
+			return nil, fmt.Errorf("%s: a rule needs a target_metric or target_matchers", name)
+		}
+		c := inhibitionRule{name: name, equal: rule.Equal}
+		var err error
+		if c.source, err = compileAnomalyMatch(rule.SourceMetric, rule.SourceMatchers); err != nil {
+			return nil, fmt.Errorf("%s: source: %v", name, err)
+		}
+		if c.target, err = compileAnomalyMatch(rule.TargetMetric, rule.TargetMatchers); err != nil {
+			return nil, fmt.Errorf("%s: target: %v", name, err)
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// compileAnomalyMatch parses a metric pattern and label matchers, such as those of the source or
+// target of an inhibition rule
+func compileAnomalyMatch(metric string, matchers []string) (suppressionRule, error) {
+	if _, err := path.Match(metric, ""); err != nil {
+		return suppressionRule{}, fmt.Errorf("invalid metric pattern %q: %v", metric, err)
+	}
+	side := suppressionRule{metric: metric}
+	for _, matcher := range matchers {
+		m, err := parseLabelMatcher(matcher)
+		if err != nil {
+			return suppressionRule{}, err
+		}
+		side.matchers = append(side.matchers, m)
+	}
+	return side, nil
+}
+
+// inhibits reports whether the source anomaly inhibits the target under the rule. An anomaly
+// never inhibits itself, so an alert matching both sides of a rule is still notified.
+func (r inhibitionRule) inhibits(source, target Anomaly) bool {
+	if source.Fingerprint == target.Fingerprint {
+		return false
+	}
+	if !r.target.matches(target) || !r.source.matches(source) {
+		return false
+	}
+	for _, label := range r.equal {
+		if inhibitionLabel(source, label) != inhibitionLabel(target, label) {
+			return false
+		}
+	}
+	return true
+}
+
+// inhibitionLabel looks the label up in the series labels, then in the metadata, as matchers do
+func inhibitionLabel(anomaly Anomaly, label string) string {
+	if value, ok := anomaly.Labels[label]; ok {
+		return value
+	}
+	return anomaly.Metadata[label]
+}
+
+// inhibitedBy returns the name of the first inhibition rule under which one of the sources
+// inhibits the anomaly, and the inhibiting anomaly
+func (r *Router) inhibitedBy(anomaly Anomaly, sources []Anomaly) (string, Anomaly, bool) {
+	for _, rule := range r.inhibitions {
+		for _, source := range sources {
+			if rule.inhibits(source, anomaly) {
+				return rule.name, source, true
+			}
+		}
+	}
+	return "", Anomaly{}, false
+}
+
+// inhibitionSources returns the anomalies that can inhibit others: those of the cycle, and the
+// latest report of the events still open or acknowledged
+func (r *Router) inhibitionSources(anomalies []Anomaly) []Anomaly {
+	if len(r.inhibitions) == 0 {
+		return nil
+	}
+	sources := make([]Anomaly, 0, len(anomalies))
+	reported := make(map[string]bool, len(anomalies))
+	for _, anomaly := range anomalies {
+		if anomaly.Kind == KindRateLimit || anomaly.Kind == KindStorm {
+			continue
+		}
+		sources = append(sources, anomaly)
+		reported[anomaly.ID] = true
+	}
+	if r.events != nil {
+		for _, event := range r.events.List("") {
+			if event.State != EventResolved && !reported[event.ID] {
+				sources = append(sources, event.Anomaly)
+			}
+		}
+	}
+	return sources
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// InjectionConfig injects a synthetic anomaly on a schedule, so delivery to the notifiers is
+// exercised continuously rather than first tested by a real incident
+type InjectionConfig struct {
+	Metric      string `yaml:"metric"`       // metric the anomaly is attributed to, defaults to the first configured metric
+	IntervalMin int    `yaml:"interval_min"` // minutes between injected anomalies, defaults to 1440 (daily)
+	Severity    string `yaml:"severity"`     // warning (default) or critical
+}
+
+// syntheticLabel marks injected anomalies, so routes and receivers can tell them apart
+const syntheticLabel = "synthetic"
+
+// validate checks the injection settings against the configuration
+func (i InjectionConfig) validate(config *Config) error {
+	if i.Severity != "" && i.Severity != SeverityWarning && i.Severity != SeverityCritical {
+		return fmt.Errorf("unknown severity %s", i.Severity)
+	}
+	if i.Metric != "" {
+		if _, ok := config.MetricConfig(i.Metric); !ok {
+			return fmt.Errorf("metric %s is not configured", i.Metric)
+		}
+	}
+	return nil
+}
+
+// syntheticAnomaly fabricates an anomaly of the metric, annotated like a detected one so that
+// routing by metric, labels and severity applies to it. The first configured metric is used if
+// metric is empty.
+func syntheticAnomaly(config *Config, metric, severity string, now time.Time) Anomaly {
+	if metric == "" && len(config.Metrics) > 0 {
+		metric = config.Metrics[0].Type
+	}
+	if severity == "" {
+		severity = SeverityWarning
+	}
+	zScore := config.ZScoreThreshold
+	if severity == SeverityCritical {
+		zScore = 2 * config.ZScoreThreshold
+	}
+
+	anomalies := []Anomaly{{
+		Kind:        KindAnomaly,
+		ID:          "synthetic-" + anomalyID(syntheticLabel, now),
+		MetricName:  metric,
+		Timestamp:   now,
+		Message:     "Synthetic anomaly injected to test notification delivery, no action is needed",
+		ZScore:      zScore,
+		Severity:    severity,
+		Fingerprint: syntheticLabel,
+		Labels:      map[string]string{"resource_type": "global", syntheticLabel: "true"},
+		EndTime:     now,
+		PeakTime:    now,
+		Points:      1,
+	}}
+	config.annotate(anomalies)
+	return anomalies[0]
+}
+
+// inject returns a synthetic anomaly if one is due, the first in the first cycle
+func (d *SimpleAnomalyDetector) inject(config *Config, now time.Time) []Anomaly {
+	injection := config.Injection
+	if injection == nil {
+		return nil
+	}
+	interval := time.Duration(injection.IntervalMin) * time.Minute
+	if injection.IntervalMin == 0 {
+		interval = 24 * time.Hour
+	}
+	if !d.injectedAt.IsZero() && now.Sub(d.injectedAt) < interval {
+		return nil
+	}
+	d.injectedAt = now
+	log.Println("Injecting a synthetic anomaly...")
+	return []Anomaly{syntheticAnomaly(config, injection.Metric, injection.Severity, now)}
+}
+
+// runTestAlert sends a synthetic anomaly through the routing and notifiers of the configuration,
+// exiting non-zero if a notifier fails
+func runTestAlert(args []string) {
+	fs := flag.NewFlagSet("test-alert", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	metric := fs.String("metric", "", "Metric to attribute the anomaly to (defaults to the first configured metric)")
+	severity := fs.String("severity", SeverityWarning, "Severity of the anomaly: warning or critical")
+	notifiers := fs.String("notifiers", "", "Comma-separated names of the notifiers to test (defaults to all)")
+	fs.Parse(args)
+
+	config := mustLoadConfig(*configPath)
+	if err := (InjectionConfig{Metric: *metric, Severity: *severity}).validate(config); err != nil {
+		log.Fatalf("Invalid test alert: %v", err)
+	}
+	// The test is sent from this process rather than by the elected leader, and is not a
+	// detection cycle to report to the heartbeat
+	config.LeaderElection = nil
+	config.Heartbeat = nil
+	router := mustCreateRouter(config)
+	if *notifiers != "" {
+		var err error
+		router, err = router.Subset(strings.Split(*notifiers, ","))
+		if err != nil {
+			log.Fatalf("Invalid -notifiers: %v", err)
+		}
+	}
+
+	anomaly := syntheticAnomaly(config, *metric, *severity, time.Now())
+	if failed := router.report(context.Background(), []Anomaly{anomaly}, nil); failed > 0 {
+		log.Printf("Test alert %s failed on %d notifiers\n", anomaly.ID, failed)
+		os.Exit(1)
+	}
+	fmt.Printf("Test alert %s routed to %d notifiers\n", anomaly.ID, len(router.notifiers))
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// LeaderElectionConfig makes replicas of a highly available deployment elect a leader, so only
+// one of them notifies while the others keep their baselines warm to take over
+type LeaderElectionConfig struct {
+	Backend       string `yaml:"backend"`        // kubernetes for a Lease object, or gcs for a lock object
+	Name          string `yaml:"name"`           // kubernetes: name of the Lease, defaults to gcp-anomaly-detector (suffixed with the tenant)
+	Namespace     string `yaml:"namespace"`      // kubernetes: namespace of the Lease, defaults to that of the pod
+	APIServer     string `yaml:"api_server"`     // kubernetes: API server URL, defaults to the in-cluster service
+	LockPath      string `yaml:"lock_path"`      // gcs: gs://bucket/object of the lock
+	LeaseDuration int    `yaml:"lease_duration"` // seconds a leader holds the lease without renewing it, defaults to 30
+	Identity      string `yaml:"identity"`       // name of this replica, defaults to the host name
+}
+
+// leaseRecord is the state of a lease as stored by a leaderLock
+type leaseRecord struct {
+	Holder    string    `json:"holder"`
+	RenewTime time.Time `json:"renew_time"`
+}
+
+// expired reports whether the holder failed to renew the lease within duration
+func (l leaseRecord) expired(now time.Time, duration time.Duration) bool {
+	return l.Holder == "" || now.Sub(l.RenewTime) > duration
+}
+
+// leaderLock acquires or renews a lease for identity, returning whether identity holds it, and
+// releases a lease identity holds
+type leaderLock interface {
+	tryAcquire(ctx context.Context, identity string, duration time.Duration, now time.Time) (bool, error)
+	release(ctx context.Context, identity string) error
+}
+
+// leaderElector keeps trying to acquire the lease and reports whether this replica leads
+type leaderElector struct {
+	lock     leaderLock
+	identity string
+	duration time.Duration
+	leading  atomic.Bool
+
+	stop context.CancelFunc // stops run
+	done chan struct{}      // closed when run returns
+}
+
+// newLeaderElector creates the lock described by config. The tenant, if any, is appended to
+// the default Lease name so tenants elect their leaders independently. A gcs lock authenticates
+// with the credentials of the detector.
+func newLeaderElector(ctx context.Context, config LeaderElectionConfig, tenant string, credentials CredentialsConfig) (*leaderElector, error) {
+	duration := time.Duration(config.LeaseDuration) * time.Second
+	if duration == 0 {
+		duration = 30 * time.Second
+	}
+	identity := config.Identity
+	if identity == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("could not determine identity: %v", err)
+		}
+		identity = hostname
+	}
+
+	var lock leaderLock
+	switch config.Backend {
+	case "kubernetes":
+		name := config.Name
+		if name == "" {
+			name = "gcp-anomaly-detector"
+			if tenant != "" {
+				name += "-" + tenant
+			}
+		}
+		namespace := config.Namespace
+		if namespace == "" {
+			data, err := os.ReadFile(serviceAccountDir + "/namespace")
+			if err != nil {
+				return nil, fmt.Errorf("no namespace configured and not running in a cluster: %v", err)
+			}
+			namespace = strings.TrimSpace(string(data))
+		}
+		kube, err := newKubeClient(config.APIServer)
+		if err != nil {
+			return nil, fmt.Errorf("could not create Kubernetes client: %v", err)
+		}
+		lock = &kubeLeaseLock{kube: kube, namespace: namespace, name: name}
+	case "gcs":
+		bucket, object, ok := parseGCSURI(config.LockPath)
+		if !ok {
+			return nil, fmt.Errorf("lock_path must be a gs://bucket/object URI")
+		}
+		opts, err := credentials.clientOptions(ctx)
+		if err != nil {
+			return nil, err
+		}
+		client, _, err := htransport.NewClient(ctx, append(opts, option.WithScopes(storageScope))...)
+		if err != nil {
+			return nil, fmt.Errorf("could not create storage client: %v", err)
+		}
+		lock = &gcsLock{client: client, bucket: bucket, object: object}
+	default:
+		return nil, fmt.Errorf("unknown backend %q, expected kubernetes or gcs", config.Backend)
+	}
+
+	return &leaderElector{lock: lock, identity: identity, duration: duration, done: make(chan struct{})}, nil
+}
+
+// start runs the election in the background until resign
+func (e *leaderElector) start() {
+	ctx, stop := context.WithCancel(context.Background())
+	e.stop = stop
+	go e.run(ctx)
+}
+
+// resign stops the election and releases the lease if this replica holds it, so a standby
+// takes over without waiting for the lease to expire
+func (e *leaderElector) resign(ctx context.Context) error {
+	e.stop()
+	<-e.done
+	if !e.leading.Swap(false) {
+		return nil
+	}
+	log.Printf("Releasing the leadership of %s\n", e.identity)
+	return e.lock.release(ctx, e.identity)
+}
+
+// run renews or acquires the lease every third of its duration until ctx is done. A replica
+// that cannot reach the lock steps down once its lease would have expired.
+func (e *leaderElector) run(ctx context.Context) {
+	defer close(e.done)
+	var lastRenewed time.Time
+	ticker := time.NewTicker(e.duration / 3)
+	defer ticker.Stop()
+	for {
+		now := time.Now()
+		leading, err := e.lock.tryAcquire(ctx, e.identity, e.duration, now)
+		switch {
+		case err != nil:
+			log.Printf("Leader election failed: %v", err)
+			leading = e.leading.Load() && now.Sub(lastRenewed) < e.duration
+		case leading:
+			lastRenewed = now
+		}
+		if leading != e.leading.Load() {
+			if leading {
+				log.Printf("Became leader as %s, sending notifications\n", e.identity)
+			} else {
+				log.Printf("Standing by as %s, notifications are sent by the leader\n", e.identity)
+			}
+			e.leading.Store(leading)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// isLeader reports whether this replica currently holds the lease
+func (e *leaderElector) isLeader() bool {
+	return e.leading.Load()
+}
+
+// kubeLeaseLock stores the lease in a coordination.k8s.io/v1 Lease object, updated with
+// optimistic concurrency so only one replica wins a race
+type kubeLeaseLock struct {
+	kube      *kubeClient
+	namespace string
+	name      string
+}
+
+type kubeLease struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   kubeLeaseMetadata `json:"metadata"`
+	Spec       kubeLeaseSpec     `json:"spec"`
+}
+
+type kubeLeaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type kubeLeaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+}
+
+// kubeMicroTime is the layout of the MicroTime fields of a Lease
+const kubeMicroTime = "2006-01-02T15:04:05.000000Z07:00"
+
+func (l *kubeLeaseLock) tryAcquire(ctx context.Context, identity string, duration time.Duration, now time.Time) (bool, error) {
+	collection := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", l.namespace)
+	stamp := now.UTC().Format(kubeMicroTime)
+
+	var lease kubeLease
+	err := l.kube.do(ctx, http.MethodGet, collection+"/"+l.name, "", nil, &lease)
+	var apiErr *kubeAPIError
+	if errors.As(err, &apiErr) && apiErr.status == http.StatusNotFound {
+		lease = kubeLease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   kubeLeaseMetadata{Name: l.name, Namespace: l.namespace},
+			Spec: kubeLeaseSpec{
+				HolderIdentity:       identity,
+				LeaseDurationSeconds: int(duration.Seconds()),
+				AcquireTime:          stamp,
+				RenewTime:            stamp,
+			},
+		}
+		return l.write(ctx, http.MethodPost, collection, lease)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	renewed, _ := time.Parse(kubeMicroTime, lease.Spec.RenewTime)
+	current := leaseRecord{Holder: lease.Spec.HolderIdentity, RenewTime: renewed}
+	if current.Holder != identity {
+		if !current.expired(now, duration) {
+			return false, nil
+		}
+		lease.Spec.AcquireTime = stamp
+	}
+	lease.Spec.HolderIdentity = identity
+	lease.Spec.LeaseDurationSeconds = int(duration.Seconds())
+	lease.Spec.RenewTime = stamp
+	return l.write(ctx, http.MethodPut, collection+"/"+l.name, lease)
+}
+
+func (l *kubeLeaseLock) release(ctx context.Context, identity string) error {
+	path := fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", l.namespace, l.name)
+	var lease kubeLease
+	if err := l.kube.do(ctx, http.MethodGet, path, "", nil, &lease); err != nil {
+		return err
+	}
+	if lease.Spec.HolderIdentity != identity {
+		return nil
+	}
+	// A lease without a holder is expired for every replica
+	lease.Spec.HolderIdentity = ""
+	_, err := l.write(ctx, http.MethodPut, path, lease)
+	return err
+}
+
+// write stores the lease, treating a conflict with another replica's write as a lost race
+func (l *kubeLeaseLock) write(ctx context.Context, method, path string, lease kubeLease) (bool, error) {
+	body, err := json.Marshal(lease)
+	if err != nil {
+		return false, err
+	}
+	err = l.kube.do(ctx, method, path, "application/json", body, nil)
+	var apiErr *kubeAPIError
+	if errors.As(err, &apiErr) && (apiErr.status == http.StatusConflict) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// gcsLock stores the lease in a Cloud Storage object, written with generation preconditions
+// so only one replica wins a race
+type gcsLock struct {
+	client *http.Client
+	bucket string
+	object string
+}
+
+func (l *gcsLock) tryAcquire(ctx context.Context, identity string, duration time.Duration, now time.Time) (bool, error) {
+	current, generation, err := l.read(ctx)
+	if err != nil {
+		return false, err
+	}
+	if current.Holder != identity && !current.expired(now, duration) {
+		return false, nil
+	}
+
+	return l.write(ctx, leaseRecord{Holder: identity, RenewTime: now}, generation)
+}
+
+func (l *gcsLock) release(ctx context.Context, identity string) error {
+	current, generation, err := l.read(ctx)
+	if err != nil || current.Holder != identity {
+		return err
+	}
+	// A lease without a holder is expired for every replica
+	_, err = l.write(ctx, leaseRecord{}, generation)
+	return err
+}
+
+// write stores the lease if the lock object is still at generation, returning whether it was
+func (l *gcsLock) write(ctx context.Context, record leaseRecord, generation int64) (bool, error) {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return false, err
+	}
+	// A generation of 0 only matches when the object does not exist yet
+	uploadURL := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s&ifGenerationMatch=%d",
+		url.PathEscape(l.bucket), url.QueryEscape(l.object), generation)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("could not write lock: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusPreconditionFailed:
+		return false, nil
+	default:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, fmt.Errorf("could not write lock: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+}
+
+// read returns the lease and the generation of the lock object, 0 when there is none
+func (l *gcsLock) read(ctx context.Context) (leaseRecord, int64, error) {
+	objectURL := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media", url.PathEscape(l.bucket), url.PathEscape(l.object))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectURL, nil)
+	if err != nil {
+		return leaseRecord{}, 0, err
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return leaseRecord{}, 0, fmt.Errorf("could not read lock: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return leaseRecord{}, 0, nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		return leaseRecord{}, 0, fmt.Errorf("could not read lock: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	generation, err := strconv.ParseInt(resp.Header.Get("X-Goog-Generation"), 10, 64)
+	if err != nil {
+		return leaseRecord{}, 0, fmt.Errorf("could not read lock generation: %v", err)
+	}
+
+	var record leaseRecord
+	if err := json.Unmarshal(body, &record); err != nil {
+		// A corrupt lock is taken over like an expired one
+		log.Printf("Ignoring unreadable lock gs://%s/%s: %v", l.bucket, l.object, err)
+		return leaseRecord{}, generation, nil
+	}
+	return record, generation, nil
+}
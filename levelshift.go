@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// LevelShiftConfig rebaselines the series of sustained level shifts from their points since the
+// shift, so the new level becomes the series' normal rather than being alerted on for as long as
+// it lasts
+type LevelShiftConfig struct {
+	RebaselineAfterMin int  `yaml:"rebaseline_after_min"` // minutes a level shift lasts before its series is rebaselined, 0 disables
+	RebaselineOnAck    bool `yaml:"rebaseline_on_ack"`    // rebaselines the series of a level shift once its event is acknowledged
+}
+
+func (c LevelShiftConfig) validate() error {
+	if c.RebaselineAfterMin < 0 {
+		return fmt.Errorf("rebaseline_after_min must not be negative")
+	}
+	return nil
+}
+
+// enabled reports whether level shifts are ever rebaselined
+func (c LevelShiftConfig) enabled() bool {
+	return c.RebaselineAfterMin > 0 || c.RebaselineOnAck
+}
+
+// rebaselineLevelShifts replaces the baseline of the series of the ongoing level shifts that
+// lasted rebaseline_after_min, or whose events were acknowledged, with the statistics of their
+// points since the shift began, and returns the other anomalies with the number of series
+// rebaselined. A series needs as many post-shift points in the recent window as a baseline
+// needs, and is left until it has them. Metrics scored against a fixed or referenced baseline
+// are never rebaselined.
+func (d *SimpleAnomalyDetector) rebaselineLevelShifts(metrics []*monitoringpb.TimeSeries, anomalies []Anomaly) ([]Anomaly, int) {
+	if !d.levelShift.enabled() || d.seriesStats == nil {
+		return anomalies, 0
+	}
+	series := make(map[string]*monitoringpb.TimeSeries, len(metrics))
+	for _, metric := range metrics {
+		series[seriesFingerprint(metric)] = metric
+	}
+
+	kept := anomalies[:0]
+	rebaselined := 0
+	for _, anomaly := range anomalies {
+		if !d.shouldRebaseline(anomaly) || !d.rebaselineShift(series[anomaly.SeriesFingerprint], anomaly) {
+			kept = append(kept, anomaly)
+			continue
+		}
+		rebaselined++
+	}
+	return kept, rebaselined
+}
+
+// shouldRebaseline reports whether the anomaly is an ongoing level shift due to be rebaselined
+func (d *SimpleAnomalyDetector) shouldRebaseline(anomaly Anomaly) bool {
+	if anomaly.Kind != KindAnomaly || anomaly.Type != TypeLevelShift {
+		return false
+	}
+	if _, ok := d.fixed[anomaly.MetricName]; ok || d.referenced[anomaly.MetricName] {
+		return false
+	}
+	if _, open := d.openEvents[anomaly.SeriesFingerprint]; !open {
+		return false // back to its old level
+	}
+	after := time.Duration(d.levelShift.RebaselineAfterMin) * time.Minute
+	if after > 0 && anomaly.EndTime.Sub(anomaly.Timestamp) >= after {
+		return true
+	}
+	if d.levelShift.RebaselineOnAck && d.events != nil {
+		event, ok := d.events.Get(anomaly.ID)
+		return ok && event.State == EventAcknowledged
+	}
+	return false
+}
+
+// rebaselineShift replaces the baseline of the series with the statistics of its points since
+// the level shift of the anomaly began, and reports whether it had enough of them
+func (d *SimpleAnomalyDetector) rebaselineShift(metric *monitoringpb.TimeSeries, anomaly Anomaly) bool {
+	if metric == nil {
+		return false
+	}
+	shifted := &monitoringpb.TimeSeries{Metric: metric.Metric, Resource: metric.Resource, Unit: metric.Unit}
+	for _, point := range metric.Points {
+		if !point.Interval.EndTime.AsTime().Before(anomaly.Timestamp) {
+			shifted.Points = append(shifted.Points, point)
+		}
+	}
+	accumulator := newBaselineAccumulator(d.seasons, d.transforms)
+	accumulator.add(shifted)
+	fingerprint := anomaly.SeriesFingerprint
+	required := int64(d.requiredBaselinePoints())
+	weekdays, weekend := accumulator.seriesStats()[fingerprint], accumulator.weekend.seriesStats()[fingerprint]
+	if weekdays.count < required && weekend.count < required {
+		log.Printf("Level shift of series %s of metric %s is due to be rebaselined, waiting for %d points since %s (%d so far)\n",
+			fingerprint, anomaly.MetricName, required, displayTime(anomaly.Timestamp), weekdays.count+weekend.count)
+		return false
+	}
+
+	// The season the shift was seen in is rebaselined, the other keeps its baseline until the
+	// shift is seen in it too
+	if weekdays.count >= required {
+		d.seriesStats[fingerprint] = weekdays
+	}
+	if weekend.count >= required {
+		if d.weekendSeriesStats == nil {
+			d.weekendSeriesStats = make(map[string]MetricStats)
+		}
+		d.weekendSeriesStats[fingerprint] = weekend
+	}
+	// The baseline of the new level replaces the one assessed as untrustworthy
+	delete(d.untrusted, fingerprint)
+	stats := weekdays
+	if weekend.count > weekdays.count {
+		stats = weekend
+	}
+	log.Printf("Rebaselined series %s of metric %s after a level shift since %s: Mean: %.2f, StdDev: %.2f over %d points\n",
+		fingerprint, anomaly.MetricName, displayTime(anomaly.Timestamp), stats.mean, stats.stddev, stats.count)
+	return true
+}
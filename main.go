@@ -3,102 +3,483 @@ package main
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"math"
 	"os"
+	"os/signal"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
 	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
 	"google.golang.org/api/iterator"
 	"google.golang.org/protobuf/types/known/timestamppb"
-	"gopkg.in/yaml.v2"
 )
 
+// Anomaly is what the detectors report to the notifiers. Its JSON and YAML encodings are version
+// 1 of the anomaly payload, so fields are only ever added to it, as optional ones.
 type Anomaly struct {
-	MetricName string
-	Value      float64
-	Timestamp  time.Time
-	Message    string
+	// Kind is anomaly for a point deviating from the baseline, forecast for a projected breach,
+	// flatline for a series stuck at a constant value, canary for a canary deviating from its
+	// control, peer for a group of series deviating from the other groups, replica for a series
+	// deviating from its group, rate_limit for the summary of notifications held back by the
+	// rate limit, or storm for the widespread anomaly alert standing in for an alert storm
+	Kind string `json:"kind" yaml:"kind"`
+	// Type classifies the shape of a deviation: spike, dip, level_shift or trend_break
+	Type string `json:"type,omitempty" yaml:"type,omitempty"`
+	// ID identifies the event; it is derived from the fingerprint and the time the event started,
+	// so a backtest over the same range reproduces it and every notifier refers to it alike
+	ID         string `json:"id" yaml:"id"`
+	MetricName string `json:"metric_name" yaml:"metric_name"`
+	// ProjectID is the project the metric was read from
+	ProjectID string `json:"project_id,omitempty" yaml:"project_id,omitempty"`
+	// DisplayName is the metric's display_name from the configuration, if any
+	DisplayName string    `json:"display_name,omitempty" yaml:"display_name,omitempty"`
+	Value       float64   `json:"value" yaml:"value"`
+	Unit        string    `json:"unit,omitempty" yaml:"unit,omitempty"` // unit of the value from the metric descriptor, such as By or ms
+	Timestamp   time.Time `json:"timestamp" yaml:"timestamp"`
+	Message     string    `json:"message" yaml:"message"`
+	ZScore      float64   `json:"z_score" yaml:"z_score"`
+	Severity    string    `json:"severity" yaml:"severity"` // warning or critical
+	// State is the lifecycle state of the anomaly's event when it was reported: open or
+	// acknowledged
+	State string `json:"state,omitempty" yaml:"state,omitempty"`
+
+	// Fingerprint identifies the alert: the series and the kind of detection, so a forecast and
+	// an anomaly on one series are tracked apart. It is the series fingerprint for anomalies.
+	Fingerprint string `json:"fingerprint" yaml:"fingerprint"`
+	// SeriesFingerprint identifies the time series, or canary comparison, the anomaly was detected
+	// on, for correlating the alerts of all detectors on it
+	SeriesFingerprint string `json:"series_fingerprint,omitempty" yaml:"series_fingerprint,omitempty"`
+	// Labels are the resource and metric labels of the series, plus its resource_type
+	Labels map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	// Metadata are the static labels of the metric from the configuration, such as team or runbook_url
+	Metadata map[string]string `json:"metadata,omitempty" yaml:"metadata,omitempty"`
+	// Expected is the range the value was expected in, for anomalies and forecasts
+	Expected *ExpectedRange `json:"expected,omitempty" yaml:"expected,omitempty"`
+
+	// An anomaly merges the contiguous anomalous points of a series into one event, which starts
+	// at Timestamp and ends at EndTime. Value and ZScore are those of its peak, at PeakTime. An
+	// event still going on is reported again with the same ID while it gains points.
+	EndTime         time.Time `json:"end_time,omitempty" yaml:"end_time,omitempty"`
+	PeakTime        time.Time `json:"peak_time,omitempty" yaml:"peak_time,omitempty"`
+	DurationSeconds float64   `json:"duration_seconds,omitempty" yaml:"duration_seconds,omitempty"`
+	Points          int       `json:"points,omitempty" yaml:"points,omitempty"`
+
+	// Context holds the newest values of the series with anomaly_context
+	Context *AnomalyContext `json:"context,omitempty" yaml:"context,omitempty"`
+	// ExplorerURL opens the series in Metrics Explorer and ChartURL a chart of it, with links
+	ExplorerURL string `json:"explorer_url,omitempty" yaml:"explorer_url,omitempty"`
+	ChartURL    string `json:"chart_url,omitempty" yaml:"chart_url,omitempty"`
+	// Backfilled marks the anomalies found over the time the detector was down, with backfill
+	Backfilled bool `json:"backfilled,omitempty" yaml:"backfilled,omitempty"`
+	// Rollout is the deployment the anomaly started during or shortly after, with rollouts
+	Rollout string `json:"rollout,omitempty" yaml:"rollout,omitempty"`
+	// Changes are the changes made to the resource of the anomaly around its start, newest
+	// first, with changes
+	Changes []ChangeEvent `json:"changes,omitempty" yaml:"changes,omitempty"`
+	// Traces are the slowest requests traced around the anomaly of a latency metric, with traces
+	Traces []TraceExemplar `json:"traces,omitempty" yaml:"traces,omitempty"`
+	// Completeness is the share of the points expected over the recent window the series had,
+	// when it was incomplete, with completeness
+	Completeness float64 `json:"completeness,omitempty" yaml:"completeness,omitempty"`
+}
+
+// displayName returns the name to show people for the anomaly's metric
+func (a Anomaly) displayName() string {
+	if a.DisplayName != "" {
+		return a.DisplayName
+	}
+	return a.MetricName
+}
+
+// formattedValue formats the value in the unit of its metric, such as "1.20 GiB"
+func (a Anomaly) formattedValue() string {
+	return formatValue(a.Value, a.Unit)
+}
+
+// resource describes the series the anomaly was detected on by its resource type and labels,
+// such as "gce_instance{instance_id=123, zone=us-central1-a}"
+func (a Anomaly) resource() string {
+	labels := make(map[string]string, len(a.Labels))
+	for key, value := range a.Labels {
+		if key != "resource_type" {
+			labels[key] = value
+		}
+	}
+	return a.Labels["resource_type"] + "{" + formatLabels(labels) + "}"
+}
+
+// links describes the runbook and dashboard of the anomaly's metric, if configured, and its
+// Metrics Explorer and chart links, such as " (runbook https://..., dashboard https://...)"
+func (a Anomaly) links() string {
+	var links []string
+	if url := a.Metadata["runbook_url"]; url != "" {
+		links = append(links, "runbook "+url)
+	}
+	if url := a.Metadata["dashboard_url"]; url != "" {
+		links = append(links, "dashboard "+url)
+	}
+	return formatLinks(append(links, a.seriesLinks()...))
+}
+
+// queryLinks describes the Metrics Explorer and chart links of the anomaly only, such as
+// " (explorer https://..., chart https://...)"
+func (a Anomaly) queryLinks() string {
+	return formatLinks(a.seriesLinks())
 }
 
-type Config struct {
-	Metrics          []string          `yaml:"metrics"`
-	PollingTime      int               `yaml:"polling_time"` // in seconds
-	ProjectID        string            `yaml:"project_id"`
-	BaselineDuration int               `yaml:"baseline_duration"` // in days
-	RecentDuration   int               `yaml:"recent_duration"`   // in minutes
-	Filters          map[string]string `yaml:"filters"`           // map of metric to filter string
-	ZScoreThreshold  float64           `yaml:"z_score_threshold"` // Z-score threshold for anomaly detection
+// seriesLinks returns the Metrics Explorer and chart links of the anomaly, named
+func (a Anomaly) seriesLinks() []string {
+	var links []string
+	if a.ExplorerURL != "" {
+		links = append(links, "explorer "+a.ExplorerURL)
+	}
+	if a.ChartURL != "" {
+		links = append(links, "chart "+a.ChartURL)
+	}
+	return links
 }
 
+// formatLinks lists named links in parentheses, nothing for none
+func formatLinks(links []string) string {
+	if len(links) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(links, ", ") + ")"
+}
+
+// ExpectedRange is the band of values that would not have been reported and how far the value
+// lies from what was expected. For a forecast it is the range the trend is projected to cover
+// over the horizon, and the deviation is the distance of the current value from the limit.
+type ExpectedRange struct {
+	Low  float64 `json:"low" yaml:"low"`
+	High float64 `json:"high" yaml:"high"`
+	// DeviationPercent is omitted when the reference is 0 and a percentage is undefined
+	DeviationPercent *float64 `json:"deviation_percent,omitempty" yaml:"deviation_percent,omitempty"`
+	// unit is the unit of the metric, used to format the range
+	unit string
+}
+
+// newExpectedRange returns the range low to high, in unit, with the deviation of value from
+// reference
+func newExpectedRange(low, high, value, reference float64, unit string) *ExpectedRange {
+	expected := &ExpectedRange{Low: low, High: high, unit: unit}
+	if reference != 0 {
+		deviation := (value - reference) / math.Abs(reference) * 100
+		expected.DeviationPercent = &deviation
+	}
+	return expected
+}
+
+// String formats the range for messages, such as "expected 10.0 ms to 20.0 ms, +35.0%"
+func (e *ExpectedRange) String() string {
+	s := fmt.Sprintf("expected %s to %s", formatValue(e.Low, e.unit), formatValue(e.High, e.unit))
+	if e.DeviationPercent != nil {
+		s += fmt.Sprintf(", %+.1f%%", *e.DeviationPercent)
+	}
+	return s
+}
+
+const (
+	// KindAnomaly marks a point that deviates from the baseline
+	KindAnomaly = "anomaly"
+	// KindForecast marks a series projected to cross its configured limit
+	KindForecast = "forecast"
+	// KindFlatline marks a normally varying series that reports a constant value
+	KindFlatline = "flatline"
+	// KindDelta marks a series whose current mean shifted abruptly since the previous cycle
+	KindDelta = "delta"
+	// KindRateLimit marks the summary of the notifications held back by the rate limit
+	KindRateLimit = "rate_limit"
+	// KindStorm marks the widespread anomaly alert standing in for the anomalies of an alert storm
+	KindStorm = "storm"
+	// KindCanary marks a canary population that deviates from its control
+	KindCanary = "canary"
+	// KindPeer marks a group of series, such as a region, that deviates from its peers
+	KindPeer = "peer"
+	// KindReplica marks a series that deviates from the other series of its group
+	KindReplica = "replica"
+	// KindHealth marks a service whose composite health score crossed its threshold
+	KindHealth = "health"
+
+	// SeverityWarning marks an anomaly above the Z-score threshold
+	SeverityWarning = "warning"
+	// SeverityCritical marks an anomaly above the critical Z-score threshold
+	SeverityCritical = "critical"
+)
+
 type SimpleAnomalyDetector struct {
-	metricsStats map[string]MetricStats
+	// mu guards the detector state. Detection cycles hold it for writing from start to end, so
+	// other goroutines, such as the admin API, only see the state between cycles. The exported
+	// methods reading or replacing the state outside cycles take it themselves; the others run
+	// within a cycle or before the detector is shared.
+	mu sync.RWMutex
+
+	metricsStats map[string]MetricStats // per metric type, over all of its series
 	initialised  bool
 	zScores      map[string]float64
+	scores       map[string]MetricScore
+	workers      int // maximum number of series scored concurrently, defaults to GOMAXPROCS
+
+	// seriesStats holds the baseline per series fingerprint, which series are scored against.
+	// It is nil for baselines restored from snapshots that predate series baselines.
+	seriesStats map[string]MetricStats
+	// minBaselinePoints is the number of baseline points a series needs to be scored, defaults to
+	// defaultMinBaselinePoints
+	minBaselinePoints int
+	// zeroStdDev sets how points are scored against a baseline without variance
+	zeroStdDev ZeroStdDevConfig
+	// referenced holds the metric types whose baseline comes from a reference environment. Their
+	// series are scored against the baseline of the whole metric, as the reference series have
+	// identities of their own.
+	referenced map[string]bool
+	// insufficient holds the metric type of every series skipped in the last detection cycle for
+	// lack of baseline data, by fingerprint
+	insufficient map[string]string
+
+	// highWaterMarks holds the end time of the newest point evaluated per series fingerprint, so
+	// overlapping recent windows do not score the same point twice
+	highWaterMarks map[string]time.Time
+	// seriesScores holds the peak Z-score of every series scored in the last detection cycle,
+	// highest absolute score first
+	seriesScores []SeriesScore
+	// latestPoints holds the newest point of every series with new points in the last cycle
+	latestPoints []SeriesPoint
+	// openEvents holds the start of the anomaly event still open per series fingerprint
+	openEvents map[string]time.Time
+	// projected holds the fingerprints of the series with an outstanding projected breach warning
+	projected map[string]bool
+	// flatlined holds the fingerprints of the series reported as stuck at a constant value
+	flatlined map[string]bool
+	// currentMeans and previousMeans hold the current mean of every series in the last cycle and
+	// in the cycle before it, by fingerprint, for the detection of deltas
+	currentMeans  map[string]float64
+	previousMeans map[string]float64
+	// canaries holds the fingerprints of the canary comparisons reported as deviating
+	canaries map[string]bool
+	// peerOutliers holds the fingerprints of the groups reported as deviating from their peers
+	peerOutliers map[string]bool
+	// replicaOutliers holds the fingerprints of the series reported as deviating from their group
+	replicaOutliers map[string]bool
+	// seriesTypes holds the metric type of every series in the baseline, by fingerprint, so the
+	// baseline of a single metric can be replaced. It is nil for restored baselines.
+	seriesTypes map[string]string
+	// exporter is set with an export location and writes the baselines and scores periodically
+	exporter *exporter
+	// health is set with health and scores the configured services every cycle
+	health *healthScorer
+	// trends is set with trends and keeps the daily history of the metrics
+	trends *trendHistory
+	// otlp is set with an OTLP configuration and pushes the scores of every cycle
+	otlp *otlpExporter
+	// conditions holds the CEL conditions of the metrics deciding which points are anomalous
+	conditions map[string]*alertCondition
+	// windows holds the fast and slow windows of the metrics scored on them instead of by point
+	windows map[string]*detectionWindows
+	// fixed holds the baseline of the metrics with fixed statistics in the configuration, which
+	// are scored against them rather than against fetched baselines
+	fixed map[string]MetricStats
+	// ingestion holds how far the recent window of each metric lags behind its ingestion delay
+	ingestion *ingestionDelays
+	// rollouts reads the deployments whose anomalies are held back or downgraded, nil without
+	// rollouts
+	rollouts *rolloutTracker
+	// backfill records the completed cycles and backfills those missed, nil without backfill
+	backfill *backfiller
+	// changes reads the changes around the anomalies, nil without changes
+	changes *changeCorrelator
+	// assets tags the anomalies with the labels of their resources and projects, nil without
+	// asset_inventory
+	assets *assetTagger
+	// traces looks up example traces of the anomalies of latency metrics, nil without traces
+	traces *traceLookup
+	// completeness tells the series with fewer points than expected in a cycle, nil without
+	// completeness
+	completeness *completenessChecker
+	// activeHours holds the metrics limited to active hours, which are not fetched outside them
+	activeHours map[string]*activeHours
+	// seasons holds the metrics with separate weekday and weekend baselines
+	seasons map[string]*season
+	// shared holds the baselines shared by several series, which are kept in seriesStats under
+	// the prefixed names of the baselines
+	shared sharedBaselines
+	// weekendMetricsStats and weekendSeriesStats hold the weekend baselines of the metrics with
+	// seasons, whose entries in metricsStats and seriesStats cover their weekdays only. They are
+	// nil for baselines restored from snapshots without weekend baselines.
+	weekendMetricsStats map[string]MetricStats
+	weekendSeriesStats  map[string]MetricStats
+	// transforms holds the metrics whose values are transformed before they enter the baseline
+	// and are scored
+	transforms map[string]*valueTransform
+	// injectedAt is the time of the last synthetic anomaly injected
+	injectedAt time.Time
+	// fetchFailures holds the metrics that could not be fetched in the last cycle, with their errors
+	fetchFailures map[string]error
+	// warmUp is how long after the baseline was initialised anomalies are only logged, and
+	// warmUpUntil the end of the current warm-up
+	warmUp      time.Duration
+	warmUpUntil time.Time
+	// levelShift configures when the series of level shifts are rebaselined, and events is the
+	// lifecycle of the reported anomalies telling which level shifts were acknowledged
+	levelShift LevelShiftConfig
+	events     *EventStore
+	// createdAt is when the baseline was computed, which snapshots keep when series are
+	// rebaselined so its age and warm-up are unchanged
+	createdAt time.Time
+	// clock tells the time the baseline is computed at
+	clock Clock
+	// quality sets when a series baseline is untrustworthy, over the baselineWindow it covers,
+	// and untrusted holds why each untrustworthy one is, by fingerprint. It is nil for restored
+	// baselines, which are not assessed.
+	quality        BaselineQualityConfig
+	baselineWindow time.Duration
+	untrusted      map[string]string
+}
+
+// MetricScore summarises the Z-scores of a metric in the last detection cycle
+type MetricScore struct {
+	Latest     float64   // Z-score of the most recent point
+	LatestTime time.Time // end time of the most recent point
+	Peak       float64   // Z-score with the largest absolute value
+	Points     int
 }
 
 type MetricStats struct {
 	mean          float64
 	stddev        float64
+	count         int64           // number of baseline points
+	digest        *quantileDigest // distribution of the baseline values of a metric, nil if unknown
 	currentMean   float64
 	currentStdDev float64
 }
 
-// LoadConfig loads the configuration from a YAML file
-func LoadConfig(filename string) (*Config, error) {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return nil, err
+// defaultMinBaselinePoints is the number of baseline points a series needs by default
+const defaultMinBaselinePoints = 30
+
+// newDetector returns a detector configured by config, without a baseline
+func newDetector(config *Config) *SimpleAnomalyDetector {
+	detector := &SimpleAnomalyDetector{
+		workers:           config.DetectionWorkers,
+		minBaselinePoints: config.MinBaselinePoints,
+		zeroStdDev:        config.ZeroStdDev,
+		referenced:        config.referencedMetrics(),
+		fixed:             config.fixedBaselines(),
+		warmUp:            time.Duration(config.WarmUpMin) * time.Minute,
+		levelShift:        config.LevelShift,
+		quality:           config.BaselineQuality.withDefaults(),
+		clock:             config.timeSource(),
+		ingestion:         newIngestionDelays(config.IngestionDelay),
 	}
-	var config Config
-	err = yaml.Unmarshal(data, &config)
-	if err != nil {
-		return nil, err
+	start, end := config.baselineRange(config.now())
+	detector.baselineWindow = end.Sub(start)
+	// Validated when the configuration was loaded
+	detector.activeHours, _ = compileActiveHours(config.Metrics)
+	detector.conditions, _ = compileConditions(config.Metrics)
+	detector.windows = compileWindows(config.Metrics, config.ZScoreThreshold)
+	detector.seasons, _ = compileSeasons(config.Metrics)
+	detector.transforms, _ = compileTransforms(config.Metrics)
+	detector.shared = config.SharedBaselines
+	if config.Rollouts != nil {
+		detector.rollouts = newRolloutTracker(*config.Rollouts, config.ProjectID, config.Credentials)
+	}
+	if config.Backfill != nil {
+		detector.backfill = newBackfiller(*config.Backfill)
+	}
+	if config.Changes != nil {
+		detector.changes = newChangeCorrelator(*config.Changes, config.ProjectID, config.Credentials)
+	}
+	if config.AssetInventory != nil {
+		detector.assets = newAssetTagger(*config.AssetInventory, config.ProjectID, config.Credentials)
+	}
+	if config.Traces != nil {
+		detector.traces = newTraceLookup(*config.Traces, config.ProjectID, config.Credentials)
+	}
+	if config.Completeness != nil {
+		detector.completeness = newCompletenessChecker(*config.Completeness, config.Metrics, time.Duration(config.RecentDuration)*time.Minute)
 	}
-	return &config, nil
+	if config.Export != nil {
+		detector.exporter = newExporter(*config.Export)
+	}
+	if config.Health != nil {
+		detector.health = newHealthScorer(config)
+	}
+	if config.Trends != nil {
+		detector.trends = newTrendHistory(context.Background(), *config.Trends, config.store)
+	}
+	if config.OTLP != nil {
+		detector.otlp = newOTLPExporter(*config.OTLP, config.ProjectID)
+		detector.otlp.skew = config.skew
+	}
+	return detector
 }
 
 func (d *SimpleAnomalyDetector) GetBaseline(metrics []*monitoringpb.TimeSeries) {
-	log.Println("Initialising baseline...")
-
-	d.metricsStats = make(map[string]MetricStats)
-
-	for _, metric := range metrics {
-		metricType := metric.Metric.Type
-
-		var sum float64
-		var count float64
-		for _, point := range metric.Points {
-			value := point.Value.GetDoubleValue()
-			sum += value
-			count++
-		}
-		if count == 0 {
-			log.Printf("No data points for metric: %s. Skipping...\n", metricType)
-			continue
-		}
-		mean := sum / count
-
-		var sumOfSquares float64
-		for _, point := range metric.Points {
-			value := point.Value.GetDoubleValue()
-			deviation := value - mean
-			sumOfSquares += deviation * deviation
+	d.streamBaseline(func(add func(*monitoringpb.TimeSeries)) error {
+		for _, metric := range metrics {
+			add(metric)
 		}
-		stddev := math.Sqrt(sumOfSquares / count)
+		return nil
+	})
+}
 
-		d.metricsStats[metricType] = MetricStats{
-			mean:   mean,
-			stddev: stddev,
-		}
+// streamBaseline initialises the baseline from series handed over one at a time by fetch. Only
+// the running statistics are kept, so the raw points can be released as soon as they are added.
+func (d *SimpleAnomalyDetector) streamBaseline(fetch func(add func(*monitoringpb.TimeSeries)) error) error {
+	log.Println("Initialising baseline...")
 
-		log.Printf("Baseline for metric %s: Mean: %.2f, StdDev: %.2f\n", metricType, mean, stddev)
+	accumulator, err := d.accumulateBaseline(fetch)
+	if err != nil {
+		return err
 	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.installBaseline(accumulator)
 
 	d.initialised = true
+	d.createdAt = d.clock.Now()
+	d.startWarmUp(d.createdAt)
 	log.Println("Baseline initialised.")
+	return nil
+}
+
+// accumulateBaseline folds the series handed over by fetch into a new accumulator
+func (d *SimpleAnomalyDetector) accumulateBaseline(fetch func(add func(*monitoringpb.TimeSeries)) error) (*baselineAccumulator, error) {
+	accumulator := newBaselineAccumulator(d.seasons, d.transforms)
+	// Only a full baseline trains the shared baselines, over the series of all their metrics
+	accumulator.shared, accumulator.weekend.shared = d.shared, d.shared
+	if err := fetch(accumulator.add); err != nil {
+		return nil, err
+	}
+	return accumulator, nil
+}
+
+// installBaseline replaces every baseline with those of the accumulator, keeping the current
+// statistics of the metrics. The caller holds mu for writing.
+func (d *SimpleAnomalyDetector) installBaseline(accumulator *baselineAccumulator) {
+	previous := d.metricsStats
+	d.metricsStats = accumulator.metricsStats()
+	for metricType, stats := range d.metricsStats {
+		stats.currentMean, stats.currentStdDev = previous[metricType].currentMean, previous[metricType].currentStdDev
+		d.metricsStats[metricType] = stats
+	}
+	d.seriesStats = accumulator.seriesStats()
+	d.seriesTypes = accumulator.seriesTypes()
+	d.weekendMetricsStats, d.weekendSeriesStats = nil, nil
+	if len(d.seasons) > 0 {
+		d.weekendMetricsStats = accumulator.weekend.metricsStats()
+		d.weekendSeriesStats = accumulator.weekend.seriesStats()
+	}
+	d.applyFixedBaselines()
+	d.untrusted = d.assessBaselines(accumulator)
+	d.completeness.learn(accumulator)
 }
 
 func (d *SimpleAnomalyDetector) DetectAnomalies(metrics []*monitoringpb.TimeSeries, zScoreThreshold float64) ([]Anomaly, error) {
@@ -106,29 +487,134 @@ func (d *SimpleAnomalyDetector) DetectAnomalies(metrics []*monitoringpb.TimeSeri
 		return nil, errors.New("baseline not initialised")
 	}
 
-	var anomalies []Anomaly
-	d.zScores = make(map[string]float64)
-	for _, metric := range metrics {
-		metricType := metric.Metric.Type
-		stats, ok := d.metricsStats[metricType]
+	// Series are scored concurrently into their own result, so the workers only read the
+	// baseline stats and the shared maps are written after all of them have finished
+	if d.highWaterMarks == nil {
+		d.highWaterMarks = make(map[string]time.Time)
+	}
+	if d.openEvents == nil {
+		d.openEvents = make(map[string]time.Time)
+	}
+
+	results := make([]seriesResult, len(metrics))
+	workers := d.workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	semaphore := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	insufficient := make(map[string]string)
+	// completeness holds the share of the expected points of every incomplete series scored
+	completeness := make([]float64, len(metrics))
+	for i, metric := range metrics {
+		fingerprint := seriesFingerprint(metric)
+		baselineKey := d.baselineKey(metric, fingerprint)
+		stats, ok := d.baselineFor(metric.Metric.Type, baselineKey, newestPointTime(metric))
 		if !ok {
-			log.Printf("No baseline stats for metric: %s. Skipping...\n", metricType)
+			if _, seen := d.insufficient[fingerprint]; !seen {
+				log.Printf("Insufficient baseline data for series %s of metric %s (%d points, %d required). Skipping...\n",
+					fingerprint, metric.Metric.Type, stats.count, d.requiredBaselinePoints())
+			}
+			insufficient[fingerprint] = metric.Metric.Type
 			continue
 		}
-		log.Printf("Detecting anomalies for metric: %s...\n", metricType)
-		for _, point := range metric.Points {
-			value := point.Value.GetDoubleValue()
-			zScore := (value - stats.mean) / stats.stddev
-			d.zScores[fmt.Sprintf("%s at %s", metricType, point.Interval.EndTime.AsTime())] = zScore // Store zScore
-			if math.Abs(zScore) > zScoreThreshold {
-				anomaly := Anomaly{
-					MetricName: metricType,
-					Value:      value,
-					Timestamp:  point.Interval.EndTime.AsTime(),
-					Message:    fmt.Sprintf("Value deviates significantly from the mean (Z-score: %.2f)", zScore),
+		// The quality of a shared baseline is not assessed, only that of the series' own baselines
+		if reason, untrusted := d.untrusted[baselineKey]; untrusted && d.quality.SkipDetection {
+			if _, seen := d.insufficient[fingerprint]; !seen {
+				log.Printf("Untrustworthy baseline for series %s of metric %s (%s). Skipping...\n", fingerprint, metric.Metric.Type, reason)
+			}
+			insufficient[fingerprint] = metric.Metric.Type
+			continue
+		}
+		weight := 1.0
+		if ratio, expected, incomplete := d.completeness.check(metric, fingerprint); incomplete {
+			log.Printf("Incomplete data for series %s of metric %s in this cycle (%d of %d expected points)\n", fingerprint, metric.Metric.Type, len(metric.Points), expected)
+			switch d.completeness.config.Action {
+			case completenessSkip:
+				insufficient[fingerprint] = metric.Metric.Type
+				continue
+			case completenessDownWeight:
+				weight = ratio
+			}
+			completeness[i] = ratio
+		}
+		wg.Add(1)
+		semaphore <- struct{}{}
+		highWaterMark, openSince := d.highWaterMarks[fingerprint], d.openEvents[fingerprint]
+		go func(i int, metric *monitoringpb.TimeSeries, baselineKey string, weight float64, highWaterMark, openSince time.Time) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			baseline := func(t time.Time) MetricStats {
+				stats, _ := d.baselineFor(metric.Metric.Type, baselineKey, t)
+				// Widening the baseline scales the Z-scores of an incomplete series down
+				stats.stddev /= weight
+				return stats
+			}
+			results[i] = detectSeries(metric, baseline, d.transforms[metric.Metric.Type], d.zeroStdDev, zScoreThreshold, d.conditions[metric.Metric.Type], d.windows[metric.Metric.Type], highWaterMark, openSince)
+		}(i, metric, baselineKey, weight, highWaterMark, openSince)
+	}
+	wg.Wait()
+	d.insufficient = insufficient
+
+	// Metrics without new points keep the score summary of the last cycle that evaluated them
+	previousScores := d.scores
+	var anomalies []Anomaly
+	d.zScores = make(map[string]float64)
+	d.scores = make(map[string]MetricScore)
+	d.seriesScores = nil
+	d.latestPoints = nil
+	for i, result := range results {
+		if result.fingerprint == "" {
+			continue // not scored
+		}
+		if len(result.points) > 0 {
+			peak := result.points[0]
+			for _, point := range result.points[1:] {
+				if math.Abs(point.zScore) > math.Abs(peak.zScore) {
+					peak = point
 				}
-				anomalies = append(anomalies, anomaly)
 			}
+			labels := seriesLabels(metrics[i])
+			d.seriesScores = append(d.seriesScores, SeriesScore{
+				MetricName:  result.metricType,
+				Fingerprint: result.fingerprint,
+				Labels:      labels,
+				ZScore:      peak.zScore,
+				Timestamp:   peak.timestamp,
+			})
+			// The points are in time order
+			newest := result.points[len(result.points)-1]
+			d.latestPoints = append(d.latestPoints, SeriesPoint{
+				MetricName:  result.metricType,
+				Fingerprint: result.fingerprint,
+				Labels:      labels,
+				Value:       newest.value,
+				Unit:        metrics[i].Unit,
+				ZScore:      newest.zScore,
+				Timestamp:   newest.timestamp,
+			})
+		}
+		if result.openSince.IsZero() {
+			delete(d.openEvents, result.fingerprint)
+		} else {
+			d.openEvents[result.fingerprint] = result.openSince
+		}
+		for _, point := range result.points {
+			d.zScores[fmt.Sprintf("%s at %s", result.metricType, displayTime(point.timestamp))] = point.zScore // Store zScore
+			d.recordScore(result.metricType, point.timestamp, point.zScore)
+			if point.timestamp.After(d.highWaterMarks[result.fingerprint]) {
+				d.highWaterMarks[result.fingerprint] = point.timestamp
+			}
+		}
+		for j := range result.anomalies {
+			result.anomalies[j].Completeness = completeness[i]
+		}
+		anomalies = append(anomalies, result.anomalies...)
+	}
+	rankSeries(d.seriesScores)
+	for metricType, score := range previousScores {
+		if _, ok := d.scores[metricType]; !ok {
+			d.scores[metricType] = score
 		}
 	}
 
@@ -141,87 +627,627 @@ func (d *SimpleAnomalyDetector) DetectAnomalies(metrics []*monitoringpb.TimeSeri
 	return anomalies, nil
 }
 
+// baselineFor returns the baseline a series is scored against at time t, and false when the
+// series has too few baseline points to be scored reliably. Metrics with seasons are scored
+// against their weekend baseline at weekends. key is the fingerprint of the series, or the key
+// of its shared baseline from baselineKey.
+func (d *SimpleAnomalyDetector) baselineFor(metricType, key string, t time.Time) (MetricStats, bool) {
+	if _, ok := d.fixed[metricType]; ok {
+		return d.metricsStats[metricType], true
+	}
+	metricsStats, seriesStats := d.metricsStats, d.seriesStats
+	if season := d.seasons[metricType]; season != nil && d.weekendMetricsStats != nil && season.isWeekend(t) {
+		metricsStats, seriesStats = d.weekendMetricsStats, d.weekendSeriesStats
+	}
+	if d.referenced[metricType] {
+		stats := metricsStats[metricType]
+		return stats, stats.count >= int64(d.requiredBaselinePoints())
+	}
+	if seriesStats == nil {
+		// Restored from a snapshot without series baselines
+		stats, ok := metricsStats[metricType]
+		return stats, ok
+	}
+	stats := seriesStats[key]
+	return stats, stats.count >= int64(d.requiredBaselinePoints())
+}
+
+// newestPointTime returns the end time of the newest point of a series, zero if it has none
+func newestPointTime(metric *monitoringpb.TimeSeries) time.Time {
+	var newest time.Time
+	for _, point := range metric.Points {
+		if t := point.Interval.EndTime.AsTime(); t.After(newest) {
+			newest = t
+		}
+	}
+	return newest
+}
+
+// startWarmUp starts the warm-up of a baseline initialised at t, if one is configured
+func (d *SimpleAnomalyDetector) startWarmUp(t time.Time) {
+	if d.warmUp > 0 {
+		d.warmUpUntil = t.Add(d.warmUp)
+	}
+}
+
+// BaselinePercentile returns the percentile of the metric's baseline distribution its current
+// mean sits at, as a trend signal between anomalies, and false without a baseline. It is read off
+// the digest of the baseline values where there is one, and assumes them normally distributed
+// as the Z-scores do otherwise, for fixed baselines and snapshots written before digests.
+func (d *SimpleAnomalyDetector) BaselinePercentile(metricType string, t time.Time) (float64, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.baselinePercentile(metricType, t)
+}
+
+func (d *SimpleAnomalyDetector) baselinePercentile(metricType string, t time.Time) (float64, bool) {
+	stats, ok := d.metricsStats[metricType]
+	if !ok {
+		return 0, false
+	}
+	baseline := stats
+	if season := d.seasons[metricType]; season != nil && d.weekendMetricsStats != nil && season.isWeekend(t) {
+		baseline = d.weekendMetricsStats[metricType]
+	}
+	if baseline.count == 0 {
+		return 0, false
+	}
+	if baseline.digest != nil {
+		return 100 * baseline.digest.CDF(stats.currentMean), true
+	}
+	if baseline.stddev == 0 {
+		switch {
+		case stats.currentMean > baseline.mean:
+			return 100, true
+		case stats.currentMean < baseline.mean:
+			return 0, true
+		}
+		return 50, true
+	}
+	z := (stats.currentMean - baseline.mean) / baseline.stddev
+	return 50 * (1 + math.Erf(z/math.Sqrt2)), true
+}
+
+// formatPercentile words where a value sits in a distribution, such as "at the 97th percentile",
+// with the tails beyond the 1st and 99th percentiles worded as below and above them
+func formatPercentile(p float64) string {
+	switch {
+	case p < 0.5:
+		return "below the 1st percentile"
+	case p >= 99.5:
+		return "above the 99th percentile"
+	}
+	n := int(math.Round(p))
+	suffix := "th"
+	switch {
+	case n%100 >= 11 && n%100 <= 13:
+	case n%10 == 1:
+		suffix = "st"
+	case n%10 == 2:
+		suffix = "nd"
+	case n%10 == 3:
+		suffix = "rd"
+	}
+	return fmt.Sprintf("at the %d%s percentile", n, suffix)
+}
+
+func (d *SimpleAnomalyDetector) requiredBaselinePoints() int {
+	if d.minBaselinePoints > 0 {
+		return d.minBaselinePoints
+	}
+	return defaultMinBaselinePoints
+}
+
+// FetchFailures returns the metric types whose recent window could not be fetched in the last
+// detection cycle, which were skipped while the others were scored, with their errors
+func (d *SimpleAnomalyDetector) FetchFailures() map[string]string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	failures := make(map[string]string, len(d.fetchFailures))
+	for metricType, err := range d.fetchFailures {
+		failures[metricType] = redactError(err).Error()
+	}
+	return failures
+}
+
+// InsufficientData returns the metric types with series skipped in the last detection cycle
+// because their baseline had too few points
+func (d *SimpleAnomalyDetector) InsufficientData() []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.insufficientData()
+}
+
+func (d *SimpleAnomalyDetector) insufficientData() []string {
+	seen := make(map[string]bool)
+	var metricTypes []string
+	for _, metricType := range d.insufficient {
+		if !seen[metricType] {
+			seen[metricType] = true
+			metricTypes = append(metricTypes, metricType)
+		}
+	}
+	sort.Strings(metricTypes)
+	return metricTypes
+}
+
+// seriesResult holds the scores and anomalies of one series in a detection cycle
+type seriesResult struct {
+	metricType  string
+	fingerprint string
+	points      []scoredPoint
+	anomalies   []Anomaly
+	openSince   time.Time // start of the event open at the newest point, zero if none
+}
+
+type scoredPoint struct {
+	timestamp time.Time
+	value     float64
+	zScore    float64
+}
+
+// detectSeries scores the points of a series newer than its high-water mark against the baseline
+// at their time and merges contiguous anomalous points into events. Values are transformed
+// before they are scored, if the metric has a transform. Points are anomalous above the Z-score
+// threshold or, if the metric has one, when its condition matches, or with windows when the mean
+// of either window ending at them crosses its threshold. openSince is the start of an event still
+// open at the end of the previous cycle, if any.
+func detectSeries(metric *monitoringpb.TimeSeries, baseline func(time.Time) MetricStats, transform *valueTransform, zeroStdDev ZeroStdDevConfig, zScoreThreshold float64, condition *alertCondition, windows *detectionWindows, highWaterMark, openSince time.Time) seriesResult {
+	metricType := metric.Metric.Type
+	fingerprint := seriesFingerprint(metric)
+	result := seriesResult{metricType: metricType, fingerprint: fingerprint}
+	var labels map[string]string
+
+	log.Printf("Detecting anomalies for metric: %s...\n", metricType)
+
+	// Points already evaluated are still needed to classify the shape of new deviations
+	points := make([]*monitoringpb.Point, len(metric.Points))
+	copy(points, metric.Points)
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Interval.EndTime.AsTime().Before(points[j].Interval.EndTime.AsTime())
+	})
+	zScores := make([]float64, len(points))
+	for i, point := range points {
+		// Values outside the domain of the transform are not scored
+		if value, ok := transform.apply(pointValue(point)); ok {
+			zScores[i] = zeroStdDev.zScore(value, baseline(point.Interval.EndTime.AsTime()), zScoreThreshold)
+		}
+	}
+	anomalous := make([]bool, len(points))
+	if condition != nil {
+		labels = seriesLabels(metric)
+	}
+	// Events follow the Z-scores of the windows of a metric with windows, of the points otherwise
+	eventScores := zScores
+	var fast, slow []windowScore
+	if windows != nil {
+		fast, slow = windows.score(points, transform, baseline, zeroStdDev)
+		eventScores = make([]float64, len(points))
+	}
+	for i, point := range points {
+		switch {
+		case windows != nil:
+			anomalous[i] = fast[i].breaches() || slow[i].breaches()
+			eventScores[i] = breaching(fast[i], slow[i]).zScore
+		case condition != nil:
+			anomalous[i] = condition.matches(metricType, zScores[i], pointValue(point), labels, point.Interval.EndTime.AsTime())
+		default:
+			anomalous[i] = math.Abs(zScores[i]) > zScoreThreshold
+		}
+	}
+
+	for i, point := range points {
+		timestamp := point.Interval.EndTime.AsTime()
+		if timestamp.After(highWaterMark) {
+			result.points = append(result.points, scoredPoint{timestamp: timestamp, value: pointValue(point), zScore: zScores[i]})
+		}
+	}
+
+	// Contiguous anomalous points deviating in the same direction form one event. Events are
+	// found across the whole window, so an event evaluated before keeps its start, and reported
+	// again while it has new points.
+	var events []pointEvent
+	for i := range points {
+		if !anomalous[i] {
+			continue
+		}
+		if n := len(events); n > 0 && events[n-1].last == i-1 && (eventScores[i] > 0) == (eventScores[events[n-1].first] > 0) {
+			events[n-1].last = i
+			if math.Abs(eventScores[i]) > math.Abs(eventScores[events[n-1].peak]) {
+				events[n-1].peak = i
+			}
+			continue
+		}
+		events = append(events, pointEvent{first: i, last: i, peak: i})
+	}
+
+	for _, event := range events {
+		end := points[event.last].Interval.EndTime.AsTime()
+		start := points[event.first].Interval.EndTime.AsTime()
+		if event.first == 0 && !openSince.IsZero() && openSince.Before(start) {
+			// The event began before the oldest point of the window
+			start = openSince
+		}
+		if event.last == len(points)-1 {
+			result.openSince = start
+		}
+		if !end.After(highWaterMark) {
+			continue
+		}
+		if labels == nil {
+			labels = seriesLabels(metric)
+		}
+
+		value := pointValue(points[event.peak])
+		zScore := zScores[event.peak]
+		threshold, subject := zScoreThreshold, "Value"
+		if windows != nil {
+			// The peak of a window event is the mean of the window that breached
+			window := breaching(fast[event.peak], slow[event.peak])
+			value, zScore, threshold = window.mean, window.zScore, window.window.threshold
+			subject = "Mean of the " + window.window.describe()
+		}
+		deviation := classifyDeviation(eventScores, event.last, threshold)
+		stats := baseline(points[event.peak].Interval.EndTime.AsTime())
+		margin := zeroStdDev.margin(stats, threshold)
+		expected := transform.expectedRange(stats.mean, margin, value, metric.Unit)
+		count := event.last - event.first + 1
+		message := fmt.Sprintf("%s deviates significantly from the mean (Z-score: %.2f, %s, %s)",
+			subject, zScore, strings.ReplaceAll(deviation, "_", " "), expected)
+		if count > 1 {
+			message = fmt.Sprintf("%s deviated significantly from the mean for %s over %d points (peak Z-score: %.2f, %s, %s)",
+				subject, end.Sub(start), count, zScore, strings.ReplaceAll(deviation, "_", " "), expected)
+		}
+
+		result.anomalies = append(result.anomalies, Anomaly{
+			Kind:       KindAnomaly,
+			Type:       deviation,
+			ID:         anomalyID(fingerprint, start),
+			MetricName: metricType,
+			Value:      value,
+			Unit:       metric.Unit,
+			Timestamp:  start,
+			Message:    message,
+			ZScore:     zScore,
+			Severity:   SeverityWarning,
+
+			Fingerprint:       fingerprint,
+			SeriesFingerprint: fingerprint,
+			Labels:            labels,
+			Expected:          expected,
+
+			EndTime:         end,
+			PeakTime:        points[event.peak].Interval.EndTime.AsTime(),
+			DurationSeconds: end.Sub(start).Seconds(),
+			Points:          count,
+		})
+	}
+	return result
+}
+
+// pointEvent is a run of contiguous anomalous points, by index into the sorted points
+type pointEvent struct {
+	first, last, peak int
+}
+
+// recordScore folds a point's Z-score into the metric's score summary
+func (d *SimpleAnomalyDetector) recordScore(metricType string, pointTime time.Time, zScore float64) {
+	score := d.scores[metricType]
+	if score.Points == 0 || pointTime.After(score.LatestTime) {
+		score.Latest = zScore
+		score.LatestTime = pointTime
+	}
+	if score.Points == 0 || math.Abs(zScore) > math.Abs(score.Peak) {
+		score.Peak = zScore
+	}
+	score.Points++
+	d.scores[metricType] = score
+}
+
+// ResetHighWaterMarks makes the next detection cycle evaluate every point it is given again
+func (d *SimpleAnomalyDetector) ResetHighWaterMarks() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.highWaterMarks = nil
+}
+
+// Scores returns the score summary of every metric evaluated in the last detection cycle
+func (d *SimpleAnomalyDetector) Scores() map[string]MetricScore {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	scores := make(map[string]MetricScore, len(d.scores))
+	for metricType, score := range d.scores {
+		scores[metricType] = score
+	}
+	return scores
+}
+
+// Stats returns the baseline and current statistics of a metric, zero without a baseline
+func (d *SimpleAnomalyDetector) Stats(metricType string) MetricStats {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.metricsStats[metricType]
+}
+
+// LatestPoints returns the newest point of every series with new points in the last cycle
+func (d *SimpleAnomalyDetector) LatestPoints() []SeriesPoint {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.latestPoints
+}
+
 func (d *SimpleAnomalyDetector) UpdateCurrentStats(metrics []*monitoringpb.TimeSeries) {
 	for _, metric := range metrics {
 		metricType := metric.Metric.Type
+		// A couple of points would make misleading current statistics
+		if _, _, incomplete := d.completeness.check(metric, seriesFingerprint(metric)); incomplete {
+			continue
+		}
 
-		var sum float64
-		var count float64
+		var current RunningStats
+		transform := d.transforms[metricType]
 		for _, point := range metric.Points {
-			value := point.Value.GetDoubleValue()
-			sum += value
-			count++
+			if value, ok := transform.apply(pointValue(point)); ok {
+				current.Add(value)
+			}
 		}
-		if count == 0 {
+		if current.Count == 0 {
 			log.Printf("No data points for metric: %s in the current run. Skipping...\n", metricType)
 			continue
 		}
-		currentMean := sum / count
-
-		var sumOfSquares float64
-		for _, point := range metric.Points {
-			value := point.Value.GetDoubleValue()
-			deviation := value - currentMean
-			sumOfSquares += deviation * deviation
-		}
-		currentStdDev := math.Sqrt(sumOfSquares / count)
+		currentMean := current.Mean
+		currentStdDev := current.StdDev()
 
 		// Update the metric's statistics in the metricsStats map
 		stats := d.metricsStats[metricType]
 		stats.currentMean = currentMean
 		stats.currentStdDev = currentStdDev
 		d.metricsStats[metricType] = stats
+		d.recordCurrentMean(seriesFingerprint(metric), currentMean)
 
 		log.Printf("Current run statistics for metric %s updated. Mean: %.2f, StdDev: %.2f\n", metricType, currentMean, currentStdDev)
 	}
 }
 
 func main() {
-	log.Println("Loading configuration...")
-	config, err := LoadConfig("config.yaml")
-	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+	// Secrets of the notifier configurations are registered as they are loaded
+	log.SetOutput(redactingWriter{os.Stderr})
+
+	command := "run"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	if runningAsService() {
+		// Long-running commands report running once their baseline is initialised
+		runAsService(func() { runCommand(command, args) }, command == "run" || command == "serve")
+		return
 	}
+	runCommand(command, args)
+}
+
+// runCommand runs the command with its arguments
+func runCommand(command string, args []string) {
+	switch command {
+	case "run":
+		runDetector(args)
+	case "backtest":
+		runBacktest(args)
+	case "tune":
+		runTune(args)
+	case "check":
+		runCheck(args)
+	case "validate":
+		runValidate(args)
+	case "test-alert":
+		runTestAlert(args)
+	case "bench":
+		runBench(args)
+	case "cost-estimate":
+		runCostEstimate(args)
+	case "describe":
+		runDescribe(args)
+	case "explain":
+		runExplain(args)
+	case "serve":
+		runServer(args)
+	case "handler":
+		runHandler(args)
+	case "baseline":
+		runBaselineExport(args)
+	case "operator":
+		runOperator(args)
+	case "subscribe":
+		runSubscriber(args)
+	case "tui":
+		runTerminalUI(args)
+	case "silence":
+		runSilenceCommand(args, SilenceKindSilence)
+	case "ack":
+		runSilenceCommand(args, SilenceKindAck)
+	case "feedback":
+		runFeedbackCommand(args)
+	case "events":
+		runEventsCommand(args)
+	case "report":
+		runReport(args)
+	case "trends":
+		runTrends(args)
+	case "emulate":
+		runEmulator(args)
+	case "central":
+		runCentral(args)
+	default:
+		log.Fatalf("Unknown command: %s", command)
+	}
+}
 
-	// Set default baseline duration if not provided
-	if config.BaselineDuration == 0 {
-		config.BaselineDuration = 7
+// runDetector initialises the baseline and polls recent metrics until the process is stopped
+func runDetector(args []string) {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	configDir := fs.String("config-dir", "", "Directory of tenant configuration files, each detected independently")
+	credentials := addCredentialFlags(fs)
+	sharding := addShardFlags(fs)
+	tail := addTailFlags(fs)
+	fs.Parse(args)
+
+	if *configDir != "" {
+		if tail.Enabled {
+			log.Fatalf("The -tail flag cannot be combined with -config-dir")
+		}
+		runTenants(*configDir, *credentials, *sharding)
+		return
 	}
 
+	config := mustLoadConfig(*configPath)
+	var syncer *configSyncer
+	if config.ConfigSync != nil {
+		config, syncer = mustSyncConfig(config)
+	}
+	config.Credentials.override(*credentials)
+	mustDiscoverWorkloads(config)
+	if tail.Enabled {
+		runTail(config, *tail)
+		return
+	}
+	router := mustCreateRouter(config)
+	mustSelectShard(config, *sharding)
+	client, detector := mustStartDetector(config)
+	detector.events = router.Events()
+
+	// The detector stops on SIGINT or SIGTERM, or to restart on a configuration applied by
+	// config_sync, once its cycles in progress have completed
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	var restart atomic.Bool
+	if syncer != nil {
+		go syncer.watch(ctx, client, router, func() {
+			restart.Store(true)
+			stop()
+		})
+	}
+	reportBackfill(client, config, detector, router)
+	superviseService(config.timeSource(), config.maxCycleAge(), fmt.Sprintf("Detecting %d metrics in project %s", len(config.Metrics), config.ProjectID), router)
+
+	// Metrics with different polling intervals share the detector
+	var mu sync.Mutex
+	runSchedules(ctx, config, func(metrics []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		processMetrics(client, config, detector, router, metrics)
+	})
+	shutdownDetector(config, detector, router)
+	if restart.Load() {
+		restartProcess()
+	}
+}
+
+// shutdownTimeout bounds how long a stopping detector takes to save its state
+const shutdownTimeout = 30 * time.Second
+
+// shutdownDetector saves the state of a detector whose cycles have stopped: its baseline, to a
+// durable store, and the events and silences of its router, which gives up its leader lease
+func shutdownDetector(config *Config, detector *SimpleAnomalyDetector, router *Router) {
+	log.Println("Shutting down the detector...")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if store, key := config.baselineStore(); store.Durable() {
+		if err := saveBaseline(ctx, store, key, detector.Snapshot()); err != nil {
+			log.Printf("Could not save the baseline: %v", err)
+		}
+	}
+	if err := router.Close(ctx); err != nil {
+		log.Printf("Could not close the router: %v", err)
+	}
+}
+
+// mustStartDetector creates the monitoring client and initialises the baseline, exiting on failure
+func mustStartDetector(config *Config) (*monitoring.MetricClient, *SimpleAnomalyDetector) {
+	client := mustCreateClient(config.Credentials, config.MonitoringAPI)
+	mustValidateFilters(client, config)
+
+	detector, err := startBaseline(context.Background(), client, config)
+	if err != nil {
+		log.Fatalf("Failed to initialise baseline: %v", err)
+	}
+	return client, detector
+}
+
+// mustCreateClient creates the monitoring client, exiting on failure
+func mustCreateClient(credentials CredentialsConfig, api MonitoringAPIConfig) *monitoring.MetricClient {
 	log.Println("Creating monitoring client...")
-	client, err := monitoring.NewMetricClient(context.Background())
+	client, err := newMetricClient(credentials, api)
 	if err != nil {
 		log.Fatalf("Failed to create client: %v", err)
 	}
+	return client
+}
+
+// newMetricClient creates a monitoring client authenticated as configured by credentials and
+// connected as configured by api
+func newMetricClient(credentials CredentialsConfig, api MonitoringAPIConfig) (*monitoring.MetricClient, error) {
+	ctx := context.Background()
+	connection, err := api.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	if api.Replay != "" || api.Insecure {
+		// Replayed and emulated responses need no credentials
+		return monitoring.NewMetricClient(ctx, connection...)
+	}
+	opts, err := credentials.clientOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return monitoring.NewMetricClient(ctx, append(opts, connection...)...)
+}
 
+// buildBaseline fetches the historical window and returns a detector initialised from it.
+// Metrics with a fixed baseline are not fetched.
+func buildBaseline(client *monitoring.MetricClient, config *Config) (*SimpleAnomalyDetector, error) {
 	log.Println("Fetching historical metrics...")
-	historicalMetrics, err := fetchHistoricalMetrics(client, config.ProjectID, config.Metrics, config.BaselineDuration, config.Filters)
+	detector := newDetector(config)
+	err := detector.streamBaseline(func(add func(*monitoringpb.TimeSeries)) error {
+		return streamHistoricalMetrics(client, config, config.fetchedBaselineMetrics(), add)
+	})
 	if err != nil {
-		log.Fatalf("Failed to fetch historical metrics: %v", err)
+		return nil, err
 	}
+	return detector, nil
+}
 
-	detector := &SimpleAnomalyDetector{}
-	detector.GetBaseline(historicalMetrics)
-
-	processMetrics(client, config, detector)
-
-	pollingInterval := time.Duration(config.PollingTime) * time.Second
-	ticker := time.NewTicker(pollingInterval)
-	log.Printf("Starting polling every %v...\n", pollingInterval)
-
-	for range ticker.C {
-		processMetrics(client, config, detector)
+func processMetrics(client *monitoring.MetricClient, config *Config, detector *SimpleAnomalyDetector, router *Router, metrics []string) {
+	anomalies, err := runCycle(client, config, detector, metrics)
+	if err != nil {
+		log.Printf("Detection cycle failed: %v", err)
+		router.ReportError(context.Background(), err)
+		return
 	}
+
+	router.ReportCycle(context.Background(), anomalies, detector.FetchFailures())
 }
 
-func processMetrics(client *monitoring.MetricClient, config *Config, detector *SimpleAnomalyDetector) {
+// runCycle fetches the recent window of the given metrics, updates the current statistics and
+// returns the anomalies detected against the baseline
+func runCycle(client *monitoring.MetricClient, config *Config, detector *SimpleAnomalyDetector, metrics []string) ([]Anomaly, error) {
+	detector.mu.Lock()
+	defer detector.mu.Unlock()
+
 	log.Println("Fetching recent metrics...")
+	metrics = activeMetrics(detector.activeHours, metrics, config.now())
+	metrics = config.flaggedMetrics(metrics)
 
-	// Now using the config object to get ProjectID, Metrics, and RecentDuration
-	recentMetrics, err := fetchRecentMetrics(client, config.ProjectID, config.Metrics, config.RecentDuration, config.Filters)
+	// Now using the config object to get ProjectID and RecentDuration
+	recentMetrics, failures, err := fetchRecentMetrics(client, config, detector.ingestion, metrics)
+	detector.fetchFailures = failures
 	if err != nil {
-		log.Printf("Failed to fetch recent metrics: %v", err)
-		return
+		return nil, fmt.Errorf("could not fetch recent metrics: %v", err)
+	}
+	for _, metric := range metrics {
+		if err, failed := failures[metric]; failed {
+			log.Printf("Could not fetch recent metrics of %s, skipped this cycle: %v", metric, err)
+		}
 	}
 
 	// Update the current run statistics
@@ -241,77 +1267,175 @@ func processMetrics(client *monitoring.MetricClient, config *Config, detector *S
 			stats.currentStdDev,
 		)
 	}
+	// Where each current mean sits in its baseline shows drift before it becomes an anomaly
+	now := config.now()
+	summarised := make(map[string]bool)
+	for _, metric := range recentMetrics {
+		metricType := metric.Metric.Type
+		if summarised[metricType] {
+			continue
+		}
+		summarised[metricType] = true
+		if percentile, ok := detector.baselinePercentile(metricType, now); ok {
+			log.Printf("Metric: %s, current mean is %s of the baseline\n", metricType, formatPercentile(percentile))
+		}
+	}
 
 	anomalies, err := detector.DetectAnomalies(recentMetrics, config.ZScoreThreshold)
 	if err != nil {
-		log.Printf("Failed to detect anomalies: %v", err)
-		return
+		return nil, fmt.Errorf("could not detect anomalies: %v", err)
+	}
+	canaries, err := compareCanaries(client, config, detector, metrics)
+	if err != nil {
+		return nil, fmt.Errorf("could not compare canaries: %v", err)
+	}
+	anomalies = append(anomalies, canaries...)
+	anomalies = append(anomalies, detector.ComparePeers(recentMetrics, config)...)
+	anomalies = append(anomalies, detector.CompareReplicas(recentMetrics, config)...)
+	config.classify(anomalies)
+	config.annotate(anomalies)
+	config.describeCosts(anomalies)
+	// A series rebaselined after a level shift stops alerting on its new level
+	anomalies, rebaselined := detector.rebaselineLevelShifts(recentMetrics, anomalies)
+	if store, key := config.baselineStore(); rebaselined > 0 && store.Durable() {
+		if err := saveBaseline(context.Background(), store, key, detector.snapshot()); err != nil {
+			log.Printf("Could not save the baseline after rebaselining %d series: %v", rebaselined, err)
+		}
+	}
+	logTopSeries(config, detector.topSeries(config.TopN))
+	if insufficient := detector.insufficientData(); len(insufficient) > 0 {
+		log.Printf("Series not scored for lack of baseline or complete data in metrics: %s\n", strings.Join(insufficient, ", "))
 	}
 
-	for _, anomaly := range anomalies {
-		fmt.Printf("Anomaly detected: %s at %s with value %.2f - %s\n",
-			anomaly.MetricName, anomaly.Timestamp, anomaly.Value, anomaly.Message)
+	// Projected breaches and stuck series are reported alongside the anomalies
+	warnings := append(detector.ForecastBreaches(recentMetrics, config), detector.DetectFlatlines(recentMetrics, config.Flatline)...)
+	warnings = append(warnings, detector.DetectDeltas(recentMetrics, config.Delta)...)
+	warnings = append(warnings, detector.health.score(context.Background(), detector.seriesScores, config.now())...)
+	config.annotate(warnings)
+	anomalies = append(anomalies, warnings...)
+	anomalies = config.flaggedDetections(anomalies)
+	config.attachContext(anomalies, recentMetrics)
+	config.attachLinks(context.Background(), anomalies, recentMetrics, config.now())
+	detector.rollouts.mark(context.Background(), client, anomalies, time.Duration(config.RecentDuration)*time.Minute, config.now())
+	// While the baseline warms up its anomalies are only logged
+	if config.now().Before(detector.warmUpUntil) && len(anomalies) > 0 {
+		printAnomalies(anomalies)
+		log.Printf("Warming up until %s, %d anomalies logged but not notified\n", detector.warmUpUntil.Format(time.RFC3339), len(anomalies))
+		anomalies = nil
 	}
+	detector.changes.attach(context.Background(), anomalies, config.now())
+	detector.assets.attach(context.Background(), anomalies, config.now())
+	detector.traces.attach(context.Background(), anomalies, config.now())
+	// Synthetic anomalies test delivery, so they are notified even while warming up
+	anomalies = append(anomalies, detector.inject(config, config.now())...)
+	if detector.exporter != nil {
+		detector.exporter.cycle(context.Background(), detector, config.now())
+	}
+	detector.trends.record(context.Background(), detector, recentMetrics, config.now())
+	if detector.otlp != nil {
+		detector.otlp.cycle(context.Background(), detector.latestPoints, anomalies, detector.fetchFailures, config.timings.snapshot(), config.now())
+	}
+	detector.backfill.completed(context.Background(), now)
+	return anomalies, nil
 }
 
-func fetchHistoricalMetrics(client *monitoring.MetricClient, projectID string, metrics []string, baselineDuration int, filters map[string]string) ([]*monitoringpb.TimeSeries, error) {
-	ctx := context.Background()
-	var allTimeSeries []*monitoringpb.TimeSeries
-
-	// Calculate the time range for the historical data
-	endTime := time.Now()
-	startTime := endTime.Add(-time.Duration(baselineDuration) * 24 * time.Hour)
+// streamHistoricalMetrics hands each historical series to fn as it is read from the API
+func streamHistoricalMetrics(client *monitoring.MetricClient, config *Config, metrics []string, fn func(*monitoringpb.TimeSeries)) error {
+	startTime, endTime := config.baselineRange(config.now())
+	return streamBaselineMetrics(client, config, metrics, startTime, endTime, fn)
+}
 
-	log.Printf("Fetching historical metrics for project %s from %s to %s...\n", projectID, startTime.Format(time.RFC3339), endTime.Format(time.RFC3339))
+// fetchRecentMetrics fetches the recent window of each metric on its own, so a metric that
+// cannot be fetched is left out with its error in failures rather than failing the others.
+// Rollups are fetched with their metric, so its series are read once. The window of a metric
+// ends its ingestion lag before now; the points after it are fetched to measure the delay, then
+// dropped. It only returns an error when every metric failed.
+func fetchRecentMetrics(client *monitoring.MetricClient, config *Config, delays *ingestionDelays, metrics []string) ([]*monitoringpb.TimeSeries, map[string]error, error) {
+	now := config.now()
+	recentDuration := time.Duration(config.RecentDuration) * time.Minute
 
+	requested := make(map[string]bool, len(metrics))
 	for _, metric := range metrics {
-		log.Printf("Fetching historical data for metric: %s...\n", metric)
-
-		filterString := fmt.Sprintf("metric.type=\"%s\"", metric)
-		if filter, exists := filters[metric]; exists {
-			filterString = fmt.Sprintf("%s AND %s", filterString, filter)
+		requested[metric] = true
+	}
+	batches := make(map[string][]string)
+	var order []string
+	for _, metric := range metrics {
+		batch := metric
+		if metricConfig, _ := config.MetricConfig(metric); metricConfig.rollup != nil && requested[metricConfig.rollup.parent] {
+			batch = metricConfig.rollup.parent
 		}
-
-		req := &monitoringpb.ListTimeSeriesRequest{
-			Name:   "projects/" + projectID,
-			Filter: filterString,
-			Interval: &monitoringpb.TimeInterval{
-				StartTime: &timestamppb.Timestamp{Seconds: startTime.Unix()},
-				EndTime:   &timestamppb.Timestamp{Seconds: endTime.Unix()},
-			},
+		if _, ok := batches[batch]; !ok {
+			order = append(order, batch)
 		}
+		batches[batch] = append(batches[batch], metric)
+	}
 
-		it := client.ListTimeSeries(ctx, req)
-		for {
-			ts, err := it.Next()
-			if err == iterator.Done {
-				break
+	var recent, fetched []*monitoringpb.TimeSeries
+	failures := make(map[string]error)
+	for _, batch := range order {
+		metricConfig, _ := config.MetricConfig(batch)
+		lag := delays.lag(metricConfig)
+		endTime := now.Add(-lag)
+		if lag > 0 {
+			log.Printf("Recent window of %s lags %s behind for its ingestion delay, ending at %s\n", batch, lag, endTime.Format(time.RFC3339))
+		}
+		if evaluated := metricConfig.evaluationEnd(endTime); evaluated.Before(endTime) {
+			endTime = evaluated
+			log.Printf("Recent window of %s ends at %s for its evaluation offset and alignment\n", batch, endTime.Format(time.RFC3339))
+		}
+		// Series of a metric failing part-way through are dropped with it and its rollups
+		var series []*monitoringpb.TimeSeries
+		// With clock_skew, the window extends past now to catch the points of a clock running behind
+		err := streamConfiguredMetrics(client, config, "recent", batches[batch], endTime.Add(-recentDuration), now.Add(config.skew.horizon()), func(ts *monitoringpb.TimeSeries) {
+			series = append(series, ts)
+		})
+		if err != nil {
+			for _, metric := range batches[batch] {
+				failures[metric] = err
 			}
-			if err != nil {
-				log.Printf("Failed to fetch time series data for metric %s: %v\n", metric, err)
-				return nil, fmt.Errorf("could not list time series: %v", err)
+			continue
+		}
+		delays.observe(metricConfig, series, now)
+		if config.skew != nil {
+			fetched = append(fetched, series...)
+		}
+		for _, ts := range series {
+			if ts = pointsUntil(ts, endTime); len(ts.Points) > 0 {
+				recent = append(recent, ts)
 			}
-			allTimeSeries = append(allTimeSeries, ts)
 		}
-		log.Printf("Fetched historical data for metric: %s\n", metric)
 	}
+	config.skew.observe(fetched, config.now())
+	if len(metrics) > 0 && len(failures) == len(metrics) {
+		return nil, failures, fmt.Errorf("every metric failed, first %s: %v", metrics[0], failures[metrics[0]])
+	}
+	return recent, failures, nil
+}
 
-	log.Println("Finished fetching historical metrics.")
+// fetchMetricsInRange lists the time series of each metric between startTime and endTime.
+// The kind is only used to describe the fetch in log messages.
+func fetchMetricsInRange(client *monitoring.MetricClient, kind string, projectID string, metrics []string, startTime, endTime time.Time, filters map[string]string, aggregations map[string]*monitoringpb.Aggregation) ([]*monitoringpb.TimeSeries, error) {
+	var allTimeSeries []*monitoringpb.TimeSeries
+	err := streamMetricsInRange(client, kind, projectID, metrics, startTime, endTime, filters, aggregations, func(ts *monitoringpb.TimeSeries) {
+		allTimeSeries = append(allTimeSeries, ts)
+	})
+	if err != nil {
+		return nil, err
+	}
 	return allTimeSeries, nil
 }
 
-func fetchRecentMetrics(client *monitoring.MetricClient, projectID string, metrics []string, recentDuration int, filters map[string]string) ([]*monitoringpb.TimeSeries, error) {
+// streamMetricsInRange hands each time series of the metrics between startTime and endTime to
+// fn as it is read from the API, without buffering the whole result. Metrics with an entry in
+// aggregations are aligned by it; the raw points are returned otherwise.
+func streamMetricsInRange(client *monitoring.MetricClient, kind string, projectID string, metrics []string, startTime, endTime time.Time, filters map[string]string, aggregations map[string]*monitoringpb.Aggregation, fn func(*monitoringpb.TimeSeries)) error {
 	ctx := context.Background()
-	var allTimeSeries []*monitoringpb.TimeSeries
 
-	// Define the time range for the recent data based on the RecentDuration config field
-	endTime := time.Now()
-	startTime := endTime.Add(-time.Duration(recentDuration) * time.Minute)
-
-	log.Printf("Fetching recent metrics for project %s from %s to %s...\n", projectID, startTime.Format(time.RFC3339), endTime.Format(time.RFC3339))
+	log.Printf("Fetching %s metrics for project %s from %s to %s...\n", kind, projectID, startTime.Format(time.RFC3339), endTime.Format(time.RFC3339))
 
 	for _, metric := range metrics {
-		log.Printf("Fetching recent data for metric: %s...\n", metric)
+		log.Printf("Fetching %s data for metric: %s...\n", kind, metric)
 
 		filterString := fmt.Sprintf("metric.type=\"%s\"", metric)
 		if filter, exists := filters[metric]; exists {
@@ -325,6 +1449,7 @@ func fetchRecentMetrics(client *monitoring.MetricClient, projectID string, metri
 				StartTime: &timestamppb.Timestamp{Seconds: startTime.Unix()},
 				EndTime:   &timestamppb.Timestamp{Seconds: endTime.Unix()},
 			},
+			Aggregation: aggregations[metric],
 		}
 
 		it := client.ListTimeSeries(ctx, req)
@@ -335,13 +1460,13 @@ func fetchRecentMetrics(client *monitoring.MetricClient, projectID string, metri
 			}
 			if err != nil {
 				log.Printf("Failed to fetch time series data for metric %s: %v\n", metric, err)
-				return nil, fmt.Errorf("could not list time series: %v", err)
+				return fmt.Errorf("could not list time series: %w", err)
 			}
-			allTimeSeries = append(allTimeSeries, ts)
+			fn(ts)
 		}
-		log.Printf("Fetched recent data for metric: %s\n", metric)
+		log.Printf("Fetched %s data for metric: %s\n", kind, metric)
 	}
 
-	log.Println("Finished fetching recent metrics.")
-	return allTimeSeries, nil
+	log.Printf("Finished fetching %s metrics.\n", kind)
+	return nil
 }
@@ -0,0 +1,814 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Notifier delivers detected anomalies to a destination
+type Notifier interface {
+	// Name identifies the notifier in logs and notifier references
+	Name() string
+	// Notify delivers the anomalies detected in one cycle
+	Notify(ctx context.Context, anomalies []Anomaly) error
+}
+
+// NotifierConfig configures one notifier. Exactly one of the destination blocks must be set.
+type NotifierConfig struct {
+	Name            string                         `yaml:"name"`         // defaults to the destination type
+	MinSeverity     string                         `yaml:"min_severity"` // warning (default) or critical, anomalies below it are not delivered
+	Schema          string                         `yaml:"schema"`       // version of the anomaly payload of JSON destinations, overrides anomaly_schema
+	Template        *MessageTemplateConfig         `yaml:"template"`     // wording of the anomalies in place of the built-in one, for destinations read by people
+	Flag            string                         `yaml:"flag"`         // feature flag the notifier only receives anomalies while on
+	Matchers        []string                       `yaml:"matchers"`     // label matchers the anomalies delivered must all match, e.g. team="payments"
+	File            *FileNotifierConfig            `yaml:"file"`
+	ErrorReporting  *ErrorReportingNotifierConfig  `yaml:"error_reporting"`
+	Grafana         *GrafanaNotifierConfig         `yaml:"grafana"`
+	OnCall          *OnCallNotifierConfig          `yaml:"oncall"`
+	Splunk          *SplunkNotifierConfig          `yaml:"splunk"`
+	Datadog         *DatadogNotifierConfig         `yaml:"datadog"`
+	Elasticsearch   *ElasticsearchNotifierConfig   `yaml:"elasticsearch"`
+	Kafka           *KafkaNotifierConfig           `yaml:"kafka"`
+	NATS            *NATSNotifierConfig            `yaml:"nats"`
+	SNS             *SNSNotifierConfig             `yaml:"sns"`
+	Statuspage      *StatuspageNotifierConfig      `yaml:"statuspage"`
+	ServiceNow      *ServiceNowNotifierConfig      `yaml:"servicenow"`
+	VictorOps       *VictorOpsNotifierConfig       `yaml:"victorops"`
+	Twilio          *TwilioNotifierConfig          `yaml:"twilio"`
+	CloudTasks      *CloudTasksNotifierConfig      `yaml:"cloud_tasks"`
+	Alertmanager    *AlertmanagerNotifierConfig    `yaml:"alertmanager"`
+	CloudMonitoring *CloudMonitoringNotifierConfig `yaml:"cloud_monitoring"`
+	BigQuery        *BigQueryNotifierConfig        `yaml:"bigquery"`
+	Central         *CentralNotifierConfig         `yaml:"central"`
+	Sheets          *SheetsNotifierConfig          `yaml:"sheets"`
+	Webhook         *WebhookNotifierConfig         `yaml:"webhook"`
+}
+
+// errorReporter is implemented by notifiers that are also told about the detector's own failures
+type errorReporter interface {
+	ReportError(ctx context.Context, err error) error
+}
+
+// recorder is implemented by notifiers that keep a record of detections rather than alert
+// anyone; they also receive anomalies suppressed by silences
+type recorder interface {
+	recordsSuppressed() bool
+}
+
+// cycleRecorder is implemented by notifiers that also record a summary of every detection cycle,
+// including those without anomalies
+type cycleRecorder interface {
+	RecordCycle(ctx context.Context, summary CycleSummary) error
+}
+
+// CycleSummary describes what a detection cycle found and what became of its anomalies
+type CycleSummary struct {
+	Time        time.Time      `json:"time"`
+	Anomalies   int            `json:"anomalies"`
+	Kinds       map[string]int `json:"kinds"`        // anomalies per kind
+	Metrics     int            `json:"metrics"`      // distinct metrics with anomalies
+	Silenced    int            `json:"silenced"`     // held back by a silence or acknowledgement
+	Suppressed  int            `json:"suppressed"`   // held back by a suppression or inhibition rule, active hours or a rollout
+	Collapsed   int            `json:"collapsed"`    // collapsed into the widespread anomaly alert of a storm
+	RateLimited int            `json:"rate_limited"` // held back by the rate limit
+	Notified    int            `json:"notified"`
+	PeakZScore  float64        `json:"peak_z_score"` // Z-score with the largest absolute value
+	// FetchFailures holds the metrics skipped because their recent window could not be fetched,
+	// with their errors
+	FetchFailures map[string]string `json:"fetch_failures,omitempty"`
+}
+
+// Router prints detected anomalies and delivers them to the configured notifiers
+type Router struct {
+	notifiers    []Notifier
+	silences     *SilenceStore
+	suppressions []suppressionRule
+	inhibitions  []inhibitionRule
+	activeHours  map[string]*activeHours
+	feedback     *FeedbackStore
+	recent       *recentAnomalies
+	// suppressRollouts holds back the anomalies marked with a rollout
+	suppressRollouts bool
+	// elector is set with leader election, and only the leader notifies
+	elector *leaderElector
+	// limiter is set with a rate limit and holds back notifications over it
+	limiter *rateLimiter
+	// remediator is set with remediation rules and runs them for the notified anomalies
+	remediator *remediator
+	// storm is set with storm levels and collapses the notifications of a storm into one
+	storm *stormDetector
+	// heartbeat is set with a dead man's switch and pinged by the leader after every cycle
+	heartbeat *heartbeat
+	// service is set when the detector runs as a service and tells its init system of the cycles
+	service *serviceSupervisor
+	// events tracks the lifecycle of the anomalies reported by the leader
+	events *EventStore
+	// minSeverity holds the severity floor of the notifiers that have one, by notifier name
+	minSeverity map[string]string
+	// matchers holds the label matchers of the notifiers that have them, by notifier name
+	matchers map[string][]labelMatcher
+	// flags evaluates the feature flags of the notifiers in notifierFlags, by notifier name
+	flags         *featureFlags
+	notifierFlags map[string]string
+	// clock tells the time the anomalies are reported at, the wall clock when nil
+	clock Clock
+}
+
+// now returns the time on the clock of the router
+func (r *Router) now() time.Time {
+	if r.clock == nil {
+		return time.Now()
+	}
+	return r.clock.Now()
+}
+
+// lifecycleNotifier is implemented by notifiers that update their alerts as the events of the
+// anomalies are acknowledged or resolved, rather than sending new ones
+type lifecycleNotifier interface {
+	transition(ctx context.Context, event Event) error
+}
+
+// NewRouter creates the notifiers described by the configuration and loads its silences and
+// anomaly feedback
+func NewRouter(ctx context.Context, config *Config) (*Router, error) {
+	silences, err := NewSilenceStore(ctx, config.SilencesPath, config.timeSource())
+	if err != nil {
+		return nil, fmt.Errorf("could not load silences: %v", err)
+	}
+	feedback, err := NewFeedbackStore(ctx, config.FeedbackPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not load feedback: %v", err)
+	}
+
+	events, err := NewEventStore(ctx, config.Lifecycle, config.timeSource())
+	if err != nil {
+		return nil, fmt.Errorf("could not load events: %v", err)
+	}
+
+	suppressions, err := compileSuppressions(config.Suppressions)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse suppressions: %v", err)
+	}
+
+	inhibitions, err := compileInhibitions(config.Inhibitions)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse inhibitions: %v", err)
+	}
+
+	remediations, err := compileRemediations(config.Remediations)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse remediations: %v", err)
+	}
+
+	activeHours, err := compileActiveHours(config.Metrics)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse active hours: %v", err)
+	}
+
+	router := &Router{silences: silences, suppressions: suppressions, inhibitions: inhibitions, activeHours: activeHours, feedback: feedback, events: events, recent: newRecentAnomalies(ctx, config.store), minSeverity: make(map[string]string), matchers: make(map[string][]labelMatcher), flags: config.flags, notifierFlags: make(map[string]string), clock: config.timeSource()}
+	router.suppressRollouts = config.Rollouts != nil && config.Rollouts.Action != rolloutDowngrade
+	if config.LeaderElection != nil {
+		router.elector, err = newLeaderElector(ctx, *config.LeaderElection, config.Tenant, config.Credentials)
+		if err != nil {
+			return nil, fmt.Errorf("could not set up leader election: %v", err)
+		}
+		router.elector.start()
+	}
+	if config.RateLimit.enabled() {
+		router.limiter = newRateLimiter(config.RateLimit, func() { router.flushRateLimit(context.Background()) })
+	}
+	if len(remediations) > 0 {
+		router.remediator = newRemediator(remediations, anomalySchema(config.AnomalySchema), config.Credentials)
+	}
+	if config.Storm.enabled() {
+		router.storm = newStormDetector(config.Storm)
+	}
+	if config.Heartbeat != nil {
+		router.heartbeat = newHeartbeat(*config.Heartbeat)
+	}
+	names := make(map[string]bool)
+	for i, notifierConfig := range config.Notifiers {
+		notifier, err := newNotifier(ctx, config, notifierConfig)
+		if err != nil {
+			return nil, fmt.Errorf("notifier %d: %v", i+1, err)
+		}
+		if names[notifier.Name()] {
+			return nil, fmt.Errorf("notifier %d: duplicate notifier name %s", i+1, notifier.Name())
+		}
+		names[notifier.Name()] = true
+		router.notifiers = append(router.notifiers, notifier)
+		if notifierConfig.MinSeverity != "" && notifierConfig.MinSeverity != SeverityWarning {
+			router.minSeverity[notifier.Name()] = notifierConfig.MinSeverity
+		}
+		if notifierConfig.Flag != "" {
+			router.notifierFlags[notifier.Name()] = notifierConfig.Flag
+		}
+		for _, matcher := range notifierConfig.Matchers {
+			m, err := parseLabelMatcher(matcher)
+			if err != nil {
+				return nil, fmt.Errorf("notifier %s: %v", notifier.Name(), err)
+			}
+			router.matchers[notifier.Name()] = append(router.matchers[notifier.Name()], m)
+		}
+	}
+	return router, nil
+}
+
+func newNotifier(ctx context.Context, detectorConfig *Config, config NotifierConfig) (Notifier, error) {
+	registerSecrets(config)
+	if config.MinSeverity != "" && config.MinSeverity != SeverityWarning && config.MinSeverity != SeverityCritical {
+		return nil, fmt.Errorf("unknown min_severity %s", config.MinSeverity)
+	}
+	if err := validateAnomalySchema(config.Schema); err != nil {
+		return nil, err
+	}
+	schema := detectorConfig.anomalySchema(config)
+
+	var notifiers []Notifier
+	if config.File != nil {
+		notifiers = append(notifiers, newFileNotifier(notifierName(config, "file"), *config.File, schema))
+	}
+	if config.ErrorReporting != nil {
+		notifier, err := newErrorReportingNotifier(ctx, notifierName(config, "error_reporting"), detectorConfig.ProjectID, *config.ErrorReporting)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.Grafana != nil {
+		notifier, err := newGrafanaNotifier(notifierName(config, "grafana"), *config.Grafana)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.OnCall != nil {
+		notifier, err := newOnCallNotifier(notifierName(config, "oncall"), *config.OnCall)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.Splunk != nil {
+		notifier, err := newSplunkNotifier(notifierName(config, "splunk"), *config.Splunk, schema)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.Datadog != nil {
+		notifier, err := newDatadogNotifier(notifierName(config, "datadog"), *config.Datadog)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.Elasticsearch != nil {
+		notifier, err := newElasticsearchNotifier(notifierName(config, "elasticsearch"), *config.Elasticsearch, schema)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.Kafka != nil {
+		notifier, err := newKafkaNotifier(notifierName(config, "kafka"), *config.Kafka, schema)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.NATS != nil {
+		notifier, err := newNATSNotifier(notifierName(config, "nats"), *config.NATS, schema)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.SNS != nil {
+		notifier, err := newSNSNotifier(notifierName(config, "sns"), *config.SNS, schema)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.Statuspage != nil {
+		notifier, err := newStatuspageNotifier(notifierName(config, "statuspage"), detectorConfig, *config.Statuspage)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.ServiceNow != nil {
+		notifier, err := newServiceNowNotifier(notifierName(config, "servicenow"), *config.ServiceNow)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.VictorOps != nil {
+		notifier, err := newVictorOpsNotifier(notifierName(config, "victorops"), *config.VictorOps)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.Twilio != nil {
+		notifier, err := newTwilioNotifier(notifierName(config, "twilio"), *config.Twilio)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.CloudTasks != nil {
+		notifier, err := newCloudTasksNotifier(ctx, notifierName(config, "cloud_tasks"), detectorConfig.ProjectID, *config.CloudTasks, schema)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.Alertmanager != nil {
+		notifier, err := newAlertmanagerNotifier(notifierName(config, "alertmanager"), *config.Alertmanager)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.CloudMonitoring != nil {
+		notifier, err := newCloudMonitoringNotifier(ctx, notifierName(config, "cloud_monitoring"), detectorConfig.ProjectID, *config.CloudMonitoring)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.BigQuery != nil {
+		notifier, err := newBigQueryNotifier(ctx, notifierName(config, "bigquery"), detectorConfig.ProjectID, *config.BigQuery)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.Central != nil {
+		notifier, err := newCentralNotifier(notifierName(config, "central"), detectorConfig, *config.Central)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.Sheets != nil {
+		notifier, err := newSheetsNotifier(ctx, notifierName(config, "sheets"), *config.Sheets)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	if config.Webhook != nil {
+		notifier, err := newWebhookNotifier(notifierName(config, "webhook"), *config.Webhook, schema)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+
+	switch len(notifiers) {
+	case 0:
+		return nil, fmt.Errorf("no destination configured")
+	case 1:
+	default:
+		return nil, fmt.Errorf("only one destination may be configured per notifier")
+	}
+	if config.Template != nil {
+		templated, ok := notifiers[0].(templatedNotifier)
+		if !ok {
+			return nil, fmt.Errorf("template not supported by this destination")
+		}
+		t, err := compileMessageTemplate(*config.Template)
+		if err != nil {
+			return nil, err
+		}
+		if err := templated.setTemplate(t); err != nil {
+			return nil, err
+		}
+	}
+	return notifiers[0], nil
+}
+
+func notifierName(config NotifierConfig, destination string) string {
+	if config.Name != "" {
+		return config.Name
+	}
+	return destination
+}
+
+// mustCreateRouter creates the router for the configured notifiers, exiting on failure
+func mustCreateRouter(config *Config) *Router {
+	router, err := NewRouter(context.Background(), config)
+	if err != nil {
+		log.Fatalf("Failed to create notifiers: %v", err)
+	}
+	return router
+}
+
+// Subset returns a router delivering only to the named notifiers. No names selects all of them.
+func (r *Router) Subset(names []string) (*Router, error) {
+	if len(names) == 0 {
+		return r, nil
+	}
+
+	byName := make(map[string]Notifier)
+	for _, notifier := range r.notifiers {
+		byName[notifier.Name()] = notifier
+	}
+
+	// Everything but the notifiers is shared, so the subset keeps the leader election, limits and
+	// rules of the router
+	subset := *r
+	subset.notifiers = nil
+	for _, name := range names {
+		notifier, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown notifier %s", name)
+		}
+		subset.notifiers = append(subset.notifiers, notifier)
+	}
+	return &subset, nil
+}
+
+// Silences returns the silences applied by the router
+func (r *Router) Silences() *SilenceStore {
+	return r.silences
+}
+
+// Feedback returns the labels given to anomalies reported through the router
+func (r *Router) Feedback() *FeedbackStore {
+	return r.feedback
+}
+
+// Events returns the lifecycle of the anomalies reported through the router
+func (r *Router) Events() *EventStore {
+	return r.events
+}
+
+// Close delivers the pending rate limit summary, persists the events and silences of a router
+// whose cycles have stopped, and gives up its leader lease, if it holds it, for a standby replica
+// to take over right away
+func (r *Router) Close(ctx context.Context) error {
+	r.flushRateLimit(ctx)
+	var errs []error
+	if err := r.events.save(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if err := r.silences.save(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if r.elector != nil {
+		if err := r.elector.resign(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("could not release the leader lease: %v", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Acknowledge moves the open events of the acknowledged fingerprint to acknowledged and updates
+// the alerts of the lifecycle-aware notifiers
+func (r *Router) Acknowledge(ctx context.Context, ack Silence) error {
+	events, err := r.events.Acknowledge(ctx, ack.Fingerprint, ack.CreatedBy, ack.Comment, r.now())
+	if err != nil {
+		return err
+	}
+	r.transition(ctx, events)
+	return nil
+}
+
+// ResolveEvent closes an event by hand and resolves its alerts in the lifecycle-aware notifiers
+func (r *Router) ResolveEvent(ctx context.Context, id, actor, comment string) (Event, error) {
+	event, err := r.events.Resolve(ctx, id, actor, comment, r.now())
+	if err != nil {
+		return Event{}, err
+	}
+	r.transition(ctx, []Event{event})
+	return event, nil
+}
+
+// transition tells the lifecycle-aware notifiers about events acknowledged or resolved. Opened
+// events reach them as anomalies.
+func (r *Router) transition(ctx context.Context, events []Event) {
+	if !r.leading() {
+		return
+	}
+	for _, event := range events {
+		if event.State == EventOpen {
+			continue
+		}
+		for _, notifier := range r.notifiers {
+			if lifecycle, ok := notifier.(lifecycleNotifier); ok {
+				if err := lifecycle.transition(ctx, event); err != nil {
+					log.Printf("Notifier %s could not update the alert of event %s: %v", notifier.Name(), event.ID, err)
+				}
+			}
+		}
+	}
+}
+
+// recentAnomaly returns a recently reported anomaly by its ID
+func (r *Router) recentAnomaly(id string) (Anomaly, bool) {
+	return r.recent.get(id)
+}
+
+// Report prints the anomalies to stdout and delivers them to every notifier. Silenced anomalies,
+// those matching a suppression rule, inhibited by an open anomaly or outside the active hours
+// of their metric and those over the rate limit only reach recording notifiers; the latter are
+// announced by a summary instead.
+// Notifiers with a min_severity only receive the anomalies of at least that severity.
+// A failing notifier is logged and does not prevent delivery to the others.
+func (r *Router) Report(ctx context.Context, anomalies []Anomaly) {
+	r.report(ctx, anomalies, nil)
+}
+
+// ReportCycle is Report for the anomalies of a detection cycle, recording the metrics the cycle
+// could not fetch in its summary
+func (r *Router) ReportCycle(ctx context.Context, anomalies []Anomaly, fetchFailures map[string]string) {
+	if r.service != nil {
+		r.service.cycleSucceeded(r.now(), len(anomalies))
+	}
+	r.report(ctx, anomalies, fetchFailures)
+}
+
+// report is ReportCycle returning the number of notifiers that failed
+func (r *Router) report(ctx context.Context, anomalies []Anomaly, fetchFailures map[string]string) int {
+	printAnomalies(anomalies)
+	if len(anomalies) > 0 {
+		r.recent.add(ctx, anomalies)
+	}
+	if !r.leading() {
+		if len(anomalies) > 0 {
+			log.Printf("Standby replica, %d anomalies left to the leader to notify\n", len(anomalies))
+		}
+		return 0
+	}
+	defer r.resolveStale(ctx)
+
+	now := r.now()
+	if r.heartbeat != nil {
+		r.heartbeat.succeeded(ctx, now)
+	}
+	if r.events != nil {
+		r.events.observe(ctx, anomalies, now)
+		r.transition(ctx, r.events.resolveQuiet(ctx, now))
+	}
+	summary := newCycleSummary(anomalies, now)
+	if len(fetchFailures) > 0 {
+		summary.FetchFailures = fetchFailures
+	}
+	sources := r.inhibitionSources(anomalies)
+	var unsilenced []Anomaly
+	for _, anomaly := range anomalies {
+		if silence, ok := r.silences.Match(anomaly, now); ok {
+			log.Printf("Anomaly on %s (fingerprint %s) suppressed by %s %s\n", anomaly.MetricName, anomaly.Fingerprint, silence.Kind, silence.ID)
+			summary.Silenced++
+			continue
+		}
+		if rule, ok := r.suppressedBy(anomaly); ok {
+			log.Printf("Anomaly on %s (fingerprint %s) suppressed by rule %s\n", anomaly.MetricName, anomaly.Fingerprint, rule)
+			summary.Suppressed++
+			continue
+		}
+		if rule, source, ok := r.inhibitedBy(anomaly, sources); ok {
+			log.Printf("Anomaly on %s (fingerprint %s) inhibited by rule %s while %s on %s is open\n", anomaly.MetricName, anomaly.Fingerprint, rule, source.ID, source.MetricName)
+			summary.Suppressed++
+			continue
+		}
+		if inactive(r.activeHours, anomaly.MetricName, anomaly.Timestamp) {
+			log.Printf("Anomaly on %s (fingerprint %s) suppressed outside the metric's active hours\n", anomaly.MetricName, anomaly.Fingerprint)
+			summary.Suppressed++
+			continue
+		}
+		if r.suppressRollouts && anomaly.Rollout != "" {
+			log.Printf("Anomaly on %s (fingerprint %s) suppressed during the %s\n", anomaly.MetricName, anomaly.Fingerprint, anomaly.Rollout)
+			summary.Suppressed++
+			continue
+		}
+		unsilenced = append(unsilenced, anomaly)
+	}
+	// Remediation runs before the storm collapse, so each anomaly of a storm is still remediated
+	for _, err := range r.remediator.run(ctx, unsilenced, now) {
+		r.ReportError(ctx, err)
+	}
+	// The storm detector and the limiter also run on quiet cycles, so the end of a storm is
+	// noticed and its summary is not delayed until the next anomaly
+	if r.storm != nil {
+		var storm bool
+		if unsilenced, storm = r.storm.collapse(unsilenced, now); storm {
+			summary.Collapsed = summary.Anomalies - summary.Silenced - summary.Suppressed
+		}
+	}
+	summary.Notified = len(unsilenced)
+	if r.limiter != nil {
+		unsilenced = r.limiter.limit(unsilenced, now)
+	}
+	if r.limiter != nil || r.storm != nil {
+		summary.Notified = 0
+		for _, anomaly := range unsilenced {
+			if anomaly.Kind != KindRateLimit && anomaly.Kind != KindStorm {
+				summary.Notified++
+			}
+		}
+	}
+	summary.RateLimited = len(anomalies) - summary.Silenced - summary.Suppressed - summary.Collapsed - summary.Notified
+
+	failed := r.deliver(ctx, unsilenced, anomalies, now)
+	for _, notifier := range r.notifiers {
+		if rec, ok := notifier.(cycleRecorder); ok {
+			if err := rec.RecordCycle(ctx, summary); err != nil {
+				log.Printf("Notifier %s could not record the cycle: %v", notifier.Name(), err)
+			}
+		}
+	}
+	return failed
+}
+
+// deliver sends the anomalies to every notifier within its severity floor, matchers and feature
+// flag, and all to the recording notifiers, returning the number of notifiers that failed
+func (r *Router) deliver(ctx context.Context, anomalies, all []Anomaly, now time.Time) int {
+	failed := 0
+	for _, notifier := range r.notifiers {
+		batch := anomalies
+		if rec, ok := notifier.(recorder); ok && rec.recordsSuppressed() {
+			batch = all
+		}
+		batch = atLeast(batch, r.minSeverity[notifier.Name()])
+		batch = matching(batch, r.matchers[notifier.Name()])
+		if len(batch) == 0 {
+			continue
+		}
+		if !r.flags.enabled(ctx, r.notifierFlags[notifier.Name()], now) {
+			log.Printf("Notifier %s turned off by feature flag %s, %d anomalies not delivered\n", notifier.Name(), r.notifierFlags[notifier.Name()], len(batch))
+			continue
+		}
+		if err := notifier.Notify(ctx, batch); err != nil {
+			log.Printf("Notifier %s failed: %v", notifier.Name(), err)
+			failed++
+		}
+	}
+	return failed
+}
+
+// flushRateLimit delivers the summary of the notifications held back by the rate limit, if any,
+// without waiting for the next report
+func (r *Router) flushRateLimit(ctx context.Context) {
+	if r.limiter == nil || !r.leading() {
+		return
+	}
+	now := r.now()
+	if summary, ok := r.limiter.flush(now); ok {
+		r.deliver(ctx, []Anomaly{summary}, nil, now)
+	}
+}
+
+// atLeast returns the anomalies of at least the given severity, all of them for warning or none
+func atLeast(anomalies []Anomaly, severity string) []Anomaly {
+	if severity != SeverityCritical {
+		return anomalies
+	}
+	var critical []Anomaly
+	for _, anomaly := range anomalies {
+		if anomaly.Severity == SeverityCritical {
+			critical = append(critical, anomaly)
+		}
+	}
+	return critical
+}
+
+// matching returns the anomalies matching all the matchers, and the rate limit and storm alerts,
+// which stand in for anomalies of any labels
+func matching(anomalies []Anomaly, matchers []labelMatcher) []Anomaly {
+	if len(matchers) == 0 {
+		return anomalies
+	}
+	var matched []Anomaly
+next:
+	for _, anomaly := range anomalies {
+		if anomaly.Kind != KindRateLimit && anomaly.Kind != KindStorm {
+			for _, matcher := range matchers {
+				if !matcher.matches(anomaly) {
+					continue next
+				}
+			}
+		}
+		matched = append(matched, anomaly)
+	}
+	return matched
+}
+
+// newCycleSummary counts the anomalies of a cycle, before any is held back
+func newCycleSummary(anomalies []Anomaly, now time.Time) CycleSummary {
+	summary := CycleSummary{Time: now, Anomalies: len(anomalies), Kinds: make(map[string]int)}
+	metrics := make(map[string]bool)
+	for _, anomaly := range anomalies {
+		summary.Kinds[anomaly.Kind]++
+		metrics[anomaly.MetricName] = true
+		if math.Abs(anomaly.ZScore) > math.Abs(summary.PeakZScore) {
+			summary.PeakZScore = anomaly.ZScore
+		}
+	}
+	summary.Metrics = len(metrics)
+	return summary
+}
+
+// suppressedBy returns the name of the first suppression rule matching the anomaly
+func (r *Router) suppressedBy(anomaly Anomaly) (string, bool) {
+	for _, rule := range r.suppressions {
+		if rule.matches(anomaly) {
+			return rule.name, true
+		}
+	}
+	return "", false
+}
+
+// leading reports whether this replica sends notifications, which it always does without
+// leader election
+func (r *Router) leading() bool {
+	return r.elector == nil || r.elector.isLeader()
+}
+
+// resolveStale lets resolving notifiers close the alerts of series that have gone quiet
+func (r *Router) resolveStale(ctx context.Context) {
+	now := r.now()
+	for _, notifier := range r.notifiers {
+		if res, ok := notifier.(resolver); ok {
+			if err := res.resolveStale(ctx, now); err != nil {
+				log.Printf("Notifier %s could not resolve alerts: %v", notifier.Name(), err)
+			}
+		}
+	}
+}
+
+// ReportError tells the notifiers that report errors about a failure of the detector itself
+func (r *Router) ReportError(ctx context.Context, err error) {
+	if r.service != nil {
+		r.service.cycleFailed(r.now(), redactError(err))
+	}
+	if !r.leading() {
+		return
+	}
+	err = redactError(err)
+	if r.heartbeat != nil {
+		r.heartbeat.failed(ctx, err)
+	}
+	for _, notifier := range r.notifiers {
+		if reporter, ok := notifier.(errorReporter); ok {
+			if reportErr := reporter.ReportError(ctx, err); reportErr != nil {
+				log.Printf("Notifier %s could not report error: %v", notifier.Name(), reportErr)
+			}
+		}
+	}
+}
+
+// printAnomalies prints the detected anomalies to stdout
+func printAnomalies(anomalies []Anomaly) {
+	for _, anomaly := range anomalies {
+		fmt.Printf("Anomaly detected: %s on %s at %s with value %s - %s [%s] (id %s)%s%s\n",
+			anomaly.displayName(), anomaly.resource(), displayTime(anomaly.Timestamp), anomaly.formattedValue(), anomaly.Message, anomaly.Severity, anomaly.ID, anomaly.links(), anomaly.contextSummary())
+	}
+}
+
+// postJSON sends payload as a JSON POST request, treating any non-2xx response as an error
+func postJSON(ctx context.Context, client *http.Client, url string, header http.Header, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	return postBody(ctx, client, url, header, "application/json", body)
+}
+
+// postBody sends body as a POST request, treating any non-2xx response as an error
+func postBody(ctx context.Context, client *http.Client, url string, header http.Header, contentType string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// AlertmanagerNotifierConfig posts anomalies to a Prometheus Alertmanager through its v2 API
+type AlertmanagerNotifierConfig struct {
+	URL             string            `yaml:"url"`                        // base URL, e.g. http://alertmanager.monitoring:9093
+	AlertName       string            `yaml:"alert_name"`                 // alertname label, defaults to GCPMetricAnomaly
+	Labels          map[string]string `yaml:"labels"`                     // added to every alert, e.g. team or environment
+	Username        string            `yaml:"username"`                   // optional basic authentication
+	Password        string            `yaml:"password" secret:"true"`     // optional basic authentication
+	BearerToken     string            `yaml:"bearer_token" secret:"true"` // optional, instead of basic authentication
+	GeneratorURL    string            `yaml:"generator_url"`              // optional link back to the detector or a dashboard
+	ResolveAfterMin int               `yaml:"resolve_after_min"`          // minutes without anomalies before Alertmanager resolves an alert, defaults to 10
+}
+
+// alertmanagerNotifier sends every anomaly as an alert labelled with its series, so Alertmanager
+// routes, groups, silences and inhibits it like any other alert. Alerts end resolve_after_min
+// after they are sent; an anomaly seen again extends its alert, and Alertmanager resolves those
+// that are not refreshed.
+type alertmanagerNotifier struct {
+	name     string
+	config   AlertmanagerNotifierConfig
+	client   *http.Client
+	template *messageTemplate // overrides the summary and description, its fields are added as annotations
+}
+
+type alertmanagerAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// invalidLabelChars matches the characters not allowed in Prometheus label names
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+func newAlertmanagerNotifier(name string, config AlertmanagerNotifierConfig) (*alertmanagerNotifier, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("no url configured")
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	if config.AlertName == "" {
+		config.AlertName = "GCPMetricAnomaly"
+	}
+	if config.ResolveAfterMin == 0 {
+		config.ResolveAfterMin = 10
+	}
+	return &alertmanagerNotifier{name: name, config: config, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (n *alertmanagerNotifier) Name() string {
+	return n.name
+}
+
+func (n *alertmanagerNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	now := time.Now()
+	alerts := make([]alertmanagerAlert, 0, len(anomalies))
+	for _, anomaly := range anomalies {
+		alerts = append(alerts, alertmanagerAlert{
+			Labels:       n.labels(anomaly),
+			Annotations:  n.annotations(anomaly),
+			StartsAt:     anomaly.Timestamp,
+			EndsAt:       now.Add(time.Duration(n.config.ResolveAfterMin) * time.Minute),
+			GeneratorURL: n.config.GeneratorURL,
+		})
+	}
+	return n.post(ctx, alerts)
+}
+
+// transition ends the alert of an event when it is resolved, instead of letting Alertmanager
+// resolve it once it is no longer refreshed
+func (n *alertmanagerNotifier) transition(ctx context.Context, event Event) error {
+	if event.State != EventResolved {
+		return nil
+	}
+	return n.post(ctx, []alertmanagerAlert{{
+		Labels:       n.labels(event.Anomaly),
+		Annotations:  n.annotations(event.Anomaly),
+		StartsAt:     event.Anomaly.Timestamp,
+		EndsAt:       event.latest().At,
+		GeneratorURL: n.config.GeneratorURL,
+	}})
+}
+
+func (n *alertmanagerNotifier) post(ctx context.Context, alerts []alertmanagerAlert) error {
+	header := http.Header{}
+	if n.config.BearerToken != "" {
+		header.Set("Authorization", "Bearer "+n.config.BearerToken)
+	} else if n.config.Username != "" {
+		header.Set("Authorization", "Basic "+basicAuth(n.config.Username, n.config.Password))
+	}
+	return postJSON(ctx, n.client, n.config.URL+"/api/v2/alerts", header, alerts)
+}
+
+// labels identify the alert: the labels of the series and the metric's static labels, then the
+// detector's own labels and those of the notifier, which take precedence. Label names are
+// sanitised to the Prometheus syntax.
+func (n *alertmanagerNotifier) labels(anomaly Anomaly) map[string]string {
+	labels := make(map[string]string)
+	for _, source := range []map[string]string{anomaly.Labels, anomaly.Metadata} {
+		for key, value := range source {
+			if key == "runbook_url" || key == "dashboard_url" {
+				continue // annotations, as they are not part of the alert's identity
+			}
+			labels[labelName(key)] = value
+		}
+	}
+	labels["alertname"] = n.config.AlertName
+	labels["metric"] = anomaly.MetricName
+	labels["severity"] = anomaly.Severity
+	labels["kind"] = anomaly.Kind
+	labels["fingerprint"] = anomaly.Fingerprint
+	if anomaly.Type != "" {
+		labels["type"] = anomaly.Type
+	}
+	for key, value := range n.config.Labels {
+		labels[labelName(key)] = value
+	}
+	return labels
+}
+
+func (n *alertmanagerNotifier) annotations(anomaly Anomaly) map[string]string {
+	annotations := map[string]string{
+		"summary":     n.template.title(anomaly, fmt.Sprintf("Anomaly on %s", anomaly.displayName())),
+		"description": n.template.body(anomaly, fmt.Sprintf("Value %s on %s - %s", anomaly.formattedValue(), anomaly.resource(), anomaly.Message)),
+		"value":       anomaly.formattedValue(),
+		"z_score":     fmt.Sprintf("%.2f", anomaly.ZScore),
+		"anomaly_id":  anomaly.ID,
+	}
+	for _, key := range []string{"runbook_url", "dashboard_url"} {
+		if url := anomaly.Metadata[key]; url != "" {
+			annotations[key] = url
+		}
+	}
+	if anomaly.ExplorerURL != "" {
+		annotations["explorer_url"] = anomaly.ExplorerURL
+	}
+	if anomaly.ChartURL != "" {
+		annotations["chart_url"] = anomaly.ChartURL
+	}
+	if anomaly.Context != nil {
+		annotations["sparkline"] = anomaly.Context.Sparkline
+	}
+	for _, name := range n.template.fieldNames() {
+		annotations[name] = n.template.field(anomaly, name)
+	}
+	return annotations
+}
+
+func (n *alertmanagerNotifier) setTemplate(t *messageTemplate) error {
+	n.template = t
+	return t.supports(true, true, true)
+}
+
+// labelName turns a label key into a valid Prometheus label name
+func labelName(key string) string {
+	name := invalidLabelChars.ReplaceAllString(key, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "_" + name
+	}
+	return name
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+// BigQueryNotifierConfig streams anomalies and a summary of every detection cycle into BigQuery
+type BigQueryNotifierConfig struct {
+	ProjectID      string `yaml:"project_id"`      // project of the dataset, defaults to the detector's project_id
+	Dataset        string `yaml:"dataset"`         // existing dataset the tables are created in
+	AnomaliesTable string `yaml:"anomalies_table"` // defaults to anomalies
+	CyclesTable    string `yaml:"cycles_table"`    // defaults to cycles
+}
+
+// bigQueryNotifier inserts a row per reported anomaly, including silenced ones, and a row per
+// detection cycle through the streaming API. The tables are created with their schema, partitioned
+// by day, the first time they are written to. Anomalies still going on are inserted again every
+// cycle they are reported in, as reported_at distinguishes the updates of an event.
+type bigQueryNotifier struct {
+	name   string
+	config BigQueryNotifierConfig
+	client *http.Client
+
+	// mu guards created, the tables known to exist
+	mu      sync.Mutex
+	created map[string]bool
+}
+
+// bigQueryField is a column of a table schema
+type bigQueryField struct {
+	Name   string          `json:"name"`
+	Type   string          `json:"type"`
+	Mode   string          `json:"mode,omitempty"`
+	Fields []bigQueryField `json:"fields,omitempty"`
+}
+
+type bigQueryRow struct {
+	InsertID string      `json:"insertId"`
+	JSON     interface{} `json:"json"`
+}
+
+type bigQueryInsertResponse struct {
+	InsertErrors []struct {
+		Index  int `json:"index"`
+		Errors []struct {
+			Reason  string `json:"reason"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"insertErrors"`
+}
+
+// bigQueryLabel is a key-value pair of a label map, as BigQuery has no map type
+type bigQueryLabel struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+var bigQueryLabelsField = []bigQueryField{{Name: "key", Type: "STRING"}, {Name: "value", Type: "STRING"}}
+
+var bigQueryAnomalySchema = []bigQueryField{
+	{Name: "reported_at", Type: "TIMESTAMP", Mode: "REQUIRED"},
+	{Name: "id", Type: "STRING", Mode: "REQUIRED"},
+	{Name: "kind", Type: "STRING"},
+	{Name: "type", Type: "STRING"},
+	{Name: "metric_type", Type: "STRING"},
+	{Name: "display_name", Type: "STRING"},
+	{Name: "fingerprint", Type: "STRING"},
+	{Name: "labels", Type: "RECORD", Mode: "REPEATED", Fields: bigQueryLabelsField},
+	{Name: "metadata", Type: "RECORD", Mode: "REPEATED", Fields: bigQueryLabelsField},
+	{Name: "value", Type: "FLOAT"},
+	{Name: "unit", Type: "STRING"},
+	{Name: "expected_low", Type: "FLOAT"},
+	{Name: "expected_high", Type: "FLOAT"},
+	{Name: "z_score", Type: "FLOAT"},
+	{Name: "severity", Type: "STRING"},
+	{Name: "message", Type: "STRING"},
+	{Name: "start_time", Type: "TIMESTAMP"},
+	{Name: "end_time", Type: "TIMESTAMP"},
+	{Name: "peak_time", Type: "TIMESTAMP"},
+	{Name: "duration_seconds", Type: "FLOAT"},
+	{Name: "points", Type: "INTEGER"},
+}
+
+var bigQueryCycleSchema = []bigQueryField{
+	{Name: "time", Type: "TIMESTAMP", Mode: "REQUIRED"},
+	{Name: "anomalies", Type: "INTEGER"},
+	{Name: "kinds", Type: "RECORD", Mode: "REPEATED", Fields: []bigQueryField{{Name: "kind", Type: "STRING"}, {Name: "count", Type: "INTEGER"}}},
+	{Name: "metrics", Type: "INTEGER"},
+	{Name: "silenced", Type: "INTEGER"},
+	{Name: "suppressed", Type: "INTEGER"},
+	{Name: "rate_limited", Type: "INTEGER"},
+	{Name: "notified", Type: "INTEGER"},
+	{Name: "peak_z_score", Type: "FLOAT"},
+	{Name: "fetch_failures", Type: "RECORD", Mode: "REPEATED", Fields: []bigQueryField{{Name: "metric_type", Type: "STRING"}, {Name: "error", Type: "STRING"}}},
+}
+
+func newBigQueryNotifier(ctx context.Context, name, projectID string, config BigQueryNotifierConfig) (*bigQueryNotifier, error) {
+	if config.Dataset == "" {
+		return nil, fmt.Errorf("no dataset configured")
+	}
+	if config.ProjectID == "" {
+		config.ProjectID = projectID
+	}
+	if config.AnomaliesTable == "" {
+		config.AnomaliesTable = "anomalies"
+	}
+	if config.CyclesTable == "" {
+		config.CyclesTable = "cycles"
+	}
+
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/bigquery")
+	if err != nil {
+		return nil, fmt.Errorf("could not create BigQuery client: %v", err)
+	}
+	return &bigQueryNotifier{name: name, config: config, client: client, created: make(map[string]bool)}, nil
+}
+
+func (n *bigQueryNotifier) Name() string {
+	return n.name
+}
+
+func (n *bigQueryNotifier) recordsSuppressed() bool {
+	return true
+}
+
+func (n *bigQueryNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	reportedAt := time.Now().UTC()
+	rows := make([]bigQueryRow, 0, len(anomalies))
+	for _, anomaly := range anomalies {
+		rows = append(rows, bigQueryRow{
+			InsertID: anomaly.ID + "-" + strconv.FormatInt(reportedAt.UnixNano(), 10),
+			JSON:     bigQueryAnomalyRow(anomaly, reportedAt),
+		})
+	}
+	return n.insert(ctx, n.config.AnomaliesTable, bigQueryAnomalySchema, "reported_at", rows)
+}
+
+func (n *bigQueryNotifier) RecordCycle(ctx context.Context, summary CycleSummary) error {
+	var kinds []map[string]interface{}
+	for kind, count := range summary.Kinds {
+		kinds = append(kinds, map[string]interface{}{"kind": kind, "count": count})
+	}
+	sort.Slice(kinds, func(i, j int) bool { return kinds[i]["kind"].(string) < kinds[j]["kind"].(string) })
+	row := map[string]interface{}{
+		"time":         summary.Time.UTC(),
+		"anomalies":    summary.Anomalies,
+		"kinds":        kinds,
+		"metrics":      summary.Metrics,
+		"silenced":     summary.Silenced,
+		"suppressed":   summary.Suppressed,
+		"rate_limited": summary.RateLimited,
+		"notified":     summary.Notified,
+		"peak_z_score": summary.PeakZScore,
+	}
+	if len(summary.FetchFailures) > 0 {
+		// Only set when there are failures, so tables created before the column keep accepting
+		// the rows of other cycles
+		var failures []map[string]interface{}
+		for metricType, err := range summary.FetchFailures {
+			failures = append(failures, map[string]interface{}{"metric_type": metricType, "error": err})
+		}
+		sort.Slice(failures, func(i, j int) bool { return failures[i]["metric_type"].(string) < failures[j]["metric_type"].(string) })
+		row["fetch_failures"] = failures
+	}
+	insertID := strconv.FormatInt(summary.Time.UnixNano(), 10)
+	return n.insert(ctx, n.config.CyclesTable, bigQueryCycleSchema, "time", []bigQueryRow{{InsertID: insertID, JSON: row}})
+}
+
+func bigQueryAnomalyRow(anomaly Anomaly, reportedAt time.Time) map[string]interface{} {
+	row := map[string]interface{}{
+		"reported_at":  reportedAt,
+		"id":           anomaly.ID,
+		"kind":         anomaly.Kind,
+		"type":         anomaly.Type,
+		"metric_type":  anomaly.MetricName,
+		"display_name": anomaly.displayName(),
+		"fingerprint":  anomaly.Fingerprint,
+		"labels":       bigQueryLabels(anomaly.Labels),
+		"metadata":     bigQueryLabels(anomaly.Metadata),
+		"value":        anomaly.Value,
+		"unit":         anomaly.Unit,
+		"z_score":      anomaly.ZScore,
+		"severity":     anomaly.Severity,
+		"message":      anomaly.Message,
+		"start_time":   anomaly.Timestamp.UTC(),
+		"points":       anomaly.Points,
+	}
+	if anomaly.Expected != nil {
+		row["expected_low"] = anomaly.Expected.Low
+		row["expected_high"] = anomaly.Expected.High
+	}
+	if !anomaly.EndTime.IsZero() {
+		row["end_time"] = anomaly.EndTime.UTC()
+		row["peak_time"] = anomaly.PeakTime.UTC()
+		row["duration_seconds"] = anomaly.DurationSeconds
+	}
+	return row
+}
+
+// bigQueryLabels turns a label map into key-value records, sorted by key
+func bigQueryLabels(labels map[string]string) []bigQueryLabel {
+	records := make([]bigQueryLabel, 0, len(labels))
+	for key, value := range labels {
+		records = append(records, bigQueryLabel{Key: key, Value: value})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].Key < records[j].Key })
+	return records
+}
+
+// insert streams the rows into the table, creating it first if needed. Rows rejected by BigQuery
+// are reported with the reason of the first one.
+func (n *bigQueryNotifier) insert(ctx context.Context, table string, schema []bigQueryField, partitionField string, rows []bigQueryRow) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	if err := n.ensureTable(ctx, table, schema, partitionField); err != nil {
+		return err
+	}
+
+	var response bigQueryInsertResponse
+	if _, err := n.call(ctx, http.MethodPost, n.tableURL(table)+"/insertAll", map[string]interface{}{"rows": rows}, &response); err != nil {
+		return fmt.Errorf("could not insert into %s: %v", table, err)
+	}
+	if len(response.InsertErrors) > 0 {
+		first := response.InsertErrors[0]
+		reason := "unknown error"
+		if len(first.Errors) > 0 {
+			reason = first.Errors[0].Reason + ": " + first.Errors[0].Message
+		}
+		return fmt.Errorf("%d of %d rows rejected by %s, row %d: %s", len(response.InsertErrors), len(rows), table, first.Index, reason)
+	}
+	return nil
+}
+
+// ensureTable creates the table with its schema unless it exists. An existing table is left as
+// it is, so columns added to it are kept.
+func (n *bigQueryNotifier) ensureTable(ctx context.Context, table string, schema []bigQueryField, partitionField string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.created[table] {
+		return nil
+	}
+
+	status, err := n.call(ctx, http.MethodGet, n.tableURL(table), nil, nil)
+	if status == http.StatusNotFound {
+		definition := map[string]interface{}{
+			"tableReference":   map[string]string{"projectId": n.config.ProjectID, "datasetId": n.config.Dataset, "tableId": table},
+			"schema":           map[string]interface{}{"fields": schema},
+			"timePartitioning": map[string]string{"type": "DAY", "field": partitionField},
+		}
+		tablesURL := fmt.Sprintf("https://bigquery.googleapis.com/bigquery/v2/projects/%s/datasets/%s/tables", url.PathEscape(n.config.ProjectID), url.PathEscape(n.config.Dataset))
+		status, err = n.call(ctx, http.MethodPost, tablesURL, definition, nil)
+		if status == http.StatusConflict {
+			err = nil // created concurrently by another replica
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("could not create table %s: %v", table, err)
+	}
+	n.created[table] = true
+	return nil
+}
+
+func (n *bigQueryNotifier) tableURL(table string) string {
+	return fmt.Sprintf("https://bigquery.googleapis.com/bigquery/v2/projects/%s/datasets/%s/tables/%s",
+		url.PathEscape(n.config.ProjectID), url.PathEscape(n.config.Dataset), url.PathEscape(table))
+}
+
+// call sends a request to the BigQuery API and decodes the response into out, if given. It
+// returns the status code along with an error for any non-2xx response.
+func (n *bigQueryNotifier) call(ctx context.Context, method, endpoint string, payload, out interface{}) (int, error) {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, body)
+	if err != nil {
+		return 0, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	if out != nil {
+		return resp.StatusCode, json.NewDecoder(resp.Body).Decode(out)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+// CloudMonitoringNotifierConfig writes anomalies to a custom metric, so Cloud Monitoring
+// dashboards can overlay when and where the detector fired on their charts
+type CloudMonitoringNotifierConfig struct {
+	ProjectID  string `yaml:"project_id"`  // defaults to the detector's project_id
+	MetricType string `yaml:"metric_type"` // defaults to custom.googleapis.com/gcp_anomaly_detector/anomaly
+}
+
+// cloudMonitoringNotifier writes a point per anomaly to a gauge metric of the global resource,
+// valued at the anomaly's Z-score and labelled with its metric and series. An event still going
+// on is written again every cycle it is reported in, so a chart of the metric shows the event's
+// window. Points are written at the time they are reported, as Cloud Monitoring only accepts
+// points newer than the last one of a series.
+type cloudMonitoringNotifier struct {
+	name   string
+	config CloudMonitoringNotifierConfig
+	client *http.Client
+
+	// mu guards described, which is set once the metric descriptor has been created
+	mu        sync.Mutex
+	described bool
+}
+
+// cloudMonitoringLabels are the labels of the anomaly metric
+var cloudMonitoringLabels = []struct{ key, description string }{
+	{"metric_type", "Type of the metric the anomaly was detected on"},
+	{"display_name", "Display name of the metric"},
+	{"fingerprint", "Fingerprint of the anomalous series"},
+	{"resource", "Resource and labels of the anomalous series"},
+	{"kind", "anomaly, forecast, flatline, canary or rate_limit"},
+	{"severity", "warning or critical"},
+}
+
+// cloudMonitoringBatchSize is the largest number of series CreateTimeSeries accepts at once
+const cloudMonitoringBatchSize = 200
+
+// maxLabelValueLength is the longest label value Cloud Monitoring accepts
+const maxLabelValueLength = 1024
+
+type monitoringTimeSeries struct {
+	Metric   monitoringMetric   `json:"metric"`
+	Resource monitoringResource `json:"resource"`
+	Points   []monitoringPoint  `json:"points"`
+}
+
+type monitoringMetric struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+}
+
+type monitoringResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+}
+
+type monitoringPoint struct {
+	Interval struct {
+		EndTime time.Time `json:"endTime"`
+	} `json:"interval"`
+	Value struct {
+		DoubleValue float64 `json:"doubleValue"`
+	} `json:"value"`
+}
+
+type monitoringLabelDescriptor struct {
+	Key         string `json:"key"`
+	ValueType   string `json:"valueType"`
+	Description string `json:"description"`
+}
+
+func newCloudMonitoringNotifier(ctx context.Context, name, projectID string, config CloudMonitoringNotifierConfig) (*cloudMonitoringNotifier, error) {
+	if config.ProjectID == "" {
+		config.ProjectID = projectID
+	}
+	if config.MetricType == "" {
+		config.MetricType = "custom.googleapis.com/gcp_anomaly_detector/anomaly"
+	}
+
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/monitoring.write")
+	if err != nil {
+		return nil, fmt.Errorf("could not create Cloud Monitoring client: %v", err)
+	}
+	return &cloudMonitoringNotifier{name: name, config: config, client: client}, nil
+}
+
+func (n *cloudMonitoringNotifier) Name() string {
+	return n.name
+}
+
+// recordsSuppressed makes silenced anomalies show on dashboards too, as nobody is alerted
+func (n *cloudMonitoringNotifier) recordsSuppressed() bool {
+	return true
+}
+
+func (n *cloudMonitoringNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	if len(anomalies) == 0 {
+		return nil
+	}
+	if err := n.describe(ctx); err != nil {
+		return err
+	}
+
+	// A request may only hold one point per series
+	now := time.Now()
+	var series []monitoringTimeSeries
+	seen := make(map[string]bool)
+	for _, anomaly := range anomalies {
+		timeSeries := n.timeSeries(anomaly, now)
+		key := formatLabels(timeSeries.Metric.Labels)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		series = append(series, timeSeries)
+	}
+
+	writeURL := fmt.Sprintf("https://monitoring.googleapis.com/v3/projects/%s/timeSeries", url.PathEscape(n.config.ProjectID))
+	for start := 0; start < len(series); start += cloudMonitoringBatchSize {
+		end := start + cloudMonitoringBatchSize
+		if end > len(series) {
+			end = len(series)
+		}
+		payload := map[string]interface{}{"timeSeries": series[start:end]}
+		if err := postJSON(ctx, n.client, writeURL, nil, payload); err != nil {
+			return fmt.Errorf("could not write anomaly points: %v", err)
+		}
+	}
+	return nil
+}
+
+// describe creates the descriptor of the anomaly metric, so its labels are documented rather
+// than inferred from the first point written. It is retried until it succeeds.
+func (n *cloudMonitoringNotifier) describe(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.described {
+		return nil
+	}
+
+	var labels []monitoringLabelDescriptor
+	for _, label := range cloudMonitoringLabels {
+		labels = append(labels, monitoringLabelDescriptor{Key: label.key, ValueType: "STRING", Description: label.description})
+	}
+	descriptor := map[string]interface{}{
+		"type":        n.config.MetricType,
+		"metricKind":  "GAUGE",
+		"valueType":   "DOUBLE",
+		"unit":        "1",
+		"displayName": "Detected anomalies",
+		"description": "Z-score of the anomalies reported by gcp-anomaly-detector, written every cycle an anomaly is reported in",
+		"labels":      labels,
+	}
+	descriptorURL := fmt.Sprintf("https://monitoring.googleapis.com/v3/projects/%s/metricDescriptors", url.PathEscape(n.config.ProjectID))
+	if err := postJSON(ctx, n.client, descriptorURL, nil, descriptor); err != nil {
+		return fmt.Errorf("could not create metric descriptor %s: %v", n.config.MetricType, err)
+	}
+	n.described = true
+	return nil
+}
+
+func (n *cloudMonitoringNotifier) timeSeries(anomaly Anomaly, now time.Time) monitoringTimeSeries {
+	labels := map[string]string{
+		"metric_type":  anomaly.MetricName,
+		"display_name": anomaly.displayName(),
+		"fingerprint":  anomaly.Fingerprint,
+		"resource":     anomaly.resource(),
+		"kind":         anomaly.Kind,
+		"severity":     anomaly.Severity,
+	}
+	for key, value := range labels {
+		if len(value) > maxLabelValueLength {
+			labels[key] = value[:maxLabelValueLength]
+		}
+	}
+
+	point := monitoringPoint{}
+	point.Interval.EndTime = now.UTC()
+	point.Value.DoubleValue = anomaly.ZScore
+	return monitoringTimeSeries{
+		Metric:   monitoringMetric{Type: n.config.MetricType, Labels: labels},
+		Resource: monitoringResource{Type: "global", Labels: map[string]string{"project_id": n.config.ProjectID}},
+		Points:   []monitoringPoint{point},
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+)
+
+// CloudTasksNotifierConfig enqueues anomalies as Cloud Tasks for a remediation service
+type CloudTasksNotifierConfig struct {
+	ProjectID           string `yaml:"project_id"` // defaults to the detector's project_id
+	Location            string `yaml:"location"`
+	Queue               string `yaml:"queue"`
+	URL                 string `yaml:"url"`                   // endpoint of the remediation service receiving the anomaly as JSON
+	ServiceAccountEmail string `yaml:"service_account_email"` // optional; requests carry an OIDC token of this account
+	Audience            string `yaml:"audience"`              // OIDC audience, defaults to url
+	MinSeverity         string `yaml:"min_severity"`          // warning (default) or critical
+}
+
+// cloudTasksNotifier creates one HTTP task per anomaly. Tasks are named after the anomaly ID, so
+// Cloud Tasks rejects an anomaly enqueued twice and the remediation runs once per anomaly.
+type cloudTasksNotifier struct {
+	name   string
+	config CloudTasksNotifierConfig
+	queue  string
+	client *http.Client
+	schema anomalySchema
+}
+
+type cloudTask struct {
+	Name        string          `json:"name"`
+	HTTPRequest cloudTaskTarget `json:"httpRequest"`
+}
+
+type cloudTaskTarget struct {
+	URL        string            `json:"url"`
+	HTTPMethod string            `json:"httpMethod"`
+	Headers    map[string]string `json:"headers"`
+	Body       []byte            `json:"body"` // base64 encoded by encoding/json
+	OIDCToken  *cloudTaskOIDC    `json:"oidcToken,omitempty"`
+}
+
+type cloudTaskOIDC struct {
+	ServiceAccountEmail string `json:"serviceAccountEmail"`
+	Audience            string `json:"audience,omitempty"`
+}
+
+func newCloudTasksNotifier(ctx context.Context, name, projectID string, config CloudTasksNotifierConfig, schema anomalySchema) (*cloudTasksNotifier, error) {
+	if config.ProjectID == "" {
+		config.ProjectID = projectID
+	}
+	if config.Location == "" || config.Queue == "" || config.URL == "" {
+		return nil, fmt.Errorf("location, queue and url are required")
+	}
+	if config.MinSeverity == "" {
+		config.MinSeverity = SeverityWarning
+	}
+	if config.MinSeverity != SeverityWarning && config.MinSeverity != SeverityCritical {
+		return nil, fmt.Errorf("unknown min_severity %s", config.MinSeverity)
+	}
+	if config.Audience == "" {
+		config.Audience = config.URL
+	}
+
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return nil, fmt.Errorf("could not create Cloud Tasks client: %v", err)
+	}
+	return &cloudTasksNotifier{
+		name:   name,
+		config: config,
+		queue:  fmt.Sprintf("projects/%s/locations/%s/queues/%s", config.ProjectID, config.Location, config.Queue),
+		client: client,
+		schema: schema,
+	}, nil
+}
+
+func (n *cloudTasksNotifier) Name() string {
+	return n.name
+}
+
+func (n *cloudTasksNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	for _, anomaly := range anomalies {
+		if n.config.MinSeverity == SeverityCritical && anomaly.Severity != SeverityCritical {
+			continue
+		}
+		if err := n.enqueue(ctx, anomaly); err != nil {
+			return fmt.Errorf("could not enqueue anomaly %s: %v", anomaly.ID, err)
+		}
+	}
+	return nil
+}
+
+func (n *cloudTasksNotifier) enqueue(ctx context.Context, anomaly Anomaly) error {
+	body, err := json.Marshal(n.schema.payload(anomaly))
+	if err != nil {
+		return err
+	}
+	task := cloudTask{
+		Name: n.queue + "/tasks/" + anomaly.ID,
+		HTTPRequest: cloudTaskTarget{
+			URL:        n.config.URL,
+			HTTPMethod: http.MethodPost,
+			Headers:    map[string]string{"Content-Type": "application/json"},
+			Body:       body,
+		},
+	}
+	if n.config.ServiceAccountEmail != "" {
+		task.HTTPRequest.OIDCToken = &cloudTaskOIDC{ServiceAccountEmail: n.config.ServiceAccountEmail, Audience: n.config.Audience}
+	}
+
+	data, err := json.Marshal(map[string]cloudTask{"task": task})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://cloudtasks.googleapis.com/v2/"+n.queue+"/tasks", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		// The task already exists, or existed recently: the anomaly was enqueued before
+		return nil
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// DatadogNotifierConfig posts anomalies to the Datadog Events API
+type DatadogNotifierConfig struct {
+	APIKey string   `yaml:"api_key" secret:"true"`
+	Site   string   `yaml:"site"` // Datadog site, defaults to datadoghq.com
+	Tags   []string `yaml:"tags"` // added to the tags derived from the series labels
+}
+
+// datadogNotifier creates one event per anomaly, tagged with the labels of the series and
+// aggregated by fingerprint so the events of a series roll up together
+type datadogNotifier struct {
+	name     string
+	config   DatadogNotifierConfig
+	client   *http.Client
+	template *messageTemplate // overrides the title and text, its fields are added as tags
+}
+
+type datadogEvent struct {
+	Title          string   `json:"title"`
+	Text           string   `json:"text"`
+	DateHappened   int64    `json:"date_happened"`
+	AlertType      string   `json:"alert_type"` // warning or error
+	Priority       string   `json:"priority"`
+	AggregationKey string   `json:"aggregation_key"`
+	SourceTypeName string   `json:"source_type_name"`
+	Tags           []string `json:"tags"`
+}
+
+func newDatadogNotifier(name string, config DatadogNotifierConfig) (*datadogNotifier, error) {
+	if config.APIKey == "" {
+		return nil, fmt.Errorf("no api_key configured")
+	}
+	if config.Site == "" {
+		config.Site = "datadoghq.com"
+	}
+	return &datadogNotifier{name: name, config: config, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (n *datadogNotifier) Name() string {
+	return n.name
+}
+
+func (n *datadogNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	header := http.Header{}
+	header.Set("DD-API-KEY", n.config.APIKey)
+	eventsURL := fmt.Sprintf("https://api.%s/api/v1/events", n.config.Site)
+
+	for _, anomaly := range anomalies {
+		alertType := "warning"
+		if anomaly.Severity == SeverityCritical {
+			alertType = "error"
+		}
+		event := datadogEvent{
+			Title: n.template.title(anomaly, fmt.Sprintf("[%s] Anomaly on %s", anomaly.Severity, anomaly.displayName())),
+			Text: n.template.body(anomaly, fmt.Sprintf("Value %s on %s - %s (fingerprint %s, id %s)%s%s",
+				anomaly.formattedValue(), anomaly.resource(), anomaly.Message, anomaly.Fingerprint, anomaly.ID, anomaly.links(), anomaly.contextSummary())),
+			DateHappened:   anomaly.Timestamp.Unix(),
+			AlertType:      alertType,
+			Priority:       "normal",
+			AggregationKey: anomaly.Fingerprint,
+			SourceTypeName: "gcp-anomaly-detector",
+			Tags:           n.tags(anomaly),
+		}
+		if err := postJSON(ctx, n.client, eventsURL, header, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *datadogNotifier) tags(anomaly Anomaly) []string {
+	tags := []string{"metric:" + anomaly.MetricName, "severity:" + anomaly.Severity}
+	if anomaly.Type != "" {
+		tags = append(tags, "type:"+anomaly.Type)
+	}
+	for _, labels := range []map[string]string{anomaly.Labels, anomaly.Metadata} {
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			tags = append(tags, key+":"+labels[key])
+		}
+	}
+	for _, name := range n.template.fieldNames() {
+		tags = append(tags, name+":"+n.template.field(anomaly, name))
+	}
+	return append(tags, n.config.Tags...)
+}
+
+func (n *datadogNotifier) setTemplate(t *messageTemplate) error {
+	n.template = t
+	return t.supports(true, true, true)
+}
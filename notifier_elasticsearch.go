@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ElasticsearchNotifierConfig bulk-indexes anomalies into Elasticsearch or OpenSearch
+type ElasticsearchNotifierConfig struct {
+	URL      string `yaml:"url"`      // base URL of the cluster
+	Index    string `yaml:"index"`    // index name; a Go time layout in braces is expanded from the anomaly time, defaults to gcp-anomalies-{2006.01.02}
+	Username string `yaml:"username"` // optional basic authentication
+	Password string `yaml:"password" secret:"true"`
+	APIKey   string `yaml:"api_key" secret:"true"` // optional Elasticsearch API key, instead of basic authentication
+}
+
+// elasticsearchNotifier writes every anomaly of a cycle, including silenced ones, with a single
+// bulk request. Documents are keyed by the anomaly ID, so replays overwrite rather than duplicate.
+type elasticsearchNotifier struct {
+	name   string
+	config ElasticsearchNotifierConfig
+	client *http.Client
+	schema anomalySchema
+}
+
+type bulkAction struct {
+	Index bulkTarget `json:"index"`
+}
+
+type bulkTarget struct {
+	Index string `json:"_index"`
+	ID    string `json:"_id"`
+}
+
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  *struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+func newElasticsearchNotifier(name string, config ElasticsearchNotifierConfig, schema anomalySchema) (*elasticsearchNotifier, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("no url configured")
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	if config.Index == "" {
+		config.Index = "gcp-anomalies-{2006.01.02}"
+	}
+	return &elasticsearchNotifier{name: name, config: config, client: &http.Client{Timeout: 30 * time.Second}, schema: schema}, nil
+}
+
+func (n *elasticsearchNotifier) Name() string {
+	return n.name
+}
+
+func (n *elasticsearchNotifier) recordsSuppressed() bool {
+	return true
+}
+
+func (n *elasticsearchNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, anomaly := range anomalies {
+		action := bulkAction{Index: bulkTarget{Index: expandIndex(n.config.Index, anomaly.Timestamp), ID: anomaly.ID}}
+		if err := encoder.Encode(action); err != nil {
+			return err
+		}
+		if err := encoder.Encode(n.schema.payload(anomaly)); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.config.URL+"/_bulk", &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	switch {
+	case n.config.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+n.config.APIKey)
+	case n.config.Username != "":
+		req.SetBasicAuth(n.config.Username, n.config.Password)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		if len(data) > 1024 {
+			data = data[:1024]
+		}
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	// A bulk request succeeds as a whole even when single documents are rejected
+	var result bulkResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("could not parse bulk response: %v", err)
+	}
+	if !result.Errors {
+		return nil
+	}
+	failed := 0
+	var firstError string
+	for _, item := range result.Items {
+		for _, outcome := range item {
+			if outcome.Error != nil {
+				failed++
+				if firstError == "" {
+					firstError = outcome.Error.Type + ": " + outcome.Error.Reason
+				}
+			}
+		}
+	}
+	return fmt.Errorf("%d of %d documents were rejected, first error: %s", failed, len(anomalies), firstError)
+}
+
+// expandIndex replaces a Go time layout in braces within the index pattern by the formatted time
+func expandIndex(pattern string, t time.Time) string {
+	start := strings.Index(pattern, "{")
+	end := strings.Index(pattern, "}")
+	if start < 0 || end < start {
+		return pattern
+	}
+	return pattern[:start] + t.UTC().Format(pattern[start+1:end]) + pattern[end+1:]
+}
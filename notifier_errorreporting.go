@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/oauth2/google"
+)
+
+const errorReportingScope = "https://www.googleapis.com/auth/cloud-platform"
+
+// ErrorReportingNotifierConfig reports anomalies and detector failures to Cloud Error Reporting
+type ErrorReportingNotifierConfig struct {
+	ProjectID   string `yaml:"project_id"`   // defaults to the detector's project_id
+	Service     string `yaml:"service"`      // defaults to gcp-anomaly-detector
+	Version     string `yaml:"version"`      // optional service version
+	MinSeverity string `yaml:"min_severity"` // warning or critical (default)
+}
+
+// errorReportingNotifier reports events through the Error Reporting API, so anomalies show up
+// next to application errors in the console. Error Reporting only accepts events with a stack
+// trace or a report location, so every event names the function that raised it.
+type errorReportingNotifier struct {
+	name     string
+	config   ErrorReportingNotifierConfig
+	client   *http.Client
+	template *messageTemplate // overrides the message of the anomaly events
+}
+
+type errorEvent struct {
+	ServiceContext errorServiceContext `json:"serviceContext"`
+	Message        string              `json:"message"`
+	Context        errorContext        `json:"context"`
+}
+
+type errorServiceContext struct {
+	Service string `json:"service"`
+	Version string `json:"version,omitempty"`
+}
+
+type errorContext struct {
+	ReportLocation errorReportLocation `json:"reportLocation"`
+}
+
+type errorReportLocation struct {
+	FilePath     string `json:"filePath"`
+	LineNumber   int    `json:"lineNumber"`
+	FunctionName string `json:"functionName"`
+}
+
+func newErrorReportingNotifier(ctx context.Context, name, projectID string, config ErrorReportingNotifierConfig) (*errorReportingNotifier, error) {
+	if config.ProjectID == "" {
+		config.ProjectID = projectID
+	}
+	if config.Service == "" {
+		config.Service = "gcp-anomaly-detector"
+	}
+	if config.MinSeverity == "" {
+		config.MinSeverity = SeverityCritical
+	}
+	if config.MinSeverity != SeverityWarning && config.MinSeverity != SeverityCritical {
+		return nil, fmt.Errorf("unknown min_severity %s", config.MinSeverity)
+	}
+
+	client, err := google.DefaultClient(ctx, errorReportingScope)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Error Reporting client: %v", err)
+	}
+	return &errorReportingNotifier{name: name, config: config, client: client}, nil
+}
+
+func (n *errorReportingNotifier) Name() string {
+	return n.name
+}
+
+func (n *errorReportingNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	for _, anomaly := range anomalies {
+		if n.config.MinSeverity == SeverityCritical && anomaly.Severity != SeverityCritical {
+			continue
+		}
+		message := n.template.body(anomaly, fmt.Sprintf("Anomaly detected: %s on %s at %s with value %s - %s [%s] (fingerprint %s, id %s)%s",
+			anomaly.displayName(), anomaly.resource(), displayTime(anomaly.Timestamp), anomaly.formattedValue(), anomaly.Message,
+			anomaly.Severity, anomaly.Fingerprint, anomaly.ID, anomaly.queryLinks()))
+		if err := n.report(ctx, message, "detectSeries"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *errorReportingNotifier) setTemplate(t *messageTemplate) error {
+	n.template = t
+	return t.supports(false, true, false)
+}
+
+func (n *errorReportingNotifier) ReportError(ctx context.Context, err error) error {
+	return n.report(ctx, fmt.Sprintf("Detection cycle failed: %v", err), "runCycle")
+}
+
+func (n *errorReportingNotifier) report(ctx context.Context, message, function string) error {
+	event := errorEvent{
+		ServiceContext: errorServiceContext{Service: n.config.Service, Version: n.config.Version},
+		Message:        message,
+		Context: errorContext{ReportLocation: errorReportLocation{
+			FilePath:     "main.go",
+			LineNumber:   1,
+			FunctionName: function,
+		}},
+	}
+	reportURL := fmt.Sprintf("https://clouderrorreporting.googleapis.com/v1beta1/projects/%s/events:report", url.PathEscape(n.config.ProjectID))
+	return postJSON(ctx, n.client, reportURL, nil, event)
+}
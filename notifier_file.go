@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FileNotifierConfig appends anomalies to a local file that is rotated by size
+type FileNotifierConfig struct {
+	Path       string `yaml:"path"`
+	Format     string `yaml:"format"`      // jsonl (default) or csv
+	MaxSizeMB  int    `yaml:"max_size_mb"` // defaults to 100
+	MaxBackups int    `yaml:"max_backups"` // rotated files kept as path.1 ... path.N, defaults to 5
+}
+
+var csvHeader = []string{"timestamp", "metric_name", "value", "message"}
+
+// fileNotifier writes one record per anomaly, so minimal deployments keep a durable log of
+// detections without a database
+type fileNotifier struct {
+	name   string
+	config FileNotifierConfig
+	schema anomalySchema
+
+	mu sync.Mutex
+}
+
+func newFileNotifier(name string, config FileNotifierConfig, schema anomalySchema) *fileNotifier {
+	if config.Format == "" {
+		config.Format = "jsonl"
+	}
+	if config.MaxSizeMB == 0 {
+		config.MaxSizeMB = 100
+	}
+	if config.MaxBackups == 0 {
+		config.MaxBackups = 5
+	}
+	return &fileNotifier{name: name, config: config, schema: schema}
+}
+
+func (n *fileNotifier) Name() string {
+	return n.name
+}
+
+func (n *fileNotifier) recordsSuppressed() bool {
+	return true
+}
+
+func (n *fileNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	if n.config.Path == "" {
+		return fmt.Errorf("no path configured")
+	}
+
+	var records bytes.Buffer
+	switch n.config.Format {
+	case "jsonl":
+		encoder := json.NewEncoder(&records)
+		for _, anomaly := range anomalies {
+			if err := encoder.Encode(n.schema.payload(anomaly)); err != nil {
+				return err
+			}
+		}
+	case "csv":
+		writer := csv.NewWriter(&records)
+		for _, anomaly := range anomalies {
+			writer.Write([]string{
+				anomaly.Timestamp.UTC().Format(time.RFC3339),
+				anomaly.MetricName,
+				strconv.FormatFloat(anomaly.Value, 'f', -1, 64),
+				anomaly.Message,
+				anomaly.ID,
+				anomaly.Fingerprint,
+			})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported format %s", n.config.Format)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.rotateIfNeeded(int64(records.Len())); err != nil {
+		return fmt.Errorf("could not rotate %s: %v", n.config.Path, err)
+	}
+
+	file, err := os.OpenFile(n.config.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if n.config.Format == "csv" {
+		if info, err := file.Stat(); err == nil && info.Size() == 0 {
+			writer := csv.NewWriter(file)
+			writer.Write(csvHeader)
+			writer.Flush()
+			if err := writer.Error(); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = file.Write(records.Bytes())
+	return err
+}
+
+// rotateIfNeeded shifts path to path.1, path.1 to path.2 and so on when appending pending bytes
+// would exceed the maximum size, dropping the oldest backup
+func (n *fileNotifier) rotateIfNeeded(pending int64) error {
+	info, err := os.Stat(n.config.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 || info.Size()+pending <= int64(n.config.MaxSizeMB)*1024*1024 {
+		return nil
+	}
+
+	backup := func(i int) string {
+		return fmt.Sprintf("%s.%d", n.config.Path, i)
+	}
+	if err := os.Remove(backup(n.config.MaxBackups)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for i := n.config.MaxBackups - 1; i >= 1; i-- {
+		if err := os.Rename(backup(i), backup(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(n.config.Path, backup(1))
+}
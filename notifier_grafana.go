@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// GrafanaNotifierConfig writes anomalies as Grafana annotations
+type GrafanaNotifierConfig struct {
+	URL          string   `yaml:"url"`                   // base URL of the Grafana instance
+	APIKey       string   `yaml:"api_key" secret:"true"` // service account token with annotation write access
+	DashboardUID string   `yaml:"dashboard_uid"`         // optional; organisation-wide annotations otherwise
+	PanelID      int      `yaml:"panel_id"`              // optional panel of the dashboard
+	Tags         []string `yaml:"tags"`                  // added to the metric and severity tags
+}
+
+// grafanaNotifier creates one annotation per anomaly through the Grafana HTTP API, tagged with
+// the metric and severity so dashboards can filter them
+type grafanaNotifier struct {
+	name     string
+	config   GrafanaNotifierConfig
+	client   *http.Client
+	template *messageTemplate // overrides the text, its fields are added as tags
+}
+
+type grafanaAnnotation struct {
+	DashboardUID string   `json:"dashboardUID,omitempty"`
+	PanelID      int      `json:"panelId,omitempty"`
+	Time         int64    `json:"time"` // epoch milliseconds
+	Tags         []string `json:"tags"`
+	Text         string   `json:"text"`
+}
+
+func newGrafanaNotifier(name string, config GrafanaNotifierConfig) (*grafanaNotifier, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("no url configured")
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	return &grafanaNotifier{name: name, config: config, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (n *grafanaNotifier) Name() string {
+	return n.name
+}
+
+func (n *grafanaNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	header := http.Header{}
+	if n.config.APIKey != "" {
+		header.Set("Authorization", "Bearer "+n.config.APIKey)
+	}
+
+	for _, anomaly := range anomalies {
+		tags := []string{"metric:" + anomaly.MetricName, "severity:" + anomaly.Severity}
+		if anomaly.Type != "" {
+			tags = append(tags, "type:"+anomaly.Type)
+		}
+		for key, value := range anomaly.Metadata {
+			tags = append(tags, key+":"+value)
+		}
+		sort.Strings(tags[len(tags)-len(anomaly.Metadata):])
+		for _, name := range n.template.fieldNames() {
+			tags = append(tags, name+":"+n.template.field(anomaly, name))
+		}
+		tags = append(tags, n.config.Tags...)
+		annotation := grafanaAnnotation{
+			DashboardUID: n.config.DashboardUID,
+			PanelID:      n.config.PanelID,
+			Time:         anomaly.Timestamp.UnixNano() / int64(time.Millisecond),
+			Tags:         tags,
+			Text: n.template.body(anomaly, fmt.Sprintf("%s on %s: value %s - %s (fingerprint %s, id %s)%s",
+				anomaly.displayName(), anomaly.resource(), anomaly.formattedValue(), anomaly.Message, anomaly.Fingerprint, anomaly.ID, anomaly.queryLinks())),
+		}
+		if err := postJSON(ctx, n.client, n.config.URL+"/api/annotations", header, annotation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n *grafanaNotifier) setTemplate(t *messageTemplate) error {
+	n.template = t
+	return t.supports(false, true, true)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// KafkaNotifierConfig publishes anomalies to a Kafka topic
+type KafkaNotifierConfig struct {
+	Brokers []string         `yaml:"brokers"`
+	Topic   string           `yaml:"topic"`
+	SASL    *KafkaSASLConfig `yaml:"sasl"`
+	TLS     *KafkaTLSConfig  `yaml:"tls"`
+}
+
+// KafkaSASLConfig authenticates to the brokers
+type KafkaSASLConfig struct {
+	Mechanism string `yaml:"mechanism"` // plain (default), scram-sha-256 or scram-sha-512
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password" secret:"true"`
+}
+
+// KafkaTLSConfig encrypts the connections to the brokers
+type KafkaTLSConfig struct {
+	CAFile             string `yaml:"ca_file"` // optional CA bundle, the system roots otherwise
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// kafkaNotifier publishes every anomaly as a JSON message keyed by the series fingerprint, so
+// the anomalies of a series stay ordered within a partition
+type kafkaNotifier struct {
+	name   string
+	writer *kafka.Writer
+	schema anomalySchema
+}
+
+func newKafkaNotifier(name string, config KafkaNotifierConfig, schema anomalySchema) (*kafkaNotifier, error) {
+	if len(config.Brokers) == 0 {
+		return nil, fmt.Errorf("no brokers configured")
+	}
+	if config.Topic == "" {
+		return nil, fmt.Errorf("no topic configured")
+	}
+
+	transport := &kafka.Transport{}
+	if config.SASL != nil {
+		mechanism, err := kafkaSASLMechanism(*config.SASL)
+		if err != nil {
+			return nil, err
+		}
+		transport.SASL = mechanism
+	}
+	if config.TLS != nil {
+		tlsConfig := &tls.Config{InsecureSkipVerify: config.TLS.InsecureSkipVerify}
+		if config.TLS.CAFile != "" {
+			data, err := os.ReadFile(config.TLS.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read CA file: %v", err)
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(data) {
+				return nil, fmt.Errorf("no certificates found in %s", config.TLS.CAFile)
+			}
+			tlsConfig.RootCAs = pool
+		}
+		transport.TLS = tlsConfig
+	}
+
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(config.Brokers...),
+		Topic:        config.Topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		BatchTimeout: 100 * time.Millisecond,
+		Transport:    transport,
+	}
+	return &kafkaNotifier{name: name, writer: writer, schema: schema}, nil
+}
+
+func kafkaSASLMechanism(config KafkaSASLConfig) (sasl.Mechanism, error) {
+	switch config.Mechanism {
+	case "", "plain":
+		return plain.Mechanism{Username: config.Username, Password: config.Password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, config.Username, config.Password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, config.Username, config.Password)
+	default:
+		return nil, fmt.Errorf("unsupported SASL mechanism %s", config.Mechanism)
+	}
+}
+
+func (n *kafkaNotifier) Name() string {
+	return n.name
+}
+
+func (n *kafkaNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	messages := make([]kafka.Message, 0, len(anomalies))
+	for _, anomaly := range anomalies {
+		value, err := json.Marshal(n.schema.payload(anomaly))
+		if err != nil {
+			return err
+		}
+		messages = append(messages, kafka.Message{
+			Key:   []byte(anomaly.Fingerprint),
+			Value: value,
+			Time:  anomaly.Timestamp,
+			Headers: []kafka.Header{
+				{Key: "metric", Value: []byte(anomaly.MetricName)},
+				{Key: "severity", Value: []byte(anomaly.Severity)},
+				{Key: "id", Value: []byte(anomaly.ID)},
+			},
+		})
+	}
+	return n.writer.WriteMessages(ctx, messages...)
+}
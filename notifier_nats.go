@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATSNotifierConfig publishes anomalies to a NATS subject
+type NATSNotifierConfig struct {
+	URL             string `yaml:"url"`                 // server URLs, comma separated; defaults to nats://127.0.0.1:4222
+	Subject         string `yaml:"subject"`             // defaults to gcp.anomalies
+	JetStream       bool   `yaml:"jetstream"`           // publish to a JetStream stream and wait for its acknowledgement
+	CredentialsFile string `yaml:"credentials_file"`    // optional user credentials (JWT and NKey seed)
+	Token           string `yaml:"token" secret:"true"` // optional token authentication
+	Username        string `yaml:"username"`            // optional user/password authentication
+	Password        string `yaml:"password" secret:"true"`
+}
+
+// natsNotifier publishes every anomaly as a JSON message. With JetStream the anomaly ID is the
+// message ID, so the stream deduplicates anomalies published twice.
+type natsNotifier struct {
+	name    string
+	config  NATSNotifierConfig
+	conn    *nats.Conn
+	stream  nats.JetStreamContext
+	subject string
+	schema  anomalySchema
+}
+
+func newNATSNotifier(name string, config NATSNotifierConfig, schema anomalySchema) (*natsNotifier, error) {
+	if config.URL == "" {
+		config.URL = nats.DefaultURL
+	}
+	if config.Subject == "" {
+		config.Subject = "gcp.anomalies"
+	}
+
+	// The connection is retried in the background, so an unreachable server does not prevent
+	// the detector from starting
+	options := []nats.Option{
+		nats.Name("gcp-anomaly-detector"),
+		nats.RetryOnFailedConnect(true),
+		nats.MaxReconnects(-1),
+	}
+	if config.CredentialsFile != "" {
+		options = append(options, nats.UserCredentials(config.CredentialsFile))
+	}
+	if config.Token != "" {
+		options = append(options, nats.Token(config.Token))
+	}
+	if config.Username != "" {
+		options = append(options, nats.UserInfo(config.Username, config.Password))
+	}
+	conn, err := nats.Connect(config.URL, options...)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to %s: %v", config.URL, err)
+	}
+
+	notifier := &natsNotifier{name: name, config: config, conn: conn, subject: config.Subject, schema: schema}
+	if config.JetStream {
+		notifier.stream, err = conn.JetStream()
+		if err != nil {
+			return nil, fmt.Errorf("could not create JetStream context: %v", err)
+		}
+	}
+	return notifier, nil
+}
+
+func (n *natsNotifier) Name() string {
+	return n.name
+}
+
+func (n *natsNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	for _, anomaly := range anomalies {
+		data, err := json.Marshal(n.schema.payload(anomaly))
+		if err != nil {
+			return err
+		}
+		msg := nats.NewMsg(n.subject)
+		msg.Data = data
+		msg.Header.Set("Metric", anomaly.MetricName)
+		msg.Header.Set("Severity", anomaly.Severity)
+
+		if n.stream != nil {
+			msg.Header.Set(nats.MsgIdHdr, anomaly.ID)
+			if _, err := n.stream.PublishMsg(msg, nats.Context(ctx)); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := n.conn.PublishMsg(msg); err != nil {
+			return err
+		}
+	}
+	if n.stream != nil {
+		return nil
+	}
+	return n.conn.FlushWithContext(ctx)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// OnCallNotifierConfig sends alerts to a Grafana OnCall webhook integration
+type OnCallNotifierConfig struct {
+	URL             string `yaml:"url" secret:"true"` // webhook URL of the integration
+	DashboardURL    string `yaml:"dashboard_url"`     // optional link added to every alert
+	ResolveAfterMin int    `yaml:"resolve_after_min"` // minutes without anomalies before a series resolves, defaults to 10
+}
+
+// onCallNotifier sends one alert per series, using the fingerprint as the deduplication key so
+// repeated anomalies are grouped into the same alert group. A series that stays quiet for
+// resolve_after_min is resolved automatically.
+type onCallNotifier struct {
+	name     string
+	config   OnCallNotifierConfig
+	client   *http.Client
+	template *messageTemplate // overrides the title and message of the alerts
+
+	mu     sync.Mutex
+	firing map[string]firingAlert // by fingerprint
+}
+
+// firingAlert is the latest anomaly sent for a series and when it was sent. Staleness is
+// measured from the send time, as points may be detected well after their timestamp.
+type firingAlert struct {
+	anomaly Anomaly
+	sentAt  time.Time
+}
+
+// resolver is implemented by notifiers that resolve their alerts once the anomalies stop. It is
+// called after every detection cycle, whether or not anomalies were found.
+type resolver interface {
+	resolveStale(ctx context.Context, now time.Time) error
+}
+
+type onCallAlert struct {
+	AlertUID string `json:"alert_uid"`
+	Title    string `json:"title"`
+	State    string `json:"state"` // alerting or ok
+	Message  string `json:"message"`
+	Link     string `json:"link_to_upstream_details,omitempty"`
+}
+
+func newOnCallNotifier(name string, config OnCallNotifierConfig) (*onCallNotifier, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("no url configured")
+	}
+	if config.ResolveAfterMin == 0 {
+		config.ResolveAfterMin = 10
+	}
+	return &onCallNotifier{
+		name:   name,
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second},
+		firing: make(map[string]firingAlert),
+	}, nil
+}
+
+func (n *onCallNotifier) Name() string {
+	return n.name
+}
+
+func (n *onCallNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	// Only the latest anomaly of each series is sent; the others would be deduplicated anyway
+	latest := make(map[string]Anomaly)
+	var order []string
+	for _, anomaly := range anomalies {
+		previous, seen := latest[anomaly.Fingerprint]
+		if !seen {
+			order = append(order, anomaly.Fingerprint)
+		}
+		if !seen || anomaly.Timestamp.After(previous.Timestamp) {
+			latest[anomaly.Fingerprint] = anomaly
+		}
+	}
+
+	for _, fingerprint := range order {
+		anomaly := latest[fingerprint]
+		alert := onCallAlert{
+			AlertUID: fingerprint,
+			Title:    n.template.title(anomaly, fmt.Sprintf("[%s] Anomaly on %s", anomaly.Severity, anomaly.displayName())),
+			State:    "alerting",
+			Message: n.template.body(anomaly, fmt.Sprintf("Value %s on %s at %s - %s (fingerprint %s, id %s)%s%s",
+				anomaly.formattedValue(), anomaly.resource(), displayTime(anomaly.Timestamp), anomaly.Message, anomaly.Fingerprint, anomaly.ID, anomaly.links(), anomaly.contextSummary())),
+			Link: n.config.DashboardURL,
+		}
+		if url := anomaly.Metadata["dashboard_url"]; url != "" {
+			alert.Link = url
+		}
+		if err := postJSON(ctx, n.client, n.config.URL, nil, alert); err != nil {
+			return err
+		}
+
+		n.mu.Lock()
+		n.firing[fingerprint] = firingAlert{anomaly: anomaly, sentAt: time.Now()}
+		n.mu.Unlock()
+	}
+	return nil
+}
+
+func (n *onCallNotifier) resolveStale(ctx context.Context, now time.Time) error {
+	resolveAfter := time.Duration(n.config.ResolveAfterMin) * time.Minute
+
+	n.mu.Lock()
+	var stale []firingAlert
+	for _, alert := range n.firing {
+		if now.Sub(alert.sentAt) >= resolveAfter {
+			stale = append(stale, alert)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, firing := range stale {
+		anomaly := firing.anomaly
+		alert := onCallAlert{
+			AlertUID: anomaly.Fingerprint,
+			Title:    n.template.title(anomaly, fmt.Sprintf("[%s] Anomaly on %s", anomaly.Severity, anomaly.displayName())),
+			State:    "ok",
+			Message:  fmt.Sprintf("No anomalies on %s since %s", anomaly.displayName(), displayTime(anomaly.Timestamp)),
+			Link:     n.config.DashboardURL,
+		}
+		if err := postJSON(ctx, n.client, n.config.URL, nil, alert); err != nil {
+			return err
+		}
+
+		n.mu.Lock()
+		if current, ok := n.firing[anomaly.Fingerprint]; ok && !current.sentAt.After(firing.sentAt) {
+			delete(n.firing, anomaly.Fingerprint)
+		}
+		n.mu.Unlock()
+	}
+	return nil
+}
+
+// transition resolves the alert group of an alert still firing when its event is resolved.
+// Acknowledgements are left to OnCall, as its webhook integrations only take alerting and ok.
+func (n *onCallNotifier) transition(ctx context.Context, event Event) error {
+	if event.State != EventResolved {
+		return nil
+	}
+	n.mu.Lock()
+	firing, ok := n.firing[event.Fingerprint]
+	n.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	anomaly := firing.anomaly
+	alert := onCallAlert{
+		AlertUID: anomaly.Fingerprint,
+		Title:    n.template.title(anomaly, fmt.Sprintf("[%s] Anomaly on %s", anomaly.Severity, anomaly.displayName())),
+		State:    "ok",
+		Message:  fmt.Sprintf("Event %s resolved by %s", event.ID, event.latest().Actor),
+		Link:     n.config.DashboardURL,
+	}
+	if err := postJSON(ctx, n.client, n.config.URL, nil, alert); err != nil {
+		return err
+	}
+
+	n.mu.Lock()
+	if current, ok := n.firing[anomaly.Fingerprint]; ok && !current.sentAt.After(firing.sentAt) {
+		delete(n.firing, anomaly.Fingerprint)
+	}
+	n.mu.Unlock()
+	return nil
+}
+
+func (n *onCallNotifier) setTemplate(t *messageTemplate) error {
+	n.template = t
+	return t.supports(true, true, false)
+}
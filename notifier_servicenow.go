@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ServiceNowNotifierConfig creates ServiceNow incidents for anomalies
+type ServiceNowNotifierConfig struct {
+	URL             string            `yaml:"url"` // instance URL, e.g. https://example.service-now.com
+	Username        string            `yaml:"username"`
+	Password        string            `yaml:"password" secret:"true"`
+	AssignmentGroup string            `yaml:"assignment_group"` // optional group name or sys_id
+	Category        string            `yaml:"category"`         // optional incident category
+	Urgency         map[string]string `yaml:"urgency"`          // severity to urgency, defaults to critical: 1 and warning: 2
+	Impact          string            `yaml:"impact"`           // defaults to 2
+}
+
+// serviceNowNotifier creates one incident per series through the Table API. The fingerprint is
+// the incident's correlation ID, so further anomalies on a series that already has an active
+// incident are added to it as work notes instead of opening a new one.
+type serviceNowNotifier struct {
+	name     string
+	config   ServiceNowNotifierConfig
+	client   *http.Client
+	template *messageTemplate // overrides the short description and description of the incidents
+}
+
+type serviceNowIncident struct {
+	ShortDescription   string `json:"short_description,omitempty"`
+	Description        string `json:"description,omitempty"`
+	AssignmentGroup    string `json:"assignment_group,omitempty"`
+	Category           string `json:"category,omitempty"`
+	Urgency            string `json:"urgency,omitempty"`
+	Impact             string `json:"impact,omitempty"`
+	CorrelationID      string `json:"correlation_id,omitempty"`
+	CorrelationDisplay string `json:"correlation_display,omitempty"`
+	WorkNotes          string `json:"work_notes,omitempty"`
+}
+
+func newServiceNowNotifier(name string, config ServiceNowNotifierConfig) (*serviceNowNotifier, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("no url configured")
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	urgency := map[string]string{SeverityCritical: "1", SeverityWarning: "2"}
+	for severity, value := range config.Urgency {
+		urgency[severity] = value
+	}
+	config.Urgency = urgency
+	if config.Impact == "" {
+		config.Impact = "2"
+	}
+	return &serviceNowNotifier{name: name, config: config, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (n *serviceNowNotifier) Name() string {
+	return n.name
+}
+
+func (n *serviceNowNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	for _, anomaly := range anomalies {
+		description := fmt.Sprintf("%s at %s with value %s - %s\nResource: %s\nSeverity: %s\nFingerprint: %s\nAnomaly ID: %s",
+			anomaly.displayName(), displayTime(anomaly.Timestamp), anomaly.formattedValue(), anomaly.Message,
+			anomaly.resource(), anomaly.Severity, anomaly.Fingerprint, anomaly.ID)
+		for _, key := range []string{"runbook_url", "dashboard_url"} {
+			if url := anomaly.Metadata[key]; url != "" {
+				description += fmt.Sprintf("\n%s: %s", key, url)
+			}
+		}
+		if anomaly.ExplorerURL != "" {
+			description += "\nexplorer_url: " + anomaly.ExplorerURL
+		}
+		if anomaly.ChartURL != "" {
+			description += "\nchart_url: " + anomaly.ChartURL
+		}
+		description = n.template.body(anomaly, description)
+
+		sysID, err := n.activeIncident(ctx, anomaly.Fingerprint)
+		if err != nil {
+			return fmt.Errorf("could not look up incident: %v", err)
+		}
+		if sysID != "" {
+			note := serviceNowIncident{WorkNotes: "Further anomaly detected:\n" + description}
+			if err := n.request(ctx, http.MethodPatch, "/api/now/table/incident/"+sysID, note, nil); err != nil {
+				return fmt.Errorf("could not update incident: %v", err)
+			}
+			continue
+		}
+
+		incident := serviceNowIncident{
+			ShortDescription:   n.template.title(anomaly, fmt.Sprintf("[%s] Anomaly on %s", anomaly.Severity, anomaly.displayName())),
+			Description:        description,
+			AssignmentGroup:    n.config.AssignmentGroup,
+			Category:           n.config.Category,
+			Urgency:            n.config.Urgency[anomaly.Severity],
+			Impact:             n.config.Impact,
+			CorrelationID:      anomaly.Fingerprint,
+			CorrelationDisplay: "gcp-anomaly-detector",
+		}
+		if err := n.request(ctx, http.MethodPost, "/api/now/table/incident", incident, nil); err != nil {
+			return fmt.Errorf("could not create incident: %v", err)
+		}
+	}
+	return nil
+}
+
+func (n *serviceNowNotifier) setTemplate(t *messageTemplate) error {
+	n.template = t
+	return t.supports(true, true, false)
+}
+
+// activeIncident returns the sys_id of the active incident correlated with the fingerprint
+func (n *serviceNowNotifier) activeIncident(ctx context.Context, fingerprint string) (string, error) {
+	query := url.Values{
+		"sysparm_query":  {"active=true^correlation_id=" + fingerprint},
+		"sysparm_fields": {"sys_id"},
+		"sysparm_limit":  {"1"},
+	}
+	var result struct {
+		Result []struct {
+			SysID string `json:"sys_id"`
+		} `json:"result"`
+	}
+	if err := n.request(ctx, http.MethodGet, "/api/now/table/incident?"+query.Encode(), nil, &result); err != nil {
+		return "", err
+	}
+	if len(result.Result) == 0 {
+		return "", nil
+	}
+	return result.Result[0].SysID, nil
+}
+
+func (n *serviceNowNotifier) request(ctx context.Context, method, path string, payload interface{}, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, n.config.URL+path, body)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(n.config.Username, n.config.Password)
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
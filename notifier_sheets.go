@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+// sheetsScope lets the detector append rows to the spreadsheets shared with its service account
+const sheetsScope = "https://www.googleapis.com/auth/spreadsheets"
+
+// sheetsColumns are the header of the rows appended per anomaly
+var sheetsColumns = []string{"reported_at", "id", "severity", "kind", "metric", "resource", "value", "z_score", "expected_low", "expected_high", "start_time", "message", "link"}
+
+// SheetsNotifierConfig appends the anomalies to a Google Sheet, a lightweight incident log
+type SheetsNotifierConfig struct {
+	SpreadsheetID string `yaml:"spreadsheet_id"` // from the URL of the spreadsheet, which must be shared with the detector's service account as an editor
+	Sheet         string `yaml:"sheet"`          // name of the sheet (tab) the rows are appended to, defaults to Sheet1
+}
+
+// sheetsNotifier appends a row per anomaly event, the first time it is reported, and writes the
+// header row into an empty sheet
+type sheetsNotifier struct {
+	name     string
+	config   SheetsNotifierConfig
+	client   *http.Client
+	base     string           // values endpoint of the sheet
+	template *messageTemplate // overrides the message column
+
+	mu       sync.Mutex
+	header   bool            // whether the sheet is known to have its header row
+	appended map[string]bool // IDs of the anomalies appended since the detector started
+}
+
+func newSheetsNotifier(ctx context.Context, name string, config SheetsNotifierConfig) (*sheetsNotifier, error) {
+	if config.SpreadsheetID == "" {
+		return nil, fmt.Errorf("no spreadsheet_id configured")
+	}
+	if config.Sheet == "" {
+		config.Sheet = "Sheet1"
+	}
+	client, err := google.DefaultClient(ctx, sheetsScope)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Sheets client: %v", err)
+	}
+	return &sheetsNotifier{
+		name:     name,
+		config:   config,
+		client:   client,
+		base:     "https://sheets.googleapis.com/v4/spreadsheets/" + url.PathEscape(config.SpreadsheetID) + "/values/",
+		appended: make(map[string]bool),
+	}, nil
+}
+
+func (n *sheetsNotifier) Name() string {
+	return n.name
+}
+
+func (n *sheetsNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	reportedAt := time.Now().UTC().Format(time.RFC3339)
+	var rows [][]interface{}
+	var ids []string
+	for _, anomaly := range anomalies {
+		if n.appended[anomaly.ID] {
+			continue
+		}
+		rows = append(rows, sheetsRow(anomaly, reportedAt, n.template.body(anomaly, anomaly.Message)))
+		ids = append(ids, anomaly.ID)
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	if !n.header {
+		empty, err := n.empty(ctx)
+		if err != nil {
+			return err
+		}
+		if empty {
+			header := make([]interface{}, len(sheetsColumns))
+			for i, column := range sheetsColumns {
+				header[i] = column
+			}
+			rows = append([][]interface{}{header}, rows...)
+		}
+	}
+	if err := n.append(ctx, rows); err != nil {
+		return err
+	}
+	n.header = true
+	for _, id := range ids {
+		n.appended[id] = true
+	}
+	return nil
+}
+
+func (n *sheetsNotifier) setTemplate(t *messageTemplate) error {
+	n.template = t
+	return t.supports(false, true, false)
+}
+
+// sheetsRow returns the cells of an anomaly, in the order of sheetsColumns
+func sheetsRow(anomaly Anomaly, reportedAt, message string) []interface{} {
+	var low, high interface{} = "", ""
+	if anomaly.Expected != nil {
+		low, high = anomaly.Expected.Low, anomaly.Expected.High
+	}
+	return []interface{}{
+		reportedAt,
+		anomaly.ID,
+		anomaly.Severity,
+		anomaly.Kind,
+		anomaly.displayName(),
+		anomaly.resource(),
+		anomaly.Value,
+		anomaly.ZScore,
+		low,
+		high,
+		anomaly.Timestamp.UTC().Format(time.RFC3339),
+		message,
+		anomaly.ExplorerURL,
+	}
+}
+
+// empty reports whether the first row of the sheet is empty
+func (n *sheetsNotifier) empty(ctx context.Context) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, n.base+url.PathEscape(n.config.Sheet+"!1:1"), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("could not read the sheet: %s", resp.Status)
+	}
+	var values struct {
+		Values [][]interface{} `json:"values"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&values); err != nil {
+		return false, err
+	}
+	return len(values.Values) == 0, nil
+}
+
+// append adds the rows after the last row of the sheet
+func (n *sheetsNotifier) append(ctx context.Context, rows [][]interface{}) error {
+	endpoint := n.base + url.PathEscape(n.config.Sheet) + ":append?valueInputOption=RAW&insertDataOption=INSERT_ROWS"
+	return postJSON(ctx, n.client, endpoint, nil, map[string]interface{}{"values": rows})
+}
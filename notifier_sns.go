@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// SNSNotifierConfig publishes anomalies to an AWS SNS topic
+type SNSNotifierConfig struct {
+	TopicARN        string `yaml:"topic_arn"`
+	AccessKeyID     string `yaml:"access_key_id"`                   // defaults to $AWS_ACCESS_KEY_ID
+	SecretAccessKey string `yaml:"secret_access_key" secret:"true"` // defaults to $AWS_SECRET_ACCESS_KEY
+	SessionToken    string `yaml:"session_token" secret:"true"`     // defaults to $AWS_SESSION_TOKEN
+}
+
+// snsNotifier publishes every anomaly as a JSON message through the SNS query API, signed with
+// Signature Version 4. On FIFO topics the series fingerprint is the message group and the
+// anomaly ID the deduplication ID.
+type snsNotifier struct {
+	name     string
+	config   SNSNotifierConfig
+	region   string
+	client   *http.Client
+	schema   anomalySchema
+	template *messageTemplate // overrides the subject, its fields are added as message attributes
+}
+
+// snsMessageAttributes is the most message attributes SNS accepts per message
+const snsMessageAttributes = 10
+
+func newSNSNotifier(name string, config SNSNotifierConfig, schema anomalySchema) (*snsNotifier, error) {
+	// arn:aws:sns:<region>:<account>:<topic>
+	parts := strings.Split(config.TopicARN, ":")
+	if len(parts) != 6 || parts[2] != "sns" {
+		return nil, fmt.Errorf("invalid topic_arn %q", config.TopicARN)
+	}
+	if config.AccessKeyID == "" {
+		config.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		config.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		config.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		registerSecrets(config)
+	}
+	if config.AccessKeyID == "" || config.SecretAccessKey == "" {
+		return nil, fmt.Errorf("no AWS credentials configured")
+	}
+	return &snsNotifier{name: name, config: config, region: parts[3], client: &http.Client{Timeout: 10 * time.Second}, schema: schema}, nil
+}
+
+func (n *snsNotifier) Name() string {
+	return n.name
+}
+
+func (n *snsNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	for _, anomaly := range anomalies {
+		params, err := n.publishParams(anomaly)
+		if err != nil {
+			return err
+		}
+		if err := n.publish(ctx, params); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// publishParams returns the parameters of the Publish call of an anomaly
+func (n *snsNotifier) publishParams(anomaly Anomaly) (url.Values, error) {
+	message, err := json.Marshal(n.schema.payload(anomaly))
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{
+		"Action":   {"Publish"},
+		"Version":  {"2010-03-31"},
+		"TopicArn": {n.config.TopicARN},
+		"Subject":  {truncateSubject(n.template.title(anomaly, fmt.Sprintf("[%s] Anomaly on %s", anomaly.Severity, anomaly.displayName())))},
+		"Message":  {string(message)},
+
+		"MessageAttributes.entry.1.Name":              {"metric"},
+		"MessageAttributes.entry.1.Value.DataType":    {"String"},
+		"MessageAttributes.entry.1.Value.StringValue": {anomaly.MetricName},
+		"MessageAttributes.entry.2.Name":              {"severity"},
+		"MessageAttributes.entry.2.Value.DataType":    {"String"},
+		"MessageAttributes.entry.2.Value.StringValue": {anomaly.Severity},
+	}
+	entries := 2
+	for _, name := range n.template.fieldNames() {
+		// SNS rejects message attributes without a value
+		value := n.template.field(anomaly, name)
+		if value == "" {
+			continue
+		}
+		entries++
+		entry := fmt.Sprintf("MessageAttributes.entry.%d.", entries)
+		params.Set(entry+"Name", name)
+		params.Set(entry+"Value.DataType", "String")
+		params.Set(entry+"Value.StringValue", value)
+	}
+	if strings.HasSuffix(n.config.TopicARN, ".fifo") {
+		params.Set("MessageGroupId", anomaly.Fingerprint)
+		params.Set("MessageDeduplicationId", anomaly.ID)
+	}
+	return params, nil
+}
+
+// setTemplate sets the template of the subject and message attributes. The message stays the
+// anomaly payload, which subscribers parse.
+func (n *snsNotifier) setTemplate(t *messageTemplate) error {
+	n.template = t
+	if len(t.fields) > snsMessageAttributes-2 {
+		return fmt.Errorf("template: at most %d fields, as SNS takes %d message attributes", snsMessageAttributes-2, snsMessageAttributes)
+	}
+	return t.supports(true, false, true)
+}
+
+func (n *snsNotifier) publish(ctx context.Context, params url.Values) error {
+	host := fmt.Sprintf("sns.%s.amazonaws.com", n.region)
+	body := []byte(params.Encode())
+
+	header := http.Header{}
+	n.sign(header, host, body, time.Now().UTC())
+	return postBody(ctx, n.client, "https://"+host+"/", header, "application/x-www-form-urlencoded; charset=utf-8", body)
+}
+
+// sign adds the Signature Version 4 headers of a POST request to / with the given body
+func (n *snsNotifier) sign(header http.Header, host string, body []byte, now time.Time) {
+	signer := awsSigner{
+		accessKeyID: n.config.AccessKeyID, secretAccessKey: n.config.SecretAccessKey, sessionToken: n.config.SessionToken,
+		region: n.region, service: "sns",
+	}
+	signer.sign(header, host, "application/x-www-form-urlencoded; charset=utf-8", body, now)
+}
+
+// awsSigner signs requests to an AWS service with Signature Version 4
+type awsSigner struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	region          string
+	service         string
+}
+
+// sign adds the Signature Version 4 headers of a POST request to / with the given content type
+// and body
+func (s awsSigner) sign(header http.Header, host, contentType string, body []byte, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, s.region, s.service)
+
+	canonicalHeaders := "content-type:" + contentType + "\nhost:" + host + "\nx-amz-date:" + amzDate + "\n"
+	signedHeaders := "content-type;host;x-amz-date"
+	if s.sessionToken != "" {
+		canonicalHeaders += "x-amz-security-token:" + s.sessionToken + "\n"
+		signedHeaders += ";x-amz-security-token"
+		header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		http.MethodPost, "/", "", canonicalHeaders, signedHeaders, hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(requestHash[:])}, "\n")
+	signature := hex.EncodeToString(hmacSHA256(s.signingKey(date), stringToSign))
+
+	header.Set("X-Amz-Date", amzDate)
+	header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKeyID, scope, signedHeaders, signature))
+}
+
+// signingKey derives the key signing the requests of a day
+func (s awsSigner) signingKey(date string) []byte {
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), date)
+	for _, part := range []string{s.region, s.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	return key
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// truncateSubject keeps an SNS subject within its 100 byte limit, cutting it on a rune boundary
+func truncateSubject(subject string) string {
+	if len(subject) <= 100 {
+		return subject
+	}
+	cut := 97
+	for cut > 0 && !utf8.RuneStart(subject[cut]) {
+		cut--
+	}
+	return subject[:cut] + "..."
+}
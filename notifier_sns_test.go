@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// awsExampleSigner has the example credentials of the AWS Signature Version 4 test suite
+var awsExampleSigner = awsSigner{
+	accessKeyID:     "AKIDEXAMPLE",
+	secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	region:          "us-east-1",
+	service:         "service",
+}
+
+func TestAWSSigningKey(t *testing.T) {
+	// From "Examples of how to derive a signing key for Signature Version 4" in the AWS docs
+	signer := awsExampleSigner
+	signer.service = "iam"
+	want := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"
+	if got := hex.EncodeToString(signer.signingKey("20120215")); got != want {
+		t.Errorf("got signing key %s, want %s", got, want)
+	}
+}
+
+func TestAWSSignature(t *testing.T) {
+	// The post-x-www-form-urlencoded case of the AWS Signature Version 4 test suite
+	header := http.Header{}
+	awsExampleSigner.sign(header, "example.amazonaws.com", "application/x-www-form-urlencoded", []byte("Param1=value1"),
+		time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+		"SignedHeaders=content-type;host;x-amz-date, " +
+		"Signature=ff11897932ad3f4e8b18135d722051e5ac45fc38421b1da7b9d196a0fe09473a"
+	if got := header.Get("Authorization"); got != want {
+		t.Errorf("got Authorization %q, want %q", got, want)
+	}
+	if got := header.Get("X-Amz-Date"); got != "20150830T123600Z" {
+		t.Errorf("got X-Amz-Date %q, want 20150830T123600Z", got)
+	}
+	if got := header.Get("X-Amz-Security-Token"); got != "" {
+		t.Errorf("got X-Amz-Security-Token %q without a session token", got)
+	}
+}
+
+func TestTruncateSubject(t *testing.T) {
+	tests := []struct {
+		name    string
+		subject string
+		want    string
+	}{
+		{name: "short", subject: "[critical] Anomaly on latency", want: "[critical] Anomaly on latency"},
+		{name: "at the limit", subject: strings.Repeat("a", 100), want: strings.Repeat("a", 100)},
+		{name: "ascii", subject: strings.Repeat("a", 101), want: strings.Repeat("a", 97) + "..."},
+		// "é" takes two bytes, the 97th byte is the second of one
+		{name: "multibyte", subject: strings.Repeat("a", 96) + strings.Repeat("é", 10), want: strings.Repeat("a", 96) + "..."},
+		// "€" takes three bytes, and one ends on the 97th
+		{name: "on a boundary", subject: "a" + strings.Repeat("€", 40), want: "a" + strings.Repeat("€", 32) + "..."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateSubject(tt.subject)
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if !utf8.ValidString(got) || len(got) > 100 {
+				t.Errorf("got %q of %d bytes, want valid UTF-8 of at most 100", got, len(got))
+			}
+		})
+	}
+}
+
+func TestSNSMessageAttributes(t *testing.T) {
+	notifier, err := newSNSNotifier("sns", SNSNotifierConfig{
+		TopicARN: "arn:aws:sns:us-east-1:123456789012:anomalies", AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret",
+	}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	template, err := compileMessageTemplate(MessageTemplateConfig{Fields: map[string]string{
+		"team": "{{.Metadata.team}}",
+		"zone": "{{.Labels.zone}}",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.setTemplate(template); err != nil {
+		t.Fatal(err)
+	}
+
+	// The anomaly has no team, so only the zone is added, as the third attribute
+	params, err := notifier.publishParams(Anomaly{MetricName: "latency", Severity: "critical", Labels: map[string]string{"zone": "us-east1-b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name, value := params.Get("MessageAttributes.entry.3.Name"), params.Get("MessageAttributes.entry.3.Value.StringValue"); name != "zone" || value != "us-east1-b" {
+		t.Errorf("got third attribute %s=%q, want zone=\"us-east1-b\"", name, value)
+	}
+	for key := range params {
+		if strings.HasPrefix(key, "MessageAttributes.entry.4.") {
+			t.Errorf("got %s, want no attribute for the empty team", key)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// SplunkNotifierConfig sends anomalies to a Splunk HTTP Event Collector
+type SplunkNotifierConfig struct {
+	URL                string `yaml:"url"`                  // base URL of the collector, e.g. https://splunk.example.com:8088
+	Token              string `yaml:"token" secret:"true"`  // HEC token
+	Index              string `yaml:"index"`                // optional; the token's default index otherwise
+	Source             string `yaml:"source"`               // defaults to gcp-anomaly-detector
+	SourceType         string `yaml:"sourcetype"`           // defaults to _json
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // for collectors with self-signed certificates
+}
+
+// splunkNotifier posts the anomalies of a cycle as one batch of HEC events
+type splunkNotifier struct {
+	name   string
+	config SplunkNotifierConfig
+	client *http.Client
+	host   string
+	schema anomalySchema
+}
+
+type splunkEvent struct {
+	Time       float64     `json:"time"` // epoch seconds
+	Host       string      `json:"host,omitempty"`
+	Source     string      `json:"source"`
+	SourceType string      `json:"sourcetype"`
+	Index      string      `json:"index,omitempty"`
+	Event      interface{} `json:"event"` // the anomaly in the schema of the notifier
+}
+
+func newSplunkNotifier(name string, config SplunkNotifierConfig, schema anomalySchema) (*splunkNotifier, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("no url configured")
+	}
+	if config.Token == "" {
+		return nil, fmt.Errorf("no token configured")
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	if config.Source == "" {
+		config.Source = "gcp-anomaly-detector"
+	}
+	if config.SourceType == "" {
+		config.SourceType = "_json"
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config.InsecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	host, _ := os.Hostname()
+	return &splunkNotifier{
+		name:   name,
+		config: config,
+		client: &http.Client{Timeout: 10 * time.Second, Transport: transport},
+		host:   host,
+		schema: schema,
+	}, nil
+}
+
+func (n *splunkNotifier) Name() string {
+	return n.name
+}
+
+func (n *splunkNotifier) recordsSuppressed() bool {
+	return true
+}
+
+func (n *splunkNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	// HEC accepts a batch as concatenated JSON objects
+	var batch bytes.Buffer
+	encoder := json.NewEncoder(&batch)
+	for _, anomaly := range anomalies {
+		event := splunkEvent{
+			Time:       float64(anomaly.Timestamp.UnixNano()) / float64(time.Second),
+			Host:       n.host,
+			Source:     n.config.Source,
+			SourceType: n.config.SourceType,
+			Index:      n.config.Index,
+			Event:      n.schema.payload(anomaly),
+		}
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+
+	header := http.Header{}
+	header.Set("Authorization", "Splunk "+n.config.Token)
+	return postBody(ctx, n.client, n.config.URL+"/services/collector/event", header, "application/json", batch.Bytes())
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const statuspageAPI = "https://api.statuspage.io/v1"
+
+// StatuspageNotifierConfig opens Statuspage incidents for critical anomalies on customer-facing
+// metrics
+type StatuspageNotifierConfig struct {
+	APIKey          string            `yaml:"api_key" secret:"true"`
+	PageID          string            `yaml:"page_id"`
+	MetricTag       string            `yaml:"metric_tag"`        // metrics with this tag open incidents, defaults to customer-facing
+	Components      map[string]string `yaml:"components"`        // optional metric type to component ID, marked degraded while the incident is open
+	ResolveAfterMin int               `yaml:"resolve_after_min"` // minutes without critical anomalies before the incident resolves, defaults to 15
+}
+
+// statuspageNotifier keeps one incident per tagged metric: the first critical anomaly opens it,
+// later ones update it, and it is resolved once the metric has been quiet for resolve_after_min
+type statuspageNotifier struct {
+	name    string
+	config  StatuspageNotifierConfig
+	metrics map[string]bool
+	client  *http.Client
+
+	mu        sync.Mutex
+	incidents map[string]*statuspageIncident // by metric type
+}
+
+type statuspageIncident struct {
+	id      string
+	updated time.Time
+}
+
+type statuspageIncidentBody struct {
+	Name         string            `json:"name,omitempty"`
+	Status       string            `json:"status"`
+	Body         string            `json:"body"`
+	ComponentIDs []string          `json:"component_ids,omitempty"`
+	Components   map[string]string `json:"components,omitempty"`
+}
+
+func newStatuspageNotifier(name string, detectorConfig *Config, config StatuspageNotifierConfig) (*statuspageNotifier, error) {
+	if config.APIKey == "" || config.PageID == "" {
+		return nil, fmt.Errorf("api_key and page_id are required")
+	}
+	if config.MetricTag == "" {
+		config.MetricTag = "customer-facing"
+	}
+	if config.ResolveAfterMin == 0 {
+		config.ResolveAfterMin = 15
+	}
+
+	metrics := make(map[string]bool)
+	for _, metricType := range detectorConfig.MetricsTagged(config.MetricTag) {
+		metrics[metricType] = true
+	}
+	if len(metrics) == 0 {
+		return nil, fmt.Errorf("no metrics are tagged %s", config.MetricTag)
+	}
+	return &statuspageNotifier{
+		name:      name,
+		config:    config,
+		metrics:   metrics,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		incidents: make(map[string]*statuspageIncident),
+	}, nil
+}
+
+func (n *statuspageNotifier) Name() string {
+	return n.name
+}
+
+func (n *statuspageNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	// One update per metric and cycle, describing its latest critical anomaly
+	latest := make(map[string]Anomaly)
+	var order []string
+	for _, anomaly := range anomalies {
+		if anomaly.Severity != SeverityCritical || !n.metrics[anomaly.MetricName] {
+			continue
+		}
+		previous, seen := latest[anomaly.MetricName]
+		if !seen {
+			order = append(order, anomaly.MetricName)
+		}
+		if !seen || anomaly.Timestamp.After(previous.Timestamp) {
+			latest[anomaly.MetricName] = anomaly
+		}
+	}
+
+	for _, metricType := range order {
+		anomaly := latest[metricType]
+		body := statuspageIncidentBody{
+			Status: "investigating",
+			Body: fmt.Sprintf("We are investigating abnormal behaviour detected at %s.",
+				anomaly.Timestamp.UTC().Format(time.RFC3339)),
+		}
+		if component, ok := n.config.Components[metricType]; ok {
+			body.ComponentIDs = []string{component}
+			body.Components = map[string]string{component: "degraded_performance"}
+		}
+
+		n.mu.Lock()
+		incident, open := n.incidents[metricType]
+		n.mu.Unlock()
+
+		if open {
+			if err := n.request(ctx, http.MethodPatch, "/incidents/"+incident.id, body, nil); err != nil {
+				return err
+			}
+		} else {
+			body.Name = fmt.Sprintf("Degraded performance (%s)", anomaly.displayName())
+			var created struct {
+				ID string `json:"id"`
+			}
+			if err := n.request(ctx, http.MethodPost, "/incidents", body, &created); err != nil {
+				return err
+			}
+			incident = &statuspageIncident{id: created.ID}
+		}
+
+		n.mu.Lock()
+		incident.updated = time.Now()
+		n.incidents[metricType] = incident
+		n.mu.Unlock()
+	}
+	return nil
+}
+
+func (n *statuspageNotifier) resolveStale(ctx context.Context, now time.Time) error {
+	resolveAfter := time.Duration(n.config.ResolveAfterMin) * time.Minute
+
+	n.mu.Lock()
+	stale := make(map[string]statuspageIncident)
+	for metricType, incident := range n.incidents {
+		if now.Sub(incident.updated) >= resolveAfter {
+			stale[metricType] = *incident
+		}
+	}
+	n.mu.Unlock()
+
+	for metricType, incident := range stale {
+		body := statuspageIncidentBody{
+			Status: "resolved",
+			Body:   "The issue has been resolved and the service is operating normally.",
+		}
+		if component, ok := n.config.Components[metricType]; ok {
+			body.ComponentIDs = []string{component}
+			body.Components = map[string]string{component: "operational"}
+		}
+		if err := n.request(ctx, http.MethodPatch, "/incidents/"+incident.id, body, nil); err != nil {
+			return err
+		}
+
+		n.mu.Lock()
+		if current, ok := n.incidents[metricType]; ok && !current.updated.After(incident.updated) {
+			delete(n.incidents, metricType)
+		}
+		n.mu.Unlock()
+	}
+	return nil
+}
+
+func (n *statuspageNotifier) request(ctx context.Context, method, path string, incident statuspageIncidentBody, out interface{}) error {
+	data, err := json.Marshal(map[string]statuspageIncidentBody{"incident": incident})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, statuspageAPI+"/pages/"+n.config.PageID+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "OAuth "+n.config.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
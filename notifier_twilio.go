@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TwilioNotifierConfig sends SMS for critical anomalies through Twilio
+type TwilioNotifierConfig struct {
+	AccountSID string   `yaml:"account_sid"`
+	AuthToken  string   `yaml:"auth_token" secret:"true"`
+	From       string   `yaml:"from"` // Twilio phone number in E.164 format
+	To         []string `yaml:"to"`   // recipients in E.164 format
+}
+
+// twilioNotifier is a last-resort channel: it only sends critical anomalies, and at most one
+// message per recipient and cycle
+type twilioNotifier struct {
+	name   string
+	config TwilioNotifierConfig
+	client *http.Client
+}
+
+// smsMaxLength keeps a message within a few SMS segments
+const smsMaxLength = 480
+
+func newTwilioNotifier(name string, config TwilioNotifierConfig) (*twilioNotifier, error) {
+	if config.AccountSID == "" || config.AuthToken == "" {
+		return nil, fmt.Errorf("account_sid and auth_token are required")
+	}
+	if config.From == "" || len(config.To) == 0 {
+		return nil, fmt.Errorf("from and to are required")
+	}
+	return &twilioNotifier{name: name, config: config, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (n *twilioNotifier) Name() string {
+	return n.name
+}
+
+func (n *twilioNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	var critical []Anomaly
+	for _, anomaly := range anomalies {
+		if anomaly.Severity == SeverityCritical {
+			critical = append(critical, anomaly)
+		}
+	}
+	if len(critical) == 0 {
+		return nil
+	}
+
+	body := smsBody(critical)
+	header := http.Header{}
+	header.Set("Authorization", "Basic "+basicAuth(n.config.AccountSID, n.config.AuthToken))
+	messagesURL := fmt.Sprintf("https://api.twilio.com/2010-04-01/Accounts/%s/Messages.json", url.PathEscape(n.config.AccountSID))
+
+	var failed []string
+	for _, to := range n.config.To {
+		form := url.Values{"From": {n.config.From}, "To": {to}, "Body": {body}}
+		if err := postBody(ctx, n.client, messagesURL, header, "application/x-www-form-urlencoded", []byte(form.Encode())); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", to, err))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("could not send SMS to %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// smsBody summarises the critical anomalies of a cycle in one short message
+func smsBody(anomalies []Anomaly) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "CRITICAL: %d anomalies detected", len(anomalies))
+	for _, anomaly := range anomalies {
+		line := fmt.Sprintf("\n%s = %s (z %.1f) at %s", anomaly.displayName(), anomaly.formattedValue(), anomaly.ZScore, displayClock(anomaly.Timestamp))
+		if b.Len()+len(line) > smsMaxLength {
+			b.WriteString("\n...")
+			break
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+func basicAuth(username, password string) string {
+	return base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const victorOpsAPI = "https://alert.victorops.com/integrations/generic/20131114/alert"
+
+// VictorOpsNotifierConfig sends alerts to the Splunk On-Call (VictorOps) REST endpoint
+type VictorOpsNotifierConfig struct {
+	APIKey          string `yaml:"api_key" secret:"true"` // key of the REST integration
+	RoutingKey      string `yaml:"routing_key"`           // routes alerts to an escalation policy
+	ResolveAfterMin int    `yaml:"resolve_after_min"`     // minutes without anomalies before a recovery is sent, defaults to 10
+}
+
+// victorOpsNotifier uses the series fingerprint as entity_id, so repeated anomalies update the
+// same incident, and sends a RECOVERY once the series has been quiet for resolve_after_min
+type victorOpsNotifier struct {
+	name     string
+	config   VictorOpsNotifierConfig
+	url      string
+	client   *http.Client
+	template *messageTemplate // overrides the entity display name and state message of the alerts
+
+	mu     sync.Mutex
+	firing map[string]firingAlert // by fingerprint
+}
+
+type victorOpsAlert struct {
+	MessageType       string `json:"message_type"` // CRITICAL, WARNING, ACKNOWLEDGEMENT or RECOVERY
+	EntityID          string `json:"entity_id"`
+	EntityDisplayName string `json:"entity_display_name"`
+	StateMessage      string `json:"state_message"`
+	StateStartTime    int64  `json:"state_start_time"`
+	MonitoringTool    string `json:"monitoring_tool"`
+}
+
+func newVictorOpsNotifier(name string, config VictorOpsNotifierConfig) (*victorOpsNotifier, error) {
+	if config.APIKey == "" || config.RoutingKey == "" {
+		return nil, fmt.Errorf("api_key and routing_key are required")
+	}
+	if config.ResolveAfterMin == 0 {
+		config.ResolveAfterMin = 10
+	}
+	return &victorOpsNotifier{
+		name:   name,
+		config: config,
+		url:    victorOpsAPI + "/" + url.PathEscape(config.APIKey) + "/" + url.PathEscape(config.RoutingKey),
+		client: &http.Client{Timeout: 10 * time.Second},
+		firing: make(map[string]firingAlert),
+	}, nil
+}
+
+func (n *victorOpsNotifier) Name() string {
+	return n.name
+}
+
+func (n *victorOpsNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	for _, anomaly := range anomalies {
+		messageType := "WARNING"
+		if anomaly.Severity == SeverityCritical {
+			messageType = "CRITICAL"
+		}
+		alert := victorOpsAlert{
+			MessageType:       messageType,
+			EntityID:          anomaly.Fingerprint,
+			EntityDisplayName: n.template.title(anomaly, fmt.Sprintf("Anomaly on %s", anomaly.displayName())),
+			StateMessage: n.template.body(anomaly, fmt.Sprintf("Value %s on %s at %s - %s (fingerprint %s, id %s)%s",
+				anomaly.formattedValue(), anomaly.resource(), displayTime(anomaly.Timestamp), anomaly.Message, anomaly.Fingerprint, anomaly.ID, anomaly.queryLinks())),
+			StateStartTime: anomaly.Timestamp.Unix(),
+			MonitoringTool: "gcp-anomaly-detector",
+		}
+		if err := postJSON(ctx, n.client, n.url, nil, alert); err != nil {
+			return err
+		}
+
+		n.mu.Lock()
+		n.firing[anomaly.Fingerprint] = firingAlert{anomaly: anomaly, sentAt: time.Now()}
+		n.mu.Unlock()
+	}
+	return nil
+}
+
+func (n *victorOpsNotifier) resolveStale(ctx context.Context, now time.Time) error {
+	resolveAfter := time.Duration(n.config.ResolveAfterMin) * time.Minute
+
+	n.mu.Lock()
+	var stale []firingAlert
+	for _, alert := range n.firing {
+		if now.Sub(alert.sentAt) >= resolveAfter {
+			stale = append(stale, alert)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, firing := range stale {
+		anomaly := firing.anomaly
+		alert := victorOpsAlert{
+			MessageType:       "RECOVERY",
+			EntityID:          anomaly.Fingerprint,
+			EntityDisplayName: n.template.title(anomaly, fmt.Sprintf("Anomaly on %s", anomaly.displayName())),
+			StateMessage:      fmt.Sprintf("No anomalies on %s since %s", anomaly.displayName(), displayTime(anomaly.Timestamp)),
+			StateStartTime:    now.Unix(),
+			MonitoringTool:    "gcp-anomaly-detector",
+		}
+		if err := postJSON(ctx, n.client, n.url, nil, alert); err != nil {
+			return err
+		}
+
+		n.mu.Lock()
+		if current, ok := n.firing[anomaly.Fingerprint]; ok && !current.sentAt.After(firing.sentAt) {
+			delete(n.firing, anomaly.Fingerprint)
+		}
+		n.mu.Unlock()
+	}
+	return nil
+}
+
+// transition acknowledges or recovers the incident of an alert still firing when its event is
+// acknowledged or resolved
+func (n *victorOpsNotifier) transition(ctx context.Context, event Event) error {
+	n.mu.Lock()
+	firing, ok := n.firing[event.Fingerprint]
+	n.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	anomaly := firing.anomaly
+	alert := victorOpsAlert{
+		MessageType:       "RECOVERY",
+		EntityID:          anomaly.Fingerprint,
+		EntityDisplayName: n.template.title(anomaly, fmt.Sprintf("Anomaly on %s", anomaly.displayName())),
+		StateMessage:      fmt.Sprintf("Event %s resolved by %s", event.ID, event.latest().Actor),
+		StateStartTime:    time.Now().Unix(),
+		MonitoringTool:    "gcp-anomaly-detector",
+	}
+	if event.State == EventAcknowledged {
+		alert.MessageType = "ACKNOWLEDGEMENT"
+		alert.StateMessage = fmt.Sprintf("Event %s acknowledged by %s", event.ID, event.latest().Actor)
+	}
+	if err := postJSON(ctx, n.client, n.url, nil, alert); err != nil {
+		return err
+	}
+
+	if event.State == EventResolved {
+		n.mu.Lock()
+		if current, ok := n.firing[anomaly.Fingerprint]; ok && !current.sentAt.After(firing.sentAt) {
+			delete(n.firing, anomaly.Fingerprint)
+		}
+		n.mu.Unlock()
+	}
+	return nil
+}
+
+func (n *victorOpsNotifier) setTemplate(t *messageTemplate) error {
+	n.template = t
+	return t.supports(true, true, false)
+}
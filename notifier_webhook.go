@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// webhookSignatureHeader carries the signature of a signed webhook request by default
+	webhookSignatureHeader = "X-Anomaly-Signature"
+	// webhookTimestampHeader carries the time a signed webhook request was signed by default
+	webhookTimestampHeader = "X-Anomaly-Timestamp"
+)
+
+// WebhookNotifierConfig posts the anomalies of every cycle as JSON to an HTTP endpoint, signed
+// with a shared secret so the receiver can tell they come from the detector
+type WebhookNotifierConfig struct {
+	URL             string            `yaml:"url" secret:"true"`
+	Headers         map[string]string `yaml:"headers" secret:"true"` // sent with every request, e.g. an authorization header
+	Secret          string            `yaml:"secret" secret:"true"`  // optional shared secret the requests are signed with, with HMAC-SHA256
+	SignatureHeader string            `yaml:"signature_header"`      // header of the signature, defaults to X-Anomaly-Signature
+	TimestampHeader string            `yaml:"timestamp_header"`      // header of the signing time, defaults to X-Anomaly-Timestamp
+}
+
+// webhookBody is the JSON body of a webhook request
+type webhookBody struct {
+	Anomalies []interface{} `json:"anomalies"` // in the schema of the notifier
+}
+
+type webhookNotifier struct {
+	name   string
+	config WebhookNotifierConfig
+	client *http.Client
+	schema anomalySchema
+}
+
+func newWebhookNotifier(name string, config WebhookNotifierConfig, schema anomalySchema) (*webhookNotifier, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("no url configured")
+	}
+	if config.SignatureHeader == "" {
+		config.SignatureHeader = webhookSignatureHeader
+	}
+	if config.TimestampHeader == "" {
+		config.TimestampHeader = webhookTimestampHeader
+	}
+	return &webhookNotifier{name: name, config: config, client: &http.Client{Timeout: 10 * time.Second}, schema: schema}, nil
+}
+
+func (n *webhookNotifier) Name() string {
+	return n.name
+}
+
+func (n *webhookNotifier) Notify(ctx context.Context, anomalies []Anomaly) error {
+	body := webhookBody{Anomalies: make([]interface{}, len(anomalies))}
+	for i, anomaly := range anomalies {
+		body.Anomalies[i] = n.schema.payload(anomaly)
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	header := http.Header{}
+	for name, value := range n.config.Headers {
+		header.Set(name, value)
+	}
+	if n.config.Secret != "" {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		header.Set(n.config.TimestampHeader, timestamp)
+		header.Set(n.config.SignatureHeader, webhookSignature(n.config.Secret, timestamp, data))
+	}
+	return postBody(ctx, n.client, n.config.URL, header, "application/json", data)
+}
+
+// webhookSignature signs the timestamp and body of a request: the hex HMAC-SHA256 of
+// "<timestamp>.<body>" keyed by the secret, prefixed with sha256=. Signing the timestamp lets
+// receivers reject replayed requests once it is too old.
+func webhookSignature(secret, timestamp string, body []byte) string {
+	return "sha256=" + hex.EncodeToString(hmacSHA256([]byte(secret), timestamp+"."+string(body)))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWebhookSignature(t *testing.T) {
+	// printf '%s' '1700000000.{"anomalies":[]}' | openssl dgst -sha256 -hmac whsec_test
+	want := "sha256=2752bab65e7c051322495404b4362904302563b6de57436556408b87974ca97e"
+	if got := webhookSignature("whsec_test", "1700000000", []byte(`{"anomalies":[]}`)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got := webhookSignature("whsec_test", "1700000001", []byte(`{"anomalies":[]}`)); got == want {
+		t.Errorf("signature does not cover the timestamp")
+	}
+}
+
+func TestWebhookSignedRequest(t *testing.T) {
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan request, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- request{header: r.Header, body: body}
+	}))
+	defer server.Close()
+
+	notifier, err := newWebhookNotifier("webhook", WebhookNotifierConfig{URL: server.URL, Secret: "whsec_test", SignatureHeader: "X-Signature"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify(context.Background(), []Anomaly{{ID: "a1", MetricName: "latency", Severity: "critical"}}); err != nil {
+		t.Fatal(err)
+	}
+	received := <-requests
+
+	// Verify the request as a receiver would
+	timestamp := received.header.Get(webhookTimestampHeader)
+	signed, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		t.Fatalf("got timestamp %q: %v", timestamp, err)
+	}
+	if age := time.Since(time.Unix(signed, 0)); age < 0 || age > time.Minute {
+		t.Errorf("request signed %s ago", age)
+	}
+	if got := received.header.Get(webhookSignatureHeader); got != "" {
+		t.Errorf("got %s on the default header, want it on the configured one", webhookSignatureHeader)
+	}
+	want := webhookSignature("whsec_test", timestamp, received.body)
+	if got := received.header.Get("X-Signature"); !hmac.Equal([]byte(got), []byte(want)) {
+		t.Errorf("got signature %q, want %q", got, want)
+	}
+}
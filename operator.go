@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+)
+
+const (
+	anomalyDetectorGroup    = "anomaly.krzko.io"
+	anomalyDetectorVersion  = "v1alpha1"
+	anomalyDetectorResource = "anomalydetectors"
+
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+)
+
+// AnomalyDetectorResource is a detection target declared as an AnomalyDetector custom resource
+type AnomalyDetectorResource struct {
+	Metadata struct {
+		Name       string `json:"name"`
+		Namespace  string `json:"namespace"`
+		Generation int64  `json:"generation"`
+	} `json:"metadata"`
+	Spec AnomalyDetectorSpec `json:"spec"`
+}
+
+// AnomalyDetectorSpec configures the detection of a single metric
+type AnomalyDetectorSpec struct {
+	ProjectID        string   `json:"projectID"`
+	Metric           string   `json:"metric"`
+	Filter           string   `json:"filter"`
+	ZScoreThreshold  float64  `json:"zScoreThreshold"`
+	BaselineDuration int      `json:"baselineDuration"`
+	RecentDuration   int      `json:"recentDuration"`
+	Notifiers        []string `json:"notifiers"`
+}
+
+// AnomalyDetectorStatus is reported back on the status subresource after each reconcile
+type AnomalyDetectorStatus struct {
+	ObservedGeneration int64     `json:"observedGeneration"`
+	BaselineReady      bool      `json:"baselineReady"`
+	LastRunTime        time.Time `json:"lastRunTime"`
+	Anomalies          int       `json:"anomalies"`
+	Message            string    `json:"message"`
+}
+
+type anomalyDetectorList struct {
+	Items []AnomalyDetectorResource `json:"items"`
+}
+
+// operatorTarget holds the reconciled state of one AnomalyDetector resource
+type operatorTarget struct {
+	generation int64
+	config     *Config
+	detector   *SimpleAnomalyDetector
+	router     *Router
+}
+
+// operator reconciles AnomalyDetector resources into running detectors
+type operator struct {
+	kube      *kubeClient
+	client    *monitoring.MetricClient
+	config    *Config
+	router    *Router
+	namespace string
+	targets   map[string]*operatorTarget
+}
+
+// runOperator watches AnomalyDetector resources and runs a detection cycle for each of them on
+// every resync interval
+func runOperator(args []string) {
+	fs := flag.NewFlagSet("operator", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file providing defaults")
+	credentials := addCredentialFlags(fs)
+	namespace := fs.String("namespace", "", "Namespace to watch (defaults to all namespaces)")
+	apiServer := fs.String("api-server", "", "Kubernetes API server URL (defaults to the in-cluster service)")
+	resync := fs.Duration("resync", 0, "Interval between reconciles (defaults to polling_time)")
+	fs.Parse(args)
+
+	config := mustLoadConfig(*configPath)
+	config.Credentials.override(*credentials)
+
+	kube, err := newKubeClient(*apiServer)
+	if err != nil {
+		log.Fatalf("Failed to create Kubernetes client: %v", err)
+	}
+
+	op := &operator{
+		kube:      kube,
+		client:    mustCreateClient(config.Credentials, config.MonitoringAPI),
+		config:    config,
+		router:    mustCreateRouter(config),
+		namespace: *namespace,
+		targets:   make(map[string]*operatorTarget),
+	}
+
+	interval := *resync
+	if interval == 0 {
+		interval = time.Duration(config.PollingTime) * time.Second
+	}
+	if interval <= 0 {
+		log.Fatalf("A positive -resync or polling_time is required")
+	}
+
+	ctx := context.Background()
+	op.reconcile(ctx)
+
+	ticker := time.NewTicker(interval)
+	log.Printf("Reconciling every %v...\n", interval)
+	for range ticker.C {
+		op.reconcile(ctx)
+	}
+}
+
+// reconcile lists the AnomalyDetector resources, (re)initialises the baseline of new or changed
+// targets, drops deleted ones and runs a detection cycle for every target
+func (o *operator) reconcile(ctx context.Context) {
+	resources, err := o.kube.listAnomalyDetectors(ctx, o.namespace)
+	if err != nil {
+		log.Printf("Failed to list AnomalyDetector resources: %v", err)
+		return
+	}
+
+	seen := make(map[string]bool)
+	for _, resource := range resources {
+		key := resource.Metadata.Namespace + "/" + resource.Metadata.Name
+		seen[key] = true
+
+		status := o.reconcileTarget(ctx, key, resource)
+		if err := o.kube.updateAnomalyDetectorStatus(ctx, resource.Metadata.Namespace, resource.Metadata.Name, status); err != nil {
+			log.Printf("Failed to update status of %s: %v", key, err)
+		}
+	}
+
+	for key := range o.targets {
+		if !seen[key] {
+			log.Printf("AnomalyDetector %s was deleted, stopping detection\n", key)
+			delete(o.targets, key)
+		}
+	}
+}
+
+func (o *operator) reconcileTarget(ctx context.Context, key string, resource AnomalyDetectorResource) AnomalyDetectorStatus {
+	status := AnomalyDetectorStatus{
+		ObservedGeneration: resource.Metadata.Generation,
+		LastRunTime:        time.Now().UTC(),
+	}
+
+	if resource.Spec.Metric == "" {
+		status.Message = "spec.metric is required"
+		return status
+	}
+
+	target, ok := o.targets[key]
+	if !ok || target.generation != resource.Metadata.Generation {
+		router, err := o.router.Subset(resource.Spec.Notifiers)
+		if err != nil {
+			delete(o.targets, key)
+			status.Message = fmt.Sprintf("invalid notifiers: %v", redactError(err))
+			return status
+		}
+
+		log.Printf("Initialising baseline for AnomalyDetector %s (generation %d)...\n", key, resource.Metadata.Generation)
+		config := o.targetConfig(resource.Spec)
+		detector, err := buildBaseline(o.client, config)
+		if err != nil {
+			delete(o.targets, key)
+			status.Message = fmt.Sprintf("failed to initialise baseline: %v", redactError(err))
+			return status
+		}
+		detector.events = router.Events()
+		target = &operatorTarget{
+			generation: resource.Metadata.Generation,
+			config:     config,
+			detector:   detector,
+			router:     router,
+		}
+		o.targets[key] = target
+	}
+	status.BaselineReady = true
+
+	anomalies, err := runCycle(o.client, target.config, target.detector, target.config.MetricTypes())
+	if err != nil {
+		status.Message = fmt.Sprintf("detection cycle failed: %v", redactError(err))
+		return status
+	}
+	target.router.ReportCycle(ctx, anomalies, target.detector.FetchFailures())
+
+	status.Anomalies = len(anomalies)
+	status.Message = fmt.Sprintf("%d anomalies detected", len(anomalies))
+	return status
+}
+
+// targetConfig derives the configuration of a target from the operator defaults and the spec
+func (o *operator) targetConfig(spec AnomalyDetectorSpec) *Config {
+	config := *o.config
+	config.Metrics = []MetricConfig{{Type: spec.Metric}}
+	config.Filters = make(map[string]string)
+	if spec.Filter != "" {
+		config.Filters[spec.Metric] = spec.Filter
+	}
+	if spec.ProjectID != "" {
+		config.ProjectID = spec.ProjectID
+	}
+	if spec.ZScoreThreshold > 0 {
+		config.ZScoreThreshold = spec.ZScoreThreshold
+	}
+	if spec.BaselineDuration > 0 {
+		config.BaselineDuration = spec.BaselineDuration
+	}
+	if spec.RecentDuration > 0 {
+		config.RecentDuration = spec.RecentDuration
+	}
+	return &config
+}
+
+// kubeClient is a minimal client for the Kubernetes REST API
+type kubeClient struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// newKubeClient connects to the given API server, or to the in-cluster API server using the
+// pod's service account when apiServer is empty. An explicit server is useful together with
+// kubectl proxy during development.
+func newKubeClient(apiServer string) (*kubeClient, error) {
+	if apiServer != "" {
+		return &kubeClient{baseURL: strings.TrimSuffix(apiServer, "/"), http: http.DefaultClient}, nil
+	}
+
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a cluster and no -api-server given")
+	}
+
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("could not read service account token: %v", err)
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("could not read service account CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("could not parse service account CA")
+	}
+
+	return &kubeClient{
+		baseURL: "https://" + host + ":" + port,
+		token:   strings.TrimSpace(string(token)),
+		http: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+func (k *kubeClient) listAnomalyDetectors(ctx context.Context, namespace string) ([]AnomalyDetectorResource, error) {
+	path := fmt.Sprintf("/apis/%s/%s/%s", anomalyDetectorGroup, anomalyDetectorVersion, anomalyDetectorResource)
+	if namespace != "" {
+		path = fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s", anomalyDetectorGroup, anomalyDetectorVersion, namespace, anomalyDetectorResource)
+	}
+
+	var list anomalyDetectorList
+	if err := k.do(ctx, http.MethodGet, path, "", nil, &list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+func (k *kubeClient) updateAnomalyDetectorStatus(ctx context.Context, namespace, name string, status AnomalyDetectorStatus) error {
+	path := fmt.Sprintf("/apis/%s/%s/namespaces/%s/%s/%s/status", anomalyDetectorGroup, anomalyDetectorVersion, namespace, anomalyDetectorResource, name)
+	patch, err := json.Marshal(map[string]interface{}{"status": status})
+	if err != nil {
+		return err
+	}
+	return k.do(ctx, http.MethodPatch, path, "application/merge-patch+json", patch, nil)
+}
+
+func (k *kubeClient) do(ctx context.Context, method, path, contentType string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, k.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if k.token != "" {
+		req.Header.Set("Authorization", "Bearer "+k.token)
+	}
+
+	resp, err := k.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &kubeAPIError{
+			status:  resp.StatusCode,
+			message: fmt.Sprintf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(message))),
+		}
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// kubeAPIError is returned for requests the API server answered with a non-2xx status
+type kubeAPIError struct {
+	status  int
+	message string
+}
+
+func (e *kubeAPIError) Error() string {
+	return e.message
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// OTLPConfig pushes the anomaly scores of every series and counts of the anomalies found to an
+// OpenTelemetry collector after every detection cycle, over OTLP/HTTP with JSON encoding
+type OTLPConfig struct {
+	Endpoint string            `yaml:"endpoint"`              // base URL of the collector, defaults to $OTEL_EXPORTER_OTLP_ENDPOINT or http://localhost:4318
+	Headers  map[string]string `yaml:"headers" secret:"true"` // sent with every request, e.g. an authorization header
+}
+
+// OTLP aggregation temporality of cumulative sums
+const otlpCumulative = 2
+
+// otlpExporter pushes the metrics of every cycle. The anomaly and fetch failure counts are
+// cumulative since the exporter started.
+type otlpExporter struct {
+	url       string
+	headers   http.Header
+	projectID string
+	client    *http.Client
+
+	// skew is set with clock_skew and its measurement pushed with the timings
+	skew *clockSkew
+
+	startTime     time.Time
+	counts        map[anomalyCountKey]int64
+	fetchFailures map[string]int64 // by metric type
+}
+
+// anomalyCountKey identifies an anomaly count by the attributes it is recorded with
+type anomalyCountKey struct {
+	metricType, kind, severity string
+}
+
+func newOTLPExporter(config OTLPConfig, projectID string) *otlpExporter {
+	registerSecrets(config)
+	endpoint := config.Endpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if endpoint == "" {
+		endpoint = "http://localhost:4318"
+	}
+	headers := make(http.Header)
+	for key, value := range config.Headers {
+		headers.Set(key, value)
+	}
+	return &otlpExporter{
+		url:       strings.TrimSuffix(endpoint, "/") + "/v1/metrics",
+		headers:   headers,
+		projectID: projectID,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		startTime: time.Now(),
+		counts:    make(map[anomalyCountKey]int64),
+
+		fetchFailures: make(map[string]int64),
+	}
+}
+
+// cycle counts the anomalies and the metrics that could not be fetched of a cycle and pushes the
+// counts with the newest scores of the series and the timings of the polling cycles. A failed
+// push is logged, as it must not hold up detection.
+func (e *otlpExporter) cycle(ctx context.Context, points []SeriesPoint, anomalies []Anomaly, fetchFailures map[string]error, timings []cycleTiming, now time.Time) {
+	for _, anomaly := range anomalies {
+		e.counts[anomalyCountKey{metricType: anomaly.MetricName, kind: anomaly.Kind, severity: anomaly.Severity}]++
+	}
+	for metricType := range fetchFailures {
+		e.fetchFailures[metricType]++
+	}
+	if err := postJSON(ctx, e.client, e.url, e.headers, e.request(points, timings, now)); err != nil {
+		log.Printf("Failed to push metrics over OTLP: %v", err)
+	}
+}
+
+// request builds the OTLP ExportMetricsServiceRequest in its JSON mapping
+func (e *otlpExporter) request(points []SeriesPoint, timings []cycleTiming, now time.Time) map[string]interface{} {
+	scores := make([]map[string]interface{}, 0, len(points))
+	for _, point := range points {
+		attributes := map[string]string{"metric_type": point.MetricName, "fingerprint": point.Fingerprint}
+		for key, value := range point.Labels {
+			if _, exists := attributes[key]; exists {
+				key = "exported_" + key
+			}
+			attributes[key] = value
+		}
+		scores = append(scores, map[string]interface{}{
+			"attributes":   otlpAttributes(attributes),
+			"timeUnixNano": strconv.FormatInt(point.Timestamp.UnixNano(), 10),
+			"asDouble":     point.ZScore,
+		})
+	}
+
+	keys := make([]anomalyCountKey, 0, len(e.counts))
+	for key := range e.counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].metricType != keys[j].metricType {
+			return keys[i].metricType < keys[j].metricType
+		}
+		if keys[i].kind != keys[j].kind {
+			return keys[i].kind < keys[j].kind
+		}
+		return keys[i].severity < keys[j].severity
+	})
+	counts := make([]map[string]interface{}, 0, len(keys))
+	for _, key := range keys {
+		counts = append(counts, map[string]interface{}{
+			"attributes":        otlpAttributes(map[string]string{"metric_type": key.metricType, "kind": key.kind, "severity": key.severity}),
+			"startTimeUnixNano": strconv.FormatInt(e.startTime.UnixNano(), 10),
+			"timeUnixNano":      strconv.FormatInt(now.UnixNano(), 10),
+			"asInt":             strconv.FormatInt(e.counts[key], 10),
+		})
+	}
+
+	metrics := []map[string]interface{}{{
+		"name":        "gcp_anomaly_detector.series.z_score",
+		"description": "Z-score of the newest point of the series against its baseline",
+		"unit":        "1",
+		"gauge":       map[string]interface{}{"dataPoints": scores},
+	}}
+	if len(counts) > 0 {
+		metrics = append(metrics, map[string]interface{}{
+			"name":        "gcp_anomaly_detector.anomalies",
+			"description": "Anomalies detected, by metric, kind and severity",
+			"unit":        "{anomaly}",
+			"sum": map[string]interface{}{
+				"dataPoints":             counts,
+				"aggregationTemporality": otlpCumulative,
+				"isMonotonic":            true,
+			},
+		})
+	}
+	if len(e.fetchFailures) > 0 {
+		metricTypes := make([]string, 0, len(e.fetchFailures))
+		for metricType := range e.fetchFailures {
+			metricTypes = append(metricTypes, metricType)
+		}
+		sort.Strings(metricTypes)
+		failures := make([]map[string]interface{}, 0, len(metricTypes))
+		for _, metricType := range metricTypes {
+			failures = append(failures, map[string]interface{}{
+				"attributes":        otlpAttributes(map[string]string{"metric_type": metricType}),
+				"startTimeUnixNano": strconv.FormatInt(e.startTime.UnixNano(), 10),
+				"timeUnixNano":      strconv.FormatInt(now.UnixNano(), 10),
+				"asInt":             strconv.FormatInt(e.fetchFailures[metricType], 10),
+			})
+		}
+		metrics = append(metrics, map[string]interface{}{
+			"name":        "gcp_anomaly_detector.fetch_failures",
+			"description": "Cycles in which the recent window of the metric could not be fetched",
+			"unit":        "{cycle}",
+			"sum": map[string]interface{}{
+				"dataPoints":             failures,
+				"aggregationTemporality": otlpCumulative,
+				"isMonotonic":            true,
+			},
+		})
+	}
+	if len(timings) > 0 {
+		metrics = append(metrics, e.timingMetrics(timings, now)...)
+	}
+	if e.skew != nil {
+		metrics = append(metrics, e.skew.otlpMetrics(now)...)
+	}
+	return map[string]interface{}{
+		"resourceMetrics": []map[string]interface{}{{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]string{"service.name": "gcp-anomaly-detector", "gcp.project_id": e.projectID}),
+			},
+			"scopeMetrics": []map[string]interface{}{{
+				"scope":   map[string]interface{}{"name": "github.com/krzko/gcp-anomaly-detector"},
+				"metrics": metrics,
+			}},
+		}},
+	}
+}
+
+// timingMetrics returns the duration and skew of the last cycle of every polling group and the
+// cycles skipped since the exporter started, by polling interval
+func (e *otlpExporter) timingMetrics(timings []cycleTiming, now time.Time) []map[string]interface{} {
+	var durations, skews, skipped []map[string]interface{}
+	for _, timing := range timings {
+		attributes := otlpAttributes(map[string]string{"polling_interval": timing.interval.String()})
+		durations = append(durations, map[string]interface{}{
+			"attributes":   attributes,
+			"timeUnixNano": strconv.FormatInt(now.UnixNano(), 10),
+			"asDouble":     timing.duration.Seconds(),
+		})
+		skews = append(skews, map[string]interface{}{
+			"attributes":   attributes,
+			"timeUnixNano": strconv.FormatInt(now.UnixNano(), 10),
+			"asDouble":     timing.skew.Seconds(),
+		})
+		skipped = append(skipped, map[string]interface{}{
+			"attributes":        attributes,
+			"startTimeUnixNano": strconv.FormatInt(e.startTime.UnixNano(), 10),
+			"timeUnixNano":      strconv.FormatInt(now.UnixNano(), 10),
+			"asInt":             strconv.FormatInt(timing.skipped, 10),
+		})
+	}
+	return []map[string]interface{}{
+		{
+			"name":        "gcp_anomaly_detector.cycle.duration",
+			"description": "Duration of the last completed detection cycle of the metrics polled at the interval",
+			"unit":        "s",
+			"gauge":       map[string]interface{}{"dataPoints": durations},
+		},
+		{
+			"name":        "gcp_anomaly_detector.cycle.skew",
+			"description": "How late the last detection cycle of the metrics polled at the interval started after its scheduled time",
+			"unit":        "s",
+			"gauge":       map[string]interface{}{"dataPoints": skews},
+		},
+		{
+			"name":        "gcp_anomaly_detector.cycles.skipped",
+			"description": "Detection cycles skipped because an earlier cycle outlasted the polling interval",
+			"unit":        "{cycle}",
+			"sum": map[string]interface{}{
+				"dataPoints":             skipped,
+				"aggregationTemporality": otlpCumulative,
+				"isMonotonic":            true,
+			},
+		},
+	}
+}
+
+// otlpAttributes converts attributes to OTLP key-values, sorted by key
+func otlpAttributes(attributes map[string]string) []map[string]interface{} {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	values := make([]map[string]interface{}, len(keys))
+	for i, key := range keys {
+		values[i] = map[string]interface{}{"key": key, "value": map[string]string{"stringValue": attributes[key]}}
+	}
+	return values
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// The Parquet writer below covers what the exporter needs: a single row group of required,
+// flat columns, PLAIN encoded in one uncompressed data page each. Such files are read by any
+// Parquet reader, including BigQuery, DuckDB, pandas and Spark.
+
+// Parquet physical types
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+// Parquet converted types
+const (
+	parquetNoConversion    = -1
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+)
+
+const (
+	parquetEncodingPlain = 0
+	parquetEncodingRLE   = 3
+)
+
+// parquetColumn is a required column with its PLAIN encoded values
+type parquetColumn struct {
+	name          string
+	physicalType  int32
+	convertedType int32
+	values        []byte
+	count         int
+}
+
+func stringColumn(name string, values []string) parquetColumn {
+	var encoded []byte
+	for _, value := range values {
+		encoded = binary.LittleEndian.AppendUint32(encoded, uint32(len(value)))
+		encoded = append(encoded, value...)
+	}
+	return parquetColumn{name: name, physicalType: parquetByteArray, convertedType: parquetUTF8, values: encoded, count: len(values)}
+}
+
+func doubleColumn(name string, values []float64) parquetColumn {
+	encoded := make([]byte, 0, 8*len(values))
+	for _, value := range values {
+		encoded = binary.LittleEndian.AppendUint64(encoded, math.Float64bits(value))
+	}
+	return parquetColumn{name: name, physicalType: parquetDouble, convertedType: parquetNoConversion, values: encoded, count: len(values)}
+}
+
+func int64Column(name string, values []int64) parquetColumn {
+	encoded := make([]byte, 0, 8*len(values))
+	for _, value := range values {
+		encoded = binary.LittleEndian.AppendUint64(encoded, uint64(value))
+	}
+	return parquetColumn{name: name, physicalType: parquetInt64, convertedType: parquetNoConversion, values: encoded, count: len(values)}
+}
+
+// timestampColumn stores times as milliseconds since the Unix epoch, in UTC
+func timestampColumn(name string, values []time.Time) parquetColumn {
+	millis := make([]int64, len(values))
+	for i, value := range values {
+		millis[i] = value.UnixMilli()
+	}
+	column := int64Column(name, millis)
+	column.convertedType = parquetTimestampMillis
+	return column
+}
+
+// encodeParquet writes the columns, which must all hold rows values, as a Parquet file
+func encodeParquet(columns []parquetColumn, rows int) []byte {
+	var file bytes.Buffer
+	file.WriteString("PAR1")
+
+	type chunk struct {
+		offset, size int64
+	}
+	chunks := make([]chunk, len(columns))
+	for i, column := range columns {
+		header := &thriftWriter{}
+		header.writeI32(1, 0) // DATA_PAGE
+		header.writeI32(2, int32(len(column.values)))
+		header.writeI32(3, int32(len(column.values)))
+		header.beginStruct(5) // DataPageHeader
+		header.writeI32(1, int32(column.count))
+		header.writeI32(2, parquetEncodingPlain)
+		header.writeI32(3, parquetEncodingRLE)
+		header.writeI32(4, parquetEncodingRLE)
+		header.endStruct()
+		header.endStruct()
+
+		chunks[i] = chunk{offset: int64(file.Len()), size: int64(header.buf.Len() + len(column.values))}
+		file.Write(header.buf.Bytes())
+		file.Write(column.values)
+	}
+
+	footer := &thriftWriter{}
+	footer.writeI32(1, 1) // version
+	footer.beginList(2, thriftStruct, len(columns)+1)
+	footer.beginElement()
+	footer.writeBinary(4, "schema")
+	footer.writeI32(5, int32(len(columns)))
+	footer.endStruct()
+	for _, column := range columns {
+		footer.beginElement()
+		footer.writeI32(1, column.physicalType)
+		footer.writeI32(3, 0) // REQUIRED
+		footer.writeBinary(4, column.name)
+		if column.convertedType != parquetNoConversion {
+			footer.writeI32(6, column.convertedType)
+		}
+		footer.endStruct()
+	}
+	footer.writeI64(3, int64(rows))
+
+	var totalSize int64
+	for _, chunk := range chunks {
+		totalSize += chunk.size
+	}
+	footer.beginList(4, thriftStruct, 1)
+	footer.beginElement() // RowGroup
+	footer.beginList(1, thriftStruct, len(columns))
+	for i, column := range columns {
+		footer.beginElement() // ColumnChunk
+		footer.writeI64(2, chunks[i].offset)
+		footer.beginStruct(3) // ColumnMetaData
+		footer.writeI32(1, column.physicalType)
+		footer.beginList(2, thriftI32, 2)
+		footer.writeListI32(parquetEncodingPlain)
+		footer.writeListI32(parquetEncodingRLE)
+		footer.beginList(3, thriftBinary, 1)
+		footer.writeListBinary(column.name)
+		footer.writeI32(4, 0) // UNCOMPRESSED
+		footer.writeI64(5, int64(column.count))
+		footer.writeI64(6, chunks[i].size)
+		footer.writeI64(7, chunks[i].size)
+		footer.writeI64(9, chunks[i].offset)
+		footer.endStruct()
+		footer.endStruct()
+	}
+	footer.writeI64(2, totalSize)
+	footer.writeI64(3, int64(rows))
+	footer.endStruct()
+	footer.writeBinary(6, "gcp-anomaly-detector")
+	footer.endStruct()
+
+	file.Write(footer.buf.Bytes())
+	file.Write(binary.LittleEndian.AppendUint32(nil, uint32(footer.buf.Len())))
+	file.WriteString("PAR1")
+	return file.Bytes()
+}
+
+// Thrift compact protocol types
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes structs with the Thrift compact protocol, which Parquet uses for its
+// metadata. The struct being written is implicit: fields are written in increasing id order and
+// each struct is closed with endStruct, including the outermost one.
+type thriftWriter struct {
+	buf bytes.Buffer
+	// lastField holds the id of the last field written per open struct, as field ids are
+	// encoded as deltas
+	lastField []int16
+}
+
+func (w *thriftWriter) fieldHeader(id int16, fieldType byte) {
+	if len(w.lastField) == 0 {
+		w.lastField = append(w.lastField, 0)
+	}
+	last := &w.lastField[len(w.lastField)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.buf.WriteByte(byte(delta)<<4 | fieldType)
+	} else {
+		w.buf.WriteByte(fieldType)
+		w.varint(uint64(zigzag(int64(id))))
+	}
+	*last = id
+}
+
+func (w *thriftWriter) writeI32(id int16, value int32) {
+	w.fieldHeader(id, thriftI32)
+	w.varint(zigzag(int64(value)))
+}
+
+func (w *thriftWriter) writeI64(id int16, value int64) {
+	w.fieldHeader(id, thriftI64)
+	w.varint(zigzag(value))
+}
+
+func (w *thriftWriter) writeBinary(id int16, value string) {
+	w.fieldHeader(id, thriftBinary)
+	w.writeListBinary(value)
+}
+
+func (w *thriftWriter) beginStruct(id int16) {
+	w.fieldHeader(id, thriftStruct)
+	w.lastField = append(w.lastField, 0)
+}
+
+// beginElement starts a struct that is an element of a list
+func (w *thriftWriter) beginElement() {
+	w.lastField = append(w.lastField, 0)
+}
+
+func (w *thriftWriter) endStruct() {
+	w.buf.WriteByte(0) // stop field
+	if len(w.lastField) > 0 {
+		w.lastField = w.lastField[:len(w.lastField)-1]
+	}
+}
+
+func (w *thriftWriter) beginList(id int16, elementType byte, size int) {
+	w.fieldHeader(id, thriftList)
+	if size < 15 {
+		w.buf.WriteByte(byte(size)<<4 | elementType)
+	} else {
+		w.buf.WriteByte(0xf0 | elementType)
+		w.varint(uint64(size))
+	}
+}
+
+func (w *thriftWriter) writeListI32(value int32) {
+	w.varint(zigzag(int64(value)))
+}
+
+func (w *thriftWriter) writeListBinary(value string) {
+	w.varint(uint64(len(value)))
+	w.buf.WriteString(value)
+}
+
+func (w *thriftWriter) varint(value uint64) {
+	w.buf.Write(binary.AppendUvarint(nil, value))
+}
+
+func zigzag(value int64) uint64 {
+	return uint64(value<<1) ^ uint64(value>>63)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// PeersConfig compares the groups of a metric's series with each other, such as its regions or
+// zones, so an incident in one region stands out even while the global aggregate looks normal
+type PeersConfig struct {
+	GroupBy         string  `yaml:"group_by"`          // series label forming the groups, e.g. zone or region
+	ZScoreThreshold float64 `yaml:"z_score_threshold"` // defaults to the global threshold
+	MinPeers        int     `yaml:"min_peers"`         // groups needed for a comparison, defaults to 3
+}
+
+func (c PeersConfig) validate() error {
+	if c.GroupBy == "" {
+		return fmt.Errorf("group_by is required")
+	}
+	if c.MinPeers != 0 && c.MinPeers < 3 {
+		return fmt.Errorf("min_peers must be at least 3")
+	}
+	return nil
+}
+
+// peerGroup is the recent points of the series of one group
+type peerGroup struct {
+	name   string
+	stats  RunningStats
+	latest time.Time
+	unit   string
+}
+
+// ComparePeers scores the recent mean of every group of the metrics with a peer comparison
+// against the median and median absolute deviation of the other groups, so a single deviating
+// group cannot hide itself by skewing the peers. A deviating group is reported once until it
+// is back in line with its peers.
+func (d *SimpleAnomalyDetector) ComparePeers(recentMetrics []*monitoringpb.TimeSeries, config *Config) []Anomaly {
+	if d.peerOutliers == nil {
+		d.peerOutliers = make(map[string]bool)
+	}
+
+	byMetric := make(map[string][]*monitoringpb.TimeSeries)
+	for _, ts := range recentMetrics {
+		byMetric[ts.Metric.Type] = append(byMetric[ts.Metric.Type], ts)
+	}
+
+	var anomalies []Anomaly
+	for _, metricConfig := range config.Metrics {
+		if metricConfig.Peers == nil || len(byMetric[metricConfig.Type]) == 0 {
+			continue
+		}
+		anomalies = append(anomalies, d.comparePeers(metricConfig.Type, *metricConfig.Peers, byMetric[metricConfig.Type], config.ZScoreThreshold)...)
+	}
+	return anomalies
+}
+
+func (d *SimpleAnomalyDetector) comparePeers(metricType string, config PeersConfig, series []*monitoringpb.TimeSeries, threshold float64) []Anomaly {
+	if config.ZScoreThreshold != 0 {
+		threshold = config.ZScoreThreshold
+	}
+	if config.MinPeers == 0 {
+		config.MinPeers = 3
+	}
+
+	groups := groupPeers(series, config.GroupBy)
+	if len(groups) < config.MinPeers {
+		log.Printf("Peer comparison of %s skipped: %d groups by %s, %d needed\n", metricType, len(groups), config.GroupBy, config.MinPeers)
+		return nil
+	}
+
+	var anomalies []Anomaly
+	for i, group := range groups {
+		stats, mad := peerStats(groups, i)
+		median := stats.mean
+		zScore := d.zeroStdDev.zScore(group.stats.Mean, stats, threshold)
+
+		fingerprint := peerFingerprint(metricType, config.GroupBy, group.name)
+		if math.Abs(zScore) <= threshold {
+			if d.peerOutliers[fingerprint] {
+				log.Printf("Group %s=%s of %s is back in line with its peers\n", config.GroupBy, group.name, metricType)
+				delete(d.peerOutliers, fingerprint)
+			}
+			continue
+		}
+		if d.peerOutliers[fingerprint] {
+			continue
+		}
+		d.peerOutliers[fingerprint] = true
+		log.Printf("Peer comparison of %s: %s=%s mean %.2f, peer median %.2f, Z-score %.2f\n", metricType, config.GroupBy, group.name, group.stats.Mean, median, zScore)
+
+		margin := d.zeroStdDev.margin(stats, threshold)
+		expected := newExpectedRange(median-margin, median+margin, group.stats.Mean, median, group.unit)
+		anomalies = append(anomalies, Anomaly{
+			ID:         anomalyID(anomalyFingerprint(KindPeer, fingerprint), group.latest),
+			Kind:       KindPeer,
+			MetricName: metricType,
+			Value:      group.stats.Mean,
+			Unit:       group.unit,
+			ZScore:     zScore,
+			Timestamp:  group.latest,
+			Message: fmt.Sprintf("%s %s deviates from its %d peers with mean %s, median %s (MAD %s), %s",
+				config.GroupBy, group.name, stats.count, formatValue(group.stats.Mean, group.unit), formatValue(median, group.unit), formatValue(mad, group.unit), expected),
+
+			Fingerprint:       anomalyFingerprint(KindPeer, fingerprint),
+			SeriesFingerprint: fingerprint,
+			Labels:            map[string]string{config.GroupBy: group.name},
+			Expected:          expected,
+		})
+	}
+	return anomalies
+}
+
+// groupPeers collects the recent points of the series by their group, sorted by name. Series
+// without the label are left out.
+func groupPeers(series []*monitoringpb.TimeSeries, groupBy string) []*peerGroup {
+	byName := make(map[string]*peerGroup)
+	for _, ts := range series {
+		name := peerGroupName(seriesLabels(ts), groupBy)
+		if name == "" {
+			continue
+		}
+		group, ok := byName[name]
+		if !ok {
+			group = &peerGroup{name: name, unit: ts.Unit}
+			byName[name] = group
+		}
+		for _, point := range ts.Points {
+			group.stats.Add(pointValue(point))
+			if t := point.Interval.EndTime.AsTime(); t.After(group.latest) {
+				group.latest = t
+			}
+		}
+	}
+
+	groups := make([]*peerGroup, 0, len(byName))
+	for _, group := range byName {
+		if group.stats.Count > 0 {
+			groups = append(groups, group)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].name < groups[j].name })
+	return groups
+}
+
+// peerGroupName returns the group of a series. Resources only labelled with their zone are
+// grouped by its region when grouping by region, e.g. us-central1 for us-central1-a.
+func peerGroupName(labels map[string]string, groupBy string) string {
+	if name := labels[groupBy]; name != "" || groupBy != "region" {
+		return name
+	}
+	zone := labels["zone"]
+	if i := strings.LastIndex(zone, "-"); i > 0 {
+		return zone[:i]
+	}
+	return zone
+}
+
+// peerStats returns the median of the means of all groups but the i-th as the mean of the peers
+// and their MAD, scaled to estimate the StdDev of normally distributed peers, as the StdDev. The
+// unscaled MAD is returned as well.
+func peerStats(groups []*peerGroup, i int) (MetricStats, float64) {
+	peers := make([]float64, 0, len(groups)-1)
+	for j, peer := range groups {
+		if j != i {
+			peers = append(peers, peer.stats.Mean)
+		}
+	}
+	median, mad := medianAbsoluteDeviation(peers)
+	return MetricStats{mean: median, stddev: 1.4826 * mad, count: int64(len(peers))}, mad
+}
+
+// medianAbsoluteDeviation returns the median of the values and their median absolute deviation
+// from it
+func medianAbsoluteDeviation(values []float64) (float64, float64) {
+	median := medianOf(values)
+	deviations := make([]float64, len(values))
+	for i, value := range values {
+		deviations[i] = math.Abs(value - median)
+	}
+	return median, medianOf(deviations)
+}
+
+func medianOf(values []float64) float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// peerFingerprint identifies the comparison of a group of a metric's series with its peers
+func peerFingerprint(metricType, groupBy, group string) string {
+	sum := sha256.Sum256([]byte("peers\x00" + metricType + "\x00" + groupBy + "\x00" + group))
+	return hex.EncodeToString(sum[:8])
+}
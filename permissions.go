@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// requiredPermissions are IAM permissions a part of the configuration needs on a resource, with
+// the predefined role granting them
+type requiredPermissions struct {
+	resource    string // project ID, or the full name of a Cloud Tasks queue
+	permissions []string
+	role        string
+	user        string // what needs them, e.g. the cloud_monitoring notifier
+}
+
+// checkPermissions verifies that the credentials may read the time series of every monitored
+// project, with one header-only call each, and hold the write permissions of the enabled Google
+// Cloud destinations, so a missing role stops the detector at startup with the role to grant
+// rather than surfacing as a PermissionDenied error mid-run. Write permissions are tested with
+// testIamPermissions; when that call fails they are left unchecked with a warning.
+func checkPermissions(ctx context.Context, client *monitoring.MetricClient, config *Config, credentials CredentialsConfig) error {
+	if config.MonitoringAPI.Replay != "" {
+		return nil // Replayed responses need no permissions
+	}
+	var missing []string
+	for _, projectID := range config.monitoredProjects() {
+		if err := checkReadPermission(ctx, client, config, projectID); err != nil {
+			missing = append(missing, err.Error())
+		}
+	}
+
+	required := config.writePermissions()
+	if len(required) > 0 {
+		opts, err := credentials.clientOptions(ctx)
+		if err != nil {
+			return err
+		}
+		httpClient, _, err := htransport.NewClient(ctx, append(opts, option.WithScopes(cloudPlatformScope))...)
+		if err != nil {
+			return fmt.Errorf("could not create client: %v", err)
+		}
+		for _, r := range required {
+			granted, err := testIAMPermissions(ctx, httpClient, r.resource, r.permissions)
+			if err != nil {
+				log.Printf("Could not check the permissions of the %s on %s, leaving them to fail on first use: %v\n", r.user, r.resource, err)
+				continue
+			}
+			var lacking []string
+			for _, permission := range r.permissions {
+				if !granted[permission] {
+					lacking = append(lacking, permission)
+				}
+			}
+			if len(lacking) > 0 {
+				missing = append(missing, fmt.Sprintf("%s: the %s lacks %s; grant %s", r.resource, r.user, strings.Join(lacking, ", "), r.role))
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing permissions of the detector's credentials:\n  %s", strings.Join(missing, "\n  "))
+	}
+	return nil
+}
+
+// checkReadPermission lists one series header of a metric of the project, reporting a denied
+// call as the missing role
+func checkReadPermission(ctx context.Context, client *monitoring.MetricClient, config *Config, projectID string) error {
+	metricType := config.projectMetric(projectID)
+	endTime := time.Now()
+	it := client.ListTimeSeries(ctx, &monitoringpb.ListTimeSeriesRequest{
+		Name:   "projects/" + projectID,
+		Filter: fmt.Sprintf("metric.type=\"%s\"", metricType),
+		Interval: &monitoringpb.TimeInterval{
+			StartTime: timestamppb.New(endTime.Add(-time.Minute)),
+			EndTime:   timestamppb.New(endTime),
+		},
+		View:     monitoringpb.ListTimeSeriesRequest_HEADERS,
+		PageSize: 1,
+	})
+	_, err := it.Next()
+	switch status.Code(err) {
+	case codes.PermissionDenied:
+		return fmt.Errorf("%s: reading metrics lacks monitoring.timeSeries.list; grant roles/monitoring.viewer", projectID)
+	case codes.Unauthenticated:
+		return fmt.Errorf("%s: the credentials were rejected: %s", projectID, status.Convert(err).Message())
+	}
+	// Other errors, such as rejected filters, are reported by the filter validation
+	return nil
+}
+
+// monitoredProjects returns the projects metrics are read from: the project and those of
+// reference environments
+func (c *Config) monitoredProjects() []string {
+	projects := map[string]bool{c.ProjectID: true}
+	for _, metric := range c.Metrics {
+		if metric.Reference != nil && metric.Reference.ProjectID != "" {
+			projects[metric.Reference.ProjectID] = true
+		}
+	}
+	var ids []string
+	for id := range projects {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// projectMetric returns a metric type read from the project, to test reading it with
+func (c *Config) projectMetric(projectID string) string {
+	for _, metric := range c.Metrics {
+		switch {
+		case metric.Reference != nil && metric.Reference.ProjectID == projectID:
+			return metric.Type
+		case projectID != c.ProjectID:
+		case metric.Ratio != nil:
+			return metric.Ratio.Numerator.Type
+		case metric.Expression == nil:
+			return metric.Type
+		}
+	}
+	// Any metric type proves the permission, as an empty response is not an error
+	return "monitoring.googleapis.com/uptime_check/check_passed"
+}
+
+// defaultString returns s, or def if s is empty
+func defaultString(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// writePermissions returns the permissions the enabled Google Cloud destinations, log rollout
+// markers, changes, the asset inventory, traces, health scores and remediation workflows need
+func (c *Config) writePermissions() []requiredPermissions {
+	var required []requiredPermissions
+	for _, notifier := range c.Notifiers {
+		switch {
+		case notifier.CloudMonitoring != nil:
+			required = append(required, requiredPermissions{
+				resource:    defaultString(notifier.CloudMonitoring.ProjectID, c.ProjectID),
+				permissions: []string{"monitoring.timeSeries.create", "monitoring.metricDescriptors.create"},
+				role:        "roles/monitoring.metricWriter",
+				user:        notifierName(notifier, "cloud_monitoring") + " notifier",
+			})
+		case notifier.ErrorReporting != nil:
+			required = append(required, requiredPermissions{
+				resource:    defaultString(notifier.ErrorReporting.ProjectID, c.ProjectID),
+				permissions: []string{"errorreporting.errorEvents.create"},
+				role:        "roles/errorreporting.writer",
+				user:        notifierName(notifier, "error_reporting") + " notifier",
+			})
+		case notifier.CloudTasks != nil:
+			// Enqueuing may be granted on the queue alone, so it is tested on the queue
+			tasks := notifier.CloudTasks
+			required = append(required, requiredPermissions{
+				resource:    fmt.Sprintf("projects/%s/locations/%s/queues/%s", defaultString(tasks.ProjectID, c.ProjectID), tasks.Location, tasks.Queue),
+				permissions: []string{"cloudtasks.tasks.create"},
+				role:        "roles/cloudtasks.enqueuer",
+				user:        notifierName(notifier, "cloud_tasks") + " notifier",
+			})
+		}
+	}
+	var logUsers []string
+	if c.Rollouts != nil {
+		for _, marker := range c.Rollouts.Markers {
+			if marker.LogFilter != "" {
+				logUsers = append(logUsers, "rollout log markers")
+				break
+			}
+		}
+	}
+	if c.Changes != nil {
+		logUsers = append(logUsers, "changes")
+	}
+	if len(logUsers) > 0 {
+		required = append(required, requiredPermissions{
+			resource:    c.ProjectID,
+			permissions: []string{"logging.logEntries.list"},
+			role:        "roles/logging.viewer",
+			user:        strings.Join(logUsers, " and "),
+		})
+	}
+	if c.AssetInventory != nil {
+		required = append(required, requiredPermissions{
+			resource:    c.ProjectID,
+			permissions: []string{"cloudasset.assets.searchAllResources"},
+			role:        "roles/cloudasset.viewer",
+			user:        "asset_inventory",
+		})
+	}
+	if c.Traces != nil {
+		required = append(required, requiredPermissions{
+			resource:    c.ProjectID,
+			permissions: []string{"cloudtrace.traces.list"},
+			role:        "roles/cloudtrace.user",
+			user:        "traces",
+		})
+	}
+	if c.Health != nil {
+		required = append(required, requiredPermissions{
+			resource:    defaultString(c.Health.ProjectID, c.ProjectID),
+			permissions: []string{"monitoring.timeSeries.create", "monitoring.metricDescriptors.create"},
+			role:        "roles/monitoring.metricWriter",
+			user:        "health",
+		})
+	}
+	for _, rule := range c.Remediations {
+		if rule.Workflow == nil || rule.DryRun {
+			continue
+		}
+		if parts := strings.Split(rule.Workflow.Name, "/"); len(parts) > 1 && parts[0] == "projects" {
+			required = append(required, requiredPermissions{
+				resource:    parts[1],
+				permissions: []string{"workflows.executions.create"},
+				role:        "roles/workflows.invoker",
+				user:        "remediation " + rule.Name,
+			})
+		}
+	}
+	return required
+}
+
+// testIAMPermissions returns which of the permissions the caller holds on a project or, for a
+// resource name of the form projects/.../queues/..., on a Cloud Tasks queue
+func testIAMPermissions(ctx context.Context, client *http.Client, resource string, permissions []string) (map[string]bool, error) {
+	testURL := fmt.Sprintf("https://cloudresourcemanager.googleapis.com/v1/projects/%s:testIamPermissions", url.PathEscape(resource))
+	if strings.Contains(resource, "/queues/") {
+		testURL = fmt.Sprintf("https://cloudtasks.googleapis.com/v2/%s:testIamPermissions", resource)
+	}
+	body, err := json.Marshal(map[string][]string{"permissions": permissions})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, testURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var response struct {
+		Permissions []string `json:"permissions"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+	granted := make(map[string]bool, len(response.Permissions))
+	for _, permission := range response.Permissions {
+		granted[permission] = true
+	}
+	return granted, nil
+}
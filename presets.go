@@ -0,0 +1,222 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// PresetsConfig adds ready-made metric sets for common use cases to the configured metrics
+type PresetsConfig struct {
+	Billing *BillingPresetConfig `yaml:"billing"` // spend anomalies from a cost metric
+	Quota   *QuotaPresetConfig   `yaml:"quota"`   // quota consumption anomalies and projected quota exhaustion
+	Uptime  *UptimePresetConfig  `yaml:"uptime"`  // failure ratio and latency anomalies of every uptime check
+}
+
+// BillingPresetConfig monitors a cost metric, such as one written from the Cloud Billing export
+// by a scheduled query, as hourly spend with separate weekday and weekend baselines
+type BillingPresetConfig struct {
+	Metric   string   `yaml:"metric"`    // type of the cost metric, e.g. custom.googleapis.com/billing/cost
+	Filter   string   `yaml:"filter"`    // optional filter, e.g. metric.labels.project_id="foo-bar-prod"
+	GroupBy  []string `yaml:"group_by"`  // labels the spend is summed per, e.g. metric.labels.service, the total otherwise
+	Currency string   `yaml:"currency"`  // currency of the cost values, defaults to USD
+	TimeZone string   `yaml:"time_zone"` // IANA time zone the weekends are judged in, defaults to UTC
+}
+
+// QuotaPresetConfig monitors the consumption of the project's service quotas: anomalous growth
+// of the usage of allocation and rate quotas, and allocation quotas projected to run out
+type QuotaPresetConfig struct {
+	Filter          string  `yaml:"filter"`           // optional filter, e.g. resource.labels.service="compute.googleapis.com"
+	Exhausted       float64 `yaml:"exhausted"`        // fraction of the limit at which a quota counts as exhausted, defaults to 1
+	HorizonMin      int     `yaml:"horizon_min"`      // how far ahead exhaustion is projected, in minutes, defaults to 1440
+	AlignmentPeriod int     `yaml:"alignment_period"` // in seconds, defaults to 300
+}
+
+// Metrics of the quota preset
+const (
+	quotaUtilisationMetric = "derived/quota/allocation_utilisation"
+	quotaRateUsageMetric   = "serviceruntime.googleapis.com/quota/rate/net_usage"
+)
+
+// UptimePresetConfig monitors every uptime check of the project: anomalous failure ratios and
+// request latency per check, named by the display names of the checks
+type UptimePresetConfig struct {
+	Filter          string `yaml:"filter"`           // optional filter, e.g. metric.labels.check_id=starts_with("prod-")
+	AlignmentPeriod int    `yaml:"alignment_period"` // in seconds, defaults to 300
+}
+
+// Metrics of the uptime preset
+const (
+	uptimeFailureMetric = "derived/uptime/failure_ratio"
+	uptimeLatencyMetric = "monitoring.googleapis.com/uptime_check/request_latency"
+)
+
+// quotaFields identify a quota of a service in a location
+var quotaFields = []string{"service", "quota_metric", "location"}
+
+// CostConfig marks a metric as a cost, so its anomalies are described as cost anomalies in the
+// notifications
+type CostConfig struct {
+	Currency string `yaml:"currency"` // defaults to USD
+}
+
+// billingAlignmentPeriod sums the spend per hour, in seconds
+const billingAlignmentPeriod = 3600
+
+// applyPresets adds the metrics of the configured presets. Configured metrics of the same type
+// take precedence.
+func (c *Config) applyPresets() error {
+	if billing := c.Presets.Billing; billing != nil {
+		if billing.Metric == "" {
+			return fmt.Errorf("billing: no metric configured")
+		}
+		c.addPresetMetric(MetricConfig{
+			Type:            billing.Metric,
+			DisplayName:     "Cloud spend",
+			Tags:            []string{"cost"},
+			AlignmentPeriod: billingAlignmentPeriod,
+			Aligner:         "ALIGN_SUM",
+			GroupByFields:   billing.GroupBy,
+			Reducer:         "REDUCE_SUM",
+			// Spend is heavy-tailed and often 0 for a service in an hour
+			Transform:   &TransformConfig{Function: TransformLog, Offset: 1},
+			Seasonality: &SeasonalityConfig{TimeZone: billing.TimeZone},
+			Cost:        &CostConfig{Currency: billing.Currency},
+		}, billing.Filter)
+	}
+	if quota := c.Presets.Quota; quota != nil {
+		if quota.Exhausted < 0 || quota.HorizonMin < 0 || quota.AlignmentPeriod < 0 {
+			return fmt.Errorf("quota: exhausted, horizon_min and alignment_period must not be negative")
+		}
+		exhausted := quota.Exhausted
+		if exhausted == 0 {
+			exhausted = 1
+		}
+		horizon := quota.HorizonMin
+		if horizon == 0 {
+			horizon = 24 * 60
+		}
+		period := quota.AlignmentPeriod
+		if period == 0 {
+			period = 300
+		}
+		// Quota usage and limits are sampled sparsely, so the latest sample stands for each period
+		c.addPresetMetric(MetricConfig{
+			Type:            quotaUtilisationMetric,
+			DisplayName:     "Quota allocation utilisation",
+			Tags:            []string{"quota"},
+			AlignmentPeriod: period,
+			Aligner:         "ALIGN_NEXT_OLDER",
+			Ratio: &RatioConfig{
+				Numerator:   MetricTerm{Type: "serviceruntime.googleapis.com/quota/allocation/usage", Filter: quota.Filter},
+				Denominator: MetricTerm{Type: "serviceruntime.googleapis.com/quota/limit", Filter: quota.Filter},
+				GroupBy:     quotaFields,
+			},
+			Forecast: &ForecastConfig{Limit: exhausted, HorizonMin: horizon},
+		}, "")
+		c.addPresetMetric(MetricConfig{
+			Type:            quotaRateUsageMetric,
+			DisplayName:     "Quota rate usage",
+			Tags:            []string{"quota"},
+			AlignmentPeriod: period,
+			Aligner:         "ALIGN_SUM",
+			GroupByFields:   []string{"resource.labels.service", "metric.labels.quota_metric", "resource.labels.location"},
+			Reducer:         "REDUCE_SUM",
+		}, quota.Filter)
+	}
+	if uptime := c.Presets.Uptime; uptime != nil {
+		if uptime.AlignmentPeriod < 0 {
+			return fmt.Errorf("uptime: alignment_period must not be negative")
+		}
+		period := uptime.AlignmentPeriod
+		if period == 0 {
+			period = 300
+		}
+		// Each check runs from several locations; their results are averaged per check
+		c.addPresetMetric(MetricConfig{
+			Type:            uptimeFailureMetric,
+			DisplayName:     "Uptime check failure ratio",
+			Tags:            []string{"uptime"},
+			AlignmentPeriod: period,
+			Aligner:         "ALIGN_FRACTION_TRUE",
+			GroupByFields:   []string{"metric.labels.check_id"},
+			Reducer:         "REDUCE_MEAN",
+			Expression: &ExpressionConfig{
+				Expr:    "1 - passed",
+				Inputs:  map[string]MetricTerm{"passed": {Type: "monitoring.googleapis.com/uptime_check/check_passed", Filter: uptime.Filter}},
+				GroupBy: []string{"check_id"},
+			},
+		}, "")
+		c.addPresetMetric(MetricConfig{
+			Type:            uptimeLatencyMetric,
+			DisplayName:     "Uptime check latency",
+			Tags:            []string{"uptime"},
+			AlignmentPeriod: period,
+			Aligner:         "ALIGN_MEAN",
+			GroupByFields:   []string{"metric.labels.check_id"},
+			Reducer:         "REDUCE_MEAN",
+		}, uptime.Filter)
+	}
+	return nil
+}
+
+// addPresetMetric adds a metric of a preset unless it is configured, with the filter unless one
+// is configured
+func (c *Config) addPresetMetric(metric MetricConfig, filter string) {
+	if _, configured := c.MetricConfig(metric.Type); configured {
+		log.Printf("Metric %s of a preset is configured explicitly, keeping its configuration\n", metric.Type)
+		return
+	}
+	c.Metrics = append(c.Metrics, metric)
+	if _, filtered := c.Filters[metric.Type]; !filtered && filter != "" {
+		if c.Filters == nil {
+			c.Filters = make(map[string]string)
+		}
+		c.Filters[metric.Type] = filter
+	}
+}
+
+// describeCosts words the anomalies of cost metrics as cost anomalies, giving the spend and the
+// expected spend in their currency
+func (c *Config) describeCosts(anomalies []Anomaly) {
+	for i, anomaly := range anomalies {
+		metric, ok := c.MetricConfig(anomaly.MetricName)
+		if !ok || metric.Cost == nil || anomaly.Kind != KindAnomaly || anomaly.Expected == nil {
+			continue
+		}
+		currency := metric.Cost.Currency
+		if currency == "" {
+			currency = "USD"
+		}
+		period := "point"
+		if metric.AlignmentPeriod > 0 {
+			period = formatPeriod(time.Duration(metric.AlignmentPeriod) * time.Second)
+		}
+		direction := "above"
+		if anomaly.ZScore < 0 {
+			direction = "below"
+		}
+		message := fmt.Sprintf("Cost anomaly: %s was %.2f %s per %s, %s the expected %.2f to %.2f %s",
+			anomaly.displayName(), anomaly.Value, currency, period, direction, anomaly.Expected.Low, anomaly.Expected.High, currency)
+		if anomaly.Expected.DeviationPercent != nil {
+			message += fmt.Sprintf(" (%+.0f%%)", *anomaly.Expected.DeviationPercent)
+		}
+		if anomaly.Points > 1 {
+			message += fmt.Sprintf(" at its peak over %d consecutive periods", anomaly.Points)
+		}
+		anomalies[i].Message = message + fmt.Sprintf(" (Z-score: %.2f)", anomaly.ZScore)
+	}
+}
+
+// formatPeriod names an alignment period, such as "hour" or "15m0s"
+func formatPeriod(period time.Duration) string {
+	switch period {
+	case time.Hour:
+		return "hour"
+	case 24 * time.Hour:
+		return "day"
+	case time.Minute:
+		return "minute"
+	}
+	return period.String()
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// scoreMetricName is the name of the Prometheus gauge holding the Z-score of every series
+const scoreMetricName = "gcp_anomaly_detector_series_z_score"
+
+// labelValueEscaper escapes label values as the text exposition format requires
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// scoreGauges holds the most recent score of every series for the Prometheus /metrics endpoint.
+// A series is dropped once its newest point is older than the recent window, so series that
+// stop reporting do not linger.
+type scoreGauges struct {
+	maxAge time.Duration
+	// skew is set with clock_skew and its measurement exposed with the scores
+	skew *clockSkew
+
+	mu     sync.Mutex
+	points map[string]SeriesPoint
+}
+
+func newScoreGauges(config *Config) *scoreGauges {
+	return &scoreGauges{
+		maxAge: time.Duration(config.RecentDuration) * time.Minute,
+		skew:   config.skew,
+		points: make(map[string]SeriesPoint),
+	}
+}
+
+// update records the newest points of a detection cycle
+func (g *scoreGauges) update(points []SeriesPoint, now time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, point := range points {
+		g.points[point.Fingerprint] = point
+	}
+	for fingerprint, point := range g.points {
+		if now.Sub(point.Timestamp) > g.maxAge {
+			delete(g.points, fingerprint)
+		}
+	}
+}
+
+// ServeHTTP writes the scores in the Prometheus text exposition format
+func (g *scoreGauges) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	points := make([]SeriesPoint, 0, len(g.points))
+	for _, point := range g.points {
+		points = append(points, point)
+	}
+	g.mu.Unlock()
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].MetricName != points[j].MetricName {
+			return points[i].MetricName < points[j].MetricName
+		}
+		return points[i].Fingerprint < points[j].Fingerprint
+	})
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# HELP %s Z-score of the newest point of the series against its baseline.\n", scoreMetricName)
+	fmt.Fprintf(&b, "# TYPE %s gauge\n", scoreMetricName)
+	for _, point := range points {
+		fmt.Fprintf(&b, "%s{%s} %s\n", scoreMetricName, prometheusLabels(point), strconv.FormatFloat(point.ZScore, 'g', -1, 64))
+	}
+	if g.skew != nil {
+		skew, exceeded := g.skew.measured()
+		fmt.Fprintf(&b, "# HELP %s Time of the newest point of the Monitoring API less the local time, positive for a local clock running behind.\n", clockSkewMetricName)
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", clockSkewMetricName)
+		fmt.Fprintf(&b, "%s %s\n", clockSkewMetricName, strconv.FormatFloat(skew.Seconds(), 'g', -1, 64))
+		flag := 0
+		if exceeded {
+			flag = 1
+		}
+		fmt.Fprintf(&b, "# HELP %s 1 when the clock skew is over its threshold, 0 otherwise.\n", clockSkewExceededMetricName)
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", clockSkewExceededMetricName)
+		fmt.Fprintf(&b, "%s %d\n", clockSkewExceededMetricName, flag)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(b.String()))
+}
+
+// prometheusLabels renders the metric type, fingerprint and series labels of a point as
+// Prometheus labels. Label names are sanitised as for Alertmanager, and series labels clashing with metric_type or
+// fingerprint are prefixed with exported_, as Prometheus does on scrape conflicts.
+func prometheusLabels(point SeriesPoint) string {
+	labels := map[string]string{"metric_type": point.MetricName, "fingerprint": point.Fingerprint}
+	for key, value := range point.Labels {
+		name := labelName(key)
+		if _, exists := labels[name]; exists {
+			name = "exported_" + name
+		}
+		labels[name] = value
+	}
+
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + `="` + labelValueEscaper.Replace(labels[name]) + `"`
+	}
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+const (
+	pubsubScope = "https://www.googleapis.com/auth/pubsub"
+
+	// pubsubAckDeadline is requested for pulled messages so that the baseline and detection
+	// cycle can finish before the message is redelivered
+	pubsubAckDeadline = 600
+)
+
+// detectionRequest is the JSON payload of a Pub/Sub message requesting a detection run. Both
+// fields are optional and default to the configured project and metrics.
+type detectionRequest struct {
+	ProjectID string   `json:"project_id"`
+	Metrics   []string `json:"metrics"`
+}
+
+type pubsubMessage struct {
+	AckID   string `json:"ackId"`
+	Message struct {
+		Data      string `json:"data"`
+		MessageID string `json:"messageId"`
+	} `json:"message"`
+}
+
+// pubsubSubscriber runs detection whenever a message arrives on a Pub/Sub subscription
+type pubsubSubscriber struct {
+	client       *monitoring.MetricClient
+	config       *Config
+	router       *Router
+	subscription string
+	http         *http.Client
+
+	// detectors holds an initialised detector per project, built on the first request
+	detectors map[string]*SimpleAnomalyDetector
+}
+
+// runSubscriber pulls detection requests from a Pub/Sub subscription instead of polling
+func runSubscriber(args []string) {
+	fs := flag.NewFlagSet("subscribe", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	credentials := addCredentialFlags(fs)
+	subscription := fs.String("subscription", "", "Subscription to pull from (projects/PROJECT/subscriptions/NAME)")
+	fs.Parse(args)
+
+	config := mustLoadConfig(*configPath)
+	config.Credentials.override(*credentials)
+	mustDiscoverWorkloads(config)
+	if !strings.HasPrefix(*subscription, "projects/") || !strings.Contains(*subscription, "/subscriptions/") {
+		log.Fatalf("The -subscription flag must be of the form projects/PROJECT/subscriptions/NAME")
+	}
+
+	ctx := context.Background()
+	opts, err := config.Credentials.clientOptions(ctx)
+	if err != nil {
+		log.Fatalf("Failed to create Pub/Sub client: %v", err)
+	}
+	httpClient, _, err := htransport.NewClient(ctx, append(opts, option.WithScopes(pubsubScope))...)
+	if err != nil {
+		log.Fatalf("Failed to create Pub/Sub client: %v", err)
+	}
+
+	subscriber := &pubsubSubscriber{
+		client:       mustCreateClient(config.Credentials, config.MonitoringAPI),
+		config:       config,
+		router:       mustCreateRouter(config),
+		subscription: *subscription,
+		http:         httpClient,
+		detectors:    make(map[string]*SimpleAnomalyDetector),
+	}
+	mustValidateFilters(subscriber.client, config)
+
+	log.Printf("Waiting for detection requests on %s...\n", *subscription)
+	for {
+		messages, err := subscriber.pull(ctx)
+		if err != nil {
+			log.Printf("Failed to pull messages: %v", err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		for _, message := range messages {
+			subscriber.handle(ctx, message)
+		}
+	}
+}
+
+// handle runs the requested detection and acknowledges the message. Malformed requests are
+// acknowledged and dropped, while failed detection runs are left for redelivery.
+func (s *pubsubSubscriber) handle(ctx context.Context, message pubsubMessage) {
+	if err := s.call(ctx, "modifyAckDeadline", map[string]interface{}{
+		"ackIds":             []string{message.AckID},
+		"ackDeadlineSeconds": pubsubAckDeadline,
+	}, nil); err != nil {
+		log.Printf("Failed to extend ack deadline of message %s: %v", message.Message.MessageID, err)
+	}
+
+	req, err := decodeDetectionRequest(message.Message.Data)
+	if err != nil {
+		log.Printf("Dropping message %s: %v", message.Message.MessageID, err)
+		s.ack(ctx, message)
+		return
+	}
+
+	config := *s.config
+	if req.ProjectID != "" {
+		config.ProjectID = req.ProjectID
+	}
+	metrics, err := scopeMetrics(&config, req.Metrics)
+	if err != nil {
+		log.Printf("Dropping message %s: %v", message.Message.MessageID, err)
+		s.ack(ctx, message)
+		return
+	}
+
+	log.Printf("Detection requested by message %s for project %s and %d metrics\n", message.Message.MessageID, config.ProjectID, len(metrics))
+	detector, ok := s.detectors[config.ProjectID]
+	if !ok {
+		detector, err = buildBaseline(s.client, &config)
+		if err != nil {
+			log.Printf("Failed to initialise baseline for project %s: %v", config.ProjectID, err)
+			return
+		}
+		detector.events = s.router.Events()
+		s.detectors[config.ProjectID] = detector
+	}
+
+	anomalies, err := runCycle(s.client, &config, detector, metrics)
+	if err != nil {
+		log.Printf("Detection cycle failed: %v", err)
+		s.router.ReportError(ctx, err)
+		return
+	}
+	s.router.ReportCycle(ctx, anomalies, detector.FetchFailures())
+	s.ack(ctx, message)
+}
+
+func decodeDetectionRequest(data string) (*detectionRequest, error) {
+	var req detectionRequest
+	if data == "" {
+		return &req, nil
+	}
+	payload, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid message data: %v", err)
+	}
+	if len(bytes.TrimSpace(payload)) == 0 {
+		return &req, nil
+	}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return nil, fmt.Errorf("invalid detection request: %v", err)
+	}
+	return &req, nil
+}
+
+func (s *pubsubSubscriber) pull(ctx context.Context) ([]pubsubMessage, error) {
+	var resp struct {
+		ReceivedMessages []pubsubMessage `json:"receivedMessages"`
+	}
+	if err := s.call(ctx, "pull", map[string]interface{}{"maxMessages": 10}, &resp); err != nil {
+		return nil, err
+	}
+	return resp.ReceivedMessages, nil
+}
+
+func (s *pubsubSubscriber) ack(ctx context.Context, message pubsubMessage) {
+	if err := s.call(ctx, "acknowledge", map[string]interface{}{"ackIds": []string{message.AckID}}, nil); err != nil {
+		log.Printf("Failed to acknowledge message %s: %v", message.Message.MessageID, err)
+	}
+}
+
+// call invokes a subscription method of the Pub/Sub REST API
+func (s *pubsubSubscriber) call(ctx context.Context, method string, body interface{}, out interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("https://pubsub.googleapis.com/v1/%s:%s", s.subscription, method)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s: %s", method, resp.Status, strings.TrimSpace(string(message)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+)
+
+// BaselineQualityConfig sets when the baseline of a series is too sparse or unstable to trust.
+// Series failing any of the thresholds are warned about once their baseline is computed, and
+// skipped like series with too few baseline points with skip_detection.
+type BaselineQualityConfig struct {
+	MinCoverage   float64 `yaml:"min_coverage"`   // percentage of the points expected over the baseline window a series needs, defaults to 50
+	MaxGapRatio   float64 `yaml:"max_gap_ratio"`  // share of the time between its first and last baseline points a series may lack points for, defaults to 0.5
+	MaxVariation  float64 `yaml:"max_variation"`  // coefficient of variation (stddev over the absolute mean) above which a baseline is unstable, defaults to 3
+	SkipDetection bool    `yaml:"skip_detection"` // skips the series with untrustworthy baselines instead of only warning about them
+}
+
+const (
+	defaultMinCoverage  = 50
+	defaultMaxGapRatio  = 0.5
+	defaultMaxVariation = 3
+)
+
+func (c BaselineQualityConfig) validate() error {
+	if c.MinCoverage < 0 || c.MinCoverage > 100 {
+		return fmt.Errorf("min_coverage must be between 0 and 100")
+	}
+	if c.MaxGapRatio < 0 || c.MaxGapRatio > 1 {
+		return fmt.Errorf("max_gap_ratio must be between 0 and 1")
+	}
+	if c.MaxVariation < 0 {
+		return fmt.Errorf("max_variation must not be negative")
+	}
+	return nil
+}
+
+// withDefaults returns the configuration with the unset thresholds defaulted
+func (c BaselineQualityConfig) withDefaults() BaselineQualityConfig {
+	if c.MinCoverage == 0 {
+		c.MinCoverage = defaultMinCoverage
+	}
+	if c.MaxGapRatio == 0 {
+		c.MaxGapRatio = defaultMaxGapRatio
+	}
+	if c.MaxVariation == 0 {
+		c.MaxVariation = defaultMaxVariation
+	}
+	return c
+}
+
+// baselineQuality measures how far the baseline of a series can be trusted
+type baselineQuality struct {
+	coverage  float64 // percentage of the points expected over the baseline window
+	gapRatio  float64 // share of the time between the first and last points without points
+	variation float64 // coefficient of variation
+}
+
+// assessSeries measures the quality of the baseline of a series over a window. The sampling
+// interval of the series is taken as the shortest time between two of its consecutive points.
+func assessSeries(series *accumulatedSeries, window time.Duration) baselineQuality {
+	var q baselineQuality
+	if series.interval > 0 && window > 0 {
+		expected := float64(window/series.interval) + 1
+		q.coverage = math.Min(100, 100*float64(series.points)/expected)
+		if span := series.last.Sub(series.first); span > 0 {
+			q.gapRatio = math.Max(0, 1-float64(series.points-1)*float64(series.interval)/float64(span))
+		}
+	} else if series.points <= 1 {
+		q.gapRatio = 1
+	}
+	switch stddev := series.stats.StdDev(); {
+	case series.stats.Mean != 0:
+		q.variation = stddev / math.Abs(series.stats.Mean)
+	case stddev > 0:
+		q.variation = math.Inf(1)
+	}
+	return q
+}
+
+// problems describes the thresholds the quality fails, none for a trustworthy baseline
+func (q baselineQuality) problems(config BaselineQualityConfig) []string {
+	var problems []string
+	if q.coverage < config.MinCoverage {
+		problems = append(problems, fmt.Sprintf("covers %.0f%% of the baseline window, %.0f%% required", q.coverage, config.MinCoverage))
+	}
+	if q.gapRatio > config.MaxGapRatio {
+		problems = append(problems, fmt.Sprintf("gaps span %.0f%% of it, at most %.0f%% allowed", 100*q.gapRatio, 100*config.MaxGapRatio))
+	}
+	if q.variation > config.MaxVariation {
+		problems = append(problems, fmt.Sprintf("coefficient of variation %.2f, at most %.2f allowed", q.variation, config.MaxVariation))
+	}
+	return problems
+}
+
+// assessBaselines measures the quality of the accumulated series baselines of the metrics and
+// returns why each untrustworthy one is, by fingerprint. Fixed and referenced baselines are not
+// series baselines and are never assessed.
+func (d *SimpleAnomalyDetector) assessBaselines(accumulator *baselineAccumulator) map[string]string {
+	untrusted := make(map[string]string)
+	for fingerprint, series := range accumulator.byKey {
+		if _, fixed := d.fixed[series.metricType]; fixed || d.referenced[series.metricType] {
+			continue
+		}
+		if problems := assessSeries(series, d.baselineWindow).problems(d.quality); len(problems) > 0 {
+			untrusted[fingerprint] = strings.Join(problems, "; ")
+			log.Printf("Baseline of series %s of metric %s may not be trustworthy: %s\n", fingerprint, series.metricType, untrusted[fingerprint])
+		}
+	}
+	if len(untrusted) > 0 && d.quality.SkipDetection {
+		log.Printf("%d series with untrustworthy baselines will not be scored\n", len(untrusted))
+	}
+	return untrusted
+}
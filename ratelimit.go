@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig caps the notifications sent during an alert storm
+type RateLimitConfig struct {
+	PerMetric int `yaml:"per_metric"` // notifications per metric and window, 0 for no limit
+	Global    int `yaml:"global"`     // notifications across all metrics per window, 0 for no limit
+	WindowMin int `yaml:"window_min"` // length of the sliding window in minutes, defaults to 60
+}
+
+// enabled reports whether any limit is configured
+func (c RateLimitConfig) enabled() bool {
+	return c.PerMetric > 0 || c.Global > 0
+}
+
+// rateLimitSummaryInterval is the minimum time between two rate limit summaries
+const rateLimitSummaryInterval = 15 * time.Minute
+
+// rateLimiter counts the anomalies notified over a sliding window, per metric and globally, and
+// holds back those over either limit. The anomalies it holds back are collected into a summary
+// that is notified in their place, at most once every rateLimitSummaryInterval. A summary not
+// due yet is returned by a later limit, or handed to onDue once due when no limit comes first,
+// as the central server only reports when agents send anomalies.
+type rateLimiter struct {
+	config          RateLimitConfig
+	window          time.Duration
+	summaryInterval time.Duration
+	// onDue is called once the summary of the anomalies held back is due
+	onDue func()
+
+	mu          sync.Mutex
+	sent        []time.Time            // send times of all notified anomalies within the window
+	sentMetric  map[string][]time.Time // send times within the window by metric type
+	suppressed  map[string]int         // anomalies held back since the last summary by metric type
+	lastSummary time.Time
+	timer       *time.Timer // calls onDue while anomalies are held back
+}
+
+func newRateLimiter(config RateLimitConfig, onDue func()) *rateLimiter {
+	if config.WindowMin == 0 {
+		config.WindowMin = 60
+	}
+	return &rateLimiter{
+		config:          config,
+		window:          time.Duration(config.WindowMin) * time.Minute,
+		summaryInterval: rateLimitSummaryInterval,
+		onDue:           onDue,
+		sentMetric:      make(map[string][]time.Time),
+		suppressed:      make(map[string]int),
+	}
+}
+
+// limit returns the anomalies that may be notified at now, followed by a summary of those held
+// back when one is due
+func (l *rateLimiter) limit(anomalies []Anomaly, now time.Time) []Anomaly {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	cutoff := now.Add(-l.window)
+	l.sent = pruneBefore(l.sent, cutoff)
+	for metric, times := range l.sentMetric {
+		if times = pruneBefore(times, cutoff); len(times) == 0 {
+			delete(l.sentMetric, metric)
+		} else {
+			l.sentMetric[metric] = times
+		}
+	}
+
+	var allowed []Anomaly
+	for _, anomaly := range anomalies {
+		if l.config.PerMetric > 0 && len(l.sentMetric[anomaly.MetricName]) >= l.config.PerMetric ||
+			l.config.Global > 0 && len(l.sent) >= l.config.Global {
+			l.suppressed[anomaly.MetricName]++
+			continue
+		}
+		l.sent = append(l.sent, now)
+		l.sentMetric[anomaly.MetricName] = append(l.sentMetric[anomaly.MetricName], now)
+		allowed = append(allowed, anomaly)
+	}
+
+	if len(l.suppressed) > 0 && now.Sub(l.lastSummary) >= l.summaryInterval {
+		allowed = append(allowed, l.summary(now))
+	} else if len(l.suppressed) > 0 && l.timer == nil && l.onDue != nil {
+		l.timer = time.AfterFunc(l.lastSummary.Add(l.summaryInterval).Sub(now), l.onDue)
+	}
+	return allowed
+}
+
+// flush returns the summary of the anomalies held back since the last one, whether it is due or
+// not, and false when none were held back
+func (l *rateLimiter) flush(now time.Time) (Anomaly, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.suppressed) == 0 {
+		return Anomaly{}, false
+	}
+	return l.summary(now), true
+}
+
+// summary returns the anomaly announcing the notifications held back since the last summary, and
+// starts counting them anew
+func (l *rateLimiter) summary(now time.Time) Anomaly {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	metrics := make([]string, 0, len(l.suppressed))
+	total := 0
+	for metric, count := range l.suppressed {
+		metrics = append(metrics, metric)
+		total += count
+	}
+	sort.Strings(metrics)
+	counts := make([]string, len(metrics))
+	for i, metric := range metrics {
+		counts[i] = fmt.Sprintf("%s: %d", metric, l.suppressed[metric])
+	}
+
+	log.Printf("Rate limit reached, %d alerts suppressed\n", total)
+	l.suppressed = make(map[string]int)
+	l.lastSummary = now
+	return Anomaly{
+		ID:          fmt.Sprintf("rate-limit-%d", now.Unix()),
+		Kind:        KindRateLimit,
+		DisplayName: "alert rate limit",
+		Fingerprint: "rate-limit",
+		Timestamp:   now,
+		Value:       float64(total),
+		Severity:    SeverityWarning,
+		Message: fmt.Sprintf("%d alerts suppressed due to rate limit (per metric %d, global %d per %d minutes): %s",
+			total, l.config.PerMetric, l.config.Global, l.config.WindowMin, strings.Join(counts, ", ")),
+	}
+}
+
+// pruneBefore drops the times before cutoff from the ascending times
+func pruneBefore(times []time.Time, cutoff time.Time) []time.Time {
+	i := sort.Search(len(times), func(i int) bool { return !times[i].Before(cutoff) })
+	return times[i:]
+}
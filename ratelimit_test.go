@@ -0,0 +1,140 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// rateLimitStart is the time of the first report in the rate limit tests
+var rateLimitStart = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// anomaliesOn returns an anomaly on each of the metrics
+func anomaliesOn(metrics ...string) []Anomaly {
+	anomalies := make([]Anomaly, len(metrics))
+	for i, metric := range metrics {
+		anomalies[i] = Anomaly{MetricName: metric, Severity: SeverityCritical}
+	}
+	return anomalies
+}
+
+func TestRateLimit(t *testing.T) {
+	// report is a call of limit, minute minutes after rateLimitStart
+	type report struct {
+		minute   int
+		metrics  []string
+		notified []string // metrics of the anomalies let through
+		summary  string   // counts of the summary returned with them, empty for none
+	}
+	tests := []struct {
+		name    string
+		config  RateLimitConfig
+		reports []report
+	}{
+		{
+			name:   "per metric",
+			config: RateLimitConfig{PerMetric: 2},
+			reports: []report{
+				{minute: 0, metrics: []string{"a", "a", "a", "b"}, notified: []string{"a", "a", "b"}, summary: "a: 1"},
+				{minute: 5, metrics: []string{"a", "b", "b"}, notified: []string{"b"}},
+				// The first two notifications of a leave the window
+				{minute: 61, metrics: []string{"a", "a", "a"}, notified: []string{"a", "a"}, summary: "a: 2, b: 1"},
+			},
+		},
+		{
+			name:   "global",
+			config: RateLimitConfig{Global: 3, WindowMin: 10},
+			reports: []report{
+				{minute: 0, metrics: []string{"a", "b"}, notified: []string{"a", "b"}},
+				{minute: 1, metrics: []string{"c", "d", "e"}, notified: []string{"c"}, summary: "d: 1, e: 1"},
+				// The window includes its start, the notifications of minute 0 leave it after minute 10
+				{minute: 10, metrics: []string{"a"}},
+				{minute: 11, metrics: []string{"b", "c", "d"}, notified: []string{"b", "c"}},
+				{minute: 16, metrics: []string{"e", "f"}, notified: []string{"e"}, summary: "a: 1, d: 1, f: 1"},
+			},
+		},
+		{
+			name:   "both",
+			config: RateLimitConfig{PerMetric: 1, Global: 2},
+			reports: []report{
+				{minute: 0, metrics: []string{"a", "a", "b", "c"}, notified: []string{"a", "b"}, summary: "a: 1, c: 1"},
+			},
+		},
+		{
+			// Summaries come at most every 15 minutes, on the first report once due, including
+			// a report of no anomalies
+			name:   "summary cadence",
+			config: RateLimitConfig{PerMetric: 1},
+			reports: []report{
+				{minute: 0, metrics: []string{"a", "a"}, notified: []string{"a"}, summary: "a: 1"},
+				{minute: 1, metrics: []string{"a"}},
+				{minute: 14, metrics: []string{"a", "a"}},
+				{minute: 15, summary: "a: 3"},
+				{minute: 20},
+				{minute: 25, metrics: []string{"a"}},
+				{minute: 29},
+				{minute: 30, summary: "a: 1"},
+			},
+		},
+		{
+			name:   "no limit",
+			config: RateLimitConfig{},
+			reports: []report{
+				{minute: 0, metrics: []string{"a", "a", "a"}, notified: []string{"a", "a", "a"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter := newRateLimiter(tt.config, nil)
+			for _, report := range tt.reports {
+				now := rateLimitStart.Add(time.Duration(report.minute) * time.Minute)
+				var notified []string
+				summary := ""
+				for _, anomaly := range limiter.limit(anomaliesOn(report.metrics...), now) {
+					if anomaly.Kind != KindRateLimit {
+						notified = append(notified, anomaly.MetricName)
+						continue
+					}
+					summary = anomaly.Message[strings.Index(anomaly.Message, "): ")+3:]
+					if !anomaly.Timestamp.Equal(now) {
+						t.Errorf("minute %d: got summary at %s, want %s", report.minute, anomaly.Timestamp, now)
+					}
+				}
+				if strings.Join(notified, ",") != strings.Join(report.notified, ",") {
+					t.Errorf("minute %d: got %v notified, want %v", report.minute, notified, report.notified)
+				}
+				if summary != report.summary {
+					t.Errorf("minute %d: got summary %q, want %q", report.minute, summary, report.summary)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimitSummaryDue(t *testing.T) {
+	due := make(chan struct{}, 1)
+	limiter := newRateLimiter(RateLimitConfig{PerMetric: 1}, func() { due <- struct{}{} })
+	limiter.summaryInterval = 50 * time.Millisecond
+
+	now := time.Now()
+	limiter.limit(anomaliesOn("a", "a"), now)
+	// The summary of the first report was returned with it; the anomaly held back since is only
+	// summarized once the interval has passed
+	limiter.limit(anomaliesOn("a"), now)
+	select {
+	case <-due:
+	case <-time.After(5 * time.Second):
+		t.Fatal("pending summary never came due")
+	}
+	summary, ok := limiter.flush(time.Now())
+	if !ok || !strings.HasSuffix(summary.Message, "a: 1") {
+		t.Fatalf("got summary %q (%v), want one of a: 1", summary.Message, ok)
+	}
+	if _, ok := limiter.flush(time.Now()); ok {
+		t.Error("got a second summary of the same anomalies")
+	}
+	if limiter.timer != nil {
+		t.Error("timer still armed with nothing held back")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checkReadOnly refuses every part of the configuration that sends data over the network or
+// writes anywhere but local files, so a read_only detector can only read metrics and write
+// local files. Reading, such as workload discovery or rollout log markers, is allowed.
+func (c *Config) checkReadOnly() error {
+	if !c.ReadOnly {
+		return nil
+	}
+	var refused []string
+	for i, notifier := range c.Notifiers {
+		if notifier.File == nil {
+			refused = append(refused, fmt.Sprintf("notifier %d (%s) is not a file notifier", i+1, notifierDestination(notifier)))
+		}
+	}
+	locations := []struct{ setting, location string }{
+		{"silences_path", c.SilencesPath},
+		{"feedback_path", c.FeedbackPath},
+		{"baseline_path", c.BaselinePath},
+		{"lifecycle.path", c.Lifecycle.Path},
+	}
+
+	if c.Export != nil {
+		locations = append(locations, struct{ setting, location string }{"export.location", c.Export.Location})
+	}
+	if c.Links != nil {
+		locations = append(locations, struct{ setting, location string }{"links.charts", c.Links.Charts})
+	}
+	if c.Backfill != nil {
+		locations = append(locations, struct{ setting, location string }{"backfill.state_path", c.Backfill.StatePath})
+	}
+	for _, l := range locations {
+		if _, _, remote := parseGCSURI(l.location); remote {
+			refused = append(refused, l.setting+" is a Cloud Storage URI")
+		}
+	}
+	if c.Store.Object != nil && strings.HasPrefix(c.Store.Object.Prefix, "gs://") {
+		refused = append(refused, "store.object.prefix is a Cloud Storage URI")
+	}
+	if c.Heartbeat != nil {
+		refused = append(refused, "heartbeat pings a URL")
+	}
+	if c.OTLP != nil {
+		refused = append(refused, "otlp pushes to a collector")
+	}
+	if c.Report != nil {
+		refused = append(refused, "report posts to Slack or email")
+	}
+	for _, rule := range c.Remediations {
+		if !rule.DryRun {
+			refused = append(refused, "remediations run actions unless dry_run")
+			break
+		}
+	}
+	if c.Health != nil {
+		refused = append(refused, "health writes a custom metric")
+	}
+	if c.LeaderElection != nil {
+		refused = append(refused, "leader_election writes a lease")
+	}
+	if len(refused) > 0 {
+		return fmt.Errorf("read_only: %s; only file notifiers and local paths are allowed", strings.Join(refused, ", "))
+	}
+	return nil
+}
+
+// notifierDestination names the destination of a notifier configuration, such as datadog
+func notifierDestination(config NotifierConfig) string {
+	destinations := []struct {
+		name string
+		set  bool
+	}{
+		{"error_reporting", config.ErrorReporting != nil},
+		{"grafana", config.Grafana != nil},
+		{"oncall", config.OnCall != nil},
+		{"splunk", config.Splunk != nil},
+		{"datadog", config.Datadog != nil},
+		{"elasticsearch", config.Elasticsearch != nil},
+		{"kafka", config.Kafka != nil},
+		{"nats", config.NATS != nil},
+		{"sns", config.SNS != nil},
+		{"statuspage", config.Statuspage != nil},
+		{"servicenow", config.ServiceNow != nil},
+		{"victorops", config.VictorOps != nil},
+		{"twilio", config.Twilio != nil},
+		{"cloud_tasks", config.CloudTasks != nil},
+		{"alertmanager", config.Alertmanager != nil},
+		{"cloud_monitoring", config.CloudMonitoring != nil},
+		{"bigquery", config.BigQuery != nil},
+		{"central", config.Central != nil},
+		{"sheets", config.Sheets != nil},
+		{"webhook", config.Webhook != nil},
+	}
+	for _, destination := range destinations {
+		if destination.set {
+			return notifierName(config, destination.name)
+		}
+	}
+	return notifierName(config, "unknown")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// recordedCall is a Monitoring API call as recorded, one JSON object per line
+type recordedCall struct {
+	Method string `json:"method"`
+	// Key identifies the request independently of its time interval, which moves with the
+	// time the detector runs at
+	Key      string          `json:"key"`
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    *recordedError  `json:"error,omitempty"`
+}
+
+type recordedError struct {
+	Code    codes.Code `json:"code"`
+	Message string     `json:"message"`
+}
+
+// recordingInterceptor appends every call made through the client, with its response or error,
+// to the file at path
+func recordingInterceptor(path string) (grpc.UnaryClientInterceptor, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open recording: %v", err)
+	}
+	log.Printf("Recording Monitoring API responses to %s\n", path)
+
+	var mu sync.Mutex
+	encoder := json.NewEncoder(file)
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		callErr := invoker(ctx, method, req, reply, cc, opts...)
+
+		call := recordedCall{Method: method, Key: requestKey(method, req)}
+		call.Request, _ = protojson.Marshal(req.(proto.Message))
+		if callErr != nil {
+			s := status.Convert(callErr)
+			call.Error = &recordedError{Code: s.Code(), Message: s.Message()}
+		} else {
+			call.Response, _ = protojson.Marshal(reply.(proto.Message))
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if err := encoder.Encode(call); err != nil {
+			log.Printf("Failed to record %s: %v", method, err)
+		}
+		return callErr
+	}, nil
+}
+
+// replayInterceptor answers calls from the recording at path without reaching the API. Identical
+// requests are answered in the order they were recorded, and the last answer is repeated once
+// the recording runs out, so a polling detector keeps replaying its last cycle.
+func replayInterceptor(path string) (grpc.UnaryClientInterceptor, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open recording: %v", err)
+	}
+	defer file.Close()
+
+	calls := make(map[string][]recordedCall)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1024*1024), 256*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var call recordedCall
+		if err := json.Unmarshal(scanner.Bytes(), &call); err != nil {
+			return nil, fmt.Errorf("could not read recording %s, line %d: %v", path, line, err)
+		}
+		calls[call.Key] = append(calls[call.Key], call)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("could not read recording %s: %v", path, err)
+	}
+	log.Printf("Replaying Monitoring API responses from %s\n", path)
+
+	var mu sync.Mutex
+	return func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		key := requestKey(method, req)
+		mu.Lock()
+		recorded := calls[key]
+		if len(recorded) == 0 {
+			mu.Unlock()
+			request, _ := protojson.Marshal(req.(proto.Message))
+			return status.Errorf(codes.NotFound, "no recorded response for %s %s", method, request)
+		}
+		call := recorded[0]
+		if len(recorded) > 1 {
+			calls[key] = recorded[1:]
+		}
+		mu.Unlock()
+
+		if call.Error != nil {
+			return status.Error(call.Error.Code, call.Error.Message)
+		}
+		return protojson.Unmarshal(call.Response, reply.(proto.Message))
+	}, nil
+}
+
+// requestKey identifies a request by its method and content, leaving out the time interval of
+// ListTimeSeries requests
+func requestKey(method string, req interface{}) string {
+	message := proto.Clone(req.(proto.Message))
+	if list, ok := message.(*monitoringpb.ListTimeSeriesRequest); ok {
+		list.Interval = nil
+	}
+	data, _ := proto.MarshalOptions{Deterministic: true}.Marshal(message)
+	return method + ":" + base64.StdEncoding.EncodeToString(data)
+}
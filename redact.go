@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// redactedPlaceholder replaces secret values in logs and error messages
+const redactedPlaceholder = "[REDACTED]"
+
+// minSecretLength is the length below which values are not redacted, as replacing such short
+// strings would garble unrelated text
+const minSecretLength = 4
+
+// secrets holds the values of every configuration field tagged secret:"true" that has been
+// registered, so they can be removed from anything written to the log or returned as an error
+var secrets = &secretSet{}
+
+type secretSet struct {
+	mu     sync.RWMutex
+	values []string // longest first, so a secret containing another is replaced whole
+}
+
+// registerSecrets walks a configuration value and registers the strings of all fields tagged
+// secret:"true", including those of nested structs, pointers, slices and maps
+func registerSecrets(config interface{}) {
+	collectSecrets(reflect.ValueOf(config), false)
+}
+
+func collectSecrets(v reflect.Value, secret bool) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			collectSecrets(v.Elem(), secret)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < v.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				collectSecrets(v.Field(i), secret || t.Field(i).Tag.Get("secret") == "true")
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			collectSecrets(v.Index(i), secret)
+		}
+	case reflect.Map:
+		for _, key := range v.MapKeys() {
+			collectSecrets(v.MapIndex(key), secret)
+		}
+	case reflect.String:
+		if secret {
+			secrets.add(v.String())
+		}
+	}
+}
+
+// add registers a secret value, along with its URL-encoded forms
+func (s *secretSet) add(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, form := range []string{value, url.QueryEscape(value), url.PathEscape(value)} {
+		if !s.contains(form) {
+			s.values = append(s.values, form)
+		}
+	}
+	sort.Slice(s.values, func(i, j int) bool { return len(s.values[i]) > len(s.values[j]) })
+}
+
+func (s *secretSet) contains(value string) bool {
+	for _, existing := range s.values {
+		if existing == value {
+			return true
+		}
+	}
+	return false
+}
+
+// redact replaces every registered secret in text
+func redact(text string) string {
+	secrets.mu.RLock()
+	defer secrets.mu.RUnlock()
+	for _, value := range secrets.values {
+		text = strings.ReplaceAll(text, value, redactedPlaceholder)
+	}
+	return text
+}
+
+// redactError returns err with every registered secret removed from its message
+func redactError(err error) error {
+	if err == nil {
+		return nil
+	}
+	message := redact(err.Error())
+	if message == err.Error() {
+		return err
+	}
+	return errors.New(message)
+}
+
+// redactingWriter removes registered secrets from everything written through it. The log
+// package writes each entry with a single call, so secrets are never split across writes.
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
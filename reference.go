@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// ReferenceConfig takes a metric's baseline from a reference environment, such as production,
+// while its recent values still come from project_id and the metric's filter
+type ReferenceConfig struct {
+	ProjectID string `yaml:"project_id"` // project of the reference environment, defaults to project_id
+	Filter    string `yaml:"filter"`     // selects the reference series in place of the metric's filter
+}
+
+// referencedMetrics returns the metric types whose baseline comes from a reference environment
+func (c *Config) referencedMetrics() map[string]bool {
+	referenced := make(map[string]bool)
+	for _, metric := range c.Metrics {
+		if metric.Reference != nil {
+			referenced[metric.Type] = true
+		}
+	}
+	return referenced
+}
+
+// streamBaselineMetrics hands each baseline series of the metrics between startTime and endTime
+// to fn. Metrics with a reference are fetched from the reference environment; the others as
+// configured. Windows longer than baseline_chunk hours are fetched in consecutive chunks, each
+// series being handed over once per chunk, as the API slows down and truncates on huge
+// responses.
+func streamBaselineMetrics(client *monitoring.MetricClient, config *Config, metrics []string, startTime, endTime time.Time, fn func(*monitoringpb.TimeSeries)) error {
+	chunks := config.baselineChunks(startTime, endTime)
+	// The rates of counters run on across the chunks
+	counters := newCounterState()
+	if len(chunks) > 1 {
+		log.Printf("Fetching the baseline window in %d chunks of up to %s\n", len(chunks), config.baselineChunk())
+	}
+	for i, chunk := range chunks {
+		add := fn
+		if i > 0 {
+			// A point at the boundary belongs to the earlier chunk, which includes its end
+			add = func(ts *monitoringpb.TimeSeries) {
+				if ts = pointsAfter(ts, chunk.start); len(ts.Points) > 0 {
+					fn(ts)
+				}
+			}
+		}
+		if err := streamBaselineChunk(client, config, metrics, chunk.start, chunk.end, counters, add); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamBaselineChunk hands the series of a part of the baseline window to fn, converting the
+// counters with the points of the earlier parts in counters
+func streamBaselineChunk(client *monitoring.MetricClient, config *Config, metrics []string, startTime, endTime time.Time, counters *counterState, fn func(*monitoringpb.TimeSeries)) error {
+	var configured []string
+	for _, metricType := range metrics {
+		metricConfig, _ := config.MetricConfig(metricType)
+		if metricConfig.Reference == nil {
+			configured = append(configured, metricType)
+			continue
+		}
+
+		reference := *metricConfig.Reference
+		projectID := reference.ProjectID
+		if projectID == "" {
+			projectID = config.ProjectID
+		}
+		var filters map[string]string
+		if reference.Filter != "" {
+			filters = map[string]string{metricType: reference.Filter}
+		}
+		var aggregations map[string]*monitoringpb.Aggregation
+		if aggregation := metricConfig.aggregation(); aggregation != nil {
+			aggregations = map[string]*monitoringpb.Aggregation{metricType: aggregation}
+		}
+		err := streamMetricsInRange(client, "reference", projectID, []string{metricType}, startTime, endTime, filters, aggregations, func(ts *monitoringpb.TimeSeries) {
+			fn(config.numericSeries(counters.series(ts, metricConfig)))
+		})
+		if err != nil {
+			return fmt.Errorf("could not fetch reference of %s: %v", metricType, err)
+		}
+	}
+	if len(configured) == 0 {
+		return nil
+	}
+	return streamConfiguredChunk(client, config, "historical", configured, startTime, endTime, counters, fn)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"google.golang.org/api/idtoken"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// remediatedRetention is how long an anomaly is remembered as remediated, so an event reported
+// again every cycle runs its remediation once
+const remediatedRetention = 24 * time.Hour
+
+// RemediationRule runs an automated action, such as a Cloud Function restarting a service, for
+// the anomalies it matches, with guardrails against runaway remediation
+type RemediationRule struct {
+	Name          string                     `yaml:"name"`           // identifies the rule in logs
+	Metric        string                     `yaml:"metric"`         // metric type or glob pattern, all metrics if empty
+	Matchers      []string                   `yaml:"matchers"`       // label matchers the anomalies must all match
+	Kinds         []string                   `yaml:"kinds"`          // kinds of detection remediated, defaults to [anomaly]
+	Types         []string                   `yaml:"types"`          // spike, dip, level_shift or trend_break, all if empty
+	MinSeverity   string                     `yaml:"min_severity"`   // warning (default) or critical
+	CloudFunction *CloudFunctionActionConfig `yaml:"cloud_function"` // action invoking an HTTP function
+	Workflow      *WorkflowActionConfig      `yaml:"workflow"`       // action executing a workflow
+	MaxPerHour    int                        `yaml:"max_per_hour"`   // executions of the rule in any hour, defaults to 1
+	DryRun        bool                       `yaml:"dry_run"`        // logs the executions instead of running them
+}
+
+// CloudFunctionActionConfig invokes an HTTP-triggered Cloud Function, or any Cloud Run service,
+// with the anomaly payload, authenticated by an ID token of the detector's service account
+type CloudFunctionActionConfig struct {
+	URL string `yaml:"url"` // e.g. https://restart-checkout-abc123-uc.a.run.app
+}
+
+// WorkflowActionConfig starts an execution of a Cloud Workflow with the anomaly payload as its
+// argument
+type WorkflowActionConfig struct {
+	Name string `yaml:"name"` // projects/p/locations/l/workflows/w
+}
+
+// remediation is a RemediationRule with its metric, matchers and selections parsed
+type remediation struct {
+	RemediationRule
+	match suppressionRule
+	kinds map[string]bool
+	types map[string]bool
+}
+
+// compileRemediations parses the remediation rules of the configuration
+func compileRemediations(rules []RemediationRule) ([]remediation, error) {
+	var compiled []remediation
+	names := make(map[string]bool)
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("remediation %d", i+1)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("%s: duplicate name", rule.Name)
+		}
+		names[rule.Name] = true
+		if (rule.CloudFunction == nil) == (rule.Workflow == nil) {
+			return nil, fmt.Errorf("%s: exactly one of cloud_function and workflow is required", rule.Name)
+		}
+		if rule.CloudFunction != nil && rule.CloudFunction.URL == "" {
+			return nil, fmt.Errorf("%s: cloud_function: no url configured", rule.Name)
+		}
+		if rule.Workflow != nil && rule.Workflow.Name == "" {
+			return nil, fmt.Errorf("%s: workflow: no name configured", rule.Name)
+		}
+		if rule.MinSeverity != "" && rule.MinSeverity != SeverityWarning && rule.MinSeverity != SeverityCritical {
+			return nil, fmt.Errorf("%s: unknown min_severity %s", rule.Name, rule.MinSeverity)
+		}
+		if rule.MaxPerHour < 0 {
+			return nil, fmt.Errorf("%s: max_per_hour must not be negative", rule.Name)
+		}
+		if rule.MaxPerHour == 0 {
+			rule.MaxPerHour = 1
+		}
+		if len(rule.Kinds) == 0 {
+			rule.Kinds = []string{KindAnomaly}
+		}
+		match, err := compileAnomalyMatch(rule.Metric, rule.Matchers)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", rule.Name, err)
+		}
+		c := remediation{RemediationRule: rule, match: match, kinds: make(map[string]bool), types: make(map[string]bool)}
+		for _, kind := range rule.Kinds {
+			c.kinds[kind] = true
+		}
+		for _, anomalyType := range rule.Types {
+			c.types[anomalyType] = true
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+// matches reports whether the rule remediates the anomaly
+func (r remediation) matches(anomaly Anomaly) bool {
+	if !r.kinds[anomaly.Kind] {
+		return false
+	}
+	if len(r.types) > 0 && !r.types[anomaly.Type] {
+		return false
+	}
+	if r.MinSeverity == SeverityCritical && anomaly.Severity != SeverityCritical {
+		return false
+	}
+	return r.match.matches(anomaly)
+}
+
+// remediator runs the remediation rules for the anomalies notified by the router
+type remediator struct {
+	rules       []remediation
+	schema      anomalySchema
+	credentials CredentialsConfig
+
+	mu         sync.Mutex
+	executions map[string][]time.Time // of every rule in the last hour, by rule name
+	remediated map[string]time.Time   // when each anomaly was remediated, by rule name and anomaly ID
+	workflows  *http.Client           // created on first use
+	functions  map[string]*http.Client
+}
+
+func newRemediator(rules []remediation, schema anomalySchema, credentials CredentialsConfig) *remediator {
+	return &remediator{
+		rules:       rules,
+		schema:      schema,
+		credentials: credentials,
+		executions:  make(map[string][]time.Time),
+		remediated:  make(map[string]time.Time),
+		functions:   make(map[string]*http.Client),
+	}
+}
+
+// run executes the rules matching each anomaly, once per anomaly and rule. A rule that already
+// ran max_per_hour times in the last hour is held back, and runs for the anomaly on a later
+// cycle if it is still reported then. It returns the errors of the executions that failed.
+func (r *remediator) run(ctx context.Context, anomalies []Anomaly, now time.Time) []error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for key, at := range r.remediated {
+		if now.Sub(at) > remediatedRetention {
+			delete(r.remediated, key)
+		}
+	}
+
+	var errs []error
+	for _, anomaly := range anomalies {
+		for _, rule := range r.rules {
+			if !rule.matches(anomaly) {
+				continue
+			}
+			key := rule.Name + "/" + anomaly.ID
+			if _, ok := r.remediated[key]; ok {
+				continue
+			}
+			recent := r.executions[rule.Name][:0]
+			for _, at := range r.executions[rule.Name] {
+				if now.Sub(at) < time.Hour {
+					recent = append(recent, at)
+				}
+			}
+			r.executions[rule.Name] = recent
+			if len(recent) >= rule.MaxPerHour {
+				log.Printf("Remediation %s of anomaly %s on %s held back, it ran %d times in the last hour\n", rule.Name, anomaly.ID, anomaly.MetricName, len(recent))
+				continue
+			}
+			r.executions[rule.Name] = append(recent, now)
+			if rule.DryRun {
+				log.Printf("Dry run: remediation %s would %s for anomaly %s on %s\n", rule.Name, rule.action(), anomaly.ID, anomaly.MetricName)
+				r.remediated[key] = now
+				continue
+			}
+			if err := r.execute(ctx, rule, anomaly); err != nil {
+				log.Printf("Remediation %s of anomaly %s failed: %v", rule.Name, anomaly.ID, err)
+				errs = append(errs, fmt.Errorf("remediation %s of anomaly %s on %s: %v", rule.Name, anomaly.ID, anomaly.MetricName, err))
+				continue
+			}
+			log.Printf("Remediation %s ran %s for anomaly %s on %s\n", rule.Name, rule.action(), anomaly.ID, anomaly.MetricName)
+			r.remediated[key] = now
+		}
+	}
+	return errs
+}
+
+// action describes the action of the rule for logs
+func (r remediation) action() string {
+	if r.CloudFunction != nil {
+		return "invoke " + r.CloudFunction.URL
+	}
+	return "execute workflow " + r.Workflow.Name
+}
+
+// execute runs the action of the rule with the payload of the anomaly. The caller holds mu.
+func (r *remediator) execute(ctx context.Context, rule remediation, anomaly Anomaly) error {
+	payload := r.schema.payload(anomaly)
+	if rule.CloudFunction != nil {
+		client, err := r.functionClient(ctx, rule.CloudFunction.URL)
+		if err != nil {
+			return err
+		}
+		return postJSON(ctx, client, rule.CloudFunction.URL, nil, payload)
+	}
+	client, err := r.workflowClient(ctx)
+	if err != nil {
+		return err
+	}
+	argument, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	executionsURL := fmt.Sprintf("https://workflowexecutions.googleapis.com/v1/%s/executions", rule.Workflow.Name)
+	return postJSON(ctx, client, executionsURL, nil, map[string]string{"argument": string(argument)})
+}
+
+// functionClient returns a client authenticating to the function at url with an ID token whose
+// audience is url, creating it on first use. The caller holds mu.
+func (r *remediator) functionClient(ctx context.Context, url string) (*http.Client, error) {
+	if client, ok := r.functions[url]; ok {
+		return client, nil
+	}
+	opts, err := r.credentials.clientOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client, err := idtoken.NewClient(ctx, url, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create ID token client: %v", err)
+	}
+	r.functions[url] = client
+	return client, nil
+}
+
+// workflowClient returns the client of the Workflow Executions API, creating it on first use.
+// The caller holds mu.
+func (r *remediator) workflowClient(ctx context.Context) (*http.Client, error) {
+	if r.workflows != nil {
+		return r.workflows, nil
+	}
+	opts, err := r.credentials.clientOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client, _, err := htransport.NewClient(ctx, append(opts, option.WithScopes(cloudPlatformScope))...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Workflow Executions client: %v", err)
+	}
+	r.workflows = client
+	return client, nil
+}
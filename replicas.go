@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sort"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// ReplicasConfig compares every series of a metric with the other series of its group, such as
+// the instances or pods behind one load balancer, to find the single misbehaving replica
+type ReplicasConfig struct {
+	GroupBy         []string `yaml:"group_by"`          // series labels identifying a group, e.g. [backend_service_name], all series form one group if empty
+	ZScoreThreshold float64  `yaml:"z_score_threshold"` // defaults to the global threshold
+	MinReplicas     int      `yaml:"min_replicas"`      // series a group needs for a comparison, defaults to 3
+}
+
+func (c ReplicasConfig) validate() error {
+	if c.MinReplicas != 0 && c.MinReplicas < 3 {
+		return fmt.Errorf("min_replicas must be at least 3")
+	}
+	return nil
+}
+
+// CompareReplicas scores the recent mean of every series of the metrics with a replica
+// comparison against the median and MAD of the other series of its group. A deviating replica
+// is reported once until it is back in line with the others.
+func (d *SimpleAnomalyDetector) CompareReplicas(recentMetrics []*monitoringpb.TimeSeries, config *Config) []Anomaly {
+	if d.replicaOutliers == nil {
+		d.replicaOutliers = make(map[string]bool)
+	}
+
+	byMetric := make(map[string][]*monitoringpb.TimeSeries)
+	for _, ts := range recentMetrics {
+		byMetric[ts.Metric.Type] = append(byMetric[ts.Metric.Type], ts)
+	}
+
+	var anomalies []Anomaly
+	for _, metricConfig := range config.Metrics {
+		if metricConfig.Replicas == nil || len(byMetric[metricConfig.Type]) == 0 {
+			continue
+		}
+		replicas := *metricConfig.Replicas
+		if replicas.ZScoreThreshold == 0 {
+			replicas.ZScoreThreshold = config.ZScoreThreshold
+		}
+		if replicas.MinReplicas == 0 {
+			replicas.MinReplicas = 3
+		}
+		for _, group := range groupReplicas(byMetric[metricConfig.Type], replicas.GroupBy) {
+			anomalies = append(anomalies, d.compareReplicas(metricConfig.Type, replicas, group)...)
+		}
+	}
+	return anomalies
+}
+
+// replicaGroup is the series of one group of replicas, each as a peerGroup of its own points
+// named by its series fingerprint
+type replicaGroup struct {
+	name     string
+	series   []*monitoringpb.TimeSeries
+	replicas []*peerGroup
+}
+
+func (d *SimpleAnomalyDetector) compareReplicas(metricType string, config ReplicasConfig, group replicaGroup) []Anomaly {
+	if len(group.replicas) < config.MinReplicas {
+		log.Printf("Replica comparison of %s%s skipped: %d series, %d needed\n", metricType, group.name, len(group.replicas), config.MinReplicas)
+		return nil
+	}
+
+	var anomalies []Anomaly
+	for i, replica := range group.replicas {
+		stats, mad := peerStats(group.replicas, i)
+		median := stats.mean
+		zScore := d.zeroStdDev.zScore(replica.stats.Mean, stats, config.ZScoreThreshold)
+
+		ts := group.series[i]
+		fingerprint := replica.name
+		if math.Abs(zScore) <= config.ZScoreThreshold {
+			if d.replicaOutliers[fingerprint] {
+				log.Printf("Series %s of %s is back in line with its group\n", fingerprint, metricType)
+				delete(d.replicaOutliers, fingerprint)
+			}
+			continue
+		}
+		if d.replicaOutliers[fingerprint] {
+			continue
+		}
+		d.replicaOutliers[fingerprint] = true
+		log.Printf("Replica comparison of %s%s: series %s mean %.2f, group median %.2f, Z-score %.2f\n", metricType, group.name, fingerprint, replica.stats.Mean, median, zScore)
+
+		margin := d.zeroStdDev.margin(stats, config.ZScoreThreshold)
+		expected := newExpectedRange(median-margin, median+margin, replica.stats.Mean, median, replica.unit)
+		anomalies = append(anomalies, Anomaly{
+			ID:         anomalyID(anomalyFingerprint(KindReplica, fingerprint), replica.latest),
+			Kind:       KindReplica,
+			MetricName: metricType,
+			Value:      replica.stats.Mean,
+			Unit:       replica.unit,
+			ZScore:     zScore,
+			Timestamp:  replica.latest,
+			Message: fmt.Sprintf("Series deviates from the %d other series of its group with mean %s, median %s (MAD %s), %s",
+				stats.count, formatValue(replica.stats.Mean, replica.unit), formatValue(median, replica.unit), formatValue(mad, replica.unit), expected),
+
+			Fingerprint:       anomalyFingerprint(KindReplica, fingerprint),
+			SeriesFingerprint: fingerprint,
+			Labels:            seriesLabels(ts),
+			Expected:          expected,
+		})
+	}
+	return anomalies
+}
+
+// groupReplicas splits the series by the values of the group labels, sorted by group. Series
+// without points are left out.
+func groupReplicas(series []*monitoringpb.TimeSeries, groupBy []string) []replicaGroup {
+	byName := make(map[string]*replicaGroup)
+	for _, ts := range series {
+		if len(ts.Points) == 0 {
+			continue
+		}
+		labels := seriesLabels(ts)
+		values := make(map[string]string, len(groupBy))
+		for _, label := range groupBy {
+			values[label] = labels[label]
+		}
+		name := ""
+		if len(values) > 0 {
+			name = " {" + formatLabels(values) + "}"
+		}
+		group, ok := byName[name]
+		if !ok {
+			group = &replicaGroup{name: name}
+			byName[name] = group
+		}
+		replica := &peerGroup{name: seriesFingerprint(ts), unit: ts.Unit}
+		for _, point := range ts.Points {
+			replica.stats.Add(pointValue(point))
+			if t := point.Interval.EndTime.AsTime(); t.After(replica.latest) {
+				replica.latest = t
+			}
+		}
+		group.series = append(group.series, ts)
+		group.replicas = append(group.replicas, replica)
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	groups := make([]replicaGroup, len(names))
+	for i, name := range names {
+		groups[i] = *byName[name]
+	}
+	return groups
+}
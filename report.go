@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ReportConfig delivers the anomaly summaries of the report command
+type ReportConfig struct {
+	SlackWebhookURL string             `yaml:"slack_webhook_url" secret:"true"` // optional Slack incoming webhook the summary is posted to
+	Email           *ReportEmailConfig `yaml:"email"`                           // optional email delivery of the summary as HTML
+	TimeZone        string             `yaml:"time_zone"`                       // IANA time zone of the busiest hours, defaults to UTC
+}
+
+// ReportEmailConfig sends the summary through an SMTP server
+type ReportEmailConfig struct {
+	SMTPHost string   `yaml:"smtp_host"`
+	SMTPPort int      `yaml:"smtp_port"` // defaults to 587
+	Username string   `yaml:"username"`  // optional PLAIN authentication
+	Password string   `yaml:"password" secret:"true"`
+	From     string   `yaml:"from"`
+	To       []string `yaml:"to"`
+}
+
+// validate checks the report settings
+func (c ReportConfig) validate() error {
+	if _, err := time.LoadLocation(c.TimeZone); err != nil {
+		return fmt.Errorf("invalid time_zone %s: %v", c.TimeZone, err)
+	}
+	if email := c.Email; email != nil && (email.SMTPHost == "" || email.From == "" || len(email.To) == 0) {
+		return fmt.Errorf("email: smtp_host, from and to are required")
+	}
+	return nil
+}
+
+// reportCount is a count of events by a name, such as a metric or an hour of the day
+type reportCount struct {
+	Name  string
+	Count int
+}
+
+// anomalyReport summarises the anomaly events opened in a period
+type anomalyReport struct {
+	Start, End   time.Time
+	Events       int
+	Critical     int
+	Open         int
+	Acknowledged int
+	Resolved     int
+	Kinds        []reportCount
+	TopMetrics   []reportCount
+	BusiestHours []reportCount // by hour of the day in the report's time zone
+	// MeanTimeToResolve is averaged over the resolved events, zero without any
+	MeanTimeToResolve time.Duration
+}
+
+// runReport summarises the anomaly events of a period from the persisted event lifecycle as
+// Markdown or HTML, for periodic reviews such as a weekly operations meeting. It is meant to be
+// run on a schedule, e.g. by cron or Cloud Scheduler, and can post the summary to Slack or email
+// it.
+func runReport(args []string) {
+	fs := flag.NewFlagSet("report", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	period := fs.Duration("period", 7*24*time.Hour, "Period the report covers, ending now, e.g. 24h for a daily report")
+	format := fs.String("format", "markdown", "Format of the report: markdown or html")
+	output := fs.String("output", "", "Local file or gs:// URI the report is written to, stdout by default")
+	top := fs.Int("top", 10, "Number of metrics and hours listed")
+	send := fs.Bool("send", false, "Post the report to Slack and email it as configured under report")
+	fs.Parse(args)
+
+	if *format != "markdown" && *format != "html" {
+		log.Fatalf("Unknown format %s, expected markdown or html", *format)
+	}
+	if *period <= 0 || *top <= 0 {
+		log.Fatalf("The -period and -top flags must be positive")
+	}
+	config := mustLoadConfig(*configPath)
+	if config.Lifecycle.Path == "" {
+		log.Fatalf("The report reads the persisted events: set lifecycle.path")
+	}
+	var delivery ReportConfig
+	if config.Report != nil {
+		delivery = *config.Report
+	}
+	if *send && delivery.SlackWebhookURL == "" && delivery.Email == nil {
+		log.Fatalf("Nothing to send the report to: configure report.slack_webhook_url or report.email")
+	}
+	registerSecrets(delivery)
+
+	ctx := context.Background()
+	store, err := NewEventStore(ctx, config.Lifecycle, config.timeSource())
+	if err != nil {
+		log.Fatalf("Failed to load events: %v", err)
+	}
+	// Validated when the configuration was loaded
+	location, _ := time.LoadLocation(delivery.TimeZone)
+	end := time.Now()
+	report := summariseEvents(config, store.List(""), end.Add(-*period), end, location, *top)
+	if *period > resolvedEventRetention {
+		log.Printf("Resolved events are kept for %s, so the report misses those resolved earlier\n", resolvedEventRetention)
+	}
+
+	var rendered []byte
+	if *format == "html" {
+		rendered, err = report.html(config)
+		if err != nil {
+			log.Fatalf("Failed to render report: %v", err)
+		}
+	} else {
+		rendered = []byte(report.markdown(config, false))
+	}
+	if *output == "" {
+		os.Stdout.Write(rendered)
+	} else if err := writeObject(ctx, *output, rendered); err != nil {
+		log.Fatalf("Failed to write report: %v", err)
+	}
+
+	if !*send {
+		return
+	}
+	failed := false
+	if delivery.SlackWebhookURL != "" {
+		if err := postSlackReport(ctx, delivery.SlackWebhookURL, report.markdown(config, true)); err != nil {
+			log.Printf("Failed to post report to Slack: %v", err)
+			failed = true
+		}
+	}
+	if delivery.Email != nil {
+		if err := emailReport(*delivery.Email, report, config); err != nil {
+			log.Printf("Failed to email report: %v", err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// summariseEvents summarises the events opened from start to end, listing the top metrics and
+// busiest hours
+func summariseEvents(config *Config, events []Event, start, end time.Time, location *time.Location, top int) anomalyReport {
+	report := anomalyReport{Start: start, End: end}
+	kinds := make(map[string]int)
+	metrics := make(map[string]int)
+	hours := make(map[int]int)
+	var resolving time.Duration
+	for _, event := range events {
+		if event.OpenedAt.Before(start) || event.OpenedAt.After(end) {
+			continue
+		}
+		report.Events++
+		if event.Anomaly.Severity == SeverityCritical {
+			report.Critical++
+		}
+		switch event.State {
+		case EventOpen:
+			report.Open++
+		case EventAcknowledged:
+			report.Acknowledged++
+		case EventResolved:
+			report.Resolved++
+			resolving += event.latest().At.Sub(event.OpenedAt)
+		}
+		kinds[event.Kind]++
+		metrics[config.displayName(event.MetricName)]++
+		hours[event.OpenedAt.In(location).Hour()]++
+	}
+	if report.Resolved > 0 {
+		report.MeanTimeToResolve = (resolving / time.Duration(report.Resolved)).Round(time.Second)
+	}
+
+	report.Kinds = rankCounts(kinds, len(kinds))
+	report.TopMetrics = rankCounts(metrics, top)
+	byHour := make(map[string]int, len(hours))
+	for hour, count := range hours {
+		byHour[fmt.Sprintf("%02d:00 %s", hour, location)] = count
+	}
+	report.BusiestHours = rankCounts(byHour, top)
+	return report
+}
+
+// rankCounts returns the n largest counts, ties in name order
+func rankCounts(counts map[string]int, n int) []reportCount {
+	ranked := make([]reportCount, 0, len(counts))
+	for name, count := range counts {
+		ranked = append(ranked, reportCount{Name: name, Count: count})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Count != ranked[j].Count {
+			return ranked[i].Count > ranked[j].Count
+		}
+		return ranked[i].Name < ranked[j].Name
+	})
+	if len(ranked) > n {
+		ranked = ranked[:n]
+	}
+	return ranked
+}
+
+// title names the report by its project and period
+func (r anomalyReport) title(config *Config) string {
+	return fmt.Sprintf("Anomaly report for %s, %s to %s", config.ProjectID, displayTime(r.Start), displayTime(r.End))
+}
+
+// meanTimeToResolve formats the mean time to resolution, "n/a" without resolved events
+func (r anomalyReport) meanTimeToResolve() string {
+	if r.Resolved == 0 {
+		return "n/a"
+	}
+	return r.MeanTimeToResolve.String()
+}
+
+// markdown renders the report as Markdown or, for Slack, in its mrkdwn flavour, which has bold
+// text in place of headings
+func (r anomalyReport) markdown(config *Config, slack bool) string {
+	var b strings.Builder
+	heading := func(level int, text string) {
+		if slack {
+			fmt.Fprintf(&b, "*%s*\n", text)
+			return
+		}
+		fmt.Fprintf(&b, "%s %s\n\n", strings.Repeat("#", level), text)
+	}
+	list := func(counts []reportCount) {
+		if len(counts) == 0 {
+			b.WriteString("- none\n")
+		}
+		for _, count := range counts {
+			fmt.Fprintf(&b, "- %s: %d\n", count.Name, count.Count)
+		}
+		b.WriteString("\n")
+	}
+
+	heading(1, r.title(config))
+	fmt.Fprintf(&b, "- Events: %d (%d critical)\n", r.Events, r.Critical)
+	fmt.Fprintf(&b, "- Open: %d, acknowledged: %d, resolved: %d\n", r.Open, r.Acknowledged, r.Resolved)
+	fmt.Fprintf(&b, "- Mean time to resolution: %s\n\n", r.meanTimeToResolve())
+	heading(2, "Top metrics")
+	list(r.TopMetrics)
+	heading(2, "Busiest hours")
+	list(r.BusiestHours)
+	heading(2, "Kinds")
+	list(r.Kinds)
+	return b.String()
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Title}}</title></head>
+<body>
+<h1>{{.Title}}</h1>
+<ul>
+<li>Events: {{.Report.Events}} ({{.Report.Critical}} critical)</li>
+<li>Open: {{.Report.Open}}, acknowledged: {{.Report.Acknowledged}}, resolved: {{.Report.Resolved}}</li>
+<li>Mean time to resolution: {{.MeanTimeToResolve}}</li>
+</ul>
+{{define "counts"}}<table>
+<tr><th align="left">{{.Header}}</th><th align="right">Events</th></tr>
+{{range .Counts}}<tr><td>{{.Name}}</td><td align="right">{{.Count}}</td></tr>
+{{else}}<tr><td colspan="2">none</td></tr>
+{{end}}</table>{{end}}
+<h2>Top metrics</h2>
+{{template "counts" (.Table "Metric" .Report.TopMetrics)}}
+<h2>Busiest hours</h2>
+{{template "counts" (.Table "Hour" .Report.BusiestHours)}}
+<h2>Kinds</h2>
+{{template "counts" (.Table "Kind" .Report.Kinds)}}
+</body>
+</html>
+`))
+
+// reportPage is the data of the HTML template
+type reportPage struct {
+	Title             string
+	MeanTimeToResolve string
+	Report            anomalyReport
+}
+
+// reportTable is a table of counts in the HTML template
+type reportTable struct {
+	Header string
+	Counts []reportCount
+}
+
+// Table returns a table of counts under the header
+func (reportPage) Table(header string, counts []reportCount) reportTable {
+	return reportTable{Header: header, Counts: counts}
+}
+
+// html renders the report as an HTML page
+func (r anomalyReport) html(config *Config) ([]byte, error) {
+	var b bytes.Buffer
+	if err := reportTemplate.Execute(&b, reportPage{Title: r.title(config), MeanTimeToResolve: r.meanTimeToResolve(), Report: r}); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// postSlackReport posts the text to a Slack incoming webhook
+func postSlackReport(ctx context.Context, webhookURL, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := (&http.Client{Timeout: 30 * time.Second}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// emailReport sends the report as an HTML email
+func emailReport(config ReportEmailConfig, report anomalyReport, detector *Config) error {
+	page, err := report.html(detector)
+	if err != nil {
+		return err
+	}
+	port := config.SMTPPort
+	if port == 0 {
+		port = 587
+	}
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", config.From)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(config.To, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", report.title(detector))
+	message.WriteString("MIME-Version: 1.0\r\nContent-Type: text/html; charset=UTF-8\r\n\r\n")
+	message.Write(page)
+
+	var auth smtp.Auth
+	if config.Username != "" {
+		auth = smtp.PlainAuth("", config.Username, config.Password, config.SMTPHost)
+	}
+	return smtp.SendMail(fmt.Sprintf("%s:%d", config.SMTPHost, port), auth, config.From, config.To, message.Bytes())
+}
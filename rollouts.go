@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+const (
+	// rolloutSuppress holds back the notifications of anomalies during rollouts
+	rolloutSuppress = "suppress"
+	// rolloutDowngrade notifies the anomalies during rollouts as warnings
+	rolloutDowngrade = "downgrade"
+
+	// loggingReadScope lets the detector read rollout markers from Cloud Logging
+	loggingReadScope = "https://www.googleapis.com/auth/logging.read"
+
+	// rolloutLogPages caps the pages of log entries read per marker and cycle
+	rolloutLogPages = 5
+)
+
+// RolloutsConfig holds back or down-ranks the anomalies of services being deployed, which are
+// expected while new versions roll out
+type RolloutsConfig struct {
+	Action       string                `yaml:"action"`        // suppress (default) or downgrade, which notifies critical anomalies as warnings
+	AfterMin     int                   `yaml:"after_min"`     // minutes after a rollout its anomalies are still affected, defaults to 15
+	ServiceLabel string                `yaml:"service_label"` // label of the anomalies naming their service, matched against the service of rollouts; every anomaly is affected when empty
+	Markers      []RolloutMarkerConfig `yaml:"markers"`
+}
+
+// RolloutMarkerConfig is a source of rollouts: Cloud Deploy rollouts, GKE deployment updates,
+// log entries matching a filter or the points of a metric
+type RolloutMarkerConfig struct {
+	Name         string `yaml:"name"`          // identifies the marker in logs and anomalies, defaults to the preset or marker number
+	Preset       string `yaml:"preset"`        // cloud_deploy or gke, setting the log filter and service field
+	LogFilter    string `yaml:"log_filter"`    // Cloud Logging filter of the entries marking rollouts
+	Metric       string `yaml:"metric"`        // metric type whose nonzero points mark rollouts, such as a deployment counter
+	ServiceField string `yaml:"service_field"` // field of the log entries, such as labels.service, or label of the metric naming the service rolled out
+}
+
+// rolloutPresets are the log filters and service fields of the rollouts of managed platforms.
+// Resource names, such as those of GKE deployments, are reduced to their last segment.
+var rolloutPresets = map[string]RolloutMarkerConfig{
+	"cloud_deploy": {
+		LogFilter:    `resource.type="clouddeploy.googleapis.com/DeliveryPipeline" AND logName:"clouddeploy.googleapis.com%2Frollout_update"`,
+		ServiceField: "resource.labels.pipeline_id",
+	},
+	"gke": {
+		LogFilter:    `resource.type="k8s_cluster" AND protoPayload.methodName=("io.k8s.apps.v1.deployments.update" OR "io.k8s.apps.v1.deployments.patch")`,
+		ServiceField: "protoPayload.resourceName",
+	},
+}
+
+// validate checks the rollouts configuration, applying the presets of the markers
+func (c *RolloutsConfig) validate() error {
+	if c.Action != "" && c.Action != rolloutSuppress && c.Action != rolloutDowngrade {
+		return fmt.Errorf("unknown action %q, expected suppress or downgrade", c.Action)
+	}
+	if c.AfterMin < 0 {
+		return fmt.Errorf("after_min must not be negative")
+	}
+	if len(c.Markers) == 0 {
+		return fmt.Errorf("no markers configured")
+	}
+	for i := range c.Markers {
+		marker := &c.Markers[i]
+		if marker.Preset != "" {
+			preset, ok := rolloutPresets[marker.Preset]
+			if !ok {
+				return fmt.Errorf("marker %d: unknown preset %q, expected cloud_deploy or gke", i+1, marker.Preset)
+			}
+			if marker.LogFilter == "" {
+				marker.LogFilter = preset.LogFilter
+			}
+			if marker.ServiceField == "" {
+				marker.ServiceField = preset.ServiceField
+			}
+		}
+		if (marker.LogFilter == "") == (marker.Metric == "") {
+			return fmt.Errorf("marker %d: needs exactly one of preset, log_filter or metric", i+1)
+		}
+		if marker.Name == "" {
+			marker.Name = marker.Preset
+		}
+		if marker.Name == "" {
+			marker.Name = fmt.Sprintf("marker %d", i+1)
+		}
+	}
+	return nil
+}
+
+// rollout is a deployment seen by a marker
+type rollout struct {
+	marker  string
+	service string // empty when the marker does not name one, affecting every service
+	time    time.Time
+}
+
+// describe words the rollout, such as "gke rollout of checkout at 2024-05-01T12:00:00Z"
+func (r rollout) describe() string {
+	subject := r.marker + " rollout"
+	if r.service != "" {
+		subject += " of " + r.service
+	}
+	return subject + " at " + r.time.UTC().Format(time.RFC3339)
+}
+
+// rolloutTracker reads the rollouts of the markers every cycle
+type rolloutTracker struct {
+	config      RolloutsConfig
+	projectID   string
+	credentials CredentialsConfig
+
+	mu   sync.Mutex
+	http *http.Client // created on first use, for log markers only
+}
+
+func newRolloutTracker(config RolloutsConfig, projectID string, credentials CredentialsConfig) *rolloutTracker {
+	if config.Action == "" {
+		config.Action = rolloutSuppress
+	}
+	if config.AfterMin == 0 {
+		config.AfterMin = 15
+	}
+	return &rolloutTracker{config: config, projectID: projectID, credentials: credentials}
+}
+
+// mark sets the rollout of the anomalies that started during or within after_min of a rollout
+// of their service, downgrading them with the downgrade action. Canary anomalies are left alone,
+// as comparing a rollout with its control is what they are for. A marker that cannot be read is
+// logged and skipped, so its rollouts go unnoticed rather than failing the cycle.
+func (t *rolloutTracker) mark(ctx context.Context, client *monitoring.MetricClient, anomalies []Anomaly, recentDuration time.Duration, now time.Time) {
+	if t == nil || len(anomalies) == 0 {
+		return
+	}
+	after := time.Duration(t.config.AfterMin) * time.Minute
+	start := now.Add(-recentDuration - after)
+	var rollouts []rollout
+	for _, marker := range t.config.Markers {
+		var found []rollout
+		var err error
+		if marker.Metric != "" {
+			found, err = metricRollouts(client, t.projectID, marker, start, now)
+		} else {
+			found, err = t.logRollouts(ctx, marker, start, now)
+		}
+		if err != nil {
+			log.Printf("Could not read the rollouts of marker %s: %v", marker.Name, err)
+			continue
+		}
+		rollouts = append(rollouts, found...)
+	}
+	// The latest rollout is the one an anomaly is put down to
+	sort.Slice(rollouts, func(i, j int) bool { return rollouts[i].time.After(rollouts[j].time) })
+
+	for i := range anomalies {
+		anomaly := &anomalies[i]
+		if anomaly.Kind == KindCanary {
+			continue
+		}
+		for _, r := range rollouts {
+			if anomaly.Timestamp.Before(r.time) || anomaly.Timestamp.After(r.time.Add(after)) || !t.affects(r, *anomaly) {
+				continue
+			}
+			anomaly.Rollout = r.describe()
+			if t.config.Action == rolloutDowngrade && anomaly.Severity == SeverityCritical {
+				anomaly.Severity = SeverityWarning
+				anomaly.Message += " (downgraded during the " + anomaly.Rollout + ")"
+			}
+			break
+		}
+	}
+}
+
+// affects reports whether the rollout concerns the service of the anomaly, looked up like the
+// labels of suppression rules
+func (t *rolloutTracker) affects(r rollout, anomaly Anomaly) bool {
+	if r.service == "" || t.config.ServiceLabel == "" {
+		return true
+	}
+	service, ok := anomaly.Labels[t.config.ServiceLabel]
+	if !ok {
+		service = anomaly.Metadata[t.config.ServiceLabel]
+	}
+	return service == r.service
+}
+
+// metricRollouts returns a rollout for every nonzero point of the marker metric
+func metricRollouts(client *monitoring.MetricClient, projectID string, marker RolloutMarkerConfig, start, end time.Time) ([]rollout, error) {
+	series, err := fetchMetricsInRange(client, "rollout marker", projectID, []string{marker.Metric}, start, end, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	var rollouts []rollout
+	for _, ts := range series {
+		service := seriesLabels(ts)[marker.ServiceField]
+		for _, point := range ts.Points {
+			if pointValue(point) != 0 {
+				rollouts = append(rollouts, rollout{marker: marker.Name, service: service, time: point.Interval.EndTime.AsTime()})
+			}
+		}
+	}
+	return rollouts, nil
+}
+
+// logEntries is a page of the response of entries.list of the Logging API
+type logEntries struct {
+	Entries       []map[string]interface{} `json:"entries"`
+	NextPageToken string                   `json:"nextPageToken"`
+}
+
+// logRollouts returns a rollout for every log entry matching the filter of the marker
+func (t *rolloutTracker) logRollouts(ctx context.Context, marker RolloutMarkerConfig, start, end time.Time) ([]rollout, error) {
+	client, err := t.httpClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filter := fmt.Sprintf("(%s) AND timestamp >= %q AND timestamp <= %q", marker.LogFilter, start.UTC().Format(time.RFC3339), end.UTC().Format(time.RFC3339))
+	request := map[string]interface{}{
+		"resourceNames": []string{"projects/" + t.projectID},
+		"filter":        filter,
+		"orderBy":       "timestamp desc",
+		"pageSize":      1000,
+	}
+	var rollouts []rollout
+	for page := 0; page < rolloutLogPages; page++ {
+		var response logEntries
+		if err := listLogEntries(ctx, client, request, &response); err != nil {
+			return nil, err
+		}
+		for _, entry := range response.Entries {
+			timestamp, _ := entry["timestamp"].(string)
+			at, err := time.Parse(time.RFC3339Nano, timestamp)
+			if err != nil {
+				continue
+			}
+			rollouts = append(rollouts, rollout{marker: marker.Name, service: entryField(entry, marker.ServiceField), time: at})
+		}
+		if response.NextPageToken == "" {
+			break
+		}
+		request["pageToken"] = response.NextPageToken
+	}
+	return rollouts, nil
+}
+
+// listLogEntries reads a page of the log entries matching the request
+func listLogEntries(ctx context.Context, client *http.Client, request map[string]interface{}, out *logEntries) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://logging.googleapis.com/v2/entries:list", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// httpClient returns the client of the Logging API, creating it on first use
+func (t *rolloutTracker) httpClient(ctx context.Context) (*http.Client, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.http != nil {
+		return t.http, nil
+	}
+	client, err := newLoggingClient(ctx, t.credentials)
+	if err != nil {
+		return nil, err
+	}
+	t.http = client
+	return client, nil
+}
+
+// newLoggingClient returns a client of the Logging API allowed to read log entries
+func newLoggingClient(ctx context.Context, credentials CredentialsConfig) (*http.Client, error) {
+	opts, err := credentials.clientOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client, _, err := htransport.NewClient(ctx, append(opts, option.WithScopes(loggingReadScope))...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Logging client: %v", err)
+	}
+	return client, nil
+}
+
+// entryField returns the string at the dotted path of the log entry, reduced to its last path
+// segment, or empty if there is none
+func entryField(entry map[string]interface{}, field string) string {
+	if field == "" {
+		return ""
+	}
+	s := entryString(entry, field)
+	if s == "" {
+		return ""
+	}
+	if unescaped, err := url.PathUnescape(s); err == nil {
+		s = unescaped
+	}
+	return path.Base(strings.TrimSuffix(s, "/"))
+}
+
+// entryString returns the string at the dotted path of the log entry, or empty if there is none
+func entryString(entry map[string]interface{}, field string) string {
+	var value interface{} = entry
+	for _, key := range strings.Split(field, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[key]
+	}
+	s, _ := value.(string)
+	return s
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+const (
+	// rollupRegion sums the series of a metric per region
+	rollupRegion = "region"
+	// rollupGlobal sums all the series of a metric
+	rollupGlobal = "global"
+)
+
+// RollupsConfig also scores a metric grouped per zone at the level of regions and of the whole
+// service, so a deviation spread thinly over many zones is caught as well as one in a single zone
+type RollupsConfig struct {
+	Levels    []string `yaml:"levels"`     // region and global
+	ZoneLabel string   `yaml:"zone_label"` // label of the series naming their zone, defaults to zone
+	Reducer   string   `yaml:"reducer"`    // sum (default) or mean of the series rolled up
+}
+
+func (c RollupsConfig) validate() error {
+	if len(c.Levels) == 0 {
+		return fmt.Errorf("no levels configured")
+	}
+	seen := make(map[string]bool)
+	for _, level := range c.Levels {
+		if level != rollupRegion && level != rollupGlobal {
+			return fmt.Errorf("unknown level %q, expected region or global", level)
+		}
+		if seen[level] {
+			return fmt.Errorf("level %s configured twice", level)
+		}
+		seen[level] = true
+	}
+	if c.Reducer != "" && c.Reducer != "sum" && c.Reducer != "mean" {
+		return fmt.Errorf("unknown reducer %q, expected sum or mean", c.Reducer)
+	}
+	return nil
+}
+
+// rollupSource is what a rollup metric is computed from
+type rollupSource struct {
+	parent    string // type of the metric rolled up
+	level     string
+	zoneLabel string
+	mean      bool
+}
+
+// rollupMetricType returns the type of the rollup of a metric at a level
+func rollupMetricType(parent, level string) string {
+	return parent + "/rollup/" + level
+}
+
+// addRollups adds a metric for every rollup level of the metrics with rollups. A rollup metric
+// is derived from the series of its metric, sharing its polling interval, static labels, tags
+// and the options shaping how it is scored, and gets its own baseline.
+func (c *Config) addRollups() {
+	for _, metric := range c.Metrics {
+		if metric.Rollups == nil {
+			continue
+		}
+		zoneLabel := metric.Rollups.ZoneLabel
+		if zoneLabel == "" {
+			zoneLabel = "zone"
+		}
+		for _, level := range metric.Rollups.Levels {
+			name := metric.DisplayName
+			if name == "" {
+				name = metric.Type
+			}
+			c.Metrics = append(c.Metrics, MetricConfig{
+				Type:        rollupMetricType(metric.Type, level),
+				DisplayName: fmt.Sprintf("%s (%s rollup)", name, level),
+				Labels:      metric.Labels,
+				PollingTime: metric.PollingTime,
+				Tags:        metric.Tags,
+				Condition:   metric.Condition,
+				ActiveHours: metric.ActiveHours,
+				Windows:     metric.Windows,
+				Seasonality: metric.Seasonality,
+				Transform:   metric.Transform,
+				Cost:        metric.Cost,
+				Flag:        metric.Flag,
+				rollup:      &rollupSource{parent: metric.Type, level: level, zoneLabel: zoneLabel, mean: metric.Rollups.Reducer == "mean"},
+			})
+		}
+	}
+}
+
+// zoneSuffix is the suffix of a zone name, such as -a in us-central1-a
+var zoneSuffix = regexp.MustCompile(`^([a-z]+-[a-z]+[0-9]+)-[a-z]$`)
+
+// regionOf returns the region of a zone, or the value itself if it is not a zone name
+func regionOf(zone string) string {
+	if parts := zoneSuffix.FindStringSubmatch(zone); parts != nil {
+		return parts[1]
+	}
+	return zone
+}
+
+// rollupAccumulator sums the points of the series of a metric per rollup group and point end
+// time (in Unix seconds), without keeping the series
+type rollupAccumulator struct {
+	source rollupSource
+	sums   map[string]map[int64]float64
+	counts map[string]map[int64]int
+	labels map[string]map[string]string
+}
+
+func newRollupAccumulator(source rollupSource) *rollupAccumulator {
+	return &rollupAccumulator{
+		source: source,
+		sums:   make(map[string]map[int64]float64),
+		counts: make(map[string]map[int64]int),
+		labels: make(map[string]map[string]string),
+	}
+}
+
+// add folds a series of the metric rolled up into its group, which is its labels without the
+// zone, plus the region at the region level
+func (a *rollupAccumulator) add(ts *monitoringpb.TimeSeries) {
+	labels := seriesLabels(ts)
+	zone := labels[a.source.zoneLabel]
+	delete(labels, a.source.zoneLabel)
+	delete(labels, "resource_type")
+	if a.source.level == rollupRegion {
+		labels["region"] = regionOf(zone)
+	}
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+"="+labels[key])
+	}
+	group := strings.Join(parts, ",")
+	if a.sums[group] == nil {
+		a.sums[group] = make(map[int64]float64)
+		a.counts[group] = make(map[int64]int)
+		a.labels[group] = labels
+	}
+	for _, point := range ts.Points {
+		t := point.Interval.EndTime.AsTime().Unix()
+		a.sums[group][t] += pointValue(point)
+		a.counts[group][t]++
+	}
+}
+
+// series returns the rollup series of the metric, one per group
+func (a *rollupAccumulator) series(metricType string) []*monitoringpb.TimeSeries {
+	groups := make([]string, 0, len(a.sums))
+	for group := range a.sums {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	var series []*monitoringpb.TimeSeries
+	for _, group := range groups {
+		values := a.sums[group]
+		if a.source.mean {
+			values = make(map[int64]float64, len(a.sums[group]))
+			for t, sum := range a.sums[group] {
+				values[t] = sum / float64(a.counts[group][t])
+			}
+		}
+		if ts := derivedSeries(metricType, a.labels[group], values); ts != nil {
+			series = append(series, ts)
+		}
+	}
+	return series
+}
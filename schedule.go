@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Policies for a cycle outlasting the polling interval of its metrics
+const (
+	overrunSkip  = "skip"  // the cycles it overran are skipped, the next one starts on schedule
+	overrunDelay = "delay" // the next cycle starts as soon as it is done, late
+)
+
+// infeasibleOverruns is the number of consecutive cycles of a polling group outlasting its
+// interval after which the interval is reported infeasible
+const infeasibleOverruns = 3
+
+// runSchedules runs cycle for each group of metrics sharing a polling interval on its own
+// ticker, starting with an immediate cycle per group, until ctx is done, and returns once the
+// cycles in progress have completed. Cycles of different
+// groups may overlap, so cycle must serialise access to shared detector state. A cycle taking
+// longer than its interval never overlaps the next one of its group, which is skipped or delayed
+// as cycle_overrun sets, and the timing of the cycles is kept for the self-metrics.
+func runSchedules(ctx context.Context, config *Config, cycle func(metrics []string)) {
+	groups := config.pollingGroups()
+	if len(groups) == 0 {
+		log.Fatalf("No metrics configured")
+	}
+	if config.timings == nil {
+		config.timings = &cycleTimings{groups: make(map[time.Duration]*cycleTiming)}
+	}
+
+	var wg sync.WaitGroup
+	for _, group := range groups {
+		wg.Add(1)
+		go func(group pollingGroup) {
+			defer wg.Done()
+			clock := config.timeSource()
+			scheduled := clock.Now()
+			ticks, stop := clock.NewTicker(group.interval)
+			defer stop()
+			log.Printf("Starting polling every %v for %d metrics...\n", group.interval, len(group.metrics))
+			overruns := 0
+			for {
+				start := clock.Now()
+				cycle(group.metrics)
+				took := clock.Now().Sub(start)
+
+				var skipped int64
+				if took > group.interval {
+					overruns++
+					missed := int64(took / group.interval)
+					if config.CycleOverrun == overrunDelay {
+						// The tick the ticker kept starts the next cycle right away
+						skipped = missed - 1
+						log.Printf("Cycle of %d metrics took %v, longer than their polling interval of %v; the next cycle starts late\n", len(group.metrics), took.Round(time.Millisecond), group.interval)
+					} else {
+						select {
+						case <-ticks:
+						default:
+						}
+						skipped = missed
+						log.Printf("Cycle of %d metrics took %v, longer than their polling interval of %v; skipping %d cycles\n", len(group.metrics), took.Round(time.Millisecond), group.interval, missed)
+					}
+					if overruns == infeasibleOverruns {
+						log.Printf("Polling interval of %v is infeasible for %d metrics: %d cycles in a row outlasted it. Raise polling_time or spread the metrics over several replicas with sharding\n", group.interval, len(group.metrics), overruns)
+					}
+				} else {
+					overruns = 0
+				}
+				config.timings.record(group.interval, start.Sub(scheduled), took, skipped)
+				select {
+				case <-ctx.Done():
+					return
+				case scheduled = <-ticks:
+				}
+			}
+		}(group)
+	}
+	wg.Wait()
+}
+
+// cycleTimings records how the cycles of every polling group keep to their schedule
+type cycleTimings struct {
+	mu     sync.Mutex
+	groups map[time.Duration]*cycleTiming
+}
+
+// cycleTiming is the timing of the cycles of a polling group
+type cycleTiming struct {
+	interval time.Duration
+	duration time.Duration // of the last completed cycle
+	skew     time.Duration // how late the last cycle started after its scheduled time
+	skipped  int64         // cycles skipped since startup because an earlier one overran
+}
+
+// record records a completed cycle of the polling group with the interval
+func (t *cycleTimings) record(interval, skew, duration time.Duration, skipped int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timing, ok := t.groups[interval]
+	if !ok {
+		timing = &cycleTiming{interval: interval}
+		t.groups[interval] = timing
+	}
+	timing.duration, timing.skew = duration, max(skew, 0)
+	timing.skipped += skipped
+}
+
+// snapshot returns the timings of the polling groups, shortest interval first, none before any
+// cycle was scheduled
+func (t *cycleTimings) snapshot() []cycleTiming {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timings := make([]cycleTiming, 0, len(t.groups))
+	for _, timing := range t.groups {
+		timings = append(timings, *timing)
+	}
+	sort.Slice(timings, func(i, j int) bool { return timings[i].interval < timings[j].interval })
+	return timings
+}
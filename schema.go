@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// Versions of the JSON payload of an anomaly, documented in schemas/. A version never changes
+// incompatibly once released: fields are only ever added to it as optional ones, and removing or
+// changing fields takes a new version, so consumers pinned to one keep working.
+const (
+	// AnomalySchemaV1 is the flat payload of the Anomaly type, the default
+	AnomalySchemaV1 = "v1"
+	// AnomalySchemaV2 nests the metric and the monitored resource and carries its version
+	AnomalySchemaV2 = "v2"
+)
+
+// anomalySchema selects the payload anomalies are encoded as for JSON sinks
+type anomalySchema string
+
+// validateAnomalySchema rejects unknown schema versions; empty selects the default
+func validateAnomalySchema(schema string) error {
+	switch schema {
+	case "", AnomalySchemaV1, AnomalySchemaV2:
+		return nil
+	}
+	return fmt.Errorf("unknown anomaly schema %s, expected %s or %s", schema, AnomalySchemaV1, AnomalySchemaV2)
+}
+
+// payload returns the value encoded as JSON for the anomaly in the schema
+func (s anomalySchema) payload(anomaly Anomaly) interface{} {
+	if s == AnomalySchemaV2 {
+		return newAnomalyV2(anomaly)
+	}
+	return anomaly
+}
+
+// payloads returns the values encoded as JSON for the anomalies in the schema, an empty list for
+// none
+func (s anomalySchema) payloads(anomalies []Anomaly) []interface{} {
+	payloads := make([]interface{}, 0, len(anomalies))
+	for _, anomaly := range anomalies {
+		payloads = append(payloads, s.payload(anomaly))
+	}
+	return payloads
+}
+
+// anomalyV2 is version 2 of the anomaly payload
+type anomalyV2 struct {
+	SchemaVersion int    `json:"schema_version"` // always 2
+	ID            string `json:"id"`
+	Kind          string `json:"kind"`
+	Type          string `json:"type,omitempty"`
+	Severity      string `json:"severity"`
+	State         string `json:"state,omitempty"`
+	Message       string `json:"message"`
+
+	Metric   anomalyMetricV2   `json:"metric"`
+	Resource anomalyResourceV2 `json:"resource"`
+	// Metadata are the static labels of the metric from the configuration
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	Value    float64        `json:"value"`
+	ZScore   float64        `json:"z_score"`
+	Expected *ExpectedRange `json:"expected,omitempty"`
+
+	// An anomaly event spans StartTime to EndTime, with Value and ZScore those of its peak
+	StartTime       time.Time  `json:"start_time"`
+	EndTime         *time.Time `json:"end_time,omitempty"`
+	PeakTime        *time.Time `json:"peak_time,omitempty"`
+	DurationSeconds float64    `json:"duration_seconds,omitempty"`
+	Points          int        `json:"points,omitempty"`
+
+	Fingerprint       string `json:"fingerprint"`
+	SeriesFingerprint string `json:"series_fingerprint,omitempty"`
+
+	Context     *AnomalyContext `json:"context,omitempty"`
+	ExplorerURL string          `json:"explorer_url,omitempty"`
+	ChartURL    string          `json:"chart_url,omitempty"`
+	Rollout     string          `json:"rollout,omitempty"`
+	Backfilled  bool            `json:"backfilled,omitempty"`
+	Changes     []ChangeEvent   `json:"changes,omitempty"`
+	Traces      []TraceExemplar `json:"traces,omitempty"`
+
+	Completeness float64 `json:"completeness,omitempty"`
+}
+
+// anomalyMetricV2 describes the metric of a version 2 payload
+type anomalyMetricV2 struct {
+	Type        string `json:"type"`
+	DisplayName string `json:"display_name"` // the type without a configured display_name
+	Unit        string `json:"unit,omitempty"`
+}
+
+// anomalyResourceV2 describes the series of a version 2 payload
+type anomalyResourceV2 struct {
+	ProjectID string            `json:"project_id,omitempty"`
+	Type      string            `json:"type,omitempty"`
+	Labels    map[string]string `json:"labels"` // resource and metric labels, without the resource type
+}
+
+// newAnomalyV2 returns the version 2 payload of the anomaly
+func newAnomalyV2(anomaly Anomaly) anomalyV2 {
+	labels := make(map[string]string, len(anomaly.Labels))
+	for key, value := range anomaly.Labels {
+		if key != "resource_type" {
+			labels[key] = value
+		}
+	}
+	payload := anomalyV2{
+		SchemaVersion: 2,
+		ID:            anomaly.ID,
+		Kind:          anomaly.Kind,
+		Type:          anomaly.Type,
+		Severity:      anomaly.Severity,
+		State:         anomaly.State,
+		Message:       anomaly.Message,
+
+		Metric:   anomalyMetricV2{Type: anomaly.MetricName, DisplayName: anomaly.displayName(), Unit: anomaly.Unit},
+		Resource: anomalyResourceV2{ProjectID: anomaly.ProjectID, Type: anomaly.Labels["resource_type"], Labels: labels},
+		Metadata: anomaly.Metadata,
+
+		Value:    anomaly.Value,
+		ZScore:   anomaly.ZScore,
+		Expected: anomaly.Expected,
+
+		StartTime:       anomaly.Timestamp,
+		DurationSeconds: anomaly.DurationSeconds,
+		Points:          anomaly.Points,
+
+		Fingerprint:       anomaly.Fingerprint,
+		SeriesFingerprint: anomaly.SeriesFingerprint,
+		Context:           anomaly.Context,
+		ExplorerURL:       anomaly.ExplorerURL,
+		ChartURL:          anomaly.ChartURL,
+		Rollout:           anomaly.Rollout,
+		Backfilled:        anomaly.Backfilled,
+		Changes:           anomaly.Changes,
+		Traces:            anomaly.Traces,
+		Completeness:      anomaly.Completeness,
+	}
+	if !anomaly.EndTime.IsZero() {
+		payload.EndTime, payload.PeakTime = &anomaly.EndTime, &anomaly.PeakTime
+	}
+	return payload
+}
+
+// anomalySchema returns the schema the notifier encodes anomalies in, its own or the detector's
+func (c *Config) anomalySchema(notifier NotifierConfig) anomalySchema {
+	if notifier.Schema != "" {
+		return anomalySchema(notifier.Schema)
+	}
+	return anomalySchema(c.AnomalySchema)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SeasonalityConfig keeps separate baselines for weekdays and weekends, for metrics such as
+// business traffic that drop at weekends and would otherwise be anomalous every Saturday
+type SeasonalityConfig struct {
+	Weekend  []string `yaml:"weekend"`   // days scored against the weekend baseline, defaults to [sat, sun]
+	TimeZone string   `yaml:"time_zone"` // IANA time zone the days are judged in, defaults to UTC
+}
+
+// season is a SeasonalityConfig with its days and time zone parsed
+type season struct {
+	weekend  map[time.Weekday]bool
+	location *time.Location
+}
+
+// compileSeasons parses the seasonality of the metrics that have it, by metric type
+func compileSeasons(metrics []MetricConfig) (map[string]*season, error) {
+	compiled := make(map[string]*season)
+	for _, metric := range metrics {
+		if metric.Seasonality == nil {
+			continue
+		}
+		s := &season{weekend: make(map[time.Weekday]bool), location: time.UTC}
+		days := metric.Seasonality.Weekend
+		if len(days) == 0 {
+			days = []string{"sat", "sun"}
+		}
+		for _, day := range days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("metric %s: seasonality: unknown day %q", metric.Type, day)
+			}
+			s.weekend[weekday] = true
+		}
+		if len(s.weekend) == len(weekdays) {
+			return nil, fmt.Errorf("metric %s: seasonality: every day is a weekend day", metric.Type)
+		}
+		if metric.Seasonality.TimeZone != "" {
+			location, err := time.LoadLocation(metric.Seasonality.TimeZone)
+			if err != nil {
+				return nil, fmt.Errorf("metric %s: seasonality: invalid time_zone: %v", metric.Type, err)
+			}
+			s.location = location
+		}
+		compiled[metric.Type] = s
+	}
+	return compiled, nil
+}
+
+// isWeekend reports whether t falls on a weekend day
+func (s *season) isWeekend(t time.Time) bool {
+	return s.weekend[t.In(s.location).Weekday()]
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+)
+
+// scanServer runs the regular polling loop and exposes an HTTP API to trigger detection on demand
+type scanServer struct {
+	client   *monitoring.MetricClient
+	config   *Config
+	detector *SimpleAnomalyDetector
+	router   *Router
+	gauges   *scoreGauges
+
+	// mu serialises detection cycles and admin calls, which share the detector state
+	mu sync.Mutex
+}
+
+// scanRequest is the optional JSON body of POST /scan
+type scanRequest struct {
+	Metrics []string `json:"metrics"`
+}
+
+// scanResponse is returned by POST /scan
+type scanResponse struct {
+	Metrics   []string      `json:"metrics"`
+	Anomalies []interface{} `json:"anomalies"` // in the configured anomaly_schema
+	// InsufficientData lists the metrics with series that were not scored for lack of baseline data
+	InsufficientData []string `json:"insufficient_data,omitempty"`
+	// FetchFailures lists the metrics skipped because their recent window could not be fetched,
+	// with their errors
+	FetchFailures map[string]string `json:"fetch_failures,omitempty"`
+	// TopSeries lists the top_n most anomalous series of the cycle, whether or not they crossed the threshold
+	TopSeries []SeriesScore `json:"top_series,omitempty"`
+}
+
+// runServer starts the detector together with an HTTP server exposing POST /scan
+func runServer(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	credentials := addCredentialFlags(fs)
+	sharding := addShardFlags(fs)
+	listenAddress := fs.String("listen", ":8080", "Address for the HTTP server to listen on")
+	grpcAddress := fs.String("grpc-listen", "", "Address for the gRPC admin service to listen on, e.g. :9090 (disabled if empty)")
+	fs.Parse(args)
+
+	config := mustLoadConfig(*configPath)
+	config.Credentials.override(*credentials)
+	mustDiscoverWorkloads(config)
+	router := mustCreateRouter(config)
+	mustSelectShard(config, *sharding)
+	client, detector := mustStartDetector(config)
+	detector.events = router.Events()
+
+	server := &scanServer{
+		client:   client,
+		config:   config,
+		detector: detector,
+		router:   router,
+		gauges:   newScoreGauges(config),
+	}
+	superviseService(config.timeSource(), config.maxCycleAge(), fmt.Sprintf("Detecting %d metrics in project %s, listening on %s", len(config.Metrics), config.ProjectID, *listenAddress), router)
+	go server.poll()
+	if *grpcAddress != "" {
+		go serveAdmin(*grpcAddress, server)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/scan", server.handleScan)
+	mux.HandleFunc("/webhook", server.handleWebhook)
+	mux.Handle("/metrics", server.gauges)
+	registerSilenceHandlers(mux, router)
+	registerFeedbackHandlers(mux, router)
+	registerEventHandlers(mux, router)
+	registerTrendHandlers(mux, detector.trends)
+
+	log.Printf("Listening on %s...\n", *listenAddress)
+	if err := config.Server.listenAndServe(*listenAddress, mux); err != nil {
+		log.Fatalf("HTTP server failed: %v", err)
+	}
+}
+
+// poll runs a detection cycle for the configured metrics on their polling intervals
+func (s *scanServer) poll() {
+	runSchedules(context.Background(), s.config, func(metrics []string) {
+		s.scan(metrics)
+	})
+}
+
+// scan runs a single detection cycle for the given metrics and reports the anomalies found
+func (s *scanServer) scan(metrics []string) (scanResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	anomalies, err := runCycle(s.client, s.config, s.detector, metrics)
+	if err != nil {
+		log.Printf("Detection cycle failed: %v", err)
+		s.router.ReportError(context.Background(), err)
+		return scanResponse{}, err
+	}
+
+	s.gauges.update(s.detector.LatestPoints(), s.config.now())
+	s.router.ReportCycle(context.Background(), anomalies, s.detector.FetchFailures())
+	return newScanResponse(metrics, anomalies, s.config, s.detector), nil
+}
+
+// newScanResponse describes the result of a detection cycle over metrics
+func newScanResponse(metrics []string, anomalies []Anomaly, config *Config, detector *SimpleAnomalyDetector) scanResponse {
+	return scanResponse{
+		Metrics:          metrics,
+		Anomalies:        anomalySchema(config.AnomalySchema).payloads(anomalies),
+		InsufficientData: detector.InsufficientData(),
+		FetchFailures:    detector.FetchFailures(),
+		TopSeries:        detector.TopSeries(config.TopN),
+	}
+}
+
+// handleScan triggers an immediate detection cycle. The metrics to scan can be limited with a
+// JSON body ({"metrics": [...]}) or repeated metric query parameters; all configured metrics
+// are scanned otherwise.
+func (s *scanServer) handleScan(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req scanRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	req.Metrics = append(req.Metrics, r.URL.Query()["metric"]...)
+
+	metrics, err := scopeMetrics(s.config, req.Metrics)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("On-demand scan requested for %d metrics\n", len(metrics))
+	response, err := s.scan(metrics)
+	if err != nil {
+		http.Error(w, redact(err.Error()), http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// scopeMetrics validates the requested metrics against the configuration. An empty request
+// selects every configured metric.
+func scopeMetrics(config *Config, requested []string) ([]string, error) {
+	if len(requested) == 0 {
+		return config.MetricTypes(), nil
+	}
+
+	configured := make(map[string]bool)
+	for _, metric := range config.MetricTypes() {
+		configured[metric] = true
+	}
+
+	var metrics []string
+	seen := make(map[string]bool)
+	for _, metric := range requested {
+		if !configured[metric] {
+			return nil, fmt.Errorf("metric %s is not configured", metric)
+		}
+		if !seen[metric] {
+			seen[metric] = true
+			metrics = append(metrics, metric)
+		}
+	}
+	return metrics, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/api/idtoken"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// iapAssertionHeader carries the JWT Identity-Aware Proxy signs every request it forwards with
+	iapAssertionHeader = "X-Goog-Iap-Jwt-Assertion"
+	// iapIssuer is the issuer of the assertions of Identity-Aware Proxy
+	iapIssuer = "https://cloud.google.com/iap"
+)
+
+// errUnauthenticated rejects requests without a valid token or IAP assertion
+var errUnauthenticated = errors.New("missing or invalid credentials")
+
+// ServerConfig secures the HTTP server of the serve and central commands and the gRPC admin
+// service, so they can be exposed beyond trusted networks
+type ServerConfig struct {
+	TLS  *ServerTLSConfig  `yaml:"tls"`  // serves over TLS, verifying client certificates with a client_ca_file
+	Auth *ServerAuthConfig `yaml:"auth"` // requires a bearer token or an IAP assertion on every request
+}
+
+// ServerTLSConfig serves over TLS, and with a client CA only accepts clients presenting a
+// certificate it signed (mTLS)
+type ServerTLSConfig struct {
+	CertFile     string `yaml:"cert_file"`      // PEM certificate chain of the server
+	KeyFile      string `yaml:"key_file"`       // PEM private key of the server
+	ClientCAFile string `yaml:"client_ca_file"` // optional PEM CAs the certificates of clients must be signed by
+}
+
+// ServerAuthConfig requires every request to carry one of the tokens, or an assertion of
+// Identity-Aware Proxy for the audience
+type ServerAuthConfig struct {
+	Tokens      []string `yaml:"tokens" secret:"true"` // bearer tokens accepted in the Authorization header
+	IAPAudience string   `yaml:"iap_audience"`         // audience of the IAP assertions, e.g. /projects/123/global/backendServices/456
+	PublicPaths []string `yaml:"public_paths"`         // HTTP paths served without authentication, e.g. /metrics for Prometheus
+}
+
+func (c ServerConfig) validate() error {
+	if c.TLS != nil {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			return fmt.Errorf("tls: cert_file and key_file must both be set")
+		}
+	}
+	if c.Auth != nil {
+		if len(c.Auth.Tokens) == 0 && c.Auth.IAPAudience == "" {
+			return fmt.Errorf("auth: no tokens or iap_audience configured")
+		}
+		for _, token := range c.Auth.Tokens {
+			if token == "" {
+				return fmt.Errorf("auth: tokens must not be empty")
+			}
+		}
+		for _, path := range c.Auth.PublicPaths {
+			if !strings.HasPrefix(path, "/") {
+				return fmt.Errorf("auth: public path %q must start with /", path)
+			}
+		}
+	}
+	return nil
+}
+
+// tlsConfig loads the certificate of the server and the CAs of its clients, nil without tls
+func (c *ServerConfig) tlsConfig() (*tls.Config, error) {
+	if c == nil || c.TLS == nil {
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(c.TLS.CertFile, c.TLS.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the server certificate: %v", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}
+	if c.TLS.ClientCAFile != "" {
+		data, err := os.ReadFile(c.TLS.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", c.TLS.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// authorize checks the credentials of a request, whose headers header looks up
+func (c ServerAuthConfig) authorize(ctx context.Context, header func(string) string) error {
+	if token, ok := strings.CutPrefix(header("Authorization"), "Bearer "); ok {
+		for _, allowed := range c.Tokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(allowed)) == 1 {
+				return nil
+			}
+		}
+	}
+	if assertion := header(iapAssertionHeader); c.IAPAudience != "" && assertion != "" {
+		payload, err := idtoken.Validate(ctx, assertion, c.IAPAudience)
+		if err != nil {
+			return fmt.Errorf("invalid IAP assertion: %v", err)
+		}
+		if payload.Issuer != iapIssuer {
+			return fmt.Errorf("invalid IAP assertion: issued by %s", payload.Issuer)
+		}
+		return nil
+	}
+	return errUnauthenticated
+}
+
+// authenticate wraps handler to reject the requests without valid credentials, except those to
+// the public paths and to the paths under the exempt prefixes, which authenticate themselves
+func (c *ServerConfig) authenticate(handler http.Handler, exempt ...string) http.Handler {
+	if c == nil || c.Auth == nil {
+		return handler
+	}
+	auth := *c.Auth
+	public := make(map[string]bool)
+	for _, path := range auth.PublicPaths {
+		public[path] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if public[r.URL.Path] {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		for _, prefix := range exempt {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				handler.ServeHTTP(w, r)
+				return
+			}
+		}
+		if err := auth.authorize(r.Context(), r.Header.Get); err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// listenAndServe serves handler on address, over TLS and behind authentication when the server
+// configuration asks for them
+func (c *ServerConfig) listenAndServe(address string, handler http.Handler, exempt ...string) error {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return err
+	}
+	server := &http.Server{Addr: address, Handler: c.authenticate(handler, exempt...), TLSConfig: tlsConfig}
+	if tlsConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// grpcOptions secures the gRPC admin service like the HTTP server: over TLS, and with the
+// credentials of every call checked from its metadata
+func (c *ServerConfig) grpcOptions() ([]grpc.ServerOption, error) {
+	var options []grpc.ServerOption
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		options = append(options, grpc.Creds(credentials.NewTLS(tlsConfig)))
+	}
+	if c != nil && c.Auth != nil {
+		auth := *c.Auth
+		options = append(options, grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			md, _ := metadata.FromIncomingContext(ctx)
+			header := func(name string) string {
+				if values := md.Get(name); len(values) > 0 {
+					return values[0]
+				}
+				return ""
+			}
+			if err := auth.authorize(ctx, header); err != nil {
+				return nil, status.Error(codes.Unauthenticated, err.Error())
+			}
+			return handler(ctx, req)
+		}))
+	}
+	return options, nil
+}
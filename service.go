@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ServiceConfig ties a long-running detector to the init system running it as a service
+type ServiceConfig struct {
+	MaxCycleAgeMin int `yaml:"max_cycle_age_min"` // minutes without a successful detection cycle after which the detector counts as wedged, defaults to three times the longest polling interval
+}
+
+// maxCycleAge returns how long the detector may go without a successful cycle before it counts
+// as wedged
+func (c *Config) maxCycleAge() time.Duration {
+	if c.Service.MaxCycleAgeMin > 0 {
+		return time.Duration(c.Service.MaxCycleAgeMin) * time.Minute
+	}
+	var longest time.Duration
+	for _, group := range c.pollingGroups() {
+		longest = max(longest, group.interval)
+	}
+	return 3 * longest
+}
+
+// serviceSupervisor reports the state of a long-running detector to the init system running it.
+// Under systemd it sends READY once the baseline is initialised, the outcome of the last cycle as
+// STATUS and, with WatchdogSec set on the unit, WATCHDOG keep-alives while detection cycles
+// succeed. Under the Windows service control manager the service reports running once ready. A
+// detector without a successful cycle for max_cycle_age_min counts as wedged: systemd no longer
+// receives keep-alives and restarts it when WatchdogSec runs out, and a Windows service exits for
+// its recovery actions to restart it.
+type serviceSupervisor struct {
+	socket         string        // NOTIFY_SOCKET of systemd, empty when not started by it
+	watchdog       time.Duration // WatchdogSec of the unit, zero without a watchdog
+	maxCycleAge    time.Duration
+	exitWhenWedged bool
+	clock          Clock // the clock of the detector, which the cycles are timed on
+
+	mu        sync.Mutex
+	lastCycle time.Time // of the last successful cycle, or when the detector became ready
+	wedged    bool
+}
+
+// newServiceSupervisor returns a supervisor for the init system the process was started by, if
+// any, with the watchdog of its environment, timing the cycles on clock
+func newServiceSupervisor(clock Clock, maxCycleAge time.Duration) *serviceSupervisor {
+	s := &serviceSupervisor{
+		socket:         os.Getenv("NOTIFY_SOCKET"),
+		maxCycleAge:    maxCycleAge,
+		exitWhenWedged: runningAsService(),
+		clock:          clock,
+	}
+	// WATCHDOG_PID names the process the watchdog is meant for, when set
+	pid := os.Getenv("WATCHDOG_PID")
+	if usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64); err == nil && usec > 0 && (pid == "" || pid == strconv.Itoa(os.Getpid())) {
+		s.watchdog = time.Duration(usec) * time.Microsecond
+	}
+	return s
+}
+
+// superviseService reports the detector ready to the init system running it, with the status,
+// and ties the cycles reported through the routers, on clock, to its watchdog
+func superviseService(clock Clock, maxCycleAge time.Duration, status string, routers ...*Router) {
+	s := newServiceSupervisor(clock, maxCycleAge)
+	for _, router := range routers {
+		router.service = s
+	}
+	s.ready(status)
+}
+
+// ready tells the init system that the detector is up and starts watching its cycles
+func (s *serviceSupervisor) ready(status string) {
+	s.mu.Lock()
+	s.lastCycle = s.clock.Now()
+	s.mu.Unlock()
+
+	s.notify("READY=1\nSTATUS=" + status)
+	reportServiceRunning()
+	if s.watchdog > 0 {
+		if s.watchdog < s.maxCycleAge {
+			log.Printf("The systemd watchdog of %s is shorter than the %s allowed between successful cycles, only the latter applies\n", s.watchdog, s.maxCycleAge)
+		}
+		go s.watch(s.watchdog / 2)
+	} else if s.exitWhenWedged {
+		go s.watch(min(s.maxCycleAge/4, time.Minute))
+	}
+}
+
+// cycleSucceeded records a successful detection cycle
+func (s *serviceSupervisor) cycleSucceeded(now time.Time, anomalies int) {
+	s.mu.Lock()
+	s.lastCycle, s.wedged = now, false
+	s.mu.Unlock()
+	s.notify(fmt.Sprintf("STATUS=Last cycle at %s: %d anomalies", now.UTC().Format(time.RFC3339), anomalies))
+}
+
+// cycleFailed records a failed detection cycle in the status, leaving the watchdog to tell a
+// detector failing for too long
+func (s *serviceSupervisor) cycleFailed(now time.Time, err error) {
+	status := strings.ReplaceAll(err.Error(), "\n", " ")
+	s.notify(fmt.Sprintf("STATUS=Last cycle failed at %s: %s", now.UTC().Format(time.RFC3339), status))
+}
+
+// watch sends a watchdog keep-alive every interval while the last successful cycle is recent
+// enough, and gives up on a wedged detector
+func (s *serviceSupervisor) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		since := s.lastCycle
+		wedged := s.clock.Now().Sub(since) > s.maxCycleAge
+		first := wedged && !s.wedged
+		s.wedged = wedged
+		s.mu.Unlock()
+
+		if !wedged {
+			if s.watchdog > 0 {
+				s.notify("WATCHDOG=1")
+			}
+			continue
+		}
+		if s.exitWhenWedged {
+			log.Printf("No successful detection cycle since %s, exiting for the service to be restarted", displayTime(since))
+			os.Exit(1)
+		}
+		if first {
+			log.Printf("No successful detection cycle since %s, withholding the watchdog keep-alive\n", displayTime(since))
+			s.notify(fmt.Sprintf("STATUS=Wedged: no successful cycle since %s", displayTime(since)))
+		}
+	}
+}
+
+// notify sends a state to systemd with the sd_notify protocol, a datagram to NOTIFY_SOCKET.
+// Failures are logged, as the detector keeps working without its init system hearing of it.
+func (s *serviceSupervisor) notify(state string) {
+	if s.socket == "" {
+		return
+	}
+	name := s.socket
+	if strings.HasPrefix(name, "@") {
+		name = "\x00" + name[1:] // abstract socket
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		log.Printf("Could not notify systemd: %v", err)
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		log.Printf("Could not notify systemd: %v", err)
+	}
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"syscall"
+)
+
+// runningAsService reports whether the process runs as a Windows service, never elsewhere
+func runningAsService() bool {
+	return false
+}
+
+// runAsService runs the command; only Windows services need wrapping
+func runAsService(run func(), waitReady bool) {
+	run()
+}
+
+// reportServiceRunning tells the Windows service control manager that the service is running
+func reportServiceRunning() {}
+
+// restartProcess replaces the process with a new run of the same command, which picks up the
+// configuration applied by config_sync
+func restartProcess() {
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Failed to restart: %v", err)
+	}
+	if err := syscall.Exec(executable, os.Args, os.Environ()); err != nil {
+		log.Fatalf("Failed to restart: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+//go:build windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+// serviceReady is closed once the detector is ready, for the service to report running
+var (
+	serviceReady     = make(chan struct{})
+	serviceReadyOnce sync.Once
+)
+
+// runningAsService reports whether the process was started by the service control manager
+func runningAsService() bool {
+	service, err := svc.IsWindowsService()
+	return err == nil && service
+}
+
+// runAsService runs the command as a Windows service named after the executable, logging to
+// the Windows Event Log. With waitReady the service stays start pending until the detector is
+// ready, as the baseline can take minutes to fetch; it reports running right away otherwise.
+func runAsService(run func(), waitReady bool) {
+	name := strings.TrimSuffix(filepath.Base(os.Args[0]), filepath.Ext(os.Args[0]))
+	if events, err := eventlog.Open(name); err == nil {
+		log.SetOutput(redactingWriter{eventLogWriter{events}})
+	}
+	if !waitReady {
+		reportServiceRunning()
+	}
+	if err := svc.Run(name, windowsService{run: run}); err != nil {
+		log.Fatalf("Service %s failed: %v", name, err)
+	}
+}
+
+// reportServiceRunning tells the service control manager that the service is running
+func reportServiceRunning() {
+	serviceReadyOnce.Do(func() { close(serviceReady) })
+}
+
+// windowsService runs a command under the service control manager
+type windowsService struct {
+	run func()
+}
+
+// Execute reports the service start pending until it is ready, then running until it is stopped
+// or the command returns
+func (s windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	const accepted = svc.AcceptStop | svc.AcceptShutdown
+	pending := svc.Status{State: svc.StartPending, WaitHint: uint32(time.Minute / time.Millisecond)}
+	changes <- pending
+
+	done := make(chan struct{})
+	go func() {
+		s.run()
+		close(done)
+	}()
+
+	// The checkpoint tells the service control manager that a long start is progressing
+	progress := time.NewTicker(20 * time.Second)
+	defer progress.Stop()
+	ready := serviceReady
+	for {
+		select {
+		case <-ready:
+			ready = nil
+			progress.Stop()
+			changes <- svc.Status{State: svc.Running, Accepts: accepted}
+		case <-progress.C:
+			pending.CheckPoint++
+			changes <- pending
+		case <-done:
+			return false, 0
+		case request := <-requests:
+			switch request.Cmd {
+			case svc.Interrogate:
+				changes <- request.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending}
+				return false, 0
+			}
+		}
+	}
+}
+
+// eventLogWriter writes log lines to the Windows Event Log as information events
+type eventLogWriter struct {
+	log *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	if err := w.log.Info(1, strings.TrimSuffix(string(p), "\n")); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// restartProcess exits for the recovery actions of the service control manager to start the
+// service again on the configuration applied by config_sync, as a running process cannot be
+// replaced in place on Windows
+func restartProcess() {
+	log.Println("Exiting for the service to be restarted")
+	os.Exit(1)
+}
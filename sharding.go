@@ -0,0 +1,98 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ShardingConfig spreads the configured metrics over several replicas, each detecting only the
+// metrics assigned to its shard. Assignment hashes the metric type, so every replica computes
+// the same split without coordination.
+type ShardingConfig struct {
+	Count int `yaml:"count"` // number of shards, 0 or 1 disables sharding
+	Index int `yaml:"index"` // shard of this replica, from 0 to count-1
+	// IndexFromHostname takes the index from the ordinal suffix of the host name, such as 2 for
+	// detector-2, as given to the pods of a Kubernetes StatefulSet
+	IndexFromHostname bool `yaml:"index_from_hostname"`
+}
+
+// addShardFlags registers flags overriding the sharding settings of the configuration
+func addShardFlags(fs *flag.FlagSet) *ShardingConfig {
+	flags := ShardingConfig{Index: -1}
+	fs.IntVar(&flags.Count, "shard-count", 0, "Number of replicas the metrics are spread over (overrides sharding.count)")
+	fs.IntVar(&flags.Index, "shard-index", -1, "Shard of this replica, from 0 to shard-count-1 (overrides sharding.index)")
+	return &flags
+}
+
+// override applies the settings given by flags
+func (c *ShardingConfig) override(flags ShardingConfig) {
+	if flags.Count != 0 {
+		c.Count = flags.Count
+	}
+	if flags.Index >= 0 {
+		c.Index = flags.Index
+		c.IndexFromHostname = false
+	}
+}
+
+// index returns the shard of this replica
+func (c ShardingConfig) index() (int, error) {
+	index := c.Index
+	if c.IndexFromHostname {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return 0, fmt.Errorf("could not determine host name: %v", err)
+		}
+		ordinal := hostname[strings.LastIndex(hostname, "-")+1:]
+		index, err = strconv.Atoi(ordinal)
+		if err != nil {
+			return 0, fmt.Errorf("host name %s has no ordinal suffix", hostname)
+		}
+	}
+	if index < 0 || index >= c.Count {
+		return 0, fmt.Errorf("shard index %d is out of range for %d shards", index, c.Count)
+	}
+	return index, nil
+}
+
+// shardOf returns the shard a metric type is assigned to
+func shardOf(metricType string, count int) int {
+	h := fnv.New32a()
+	h.Write([]byte(metricType))
+	return int(h.Sum32() % uint32(count))
+}
+
+// selectShard limits the configured metrics to those assigned to this replica's shard
+func (c *Config) selectShard() error {
+	if c.Sharding.Count <= 1 {
+		return nil
+	}
+	index, err := c.Sharding.index()
+	if err != nil {
+		return err
+	}
+
+	var assigned []MetricConfig
+	for _, metric := range c.Metrics {
+		if shardOf(metric.Type, c.Sharding.Count) == index {
+			assigned = append(assigned, metric)
+		}
+	}
+	log.Printf("Shard %d of %d: detecting %d of %d metrics\n", index, c.Sharding.Count, len(assigned), len(c.Metrics))
+	c.Metrics = assigned
+	return nil
+}
+
+// mustSelectShard applies the sharding flags and limits the metrics to this replica's shard,
+// exiting on failure. Notifiers are created beforehand, as some validate the whole metric list.
+func mustSelectShard(config *Config, flags ShardingConfig) {
+	config.Sharding.override(flags)
+	if err := config.selectShard(); err != nil {
+		log.Fatalf("Failed to select shard: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestShardsCoverEveryMetricOnce(t *testing.T) {
+	var metrics []MetricConfig
+	for i := 0; i < 200; i++ {
+		metrics = append(metrics, MetricConfig{Type: fmt.Sprintf("custom.googleapis.com/otel/metric_%d", i)})
+	}
+	for _, count := range []int{2, 3, 5, 16} {
+		seen := make(map[string]int)
+		for index := 0; index < count; index++ {
+			config := &Config{Metrics: append([]MetricConfig(nil), metrics...), Sharding: ShardingConfig{Count: count, Index: index}}
+			if err := config.selectShard(); err != nil {
+				t.Fatalf("%d shards, index %d: %v", count, index, err)
+			}
+			// 200 metrics leave no shard of up to 16 empty
+			if len(config.Metrics) == 0 {
+				t.Errorf("%d shards: shard %d has no metrics", count, index)
+			}
+			for _, metric := range config.Metrics {
+				seen[metric.Type]++
+			}
+		}
+		for _, metric := range metrics {
+			if seen[metric.Type] != 1 {
+				t.Errorf("%d shards: %s detected by %d shards, want 1", count, metric.Type, seen[metric.Type])
+			}
+		}
+	}
+}
+
+func TestSelectShard(t *testing.T) {
+	metrics := []MetricConfig{{Type: "custom.googleapis.com/a"}, {Type: "custom.googleapis.com/b"}}
+	tests := []struct {
+		name     string
+		sharding ShardingConfig
+		flags    ShardingConfig
+		metrics  int // metrics kept, 0 not to count them, -1 for an error
+	}{
+		{name: "disabled", sharding: ShardingConfig{}, flags: ShardingConfig{Index: -1}, metrics: 2},
+		{name: "one shard", sharding: ShardingConfig{Count: 1}, flags: ShardingConfig{Index: -1}, metrics: 2},
+		{name: "index out of range", sharding: ShardingConfig{Count: 2, Index: 2}, flags: ShardingConfig{Index: -1}, metrics: -1},
+		{name: "flag out of range", sharding: ShardingConfig{Count: 2}, flags: ShardingConfig{Count: 3, Index: 3}, metrics: -1},
+		{name: "flags take over the hostname", sharding: ShardingConfig{Count: 2, IndexFromHostname: true}, flags: ShardingConfig{Index: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Metrics: append([]MetricConfig(nil), metrics...), Sharding: tt.sharding}
+			config.Sharding.override(tt.flags)
+			err := config.selectShard()
+			switch {
+			case tt.metrics < 0 && err == nil:
+				t.Errorf("selected shard %+v, want an error", config.Sharding)
+			case tt.metrics >= 0 && err != nil:
+				t.Errorf("selectShard: %v", err)
+			case tt.metrics > 0 && len(config.Metrics) != tt.metrics:
+				t.Errorf("got %d metrics, want %d", len(config.Metrics), tt.metrics)
+			}
+		})
+	}
+}
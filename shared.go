@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// sharedBaselinePrefix prefixes the names of the shared baselines among the series fingerprints
+// of the baseline, which they are persisted and exported with
+const sharedBaselinePrefix = "shared:"
+
+// SharedBaselineConfig trains one baseline on the series of several metrics or series, such as
+// the regional replicas of a service, which are all scored against it
+type SharedBaselineConfig struct {
+	Name    string            `yaml:"name"`    // identifies the baseline in logs, persisted baselines and exports
+	Metrics []string          `yaml:"metrics"` // metric types whose series share the baseline
+	Match   map[string]string `yaml:"match"`   // optional labels the series must have, e.g. {service_name: checkout}
+}
+
+// validateSharedBaselines checks that the shared baselines are named uniquely and pool metrics
+// of the configuration that fetch their own baseline
+func (c *Config) validateSharedBaselines() error {
+	names := make(map[string]bool)
+	for i, shared := range c.SharedBaselines {
+		if shared.Name == "" {
+			return fmt.Errorf("shared_baselines[%d]: no name configured", i)
+		}
+		if names[shared.Name] {
+			return fmt.Errorf("shared_baselines: duplicate name %q", shared.Name)
+		}
+		names[shared.Name] = true
+		if len(shared.Metrics) == 0 {
+			return fmt.Errorf("shared_baselines %s: no metrics configured", shared.Name)
+		}
+		for _, metric := range shared.Metrics {
+			metricConfig, ok := c.MetricConfig(metric)
+			if !ok {
+				return fmt.Errorf("shared_baselines %s: metric %s is not configured", shared.Name, metric)
+			}
+			if metricConfig.Baseline != nil || metricConfig.Reference != nil {
+				return fmt.Errorf("shared_baselines %s: metric %s has a fixed or reference baseline", shared.Name, metric)
+			}
+		}
+	}
+	return nil
+}
+
+// sharedBaselines tells which shared baseline, if any, a series is trained into and scored
+// against. A series matching several is in the first.
+type sharedBaselines []SharedBaselineConfig
+
+// keyOf returns the key of the shared baseline of the series among the series baselines, and
+// false if it has none
+func (s sharedBaselines) keyOf(ts *monitoringpb.TimeSeries) (string, bool) {
+	if len(s) == 0 {
+		return "", false
+	}
+	var labels map[string]string
+	for _, shared := range s {
+		if !shared.pools(ts.GetMetric().GetType()) {
+			continue
+		}
+		if labels == nil {
+			labels = seriesLabels(ts)
+		}
+		if matchesLabels(labels, shared.Match) {
+			return sharedBaselinePrefix + shared.Name, true
+		}
+	}
+	return "", false
+}
+
+// pools reports whether the series of the metric type may share the baseline
+func (s SharedBaselineConfig) pools(metricType string) bool {
+	for _, metric := range s.Metrics {
+		if metric == metricType {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesLabels reports whether labels has every label of match
+func matchesLabels(labels, match map[string]string) bool {
+	for key, value := range match {
+		if labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// baselineKey returns the key of the baseline the series is scored against: its shared
+// baseline if it has one, otherwise its own fingerprint
+func (d *SimpleAnomalyDetector) baselineKey(ts *monitoringpb.TimeSeries, fingerprint string) string {
+	if key, ok := d.shared.keyOf(ts); ok {
+		return key
+	}
+	return fingerprint
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// SilenceKindSilence mutes a metric or a single series
+	SilenceKindSilence = "silence"
+	// SilenceKindAck acknowledges the anomalies of a single series
+	SilenceKindAck = "ack"
+)
+
+// Silence suppresses notifications for a metric or a fingerprint until it ends. Suppressed
+// anomalies are still detected, printed and recorded.
+type Silence struct {
+	ID          string    `json:"id"`
+	Kind        string    `json:"kind"`
+	Metric      string    `json:"metric,omitempty"`
+	Fingerprint string    `json:"fingerprint,omitempty"`
+	Comment     string    `json:"comment,omitempty"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	StartsAt    time.Time `json:"starts_at"`
+	EndsAt      time.Time `json:"ends_at"`
+}
+
+// Matches reports whether the silence applies to the anomaly at the given time
+func (s Silence) Matches(anomaly Anomaly, now time.Time) bool {
+	if now.Before(s.StartsAt) || !now.Before(s.EndsAt) {
+		return false
+	}
+	// A silence of a series fingerprint covers the alerts of all detectors on the series
+	if s.Fingerprint != "" && s.Fingerprint != anomaly.Fingerprint && s.Fingerprint != anomaly.SeriesFingerprint {
+		return false
+	}
+	if s.Metric != "" && s.Metric != anomaly.MetricName {
+		return false
+	}
+	return true
+}
+
+// SilenceStore keeps the silences, optionally persisting them so they survive restarts
+type SilenceStore struct {
+	path  string
+	clock Clock // tells when silences start and end, the clock of the detector
+
+	mu       sync.Mutex
+	silences []Silence
+}
+
+// NewSilenceStore loads the silences persisted at path, running on clock. An empty path keeps
+// them in memory only.
+func NewSilenceStore(ctx context.Context, path string, clock Clock) (*SilenceStore, error) {
+	store := &SilenceStore{path: path, clock: clock}
+	if path == "" {
+		return store, nil
+	}
+
+	data, err := readObject(ctx, path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.silences); err != nil {
+		return nil, fmt.Errorf("could not parse silences %s: %v", path, err)
+	}
+	return store, nil
+}
+
+// Add validates and stores a new silence, returning it with its ID assigned
+func (s *SilenceStore) Add(ctx context.Context, silence Silence) (Silence, error) {
+	if silence.Kind == "" {
+		silence.Kind = SilenceKindSilence
+	}
+	switch silence.Kind {
+	case SilenceKindSilence:
+		if silence.Metric == "" && silence.Fingerprint == "" {
+			return Silence{}, errors.New("a silence needs a metric or a fingerprint")
+		}
+	case SilenceKindAck:
+		if silence.Fingerprint == "" {
+			return Silence{}, errors.New("an acknowledgement needs a fingerprint")
+		}
+	default:
+		return Silence{}, fmt.Errorf("unknown silence kind %s", silence.Kind)
+	}
+	if silence.StartsAt.IsZero() {
+		silence.StartsAt = s.clock.Now().UTC()
+	}
+	if !silence.EndsAt.After(silence.StartsAt) {
+		return Silence{}, errors.New("a silence must end after it starts")
+	}
+	silence.ID = newSilenceID()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.silences = append(s.silences, silence)
+	if err := s.persist(ctx); err != nil {
+		s.silences = s.silences[:len(s.silences)-1]
+		return Silence{}, err
+	}
+	log.Printf("Added %s %s for metric %q fingerprint %q until %s\n", silence.Kind, silence.ID, silence.Metric, silence.Fingerprint, silence.EndsAt.Format(time.RFC3339))
+	return silence, nil
+}
+
+// Expire ends a silence immediately
+func (s *SilenceStore) Expire(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, silence := range s.silences {
+		if silence.ID == id {
+			s.silences = append(s.silences[:i], s.silences[i+1:]...)
+			log.Printf("Expired %s %s\n", silence.Kind, silence.ID)
+			return s.persist(ctx)
+		}
+	}
+	return fmt.Errorf("silence %s not found: %w", id, os.ErrNotExist)
+}
+
+// Active returns the silences that have not ended yet, soonest ending first
+func (s *SilenceStore) Active(now time.Time) []Silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	active := []Silence{}
+	for _, silence := range s.silences {
+		if now.Before(silence.EndsAt) {
+			active = append(active, silence)
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].EndsAt.Before(active[j].EndsAt) })
+	return active
+}
+
+// Match returns the first silence suppressing the anomaly
+func (s *SilenceStore) Match(anomaly Anomaly, now time.Time) (Silence, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, silence := range s.silences {
+		if silence.Matches(anomaly, now) {
+			return silence, true
+		}
+	}
+	return Silence{}, false
+}
+
+// save persists the silences
+func (s *SilenceStore) save(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.persist(ctx)
+}
+
+// persist writes the unexpired silences to the configured path. The caller holds mu.
+func (s *SilenceStore) persist(ctx context.Context) error {
+	if s.path == "" {
+		return nil
+	}
+
+	now := s.clock.Now()
+	var unexpired []Silence
+	for _, silence := range s.silences {
+		if now.Before(silence.EndsAt) {
+			unexpired = append(unexpired, silence)
+		}
+	}
+	s.silences = unexpired
+
+	data, err := json.MarshalIndent(unexpired, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeObject(ctx, s.path, data); err != nil {
+		return fmt.Errorf("could not persist silences: %v", err)
+	}
+	return nil
+}
+
+func newSilenceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
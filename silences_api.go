@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// silenceRequest is the JSON body accepted by POST /silences and POST /ack
+type silenceRequest struct {
+	Metric      string `json:"metric"`
+	Fingerprint string `json:"fingerprint"`
+	Duration    string `json:"duration"` // Go duration such as 30m or 24h
+	Comment     string `json:"comment"`
+	CreatedBy   string `json:"created_by"`
+}
+
+// silence returns the silence of the request, starting at now
+func (req silenceRequest) silence(kind string, now time.Time) (Silence, error) {
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil {
+		return Silence{}, fmt.Errorf("invalid duration %q: %v", req.Duration, err)
+	}
+	now = now.UTC()
+	return Silence{
+		Kind:        kind,
+		Metric:      req.Metric,
+		Fingerprint: req.Fingerprint,
+		Comment:     req.Comment,
+		CreatedBy:   req.CreatedBy,
+		StartsAt:    now,
+		EndsAt:      now.Add(duration),
+	}, nil
+}
+
+// registerSilenceHandlers adds the silencing API to the mux:
+//
+//	GET    /silences       lists the active silences and acknowledgements
+//	POST   /silences       silences a metric or fingerprint for a duration
+//	DELETE /silences/{id}  expires a silence
+//	POST   /ack            acknowledges the anomalies of a fingerprint for a duration, moving
+//	                       its open events to acknowledged
+func registerSilenceHandlers(mux *http.ServeMux, router *Router) {
+	store := router.Silences()
+	mux.HandleFunc("/silences", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, store.Active(router.now()))
+		case http.MethodPost:
+			createSilence(w, r, store, SilenceKindSilence, router.now())
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/silences/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			w.Header().Set("Allow", http.MethodDelete)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		err := store.Expire(r.Context(), strings.TrimPrefix(r.URL.Path, "/silences/"))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	mux.HandleFunc("/ack", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		silence, ok := createSilence(w, r, store, SilenceKindAck, router.now())
+		if ok {
+			if err := router.Acknowledge(r.Context(), silence); err != nil {
+				log.Printf("Failed to acknowledge the events of %s: %v", silence.Fingerprint, err)
+			}
+		}
+	})
+}
+
+// createSilence adds the silence of the request, starting at now, and writes it, returning
+// whether it was added
+func createSilence(w http.ResponseWriter, r *http.Request, store *SilenceStore, kind string, now time.Time) (Silence, bool) {
+	var req silenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return Silence{}, false
+	}
+	silence, err := req.silence(kind, now)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return Silence{}, false
+	}
+	silence, err = store.Add(r.Context(), silence)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return Silence{}, false
+	}
+	writeJSON(w, http.StatusCreated, silence)
+	return silence, true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// runSilenceCommand manages silences on a running detector through its HTTP API
+func runSilenceCommand(args []string, kind string) {
+	fs := flag.NewFlagSet(kind, flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "URL of the detector started with serve")
+	token := fs.String("token", os.Getenv("ANOMALY_DETECTOR_TOKEN"), "Bearer token of a server with auth configured, defaults to $ANOMALY_DETECTOR_TOKEN")
+	metric := fs.String("metric", "", "Metric type to silence")
+	fingerprint := fs.String("fingerprint", "", "Anomaly fingerprint to silence or acknowledge")
+	duration := fs.Duration("duration", time.Hour, "How long the silence lasts")
+	comment := fs.String("comment", "", "Reason for the silence")
+	list := fs.Bool("list", false, "List the active silences instead of creating one")
+	expire := fs.String("expire", "", "ID of a silence to expire instead of creating one")
+	fs.Parse(args)
+
+	baseURL := strings.TrimSuffix(*server, "/")
+	var req *http.Request
+	var err error
+	switch {
+	case *list:
+		req, err = http.NewRequest(http.MethodGet, baseURL+"/silences", nil)
+	case *expire != "":
+		req, err = http.NewRequest(http.MethodDelete, baseURL+"/silences/"+*expire, nil)
+	default:
+		path := "/silences"
+		if kind == SilenceKindAck {
+			path = "/ack"
+		}
+		body, _ := json.Marshal(silenceRequest{
+			Metric:      *metric,
+			Fingerprint: *fingerprint,
+			Duration:    duration.String(),
+			Comment:     *comment,
+			CreatedBy:   os.Getenv("USER"),
+		})
+		req, err = http.NewRequest(http.MethodPost, baseURL+path, bytes.NewReader(body))
+	}
+	if err != nil {
+		log.Fatalf("Invalid request: %v", err)
+	}
+
+	if *token != "" {
+		req.Header.Set("Authorization", "Bearer "+*token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Fatalf("Request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode >= 300 {
+		log.Fatalf("Request failed: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Print(string(body))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	metricpb "google.golang.org/genproto/googleapis/api/metric"
+)
+
+// StatesConfig scores a metric of states, such as uptime check results or the health enum of a
+// service written as a string, as numbers: each state by its value, or the transitions between
+// states as an event series
+type StatesConfig struct {
+	Values      map[string]float64 `yaml:"values"`      // number of each state, e.g. {SERVING: 0, NOT_SERVING: 1}; points in other states are dropped
+	Transitions bool               `yaml:"transitions"` // scores 1 at each point whose state differs from the one before and 0 otherwise
+	To          []string           `yaml:"to"`          // only counts transitions into these states, e.g. ["false"] for uptime checks starting to fail
+}
+
+func (c StatesConfig) validate() error {
+	if c.Transitions == (len(c.Values) > 0) {
+		return fmt.Errorf("exactly one of values and transitions must be set")
+	}
+	if len(c.To) > 0 && !c.Transitions {
+		return fmt.Errorf("to requires transitions")
+	}
+	return nil
+}
+
+// pointState returns the state of a point as a string: true or false for bools, the value
+// itself for strings and numbers
+func pointState(point *monitoringpb.Point) string {
+	switch v := point.GetValue().GetValue().(type) {
+	case *monitoringpb.TypedValue_BoolValue:
+		return strconv.FormatBool(v.BoolValue)
+	case *monitoringpb.TypedValue_StringValue:
+		return v.StringValue
+	case *monitoringpb.TypedValue_Int64Value:
+		return strconv.FormatInt(v.Int64Value, 10)
+	}
+	return strconv.FormatFloat(point.GetValue().GetDoubleValue(), 'g', -1, 64)
+}
+
+// numericSeries returns the series with double values, as the detectors score them. Int64 and
+// bool values are converted, bools to 1 for true and 0 for false, and the values of metrics with
+// states are mapped by them. A string series without states cannot be scored and is returned
+// without points.
+func (c *Config) numericSeries(ts *monitoringpb.TimeSeries) *monitoringpb.TimeSeries {
+	metric, _ := c.MetricConfig(ts.GetMetric().GetType())
+	if metric.States != nil {
+		return metric.States.series(ts)
+	}
+	switch ts.ValueType {
+	case metricpb.MetricDescriptor_INT64, metricpb.MetricDescriptor_BOOL:
+	case metricpb.MetricDescriptor_STRING:
+		log.Printf("Dropped the points of series %s of %s: string values need states to be scored\n", seriesFingerprint(ts), ts.GetMetric().GetType())
+		ts.Points = nil
+		return ts
+	default:
+		return ts
+	}
+	points := make([]*monitoringpb.Point, len(ts.Points))
+	for i, point := range ts.Points {
+		points[i] = doublePoint(point, pointValue(point))
+	}
+	ts.Points, ts.ValueType = points, metricpb.MetricDescriptor_DOUBLE
+	return ts
+}
+
+// series maps the points of the series to the numbers of their states, or to their transitions
+func (c StatesConfig) series(ts *monitoringpb.TimeSeries) *monitoringpb.TimeSeries {
+	var points []*monitoringpb.Point
+	if c.Transitions {
+		points = c.transitions(ts.Points)
+	} else {
+		for _, point := range ts.Points {
+			if value, ok := c.Values[pointState(point)]; ok {
+				points = append(points, doublePoint(point, value))
+			}
+		}
+	}
+	ts.Points, ts.ValueType = points, metricpb.MetricDescriptor_DOUBLE
+	return ts
+}
+
+// transitions returns a point for every point but the oldest, 1 when its state differs from
+// that of the point before and is one of the states transitions are counted into, 0 otherwise.
+// The points are returned newest first, as the API returns them.
+func (c StatesConfig) transitions(points []*monitoringpb.Point) []*monitoringpb.Point {
+	sorted := append([]*monitoringpb.Point(nil), points...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Interval.EndTime.AsTime().After(sorted[j].Interval.EndTime.AsTime())
+	})
+	to := make(map[string]bool, len(c.To))
+	for _, state := range c.To {
+		to[state] = true
+	}
+	transitions := make([]*monitoringpb.Point, 0, len(sorted))
+	for i := 0; i+1 < len(sorted); i++ {
+		state, previous := pointState(sorted[i]), pointState(sorted[i+1])
+		value := 0.0
+		if state != previous && (len(to) == 0 || to[state]) {
+			value = 1
+		}
+		transitions = append(transitions, doublePoint(sorted[i], value))
+	}
+	return transitions
+}
+
+// doublePoint returns a point over the interval of point with a double value
+func doublePoint(point *monitoringpb.Point, value float64) *monitoringpb.Point {
+	return &monitoringpb.Point{
+		Interval: point.Interval,
+		Value:    &monitoringpb.TypedValue{Value: &monitoringpb.TypedValue_DoubleValue{DoubleValue: value}},
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import "math"
+
+// RunningStats accumulates the mean and variance of a stream of values with Welford's online
+// algorithm, so statistics can be computed while points are read instead of after buffering them
+type RunningStats struct {
+	Count int64   `json:"count"`
+	Mean  float64 `json:"mean"`
+	M2    float64 `json:"m2"` // sum of squared deviations from the mean
+}
+
+// Add folds a value into the statistics
+func (s *RunningStats) Add(value float64) {
+	s.Count++
+	delta := value - s.Mean
+	s.Mean += delta / float64(s.Count)
+	s.M2 += delta * (value - s.Mean)
+}
+
+// Variance returns the population variance of the values added so far
+func (s *RunningStats) Variance() float64 {
+	if s.Count == 0 {
+		return 0
+	}
+	return s.M2 / float64(s.Count)
+}
+
+// StdDev returns the population standard deviation of the values added so far
+func (s *RunningStats) StdDev() float64 {
+	return math.Sqrt(s.Variance())
+}
+
+// Merge folds the statistics of another set of values into s, as if its values had been added
+func (s *RunningStats) Merge(other RunningStats) {
+	if other.Count == 0 {
+		return
+	}
+	if s.Count == 0 {
+		*s = other
+		return
+	}
+	count := s.Count + other.Count
+	delta := other.Mean - s.Mean
+	s.M2 += other.M2 + delta*delta*float64(s.Count)*float64(other.Count)/float64(count)
+	s.Mean += delta * float64(other.Count) / float64(count)
+	s.Count = count
+}
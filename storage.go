@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/oauth2/google"
+)
+
+const storageScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// readObject reads a local file or a gs://bucket/object URI. A missing object is reported
+// with an error wrapping os.ErrNotExist for both kinds of location.
+func readObject(ctx context.Context, location string) ([]byte, error) {
+	bucket, object, ok := parseGCSURI(location)
+	if !ok {
+		return os.ReadFile(location)
+	}
+
+	client, err := google.DefaultClient(ctx, storageScope)
+	if err != nil {
+		return nil, fmt.Errorf("could not create storage client: %v", err)
+	}
+
+	objectURL := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media", url.PathEscape(bucket), url.PathEscape(object))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, objectURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %s: %v", location, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("could not read %s: %w", location, os.ErrNotExist)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("could not read %s: %s: %s", location, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// writeObject writes data to a local file or a gs://bucket/object URI
+func writeObject(ctx context.Context, location string, data []byte) error {
+	return writeTypedObject(ctx, location, "application/octet-stream", data)
+}
+
+// writeTypedObject writes data to a local file or a gs://bucket/object URI, where it is served
+// with the content type
+func writeTypedObject(ctx context.Context, location, contentType string, data []byte) error {
+	bucket, object, ok := parseGCSURI(location)
+	if !ok {
+		return os.WriteFile(location, data, 0o644)
+	}
+
+	client, err := google.DefaultClient(ctx, storageScope)
+	if err != nil {
+		return fmt.Errorf("could not create storage client: %v", err)
+	}
+
+	uploadURL := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s", url.PathEscape(bucket), url.QueryEscape(object))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, uploadURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not write %s: %v", location, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("could not write %s: %s: %s", location, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// parseGCSURI splits a gs://bucket/object URI into its bucket and object name
+func parseGCSURI(location string) (string, string, bool) {
+	if !strings.HasPrefix(location, "gs://") {
+		return "", "", false
+	}
+	bucket, object, found := strings.Cut(strings.TrimPrefix(location, "gs://"), "/")
+	if !found || bucket == "" || object == "" {
+		return "", "", false
+	}
+	return bucket, object, true
+}
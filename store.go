@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// storeBaselineKey holds the baseline snapshot when baseline_path is not set
+	storeBaselineKey = "baseline.json"
+	// storeRecentKey holds the recently reported anomalies feedback can refer to
+	storeRecentKey = "recent_anomalies.json"
+	// storeAgentsKey holds the anomaly reports the central command received from its agents
+	storeAgentsKey = "agent_reports.json"
+	// storeTrendsKey holds the daily history of the metrics their long-term trends are derived from
+	storeTrendsKey = "metric_trends.json"
+)
+
+// Store keeps the state of the detector that outlives a detection cycle: baselines, the recently
+// reported anomalies, the daily history of the metrics and the reports of agents the central
+// command deduplicates. Values are opaque to the store, which only needs to read and write them
+// whole by key.
+type Store interface {
+	// Get returns the value of key, or an error wrapping os.ErrNotExist if it has none
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Put replaces the value of key
+	Put(ctx context.Context, key string, data []byte) error
+	// Durable reports whether the values outlive the process
+	Durable() bool
+}
+
+// StoreConfig selects the backend of the state of the detector; at most one backend block may be
+// set, and the state is kept in memory when none is
+type StoreConfig struct {
+	Object *ObjectStoreConfig `yaml:"object"`
+}
+
+// ObjectStoreConfig keeps each value as a file in a local directory or an object under a
+// gs:// prefix
+type ObjectStoreConfig struct {
+	Prefix string `yaml:"prefix"` // local directory or gs://bucket/prefix the values are written under
+}
+
+// storeBackends creates the backends of the blocks of a StoreConfig, by block name
+var storeBackends = []struct {
+	name   string
+	set    func(StoreConfig) bool
+	create func(StoreConfig) (Store, error)
+}{
+	{"object", func(c StoreConfig) bool { return c.Object != nil }, func(c StoreConfig) (Store, error) { return newObjectStore(*c.Object) }},
+}
+
+// newStore creates the store of the configuration, in memory without a backend block
+func newStore(config StoreConfig) (Store, error) {
+	var store Store
+	for _, backend := range storeBackends {
+		if !backend.set(config) {
+			continue
+		}
+		if store != nil {
+			return nil, fmt.Errorf("only one backend may be set")
+		}
+		var err error
+		if store, err = backend.create(config); err != nil {
+			return nil, fmt.Errorf("%s: %v", backend.name, err)
+		}
+	}
+	if store == nil {
+		store = newMemoryStore()
+	}
+	return store, nil
+}
+
+// memoryStore keeps the state in memory for the lifetime of the process, the default
+type memoryStore struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{values: make(map[string][]byte)}
+}
+
+func (s *memoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.values[key]
+	if !ok {
+		return nil, fmt.Errorf("no value for %s: %w", key, os.ErrNotExist)
+	}
+	return data, nil
+}
+
+func (s *memoryStore) Put(ctx context.Context, key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = append([]byte(nil), data...)
+	return nil
+}
+
+func (s *memoryStore) Durable() bool {
+	return false
+}
+
+// objectStore keeps each value in a local file or a Cloud Storage object named by its key
+type objectStore struct {
+	prefix string
+}
+
+func newObjectStore(config ObjectStoreConfig) (*objectStore, error) {
+	if config.Prefix == "" {
+		return nil, fmt.Errorf("no prefix configured")
+	}
+	return &objectStore{prefix: config.Prefix}, nil
+}
+
+// location returns the file or gs:// URI of key
+func (s *objectStore) location(key string) string {
+	if strings.HasPrefix(s.prefix, "gs://") {
+		return strings.TrimSuffix(s.prefix, "/") + "/" + key
+	}
+	return filepath.Join(s.prefix, key)
+}
+
+func (s *objectStore) Get(ctx context.Context, key string) ([]byte, error) {
+	return readObject(ctx, s.location(key))
+}
+
+func (s *objectStore) Put(ctx context.Context, key string, data []byte) error {
+	return writeObject(ctx, s.location(key), data)
+}
+
+func (s *objectStore) Durable() bool {
+	return true
+}
+
+// loadState decodes the JSON value of key into out, leaving out unchanged when the key has no
+// value yet
+func loadState(ctx context.Context, store Store, key string, out interface{}) error {
+	data, err := store.Get(ctx, key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// saveState encodes value as the JSON value of key
+func saveState(ctx context.Context, store Store, key string, value interface{}) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return store.Put(ctx, key, data)
+}
+
+// objectStoreAt returns an object store holding the single local file or gs:// URI location,
+// with the key of location in it
+func objectStoreAt(location string) (*objectStore, string) {
+	if bucket, object, ok := parseGCSURI(location); ok {
+		dir, key := path.Split(object)
+		return &objectStore{prefix: "gs://" + bucket + "/" + dir}, key
+	}
+	return &objectStore{prefix: filepath.Dir(location)}, filepath.Base(location)
+}
+
+// storeLocation describes where the store keeps key, for logs
+func storeLocation(store Store, key string) string {
+	if objects, ok := store.(*objectStore); ok {
+		return objects.location(key)
+	}
+	return key + " in memory"
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StormConfig collapses the notifications of an alert storm, when anomalies on many metrics at
+// once usually mean one underlying outage, into a single widespread anomaly alert
+type StormConfig struct {
+	Metrics   int `yaml:"metrics"`    // metrics with anomalies within the window that make a storm, 0 for no limit
+	Anomalies int `yaml:"anomalies"`  // anomalies across all metrics within the window that make a storm, 0 for no limit
+	WindowMin int `yaml:"window_min"` // length of the sliding window in minutes, defaults to 15
+}
+
+// enabled reports whether any level is configured
+func (c StormConfig) enabled() bool {
+	return c.Metrics > 0 || c.Anomalies > 0
+}
+
+// stormDetector tracks the anomalies notifiable over a sliding window. While they are over
+// either level, it holds them back and notifies a widespread anomaly alert in their place, once
+// when the storm starts and again whenever it spreads to more metrics.
+type stormDetector struct {
+	config StormConfig
+	window time.Duration
+
+	mu       sync.Mutex
+	seen     map[string][]time.Time // report times of the anomalies within the window by metric type
+	start    time.Time              // start of the current storm, zero if there is none
+	notified int                    // metrics affected when the storm was last notified
+}
+
+func newStormDetector(config StormConfig) *stormDetector {
+	if config.WindowMin == 0 {
+		config.WindowMin = 15
+	}
+	return &stormDetector{
+		config: config,
+		window: time.Duration(config.WindowMin) * time.Minute,
+		seen:   make(map[string][]time.Time),
+	}
+}
+
+// collapse returns the anomalies to notify at now: the anomalies themselves outside a storm, and
+// during one the widespread anomaly alert when it is due, or nothing. It reports whether a storm
+// is going on.
+func (s *stormDetector) collapse(anomalies []Anomaly, now time.Time) ([]Anomaly, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cutoff := now.Add(-s.window)
+	total := 0
+	for metric, times := range s.seen {
+		if times = pruneBefore(times, cutoff); len(times) == 0 {
+			delete(s.seen, metric)
+		} else {
+			s.seen[metric] = times
+			total += len(times)
+		}
+	}
+	for _, anomaly := range anomalies {
+		s.seen[anomaly.MetricName] = append(s.seen[anomaly.MetricName], now)
+		total++
+	}
+
+	storm := s.config.Metrics > 0 && len(s.seen) >= s.config.Metrics ||
+		s.config.Anomalies > 0 && total >= s.config.Anomalies
+	if !storm {
+		if !s.start.IsZero() {
+			log.Printf("Alert storm that started at %s is over\n", displayTime(s.start))
+			s.start = time.Time{}
+		}
+		return anomalies, false
+	}
+
+	if s.start.IsZero() {
+		s.start = now
+		s.notified = 0
+		log.Printf("Alert storm: %d anomalies across %d metrics within %d minutes\n", total, len(s.seen), s.config.WindowMin)
+	}
+	if len(anomalies) == 0 || len(s.seen) <= s.notified {
+		return nil, true
+	}
+	s.notified = len(s.seen)
+	return []Anomaly{s.alert(total)}, true
+}
+
+// alert returns the widespread anomaly alert listing the affected metrics. It keeps the ID of
+// the storm, so destinations deduplicating by ID update one incident as it spreads.
+func (s *stormDetector) alert(total int) Anomaly {
+	metrics := make([]string, 0, len(s.seen))
+	for metric := range s.seen {
+		metrics = append(metrics, metric)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		if len(s.seen[metrics[i]]) != len(s.seen[metrics[j]]) {
+			return len(s.seen[metrics[i]]) > len(s.seen[metrics[j]])
+		}
+		return metrics[i] < metrics[j]
+	})
+	counts := make([]string, len(metrics))
+	for i, metric := range metrics {
+		counts[i] = fmt.Sprintf("%s: %d", metric, len(s.seen[metric]))
+	}
+
+	return Anomaly{
+		ID:          fmt.Sprintf("storm-%d", s.start.Unix()),
+		Kind:        KindStorm,
+		DisplayName: "widespread anomaly",
+		Fingerprint: "storm",
+		Timestamp:   s.start,
+		Value:       float64(len(metrics)),
+		Severity:    SeverityCritical,
+		Message: fmt.Sprintf("Widespread anomaly: %d anomalies across %d metrics within %d minutes, likely one underlying outage: %s",
+			total, len(metrics), s.config.WindowMin, strings.Join(counts, ", ")),
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// SuppressionRule keeps the anomalies of known-noisy series from being notified, like a
+// permanent silence defined in the configuration
+type SuppressionRule struct {
+	Name     string             `yaml:"name"`     // identifies the rule in logs
+	Metric   string             `yaml:"metric"`   // metric type or glob pattern, e.g. compute.googleapis.com/instance/*, all metrics if empty
+	Matchers []string           `yaml:"matchers"` // label matchers that must all match, e.g. zone=~"us-central1-.*" or preemptible="true"
+	Window   *SuppressionWindow `yaml:"window"`   // optional daily window the rule applies in, always otherwise
+}
+
+// SuppressionWindow is a recurring daily time window, such as a nightly batch run
+type SuppressionWindow struct {
+	Start    string   `yaml:"start"`     // HH:MM
+	End      string   `yaml:"end"`       // HH:MM, before start for windows spanning midnight
+	Days     []string `yaml:"days"`      // days the window starts on, e.g. [sat, sun], every day if empty
+	TimeZone string   `yaml:"time_zone"` // IANA time zone, defaults to UTC
+}
+
+// suppressionRule is a SuppressionRule with its matchers and window parsed
+type suppressionRule struct {
+	name     string
+	metric   string
+	matchers []labelMatcher
+	window   *dailyWindow
+}
+
+// labelMatcher matches a label of an anomaly's series or metric with =, !=, =~ or !~
+type labelMatcher struct {
+	label  string
+	op     string
+	value  string
+	regexp *regexp.Regexp
+}
+
+// dailyWindow holds a SuppressionWindow as minutes since midnight
+type dailyWindow struct {
+	start, end int
+	days       map[time.Weekday]bool
+	location   *time.Location
+}
+
+// labelMatcherSyntax parses matchers such as zone=~"us-central1-.*", the value optionally quoted
+var labelMatcherSyntax = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_.]*)\s*(=~|!~|!=|=)\s*(.*?)\s*$`)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// compileSuppressions parses the suppression rules of the configuration
+func compileSuppressions(rules []SuppressionRule) ([]suppressionRule, error) {
+	var compiled []suppressionRule
+	for i, rule := range rules {
+		name := rule.Name
+		if name == "" {
+			name = fmt.Sprintf("suppression %d", i+1)
+		}
+		if rule.Metric == "" && len(rule.Matchers) == 0 {
+			return nil, fmt.Errorf("%s: a rule needs a metric or matchers", name)
+		}
+		if _, err := path.Match(rule.Metric, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid metric pattern %q: %v", name, rule.Metric, err)
+		}
+		c := suppressionRule{name: name, metric: rule.Metric}
+		for _, matcher := range rule.Matchers {
+			m, err := parseLabelMatcher(matcher)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			c.matchers = append(c.matchers, m)
+		}
+		if rule.Window != nil {
+			window, err := parseDailyWindow(*rule.Window)
+			if err != nil {
+				return nil, fmt.Errorf("%s: window: %v", name, err)
+			}
+			c.window = window
+		}
+		compiled = append(compiled, c)
+	}
+	return compiled, nil
+}
+
+func parseLabelMatcher(matcher string) (labelMatcher, error) {
+	parts := labelMatcherSyntax.FindStringSubmatch(matcher)
+	if parts == nil {
+		return labelMatcher{}, fmt.Errorf("invalid matcher %q, expected label=\"value\", !=, =~ or !~", matcher)
+	}
+	m := labelMatcher{label: parts[1], op: parts[2], value: strings.Trim(parts[3], `"`)}
+	if m.op == "=~" || m.op == "!~" {
+		re, err := regexp.Compile("^(?:" + m.value + ")$")
+		if err != nil {
+			return labelMatcher{}, fmt.Errorf("invalid regular expression in matcher %q: %v", matcher, err)
+		}
+		m.regexp = re
+	}
+	return m, nil
+}
+
+func parseDailyWindow(window SuppressionWindow) (*dailyWindow, error) {
+	start, err := minuteOfDay(window.Start)
+	if err != nil {
+		return nil, fmt.Errorf("invalid start: %v", err)
+	}
+	end, err := minuteOfDay(window.End)
+	if err != nil {
+		return nil, fmt.Errorf("invalid end: %v", err)
+	}
+	location := time.UTC
+	if window.TimeZone != "" {
+		location, err = time.LoadLocation(window.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time_zone: %v", err)
+		}
+	}
+	d := &dailyWindow{start: start, end: end, location: location}
+	if len(window.Days) > 0 {
+		d.days = make(map[time.Weekday]bool)
+		for _, day := range window.Days {
+			weekday, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return nil, fmt.Errorf("unknown day %q", day)
+			}
+			d.days[weekday] = true
+		}
+	}
+	return d, nil
+}
+
+func minuteOfDay(hhmm string) (int, error) {
+	t, err := time.Parse("15:04", hhmm)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// contains reports whether t falls in the window on a day it starts on
+func (w *dailyWindow) contains(t time.Time) bool {
+	t = t.In(w.location)
+	minute := t.Hour()*60 + t.Minute()
+	day := t.Weekday()
+	if w.end <= w.start {
+		// The window spans midnight, so the early part belongs to the previous day's window
+		if minute < w.end {
+			return w.days == nil || w.days[(day+6)%7]
+		}
+		if minute < w.start {
+			return false
+		}
+	} else if minute < w.start || minute >= w.end {
+		return false
+	}
+	return w.days == nil || w.days[day]
+}
+
+// matches reports whether the rule suppresses the anomaly, judging its window by the time the
+// anomaly occurred
+func (r suppressionRule) matches(anomaly Anomaly) bool {
+	if r.metric != "" {
+		if ok, _ := path.Match(r.metric, anomaly.MetricName); !ok {
+			return false
+		}
+	}
+	for _, matcher := range r.matchers {
+		if !matcher.matches(anomaly) {
+			return false
+		}
+	}
+	return r.window == nil || r.window.contains(anomaly.Timestamp)
+}
+
+// matches looks the label up in the series labels, then in the metric's static labels. A
+// missing label has the empty value, as in Prometheus.
+func (m labelMatcher) matches(anomaly Anomaly) bool {
+	value, ok := anomaly.Labels[m.label]
+	if !ok {
+		value = anomaly.Metadata[m.label]
+	}
+	switch m.op {
+	case "=":
+		return value == m.value
+	case "!=":
+		return value != m.value
+	case "=~":
+		return m.regexp.MatchString(value)
+	default:
+		return !m.regexp.MatchString(value)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SeriesPoint is the newest point of a series scored in a detection cycle
+type SeriesPoint struct {
+	MetricName  string            `json:"metric_name"`
+	Fingerprint string            `json:"fingerprint"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Value       float64           `json:"value"`
+	Unit        string            `json:"unit,omitempty"`
+	ZScore      float64           `json:"z_score"`
+	Timestamp   time.Time         `json:"timestamp"`
+	Severity    string            `json:"severity,omitempty"` // set when the point breaches the threshold
+}
+
+// TailOptions selects the series the tail mode of run streams
+type TailOptions struct {
+	Enabled bool
+	Metrics string // comma-separated metric types, all configured metrics if empty
+	Labels  string // comma-separated key=value labels the series must have
+	SSE     string // address to stream the points from as server-sent events
+}
+
+func addTailFlags(fs *flag.FlagSet) *TailOptions {
+	var options TailOptions
+	fs.BoolVar(&options.Enabled, "tail", false, "Stream the newest value and Z-score of the series after every cycle instead of notifying")
+	fs.StringVar(&options.Metrics, "tail-metrics", "", "Comma-separated metric types to tail (defaults to all configured metrics)")
+	fs.StringVar(&options.Labels, "tail-labels", "", "Comma-separated key=value labels selecting the series to tail")
+	fs.StringVar(&options.SSE, "tail-sse", "", "Address to also stream the tailed points from as server-sent events, e.g. :8090")
+	return &options
+}
+
+// tailer prints the newest point of the selected series after every cycle and streams it to
+// the connected SSE clients
+type tailer struct {
+	config   *Config
+	selector map[string]string
+	out      io.Writer
+	color    bool
+
+	mu      sync.Mutex
+	clients map[chan []byte]bool
+}
+
+// runTail polls like run, but streams the scores of the selected series rather than notifying,
+// so it can run next to the production detector during an incident
+func runTail(config *Config, options TailOptions) {
+	if options.Metrics != "" {
+		if err := config.selectMetrics(strings.Split(options.Metrics, ",")); err != nil {
+			log.Fatalf("Invalid -tail-metrics: %v", err)
+		}
+	}
+	selector, err := parseLabelSelector(options.Labels)
+	if err != nil {
+		log.Fatalf("Invalid -tail-labels: %v", err)
+	}
+	client, detector := mustStartDetector(config)
+
+	t := &tailer{config: config, selector: selector, out: os.Stdout, color: isTerminal(os.Stdout), clients: make(map[chan []byte]bool)}
+	if options.SSE != "" {
+		go func() {
+			log.Printf("Streaming tailed points on %s\n", options.SSE)
+			if err := http.ListenAndServe(options.SSE, t); err != nil {
+				log.Fatalf("Failed to serve tailed points: %v", err)
+			}
+		}()
+	}
+
+	var mu sync.Mutex
+	runSchedules(context.Background(), config, func(metrics []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if _, err := runCycle(client, config, detector, metrics); err != nil {
+			log.Printf("Detection cycle failed: %v", err)
+			return
+		}
+		t.publish(detector.LatestPoints())
+	})
+}
+
+// publish prints and streams the selected points, breaches in yellow for warnings and red for
+// critical ones
+func (t *tailer) publish(points []SeriesPoint) {
+	critical := t.config.CriticalZScore
+	if critical == 0 {
+		critical = 1.5 * t.config.ZScoreThreshold
+	}
+	for _, point := range points {
+		if !selectsLabels(t.selector, point.Labels) {
+			continue
+		}
+		color := ""
+		switch {
+		case math.Abs(point.ZScore) > critical:
+			point.Severity, color = SeverityCritical, ansiRed
+		case math.Abs(point.ZScore) > t.config.ZScoreThreshold:
+			point.Severity, color = SeverityWarning, ansiYellow
+		}
+
+		line := fmt.Sprintf("%s  %s %s {%s}  %s  z=%.2f", point.Timestamp.Format(time.RFC3339), t.config.displayName(point.MetricName),
+			point.Labels["resource_type"], formatLabels(withoutResourceType(point.Labels)), formatValue(point.Value, point.Unit), point.ZScore)
+		if point.Severity != "" {
+			line += " [" + point.Severity + "]"
+		}
+		if t.color && color != "" {
+			line = color + line + ansiReset
+		}
+		fmt.Fprintln(t.out, line)
+
+		data, _ := json.Marshal(point)
+		t.broadcast(data)
+	}
+}
+
+// broadcast hands the event to every client, dropping it for clients too slow to keep up
+func (t *tailer) broadcast(data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for client := range t.clients {
+		select {
+		case client <- data:
+		default:
+		}
+	}
+}
+
+// ServeHTTP streams the tailed points as server-sent events named point, one per series and cycle
+func (t *tailer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	events := make(chan []byte, 256)
+	t.mu.Lock()
+	t.clients[events] = true
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		delete(t.clients, events)
+		t.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case data := <-events:
+			fmt.Fprintf(w, "event: point\ndata: %s\n\n", data)
+			flusher.Flush()
+		}
+	}
+}
+
+// isTerminal reports whether the file is a terminal that colors can be written to, honouring
+// NO_COLOR
+func isTerminal(file *os.File) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
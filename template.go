@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// MessageTemplateConfig overrides how a notifier words its anomalies with Go text/template
+// templates over the anomaly. Parts left empty keep the built-in wording of the notifier.
+type MessageTemplateConfig struct {
+	Title  string            `yaml:"title"`  // e.g. "[{{.Severity}}] {{.Name}} for {{.Metadata.team}}"
+	Body   string            `yaml:"body"`   // e.g. "{{.FormattedValue}} on {{.Resource}}: {{.Message}}"
+	Fields map[string]string `yaml:"fields"` // extra fields by name, such as Alertmanager annotations or Datadog tags
+}
+
+// templateData is what the templates of a notifier are executed on: the fields of the anomaly,
+// such as .Severity, .Labels.zone or .Metadata.team, and the parts of its built-in wording
+type templateData struct {
+	Anomaly
+	Name           string // display name of the metric, or its type
+	FormattedValue string // value in the unit of the metric, such as 1.20 GiB
+	Resource       string // resource type and labels of the series
+	Links          string // runbook, dashboard and Metrics Explorer links, as " (runbook ..., ...)"
+}
+
+// templateFuncs are the functions available to templates beyond the text/template built-ins
+var templateFuncs = template.FuncMap{
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"time": func(format string, t time.Time) string {
+		return t.In(displayTimes.location).Format(format)
+	},
+}
+
+// messageTemplate is a compiled MessageTemplateConfig
+type messageTemplate struct {
+	titleTemplate *template.Template
+	bodyTemplate  *template.Template
+	fields        map[string]*template.Template
+}
+
+// compileMessageTemplate parses the templates of the configuration. Missing map keys, such as
+// a label a series does not have, render as empty strings.
+func compileMessageTemplate(config MessageTemplateConfig) (*messageTemplate, error) {
+	parse := func(name, text string) (*template.Template, error) {
+		if text == "" {
+			return nil, nil
+		}
+		t, err := template.New(name).Funcs(templateFuncs).Option("missingkey=zero").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %v", name, err)
+		}
+		return t, nil
+	}
+	t := &messageTemplate{fields: make(map[string]*template.Template)}
+	var err error
+	if t.titleTemplate, err = parse("title", config.Title); err != nil {
+		return nil, err
+	}
+	if t.bodyTemplate, err = parse("body", config.Body); err != nil {
+		return nil, err
+	}
+	for name, text := range config.Fields {
+		if text == "" {
+			return nil, fmt.Errorf("template field %s: empty template", name)
+		}
+		if t.fields[name], err = parse("field "+name, text); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// supports checks that the template only sets the parts a destination has
+func (t *messageTemplate) supports(title, body, fields bool) error {
+	var unsupported []string
+	if t.titleTemplate != nil && !title {
+		unsupported = append(unsupported, "title")
+	}
+	if t.bodyTemplate != nil && !body {
+		unsupported = append(unsupported, "body")
+	}
+	if len(t.fields) > 0 && !fields {
+		unsupported = append(unsupported, "fields")
+	}
+	if len(unsupported) > 0 {
+		return fmt.Errorf("template: %s not supported by this destination", strings.Join(unsupported, " and "))
+	}
+	return nil
+}
+
+// templatedNotifier is implemented by notifiers whose wording a template can override
+type templatedNotifier interface {
+	setTemplate(t *messageTemplate) error
+}
+
+// render executes a template on the anomaly, returning the built-in wording if there is no
+// template or it fails, which is logged
+func render(t *template.Template, anomaly Anomaly, builtIn string) string {
+	if t == nil {
+		return builtIn
+	}
+	var b strings.Builder
+	data := templateData{Anomaly: anomaly, Name: anomaly.displayName(), FormattedValue: anomaly.formattedValue(), Resource: anomaly.resource(), Links: anomaly.links()}
+	if err := t.Execute(&b, data); err != nil {
+		log.Printf("Could not execute %s on anomaly %s, using the built-in wording: %v\n", t.Name(), anomaly.ID, err)
+		return builtIn
+	}
+	return b.String()
+}
+
+// title returns the title of the anomaly, builtIn without a title template. A nil template
+// keeps the built-in wording of every part.
+func (t *messageTemplate) title(anomaly Anomaly, builtIn string) string {
+	if t == nil {
+		return builtIn
+	}
+	return render(t.titleTemplate, anomaly, builtIn)
+}
+
+// body returns the body of the anomaly, builtIn without a body template
+func (t *messageTemplate) body(anomaly Anomaly, builtIn string) string {
+	if t == nil {
+		return builtIn
+	}
+	return render(t.bodyTemplate, anomaly, builtIn)
+}
+
+// fieldNames returns the names of the template fields in order
+func (t *messageTemplate) fieldNames() []string {
+	if t == nil {
+		return nil
+	}
+	names := make([]string, 0, len(t.fields))
+	for name := range t.fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// field returns the value of the named template field for the anomaly
+func (t *messageTemplate) field(anomaly Anomaly, name string) string {
+	return render(t.fields[name], anomaly, "")
+}
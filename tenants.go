@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+)
+
+// tenant is one configuration set of a config directory with its own detector state
+type tenant struct {
+	name     string
+	config   *Config
+	router   *Router
+	detector *SimpleAnomalyDetector
+	// discovered is set once the workloads of the tenant are discovered and its shard selected
+	discovered bool
+}
+
+// loadTenants loads every YAML file of a directory as a tenant. The tenant is named by the
+// config's tenant field, or the file name without extension.
+func loadTenants(dir string) ([]*tenant, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var tenants []*tenant
+	names := make(map[string]string)
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+
+		path := filepath.Join(dir, entry.Name())
+		config, err := LoadConfig(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not load %s: %v", path, err)
+		}
+		config.setDefaults()
+
+		name := config.Tenant
+		if name == "" {
+			name = strings.TrimSuffix(entry.Name(), ext)
+		}
+		if other, exists := names[name]; exists {
+			return nil, fmt.Errorf("tenant %s is defined by both %s and %s", name, other, path)
+		}
+		names[name] = path
+
+		router, err := NewRouter(context.Background(), config)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: could not create notifiers: %v", name, err)
+		}
+		tenants = append(tenants, &tenant{name: name, config: config, router: router})
+	}
+
+	if len(tenants) == 0 {
+		return nil, fmt.Errorf("no configuration files found in %s", dir)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].name < tenants[j].name })
+	// Times are shown the same way by the whole process
+	for _, t := range tenants[1:] {
+		if t.config.TimeDisplay != tenants[0].config.TimeDisplay {
+			return nil, fmt.Errorf("tenants %s and %s set different time_display, which must be the same for every tenant", tenants[0].name, t.name)
+		}
+	}
+	tenants[0].config.TimeDisplay.apply()
+	return tenants, nil
+}
+
+// runTenants runs an independent polling loop per tenant, each usually watching its own project.
+// A tenant that cannot be started, for example for lack of permissions on its project, is
+// reported and retried without affecting the others. Tenants share a monitoring client unless
+// their configuration sets its own credentials or Monitoring API connection. Credentials and
+// sharding given by flags apply to all of them.
+func runTenants(dir string, credentials CredentialsConfig, sharding ShardingConfig) {
+	log.Printf("Loading tenant configurations from %s...\n", dir)
+	tenants, err := loadTenants(dir)
+	if err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
+	}
+	log.Printf("Loaded %d tenants\n", len(tenants))
+	for _, t := range tenants {
+		t.config.Sharding.override(sharding)
+	}
+
+	client := mustCreateClient(credentials, MonitoringAPIConfig{})
+
+	// Tenants that cannot start are retried, so the detector is ready once they are launched and
+	// wedged only when no tenant completes cycles, timed on the wall clock
+	var maxCycleAge time.Duration
+	routers := make([]*Router, 0, len(tenants))
+	for _, t := range tenants {
+		maxCycleAge = max(maxCycleAge, t.config.maxCycleAge())
+		routers = append(routers, t.router)
+	}
+	superviseService(wallClock{}, maxCycleAge, fmt.Sprintf("Detecting %d tenants", len(tenants)), routers...)
+
+	var wg sync.WaitGroup
+	for _, t := range tenants {
+		tenantClient := client
+		if t.config.Credentials != (CredentialsConfig{}) || t.config.MonitoringAPI != (MonitoringAPIConfig{}) {
+			tenantClient, err = newMetricClient(t.credentials(credentials), t.config.MonitoringAPI)
+			if err != nil {
+				log.Printf("[%s] Failed to create monitoring client, tenant disabled: %v", t.name, err)
+				continue
+			}
+		}
+		wg.Add(1)
+		go func(t *tenant, client *monitoring.MetricClient) {
+			defer wg.Done()
+			t.run(client, t.credentials(credentials))
+		}(t, tenantClient)
+	}
+	wg.Wait()
+	log.Fatalf("No tenant could be started")
+}
+
+// credentials returns the tenant's credentials with the flags applied, or the flags alone if the
+// tenant sets none
+func (t *tenant) credentials(flags CredentialsConfig) CredentialsConfig {
+	if t.config.Credentials == (CredentialsConfig{}) {
+		return flags
+	}
+	credentials := t.config.Credentials
+	credentials.override(flags)
+	return credentials
+}
+
+// Delays between attempts to start a tenant, doubling from the first to the last
+const (
+	tenantRetryMin = time.Minute
+	tenantRetryMax = 30 * time.Minute
+)
+
+// run starts the tenant, retrying until it succeeds, and then polls its metrics
+func (t *tenant) run(client *monitoring.MetricClient, credentials CredentialsConfig) {
+	for delay := tenantRetryMin; ; delay = min(2*delay, tenantRetryMax) {
+		err := t.start(client, credentials)
+		if err == nil {
+			break
+		}
+		log.Printf("[%s] Failed to start, retrying in %s: %v", t.name, delay, err)
+		t.router.ReportError(context.Background(), fmt.Errorf("tenant %s: %v", t.name, err))
+		time.Sleep(delay)
+	}
+	reportBackfill(client, t.config, t.detector, t.router)
+
+	var mu sync.Mutex
+	runSchedules(context.Background(), t.config, func(metrics []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		t.cycle(client, metrics)
+	})
+}
+
+// start discovers the tenant's workloads, selects its shard, validates its filters and
+// initialises its baseline. Workloads are discovered once, on the first successful attempt.
+func (t *tenant) start(client *monitoring.MetricClient, credentials CredentialsConfig) error {
+	if !t.discovered {
+		if err := t.config.discoverWorkloads(context.Background(), credentials); err != nil {
+			return fmt.Errorf("could not discover workloads: %v", err)
+		}
+		if err := t.config.selectShard(); err != nil {
+			return fmt.Errorf("could not select shard: %v", err)
+		}
+		t.discovered = true
+	}
+	if err := checkPermissions(context.Background(), client, t.config, credentials); err != nil {
+		return err
+	}
+	if err := validateFilters(context.Background(), client, t.config); err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
+	}
+	log.Printf("[%s] Initialising baseline for project %s...\n", t.name, t.config.ProjectID)
+	detector, err := startBaseline(context.Background(), client, t.config)
+	if err != nil {
+		return fmt.Errorf("could not initialise baseline: %v", err)
+	}
+	detector.events = t.router.Events()
+	t.detector = detector
+	return nil
+}
+
+// cycle runs detection for the tenant and logs a per-tenant summary. A panic is reported as a
+// failed cycle of the tenant rather than stopping every tenant.
+func (t *tenant) cycle(client *monitoring.MetricClient, metrics []string) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("[%s] Detection cycle panicked: %v", t.name, r)
+			t.router.ReportError(context.Background(), fmt.Errorf("tenant %s: detection cycle panicked: %v", t.name, r))
+		}
+	}()
+	anomalies, err := runCycle(client, t.config, t.detector, metrics)
+	if err != nil {
+		log.Printf("[%s] Detection cycle failed: %v", t.name, err)
+		t.router.ReportError(context.Background(), fmt.Errorf("tenant %s: %v", t.name, err))
+		return
+	}
+	failures := t.detector.FetchFailures()
+	t.router.ReportCycle(context.Background(), anomalies, failures)
+
+	log.Printf("[%s] Summary: %d anomalies across %d metrics in project %s, %d metrics not fetched\n", t.name, len(anomalies), len(metrics), t.config.ProjectID, len(failures))
+}
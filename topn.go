@@ -0,0 +1,63 @@
+package main
+
+import (
+	"log"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SeriesScore is the peak Z-score of one series in a detection cycle
+type SeriesScore struct {
+	MetricName  string            `json:"metric_name"`
+	Fingerprint string            `json:"fingerprint"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	ZScore      float64           `json:"z_score"`
+	Timestamp   time.Time         `json:"timestamp"` // end time of the peak point
+}
+
+// TopSeries returns the n series with the highest absolute Z-scores in the last detection
+// cycle, whether or not they crossed the threshold
+func (d *SimpleAnomalyDetector) TopSeries(n int) []SeriesScore {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.topSeries(n)
+}
+
+func (d *SimpleAnomalyDetector) topSeries(n int) []SeriesScore {
+	if n > len(d.seriesScores) {
+		n = len(d.seriesScores)
+	}
+	top := make([]SeriesScore, n)
+	copy(top, d.seriesScores)
+	return top
+}
+
+// rankSeries orders the series scored in a cycle by the absolute value of their peak Z-score
+func rankSeries(scores []SeriesScore) {
+	sort.SliceStable(scores, func(i, j int) bool {
+		return math.Abs(scores[i].ZScore) > math.Abs(scores[j].ZScore)
+	})
+}
+
+// logTopSeries logs the most anomalous series of a cycle
+func logTopSeries(config *Config, top []SeriesScore) {
+	if len(top) == 0 {
+		return
+	}
+	log.Printf("Top %d series by absolute Z-score:\n", len(top))
+	for _, score := range top {
+		log.Printf("  %8.2f  %s {%s} (fingerprint %s)\n", score.ZScore, config.displayName(score.MetricName), formatLabels(score.Labels), score.Fingerprint)
+	}
+}
+
+// formatLabels renders labels as sorted key=value pairs
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ", ")
+}
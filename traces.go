@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// traceReadScope is the OAuth scope of reading traces from Cloud Trace
+const traceReadScope = "https://www.googleapis.com/auth/trace.readonly"
+
+// TracesConfig attaches example traces from Cloud Trace to the anomalies of latency metrics,
+// the slowest requests of the time of the anomaly, connecting the statistical signal to
+// concrete requests to inspect
+type TracesConfig struct {
+	Metrics   []string          `yaml:"metrics"`    // metric types whose anomalies get traces, defaults to those with a time unit such as ms
+	Labels    map[string]string `yaml:"labels"`     // trace label each anomaly label must match, e.g. service_name: service.name
+	Filter    string            `yaml:"filter"`     // Cloud Trace filter added to every lookup, e.g. root:/checkout
+	MarginMin int               `yaml:"margin_min"` // minutes before the start and after the end of an anomaly its traces are searched, defaults to 5
+	MaxTraces int               `yaml:"max_traces"` // traces attached to an anomaly, slowest first, defaults to 3
+}
+
+func (c TracesConfig) validate() error {
+	if c.MarginMin < 0 {
+		return fmt.Errorf("margin_min must not be negative")
+	}
+	if c.MaxTraces < 0 {
+		return fmt.Errorf("max_traces must not be negative")
+	}
+	return nil
+}
+
+// TraceExemplar is a request traced around an anomaly
+type TraceExemplar struct {
+	TraceID   string  `json:"trace_id" yaml:"trace_id"`
+	Name      string  `json:"name,omitempty" yaml:"name,omitempty"` // name of the root span, e.g. /checkout
+	LatencyMs float64 `json:"latency_ms" yaml:"latency_ms"`
+	URL       string  `json:"url" yaml:"url"` // the trace in the Cloud console
+}
+
+// traceLookup reads example traces of the anomalies of latency metrics from Cloud Trace
+type traceLookup struct {
+	config      TracesConfig
+	projectID   string
+	credentials CredentialsConfig
+	metrics     map[string]bool // the metric types looked up, those with a time unit when empty
+
+	mu   sync.Mutex
+	http *http.Client // created on first use
+}
+
+func newTraceLookup(config TracesConfig, projectID string, credentials CredentialsConfig) *traceLookup {
+	if config.MarginMin == 0 {
+		config.MarginMin = 5
+	}
+	if config.MaxTraces == 0 {
+		config.MaxTraces = 3
+	}
+	metrics := make(map[string]bool)
+	for _, metric := range config.Metrics {
+		metrics[metric] = true
+	}
+	return &traceLookup{config: config, projectID: projectID, credentials: credentials, metrics: metrics}
+}
+
+// attach sets the traces of the Z-score anomalies of latency metrics: the slowest traces
+// between margin_min before their start and after their end, no faster than the top of the
+// expected range of a spike. An anomaly whose traces cannot be read is logged and reported
+// without them.
+func (l *traceLookup) attach(ctx context.Context, anomalies []Anomaly, now time.Time) {
+	if l == nil {
+		return
+	}
+	margin := time.Duration(l.config.MarginMin) * time.Minute
+	for i := range anomalies {
+		anomaly := &anomalies[i]
+		if anomaly.Kind != KindAnomaly || !l.latency(*anomaly) {
+			continue
+		}
+		projectID := anomaly.ProjectID
+		if projectID == "" {
+			projectID = l.projectID
+		}
+		end := anomaly.EndTime
+		if end.Before(anomaly.Timestamp) {
+			end = anomaly.Timestamp
+		}
+		end = end.Add(margin)
+		if end.After(now) {
+			end = now
+		}
+		traces, err := l.list(ctx, projectID, l.filter(*anomaly), anomaly.Timestamp.Add(-margin), end)
+		if err != nil {
+			log.Printf("Could not read the traces of anomaly %s from Cloud Trace: %v", anomaly.ID, err)
+			continue
+		}
+		anomaly.Traces = traces
+	}
+}
+
+// latency reports whether traces are looked up for the metric of the anomaly
+func (l *traceLookup) latency(anomaly Anomaly) bool {
+	if len(l.metrics) > 0 {
+		return l.metrics[anomaly.MetricName]
+	}
+	return secondMultiples[anomaly.Unit] != 0
+}
+
+// filter returns the Cloud Trace filter of the traces of the anomaly: the configured filter, the
+// trace labels matching its labels and, for a spike, a latency of at least the top of its
+// expected range
+func (l *traceLookup) filter(anomaly Anomaly) string {
+	var terms []string
+	if l.config.Filter != "" {
+		terms = append(terms, l.config.Filter)
+	}
+	labels := make([]string, 0, len(l.config.Labels))
+	for label := range l.config.Labels {
+		labels = append(labels, label)
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		if value := anomaly.Labels[label]; value != "" {
+			terms = append(terms, fmt.Sprintf("+%s:%s", l.config.Labels[label], value))
+		}
+	}
+	if anomaly.ZScore > 0 && anomaly.Expected != nil && anomaly.Expected.High > 0 {
+		if seconds := secondMultiples[anomaly.Unit]; seconds != 0 {
+			terms = append(terms, fmt.Sprintf("latency:%dms", int64(math.Ceil(anomaly.Expected.High*seconds*1000))))
+		}
+	}
+	return strings.Join(terms, " ")
+}
+
+// list returns the slowest traces of the project matching the filter between start and end
+func (l *traceLookup) list(ctx context.Context, projectID, filter string, start, end time.Time) ([]TraceExemplar, error) {
+	client, err := l.httpClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	params := url.Values{
+		"startTime": {start.UTC().Format(time.RFC3339Nano)},
+		"endTime":   {end.UTC().Format(time.RFC3339Nano)},
+		"orderBy":   {"duration desc"},
+		"pageSize":  {fmt.Sprint(l.config.MaxTraces)},
+		"view":      {"ROOTSPAN"},
+	}
+	if filter != "" {
+		params.Set("filter", filter)
+	}
+	var response struct {
+		Traces []struct {
+			TraceID string `json:"traceId"`
+			Spans   []struct {
+				Name      string    `json:"name"`
+				StartTime time.Time `json:"startTime"`
+				EndTime   time.Time `json:"endTime"`
+			} `json:"spans"`
+		} `json:"traces"`
+	}
+	listURL := fmt.Sprintf("https://cloudtrace.googleapis.com/v1/projects/%s/traces?%s", url.PathEscape(projectID), params.Encode())
+	if err := getJSON(ctx, client, listURL, &response); err != nil {
+		return nil, err
+	}
+	var traces []TraceExemplar
+	for _, trace := range response.Traces {
+		exemplar := TraceExemplar{
+			TraceID: trace.TraceID,
+			URL:     fmt.Sprintf("https://console.cloud.google.com/traces/list?project=%s&tid=%s", url.QueryEscape(projectID), trace.TraceID),
+		}
+		if len(trace.Spans) > 0 {
+			root := trace.Spans[0]
+			exemplar.Name = root.Name
+			exemplar.LatencyMs = float64(root.EndTime.Sub(root.StartTime)) / float64(time.Millisecond)
+		}
+		traces = append(traces, exemplar)
+	}
+	return traces, nil
+}
+
+// httpClient returns the client of the Cloud Trace API, creating it on first use
+func (l *traceLookup) httpClient(ctx context.Context) (*http.Client, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.http != nil {
+		return l.http, nil
+	}
+	opts, err := l.credentials.clientOptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	client, _, err := htransport.NewClient(ctx, append(opts, option.WithScopes(traceReadScope))...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create Cloud Trace client: %v", err)
+	}
+	l.http = client
+	return client, nil
+}
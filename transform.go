@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Functions a transform applies to the scaled values
+const (
+	TransformLog  = "log"  // natural logarithm, for heavy-tailed metrics such as latencies
+	TransformSqrt = "sqrt" // square root, for counts
+)
+
+// TransformConfig maps the values of a metric before they enter its baseline and are scored,
+// so that a heavy-tailed metric is approximately normal and its Z-scores are meaningful. The
+// value v becomes function(v*scale + offset).
+type TransformConfig struct {
+	Function string  `yaml:"function"` // log or sqrt, none if empty
+	Scale    float64 `yaml:"scale"`    // factor the values are multiplied by, defaults to 1
+	Offset   float64 `yaml:"offset"`   // added after scaling, e.g. 1 so that log is defined at 0
+}
+
+// valueTransform is a TransformConfig with its defaults applied. A nil transform leaves values
+// unchanged.
+type valueTransform struct {
+	function      string
+	scale, offset float64
+}
+
+// compileTransforms returns the transforms of the metrics that have one, by metric type
+func compileTransforms(metrics []MetricConfig) (map[string]*valueTransform, error) {
+	compiled := make(map[string]*valueTransform)
+	for _, metric := range metrics {
+		if metric.Transform == nil {
+			continue
+		}
+		config := metric.Transform
+		switch config.Function {
+		case "", TransformLog, TransformSqrt:
+		default:
+			return nil, fmt.Errorf("metric %s: transform: unknown function %q, expected log or sqrt", metric.Type, config.Function)
+		}
+		if config.Scale < 0 {
+			return nil, fmt.Errorf("metric %s: transform: scale must not be negative", metric.Type)
+		}
+		t := &valueTransform{function: config.Function, scale: config.Scale, offset: config.Offset}
+		if t.scale == 0 {
+			t.scale = 1
+		}
+		compiled[metric.Type] = t
+	}
+	return compiled, nil
+}
+
+// apply transforms a value, and returns false for values outside the domain of the function,
+// such as 0 for log without an offset
+func (t *valueTransform) apply(value float64) (float64, bool) {
+	if t == nil {
+		return value, true
+	}
+	value = value*t.scale + t.offset
+	switch t.function {
+	case TransformLog:
+		if value <= 0 {
+			return 0, false
+		}
+		value = math.Log(value)
+	case TransformSqrt:
+		if value < 0 {
+			return 0, false
+		}
+		value = math.Sqrt(value)
+	}
+	return value, true
+}
+
+// invert maps a transformed value back to the unit of the metric
+func (t *valueTransform) invert(value float64) float64 {
+	if t == nil {
+		return value
+	}
+	switch t.function {
+	case TransformLog:
+		value = math.Exp(value)
+	case TransformSqrt:
+		value = math.Max(value, 0)
+		value *= value
+	}
+	return (value - t.offset) / t.scale
+}
+
+// expectedRange returns the range of values within margin of the transformed mean, mapped back
+// to the unit of the metric, with the deviation of value from the mean
+func (t *valueTransform) expectedRange(mean, margin, value float64, unit string) *ExpectedRange {
+	return newExpectedRange(t.invert(mean-margin), t.invert(mean+margin), value, t.invert(mean), unit)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// trendDateLayout is the layout of the UTC date of a day of the history
+const trendDateLayout = "2006-01-02"
+
+// TrendsConfig keeps a daily summary of the statistics and scores of every metric in the store,
+// from which the trends command and the /trends endpoint derive the long-term growth of the
+// metrics for capacity planning, reusing the data the detector already collects
+type TrendsConfig struct {
+	RetentionDays int `yaml:"retention_days"` // days of history kept, defaults to 400
+}
+
+func (c TrendsConfig) validate() error {
+	if c.RetentionDays < 0 {
+		return fmt.Errorf("retention_days must not be negative")
+	}
+	return nil
+}
+
+// TrendDay summarises a metric over the detection cycles of one UTC day
+type TrendDay struct {
+	Date           string  `json:"date"`            // e.g. 2026-10-15
+	Mean           float64 `json:"mean"`            // average of the current means of the cycles
+	StdDev         float64 `json:"stddev"`          // average of the current standard deviations of the cycles
+	BaselineMean   float64 `json:"baseline_mean"`   // baseline mean at the last cycle of the day
+	BaselineStdDev float64 `json:"baseline_stddev"` // baseline standard deviation at the last cycle of the day
+	MeanScore      float64 `json:"mean_score"`      // average absolute peak Z-score of the cycles
+	MaxScore       float64 `json:"max_score"`       // largest absolute peak Z-score of the day
+	Cycles         int     `json:"cycles"`
+}
+
+// TrendHistory is the daily history of a metric, oldest day first
+type TrendHistory struct {
+	Unit string     `json:"unit,omitempty"`
+	Days []TrendDay `json:"days"`
+}
+
+// MetricTrend is the long-term trend of a metric over the days of its history in a period.
+// Growth and changes are least-squares slopes over the daily values; their percentages are
+// relative to the fitted value of the first day, and zero when it is.
+type MetricTrend struct {
+	Metric                       string  `json:"metric"`
+	Unit                         string  `json:"unit,omitempty"`
+	From                         string  `json:"from"`
+	To                           string  `json:"to"`
+	Days                         int     `json:"days"` // days with cycles, trends need at least two
+	Mean                         float64 `json:"mean"` // of the last day
+	GrowthPerDay                 float64 `json:"growth_per_day"`
+	GrowthPercentPer30Days       float64 `json:"growth_percent_per_30_days"`
+	StdDev                       float64 `json:"stddev"` // of the last day
+	StdDevChangePerDay           float64 `json:"stddev_change_per_day"`
+	StdDevChangePercentPer30Days float64 `json:"stddev_change_percent_per_30_days"`
+	MeanScore                    float64 `json:"mean_score"` // average absolute peak Z-score over the period
+	MaxScore                     float64 `json:"max_score"`  // largest absolute peak Z-score over the period
+}
+
+// trendHistory records the daily history of the metrics and saves it to the store. It is
+// recorded within the detection cycle, and read by the /trends endpoint.
+type trendHistory struct {
+	config TrendsConfig
+	store  Store
+
+	mu      sync.Mutex
+	metrics map[string]*TrendHistory // by metric type
+	savedAt time.Time
+}
+
+// newTrendHistory restores the history kept in a durable store
+func newTrendHistory(ctx context.Context, config TrendsConfig, store Store) *trendHistory {
+	if config.RetentionDays == 0 {
+		config.RetentionDays = 400
+	}
+	h := &trendHistory{config: config, store: store, metrics: make(map[string]*TrendHistory)}
+	if store == nil || !store.Durable() {
+		return h
+	}
+	if err := loadState(ctx, store, storeTrendsKey, &h.metrics); err != nil {
+		log.Printf("Could not restore the metric trends: %v", err)
+	}
+	return h
+}
+
+// record folds the current statistics and scores of the metrics of the series of a cycle into
+// the day of now, and saves the history to a durable store hourly and on the first cycle of a
+// day. The caller holds the detector's lock.
+func (h *trendHistory) record(ctx context.Context, d *SimpleAnomalyDetector, series []*monitoringpb.TimeSeries, now time.Time) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	date := now.UTC().Format(trendDateLayout)
+	newDay := false
+	recorded := make(map[string]bool)
+	for _, ts := range series {
+		metricType := ts.Metric.Type
+		stats, ok := d.metricsStats[metricType]
+		if recorded[metricType] || !ok {
+			continue
+		}
+		recorded[metricType] = true
+		history := h.metrics[metricType]
+		if history == nil {
+			history = &TrendHistory{}
+			h.metrics[metricType] = history
+		}
+		history.Unit = ts.Unit
+		if n := len(history.Days); n == 0 || history.Days[n-1].Date != date {
+			history.Days = append(history.Days, TrendDay{Date: date})
+			newDay = true
+		}
+		day := &history.Days[len(history.Days)-1]
+		score := math.Abs(d.scores[metricType].Peak)
+		day.Cycles++
+		n := float64(day.Cycles)
+		day.Mean += (stats.currentMean - day.Mean) / n
+		day.StdDev += (stats.currentStdDev - day.StdDev) / n
+		day.MeanScore += (score - day.MeanScore) / n
+		day.MaxScore = math.Max(day.MaxScore, score)
+		day.BaselineMean = stats.mean
+		day.BaselineStdDev = stats.stddev
+	}
+	oldest := now.UTC().AddDate(0, 0, -h.config.RetentionDays).Format(trendDateLayout)
+	for metricType, history := range h.metrics {
+		kept := 0
+		for kept < len(history.Days) && history.Days[kept].Date < oldest {
+			kept++
+		}
+		history.Days = history.Days[kept:]
+		if len(history.Days) == 0 {
+			delete(h.metrics, metricType)
+		}
+	}
+	save := h.store != nil && h.store.Durable() && (newDay || now.Sub(h.savedAt) >= time.Hour)
+	var data []byte
+	if save {
+		var err error
+		if data, err = json.Marshal(h.metrics); err != nil {
+			log.Printf("Could not encode the metric trends: %v", err)
+			save = false
+		}
+		h.savedAt = now
+	}
+	h.mu.Unlock()
+
+	if save {
+		if err := h.store.Put(ctx, storeTrendsKey, data); err != nil {
+			log.Printf("Could not save the metric trends: %v", err)
+		}
+	}
+}
+
+// Trends returns the trends of the metrics, all when empty, over the days of the period ending
+// at now, sorted by metric type
+func (h *trendHistory) Trends(metrics []string, period time.Duration, now time.Time) []MetricTrend {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return metricTrends(h.metrics, metrics, period, now)
+}
+
+// metricTrends derives the trends of the metrics, all when empty, from their histories
+func metricTrends(histories map[string]*TrendHistory, metrics []string, period time.Duration, now time.Time) []MetricTrend {
+	if len(metrics) == 0 {
+		for metricType := range histories {
+			metrics = append(metrics, metricType)
+		}
+	}
+	sort.Strings(metrics)
+	from := now.UTC().Add(-period).Format(trendDateLayout)
+	trends := make([]MetricTrend, 0, len(metrics))
+	for _, metricType := range metrics {
+		history, ok := histories[metricType]
+		if !ok {
+			continue
+		}
+		var days []TrendDay
+		for _, day := range history.Days {
+			if day.Date >= from {
+				days = append(days, day)
+			}
+		}
+		if len(days) == 0 {
+			continue
+		}
+		trends = append(trends, newMetricTrend(metricType, history.Unit, days))
+	}
+	return trends
+}
+
+// newMetricTrend derives the trend of a metric from its days in the period, oldest first
+func newMetricTrend(metricType, unit string, days []TrendDay) MetricTrend {
+	last := days[len(days)-1]
+	trend := MetricTrend{
+		Metric: metricType,
+		Unit:   unit,
+		From:   days[0].Date,
+		To:     last.Date,
+		Days:   len(days),
+		Mean:   last.Mean,
+		StdDev: last.StdDev,
+	}
+	first, _ := time.Parse(trendDateLayout, days[0].Date)
+	offsets := make([]float64, len(days))
+	means := make([]float64, len(days))
+	stddevs := make([]float64, len(days))
+	cycles := 0
+	for i, day := range days {
+		date, _ := time.Parse(trendDateLayout, day.Date)
+		offsets[i] = date.Sub(first).Hours() / 24
+		means[i] = day.Mean
+		stddevs[i] = day.StdDev
+		trend.MeanScore += day.MeanScore * float64(day.Cycles)
+		trend.MaxScore = math.Max(trend.MaxScore, day.MaxScore)
+		cycles += day.Cycles
+	}
+	if cycles > 0 {
+		trend.MeanScore /= float64(cycles)
+	}
+	if len(days) < 2 {
+		return trend
+	}
+	trend.GrowthPerDay, trend.GrowthPercentPer30Days = dailySlope(offsets, means)
+	trend.StdDevChangePerDay, trend.StdDevChangePercentPer30Days = dailySlope(offsets, stddevs)
+	return trend
+}
+
+// dailySlope fits a line to the values by least squares and returns its slope per day, and the
+// change over 30 days as a percentage of the fitted value at the first offset
+func dailySlope(offsets, values []float64) (float64, float64) {
+	n := float64(len(values))
+	var sumX, sumY, sumXY, sumXX float64
+	for i, x := range offsets {
+		sumX += x
+		sumY += values[i]
+		sumXY += x * values[i]
+		sumXX += x * x
+	}
+	denominator := n*sumXX - sumX*sumX
+	if denominator == 0 {
+		return 0, 0
+	}
+	slope := (n*sumXY - sumX*sumY) / denominator
+	intercept := (sumY - slope*sumX) / n
+	start := intercept + slope*offsets[0]
+	if start == 0 {
+		return slope, 0
+	}
+	return slope, slope * 30 / math.Abs(start) * 100
+}
+
+// registerTrendHandlers adds the trends API to the mux:
+//
+//	GET /trends  returns the trends of the metrics, optionally limited with repeated metric
+//	             parameters and to the last days with ?days=90
+func registerTrendHandlers(mux *http.ServeMux, trends *trendHistory) {
+	mux.HandleFunc("/trends", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", http.MethodGet)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if trends == nil {
+			http.Error(w, "trends are not configured", http.StatusNotFound)
+			return
+		}
+		days := 90
+		if value := r.URL.Query().Get("days"); value != "" {
+			var err error
+			if days, err = strconv.Atoi(value); err != nil || days <= 0 {
+				http.Error(w, fmt.Sprintf("invalid days %q", value), http.StatusBadRequest)
+				return
+			}
+		}
+		writeJSON(w, http.StatusOK, trends.Trends(r.URL.Query()["metric"], time.Duration(days)*24*time.Hour, time.Now()))
+	})
+}
+
+// runTrends prints the long-term trends of the metrics from the history the detector keeps in
+// the store, for capacity planning tools to consume
+func runTrends(args []string) {
+	fs := flag.NewFlagSet("trends", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	metrics := fs.String("metrics", "", "Comma-separated metric types to show (defaults to all with history)")
+	days := fs.Int("days", 90, "Days of history the trends are derived from, ending today")
+	format := fs.String("format", "text", "Output format: text or json")
+	fs.Parse(args)
+
+	if *format != "text" && *format != "json" {
+		log.Fatalf("Unknown format %s, expected text or json", *format)
+	}
+	if *days <= 0 {
+		log.Fatalf("The -days flag must be positive")
+	}
+	config := mustLoadConfig(*configPath)
+	if config.Trends == nil || !config.store.Durable() {
+		log.Fatalf("The trends are read from the history kept by the detector: set trends and a store")
+	}
+	var selected []string
+	if *metrics != "" {
+		selected = strings.Split(*metrics, ",")
+	}
+	histories := make(map[string]*TrendHistory)
+	if err := loadState(context.Background(), config.store, storeTrendsKey, &histories); err != nil {
+		log.Fatalf("Failed to load the metric trends from %s: %v", storeLocation(config.store, storeTrendsKey), err)
+	}
+	trends := metricTrends(histories, selected, time.Duration(*days)*24*time.Hour, time.Now())
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(trends); err != nil {
+			log.Fatalf("Failed to encode trends: %v", err)
+		}
+		return
+	}
+	if len(trends) == 0 {
+		fmt.Println("No history recorded yet.")
+		return
+	}
+	for _, trend := range trends {
+		fmt.Printf("%s: %d days from %s to %s\n", config.displayName(trend.Metric), trend.Days, trend.From, trend.To)
+		fmt.Printf("  mean %s, growth %s per day (%+.1f%% per 30 days)\n", formatValue(trend.Mean, trend.Unit), formatValue(trend.GrowthPerDay, trend.Unit), trend.GrowthPercentPer30Days)
+		fmt.Printf("  stddev %s, change %s per day (%+.1f%% per 30 days)\n", formatValue(trend.StdDev, trend.Unit), formatValue(trend.StdDevChangePerDay, trend.Unit), trend.StdDevChangePercentPer30Days)
+		fmt.Printf("  Z-score mean %.2f, max %.2f\n", trend.MeanScore, trend.MaxScore)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+)
+
+const (
+	ansiClear  = "\033[H\033[2J"
+	ansiReset  = "\033[0m"
+	ansiBold   = "\033[1m"
+	ansiRed    = "\033[31m"
+	ansiYellow = "\033[33m"
+	ansiGreen  = "\033[32m"
+	ansiDim    = "\033[2m"
+
+	// tuiRecentAnomalies is the number of anomalies kept on screen
+	tuiRecentAnomalies = 15
+)
+
+// terminalUI live-renders the statistics and scores of every metric after each cycle. It never
+// notifies, so thresholds can be tuned freely during an incident.
+type terminalUI struct {
+	client   *monitoring.MetricClient
+	config   *Config
+	detector *SimpleAnomalyDetector
+
+	anomalies []Anomaly
+	lastCycle time.Time
+	lastErr   error
+}
+
+// runTerminalUI runs the polling loop with an interactive terminal view
+func runTerminalUI(args []string) {
+	fs := flag.NewFlagSet("tui", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	credentials := addCredentialFlags(fs)
+	logFile := fs.String("log-file", "", "File to write logs to while the UI is running (discarded by default)")
+	fs.Parse(args)
+
+	config := mustLoadConfig(*configPath)
+	config.Credentials.override(*credentials)
+	mustDiscoverWorkloads(config)
+	client, detector := mustStartDetector(config)
+
+	// Logs would scroll the rendered view away
+	log.SetOutput(redactingWriter{io.Discard})
+	if *logFile != "" {
+		file, err := os.OpenFile(*logFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		defer file.Close()
+		log.SetOutput(redactingWriter{file})
+	}
+
+	ui := &terminalUI{client: client, config: config, detector: detector}
+	commands := make(chan string)
+	go readCommands(os.Stdin, commands)
+
+	ui.cycle()
+	pollingInterval := time.Duration(config.PollingTime) * time.Second
+	ticker := time.NewTicker(pollingInterval)
+	for {
+		select {
+		case <-ticker.C:
+			ui.cycle()
+		case command, ok := <-commands:
+			if !ok || command == "q" {
+				fmt.Print(ansiReset)
+				return
+			}
+			ui.handleCommand(command)
+		}
+	}
+}
+
+func readCommands(r io.Reader, commands chan<- string) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		commands <- strings.TrimSpace(scanner.Text())
+	}
+	close(commands)
+}
+
+// handleCommand applies a line typed by the user: a number sets the Z-score threshold and
+// rescans, "r" rescans immediately. Rescans evaluate the whole recent window again.
+func (ui *terminalUI) handleCommand(command string) {
+	switch {
+	case command == "":
+		ui.render()
+	case command == "r":
+		ui.detector.ResetHighWaterMarks()
+		ui.cycle()
+	default:
+		threshold, err := strconv.ParseFloat(command, 64)
+		if err != nil || threshold <= 0 {
+			ui.lastErr = fmt.Errorf("unknown command %q", command)
+			ui.render()
+			return
+		}
+		ui.config.ZScoreThreshold = threshold
+		ui.detector.ResetHighWaterMarks()
+		ui.cycle()
+	}
+}
+
+func (ui *terminalUI) cycle() {
+	anomalies, err := runCycle(ui.client, ui.config, ui.detector, ui.config.MetricTypes())
+	ui.lastCycle = time.Now()
+	ui.lastErr = err
+	if err == nil {
+		ui.anomalies = append(anomalies, ui.anomalies...)
+		if len(ui.anomalies) > tuiRecentAnomalies {
+			ui.anomalies = ui.anomalies[:tuiRecentAnomalies]
+		}
+	}
+	ui.render()
+}
+
+func (ui *terminalUI) render() {
+	var b strings.Builder
+	threshold := ui.config.ZScoreThreshold
+
+	b.WriteString(ansiClear)
+	fmt.Fprintf(&b, "%sgcp-anomaly-detector%s  project %s  threshold %.2f  last cycle %s\n\n",
+		ansiBold, ansiReset, ui.config.ProjectID, threshold, ui.lastCycle.Format(time.Kitchen))
+
+	fmt.Fprintf(&b, "%s%-60s %10s %10s %10s %10s %6s %8s %8s%s\n", ansiBold,
+		"METRIC", "BASE MEAN", "BASE SD", "CUR MEAN", "CUR SD", "PCTL", "LAST Z", "PEAK Z", ansiReset)
+	scores := ui.detector.Scores()
+	insufficient := make(map[string]bool)
+	for _, metric := range ui.detector.InsufficientData() {
+		insufficient[metric] = true
+	}
+	for _, metric := range ui.config.MetricTypes() {
+		stats := ui.detector.Stats(metric)
+		score, scored := scores[metric]
+
+		color := ansiGreen
+		switch {
+		case !scored:
+			color = ansiDim
+		case math.Abs(score.Peak) > threshold:
+			color = ansiRed
+		case math.Abs(score.Peak) > 0.75*threshold:
+			color = ansiYellow
+		}
+
+		latest, peak, percentile := "-", "-", "-"
+		if p, ok := ui.detector.BaselinePercentile(metric, ui.lastCycle); ok && scored {
+			percentile = fmt.Sprintf("%.0f", p)
+		}
+		if scored {
+			latest, peak = fmt.Sprintf("%.2f", score.Latest), fmt.Sprintf("%.2f", score.Peak)
+		}
+		marker := " "
+		if insufficient[metric] {
+			marker = "*"
+		}
+		fmt.Fprintf(&b, "%s%-59s%s %10.2f %10.2f %10.2f %10.2f %6s %8s %8s%s\n", color,
+			truncate(ui.config.displayName(metric), 59), marker, stats.mean, stats.stddev, stats.currentMean, stats.currentStdDev, percentile, latest, peak, ansiReset)
+	}
+	if len(insufficient) > 0 {
+		fmt.Fprintf(&b, "%s* some series not scored for lack of baseline data%s\n", ansiDim, ansiReset)
+	}
+
+	if top := ui.detector.TopSeries(ui.config.TopN); len(top) > 0 {
+		fmt.Fprintf(&b, "\n%sTop series%s\n", ansiBold, ansiReset)
+		for _, score := range top {
+			fmt.Fprintf(&b, "  %8.2f  %s {%s}\n", score.ZScore, truncate(ui.config.displayName(score.MetricName), 60), formatLabels(score.Labels))
+		}
+	}
+
+	fmt.Fprintf(&b, "\n%sRecent anomalies%s\n", ansiBold, ansiReset)
+	if len(ui.anomalies) == 0 {
+		fmt.Fprintf(&b, "%s  none%s\n", ansiDim, ansiReset)
+	}
+	for _, anomaly := range ui.anomalies {
+		fmt.Fprintf(&b, "%s  %s  %s  %s  %s%s\n", ansiRed,
+			anomaly.Timestamp.Format(time.RFC3339), truncate(anomaly.displayName(), 60), anomaly.formattedValue(), anomaly.Message, ansiReset)
+	}
+
+	if ui.lastErr != nil {
+		fmt.Fprintf(&b, "\n%sError: %v%s\n", ansiRed, redactError(ui.lastErr), ansiReset)
+	}
+	fmt.Fprintf(&b, "\n%sEnter a number to set the threshold, r to rescan, q to quit%s\n", ansiDim, ansiReset)
+
+	fmt.Print(b.String())
+}
+
+// truncate shortens s to at most n characters, marking the cut with an ellipsis
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return "…" + s[len(s)-n+1:]
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// thresholdVolume is the alert volume a metric would have produced at a threshold
+type thresholdVolume struct {
+	threshold float64
+	alerts    int
+	perWeek   float64
+}
+
+// runTune replays the baseline window against itself and reports, for every metric, the alerts
+// per week each candidate threshold would have raised, recommending the lowest threshold that
+// keeps within an alert budget
+func runTune(args []string) {
+	fs := flag.NewFlagSet("tune", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	credentials := addCredentialFlags(fs)
+	thresholdList := fs.String("thresholds", "2,2.5,3,3.5,4,4.5,5,6", "Comma-separated candidate Z-score thresholds")
+	budget := fs.Float64("budget", 3, "Alerts per week each metric may raise")
+	step := fs.Duration("step", 0, "Time between simulated polling cycles (defaults to polling_time)")
+	fs.Parse(args)
+
+	thresholds, err := parseThresholds(*thresholdList)
+	if err != nil {
+		log.Fatalf("Invalid -thresholds: %v", err)
+	}
+	if *budget < 0 {
+		log.Fatalf("The -budget flag must not be negative")
+	}
+
+	config := mustLoadConfig(*configPath)
+	config.Credentials.override(*credentials)
+	mustDiscoverWorkloads(config)
+
+	stepInterval := *step
+	if stepInterval == 0 {
+		stepInterval = time.Duration(config.PollingTime) * time.Second
+	}
+	if stepInterval <= 0 {
+		log.Fatalf("A positive -step or polling_time is required")
+	}
+	window := time.Duration(config.RecentDuration) * time.Minute
+
+	// The baseline window is both the baseline and the range replayed, scored at the lowest
+	// candidate so the events of every higher one are among those found
+	startTime, endTime := config.baselineRange(config.now())
+	replay := *config
+	replay.BaselineWindow = &BaselineWindowConfig{Start: startTime.Format(time.RFC3339), End: endTime.Format(time.RFC3339)}
+	replay.ZScoreThreshold = thresholds[0]
+
+	client := mustCreateClient(config.Credentials, config.MonitoringAPI)
+	mustValidateFilters(client, config)
+
+	log.Printf("Replaying the baseline window from %s to %s...\n", startTime.Format(time.RFC3339), endTime.Format(time.RFC3339))
+	anomalies, cycles, err := backtest(client, &replay, startTime, endTime, stepInterval, window)
+	if err != nil {
+		log.Fatalf("Tuning failed: %v", err)
+	}
+	weeks := endTime.Sub(startTime).Hours() / (24 * 7)
+	fmt.Printf("Replayed the baseline window from %s to %s: %d cycles, %.1f weeks\n", startTime.Format(time.RFC3339), endTime.Format(time.RFC3339), cycles, weeks)
+	printTuning(config, anomalies, thresholds, weeks, *budget)
+}
+
+// parseThresholds parses a comma-separated list of positive thresholds, sorted ascending
+func parseThresholds(list string) ([]float64, error) {
+	var thresholds []float64
+	for _, field := range strings.Split(list, ",") {
+		threshold, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, err
+		}
+		if threshold <= 0 {
+			return nil, fmt.Errorf("threshold %g is not positive", threshold)
+		}
+		thresholds = append(thresholds, threshold)
+	}
+	sort.Float64s(thresholds)
+	return thresholds, nil
+}
+
+// tuneVolumes returns the alerts of the anomalies at every threshold: those whose peak reaches it
+func tuneVolumes(anomalies []Anomaly, thresholds []float64, weeks float64) []thresholdVolume {
+	volumes := make([]thresholdVolume, len(thresholds))
+	for i, threshold := range thresholds {
+		volumes[i].threshold = threshold
+		for _, anomaly := range anomalies {
+			if math.Abs(anomaly.ZScore) >= threshold {
+				volumes[i].alerts++
+			}
+		}
+		volumes[i].perWeek = float64(volumes[i].alerts) / weeks
+	}
+	return volumes
+}
+
+// recommendThreshold returns the lowest threshold whose alerts per week keep within the budget,
+// or the highest candidate if none does
+func recommendThreshold(volumes []thresholdVolume, budget float64) (float64, bool) {
+	for _, volume := range volumes {
+		if volume.perWeek <= budget {
+			return volume.threshold, true
+		}
+	}
+	return volumes[len(volumes)-1].threshold, false
+}
+
+// printTuning prints the alert volumes and recommended threshold of every metric, and the
+// z_score_threshold keeping every metric within the budget. Metrics scored by a condition do
+// not use the threshold and are left out.
+func printTuning(config *Config, anomalies []Anomaly, thresholds []float64, weeks, budget float64) {
+	perMetric := make(map[string][]Anomaly)
+	for _, anomaly := range anomalies {
+		perMetric[anomaly.MetricName] = append(perMetric[anomaly.MetricName], anomaly)
+	}
+	overall := thresholds[0]
+	withinBudget := true
+	for _, metric := range config.MetricTypes() {
+		metricConfig, _ := config.MetricConfig(metric)
+		if metricConfig.Condition != "" {
+			fmt.Printf("  %s: scored by its condition, not tuned\n", config.displayName(metric))
+			continue
+		}
+		volumes := tuneVolumes(perMetric[metric], thresholds, weeks)
+		recommended, ok := recommendThreshold(volumes, budget)
+		parts := make([]string, len(volumes))
+		for i, volume := range volumes {
+			parts[i] = fmt.Sprintf("%g: %.1f/week", volume.threshold, volume.perWeek)
+		}
+		verdict := fmt.Sprintf("recommended %g", recommended)
+		if !ok {
+			verdict = fmt.Sprintf("over budget even at %g", recommended)
+			withinBudget = false
+		}
+		fmt.Printf("  %s: %s; %s\n", config.displayName(metric), strings.Join(parts, ", "), verdict)
+		overall = math.Max(overall, recommended)
+	}
+	if !withinBudget {
+		fmt.Printf("Some metrics exceed %g alerts per week at every candidate; try higher -thresholds\n", budget)
+	}
+	fmt.Printf("Recommended z_score_threshold: %g for at most %g alerts per week per metric (currently %g)\n", overall, budget, config.ZScoreThreshold)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// byteMultiples are the factors of the UCUM byte units Cloud Monitoring uses, relative to By
+var byteMultiples = map[string]float64{
+	"By": 1, "kBy": 1e3, "MBy": 1e6, "GBy": 1e9, "TBy": 1e12,
+	"KiBy": 1 << 10, "MiBy": 1 << 20, "GiBy": 1 << 30, "TiBy": 1 << 40,
+	"bit": 1.0 / 8, "kbit": 1e3 / 8, "Mbit": 1e6 / 8, "Gbit": 1e9 / 8,
+}
+
+// secondMultiples are the factors of the UCUM time units, relative to s
+var secondMultiples = map[string]float64{
+	"ns": 1e-9, "us": 1e-6, "ms": 1e-3, "s": 1, "min": 60, "h": 3600, "d": 86400,
+}
+
+// unitAnnotation matches the curly-braced annotations of UCUM units, such as {request}
+var unitAnnotation = regexp.MustCompile(`\{([^}]*)\}`)
+
+// formatValue formats a value in the unit of its metric descriptor, such as "1.20 GiB",
+// "350 ms" or "87%". Values without a unit, or in a unit without special formatting, keep their
+// number followed by the unit.
+func formatValue(value float64, unit string) string {
+	base, per := unit, ""
+	if i := strings.Index(unit, "/"); i > 0 {
+		base, per = unit[:i], unit[i:]
+	}
+
+	switch {
+	case unit == "" || unit == "1":
+		return formatNumber(value)
+	case unit == "%":
+		return formatNumber(value) + "%"
+	case unit == "10^2.%":
+		// A ratio expressed in hundreds of percent, as for utilisations
+		return formatNumber(value*100) + "%"
+	case byteMultiples[base] != 0:
+		return formatBytes(value*byteMultiples[base]) + per
+	case secondMultiples[unit] != 0:
+		return formatSeconds(value * secondMultiples[unit])
+	}
+	return formatNumber(value) + " " + unitAnnotation.ReplaceAllString(unit, "$1")
+}
+
+// formatNumber formats a number with three significant digits at most before the decimal point
+// and two decimals at most
+func formatNumber(value float64) string {
+	switch abs := math.Abs(value); {
+	case abs >= 100 || value == math.Trunc(value):
+		return fmt.Sprintf("%.0f", value)
+	case abs >= 10:
+		return fmt.Sprintf("%.1f", value)
+	}
+	return fmt.Sprintf("%.2f", value)
+}
+
+// formatBytes formats a number of bytes in the largest binary multiple it has at least one of
+func formatBytes(bytes float64) string {
+	for _, multiple := range []struct {
+		suffix string
+		size   float64
+	}{{"TiB", 1 << 40}, {"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}} {
+		if math.Abs(bytes) >= multiple.size {
+			return formatNumber(bytes/multiple.size) + " " + multiple.suffix
+		}
+	}
+	return formatNumber(bytes) + " B"
+}
+
+// formatSeconds formats a duration in seconds in the largest unit it has at least one of
+func formatSeconds(seconds float64) string {
+	for _, multiple := range []struct {
+		suffix string
+		size   float64
+	}{{"h", 3600}, {"min", 60}, {"s", 1}, {"ms", 1e-3}, {"µs", 1e-6}} {
+		if math.Abs(seconds) >= multiple.size {
+			return formatNumber(seconds/multiple.size) + " " + multiple.suffix
+		}
+	}
+	if seconds == 0 {
+		return "0 s"
+	}
+	return formatNumber(seconds/1e-9) + " ns"
+}
+
+// seriesUnit returns the unit of the first of the series, which share a metric
+func seriesUnit(series []*monitoringpb.TimeSeries) string {
+	if len(series) == 0 {
+		return ""
+	}
+	return series[0].Unit
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// monitoringReadScope lets the detector list the uptime checks of the project
+const monitoringReadScope = "https://www.googleapis.com/auth/monitoring.read"
+
+// uptimeCheckLabel is the label the display name of an uptime check is set as on its anomalies
+const uptimeCheckLabel = "check_name"
+
+// resolveUptimeChecks looks up the display names of the project's uptime checks for the uptime
+// preset, so its anomalies name the checks rather than their IDs. Checks created later are named
+// by their ID until the detector restarts.
+func (c *Config) resolveUptimeChecks(ctx context.Context, credentials CredentialsConfig) error {
+	if c.Presets.Uptime == nil {
+		return nil
+	}
+	opts, err := credentials.clientOptions(ctx)
+	if err != nil {
+		return err
+	}
+	client, _, err := htransport.NewClient(ctx, append(opts, option.WithScopes(monitoringReadScope))...)
+	if err != nil {
+		return fmt.Errorf("could not create client: %v", err)
+	}
+	checks, err := listUptimeChecks(ctx, client, c.ProjectID)
+	if err != nil {
+		return err
+	}
+	log.Printf("Resolved the names of %d uptime checks\n", len(checks))
+	c.uptimeChecks = checks
+	return nil
+}
+
+// listUptimeChecks returns the display names of the uptime checks of the project by check ID
+func listUptimeChecks(ctx context.Context, client *http.Client, projectID string) (map[string]string, error) {
+	checks := make(map[string]string)
+	pageToken := ""
+	for {
+		var response struct {
+			UptimeCheckConfigs []struct {
+				Name        string `json:"name"` // projects/<project>/uptimeCheckConfigs/<check ID>
+				DisplayName string `json:"displayName"`
+			} `json:"uptimeCheckConfigs"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		listURL := fmt.Sprintf("https://monitoring.googleapis.com/v3/projects/%s/uptimeCheckConfigs?pageToken=%s", url.PathEscape(projectID), url.QueryEscape(pageToken))
+		if err := getJSON(ctx, client, listURL, &response); err != nil {
+			return nil, err
+		}
+		for _, check := range response.UptimeCheckConfigs {
+			if check.DisplayName != "" {
+				checks[path.Base(check.Name)] = check.DisplayName
+			}
+		}
+		if response.NextPageToken == "" {
+			break
+		}
+		pageToken = response.NextPageToken
+	}
+	return checks, nil
+}
+
+// nameUptimeChecks sets the display name of the uptime check of each anomaly of the uptime
+// preset as its check_name label
+func (c *Config) nameUptimeChecks(anomalies []Anomaly) {
+	for i, anomaly := range anomalies {
+		if anomaly.MetricName != uptimeFailureMetric && anomaly.MetricName != uptimeLatencyMetric {
+			continue
+		}
+		name, ok := c.uptimeChecks[anomaly.Labels["check_id"]]
+		if !ok {
+			continue
+		}
+		labels := make(map[string]string, len(anomaly.Labels)+1)
+		for key, value := range anomaly.Labels {
+			labels[key] = value
+		}
+		labels[uptimeCheckLabel] = name
+		anomalies[i].Labels = labels
+	}
+}
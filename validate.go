@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	monitoring "cloud.google.com/go/monitoring/apiv3/v2"
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// configuredFilter is a monitoring filter from the configuration, with where it is used
+type configuredFilter struct {
+	metric    string // configured metric the filter belongs to
+	use       string // part of the metric the filter selects, e.g. numerator
+	projectID string
+	filter    string // complete filter, including the metric type
+}
+
+// runValidate loads the configuration and checks its permissions and filters against the
+// Monitoring API
+func runValidate(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := fs.String("config", "config.yaml", "Path to the configuration file")
+	credentials := addCredentialFlags(fs)
+	fs.Parse(args)
+
+	config := mustLoadConfig(*configPath)
+	config.Credentials.override(*credentials)
+	mustDiscoverWorkloads(config)
+	client := mustCreateClient(config.Credentials, config.MonitoringAPI)
+	mustValidateFilters(client, config)
+	fmt.Printf("Configuration %s is valid: %d metrics, %d filters checked\n", *configPath, len(config.Metrics), len(config.configuredFilters()))
+}
+
+// mustValidateFilters checks the permissions of the credentials and the filters of the
+// configuration, exiting if a permission is missing or a filter is rejected
+func mustValidateFilters(client *monitoring.MetricClient, config *Config) {
+	if err := checkPermissions(context.Background(), client, config, config.Credentials); err != nil {
+		log.Fatalf("Insufficient permissions: %v", err)
+	}
+	if err := validateFilters(context.Background(), client, config); err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+}
+
+// validateFilters lists a single series header per configured filter, so filter syntax errors
+// are reported with the metric they belong to before detection starts, rather than as the raw
+// error of a failed cycle. Every rejected filter is reported.
+func validateFilters(ctx context.Context, client *monitoring.MetricClient, config *Config) error {
+	filters := config.configuredFilters()
+	if len(filters) == 0 {
+		return nil
+	}
+	log.Printf("Validating %d filters...\n", len(filters))
+
+	endTime := time.Now()
+	var invalid []string
+	for _, f := range filters {
+		it := client.ListTimeSeries(ctx, &monitoringpb.ListTimeSeriesRequest{
+			Name:   "projects/" + f.projectID,
+			Filter: f.filter,
+			Interval: &monitoringpb.TimeInterval{
+				StartTime: timestamppb.New(endTime.Add(-time.Minute)),
+				EndTime:   timestamppb.New(endTime),
+			},
+			View:     monitoringpb.ListTimeSeriesRequest_HEADERS,
+			PageSize: 1,
+		})
+		_, err := it.Next()
+		if err == nil || err == iterator.Done {
+			continue
+		}
+		if status.Code(err) != codes.InvalidArgument {
+			return fmt.Errorf("could not validate filter of metric %s: %v", f.metric, err)
+		}
+		invalid = append(invalid, fmt.Sprintf("metric %s: invalid %s filter %q: %s", f.metric, f.use, f.filter, status.Convert(err).Message()))
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("%d filters rejected by the Monitoring API:\n  %s", len(invalid), strings.Join(invalid, "\n  "))
+	}
+	return nil
+}
+
+// configuredFilters returns the filters of the configured metrics: the metric filters, the terms
+// of derived metrics, canary selectors and reference filters
+func (c *Config) configuredFilters() []configuredFilter {
+	var filters []configuredFilter
+	add := func(metric, use, projectID, metricType, filter string) {
+		if filter != "" {
+			filters = append(filters, configuredFilter{
+				metric:    metric,
+				use:       use,
+				projectID: projectID,
+				filter:    joinFilters(fmt.Sprintf("metric.type=\"%s\"", metricType), filter),
+			})
+		}
+	}
+	for _, metric := range c.Metrics {
+		switch {
+		case metric.Ratio != nil:
+			add(metric.Type, "numerator", c.ProjectID, metric.Ratio.Numerator.Type, metric.Ratio.Numerator.Filter)
+			add(metric.Type, "denominator", c.ProjectID, metric.Ratio.Denominator.Type, metric.Ratio.Denominator.Filter)
+		case metric.Expression != nil:
+			var names []string
+			for name := range metric.Expression.Inputs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				term := metric.Expression.Inputs[name]
+				add(metric.Type, "input "+name, c.ProjectID, term.Type, term.Filter)
+			}
+		default:
+			add(metric.Type, "metric", c.ProjectID, metric.Type, c.Filters[metric.Type])
+			if metric.Canary != nil {
+				add(metric.Type, "canary", c.ProjectID, metric.Type, joinFilters(c.Filters[metric.Type], metric.Canary.Canary))
+				add(metric.Type, "control", c.ProjectID, metric.Type, joinFilters(c.Filters[metric.Type], metric.Canary.Control))
+			}
+		}
+		if metric.Reference != nil {
+			projectID := metric.Reference.ProjectID
+			if projectID == "" {
+				projectID = c.ProjectID
+			}
+			add(metric.Type, "reference", projectID, metric.Type, metric.Reference.Filter)
+		}
+	}
+	return filters
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// webhookMaxWindow is the longest window a webhook scan covers, bounding the range it fetches
+const webhookMaxWindow = 24 * time.Hour
+
+// webhookRequest is the JSON body of POST /webhook
+type webhookRequest struct {
+	Metrics []string `json:"metrics"`
+	Window  string   `json:"window"` // duration of the window to scan, ending now, e.g. 15m; defaults to 15m
+	Since   string   `json:"since"`  // start of the window (RFC3339), e.g. the deployment time; overrides window
+	Source  string   `json:"source"` // who triggered the scan, e.g. the deployment tool, for the logs
+	Notify  bool     `json:"notify"` // also report the anomalies found to the notifiers
+}
+
+// webhookResponse is returned by POST /webhook
+type webhookResponse struct {
+	Metrics   []string      `json:"metrics"`
+	Start     time.Time     `json:"start"`
+	End       time.Time     `json:"end"`
+	Anomalies []interface{} `json:"anomalies"` // in the configured anomaly_schema
+}
+
+// handleWebhook scores a window of the requested metrics against the baseline preceding it, like
+// the check command, and returns the anomalies found once the scan is done. External systems
+// such as deployment tools and incident bots call it to check the metrics they care about.
+func (s *scanServer) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, fmt.Sprintf("invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	metrics, err := scopeMetrics(s.config, req.Metrics)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	endTime := s.config.now()
+	startTime, err := req.start(endTime)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	source := req.Source
+	if source == "" {
+		source = r.RemoteAddr
+	}
+	log.Printf("Webhook scan of %d metrics from %s to %s requested by %s\n", len(metrics), startTime.Format(time.RFC3339), endTime.Format(time.RFC3339), source)
+
+	// The scan has a detector of its own, so it neither waits for nor disturbs the polling cycles
+	config := *s.config
+	if err := config.selectMetrics(metrics); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	window := endTime.Sub(startTime)
+	anomalies, _, err := backtest(s.client, &config, startTime, endTime, window, window)
+	if err != nil {
+		log.Printf("Webhook scan failed: %v", err)
+		http.Error(w, redact(err.Error()), http.StatusBadGateway)
+		return
+	}
+	if req.Notify {
+		s.router.Report(context.Background(), anomalies)
+	}
+
+	if anomalies == nil {
+		anomalies = []Anomaly{}
+	}
+	writeJSON(w, http.StatusOK, webhookResponse{
+		Metrics:   metrics,
+		Start:     startTime,
+		End:       endTime,
+		Anomalies: anomalySchema(s.config.AnomalySchema).payloads(anomalies),
+	})
+}
+
+// start returns the start of the window to scan, which must be before end and at most
+// webhookMaxWindow earlier
+func (req webhookRequest) start(end time.Time) (time.Time, error) {
+	if req.Since != "" {
+		start, err := time.Parse(time.RFC3339, req.Since)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid since: %v", err)
+		}
+		if !end.After(start) {
+			return time.Time{}, fmt.Errorf("the scan window is empty: %s is not in the past", req.Since)
+		}
+		if end.Sub(start) > webhookMaxWindow {
+			return time.Time{}, fmt.Errorf("since must be within %s of now", webhookMaxWindow)
+		}
+		return start, nil
+	}
+
+	window := 15 * time.Minute
+	if req.Window != "" {
+		var err error
+		window, err = time.ParseDuration(req.Window)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid window: %v", err)
+		}
+		if window <= 0 {
+			return time.Time{}, fmt.Errorf("window must be positive")
+		}
+		if window > webhookMaxWindow {
+			return time.Time{}, fmt.Errorf("window must not exceed %s", webhookMaxWindow)
+		}
+	}
+	return end.Add(-window), nil
+}
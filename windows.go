@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	monitoringpb "cloud.google.com/go/monitoring/apiv3/v2/monitoringpb"
+)
+
+// WindowsConfig scores a metric on the means of a fast and a slow window ending at each point
+// instead of point by point: the fast one catches short spikes, the slow one sustained drifts too
+// small for any single point to cross the threshold. A point is anomalous when either window
+// crosses its own threshold, and the anomalous points form one stream of events as usual.
+type WindowsConfig struct {
+	Fast WindowConfig `yaml:"fast"`
+	Slow WindowConfig `yaml:"slow"`
+}
+
+// WindowConfig is one of the windows of a metric
+type WindowConfig struct {
+	Minutes int     `yaml:"minutes"` // length of the window, at most recent_duration
+	ZScore  float64 `yaml:"z_score"` // threshold on the Z-score of the mean of the window, defaults to z_score_threshold
+}
+
+func (c WindowsConfig) validate(recentDuration int) error {
+	if c.Fast.Minutes <= 0 || c.Slow.Minutes <= 0 {
+		return fmt.Errorf("fast and slow minutes must be positive")
+	}
+	if c.Fast.Minutes >= c.Slow.Minutes {
+		return fmt.Errorf("the fast window must be shorter than the slow one")
+	}
+	if c.Slow.Minutes > recentDuration {
+		return fmt.Errorf("the slow window of %d minutes is longer than recent_duration", c.Slow.Minutes)
+	}
+	if c.Fast.ZScore < 0 || c.Slow.ZScore < 0 {
+		return fmt.Errorf("z_score must not be negative")
+	}
+	return nil
+}
+
+// detectionWindows are the compiled windows of a metric
+type detectionWindows struct {
+	fast, slow scoringWindow
+}
+
+// scoringWindow is a window of a metric with its threshold
+type scoringWindow struct {
+	name      string
+	length    time.Duration
+	threshold float64
+}
+
+// compileWindows returns the windows of the metrics that have some, by metric type, with the
+// thresholds they leave unset defaulted to zScoreThreshold
+func compileWindows(metrics []MetricConfig, zScoreThreshold float64) map[string]*detectionWindows {
+	windows := make(map[string]*detectionWindows)
+	for _, metric := range metrics {
+		if metric.Windows == nil {
+			continue
+		}
+		window := func(name string, config WindowConfig) scoringWindow {
+			threshold := config.ZScore
+			if threshold == 0 {
+				threshold = zScoreThreshold
+			}
+			return scoringWindow{name: name, length: time.Duration(config.Minutes) * time.Minute, threshold: threshold}
+		}
+		windows[metric.Type] = &detectionWindows{fast: window("fast", metric.Windows.Fast), slow: window("slow", metric.Windows.Slow)}
+	}
+	return windows
+}
+
+// windowScore is the score of the window ending at a point
+type windowScore struct {
+	window  *scoringWindow
+	mean    float64 // of the raw values in the window
+	zScore  float64 // of the mean of the transformed values in the window
+	covered bool    // whether the points of the series reach back to the start of the window
+}
+
+// breaches reports whether the window crosses its threshold
+func (s windowScore) breaches() bool {
+	return s.covered && math.Abs(s.zScore) > s.window.threshold
+}
+
+// score returns the scores of the fast and the slow window ending at each of the points, which
+// are in time order. Values outside the domain of the transform are left out of the means, and
+// a window reaching back before the oldest point is not covered and never breaches.
+func (w *detectionWindows) score(points []*monitoringpb.Point, transform *valueTransform, baseline func(time.Time) MetricStats, zeroStdDev ZeroStdDevConfig) (fast, slow []windowScore) {
+	fast = w.fast.score(points, transform, baseline, zeroStdDev)
+	slow = w.slow.score(points, transform, baseline, zeroStdDev)
+	return fast, slow
+}
+
+func (w *scoringWindow) score(points []*monitoringpb.Point, transform *valueTransform, baseline func(time.Time) MetricStats, zeroStdDev ZeroStdDevConfig) []windowScore {
+	scores := make([]windowScore, len(points))
+	if len(points) == 0 {
+		return scores
+	}
+	oldest := points[0].Interval.EndTime.AsTime()
+	var raw, transformed float64
+	var count, rawCount int
+	start := 0
+	for i, point := range points {
+		end := point.Interval.EndTime.AsTime()
+		raw += pointValue(point)
+		rawCount++
+		if value, ok := transform.apply(pointValue(point)); ok {
+			transformed += value
+			count++
+		}
+		// The window is (end - length, end]
+		for !points[start].Interval.EndTime.AsTime().After(end.Add(-w.length)) {
+			raw -= pointValue(points[start])
+			rawCount--
+			if value, ok := transform.apply(pointValue(points[start])); ok {
+				transformed -= value
+				count--
+			}
+			start++
+		}
+		scores[i] = windowScore{window: w, mean: raw / float64(rawCount), covered: !oldest.After(end.Add(-w.length))}
+		if count > 0 {
+			scores[i].zScore = zeroStdDev.zScore(transformed/float64(count), baseline(end), w.threshold)
+		}
+	}
+	return scores
+}
+
+// breaching returns the score of the window of a point to report it by: the fast window if it
+// breaches, the slow one if it does, otherwise the one closer to its threshold
+func breaching(fast, slow windowScore) windowScore {
+	switch {
+	case fast.breaches():
+		return fast
+	case slow.breaches():
+		return slow
+	case math.Abs(fast.zScore)/fast.window.threshold >= math.Abs(slow.zScore)/slow.window.threshold:
+		return fast
+	}
+	return slow
+}
+
+// describe words the window, such as "fast 5m window"
+func (w *scoringWindow) describe() string {
+	length := fmt.Sprintf("%dm", int(w.length/time.Minute))
+	if w.length%time.Hour == 0 {
+		length = fmt.Sprintf("%dh", int(w.length/time.Hour))
+	}
+	return fmt.Sprintf("%s %s window", w.name, length)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Modes of scoring points against a baseline without variance
+const (
+	ZeroStdDevAny   = "any"   // any deviation from the mean is anomalous
+	ZeroStdDevDelta = "delta" // deviations larger than an absolute delta are anomalous
+	ZeroStdDevFloor = "floor" // the stddev is raised to a minimum before scoring
+)
+
+// maxZScore is the Z-score of a deviation from a baseline without variance in any mode. It
+// stands in for an infinite Z-score, which cannot be encoded in JSON payloads.
+const maxZScore = 1e6
+
+// ZeroStdDevConfig sets how points are scored when the baseline StdDev is 0, as for a series
+// constant throughout the baseline window, where the Z-score is undefined
+type ZeroStdDevConfig struct {
+	Mode  string  `yaml:"mode"`  // any, delta or floor, defaults to any
+	Delta float64 `yaml:"delta"` // absolute deviation from the mean above which points are anomalous in delta mode
+	Floor float64 `yaml:"floor"` // minimum stddev in floor mode, applied to every baseline below it
+}
+
+func (c ZeroStdDevConfig) validate() error {
+	switch c.Mode {
+	case "", ZeroStdDevAny:
+	case ZeroStdDevDelta:
+		if c.Delta <= 0 {
+			return fmt.Errorf("delta mode requires a positive delta")
+		}
+	case ZeroStdDevFloor:
+		if c.Floor <= 0 {
+			return fmt.Errorf("floor mode requires a positive floor")
+		}
+	default:
+		return fmt.Errorf("unknown mode %q, expected any, delta or floor", c.Mode)
+	}
+	return nil
+}
+
+// margin returns how far from the mean a value may lie before its Z-score exceeds the threshold
+func (c ZeroStdDevConfig) margin(stats MetricStats, threshold float64) float64 {
+	stddev := stats.stddev
+	if c.Mode == ZeroStdDevFloor && stddev < c.Floor {
+		stddev = c.Floor
+	}
+	if stddev > 0 {
+		return threshold * stddev
+	}
+	if c.Mode == ZeroStdDevDelta {
+		return c.Delta
+	}
+	return 0
+}
+
+// zScore scores a value against the baseline. In delta mode the deviation is scaled so that
+// it exceeds the threshold exactly when it exceeds the delta.
+func (c ZeroStdDevConfig) zScore(value float64, stats MetricStats, threshold float64) float64 {
+	deviation := value - stats.mean
+	stddev := stats.stddev
+	if c.Mode == ZeroStdDevFloor && stddev < c.Floor {
+		stddev = c.Floor
+	}
+	if stddev > 0 {
+		return deviation / stddev
+	}
+
+	if c.Mode == ZeroStdDevDelta {
+		return deviation / c.Delta * threshold
+	}
+	if deviation == 0 {
+		return 0
+	}
+	return math.Copysign(maxZScore, deviation)
+}